@@ -0,0 +1,120 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"zombiezen.com/go/nix"
+)
+
+// AddOptions is the set of optional parameters to [AddPath].
+type AddOptions struct {
+	// Name is the name of the store object.
+	// If empty, the base name of the path is used.
+	Name string
+	// Flat is whether to content-address a regular file by its contents
+	// rather than by its NAR serialization.
+	Flat bool
+	// ExpectedHash is the hash that the content must have.
+	// If it is the zero hash, the content is hashed with SHA-256
+	// and not verified.
+	ExpectedHash nix.Hash
+	// AutoOptimise is whether to hard-link the new store object's files
+	// to identical files already in the store.
+	AutoOptimise bool
+	// StoreRoot is the directory that holds the store
+	// in place of the file system root (see [Eval.SetStoreRoot]).
+	StoreRoot string
+	// LowerStoreRoot and UpperLayer make the store an overlay store
+	// (see [Eval.SetLowerStore]).
+	LowerStoreRoot string
+	UpperLayer     string
+}
+
+// AddPath copies the file or directory at path into the store
+// as a fixed content-addressed store object and returns its store path.
+// The content is hashed while it is streamed into the store:
+// if it does not match opts.ExpectedHash,
+// the import is aborted before the store object is registered.
+func AddPath(ctx context.Context, dir nix.StoreDirectory, path string, opts *AddOptions) (nix.StorePath, error) {
+	if opts == nil {
+		opts = new(AddOptions)
+	}
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	htype := nix.SHA256
+	if !opts.ExpectedHash.IsZero() {
+		htype = opts.ExpectedHash.Type()
+	}
+
+	var f *os.File
+	var info fs.FileInfo
+	if opts.Flat {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("add %s: %v", path, err)
+		}
+		defer f.Close()
+		info, err = f.Stat()
+		if err != nil {
+			return "", fmt.Errorf("add %s: %v", path, err)
+		}
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("add %s: flat hashing requires a regular file", path)
+		}
+	}
+
+	imp, err := startImport(ctx, storeOptions{
+		dir:          dir,
+		root:         opts.StoreRoot,
+		lowerRoot:    opts.LowerStoreRoot,
+		upperLayer:   opts.UpperLayer,
+		autoOptimise: opts.AutoOptimise,
+	})
+	if err != nil {
+		return "", fmt.Errorf("add %s: %v", path, err)
+	}
+	defer imp.Close()
+	h := nix.NewHasher(htype)
+	if opts.Flat {
+		err = writeSingleFileNARMode(imp, io.TeeReader(f, h), info.Size(), canonicalMode(info.Mode()))
+	} else {
+		err = dumpPathParallel(ctx, io.MultiWriter(imp, h), path, new(parallelDumpOptions))
+	}
+	if err != nil {
+		imp.Abort()
+		return "", fmt.Errorf("add %s: %v", path, err)
+	}
+	sum := h.SumHash()
+	if !opts.ExpectedHash.IsZero() && !sum.Equal(opts.ExpectedHash) {
+		imp.Abort()
+		return "", fmt.Errorf("add %s: hash mismatch: got %v (expected %v)", path, sum, opts.ExpectedHash)
+	}
+
+	ca := nix.RecursiveFileContentAddress(sum)
+	if opts.Flat {
+		ca = nix.FlatFileContentAddress(sum)
+	}
+	storePath, err := fixedCAOutputPath(dir, name, ca, storeReferences{})
+	if err != nil {
+		imp.Abort()
+		return "", fmt.Errorf("add %s: %v", path, err)
+	}
+	if err := imp.Trailer(&nixExportTrailer{storePath: storePath}); err != nil {
+		return "", fmt.Errorf("add %s: %v", path, err)
+	}
+	if err := imp.Close(); err != nil {
+		return "", fmt.Errorf("add %s: %v", path, err)
+	}
+	return storePath, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// assertUnsetVar is the name of the derivation environment variable
+// that lists variables that must not be set in the builder's environment.
+const assertUnsetVar = "assertUnset"
+
+// Always-set builder environment variable values.
+const (
+	// BuilderHome is the value of HOME given to builders.
+	// It names a directory that does not exist
+	// so that builds cannot depend on the user's home directory.
+	BuilderHome = "/homeless-shelter"
+	// DefaultBuilderPath is the value of PATH given to builders
+	// whose derivations do not set PATH
+	// when the [BuilderEnvPolicy] does not specify one.
+	DefaultBuilderPath = "/path-not-set"
+)
+
+// BuilderEnvPolicy is the baseline environment given to builders.
+// The zero value gives builders only the always-set variables:
+//
+//   - HOME is [BuilderHome].
+//   - PATH is [DefaultBuilderPath] or [BuilderEnvPolicy.Path].
+//   - NIX_BUILD_TOP, TMPDIR, TEMPDIR, TMP, and TEMP are the build directory.
+//   - NIX_STORE is the store directory.
+//   - NIX_BUILD_CORES is the number of CPU cores the builder may use.
+//   - NIX_LOG_FD is 2.
+//   - TERM is xterm-256color.
+//
+// The derivation's own environment is applied last,
+// so a derivation can override any of these.
+type BuilderEnvPolicy struct {
+	// Baseline is a set of variables given to every builder
+	// in addition to the always-set variables.
+	Baseline map[string]string
+	// Path is the PATH given to builders whose derivations do not set PATH.
+	// If empty, [DefaultBuilderPath] is used.
+	Path string
+}
+
+// Environ returns the environment for running drv's builder
+// in the directory buildDir with the given number of cores.
+// Environ returns an error if the derivation lists a variable in its assertUnset attribute
+// that would be set.
+func (policy *BuilderEnvPolicy) Environ(drv *Derivation, buildDir string, cores int) (map[string]string, error) {
+	env := map[string]string{
+		"HOME":            BuilderHome,
+		"PATH":            DefaultBuilderPath,
+		"NIX_STORE":       string(drv.Dir),
+		"NIX_BUILD_CORES": strconv.Itoa(cores),
+		"NIX_LOG_FD":      "2",
+		"TERM":            "xterm-256color",
+	}
+	for _, k := range []string{"NIX_BUILD_TOP", "TMPDIR", "TEMPDIR", "TMP", "TEMP"} {
+		env[k] = buildDir
+	}
+	if policy != nil {
+		if policy.Path != "" {
+			env["PATH"] = policy.Path
+		}
+		for k, v := range policy.Baseline {
+			env[k] = v
+		}
+	}
+	for k, v := range drv.Env {
+		env[k] = v
+	}
+
+	for _, k := range strings.Fields(drv.Env[assertUnsetVar]) {
+		if _, set := env[k]; set {
+			return nil, fmt.Errorf("%s: %s must not be set in the builder environment", drv.Name, k)
+		}
+	}
+	return env, nil
+}
+
+// checkAssertUnset returns an error if the derivation sets a variable
+// that it lists in its assertUnset attribute.
+func checkAssertUnset(drv *Derivation) error {
+	for _, k := range strings.Fields(drv.Env[assertUnsetVar]) {
+		if _, set := drv.Env[k]; set {
+			return fmt.Errorf("%s sets %s, which it asserts is unset", drv.Name, k)
+		}
+	}
+	return nil
+}
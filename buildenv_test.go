@@ -0,0 +1,107 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestBuilderEnvPolicy(t *testing.T) {
+	const buildDir = "/build"
+	alwaysSet := func(extra map[string]string) map[string]string {
+		m := map[string]string{
+			"HOME":            BuilderHome,
+			"PATH":            DefaultBuilderPath,
+			"NIX_STORE":       "/nix/store",
+			"NIX_BUILD_CORES": "4",
+			"NIX_LOG_FD":      "2",
+			"TERM":            "xterm-256color",
+			"NIX_BUILD_TOP":   buildDir,
+			"TMPDIR":          buildDir,
+			"TEMPDIR":         buildDir,
+			"TMP":             buildDir,
+			"TEMP":            buildDir,
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		policy  *BuilderEnvPolicy
+		env     map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "Empty",
+			env:  map[string]string{"out": "/out"},
+			want: alwaysSet(map[string]string{"out": "/out"}),
+		},
+		{
+			name: "Baseline",
+			policy: &BuilderEnvPolicy{
+				Baseline: map[string]string{"LANG": "C.UTF-8", "out": "/bad"},
+				Path:     "/bin",
+			},
+			env: map[string]string{"out": "/out"},
+			want: alwaysSet(map[string]string{
+				"LANG": "C.UTF-8",
+				"PATH": "/bin",
+				"out":  "/out",
+			}),
+		},
+		{
+			name: "AssertUnsetOK",
+			env: map[string]string{
+				"assertUnset": "SSL_CERT_FILE",
+			},
+			want: alwaysSet(map[string]string{"assertUnset": "SSL_CERT_FILE"}),
+		},
+		{
+			name: "AssertUnsetBaseline",
+			policy: &BuilderEnvPolicy{
+				Baseline: map[string]string{"SSL_CERT_FILE": "/etc/ssl/certs/ca-bundle.crt"},
+			},
+			env: map[string]string{
+				"assertUnset": "LANG SSL_CERT_FILE",
+			},
+			wantErr: true,
+		},
+		{
+			name: "AssertUnsetAlwaysSet",
+			env: map[string]string{
+				"assertUnset": "HOME",
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drv := &Derivation{
+				Dir:  nix.DefaultStoreDirectory,
+				Name: "test",
+				Env:  test.env,
+			}
+			got, err := test.policy.Environ(drv, buildDir, 4)
+			if err != nil {
+				if !test.wantErr {
+					t.Error("Unexpected error:", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("Environ(...) = %v; want error", got)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Environ(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,913 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type buildOptions struct {
+	evalOptions
+	outLink           string
+	dryRun            bool
+	provenanceKeyFile string
+	watch             bool
+	progress          string
+	failedBuildTTL    time.Duration
+	retryFailed       bool
+	rebuild           bool
+	fallback          bool
+}
+
+func newBuildCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "build [options] [INSTALLABLE [...]]",
+		Short:                 "build one or more derivations",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.Long = "Build the derivations that the installables evaluate to. " +
+		"Without --expr or --file, each installable is instead a store path to realise, " +
+		"optionally followed by ! and a comma-separated list of the derivation's outputs to build " +
+		"(for example, /nix/store/...-hello.drv!out,doc). " +
+		"Before building, zb checks that the configured substituters respond: " +
+		"a substituter that fails is skipped for a while, " +
+		"for longer after each consecutive failure."
+	opts := new(buildOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVarP(&opts.outLink, "out-link", "o", "result", "change the name of the output path symlink to `path`")
+	noOutLink := c.Flags().Bool("no-out-link", false, "do not create symlinks to the outputs")
+	c.Flags().BoolVar(&opts.dryRun, "dry-run", false, "show what would be built or downloaded without doing so")
+	c.Flags().StringVar(&opts.provenanceKeyFile, "sign-provenance", "", "record SLSA provenance for built outputs, signed with the secret key in `file`")
+	c.Flags().BoolVar(&opts.watch, "watch", false, "rebuild whenever the source files read during evaluation change")
+	c.Flags().DurationVar(&opts.failedBuildTTL, "failed-build-ttl", g.failedBuildTTL, "remember derivations that fail to build for `duration` and fail immediately if they are built again (0 to not remember failures)")
+	c.Flags().BoolVar(&opts.rebuild, "rebuild", false, "build the requested derivations again even if their outputs exist (dependencies are not rebuilt)")
+	c.Flags().BoolVar(&opts.retryFailed, "retry-failed", false, "build derivations even if they recently failed to build")
+	c.Flags().BoolVar(&opts.fallback, "fallback", g.fallback, "build derivations locally if downloading their outputs from a substituter fails")
+	c.Flags().StringVar(&opts.progress, "progress", progressPlain, "how to show build progress: `mode` is plain (raw logs) or tui (a status display of running builds that only shows logs of failed builds)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		if *noOutLink {
+			opts.outLink = ""
+		}
+		if opts.progress != progressPlain && opts.progress != progressTUI {
+			return fmt.Errorf("--progress must be one of %s or %s (got %q)", progressPlain, progressTUI, opts.progress)
+		}
+		if opts.failedBuildTTL < 0 {
+			return fmt.Errorf("--failed-build-ttl must not be negative")
+		}
+		return runBuild(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runBuild(ctx context.Context, g *globalConfig, opts *buildOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	if opts.watch {
+		return watchBuild(ctx, g, opts, eval)
+	}
+	return build(ctx, g, opts, eval)
+}
+
+// build evaluates and builds the derivations described by opts.
+func build(ctx context.Context, g *globalConfig, opts *buildOptions, eval *zb.Eval) error {
+	if opts.expr == "" && opts.file == "" {
+		return buildDerivedPaths(ctx, g, opts, eval)
+	}
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("no evaluation results")
+	}
+
+	drvs := make([]*zb.Derivation, 0, len(results))
+	drvPaths := make([]nix.StorePath, 0, len(results))
+	for _, result := range results {
+		result, err := selectSystem(result, g.system)
+		if err != nil {
+			return err
+		}
+		drv, _ := result.(*zb.Derivation)
+		if drv == nil {
+			return fmt.Errorf("%v is not a derivation", result)
+		}
+		p, err := drv.StorePath()
+		if err != nil {
+			return err
+		}
+		drvs = append(drvs, drv)
+		drvPaths = append(drvPaths, p)
+	}
+
+	store := g.realisingStore(ctx)
+	store.Fallback = opts.fallback
+	if opts.dryRun {
+		return printDryRun(ctx, store, drvPaths)
+	}
+	var provenanceKey *nix.PrivateKey
+	if opts.provenanceKeyFile != "" {
+		provenanceKey, err = readSecretKeyFile(opts.provenanceKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		log.Warnf(ctx, "Realizations unavailable: %v", err)
+		db = nil
+	} else {
+		defer db.Close()
+	}
+
+	// Derivations whose outputs have all been realized before
+	// and are still present don't need to go through the builder.
+	allOutputs := make([]map[string]nix.StorePath, len(drvPaths))
+	var toBuild []nix.StorePath
+	var toBuildIndices []int
+	for i, drv := range drvs {
+		if opts.rebuild {
+			toBuild = append(toBuild, drvPaths[i])
+			toBuildIndices = append(toBuildIndices, i)
+			continue
+		}
+		outputs, err := lookupRealizations(ctx, g, store, db, drv)
+		if err != nil {
+			return err
+		}
+		if outputs != nil {
+			log.Debugf(ctx, "Using recorded realizations for %s", drvPaths[i])
+			allOutputs[i] = outputs
+			continue
+		}
+		toBuild = append(toBuild, drvPaths[i])
+		toBuildIndices = append(toBuildIndices, i)
+	}
+	built := make([]bool, len(drvPaths))
+	var buildStart, buildEnd time.Time
+	if len(toBuild) > 0 {
+		var willBuild []nix.StorePath
+		if opts.failedBuildTTL > 0 && db != nil {
+			willBuild, err = checkBuildFailures(ctx, store, db, toBuild, opts)
+			if err != nil {
+				return err
+			}
+			store.BuildFailed = func(f *zbstore.BuildFailure) {
+				if err := db.RecordBuildFailure(ctx, f); err != nil {
+					log.Warnf(ctx, "Recording build failure: %v", err)
+				}
+			}
+		}
+		skipUnhealthySubstituters(ctx, g, store, db)
+		if opts.progress == progressTUI && store.Socket == "" && isTerminal(os.Stderr) {
+			display := newProgressDisplay(os.Stderr)
+			defer display.Close()
+			store.Progress = display.event
+		}
+		buildStart = time.Now()
+		realise := store.Realise
+		if opts.rebuild {
+			realise = store.Rebuild
+		}
+		outPaths, err := realise(ctx, toBuild...)
+		if err != nil {
+			return err
+		}
+		buildEnd = time.Now()
+		toBuildDrvs := make([]*zb.Derivation, 0, len(toBuildIndices))
+		for _, i := range toBuildIndices {
+			toBuildDrvs = append(toBuildDrvs, drvs[i])
+		}
+		builtOutputs, err := splitRealisedOutputs(toBuild, toBuildDrvs, outPaths)
+		if err != nil {
+			return err
+		}
+		for j, i := range toBuildIndices {
+			allOutputs[i] = builtOutputs[j]
+			built[i] = true
+		}
+		if len(willBuild) > 0 {
+			if err := db.ForgetBuildFailures(ctx, willBuild...); err != nil {
+				log.Warnf(ctx, "Forgetting build failures: %v", err)
+			}
+		}
+	}
+	for i, drvPath := range drvPaths {
+		outputs := allOutputs[i]
+		if built[i] {
+			// Check closure sizes before the outputs are recorded
+			// or any roots are created.
+			// The size can only be known after the build,
+			// so remove outputs that exceed the limit
+			// rather than leave them in the store for later builds to reuse.
+			if err := checkClosureSize(drvPath, drvs[i], outputs, storeClosureSize(ctx, store)); err != nil {
+				if err := store.Delete(ctx, sortedOutputPaths(outputs)...); err != nil {
+					log.Warnf(ctx, "Removing oversize outputs of %s: %v", drvPath, err)
+				}
+				return err
+			}
+			if err := recordRealizations(ctx, store, db, drvs[i], drvPath, outputs); err != nil {
+				log.Warnf(ctx, "Recording realizations: %v", err)
+			}
+			if err := recordMeta(ctx, db, drvs[i], drvPath); err != nil {
+				log.Warnf(ctx, "Recording metadata: %v", err)
+			}
+			if provenanceKey != nil {
+				err := recordProvenance(ctx, store, db, provenanceKey, drvs[i], drvPath, outputs, buildStart, buildEnd)
+				if err != nil {
+					return fmt.Errorf("provenance for %s: %v", drvPath, err)
+				}
+			}
+		} else if err := checkClosureSize(drvPath, drvs[i], outputs, storeClosureSize(ctx, store)); err != nil {
+			return err
+		}
+	}
+
+	used := slices.Clone(drvPaths)
+	for i, outputs := range allOutputs {
+		for _, outName := range sortedOutputNames(outputs) {
+			outPath := outputs[outName]
+			used = append(used, outPath)
+			if opts.outLink != "" {
+				link := outLinkName(opts.outLink, i, outName)
+				if err := store.AddRoot(ctx, link, outPath); err != nil {
+					return err
+				}
+			}
+			fmt.Println(outPath)
+		}
+	}
+	g.recordAccess(ctx, used...)
+	return nil
+}
+
+// buildDerivedPaths realises installables given as store paths
+// (see [zbstore.ParseDerivedPath]) without evaluating anything.
+func buildDerivedPaths(ctx context.Context, g *globalConfig, opts *buildOptions, eval *zb.Eval) error {
+	switch {
+	case len(opts.installables) == 0:
+		return fmt.Errorf("no installables given (use --expr or --file to evaluate Lua)")
+	case opts.watch:
+		return fmt.Errorf("--watch requires --expr or --file")
+	case opts.rebuild:
+		return fmt.Errorf("--rebuild requires --expr or --file")
+	case opts.provenanceKeyFile != "":
+		return fmt.Errorf("--sign-provenance requires --expr or --file")
+	}
+	paths := make([]zbstore.DerivedPath, 0, len(opts.installables))
+	for _, arg := range opts.installables {
+		p, err := zbstore.ParseDerivedPath(arg)
+		if err != nil {
+			return fmt.Errorf("%v (use --expr or --file to evaluate Lua)", err)
+		}
+		paths = append(paths, p)
+	}
+
+	store := g.realisingStore(ctx)
+	store.Fallback = opts.fallback
+	if opts.dryRun {
+		storePaths := make([]nix.StorePath, 0, len(paths))
+		for _, p := range paths {
+			storePaths = append(storePaths, p.Path)
+		}
+		return printDryRun(ctx, store, storePaths)
+	}
+	if db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath()); err != nil {
+		log.Debugf(ctx, "Substituter failures will not be remembered: %v", err)
+		skipUnhealthySubstituters(ctx, g, store, nil)
+	} else {
+		skipUnhealthySubstituters(ctx, g, store, db)
+		db.Close()
+	}
+	if opts.progress == progressTUI && store.Socket == "" && isTerminal(os.Stderr) {
+		display := newProgressDisplay(os.Stderr)
+		defer display.Close()
+		store.Progress = display.event
+	}
+	// The derivations were not evaluated in this process,
+	// so fetchurl outputs that need a registered fetcher
+	// must be fetched before the backend tries to build them.
+	readDerivation := storeDerivationReader(store)
+	for _, p := range paths {
+		if !p.Path.IsDerivation() {
+			continue
+		}
+		if err := eval.PrefetchClosure(ctx, p.Path, readDerivation); err != nil {
+			return err
+		}
+	}
+	var used []nix.StorePath
+	for i, p := range paths {
+		outPaths, err := store.RealisePaths(ctx, p)
+		if err != nil {
+			return err
+		}
+		for _, outPath := range outPaths {
+			used = append(used, outPath)
+			if opts.outLink != "" {
+				outName := "out"
+				if p.Path.IsDerivation() {
+					outName, _ = zbstore.OutputName(p.Path, outPath)
+				}
+				if err := store.AddRoot(ctx, outLinkName(opts.outLink, i, outName), outPath); err != nil {
+					return err
+				}
+			}
+			fmt.Println(outPath)
+		}
+	}
+	g.recordAccess(ctx, used...)
+	return nil
+}
+
+// substituterProbeTimeout is how long to wait for a substituter to respond
+// before skipping it.
+const substituterProbeTimeout = 5 * time.Second
+
+// skipUnhealthySubstituters removes the substituters from store
+// that have failed recently or that do not respond now,
+// so that an unreachable cache does not stall the build.
+// A substituter that fails is skipped for a time
+// that grows with each consecutive failure.
+// db may be nil, in which case failures are not remembered across runs.
+func skipUnhealthySubstituters(ctx context.Context, g *globalConfig, store *zbstore.Store, db *zbstore.DB) {
+	if store.Socket != "" || store.NoSubstitutes {
+		// The daemon uses its own substituters.
+		return
+	}
+	urls := slices.Concat(store.Substituters, store.ExtraSubstituters)
+	if len(urls) == 0 {
+		return
+	}
+	client, err := g.cacheAuth(ctx).Client()
+	if err != nil {
+		log.Debugf(ctx, "Checking substituters: %v", err)
+		return
+	}
+
+	now := time.Now()
+	probeErrors := make([]error, len(urls))
+	skip := make([]bool, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		if db != nil {
+			if f, err := db.SubstituterFailure(ctx, u); err == nil && f.Disabled(now) {
+				log.Debugf(ctx, "Skipping substituter %s until %v: %s", u, f.DisabledUntil.Format(time.TimeOnly), f.Message)
+				skip[i] = true
+				continue
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, substituterProbeTimeout)
+			defer cancel()
+			sub := &zbstore.Substituter{URL: u, Client: client}
+			_, probeErrors[i] = sub.CacheInfo(ctx)
+		}()
+	}
+	wg.Wait()
+
+	healthy := make(map[string]struct{})
+	for i, u := range urls {
+		switch {
+		case skip[i]:
+		case probeErrors[i] == nil:
+			healthy[u] = struct{}{}
+			if db != nil {
+				if err := db.RecordSubstituterSuccess(ctx, u); err != nil {
+					log.Debugf(ctx, "%v", err)
+				}
+			}
+		case db != nil:
+			f, err := db.RecordSubstituterFailure(ctx, u, probeErrors[i], now)
+			if err != nil {
+				log.Debugf(ctx, "%v", err)
+				log.Warnf(ctx, "Skipping substituter: %v", probeErrors[i])
+				continue
+			}
+			log.Warnf(ctx, "Skipping substituter until %v: %v", f.DisabledUntil.Format(time.TimeOnly), probeErrors[i])
+		default:
+			log.Warnf(ctx, "Skipping substituter: %v", probeErrors[i])
+		}
+	}
+	if len(healthy) == len(urls) {
+		return
+	}
+	unhealthy := func(u string) bool {
+		_, ok := healthy[u]
+		return !ok
+	}
+	hadSubstituters := len(store.Substituters) > 0
+	store.Substituters = slices.DeleteFunc(slices.Clone(store.Substituters), unhealthy)
+	store.ExtraSubstituters = slices.DeleteFunc(slices.Clone(store.ExtraSubstituters), unhealthy)
+	if hadSubstituters && len(store.Substituters) == 0 {
+		// An empty list would mean the backend's default substituters.
+		store.Substituters, store.ExtraSubstituters = store.ExtraSubstituters, nil
+		store.NoSubstitutes = len(store.Substituters) == 0
+	}
+}
+
+// checkBuildFailures returns an error if any of the derivations
+// that need to be built to realize drvPaths
+// failed to build within opts.failedBuildTTL,
+// unless opts.retryFailed is set.
+// It returns the derivations that will be built.
+func checkBuildFailures(ctx context.Context, store *zbstore.Store, db *zbstore.DB, drvPaths []nix.StorePath, opts *buildOptions) ([]nix.StorePath, error) {
+	missing, err := store.QueryMissing(ctx, drvPaths...)
+	if err != nil {
+		log.Warnf(ctx, "Checking for recent build failures: %v", err)
+		return nil, nil
+	}
+	if opts.retryFailed {
+		return missing.WillBuild, nil
+	}
+	now := time.Now()
+	for _, drvPath := range missing.WillBuild {
+		f, err := db.BuildFailure(ctx, drvPath)
+		if errors.Is(err, zbstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if age := now.Sub(f.Time); age < opts.failedBuildTTL {
+			return nil, fmt.Errorf("%s failed to build %v ago (run with --retry-failed to build again; see nix-store --read-log %s):\n%s",
+				drvPath, age.Round(time.Second), drvPath, f.Message)
+		}
+	}
+	return missing.WillBuild, nil
+}
+
+// lookupRealizations returns the recorded output paths of drv
+// if every one of its outputs has been realized before
+// and is still present in the store
+// (or, with ipfs-substitution, can be downloaded from IPFS).
+// Realizations are looked up by the derivation's hash
+// and then by the hash of the derivation
+// resolved against the realizations of its inputs,
+// so that changing a dependency in a way that produces identical output
+// does not cause drv to be rebuilt.
+// Otherwise, lookupRealizations returns a nil map.
+// db may be nil, in which case nothing has been recorded.
+func lookupRealizations(ctx context.Context, g *globalConfig, store *zbstore.Store, db *zbstore.DB, drv *zb.Derivation) (map[string]nix.StorePath, error) {
+	if db == nil {
+		return nil, nil
+	}
+	drvHash, err := drv.Hash()
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := lookupRealizationsByHash(ctx, g, store, db, drv, drvHash)
+	if outputs != nil || err != nil {
+		return outputs, err
+	}
+	resolvedHash, ok := resolvedDerivationHash(ctx, store, db, drv)
+	if !ok || resolvedHash.Equal(drvHash) {
+		return nil, nil
+	}
+	outputs, err = lookupRealizationsByHash(ctx, g, store, db, drv, resolvedHash)
+	if outputs != nil {
+		log.Debugf(ctx, "Using realizations of resolved %s derivation", drv.Name)
+	}
+	return outputs, err
+}
+
+func lookupRealizationsByHash(ctx context.Context, g *globalConfig, store *zbstore.Store, db *zbstore.DB, drv *zb.Derivation, drvHash nix.Hash) (map[string]nix.StorePath, error) {
+	outputs := make(map[string]nix.StorePath, len(drv.Outputs))
+	for outName := range drv.Outputs {
+		id := zbstore.DrvOutput{DrvHash: drvHash, OutputName: outName}
+		r, err := db.Realization(ctx, id)
+		if errors.Is(err, zbstore.ErrNotFound) {
+			r = fetchRealization(ctx, g, db, id)
+			if r == nil {
+				return nil, nil
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(store.RealPath(string(r.OutPath))); err != nil {
+			if !substituteRealization(ctx, g, store, r) {
+				log.Debugf(ctx, "Ignoring realization %v: %v", r.ID, err)
+				return nil, nil
+			}
+		}
+		outputs[outName] = r.OutPath
+	}
+	return outputs, nil
+}
+
+// fetchRealization asks the configured substituters
+// for the realization of a derivation output that has not been recorded locally
+// and records the first one found.
+// Realizations are only fetched if trusted public keys are configured,
+// and they must be signed by one of the keys.
+// fetchRealization returns nil if no substituter has a trusted realization.
+func fetchRealization(ctx context.Context, g *globalConfig, db *zbstore.DB, id zbstore.DrvOutput) *zbstore.Realization {
+	if len(g.trustedPublicKeys) == 0 {
+		return nil
+	}
+	subs, err := g.substituterClients(ctx)
+	if err != nil {
+		log.Debugf(ctx, "%v", err)
+		return nil
+	}
+	for _, sub := range subs {
+		r, err := sub.Realization(ctx, id)
+		if errors.Is(err, zbstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf(ctx, "%v", err)
+			continue
+		}
+		log.Debugf(ctx, "Found realization %v in %s", id, sub.URL)
+		if err := db.RecordRealization(ctx, r); err != nil {
+			log.Warnf(ctx, "%v", err)
+		}
+		return r
+	}
+	return nil
+}
+
+// substituteRealization downloads the missing output of a realization
+// that came from somewhere other than this machine.
+// If ipfs-substitution is enabled and the realization records a CID,
+// the IPFS binary cache is tried in addition to the configured substituters.
+// The backend checks the caches' signatures as usual.
+// It reports whether the output is now present in the store.
+func substituteRealization(ctx context.Context, g *globalConfig, store *zbstore.Store, r *zbstore.Realization) bool {
+	if store.Socket != "" || store.NoSubstitutes {
+		return false
+	}
+	subStore := new(zbstore.Store)
+	*subStore = *store
+	switch {
+	case g.ipfsSubstitution && r.CID != "":
+		cacheURL, _, err := zbstore.GatewayURL(g.ipfsGateway, zbstore.IPFSCacheURL(r.CID))
+		if err != nil {
+			log.Debugf(ctx, "Realization %v: %v", r.ID, err)
+			return false
+		}
+		subStore.ExtraSubstituters = append(slices.Clip(store.ExtraSubstituters), cacheURL)
+		log.Debugf(ctx, "Downloading %s from IPFS (%s)", r.OutPath, r.CID)
+	case r.Source == zbstore.LocalSource:
+		// The output was built here and has since been deleted.
+		return false
+	default:
+		log.Debugf(ctx, "Downloading %s (realized by %s)", r.OutPath, r.Source)
+	}
+	if _, err := subStore.RealisePaths(ctx, zbstore.DerivedPath{Path: r.OutPath}); err != nil {
+		log.Warnf(ctx, "Could not download %s: %v", r.OutPath, err)
+		return false
+	}
+	return true
+}
+
+// resolvedDerivationHash returns the hash of drv
+// resolved against the recorded realizations of its inputs.
+// ok is false if drv cannot be resolved.
+func resolvedDerivationHash(ctx context.Context, store *zbstore.Store, db *zbstore.DB, drv *zb.Derivation) (_ nix.Hash, ok bool) {
+	resolved, ok, err := zb.ResolveDerivation(drv, storeDerivationReader(store), func(drvHash nix.Hash, outputName string) (nix.StorePath, bool, error) {
+		r, err := db.Realization(ctx, zbstore.DrvOutput{DrvHash: drvHash, OutputName: outputName})
+		if errors.Is(err, zbstore.ErrNotFound) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return r.OutPath, true, nil
+	})
+	if err != nil {
+		log.Debugf(ctx, "%v", err)
+		return nix.Hash{}, false
+	}
+	if !ok {
+		return nix.Hash{}, false
+	}
+	h, err := resolved.Hash()
+	if err != nil {
+		log.Debugf(ctx, "Resolve %s: %v", drv.Name, err)
+		return nix.Hash{}, false
+	}
+	return h, true
+}
+
+// recordRealizations saves the outputs of a locally realized derivation
+// so that later builds of the same derivation can skip the builder.
+// The outputs are recorded for both the derivation's hash
+// and the hash of the resolved derivation.
+// db may be nil, in which case recordRealizations does nothing.
+func recordRealizations(ctx context.Context, store *zbstore.Store, db *zbstore.DB, drv *zb.Derivation, drvPath nix.StorePath, outputs map[string]nix.StorePath) error {
+	if db == nil {
+		return nil
+	}
+	drvHash, err := drv.Hash()
+	if err != nil {
+		return err
+	}
+	hashes := []nix.Hash{drvHash}
+	if resolvedHash, ok := resolvedDerivationHash(ctx, store, db, drv); ok && !resolvedHash.Equal(drvHash) {
+		hashes = append(hashes, resolvedHash)
+	}
+	now := time.Now()
+	for _, h := range hashes {
+		for _, outName := range sortedOutputNames(outputs) {
+			err := db.RecordRealization(ctx, &zbstore.Realization{
+				ID:      zbstore.DrvOutput{DrvHash: h, OutputName: outName},
+				OutPath: outputs[outName],
+				DrvPath: drvPath,
+				Source:  zbstore.LocalSource,
+				Time:    now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordMeta saves the descriptive metadata of a built derivation
+// so that it can be found with zb search.
+// db may be nil, in which case recordMeta does nothing.
+func recordMeta(ctx context.Context, db *zbstore.DB, drv *zb.Derivation, drvPath nix.StorePath) error {
+	if db == nil {
+		return nil
+	}
+	return db.RecordMeta(ctx, packageMeta(drv, drvPath))
+}
+
+// packageMeta returns the descriptive metadata of a derivation.
+// The pname, version, description, license, and homepage attributes
+// are used for anything not given in the derivation's meta argument.
+func packageMeta(drv *zb.Derivation, drvPath nix.StorePath) *zbstore.PackageMeta {
+	meta := &zbstore.PackageMeta{
+		DrvPath:     drvPath,
+		Name:        drv.Env["pname"],
+		Version:     drv.Env["version"],
+		Description: drv.Env["description"],
+		License:     drv.Env["license"],
+		Homepage:    drv.Env["homepage"],
+	}
+	if meta.Name == "" {
+		meta.Name = drv.Name
+	}
+	if m := drv.Meta; m != nil {
+		if m.Description != "" {
+			meta.Description = m.Description
+		}
+		if m.License != "" {
+			meta.License = m.License
+		}
+		if m.Homepage != "" {
+			meta.Homepage = m.Homepage
+		}
+		meta.Maintainers = m.Maintainers
+	}
+	return meta
+}
+
+// recordProvenance signs and saves a SLSA provenance statement
+// for the outputs of a derivation built between start and end.
+func recordProvenance(ctx context.Context, store *zbstore.Store, db *zbstore.DB, pk *nix.PrivateKey, drv *zb.Derivation, drvPath nix.StorePath, outputs map[string]nix.StorePath, start, end time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database unavailable")
+	}
+	drvHash, err := drv.Hash()
+	if err != nil {
+		return err
+	}
+	opts := &zbstore.ProvenanceOptions{
+		OutputHashes: make(map[nix.StorePath]nix.Hash, len(outputs)),
+		BuilderID:    "zb",
+		StartedOn:    start,
+		FinishedOn:   end,
+	}
+	if host, err := os.Hostname(); err == nil {
+		opts.BuilderID = "zb://" + host
+	}
+	var outPaths []nix.StorePath
+	for _, outName := range sortedOutputNames(outputs) {
+		outPath := outputs[outName]
+		info, err := store.QueryPathInfo(ctx, outPath)
+		if err != nil {
+			return err
+		}
+		opts.OutputHashes[outPath] = info.NARHash
+		opts.Realizations = append(opts.Realizations, &zbstore.Realization{
+			ID:      zbstore.DrvOutput{DrvHash: drvHash, OutputName: outName},
+			OutPath: outPath,
+			DrvPath: drvPath,
+		})
+		outPaths = append(outPaths, outPath)
+	}
+	opts.Inputs = append(opts.Inputs, sortedInputDerivations(drv)...)
+	for i := 0; i < drv.InputSources.Len(); i++ {
+		opts.Inputs = append(opts.Inputs, drv.InputSources.At(i))
+	}
+	stmt, err := zbstore.NewProvenanceStatement(opts)
+	if err != nil {
+		return err
+	}
+	env, err := zbstore.SignStatement(pk, stmt)
+	if err != nil {
+		return err
+	}
+	return db.RecordProvenance(ctx, env, outPaths...)
+}
+
+// outLinkName returns the name of the symlink to create
+// for the given output of the i'th (zero-based) requested derivation.
+// It uses the same scheme as nix-build:
+// the first derivation's out output is linked at base,
+// subsequent derivations get a numeric suffix,
+// and outputs other than out are suffixed with their name.
+func outLinkName(base string, i int, outputName string) string {
+	name := filepath.Clean(base)
+	if i > 0 {
+		name += "-" + strconv.Itoa(i+1)
+	}
+	if outputName != "out" {
+		name += "-" + outputName
+	}
+	return name
+}
+
+func sortedOutputNames(outputs map[string]nix.StorePath) []string {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// splitRealisedOutputs groups the output paths returned by [zbstore.Store.Realise]
+// by derivation.
+// The backend lists each derivation's outputs in the order the derivations were given,
+// so drvs[i] is the parsed derivation at drvPaths[i]
+// and is used to know how many of the paths belong to it.
+func splitRealisedOutputs(drvPaths []nix.StorePath, drvs []*zb.Derivation, paths []nix.StorePath) ([]map[string]nix.StorePath, error) {
+	result := make([]map[string]nix.StorePath, 0, len(drvPaths))
+	for i, drvPath := range drvPaths {
+		n := len(drvs[i].Outputs)
+		if n > len(paths) {
+			return nil, fmt.Errorf("realise %s: missing outputs", drvPath)
+		}
+		outputs := make(map[string]nix.StorePath, n)
+		for _, p := range paths[:n] {
+			name, ok := zbstore.OutputName(drvPath, p)
+			if _, known := drvs[i].Outputs[name]; !ok || !known {
+				return nil, fmt.Errorf("realise %s: unexpected output %s", drvPath, p)
+			}
+			if _, dup := outputs[name]; dup {
+				return nil, fmt.Errorf("realise %s: multiple paths for output %s", drvPath, name)
+			}
+			outputs[name] = p
+		}
+		result = append(result, outputs)
+		paths = paths[n:]
+	}
+	if len(paths) > 0 {
+		return nil, fmt.Errorf("realise: unexpected output %s", paths[0])
+	}
+	return result, nil
+}
+
+// checkClosureSize verifies that each of the derivation's outputs' closures
+// fit within the derivation's maxClosureSize attribute, if present.
+// closureSize is called to compute the size of an output's closure in bytes.
+// Outputs are checked in name order.
+func checkClosureSize(drvPath nix.StorePath, drv *zb.Derivation, outputs map[string]nix.StorePath, closureSize func(nix.StorePath) (int64, error)) error {
+	maxSize, ok, err := drv.MaxClosureSize()
+	if !ok {
+		return err
+	}
+	for _, outName := range sortedOutputNames(outputs) {
+		size, err := closureSize(outputs[outName])
+		if err != nil {
+			return err
+		}
+		if size > maxSize {
+			return fmt.Errorf("%s: closure of output %s is %d bytes (exceeds maxClosureSize of %d bytes)",
+				drvPath, outName, size, maxSize)
+		}
+	}
+	return nil
+}
+
+// storeClosureSize returns a function that computes closure sizes
+// with [zbstore.Store.ClosureSize].
+func storeClosureSize(ctx context.Context, store *zbstore.Store) func(nix.StorePath) (int64, error) {
+	return func(p nix.StorePath) (int64, error) {
+		return store.ClosureSize(ctx, p)
+	}
+}
+
+// sortedOutputPaths returns the store paths in outputs
+// in the order of their output names.
+func sortedOutputPaths(outputs map[string]nix.StorePath) []nix.StorePath {
+	paths := make([]nix.StorePath, 0, len(outputs))
+	for _, name := range sortedOutputNames(outputs) {
+		paths = append(paths, outputs[name])
+	}
+	return paths
+}
+
+// printDryRun prints the derivations that would be built,
+// the store objects that would be downloaded,
+// and the derivations whose outputs are already available.
+func printDryRun(ctx context.Context, store *zbstore.Store, drvPaths []nix.StorePath) error {
+	missing, err := store.QueryMissing(ctx, drvPaths...)
+	if err != nil {
+		return err
+	}
+
+	willBuild := make(map[nix.StorePath]struct{}, len(missing.WillBuild))
+	for _, p := range missing.WillBuild {
+		willBuild[p] = struct{}{}
+	}
+	var valid []nix.StorePath
+	visited := make(map[nix.StorePath]struct{})
+	stack := slices.Clone(drvPaths)
+	for len(stack) > 0 {
+		drvPath := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, seen := visited[drvPath]; seen {
+			continue
+		}
+		visited[drvPath] = struct{}{}
+		if _, building := willBuild[drvPath]; !building {
+			// Inputs of a derivation that doesn't need building
+			// are irrelevant.
+			valid = append(valid, drvPath)
+			continue
+		}
+		drv, err := zb.ReadDerivationFromRoot(store.Root, drvPath)
+		if err != nil {
+			return err
+		}
+		for input := range drv.InputDerivations {
+			stack = append(stack, input)
+		}
+	}
+	slices.Sort(valid)
+
+	fmt.Printf("will build %d derivation(s):\n", len(missing.WillBuild))
+	for _, p := range missing.WillBuild {
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Printf("will download %d path(s)", len(missing.WillSubstitute))
+	if missing.DownloadSize >= 0 && missing.NARSize >= 0 {
+		fmt.Printf(" (%s download, %s unpacked)", formatSize(missing.DownloadSize), formatSize(missing.NARSize))
+	}
+	fmt.Printf(":\n")
+	for _, p := range missing.WillSubstitute {
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Printf("already available %d derivation(s):\n", len(valid))
+	for _, p := range valid {
+		fmt.Printf("  %s\n", p)
+	}
+	if len(missing.Unknown) > 0 {
+		fmt.Printf("cannot build or download %d path(s):\n", len(missing.Unknown))
+		for _, p := range missing.Unknown {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	return nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+)
+
+func TestCheckClosureSize(t *testing.T) {
+	const drvPath nix.StorePath = "/nix/store/s5fm3mqx08mlmlbnnvsm2zqfixn1wxma-hello.drv"
+	const (
+		outPath nix.StorePath = "/nix/store/6bxpd2xvp5hbkfkcaahxkxzx3ja2ck0k-hello"
+		devPath nix.StorePath = "/nix/store/2sc9kz0ny2wy5xbwj3c8jsmi3jbhl6b0-hello-dev"
+	)
+	outputs := map[string]nix.StorePath{
+		"out": outPath,
+		"dev": devPath,
+	}
+	sizes := map[nix.StorePath]int64{
+		outPath: 1000,
+		devPath: 200,
+	}
+	closureSize := func(p nix.StorePath) (int64, error) {
+		n, ok := sizes[p]
+		if !ok {
+			return 0, errors.New("unknown path")
+		}
+		return n, nil
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		size    func(nix.StorePath) (int64, error)
+		wantErr string
+	}{
+		{
+			name: "NoLimit",
+			env:  map[string]string{},
+			size: func(nix.StorePath) (int64, error) {
+				return 0, errors.New("closure size should not be computed")
+			},
+		},
+		{
+			name: "UnderLimit",
+			env:  map[string]string{"maxClosureSize": "2000"},
+			size: closureSize,
+		},
+		{
+			name: "AtLimit",
+			env:  map[string]string{"maxClosureSize": "1000"},
+			size: closureSize,
+		},
+		{
+			name:    "OverLimit",
+			env:     map[string]string{"maxClosureSize": "500"},
+			size:    closureSize,
+			wantErr: "closure of output out is 1000 bytes (exceeds maxClosureSize of 500 bytes)",
+		},
+		{
+			name:    "FirstOutputOverLimit",
+			env:     map[string]string{"maxClosureSize": "100"},
+			size:    closureSize,
+			wantErr: "closure of output dev is 200 bytes",
+		},
+		{
+			name:    "InvalidLimit",
+			env:     map[string]string{"maxClosureSize": "big"},
+			size:    closureSize,
+			wantErr: "invalid maxClosureSize",
+		},
+		{
+			name: "SizeError",
+			env:  map[string]string{"maxClosureSize": "2000"},
+			size: func(nix.StorePath) (int64, error) {
+				return 0, errors.New("bork")
+			},
+			wantErr: "bork",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drv := &zb.Derivation{
+				Name: "hello",
+				Env:  test.env,
+			}
+			err := checkClosureSize(drvPath, drv, outputs, test.size)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Error("checkClosureSize:", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("checkClosureSize(...) = <nil>; want error containing %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("checkClosureSize(...) = %v; want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSortedOutputPaths(t *testing.T) {
+	outputs := map[string]nix.StorePath{
+		"out": "/nix/store/6bxpd2xvp5hbkfkcaahxkxzx3ja2ck0k-hello",
+		"dev": "/nix/store/2sc9kz0ny2wy5xbwj3c8jsmi3jbhl6b0-hello-dev",
+	}
+	got := sortedOutputPaths(outputs)
+	want := []nix.StorePath{outputs["dev"], outputs["out"]}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("sortedOutputPaths(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestSplitRealisedOutputs(t *testing.T) {
+	const (
+		helloDrvPath    nix.StorePath = "/nix/store/s5fm3mqx08mlmlbnnvsm2zqfixn1wxma-hello.drv"
+		helloOutPath    nix.StorePath = "/nix/store/6bxpd2xvp5hbkfkcaahxkxzx3ja2ck0k-hello"
+		helloDevPath    nix.StorePath = "/nix/store/2sc9kz0ny2wy5xbwj3c8jsmi3jbhl6b0-hello-dev"
+		otherDrvPath    nix.StorePath = "/nix/store/ffffffffffffffffffffffffffffffff-hello.drv"
+		otherOutPath    nix.StorePath = "/nix/store/00000000000000000000000000000000-hello"
+		unrelatedOutput nix.StorePath = "/nix/store/11111111111111111111111111111111-goodbye"
+	)
+	helloDrv := &zb.Derivation{
+		Name: "hello",
+		Outputs: map[string]*zb.DerivationOutput{
+			"out": zb.DeferredOutput(),
+			"dev": zb.DeferredOutput(),
+		},
+	}
+	otherDrv := &zb.Derivation{
+		Name: "hello",
+		Outputs: map[string]*zb.DerivationOutput{
+			"out": zb.DeferredOutput(),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		paths   []nix.StorePath
+		want    []map[string]nix.StorePath
+		wantErr bool
+	}{
+		{
+			name:  "SameName",
+			paths: []nix.StorePath{helloDevPath, helloOutPath, otherOutPath},
+			want: []map[string]nix.StorePath{
+				{"out": helloOutPath, "dev": helloDevPath},
+				{"out": otherOutPath},
+			},
+		},
+		{
+			name:    "Missing",
+			paths:   []nix.StorePath{helloDevPath, helloOutPath},
+			wantErr: true,
+		},
+		{
+			name:    "Extra",
+			paths:   []nix.StorePath{helloDevPath, helloOutPath, otherOutPath, unrelatedOutput},
+			wantErr: true,
+		},
+		{
+			name:    "Duplicate",
+			paths:   []nix.StorePath{helloOutPath, helloOutPath, otherOutPath},
+			wantErr: true,
+		},
+		{
+			name:    "Unexpected",
+			paths:   []nix.StorePath{helloOutPath, unrelatedOutput, otherOutPath},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := splitRealisedOutputs(
+				[]nix.StorePath{helloDrvPath, otherDrvPath},
+				[]*zb.Derivation{helloDrv, otherDrv},
+				test.paths,
+			)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatal("splitRealisedOutputs:", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("splitRealisedOutputs(...) = %v, <nil>; want error", got)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("splitRealisedOutputs(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type bundleOptions struct {
+	evalOptions
+	output  string
+	program string
+}
+
+func newBundleCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "bundle [options] [INSTALLABLE]",
+		Short: "build a derivation and write a self-extracting executable of its closure",
+		Long: "Build a derivation and write a single executable " +
+			"that runs its program on machines without zb. " +
+			"The executable contains a copy of zb and the closure of the derivation's out output. " +
+			"When run, it unpacks the closure into the user's cache directory " +
+			"(rewriting references to the store directory to a symlink in /tmp), " +
+			"then runs the program with the given arguments. " +
+			"The program is the one zb run would execute unless --program is given. " +
+			"The executable only runs on machines with the same operating system and architecture as this one.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(bundleOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVarP(&opts.output, "output", "o", "", "write the executable to `file` (default <name>)")
+	c.Flags().StringVar(&opts.program, "program", "", "run `path` (relative to the output) instead of the main program")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runBundle(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runBundle(ctx context.Context, g *globalConfig, opts *bundleOptions) (err error) {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+	if drv.System != zbstore.HostSystem() {
+		log.Warnf(ctx, "%s is built for %s, but the bundle only runs on %s", drv.Name, drv.System, zbstore.HostSystem())
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		return err
+	}
+
+	store := g.realisingStore(ctx)
+	outputs, err := store.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		return err
+	}
+	outPath, ok := outputs["out"]
+	if !ok {
+		return fmt.Errorf("%s does not have an out output", drvPath)
+	}
+	// Keep the closure alive while the bundle is written.
+	rootDir, err := os.MkdirTemp("", "zb-bundle-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootDir)
+	if err := store.AddRoot(ctx, filepath.Join(rootDir, "result"), outPath); err != nil {
+		return err
+	}
+	g.recordAccess(ctx, drvPath, outPath)
+
+	var program string
+	if opts.program != "" {
+		program = filepath.Join(string(outPath), filepath.Clean("/"+opts.program))
+	} else {
+		program, err = findMainProgram(store, drv, outPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Open(exePath)
+	if err != nil {
+		return err
+	}
+	defer exe.Close()
+	output := opts.output
+	if output == "" {
+		output = packageName(drv.Name)
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	if err := zbstore.WriteSelfExtracting(ctx, f, store, exe, []nix.StorePath{outPath}, program); err != nil {
+		return err
+	}
+	log.Infof(ctx, "Wrote %s", output)
+	return nil
+}
+
+// runSelfExtracting runs the program in a bundle written by zb bundle
+// if the running executable is one, and then exits.
+// Otherwise, it returns without doing anything.
+func runSelfExtracting() {
+	exePath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	program, ok, err := zbstore.ExtractSelf(exePath, filepath.Join(cacheDir, "zb", "bundles"))
+	if !ok {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+
+	// Let the program decide how to handle interrupts.
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+	c := exec.Command(program, os.Args[1:]...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.Exited() {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
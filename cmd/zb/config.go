@@ -0,0 +1,358 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// configFileName is the name of zb's configuration files.
+const configFileName = "zb.toml"
+
+// systemConfigPath is the path of the system-wide configuration file.
+const systemConfigPath = "/etc/zb/" + configFileName
+
+// config is the set of settings that can be given in configuration files.
+// Each field's toml tag is the setting's name.
+type config struct {
+	Store              string   `toml:"store"`
+	StoreSocket        string   `toml:"store-socket"`
+	Substituters       []string `toml:"substituters"`
+	TrustedPublicKeys  []string `toml:"trusted-public-keys"`
+	DownloadSegments   int      `toml:"download-segments"`
+	PeerSubstitution   bool     `toml:"peer-substitution"`
+	IPFSSubstitution   bool     `toml:"ipfs-substitution"`
+	IPFSGateway        string   `toml:"ipfs-gateway"`
+	Fallback           bool     `toml:"fallback"`
+	NARInfoPositiveTTL string   `toml:"narinfo-cache-positive-ttl"`
+	NARInfoNegativeTTL string   `toml:"narinfo-cache-negative-ttl"`
+	AccessTokens       []string `toml:"access-tokens"`
+	NetrcFile          string   `toml:"netrc-file"`
+	ClientCertificate  string   `toml:"client-certificate"`
+	ClientKey          string   `toml:"client-key"`
+	MaxJobs            int      `toml:"max-jobs"`
+	Sandbox            string   `toml:"sandbox"`
+	SandboxPaths       []string `toml:"extra-sandbox-paths"`
+	ExtraPlatforms     []string `toml:"extra-platforms"`
+	AutoOptimise       bool     `toml:"auto-optimise"`
+	TrackAccess        bool     `toml:"track-access"`
+	PathCache          string   `toml:"path-cache"`
+	PureEval           bool     `toml:"pure-eval"`
+	EvalMemoryLimit    int64    `toml:"eval-memory-limit"`
+	EvalInstructions   int64    `toml:"eval-instruction-limit"`
+	SuppressWarnings   []string `toml:"suppress-warnings"`
+	FailedBuildTTL     string   `toml:"failed-build-ttl"`
+}
+
+// failedBuildTTL parses the failed-build-ttl setting.
+// Zero means that build failures are not remembered.
+func (cfg *config) failedBuildTTL() (time.Duration, error) {
+	if cfg.FailedBuildTTL == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(cfg.FailedBuildTTL)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %v", d)
+	}
+	return d, nil
+}
+
+// narInfoTTLs parses the narinfo-cache-positive-ttl and narinfo-cache-negative-ttl settings
+// into the form used by [zbstore.NARInfoCache]:
+// zero if unset (to use the defaults)
+// and negative if set to zero (to not remember results).
+func (cfg *config) narInfoTTLs() (positive, negative time.Duration, err error) {
+	parse := func(name, s string) (time.Duration, error) {
+		if s == "" {
+			return 0, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("%s: negative duration %v", name, d)
+		}
+		if d == 0 {
+			return -1, nil
+		}
+		return d, nil
+	}
+	positive, err = parse("narinfo-cache-positive-ttl", cfg.NARInfoPositiveTTL)
+	if err != nil {
+		return 0, 0, err
+	}
+	negative, err = parse("narinfo-cache-negative-ttl", cfg.NARInfoNegativeTTL)
+	if err != nil {
+		return 0, 0, err
+	}
+	return positive, negative, nil
+}
+
+// accessTokens parses the access-tokens setting,
+// a list of host=token pairs,
+// into a map from host to token.
+func (cfg *config) accessTokens() (map[string]string, error) {
+	if len(cfg.AccessTokens) == 0 {
+		return nil, nil
+	}
+	tokens := make(map[string]string, len(cfg.AccessTokens))
+	for _, entry := range cfg.AccessTokens {
+		host, token, ok := strings.Cut(entry, "=")
+		if !ok || host == "" || token == "" {
+			return nil, fmt.Errorf("%q is not in the form host=token", redactAccessToken(entry))
+		}
+		tokens[host] = token
+	}
+	return tokens, nil
+}
+
+// redactAccessToken hides the token in an access-tokens entry
+// unless it refers to a file.
+func redactAccessToken(entry string) string {
+	host, token, ok := strings.Cut(entry, "=")
+	if !ok || strings.HasPrefix(token, "@") {
+		return entry
+	}
+	return host + "=<redacted>"
+}
+
+// defaultEvalMemoryLimit is the default value of the eval-memory-limit setting
+// in mebibytes.
+// It is generous for real package sets
+// but keeps runaway evaluations from exhausting a machine's memory.
+const defaultEvalMemoryLimit = 4096
+
+// projectForbidden is the set of settings that a project's configuration file
+// may not set, since projects are not necessarily trusted.
+var projectForbidden = map[string]struct{}{
+	"trusted-public-keys": {},
+	"store":               {},
+	"store-socket":        {},
+	"access-tokens":       {},
+	"netrc-file":          {},
+	"client-certificate":  {},
+	"client-key":          {},
+	"peer-substitution":   {},
+	"ipfs-substitution":   {},
+	"ipfs-gateway":        {},
+}
+
+// loadedConfig is the effective configuration
+// along with where each setting came from.
+type loadedConfig struct {
+	config
+	// sources maps setting names to a description of where they were set.
+	// Settings not in sources have their default values.
+	sources map[string]string
+}
+
+// configLayer is a configuration file that may or may not exist.
+type configLayer struct {
+	path    string
+	project bool
+}
+
+// configLayers returns the configuration files that apply
+// to a zb run in the working directory,
+// in order of increasing precedence:
+// the system configuration, the user's configuration,
+// and the nearest zb.toml in the working directory or its parents.
+func configLayers() []configLayer {
+	layers := []configLayer{{path: systemConfigPath}}
+	if dir, err := os.UserConfigDir(); err == nil {
+		layers = append(layers, configLayer{path: filepath.Join(dir, "zb", configFileName)})
+	}
+	if wd, err := os.Getwd(); err == nil {
+		for dir := wd; ; dir = filepath.Dir(dir) {
+			p := filepath.Join(dir, configFileName)
+			if _, err := os.Stat(p); err == nil {
+				layers = append(layers, configLayer{path: p, project: true})
+				break
+			}
+			if filepath.Dir(dir) == dir {
+				break
+			}
+		}
+	}
+	return layers
+}
+
+// loadConfig reads the given configuration files
+// on top of the built-in defaults and then applies environment variables.
+func loadConfig(layers []configLayer) (*loadedConfig, error) {
+	cfg := &loadedConfig{
+		config: config{
+			EvalMemoryLimit: defaultEvalMemoryLimit,
+		},
+		sources: make(map[string]string),
+	}
+	for _, layer := range layers {
+		if err := cfg.mergeFile(layer); err != nil {
+			return cfg, err
+		}
+	}
+	for name, envVar := range map[string]string{
+		"store":         "ZB_STORE",
+		"store-socket":  "ZB_DAEMON_SOCKET",
+		"path-cache":    "ZB_PATH_CACHE",
+		"access-tokens": "ZB_ACCESS_TOKENS",
+		"ipfs-gateway":  "IPFS_GATEWAY",
+	} {
+		value := os.Getenv(envVar)
+		if value == "" {
+			continue
+		}
+		if f := cfg.field(name); f.Kind() == reflect.Slice {
+			f.Set(reflect.ValueOf(strings.Fields(value)))
+		} else {
+			f.SetString(value)
+		}
+		cfg.sources[name] = "$" + envVar
+	}
+	switch cfg.Sandbox {
+	case "", "true", "false", "relaxed":
+	default:
+		return cfg, fmt.Errorf("%s: sandbox must be one of true, false, or relaxed (got %q)", cfg.sources["sandbox"], cfg.Sandbox)
+	}
+	if cfg.MaxJobs < 0 {
+		return cfg, fmt.Errorf("%s: max-jobs must not be negative", cfg.sources["max-jobs"])
+	}
+	if _, err := cfg.accessTokens(); err != nil {
+		return cfg, fmt.Errorf("%s: access-tokens: %v", cfg.sources["access-tokens"], err)
+	}
+	if (cfg.ClientCertificate == "") != (cfg.ClientKey == "") {
+		return cfg, fmt.Errorf("client-certificate and client-key must be set together")
+	}
+	if cfg.DownloadSegments < 0 {
+		return cfg, fmt.Errorf("%s: download-segments must not be negative", cfg.sources["download-segments"])
+	}
+	if cfg.EvalMemoryLimit < 0 {
+		return cfg, fmt.Errorf("%s: eval-memory-limit must not be negative", cfg.sources["eval-memory-limit"])
+	}
+	if cfg.EvalInstructions < 0 {
+		return cfg, fmt.Errorf("%s: eval-instruction-limit must not be negative", cfg.sources["eval-instruction-limit"])
+	}
+	if _, _, err := cfg.narInfoTTLs(); err != nil {
+		return cfg, err
+	}
+	if _, err := cfg.failedBuildTTL(); err != nil {
+		return cfg, fmt.Errorf("%s: failed-build-ttl: %v", cfg.sources["failed-build-ttl"], err)
+	}
+	return cfg, nil
+}
+
+// mergeFile overwrites the settings in cfg with the ones in the given file.
+// A missing file is ignored.
+func (cfg *loadedConfig) mergeFile(layer configLayer) error {
+	var fileConfig config
+	md, err := toml.DecodeFile(layer.path, &fileConfig)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read configuration: %v", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("read configuration %s: unknown setting %s", layer.path, undecoded[0])
+	}
+	src := reflect.ValueOf(fileConfig)
+	for i := 0; i < src.NumField(); i++ {
+		name := configSettingName(i)
+		if !md.IsDefined(name) {
+			continue
+		}
+		if _, forbidden := projectForbidden[name]; forbidden && layer.project {
+			return fmt.Errorf("read configuration %s: %s can only be set in %s or the user configuration", layer.path, name, systemConfigPath)
+		}
+		cfg.field(name).Set(src.Field(i))
+		cfg.sources[name] = layer.path
+	}
+	return nil
+}
+
+// configSettingName returns the name of the i'th field of [config].
+func configSettingName(i int) string {
+	return reflect.TypeFor[config]().Field(i).Tag.Get("toml")
+}
+
+// field returns the field of cfg for the named setting.
+func (cfg *loadedConfig) field(name string) reflect.Value {
+	v := reflect.ValueOf(&cfg.config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if configSettingName(i) == name {
+			return v.Field(i)
+		}
+	}
+	panic("unknown setting " + name)
+}
+
+func newConfigCommand(cfg *loadedConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "config COMMAND",
+		Short: "inspect zb's configuration",
+		Long: "zb reads settings from " + systemConfigPath + ", " +
+			"the user's configuration directory (e.g. ~/.config/zb/" + configFileName + "), " +
+			"and the nearest " + configFileName + " in the working directory or its parents, " +
+			"with later files overriding earlier ones. " +
+			"Environment variables and command-line flags override configuration files.",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(&cobra.Command{
+		Use:                   "show",
+		Short:                 "print the effective configuration",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConfigShow(cfg)
+		},
+	})
+	return c
+}
+
+func runConfigShow(cfg *loadedConfig) error {
+	v := reflect.ValueOf(cfg.config)
+	for i := 0; i < v.NumField(); i++ {
+		name := configSettingName(i)
+		field := v.Field(i)
+		if field.Kind() == reflect.Slice && field.IsNil() {
+			// The encoder omits nil slices.
+			field = reflect.MakeSlice(field.Type(), 0, 0)
+		}
+		if name == "access-tokens" {
+			redacted := make([]string, 0, field.Len())
+			for _, entry := range cfg.AccessTokens {
+				redacted = append(redacted, redactAccessToken(entry))
+			}
+			field = reflect.ValueOf(redacted)
+		}
+		value := new(strings.Builder)
+		if err := toml.NewEncoder(value).Encode(map[string]any{name: field.Interface()}); err != nil {
+			return err
+		}
+		source := cfg.sources[name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Printf("%s # %s\n", strings.TrimSuffix(value.String(), "\n"), source)
+	}
+	return nil
+}
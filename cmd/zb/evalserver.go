@@ -0,0 +1,246 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/internal/logsink"
+)
+
+// defaultEvalSocket returns the default path of the evaluation server's socket.
+func defaultEvalSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "zb-"+strconv.Itoa(os.Getuid()))
+	}
+	return filepath.Join(dir, "zb", "eval.sock")
+}
+
+func newEvalDaemonCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "eval-daemon [options]",
+		Short: "run a server that evaluates Lua expressions on behalf of zb eval",
+		Long: "Run a long-lived evaluator that keeps its record of imported source trees warm between invocations. " +
+			"Each request is evaluated in a fresh Lua state, one request at a time. " +
+			"Use zb eval --eval-server to send requests to it.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(evalDaemonOptions)
+	c.Flags().StringVar(&opts.socket, "socket", defaultEvalSocket(), "listen on the Unix socket at `path`")
+	c.Flags().StringArrayVar(&opts.logSinks, "log-sink", nil, "send logs to `sink` instead of stderr "+
+		"(one of stderr, syslog, syslog://host:port, journald, or an http(s) URL; may be repeated)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runEvalDaemon(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+type evalDaemonOptions struct {
+	socket   string
+	logSinks []string
+}
+
+func runEvalDaemon(ctx context.Context, g *globalConfig, opts *evalDaemonOptions) error {
+	if len(opts.logSinks) > 0 {
+		var sinks []logsink.Sink
+		for _, spec := range opts.logSinks {
+			s, err := logsink.Open(spec, "zb")
+			if err != nil {
+				for _, s := range sinks {
+					s.Close()
+				}
+				return err
+			}
+			sinks = append(sinks, s)
+		}
+		sink := logsink.Multi(sinks...)
+		defer sink.Close()
+		prevLogger := log.Default()
+		log.SetDefault(&log.LevelFilter{
+			Min:    minLogLevel(g.debug),
+			Output: sink,
+		})
+		defer log.SetDefault(prevLogger)
+	}
+
+	socket := opts.socket
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return err
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	log.Infof(ctx, "Listening on %s", socket)
+
+	srv := rpc.NewServer()
+	svc := &evalService{
+		newEval: func() *zb.Eval { return g.newEval(ctx) },
+		cache:   g.newEval(ctx),
+	}
+	defer svc.cache.Close()
+	if err := srv.RegisterName("Eval", svc); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// EvalRequest is the argument to the Eval.Eval RPC.
+type EvalRequest struct {
+	// Dir is the client's working directory.
+	// Relative paths are resolved against it.
+	Dir          string
+	Expr         string
+	File         string
+	Installables []string
+}
+
+// EvalResponse is the result of the Eval.Eval RPC.
+type EvalResponse struct {
+	// Results is the JSON representation of each result
+	// as produced by zb eval --json.
+	Results []json.RawMessage
+}
+
+// evalService is the RPC service exposed by zb eval-daemon.
+type evalService struct {
+	// newEval returns a new evaluator for a request.
+	newEval func() *zb.Eval
+	// mu serializes requests, since their evaluators share cache's path cache.
+	mu sync.Mutex
+	// cache holds the path cache shared by requests.
+	// It is never used to evaluate.
+	cache *zb.Eval
+}
+
+// Eval evaluates an expression or file.
+func (svc *evalService) Eval(req *EvalRequest, resp *EvalResponse) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	ctx := context.Background()
+	start := time.Now()
+	target := req.File
+	if req.Expr != "" {
+		target = "expression"
+	}
+	if err := svc.evaluate(req, resp); err != nil {
+		log.Warnf(ctx, "Evaluating %s %q failed after %v: %v", target, req.Installables, time.Since(start), err)
+		return err
+	}
+	log.Infof(ctx, "Evaluated %s %q in %v", target, req.Installables, time.Since(start))
+	return nil
+}
+
+func (svc *evalService) evaluate(req *EvalRequest, resp *EvalResponse) error {
+	// A fresh evaluator keeps globals from leaking between requests.
+	eval := svc.newEval()
+	defer eval.Close()
+	eval.SharePathCache(svc.cache)
+	if req.Dir != "" {
+		if !filepath.IsAbs(req.Dir) {
+			return fmt.Errorf("working directory %q is not absolute", req.Dir)
+		}
+		eval.SetDir(req.Dir)
+	}
+	opts := &evalOptions{
+		expr:         req.Expr,
+		file:         req.File,
+		installables: req.Installables,
+	}
+	results, err := evaluate(eval, opts)
+	if err != nil {
+		return err
+	}
+	resp.Results = make([]json.RawMessage, 0, len(results))
+	for _, result := range results {
+		v, err := toJSONValue(result)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		resp.Results = append(resp.Results, data)
+	}
+	return nil
+}
+
+// evalRemote sends an evaluation request to the server listening on socket.
+func evalRemote(ctx context.Context, socket string, opts *evalOptions) ([]json.RawMessage, error) {
+	if opts.expr != "" && opts.file != "" {
+		return nil, fmt.Errorf("can specify at most one of --expr or --file")
+	}
+	req := &EvalRequest{
+		Expr:         opts.expr,
+		File:         opts.file,
+		Installables: opts.installables,
+	}
+	var err error
+	req.Dir, err = os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if req.File != "" {
+		req.File, err = filepath.Abs(req.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect to evaluation server: %w", err)
+	}
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	resp := new(EvalResponse)
+	call := client.Go("Eval.Eval", req, resp, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return resp.Results, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/internal/ociimage"
+)
+
+func newExportCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "export COMMAND",
+		Short:                 "package build outputs for use outside the store",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(
+		newExportOCICommand(g),
+	)
+	return c
+}
+
+type exportOCIOptions struct {
+	evalOptions
+	output     string
+	tag        string
+	entrypoint []string
+	env        []string
+	maxLayers  int
+}
+
+func newExportOCICommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "oci [options] [INSTALLABLE]",
+		Short: "build a derivation and write its closure as an OCI image",
+		Long: "Build a derivation and write an OCI image tarball containing the closure of its out output. " +
+			"Each store object gets its own layer (up to --max-layers), " +
+			"so images that share dependencies share layers. " +
+			"The image can be loaded with docker load or podman load. " +
+			"The entrypoint defaults to the program zb run would execute.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(exportOCIOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVarP(&opts.output, "output", "o", "", "write the image to `file` or - for stdout (default <name>.tar)")
+	c.Flags().StringVarP(&opts.tag, "tag", "t", "", "name the image `ref` (default <name>:latest)")
+	c.Flags().StringArrayVar(&opts.entrypoint, "entrypoint", nil, "use `arg` as the next element of the image's entrypoint (may be repeated)")
+	c.Flags().StringArrayVar(&opts.env, "env", nil, "set `NAME=VALUE` in the image's environment (may be repeated)")
+	c.Flags().IntVar(&opts.maxLayers, "max-layers", 100, "put the closure in at most `n` layers")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runExportOCI(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runExportOCI(ctx context.Context, g *globalConfig, opts *exportOCIOptions) error {
+	if opts.maxLayers < 1 {
+		return fmt.Errorf("--max-layers must be positive")
+	}
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+	goos, goarch, variant, ok := ociPlatform(drv.System)
+	if !ok {
+		return fmt.Errorf("%s: no OCI platform for system %s", drv.Name, drv.System)
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		return err
+	}
+
+	store := g.realisingStore(ctx)
+	outputs, err := store.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		return err
+	}
+	outPath, ok := outputs["out"]
+	if !ok {
+		return fmt.Errorf("%s does not have an out output", drvPath)
+	}
+	// Keep the closure alive while the image is written.
+	rootDir, err := os.MkdirTemp("", "zb-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootDir)
+	if err := store.AddRoot(ctx, filepath.Join(rootDir, "result"), outPath); err != nil {
+		return err
+	}
+	closure, err := store.QueryRequisites(ctx, outPath)
+	if err != nil {
+		return err
+	}
+	g.recordAccess(ctx, drvPath, outPath)
+
+	img := &ociimage.Image{
+		RefName:      opts.tag,
+		OS:           goos,
+		Architecture: goarch,
+		Variant:      variant,
+		Entrypoint:   opts.entrypoint,
+		Env:          opts.env,
+		Layers:       groupLayers(closure, opts.maxLayers),
+	}
+	if img.RefName == "" {
+		img.RefName = packageName(drv.Name) + ":latest"
+	}
+	if len(img.Entrypoint) == 0 {
+		program, err := findMainProgram(store, drv, outPath)
+		if err != nil {
+			log.Warnf(ctx, "Image has no entrypoint: %v", err)
+		} else {
+			img.Entrypoint = []string{program}
+		}
+	}
+	if !hasEnv(img.Env, "PATH") {
+		if bin := appendBinDir(nil, store, string(outPath)); len(bin) > 0 {
+			img.Env = append(img.Env, "PATH="+bin[0])
+		}
+	}
+
+	output := opts.output
+	if output == "" {
+		output = drv.Name + ".tar"
+	}
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := ociimage.Write(w, img); err != nil {
+		return fmt.Errorf("write %s: %v", output, err)
+	}
+	if f, ok := w.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return err
+		}
+		log.Infof(ctx, "Wrote %s with %d layer(s)", output, len(img.Layers))
+	}
+	return nil
+}
+
+// groupLayers assigns the store objects in a closure to image layers.
+// Each object gets its own layer in the order given
+// (dependencies first, as returned by nix-store --query --requisites),
+// except that objects beyond the maximum are combined into the last layer.
+func groupLayers(closure []nix.StorePath, maxLayers int) [][]string {
+	var layers [][]string
+	for i, p := range closure {
+		if i < maxLayers {
+			layers = append(layers, []string{string(p)})
+		} else {
+			layers[maxLayers-1] = append(layers[maxLayers-1], string(p))
+		}
+	}
+	return layers
+}
+
+// ociPlatform returns the OCI platform for a Nix system type.
+func ociPlatform(system string) (goos, goarch, variant string, ok bool) {
+	arch, kernel, ok := strings.Cut(system, "-")
+	if !ok || kernel != "linux" {
+		return "", "", "", false
+	}
+	switch arch {
+	case "x86_64":
+		return "linux", "amd64", "", true
+	case "i686":
+		return "linux", "386", "", true
+	case "aarch64":
+		return "linux", "arm64", "", true
+	case "armv7l":
+		return "linux", "arm", "v7", true
+	case "armv6l":
+		return "linux", "arm", "v6", true
+	case "riscv64":
+		return "linux", "riscv64", "", true
+	case "powerpc64le":
+		return "linux", "ppc64le", "", true
+	default:
+		return "", "", "", false
+	}
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == name {
+			return true
+		}
+	}
+	return false
+}
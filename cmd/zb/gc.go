@@ -0,0 +1,90 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type gcOptions struct {
+	dryRun bool
+}
+
+func newGCCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "gc [options]",
+		Short: "delete unreachable store objects",
+		Long: "Delete every store object that is not reachable from a garbage collector root. " +
+			"With --dry-run, nothing is deleted: instead, zb reports how much space would be freed " +
+			"and how much each root is keeping alive, " +
+			"so you can decide which out-links to remove first.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(gcOptions)
+	c.Flags().BoolVarP(&opts.dryRun, "dry-run", "n", false, "report what would be deleted without deleting anything")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runGC(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runGC(ctx context.Context, g *globalConfig, opts *gcOptions) error {
+	store := g.store()
+	if opts.dryRun {
+		plan, err := store.PlanGC(ctx)
+		if err != nil {
+			return err
+		}
+		printGCPlan(plan)
+		return nil
+	}
+
+	dead, err := store.DeadPaths(ctx)
+	if err != nil {
+		return err
+	}
+	freed, err := store.CollectGarbage(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d store objects deleted, %s freed\n", len(dead), formatSize(freed))
+
+	if g.trackAccess && len(dead) > 0 {
+		db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+		if err != nil {
+			log.Warnf(ctx, "Updating access times: %v", err)
+			return nil
+		}
+		defer db.Close()
+		if err := db.Forget(ctx, dead...); err != nil {
+			log.Warnf(ctx, "Updating access times: %v", err)
+		}
+	}
+	return nil
+}
+
+func printGCPlan(plan *zbstore.GCPlan) {
+	fmt.Printf("%d store objects would be deleted, freeing %s\n", len(plan.Dead), formatSize(plan.DeadSize))
+	if len(plan.Roots) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Removing a single root would additionally free:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "FREED\tCLOSURE\tROOT")
+	for _, u := range plan.Roots {
+		fmt.Fprintf(tw, "%s\t%s\t%s -> %s\n", formatSize(u.UniqueSize), formatSize(u.ClosureSize), u.Link, u.Path)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+)
+
+type graphOptions struct {
+	evalOptions
+	format  string
+	runtime bool
+}
+
+func newGraphCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "graph [options] [INSTALLABLE [...]]",
+		Short: "print the dependency graph of derivations",
+		Long: "Print the graph of input derivations of the given derivations. " +
+			"With --runtime, the derivations are built " +
+			"and the graph of references between their outputs' closures is printed instead.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(graphOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVar(&opts.format, "format", "dot", "output `format` (one of dot or json)")
+	c.Flags().BoolVar(&opts.runtime, "runtime", false, "print the runtime reference graph of the outputs")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runGraph(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runGraph(ctx context.Context, g *globalConfig, opts *graphOptions) error {
+	var write func(io.Writer, *storeGraph) error
+	switch opts.format {
+	case "dot":
+		write = writeDOTGraph
+	case "json":
+		write = writeJSONGraph
+	default:
+		return fmt.Errorf("unknown format %q", opts.format)
+	}
+
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	var drvPaths []nix.StorePath
+	for _, result := range results {
+		drv, _ := result.(*zb.Derivation)
+		if drv == nil {
+			return fmt.Errorf("%v is not a derivation", result)
+		}
+		p, err := drv.StorePath()
+		if err != nil {
+			return err
+		}
+		drvPaths = append(drvPaths, p)
+	}
+
+	var graph *storeGraph
+	if opts.runtime {
+		store := g.realisingStore(ctx)
+		outPaths, err := store.Realise(ctx, drvPaths...)
+		if err != nil {
+			return err
+		}
+		graph, err = newStoreGraph(outPaths, func(p nix.StorePath) ([]nix.StorePath, error) {
+			return store.QueryReferences(ctx, p)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		graph, err = newStoreGraph(drvPaths, func(p nix.StorePath) ([]nix.StorePath, error) {
+			drv, err := zb.ReadDerivationFromRoot(g.layout.root, p)
+			if err != nil {
+				return nil, err
+			}
+			return sortedInputDerivations(drv), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if err := write(out, graph); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// storeGraph is a directed graph of store objects.
+type storeGraph struct {
+	// nodes is the sorted list of store objects in the graph.
+	nodes []nix.StorePath
+	// edges maps a store object to the objects it depends on.
+	edges map[nix.StorePath][]nix.StorePath
+}
+
+// newStoreGraph builds the graph reachable from roots.
+// deps returns the direct dependencies of a store object.
+func newStoreGraph(roots []nix.StorePath, deps func(nix.StorePath) ([]nix.StorePath, error)) (*storeGraph, error) {
+	g := &storeGraph{edges: make(map[nix.StorePath][]nix.StorePath)}
+	stack := slices.Clone(roots)
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, visited := g.edges[p]; visited {
+			continue
+		}
+		pdeps, err := deps(p)
+		if err != nil {
+			return nil, err
+		}
+		// Self-references aren't interesting in a dependency graph.
+		pdeps = slices.DeleteFunc(slices.Clone(pdeps), func(dep nix.StorePath) bool {
+			return dep == p
+		})
+		slices.Sort(pdeps)
+		if pdeps == nil {
+			pdeps = []nix.StorePath{}
+		}
+		g.edges[p] = pdeps
+		g.nodes = append(g.nodes, p)
+		stack = append(stack, pdeps...)
+	}
+	slices.Sort(g.nodes)
+	return g, nil
+}
+
+func writeDOTGraph(w io.Writer, g *storeGraph) error {
+	if _, err := io.WriteString(w, "digraph G {\n"); err != nil {
+		return err
+	}
+	for _, p := range g.nodes {
+		_, err := fmt.Fprintf(w, "  %s [label=%s];\n", strconv.Quote(string(p)), strconv.Quote(p.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range g.nodes {
+		for _, dep := range g.edges[p] {
+			if _, err := fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(string(p)), strconv.Quote(string(dep))); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+func writeJSONGraph(w io.Writer, g *storeGraph) error {
+	type jsonNode struct {
+		Path nix.StorePath   `json:"path"`
+		Name string          `json:"name"`
+		Deps []nix.StorePath `json:"dependencies"`
+	}
+	nodes := make([]jsonNode, 0, len(g.nodes))
+	for _, p := range g.nodes {
+		nodes = append(nodes, jsonNode{
+			Path: p,
+			Name: p.Name(),
+			Deps: g.edges[p],
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"nodes": nodes})
+}
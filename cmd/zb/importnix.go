@@ -0,0 +1,104 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storeImportNixOptions struct {
+	paths   []string
+	dir     string
+	realDir string
+	db      string
+	all     bool
+}
+
+func newStoreImportNixCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "import-nix [options] PATH [...]",
+		Short: "import store objects from an existing Nix store",
+		Long: "Copy the closures of store objects (including store derivations) " +
+			"from an existing Nix store into zb's store and print their new paths. " +
+			"Paths are read from the source store's SQLite database " +
+			"and may be given as full store paths or as store object names. " +
+			"If the source store directory (--from) differs from zb's, " +
+			"references to it are rewritten, keeping each object's digest. " +
+			"If the two directories have different lengths, " +
+			"content-addressed objects get new paths. " +
+			"When zb's store directory is writable and on a file system that supports reflinks " +
+			"(such as Btrfs, XFS, or APFS), files are cloned from the source store instead of copied. " +
+			"--from-root imports from a store mounted somewhere other than its store directory, " +
+			"such as a chroot store.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeImportNixOptions)
+	c.Flags().StringVar(&opts.dir, "from", string(nix.DefaultStoreDirectory), "store directory of the source store")
+	c.Flags().StringVar(&opts.realDir, "from-root", "", "read the source store's objects from `dir` (defaults to --from)")
+	c.Flags().StringVar(&opts.db, "from-db", "", "read the source store's database from `path` (defaults to var/nix/db/db.sqlite next to the store directory)")
+	c.Flags().BoolVar(&opts.all, "all", false, "import every valid path in the source store")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		if len(args) == 0 && !opts.all {
+			return fmt.Errorf("no paths given (use --all to import everything)")
+		}
+		return runStoreImportNix(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreImportNix(ctx context.Context, g *globalConfig, opts *storeImportNixOptions) error {
+	srcDir, err := nix.CleanStoreDirectory(opts.dir)
+	if err != nil {
+		return fmt.Errorf("--from: %v", err)
+	}
+	src := &zbstore.NixSource{
+		Dir:     srcDir,
+		RealDir: opts.realDir,
+		DB:      opts.db,
+	}
+	var paths []nix.StorePath
+	if opts.all {
+		paths, err = src.ValidPaths(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	for _, arg := range opts.paths {
+		var p nix.StorePath
+		if strings.Contains(arg, "/") {
+			p, _, err = srcDir.ParsePath(arg)
+		} else {
+			p, err = srcDir.Object(arg)
+		}
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+	}
+
+	store := g.store()
+	store.Dir, err = nix.StoreDirectoryFromEnvironment()
+	if err != nil {
+		return err
+	}
+	imported, err := store.ImportNix(ctx, src, paths...)
+	if err != nil {
+		return err
+	}
+	for _, p := range imported {
+		fmt.Println(p)
+	}
+	g.recordAccess(ctx, imported...)
+	return nil
+}
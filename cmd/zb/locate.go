@@ -0,0 +1,197 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type locateOptions struct {
+	path string
+	json bool
+}
+
+func newLocateCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "locate [options] PATH",
+		Short: "find the packages that provide a file",
+		Long: "List the files indexed with zb index --files whose path ends with PATH, " +
+			"like bin/protoc, along with the package and store object that provides each one. " +
+			"PATH matches whole path elements. " +
+			"If PATH starts with a slash, it must match a file's whole path inside its store object.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(locateOptions)
+	c.Flags().BoolVar(&opts.json, "json", false, "print results as JSON, one per line")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.path = args[0]
+		return runLocate(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runLocate(ctx context.Context, g *globalConfig, opts *locateOptions) error {
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	files, err := db.LocateFile(ctx, opts.path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no indexed files match %s (run zb index --files to update the index)", opts.path)
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, f := range files {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, f := range files {
+		attrPath := f.AttrPath
+		if attrPath == "" {
+			attrPath = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s/%s", attrPath, objectModeString(f.Mode), f.StorePath, f.Path)
+		if f.Mode.Type() == fs.ModeSymlink {
+			fmt.Fprintf(tw, " -> %s", f.LinkTarget)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// fileIndexParallelism is the number of store objects
+// that zb index --files lists at once.
+const fileIndexParallelism = 16
+
+// appendFileIndexObjects appends the known output paths of the derivations in x
+// (found at the attribute path attrPath) to dst.
+// Outputs whose paths are not known until they are built are skipped.
+func appendFileIndexObjects(ctx context.Context, dst []*zbstore.IndexedObject, attrPath string, x any) []*zbstore.IndexedObject {
+	switch x := x.(type) {
+	case *zb.Derivation:
+		for _, outputName := range sortedKeys(x.Outputs) {
+			p, ok := x.Outputs[outputName].Path(x.Dir, x.Name, outputName)
+			if !ok {
+				log.Debugf(ctx, "Not indexing files of %s output %s: path not known", attrPath, outputName)
+				continue
+			}
+			dst = append(dst, &zbstore.IndexedObject{StorePath: p, AttrPath: attrPath})
+		}
+		return dst
+	case map[string]any:
+		for _, k := range sortedKeys(x) {
+			sub := k
+			if attrPath != "" {
+				sub = attrPath + "." + k
+			}
+			dst = appendFileIndexObjects(ctx, dst, sub, x[k])
+		}
+		return dst
+	default:
+		return dst
+	}
+}
+
+// listIndexObjects fills in the listings of the given objects
+// and returns the objects that could be listed.
+// If an object appears more than once, only the first is kept.
+// Objects in the local store are listed directly.
+// Otherwise, the object's .ls listing is downloaded from the configured substituters.
+// Objects that are in neither are skipped.
+func listIndexObjects(ctx context.Context, g *globalConfig, objects []*zbstore.IndexedObject) ([]*zbstore.IndexedObject, error) {
+	store := g.store()
+	subs, err := g.substituterClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zbstore.SortSubstituters(ctx, subs)
+
+	seen := make(map[nix.StorePath]struct{})
+	objects = slices.DeleteFunc(objects, func(obj *zbstore.IndexedObject) bool {
+		_, dup := seen[obj.StorePath]
+		seen[obj.StorePath] = struct{}{}
+		return dup
+	})
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fileIndexParallelism)
+	for _, obj := range objects {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			obj.Listing = listIndexObject(ctx, store, subs, obj.StorePath)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	n := len(objects)
+	objects = slices.DeleteFunc(objects, func(obj *zbstore.IndexedObject) bool {
+		return obj.Listing == nil
+	})
+	if skipped := n - len(objects); skipped > 0 {
+		log.Warnf(ctx, "No listings found for %d of %d outputs (build or push them to index their files)", skipped, n)
+	}
+	return objects, nil
+}
+
+// listIndexObject returns the listing of the store object at p
+// or nil if it cannot be found.
+func listIndexObject(ctx context.Context, store *zbstore.Store, subs []*zbstore.Substituter, p nix.StorePath) *nar.Listing {
+	if _, err := store.QueryPathInfo(ctx, p); err == nil {
+		ls, err := store.ListObject(ctx, p)
+		if err != nil {
+			log.Warnf(ctx, "%v", err)
+			return nil
+		}
+		return ls
+	} else if !errors.Is(err, zbstore.ErrNotFound) {
+		log.Warnf(ctx, "%v", err)
+		return nil
+	}
+	for _, sub := range subs {
+		ls, err := sub.Listing(ctx, p)
+		if errors.Is(err, zbstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf(ctx, "%v", err)
+			continue
+		}
+		return ls
+	}
+	log.Debugf(ctx, "Not indexing files of %s: no listing found", p)
+	return nil
+}
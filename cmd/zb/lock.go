@@ -0,0 +1,75 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/zb"
+)
+
+func newLockCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "lock COMMAND",
+		Short: "manage the project lockfile",
+		Long: "The lockfile (" + zb.LockfileName + ", next to the file passed to --file) " +
+			"records the revisions and hashes of the inputs declared with the input function " +
+			"and of the archives loaded with the import function (named by their URL). " +
+			"Evaluation adds inputs that are not yet in the lockfile " +
+			"(except with --pure-eval, where they are an error) " +
+			"and otherwise uses the recorded versions.",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(
+		newLockUpdateCommand(g),
+	)
+	return c
+}
+
+type lockUpdateOptions struct {
+	evalOptions
+	inputs []string
+}
+
+func newLockUpdateCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "update [options] [INPUT [...]]",
+		Short: "resolve inputs to their latest versions",
+		Long: "Evaluate the project and record the latest versions of the named inputs in the lockfile. " +
+			"With no INPUTs, all inputs in the lockfile are updated.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(lockUpdateOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.inputs = args
+		return runLockUpdate(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runLockUpdate(ctx context.Context, g *globalConfig, opts *lockUpdateOptions) error {
+	inputs := opts.inputs
+	if len(inputs) == 0 {
+		lf, err := zb.ReadLockfile(lockfilePath(&opts.evalOptions))
+		if err != nil {
+			return err
+		}
+		inputs = sortedKeys(lf.Inputs)
+	}
+
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	// Resolving inputs is inherently impure.
+	eval.SetPureEval(false)
+	eval.UpdateInputs(inputs...)
+	_, err := evaluate(eval, &opts.evalOptions)
+	return err
+}
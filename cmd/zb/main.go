@@ -5,25 +5,325 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/trace"
 	"zombiezen.com/go/bass/sigterm"
 	"zombiezen.com/go/log"
 	"zombiezen.com/go/nix"
 	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/internal/spans"
+	"zombiezen.com/go/zb/zbstore"
 )
 
 type globalConfig struct {
-	// global options go here
+	// debug is whether to show debugging output.
+	debug bool
+	// trackAccess is whether to record when store objects are used
+	// and the time and resources that builds use.
+	trackAccess bool
+	// extraPlatforms is the list of system types other than the host's
+	// that may be built locally.
+	extraPlatforms []string
+	// sandboxPaths is the list of additional paths visible to builders.
+	sandboxPaths []string
+	// autoOptimise is whether to deduplicate files as they are added to the store.
+	autoOptimise bool
+	// layout is where the store's objects are kept.
+	layout storeLayout
+	// storeSocket is the path to the zb serve daemon's socket.
+	// If empty, builds are run directly.
+	storeSocket string
+	// pathCacheMode is how source imports are skipped.
+	pathCacheMode zb.PathCacheMode
+	// system is the system type that evaluation targets.
+	system string
+	// substituters and trustedPublicKeys configure where store objects
+	// can be downloaded from instead of built.
+	substituters      []string
+	trustedPublicKeys []string
+	// accessTokens, netrcFile, clientCertificate, and clientKey
+	// are the credentials used to access substituters.
+	accessTokens      map[string]string
+	netrcFile         string
+	clientCertificate string
+	clientKey         string
+	// downloadSegments is the number of parallel range requests
+	// used to download a large NAR from a substituter.
+	downloadSegments int
+	// peerSubstitution is whether to download store objects
+	// from binary caches discovered on the local network.
+	// peers is the result of discovery, filled in by peerSubstituters.
+	peerSubstitution bool
+	peersOnce        sync.Once
+	peers            []string
+	// ipfsSubstitution is whether zb build downloads outputs
+	// from the IPFS CIDs recorded in realizations.
+	// ipfsGateway is the IPFS HTTP gateway used for IPFS downloads.
+	ipfsSubstitution bool
+	ipfsGateway      string
+	// fallback is the default for zb build --fallback.
+	fallback bool
+	// substituterClientsOnce guards the result of substituterClients.
+	substituterClientsOnce   sync.Once
+	substituterClientsResult []*zbstore.Substituter
+	substituterClientsErr    error
+	// narInfoPositiveTTL and narInfoNegativeTTL are how long
+	// substituter lookups are remembered (see [zbstore.NARInfoCache]).
+	narInfoPositiveTTL time.Duration
+	narInfoNegativeTTL time.Duration
+	// maxJobs is the maximum number of parallel builds.
+	// Zero means the backend's default.
+	maxJobs int
+	// sandbox is the backend's sandbox mode.
+	// Empty means the backend's default.
+	sandbox string
+	// pureEval is whether evaluation is restricted to reproducible operations.
+	pureEval bool
+	// lint is whether to warn about likely impurities in new derivations.
+	lint bool
+	// evalMemoryLimit is the evaluator's memory limit in mebibytes.
+	// Zero means no limit.
+	evalMemoryLimit int64
+	// evalInstructionLimit is the number of Lua instructions
+	// an evaluation may execute.
+	// Zero means no limit.
+	evalInstructionLimit int64
+	// suppressWarnings is the list of evaluation warning categories to hide.
+	suppressWarnings []string
+	// failedBuildTTL is how long zb build remembers that a derivation failed to build.
+	// Zero means failures are not remembered.
+	failedBuildTTL time.Duration
+	// allowLicenses and denyLicenses are the evaluator's license policy.
+	allowLicenses []string
+	denyLicenses  []string
+}
+
+// store returns a handle to the store configured by the global options.
+// It does not use peer substituters;
+// commands that realise store objects should use [globalConfig.realisingStore].
+func (g *globalConfig) store() *zbstore.Store {
+	store := &zbstore.Store{
+		Dir:                g.layout.dir,
+		Root:               g.layout.root,
+		ExtraPlatforms:     g.extraPlatforms,
+		SandboxPaths:       g.sandboxPaths,
+		AutoOptimise:       g.autoOptimise,
+		Substituters:       g.backendSubstituters(),
+		TrustedPublicKeys:  g.trustedPublicKeys,
+		NARInfoPositiveTTL: g.narInfoPositiveTTL,
+		NARInfoNegativeTTL: g.narInfoNegativeTTL,
+		NetrcFile:          g.netrcFile,
+		MaxJobs:            g.maxJobs,
+		Sandbox:            g.sandbox,
+		Socket:             g.storeSocket,
+	}
+	if g.layout.upperLayer != "" {
+		store.Lower = &zbstore.Store{
+			Dir:  g.layout.dir,
+			Root: g.layout.lowerRoot,
+		}
+		store.UpperLayer = g.layout.upperLayer
+	}
+	if g.trackAccess {
+		store.BuildStats = recordBuildStats
+	}
+	return store
+}
+
+// realisingStore returns a handle to the store configured by the global options
+// that also substitutes from any peers on the local network
+// (see [globalConfig.peerSubstituters]).
+func (g *globalConfig) realisingStore(ctx context.Context) *zbstore.Store {
+	store := g.store()
+	store.ExtraSubstituters = g.peerSubstituters(ctx)
+	return store
+}
+
+// storeLayout is where the store's objects are kept in the local file system.
+type storeLayout struct {
+	// dir is the store directory that store paths are computed against.
+	dir nix.StoreDirectory
+	// root is the directory in the local file system
+	// that holds the store in place of the file system root.
+	// If empty, the store is at dir.
+	root string
+	// lowerRoot and upperLayer describe the read-only lower layer
+	// of an overlay store (see [zbstore.Store.Lower]).
+	// If upperLayer is empty, the store has no lower layer.
+	lowerRoot  string
+	upperLayer string
+}
+
+// parseStoreSetting parses the value of the --store flag:
+// a store directory optionally followed by a query string
+// with the parameters:
+//
+//   - real: the directory in the local file system that holds the store
+//     in place of the file system root,
+//     like "/zb/store?real=/home/me/zbroot".
+//   - lower and upper: the directory that holds a read-only lower store
+//     in place of the file system root
+//     and the directory that new store objects are written to.
+//     The store directory must be an overlay mount of the two layers.
+func parseStoreSetting(s string) (*storeLayout, error) {
+	dirPart, query, _ := strings.Cut(s, "?")
+	dir, err := nix.CleanStoreDirectory(dirPart)
+	if err != nil {
+		return nil, err
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for k := range params {
+		if k != "real" && k != "lower" && k != "upper" {
+			return nil, fmt.Errorf("unknown store parameter %q", k)
+		}
+	}
+	layout := &storeLayout{dir: dir}
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{
+		{"real", &layout.root},
+		{"lower", &layout.lowerRoot},
+		{"upper", &layout.upperLayer},
+	} {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		if !filepath.IsAbs(v) {
+			return nil, fmt.Errorf("%s store location %s is not absolute", p.name, v)
+		}
+		*p.dst = filepath.Clean(v)
+	}
+	if (layout.lowerRoot == "") != (layout.upperLayer == "") {
+		return nil, fmt.Errorf("lower and upper must be given together")
+	}
+	return layout, nil
+}
+
+// storeDerivationReader returns a function that reads store derivations
+// from the local file system location of store.
+func storeDerivationReader(store *zbstore.Store) func(nix.StorePath) (*zb.Derivation, error) {
+	return func(p nix.StorePath) (*zb.Derivation, error) {
+		return zb.ReadDerivationFromRoot(store.Root, p)
+	}
+}
+
+// recordBuildStats saves the statistics of a build in the zb database
+// for zb store build-stats.
+// Failures are logged rather than returned,
+// since the database is advisory.
+func recordBuildStats(stats *zbstore.BuildStats) {
+	ctx := context.Background()
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		log.Warnf(ctx, "Recording build time: %v", err)
+		return
+	}
+	defer db.Close()
+	if err := db.RecordBuild(ctx, stats); err != nil {
+		log.Warnf(ctx, "Recording build time: %v", err)
+	}
+}
+
+// newEval returns a new evaluator configured by the global options.
+// The evaluator's trace spans descend from ctx.
+func (g *globalConfig) newEval(ctx context.Context) *zb.Eval {
+	eval := zb.NewEval(g.layout.dir)
+	eval.SetContext(ctx)
+	eval.SetStoreRoot(g.layout.root)
+	eval.SetLowerStore(g.layout.lowerRoot, g.layout.upperLayer)
+	eval.SetAutoOptimise(g.autoOptimise)
+	eval.SetPathCacheMode(g.pathCacheMode)
+	eval.SetSystem(g.system)
+	eval.SetPureEval(g.pureEval)
+	eval.SetLint(g.lint)
+	eval.SetMemoryLimit(g.evalMemoryLimit << 20)
+	eval.SetInstructionLimit(g.evalInstructionLimit)
+	eval.SuppressWarnings(g.suppressWarnings...)
+	if len(g.allowLicenses) > 0 || len(g.denyLicenses) > 0 {
+		eval.SetLicensePolicy(&zb.LicensePolicy{
+			Allow: g.allowLicenses,
+			Deny:  g.denyLicenses,
+		})
+	}
+	return eval
+}
+
+// addEmulatedPlatforms adds the systems that the host's binfmt_misc emulators can run
+// to the extra platforms,
+// and makes the emulators visible to builders if necessary.
+func (g *globalConfig) addEmulatedPlatforms(ctx context.Context) error {
+	emulators, err := zbstore.Emulators(zbstore.DefaultBinfmtDir)
+	if err != nil {
+		return err
+	}
+	host := zbstore.HostSystem()
+	systems := zbstore.EmulatedSystems(host, emulators)
+	if len(systems) == 0 {
+		log.Warnf(ctx, "--emulate: no binfmt_misc emulators registered")
+		return nil
+	}
+	for _, system := range systems {
+		if !slices.Contains(g.extraPlatforms, system) {
+			g.extraPlatforms = append(g.extraPlatforms, system)
+		}
+	}
+	for _, emu := range emulators {
+		if slices.Contains(systems, emu.System) && !emu.FixBinary && emu.Interpreter != "" {
+			g.sandboxPaths = append(g.sandboxPaths, emu.Interpreter)
+		}
+	}
+	log.Debugf(ctx, "Emulating %s", strings.Join(systems, ", "))
+	return nil
+}
+
+// recordAccess notes in the zb database that the given paths were just used
+// and saves their metadata, if access tracking is enabled.
+// Failures are logged rather than returned,
+// since the database is advisory.
+func (g *globalConfig) recordAccess(ctx context.Context, paths ...nix.StorePath) {
+	if !g.trackAccess || len(paths) == 0 {
+		return
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		log.Warnf(ctx, "Recording access times: %v", err)
+		return
+	}
+	defer db.Close()
+	if err := db.Touch(ctx, time.Now(), paths...); err != nil {
+		log.Warnf(ctx, "Recording access times: %v", err)
+	}
+	infos, err := g.store().QueryPathInfos(ctx, paths...)
+	if err != nil {
+		log.Debugf(ctx, "Recording metadata: %v", err)
+	}
+	if err := db.RecordPathInfos(ctx, infos); err != nil {
+		log.Warnf(ctx, "Recording metadata: %v", err)
+	}
 }
 
 func main() {
+	runSelfExtracting()
+
 	rootCommand := &cobra.Command{
 		Use:           "zb",
 		Short:         "zombiezen build",
@@ -32,33 +332,170 @@ func main() {
 	}
 
 	g := new(globalConfig)
-	showDebug := rootCommand.PersistentFlags().Bool("debug", false, "show debugging output")
+	cfg, cfgErr := loadConfig(configLayers())
+	shutdownTracing, tracingErr := initTracing(context.Background())
+	rootCommand.PersistentFlags().BoolVar(&g.debug, "debug", false, "show debugging output")
+	rootCommand.PersistentFlags().StringSliceVar(&g.extraPlatforms, "extra-platforms", cfg.ExtraPlatforms, "allow building derivations for `system`s other than the host's "+
+		"in addition to the extra-platforms setting in nix.conf")
+	rootCommand.PersistentFlags().BoolVar(&g.autoOptimise, "auto-optimise", cfg.AutoOptimise, "hard-link identical files as store objects are added (see zb store optimise)")
+	rootCommand.PersistentFlags().BoolVar(&g.trackAccess, "track-access", cfg.TrackAccess, "record when store objects are used and how long builds take (for zb store stats and zb store build-stats)")
+	rootCommand.PersistentFlags().StringVar(&g.system, "system", zbstore.HostSystem(), "evaluate for and select results for `system` (exposed to Lua as currentSystem)")
+	storeSetting := rootCommand.PersistentFlags().String("store", cfg.Store, "use the store at `dir`; add ?real=root to keep its objects under the directory root instead, or ?lower=root&upper=layer to layer it over a read-only store (defaults to $ZB_STORE)")
+	rootCommand.PersistentFlags().StringVar(&g.storeSocket, "store-socket", cfg.StoreSocket, "send builds to the zb serve daemon listening on `socket` (defaults to $ZB_DAEMON_SOCKET)")
+	rootCommand.PersistentFlags().IntVar(&g.maxJobs, "max-jobs", cfg.MaxJobs, "run at most `n` builds in parallel")
+	rootCommand.PersistentFlags().StringSliceVar(&g.allowLicenses, "allow-license", strings.Fields(os.Getenv("ZB_ALLOWED_LICENSES")), "fail evaluation if results depend on derivations whose licenses are not one of the SPDX `license`s (defaults to $ZB_ALLOWED_LICENSES)")
+	rootCommand.PersistentFlags().StringSliceVar(&g.denyLicenses, "deny-license", strings.Fields(os.Getenv("ZB_DENIED_LICENSES")), "fail evaluation if results depend on derivations with the SPDX `license` (defaults to $ZB_DENIED_LICENSES)")
+	pathCache := rootCommand.PersistentFlags().String("path-cache", cfg.PathCache, "how to skip importing unchanged sources: `mode` is stamp (file metadata) or content (file contents) (defaults to $ZB_PATH_CACHE)")
+	rootCommand.PersistentFlags().BoolVar(&g.pureEval, "pure-eval", cfg.PureEval, "forbid reading files outside the project, environment variables, and unpinned fetches during evaluation")
+	rootCommand.PersistentFlags().BoolVar(&g.lint, "lint", false, "warn about derivation environment values that look impure, like host paths and timestamps")
+	rootCommand.PersistentFlags().Int64Var(&g.evalMemoryLimit, "eval-memory-limit", cfg.EvalMemoryLimit, "fail evaluation if Lua uses more than `MiB` mebibytes of memory (0 for no limit)")
+	rootCommand.PersistentFlags().Int64Var(&g.evalInstructionLimit, "eval-instruction-limit", cfg.EvalInstructions, "fail evaluation after executing `n` Lua instructions (0 for no limit)")
+	rootCommand.PersistentFlags().StringSliceVar(&g.suppressWarnings, "suppress-warnings", cfg.SuppressWarnings, "hide evaluation warnings in the `category` (like deprecated), or all warnings if category is all")
+	impure := rootCommand.PersistentFlags().Bool("impure", false, "allow impure operations during evaluation even if pure-eval is configured")
+	emulate := rootCommand.PersistentFlags().Bool("emulate", false, "allow building derivations for systems that binfmt_misc emulators (like QEMU) can run")
+	g.sandboxPaths = cfg.SandboxPaths
+	g.substituters = cfg.Substituters
+	g.trustedPublicKeys = cfg.TrustedPublicKeys
+	g.accessTokens, _ = cfg.accessTokens()
+	g.netrcFile = cfg.NetrcFile
+	g.clientCertificate = cfg.ClientCertificate
+	g.clientKey = cfg.ClientKey
+	g.peerSubstitution = cfg.PeerSubstitution
+	g.ipfsSubstitution = cfg.IPFSSubstitution
+	g.ipfsGateway = cfg.IPFSGateway
+	g.fallback = cfg.Fallback
+	g.narInfoPositiveTTL, g.narInfoNegativeTTL, _ = cfg.narInfoTTLs()
+	g.downloadSegments = cfg.DownloadSegments
+	if g.downloadSegments == 0 {
+		g.downloadSegments = defaultDownloadSegments
+	}
+	g.sandbox = cfg.Sandbox
+	g.failedBuildTTL, _ = cfg.failedBuildTTL()
 	rootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		initLogging(*showDebug)
+		initLogging(g.debug)
+		trace.SpanFromContext(cmd.Context()).SetName(cmd.CommandPath())
+		if tracingErr != nil {
+			log.Warnf(cmd.Context(), "Tracing disabled: %v", tracingErr)
+		}
+		if cfgErr != nil {
+			return cfgErr
+		}
+		if g.evalMemoryLimit < 0 {
+			return fmt.Errorf("--eval-memory-limit must not be negative")
+		}
+		if g.evalInstructionLimit < 0 {
+			return fmt.Errorf("--eval-instruction-limit must not be negative")
+		}
+		if *impure {
+			if cmd.Flags().Changed("pure-eval") && g.pureEval {
+				return fmt.Errorf("cannot pass both --pure-eval and --impure")
+			}
+			g.pureEval = false
+		}
+		if *emulate {
+			if err := g.addEmulatedPlatforms(cmd.Context()); err != nil {
+				return err
+			}
+		}
+		g.layout = storeLayout{dir: nix.DefaultStoreDirectory}
+		if *storeSetting != "" {
+			layout, err := parseStoreSetting(*storeSetting)
+			if err != nil {
+				return fmt.Errorf("--store: %v", err)
+			}
+			g.layout = *layout
+		}
+		if *pathCache != "" {
+			var err error
+			g.pathCacheMode, err = zb.ParsePathCacheMode(*pathCache)
+			if err != nil {
+				return fmt.Errorf("--path-cache: %v", err)
+			}
+		}
 		return nil
 	}
 
 	rootCommand.AddCommand(
 		newBuildCommand(g),
+		newBundleCommand(g),
+		newConfigCommand(cfg),
 		newEvalCommand(g),
+		newEvalDaemonCommand(g),
+		newExportCommand(g),
+		newGCCommand(g),
+		newGraphCommand(g),
+		newIndexCommand(g),
+		newLocateCommand(g),
+		newLockCommand(g),
+		newRunCommand(g),
+		newSBOMCommand(g),
+		newSearchCommand(g),
+		newServeCommand(g),
+		newShellCommand(g),
+		newStoreCommand(g),
+		newTestCommand(g),
+		newVerifyEvalCommand(g),
+		newWhyDependsCommand(g),
+		newWhyRebuildCommand(g),
 	)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), sigterm.Signals()...)
+	ctx, span := tracer.Start(traceParentContext(ctx), "zb")
 	err := rootCommand.ExecuteContext(ctx)
+	spans.End(span, err)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		initLogging(g.debug)
+		log.Warnf(context.Background(), "Exporting traces: %v", err)
+	}
+	cancelShutdown()
 	cancel()
 	if err != nil {
-		initLogging(*showDebug)
+		// Commands that run a subprocess pass through its exit code.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.Exited() {
+			os.Exit(exitErr.ExitCode())
+		}
+		initLogging(g.debug)
 		log.Errorf(context.Background(), "%v", err)
 		os.Exit(1)
 	}
 }
 
+// selectSystem returns the element of a table of evaluation results keyed by system type
+// if x is such a table.
+// Otherwise, selectSystem returns x unchanged.
+func selectSystem(x any, system string) (any, error) {
+	m, ok := x.(map[string]any)
+	if !ok {
+		return x, nil
+	}
+	for k := range m {
+		// System types are of the form "arch-os", like "x86_64-linux".
+		arch, kernel, ok := strings.Cut(k, "-")
+		if !ok || arch == "" || kernel == "" || strings.Contains(kernel, "-") {
+			return x, nil
+		}
+	}
+	v, ok := m[system]
+	if !ok {
+		return nil, fmt.Errorf("no result for %s (available: %s)", system, strings.Join(sortedKeys(m), ", "))
+	}
+	return v, nil
+}
+
 type evalOptions struct {
 	expr         string
 	file         string
 	installables []string
 }
 
+type evalCommandOptions struct {
+	evalOptions
+	json       bool
+	evalServer string
+}
+
 func newEvalCommand(g *globalConfig) *cobra.Command {
 	c := &cobra.Command{
 		Use:                   "eval [options] [INSTALLABLE [...]]",
@@ -68,9 +505,11 @@ func newEvalCommand(g *globalConfig) *cobra.Command {
 		SilenceErrors:         true,
 		SilenceUsage:          true,
 	}
-	opts := new(evalOptions)
-	c.Flags().StringVar(&opts.expr, "expr", "", "interpret installables as attribute paths relative to the Lua expression `expr`")
-	c.Flags().StringVar(&opts.file, "file", "", "interpret installables as attribute paths relative to the Lua expression stored in `path`")
+	opts := new(evalCommandOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().BoolVar(&opts.json, "json", false, "print results as JSON, one per line")
+	c.Flags().StringVar(&opts.evalServer, "eval-server", "", "send the evaluation to the zb eval-daemon listening on `socket`")
+	c.Flags().Lookup("eval-server").NoOptDefVal = defaultEvalSocket()
 	c.RunE = func(cmd *cobra.Command, args []string) error {
 		opts.installables = args
 		return runEval(cmd.Context(), g, opts)
@@ -78,134 +517,163 @@ func newEvalCommand(g *globalConfig) *cobra.Command {
 	return c
 }
 
-func runEval(ctx context.Context, g *globalConfig, opts *evalOptions) error {
-	eval := zb.NewEval(nix.DefaultStoreDirectory)
+func addEvalFlags(c *cobra.Command, opts *evalOptions) {
+	c.Flags().StringVar(&opts.expr, "expr", "", "interpret installables as attribute paths relative to the Lua expression `expr`")
+	c.Flags().StringVar(&opts.file, "file", "", "interpret installables as attribute paths relative to the Lua expression stored in `path`")
+}
 
-	var results []any
-	var err error
+// evaluate evaluates the installables given in opts.
+// Inputs resolved during evaluation are saved to the project's lockfile.
+func evaluate(eval *zb.Eval, opts *evalOptions) ([]any, error) {
 	switch {
 	case opts.expr != "" && opts.file != "":
-		return fmt.Errorf("can specify at most one of --expr or --file")
-	case opts.expr != "":
+		return nil, fmt.Errorf("can specify at most one of --expr or --file")
+	case opts.expr == "" && opts.file == "":
+		return nil, fmt.Errorf("installables not supported yet")
+	}
+	if err := eval.SetLockfile(lockfilePath(opts)); err != nil {
+		return nil, err
+	}
+	var results []any
+	var err error
+	if opts.expr != "" {
 		results, err = eval.Expression(opts.expr, opts.installables)
-	case opts.file != "":
+	} else {
 		results, err = eval.File(opts.file, opts.installables)
-	default:
-		return fmt.Errorf("installables not supported yet")
+	}
+	for _, w := range eval.Warnings() {
+		log.Warnf(context.Background(), "%v", w)
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	for _, result := range results {
-		fmt.Println(result)
+	if err := eval.SaveLockfile(); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return results, nil
 }
 
-type buildOptions struct {
-	evalOptions
-	outLink string
+// lockfilePath returns the path of the lockfile for the evaluation described by opts:
+// the lockfile next to the file given by --file,
+// or the lockfile in the working directory for --expr.
+func lockfilePath(opts *evalOptions) string {
+	if opts.file == "" {
+		return zb.LockfileName
+	}
+	return filepath.Join(filepath.Dir(opts.file), zb.LockfileName)
 }
 
-func newBuildCommand(g *globalConfig) *cobra.Command {
-	c := &cobra.Command{
-		Use:                   "build [options] [INSTALLABLE [...]]",
-		Short:                 "build one or more derivations",
-		DisableFlagsInUseLine: true,
-		Args:                  cobra.ArbitraryArgs,
-		SilenceErrors:         true,
-		SilenceUsage:          true,
-	}
-	opts := new(buildOptions)
-	c.Flags().StringVar(&opts.expr, "expr", "", "interpret installables as attribute paths relative to the Lua expression `expr`")
-	c.Flags().StringVar(&opts.file, "file", "", "interpret installables as attribute paths relative to the Lua expression stored in `path`")
-	c.Flags().StringVarP(&opts.outLink, "out-link", "o", "result", "change the name of the output path symlink to `path`")
-	c.RunE = func(cmd *cobra.Command, args []string) error {
-		opts.installables = args
-		return runBuild(cmd.Context(), g, opts)
+func runEval(ctx context.Context, g *globalConfig, opts *evalCommandOptions) error {
+	if opts.evalServer != "" {
+		results, err := evalRemote(ctx, opts.evalServer, &opts.evalOptions)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			var s string
+			if !opts.json && json.Unmarshal(result, &s) == nil {
+				fmt.Println(s)
+			} else {
+				fmt.Printf("%s\n", result)
+			}
+		}
+		return nil
 	}
-	return c
-}
 
-func runBuild(ctx context.Context, g *globalConfig, opts *buildOptions) error {
-	eval := zb.NewEval(nix.DefaultStoreDirectory)
+	eval := g.newEval(ctx)
 
-	var results []any
-	var err error
-	switch {
-	case opts.expr != "" && opts.file != "":
-		return fmt.Errorf("can specify at most one of --expr or --file")
-	case opts.expr != "":
-		results, err = eval.Expression(opts.expr, opts.installables)
-	case opts.file != "":
-		results, err = eval.File(opts.file, opts.installables)
-	default:
-		return fmt.Errorf("installables not supported yet")
-	}
+	results, err := evaluate(eval, &opts.evalOptions)
 	if err != nil {
 		return err
 	}
-	if len(results) == 0 {
-		return fmt.Errorf("no evaluation results")
-	}
 
-	args := []string{"--realise"}
-	if opts.outLink != "" {
-		args = append(args, "--add-root", opts.outLink)
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, result := range results {
+			v, err := toJSONValue(result)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	args = append(args, "--")
 	for _, result := range results {
-		drv, _ := result.(*zb.Derivation)
-		if drv == nil {
-			return fmt.Errorf("%v is not a derivation", result)
+		fmt.Println(result)
+	}
+
+	return nil
+}
+
+// toJSONValue converts an evaluation result to a value
+// that can be passed to [json.Marshal].
+// Derivations are converted to their store derivation paths.
+func toJSONValue(x any) (any, error) {
+	switch x := x.(type) {
+	case nil, bool, int64, string:
+		return x, nil
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			return nil, fmt.Errorf("cannot represent %v in JSON", x)
 		}
-		p, err := drv.StorePath()
+		return x, nil
+	case *zb.Derivation:
+		p, err := x.StorePath()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		args = append(args, string(p))
-	}
-
-	stdout := new(strings.Builder)
-	c := exec.CommandContext(ctx, "nix-store", args...)
-	if opts.outLink == "" {
-		c.Stdout = os.Stdout
-	} else {
-		c.Stdout = stdout
-	}
-	c.Stderr = os.Stderr
-	if err := c.Run(); err != nil {
-		return fmt.Errorf("nix-store --realise: %v", err)
-	}
-	if opts.outLink != "" {
-		outLinks := strings.FieldsFunc(stdout.String(), func(c rune) bool {
-			return c == '\n'
-		})
-		for _, out := range outLinks {
-			target, err := os.Readlink(out)
+		return string(p), nil
+	case []any:
+		arr := make([]any, 0, len(x))
+		for i, elem := range x {
+			v, err := toJSONValue(elem)
 			if err != nil {
-				fmt.Println(out)
-			} else {
-				fmt.Println(target)
+				return nil, fmt.Errorf("#%d: %v", i+1, err)
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k, elem := range x {
+			v, err := toJSONValue(elem)
+			if err != nil {
+				return nil, fmt.Errorf("[%q]: %v", k, err)
 			}
+			m[k] = v
 		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("cannot represent %T in JSON", x)
 	}
-	return nil
 }
 
 var initLogOnce sync.Once
 
+func sortedKeys[M ~map[string]V, V any](m M) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
 func initLogging(showDebug bool) {
 	initLogOnce.Do(func() {
-		minLogLevel := log.Info
-		if showDebug {
-			minLogLevel = log.Debug
-		}
 		log.SetDefault(&log.LevelFilter{
-			Min:    minLogLevel,
+			Min:    minLogLevel(showDebug),
 			Output: log.New(os.Stderr, "zb: ", log.StdFlags, nil),
 		})
 	})
 }
+
+func minLogLevel(showDebug bool) log.Level {
+	if showDebug {
+		return log.Debug
+	}
+	return log.Info
+}
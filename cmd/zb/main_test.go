@@ -0,0 +1,146 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+)
+
+func TestToJSONValue(t *testing.T) {
+	drv := &zb.Derivation{
+		Dir:     nix.DefaultStoreDirectory,
+		Name:    "hello",
+		System:  "x86_64-linux",
+		Builder: "/bin/sh",
+		Outputs: map[string]*zb.DerivationOutput{
+			"out": zb.RecursiveFileFloatingCAOutput(nix.SHA256),
+		},
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drvPathJSON, err := json.Marshal(string(drvPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outPlaceholder := zb.UnknownCAOutputPlaceholder(drvPath, "out")
+	outPlaceholderJSON, err := json.Marshal("PATH=" + outPlaceholder + "/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		x       any
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Nil",
+			x:    nil,
+			want: `null`,
+		},
+		{
+			name: "False",
+			x:    false,
+			want: `false`,
+		},
+		{
+			name: "Integer",
+			x:    int64(42),
+			want: `42`,
+		},
+		{
+			name: "Float",
+			x:    3.5,
+			want: `3.5`,
+		},
+		{
+			name:    "Infinity",
+			x:       math.Inf(1),
+			wantErr: true,
+		},
+		{
+			name:    "NaN",
+			x:       math.NaN(),
+			wantErr: true,
+		},
+		{
+			name: "String",
+			x:    "Hello, World!",
+			want: `"Hello, World!"`,
+		},
+		{
+			name: "StringWithContext",
+			x:    "PATH=" + outPlaceholder + "/bin",
+			want: string(outPlaceholderJSON),
+		},
+		{
+			name: "Derivation",
+			x:    drv,
+			want: string(drvPathJSON),
+		},
+		{
+			name: "Array",
+			x:    []any{int64(1), "two", drv},
+			want: `[1,"two",` + string(drvPathJSON) + `]`,
+		},
+		{
+			name: "Table",
+			x: map[string]any{
+				"enabled": true,
+				"drv":     drv,
+				"nested":  map[string]any{"list": []any{}},
+			},
+			want: `{"drv":` + string(drvPathJSON) + `,"enabled":true,"nested":{"list":[]}}`,
+		},
+		{
+			name:    "ArrayWithBadElement",
+			x:       []any{int64(1), math.NaN()},
+			wantErr: true,
+		},
+		{
+			name:    "TableWithBadElement",
+			x:       map[string]any{"x": math.Inf(-1)},
+			wantErr: true,
+		},
+		{
+			name:    "DerivationWithoutName",
+			x:       &zb.Derivation{Dir: nix.DefaultStoreDirectory},
+			wantErr: true,
+		},
+		{
+			name:    "UnsupportedType",
+			x:       struct{}{},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := toJSONValue(test.x)
+			if err != nil {
+				if !test.wantErr {
+					t.Fatal("toJSONValue:", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Fatalf("toJSONValue(...) = %#v, <nil>; want error", v)
+			}
+			got, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("json.Marshal(toJSONValue(...)) = %s; want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storeMountOptions struct {
+	mountpoint string
+	cacheDir   string
+}
+
+func newStoreMountCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "mount [options] DIR",
+		Short: "mount the objects available from substituters as a lazy store",
+		Long: "Mount a read-only FUSE file system at DIR " +
+			"that presents the store objects available from the configured substituters. " +
+			"Each object is downloaded the first time it is accessed " +
+			"and kept in the --cache-dir directory, " +
+			"so programs in a large closure can start before the whole closure has been downloaded. " +
+			"DIR is usually the store directory, for example inside a private mount namespace. " +
+			"The file system is unmounted when zb store mount is interrupted. " +
+			"Only Linux is supported.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeMountOptions)
+	defaultCacheDir := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		defaultCacheDir = filepath.Join(dir, "zb", "lazy")
+	}
+	c.Flags().StringVar(&opts.cacheDir, "cache-dir", defaultCacheDir, "keep downloaded store objects in `dir`")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.mountpoint = args[0]
+		return runStoreMount(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreMount(ctx context.Context, g *globalConfig, opts *storeMountOptions) error {
+	if opts.cacheDir == "" {
+		return fmt.Errorf("--cache-dir not set")
+	}
+	subs, err := g.substituterClients(ctx)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return fmt.Errorf("no substituters configured")
+	}
+	zbstore.SortSubstituters(ctx, subs)
+	ls := &zbstore.LazyStore{
+		Dir:          g.layout.dir,
+		Substituters: subs,
+		CacheDir:     opts.cacheDir,
+	}
+	return ls.Mount(ctx, opts.mountpoint)
+}
+
+// cacheAuth returns the credentials for accessing substituters.
+func (g *globalConfig) cacheAuth(ctx context.Context) *zbstore.CacheAuth {
+	auth := &zbstore.CacheAuth{
+		Tokens:   g.accessTokens,
+		CertFile: g.clientCertificate,
+		KeyFile:  g.clientKey,
+	}
+	netrcFile := g.netrcFile
+	if netrcFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			netrcFile = filepath.Join(home, ".netrc")
+		}
+	}
+	if netrcFile != "" {
+		if data, err := os.ReadFile(netrcFile); err == nil {
+			auth.Netrc, err = zbstore.ParseNetrc(data)
+			if err != nil {
+				log.Warnf(ctx, "%s: %v", netrcFile, err)
+			}
+		} else if g.netrcFile != "" {
+			log.Warnf(ctx, "Reading netrc file: %v", err)
+		}
+	}
+	return auth
+}
+
+// defaultDownloadSegments is the default value of the download-segments setting.
+const defaultDownloadSegments = 4
+
+// peerDiscoveryTimeout is how long to wait for binary caches on the local network
+// to respond.
+const peerDiscoveryTimeout = 500 * time.Millisecond
+
+// peerSubstituters returns the URLs of the binary caches
+// advertised on the local network
+// if peer-substitution is enabled.
+// Discovery happens at most once per process.
+// Peers are only used if trusted public keys are configured,
+// since their objects would otherwise be accepted without verifying signatures.
+func (g *globalConfig) peerSubstituters(ctx context.Context) []string {
+	if !g.peerSubstitution {
+		return nil
+	}
+	g.peersOnce.Do(func() {
+		if len(g.trustedPublicKeys) == 0 {
+			log.Warnf(ctx, "Ignoring peer-substitution because trusted-public-keys is not set")
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, peerDiscoveryTimeout)
+		defer cancel()
+		var err error
+		g.peers, err = zbstore.DiscoverPeers(ctx, g.layout.dir)
+		if err != nil {
+			log.Warnf(ctx, "Peer substitution: %v", err)
+		}
+		for _, u := range g.peers {
+			log.Debugf(ctx, "Found peer binary cache %s", u)
+		}
+	})
+	return g.peers
+}
+
+// substituterClients returns clients for the configured substituters,
+// preceded by any peers on the local network (see [globalConfig.peerSubstituters]).
+// If trusted public keys are configured,
+// the clients only accept objects signed by one of them.
+// Requests are authenticated with the configured access tokens,
+// the netrc file (~/.netrc by default), and client certificate.
+// The clients share a chunk store in the user's cache directory
+// so that NARs served as chunks only download new chunks,
+// and a [zbstore.NARInfoCache] so that repeated lookups
+// do not contact the substituters again.
+// The cache stays open for the rest of the process.
+// The clients are created once and shared by later calls.
+func (g *globalConfig) substituterClients(ctx context.Context) ([]*zbstore.Substituter, error) {
+	g.substituterClientsOnce.Do(func() {
+		g.substituterClientsResult, g.substituterClientsErr = g.newSubstituterClients(ctx)
+	})
+	return g.substituterClientsResult, g.substituterClientsErr
+}
+
+func (g *globalConfig) newSubstituterClients(ctx context.Context) ([]*zbstore.Substituter, error) {
+	var keys []*nix.PublicKey
+	for _, s := range g.trustedPublicKeys {
+		pub, err := nix.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted-public-keys: %v", err)
+		}
+		keys = append(keys, pub)
+	}
+	client, err := g.cacheAuth(ctx).Client()
+	if err != nil {
+		return nil, err
+	}
+	narInfoCache, err := zbstore.OpenNARInfoCache(ctx, zbstore.DefaultNARInfoCachePath())
+	if err != nil {
+		log.Warnf(ctx, "Substituter lookups will not be cached: %v", err)
+		narInfoCache = nil
+	} else {
+		narInfoCache.PositiveTTL = g.narInfoPositiveTTL
+		narInfoCache.NegativeTTL = g.narInfoNegativeTTL
+	}
+	var chunks *zbstore.ChunkStore
+	if dir, err := os.UserCacheDir(); err == nil {
+		chunks = &zbstore.ChunkStore{Dir: filepath.Join(dir, "zb", "chunks")}
+	}
+	peers := g.peerSubstituters(ctx)
+	subs := make([]*zbstore.Substituter, 0, len(peers)+len(g.substituters))
+	for _, u := range append(peers, g.substituters...) {
+		subs = append(subs, &zbstore.Substituter{
+			URL:               u,
+			Client:            client,
+			TrustedPublicKeys: keys,
+			Chunks:            chunks,
+			Parallelism:       g.downloadSegments,
+			IPFSGateway:       g.ipfsGateway,
+			NARInfoCache:      narInfoCache,
+		})
+	}
+	return subs, nil
+}
+
+// backendSubstituters returns the configured substituters
+// in a form that the backend can use.
+// IPFS caches (ipfs:// and ipns://) are read through the IPFS gateway.
+// Object storage caches (gs:// and azblob://)
+// are only used by zb's own substituter clients.
+func (g *globalConfig) backendSubstituters() []string {
+	var result []string
+	for _, u := range g.substituters {
+		if strings.HasPrefix(u, "gs://") || strings.HasPrefix(u, "azblob://") {
+			continue
+		}
+		if gatewayURL, isIPFS, err := zbstore.GatewayURL(g.ipfsGateway, u); isIPFS {
+			if err != nil {
+				log.Warnf(context.Background(), "Ignoring substituter: %v", err)
+				continue
+			}
+			u = gatewayURL
+		}
+		result = append(result, u)
+	}
+	return result
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+// Progress display modes for the --progress flag.
+const (
+	progressPlain = "plain"
+	progressTUI   = "tui"
+)
+
+const (
+	// progressRefresh is how often the progress display is redrawn.
+	progressRefresh = 100 * time.Millisecond
+	// progressWidth is the maximum number of columns in a status line.
+	// Longer lines are truncated so that they don't wrap,
+	// which would throw off the count of lines to erase.
+	progressWidth = 80
+	// progressLogTail is the number of log lines kept for each build
+	// to show if the build fails.
+	progressLogTail = 25
+)
+
+// isTerminal reports whether f is connected to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressDisplay is an interactive terminal display of [zbstore.BuildEvent] values.
+// It shows the running builds and downloads along with the overall build count.
+// Logs of builds are hidden unless the build fails.
+type progressDisplay struct {
+	w    io.Writer
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu        sync.Mutex
+	builds    map[uint64]*buildStatus
+	downloads map[uint64]*downloadStatus
+	// finished holds the log tails of builds that have stopped
+	// so that they can be printed if the backend reports that the build failed.
+	finished map[nix.StorePath][]string
+	progress zbstore.BuildEvent
+	dirty    bool
+	// lines is the number of status lines currently on screen.
+	lines int
+}
+
+type buildStatus struct {
+	drvPath nix.StorePath
+	start   time.Time
+	phase   string
+	log     []string
+}
+
+type downloadStatus struct {
+	storePath nix.StorePath
+	done      int64
+	expected  int64
+}
+
+// newProgressDisplay returns a new display that writes to w
+// and starts redrawing it periodically.
+// The caller is responsible for calling Close.
+func newProgressDisplay(w io.Writer) *progressDisplay {
+	d := &progressDisplay{
+		w:         w,
+		done:      make(chan struct{}),
+		builds:    make(map[uint64]*buildStatus),
+		downloads: make(map[uint64]*downloadStatus),
+		finished:  make(map[nix.StorePath][]string),
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(progressRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mu.Lock()
+				if d.dirty {
+					d.redraw()
+				}
+				d.mu.Unlock()
+			case <-d.done:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Close stops redrawing the display and erases it.
+func (d *progressDisplay) Close() error {
+	close(d.done)
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	return nil
+}
+
+// event updates the display with a build event.
+// It is safe to call from multiple goroutines.
+func (d *progressDisplay) event(ev *zbstore.BuildEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirty = true
+	switch ev.Kind {
+	case zbstore.BuildStarted:
+		d.builds[ev.ID] = &buildStatus{drvPath: ev.DrvPath, start: time.Now()}
+	case zbstore.BuildPhase:
+		if b := d.builds[ev.ID]; b != nil {
+			b.phase = ev.Text
+		}
+	case zbstore.BuildLog:
+		if b := d.builds[ev.ID]; b != nil {
+			if len(b.log) >= progressLogTail {
+				b.log = slices.Delete(b.log, 0, 1)
+			}
+			b.log = append(b.log, ev.Text)
+		}
+	case zbstore.BuildFinished:
+		if b := d.builds[ev.ID]; b != nil {
+			d.finished[b.drvPath] = b.log
+			delete(d.builds, ev.ID)
+		}
+	case zbstore.DownloadStarted:
+		d.downloads[ev.ID] = &downloadStatus{storePath: ev.StorePath}
+	case zbstore.DownloadFinished:
+		delete(d.downloads, ev.ID)
+	case zbstore.Progress:
+		switch {
+		case ev.StorePath != "":
+			if dl := d.downloads[ev.ID]; dl != nil {
+				dl.done = ev.Done
+				dl.expected = ev.Expected
+			}
+		case ev.DrvPath == "":
+			d.progress = *ev
+		}
+	case zbstore.Message:
+		d.clear()
+		fmt.Fprintln(d.w, ev.Text)
+		if ev.Error {
+			d.printFailedLog(ev.Text)
+		}
+	}
+}
+
+// printFailedLog prints the log tail of the finished build
+// whose derivation is mentioned in msg, if any.
+// Each log is printed at most once.
+// d.mu must be held.
+func (d *progressDisplay) printFailedLog(msg string) {
+	for drvPath, log := range d.finished {
+		if !strings.Contains(msg, string(drvPath)) {
+			continue
+		}
+		delete(d.finished, drvPath)
+		if len(log) == 0 {
+			continue
+		}
+		fmt.Fprintf(d.w, "last %d log lines of %s:\n", len(log), drvName(drvPath))
+		for _, line := range log {
+			fmt.Fprintf(d.w, "> %s\n", line)
+		}
+	}
+}
+
+// clear erases the status lines from the terminal.
+// d.mu must be held.
+func (d *progressDisplay) clear() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.w, "\x1b[%dA\x1b[J", d.lines)
+		d.lines = 0
+	}
+	d.dirty = true
+}
+
+// redraw replaces the status lines on the terminal.
+// d.mu must be held.
+func (d *progressDisplay) redraw() {
+	lines := d.status()
+	sb := new(strings.Builder)
+	if d.lines > 0 {
+		fmt.Fprintf(sb, "\x1b[%dA\x1b[J", d.lines)
+	}
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	io.WriteString(d.w, sb.String())
+	d.lines = len(lines)
+	d.dirty = false
+}
+
+// status returns the lines to display.
+// d.mu must be held.
+func (d *progressDisplay) status() []string {
+	var lines []string
+	buildIDs := make([]uint64, 0, len(d.builds))
+	for id := range d.builds {
+		buildIDs = append(buildIDs, id)
+	}
+	slices.Sort(buildIDs)
+	now := time.Now()
+	for _, id := range buildIDs {
+		b := d.builds[id]
+		line := fmt.Sprintf("building %s (%v)", drvName(b.drvPath), now.Sub(b.start).Truncate(time.Second))
+		if b.phase != "" {
+			line += " " + b.phase
+		}
+		if len(b.log) > 0 {
+			line += ": " + b.log[len(b.log)-1]
+		}
+		lines = append(lines, truncateStatus(line))
+	}
+	downloadIDs := make([]uint64, 0, len(d.downloads))
+	for id := range d.downloads {
+		downloadIDs = append(downloadIDs, id)
+	}
+	slices.Sort(downloadIDs)
+	for _, id := range downloadIDs {
+		dl := d.downloads[id]
+		line := "downloading " + dl.storePath.Name()
+		if dl.expected > 0 {
+			line += fmt.Sprintf(" (%s / %s)", formatSize(dl.done), formatSize(dl.expected))
+		}
+		lines = append(lines, truncateStatus(line))
+	}
+	if p := d.progress; p.Expected > 0 {
+		line := fmt.Sprintf("[%d/%d built, %d running", p.Done, p.Expected, len(d.builds))
+		if p.Failed > 0 {
+			line += fmt.Sprintf(", %d failed", p.Failed)
+		}
+		line += "]"
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// drvName returns the name of a derivation without the ".drv" suffix.
+func drvName(drvPath nix.StorePath) string {
+	return strings.TrimSuffix(drvPath.Name(), ".drv")
+}
+
+// truncateStatus shortens a status line so that it fits in [progressWidth] columns.
+func truncateStatus(line string) string {
+	line = strings.Map(func(c rune) rune {
+		if c < ' ' || c == 0x7f {
+			return ' '
+		}
+		return c
+	}, line)
+	if n := 0; len(line) > progressWidth {
+		for i := range line {
+			if n == progressWidth-3 {
+				return line[:i] + "..."
+			}
+			n++
+		}
+	}
+	return line
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storePushOptions struct {
+	to            string
+	paths         []string
+	compression   string
+	secretKeyFile string
+	realizations  bool
+	noListings    bool
+}
+
+func newStorePushCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "push [options] --to URL PATH [...]",
+		Short: "upload store objects to a binary cache",
+		Long: "Upload the closure of the given store objects to the binary cache at URL, " +
+			"skipping objects that the cache already has. " +
+			"URL can be an http:// or https:// cache that accepts PUT requests, " +
+			"a Google Cloud Storage bucket (gs://bucket/prefix), " +
+			"or an Azure Storage container (azblob://account/container/prefix). " +
+			"Object storage is accessed with the environment's ambient credentials. " +
+			"With --realizations, the recorded realizations that produced the given paths " +
+			"are uploaded too, so that clients can look up what a derivation builds to " +
+			"without downloading anything else. " +
+			"Each object is uploaded with a .ls listing of its files " +
+			"so that tools can search the cache without downloading NARs.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storePushOptions)
+	c.Flags().StringVar(&opts.to, "to", "", "upload to the binary cache at `url`")
+	c.Flags().StringVar(&opts.compression, "compression", string(nix.Zstandard), "compress NARs with `algorithm` (zstd, xz, gzip, or none)")
+	c.Flags().StringVar(&opts.secretKeyFile, "secret-key-file", "", "sign the uploaded metadata with the Nix signing key in `file`")
+	c.Flags().BoolVar(&opts.realizations, "realizations", false, "also upload the realizations of the given paths")
+	c.Flags().BoolVar(&opts.noListings, "no-listings", false, "do not upload .ls file listings")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStorePush(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStorePush(ctx context.Context, g *globalConfig, opts *storePushOptions) error {
+	if opts.to == "" {
+		return fmt.Errorf("--to not set")
+	}
+	pushOpts := &zbstore.PushOptions{
+		Compression: nix.CompressionType(opts.compression),
+		NoListings:  opts.noListings,
+	}
+	switch pushOpts.Compression {
+	case nix.Zstandard, nix.XZ, nix.Gzip, nix.NoCompression:
+	default:
+		return fmt.Errorf("unsupported --compression %q (want zstd, xz, gzip, or none)", opts.compression)
+	}
+	if opts.secretKeyFile != "" {
+		var err error
+		pushOpts.SecretKey, err = readSecretKeyFile(opts.secretKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	paths := make([]nix.StorePath, 0, len(opts.paths))
+	for _, arg := range opts.paths {
+		p, err := storePathArg(g.layout.dir, arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+	}
+	if opts.realizations {
+		db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+		if err != nil {
+			return err
+		}
+		pushOpts.Realizations, err = db.RealizationsOf(ctx, paths...)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		if len(pushOpts.Realizations) == 0 {
+			log.Warnf(ctx, "No realizations recorded for the given paths")
+		}
+	}
+	client, err := g.cacheAuth(ctx).Client()
+	if err != nil {
+		return err
+	}
+	sub := &zbstore.Substituter{
+		URL:    opts.to,
+		Client: client,
+	}
+	n, err := zbstore.Push(ctx, g.store(), sub, paths, pushOpts)
+	log.Infof(ctx, "Uploaded %d store object(s) to %s", n, opts.to)
+	if err == nil && len(pushOpts.Realizations) > 0 {
+		log.Infof(ctx, "Uploaded %d realization(s) to %s", len(pushOpts.Realizations), opts.to)
+	}
+	return err
+}
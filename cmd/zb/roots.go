@@ -0,0 +1,191 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+func newStoreRootsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "roots COMMAND",
+		Short: "manage named garbage collector roots",
+		Long: "Named roots keep store objects alive under a name of your choosing. " +
+			"Each user has their own namespace of names, " +
+			"so users on a shared machine cannot remove or replace each other's roots. " +
+			"When using a store daemon (see zb serve), the daemon records every user's roots " +
+			"in its database and identifies the user from the connection. " +
+			"Otherwise, roots are recorded in your own state database.",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(
+		newStoreRootsAddCommand(g),
+		newStoreRootsListCommand(g),
+		newStoreRootsRemoveCommand(g),
+	)
+	return c
+}
+
+// currentUser returns the name of the namespace
+// that the invoking user's roots are stored in.
+func currentUser() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("determine current user: %v", err)
+	}
+	return u.Username, nil
+}
+
+// openRootsDB opens the database that records the invoking user's named roots.
+// When using a store daemon, the daemon records roots in its own database,
+// so openRootsDB returns a nil database.
+func openRootsDB(ctx context.Context, g *globalConfig) (*zbstore.DB, error) {
+	if g.storeSocket != "" {
+		return nil, nil
+	}
+	return zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+}
+
+func newStoreRootsAddCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "add NAME PATH",
+		Short:                 "create or replace one of your named roots",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(2),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreRootsAdd(cmd.Context(), g, args[0], args[1])
+	}
+	return c
+}
+
+func runStoreRootsAdd(ctx context.Context, g *globalConfig, name, arg string) error {
+	owner, err := currentUser()
+	if err != nil {
+		return err
+	}
+	p, err := storePathArg(g.layout.dir, arg)
+	if err != nil {
+		return err
+	}
+	db, err := openRootsDB(ctx, g)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		defer db.Close()
+	}
+	r, err := g.store().AddNamedRoot(ctx, db, owner, name, p)
+	if err != nil {
+		return err
+	}
+	fmt.Println(r.Link)
+	return nil
+}
+
+type storeRootsListOptions struct {
+	all bool
+}
+
+func newStoreRootsListCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "list [options]",
+		Aliases:               []string{"ls"},
+		Short:                 "list named roots",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeRootsListOptions)
+	c.Flags().BoolVarP(&opts.all, "all", "a", false, "list every user's roots instead of only your own")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreRootsList(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreRootsList(ctx context.Context, g *globalConfig, opts *storeRootsListOptions) error {
+	owner := ""
+	if !opts.all {
+		var err error
+		owner, err = currentUser()
+		if err != nil {
+			return err
+		}
+	}
+	db, err := openRootsDB(ctx, g)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		defer db.Close()
+	}
+	roots, err := g.store().NamedRoots(ctx, db, owner)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if opts.all {
+		fmt.Fprintf(tw, "OWNER\t")
+	}
+	fmt.Fprintf(tw, "NAME\tUPDATED\tPATH\n")
+	for _, r := range roots {
+		if opts.all {
+			fmt.Fprintf(tw, "%s\t", r.Owner)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, r.Time.Format(time.DateTime), r.Path)
+	}
+	return tw.Flush()
+}
+
+func newStoreRootsRemoveCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "remove NAME [...]",
+		Aliases:               []string{"rm"},
+		Short:                 "remove your named roots",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreRootsRemove(cmd.Context(), g, args)
+	}
+	return c
+}
+
+func runStoreRootsRemove(ctx context.Context, g *globalConfig, names []string) error {
+	owner, err := currentUser()
+	if err != nil {
+		return err
+	}
+	db, err := openRootsDB(ctx, g)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		defer db.Close()
+	}
+	store := g.store()
+	for _, name := range names {
+		if err := store.RemoveNamedRoot(ctx, db, owner, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type runOptions struct {
+	evalOptions
+	args []string
+}
+
+func newRunCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "run [options] [INSTALLABLE] [-- ARG [...]]",
+		Short: "build a derivation and run its program",
+		Long: "Build a derivation and run the program in its out output. " +
+			"The program is the file named by the derivation's mainProgram attribute, " +
+			"otherwise bin/<name> where <name> is the derivation's name with any version removed. " +
+			"The output's closure is protected from garbage collection while the program runs.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(runOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+			opts.installables = args[:dash]
+			opts.args = args[dash:]
+		} else {
+			opts.installables = args
+		}
+		if len(opts.installables) > 1 {
+			return fmt.Errorf("at most one installable may be given (use -- to pass arguments)")
+		}
+		return runRun(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runRun(ctx context.Context, g *globalConfig, opts *runOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		return err
+	}
+
+	store := g.realisingStore(ctx)
+	outputs, err := store.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		return err
+	}
+	outPath, ok := outputs["out"]
+	if !ok {
+		return fmt.Errorf("%s does not have an out output", drvPath)
+	}
+
+	// Keep the closure alive while the program runs.
+	rootDir, err := os.MkdirTemp("", "zb-run-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootDir)
+	if err := store.AddRoot(ctx, filepath.Join(rootDir, "result"), outPath); err != nil {
+		return err
+	}
+
+	g.recordAccess(ctx, drvPath, outPath)
+	program, err := findMainProgram(store, drv, outPath)
+	if err != nil {
+		return err
+	}
+	c := exec.CommandContext(ctx, store.RealPath(program), opts.args...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+// findMainProgram returns the path to the executable
+// that zb run should execute for the given derivation output.
+// The returned path is inside the store directory,
+// which may not be its location in the local file system
+// (see [zbstore.Store.RealPath]).
+func findMainProgram(store *zbstore.Store, drv *zb.Derivation, outPath nix.StorePath) (string, error) {
+	info, err := os.Stat(store.RealPath(string(outPath)))
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().IsRegular() {
+		if info.Mode()&0o111 == 0 {
+			return "", fmt.Errorf("%s is not executable", outPath)
+		}
+		return string(outPath), nil
+	}
+
+	var candidates []string
+	if name := drv.Env["mainProgram"]; name != "" {
+		candidates = append(candidates, filepath.Join(string(outPath), filepath.FromSlash(name)))
+		if filepath.Base(name) == name {
+			candidates = append(candidates, filepath.Join(string(outPath), "bin", name))
+		}
+	} else {
+		candidates = append(candidates, filepath.Join(string(outPath), "bin", drv.Name))
+		if name := packageName(drv.Name); name != drv.Name {
+			candidates = append(candidates, filepath.Join(string(outPath), "bin", name))
+		}
+	}
+	for _, c := range candidates {
+		if info, err := os.Stat(store.RealPath(c)); err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0 {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("%s: no program found (tried %v); set the mainProgram attribute", outPath, candidates)
+}
+
+// packageName returns the derivation name without its version suffix.
+// The version is the first dash-separated component that starts with a digit
+// and everything following it.
+func packageName(drvName string) string {
+	for i := 0; i < len(drvName)-1; i++ {
+		if drvName[i] == '-' && '0' <= drvName[i+1] && drvName[i+1] <= '9' {
+			return drvName[:i]
+		}
+	}
+	return drvName
+}
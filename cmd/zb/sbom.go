@@ -0,0 +1,198 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/internal/sbom"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type sbomOptions struct {
+	evalOptions
+	format string
+	output string
+}
+
+func newSBOMCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "sbom [options] [INSTALLABLE]",
+		Short: "write a software bill of materials for a derivation's runtime closure",
+		Long: "Build a derivation and describe every store object in the closure of its out output. " +
+			"Each component's name, version, license, homepage, and description " +
+			"come from the pname, version, license, homepage, and description attributes " +
+			"of the derivation that produced it. " +
+			"Source URLs come from the fixed-output derivations (like fetchurl) it was built from.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(sbomOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVar(&opts.format, "format", "spdx", "write the SBOM in `format` (spdx or cyclonedx)")
+	c.Flags().StringVarP(&opts.output, "output", "o", "-", "write the SBOM to `file` (- for stdout)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runSBOM(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runSBOM(ctx context.Context, g *globalConfig, opts *sbomOptions) error {
+	var write func(io.Writer, *sbom.Document) error
+	switch opts.format {
+	case "spdx":
+		write = sbom.WriteSPDX
+	case "cyclonedx":
+		write = sbom.WriteCycloneDX
+	default:
+		return fmt.Errorf("unknown SBOM format %q", opts.format)
+	}
+
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		return err
+	}
+	store := g.realisingStore(ctx)
+	outputs, err := store.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		return err
+	}
+	outPath, ok := outputs["out"]
+	if !ok {
+		return fmt.Errorf("%s does not have an out output", drvPath)
+	}
+	closure, err := store.QueryRequisites(ctx, outPath)
+	if err != nil {
+		return err
+	}
+	g.recordAccess(ctx, drvPath, outPath)
+
+	doc := &sbom.Document{
+		Name:    drv.Name,
+		Created: time.Now(),
+		Root:    string(outPath),
+	}
+	for _, p := range closure {
+		c, err := sbomComponent(ctx, store, p)
+		if err != nil {
+			return err
+		}
+		if p == outPath {
+			// We already know the deriver.
+			fillSBOMComponent(store, c, drv)
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	// List the root first.
+	slices.SortStableFunc(doc.Components, func(a, b *sbom.Component) int {
+		switch {
+		case a.ID == doc.Root && b.ID != doc.Root:
+			return -1
+		case a.ID != doc.Root && b.ID == doc.Root:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if opts.output == "-" {
+		return write(os.Stdout, doc)
+	}
+	f, err := os.Create(opts.output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, doc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sbomComponent describes a single store object for an SBOM.
+func sbomComponent(ctx context.Context, store *zbstore.Store, path nix.StorePath) (*sbom.Component, error) {
+	info, err := store.QueryPathInfo(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	c := &sbom.Component{
+		ID:   string(path),
+		Name: packageName(path.Name()),
+		Hash: info.NARHash,
+	}
+	c.Version = strings.TrimPrefix(strings.TrimPrefix(path.Name(), c.Name), "-")
+	for _, ref := range info.References {
+		if ref != path {
+			c.DependsOn = append(c.DependsOn, string(ref))
+		}
+	}
+	if info.Deriver != "" {
+		if drv, err := zb.ReadDerivationFromRoot(store.Root, info.Deriver); err != nil {
+			log.Debugf(ctx, "No metadata for %s: %v", path, err)
+		} else {
+			fillSBOMComponent(store, c, drv)
+		}
+	}
+	return c, nil
+}
+
+// fillSBOMComponent sets a component's metadata from the derivation that produced it.
+func fillSBOMComponent(store *zbstore.Store, c *sbom.Component, drv *zb.Derivation) {
+	if name := drv.Env["pname"]; name != "" {
+		c.Name = name
+	}
+	if version := drv.Env["version"]; version != "" {
+		c.Version = version
+	}
+	c.License = drv.Env["license"]
+	c.Homepage = drv.Env["homepage"]
+	c.Description = drv.Env["description"]
+
+	c.Sources = nil
+	for inputPath := range drv.InputDerivations {
+		input, err := zb.ReadDerivationFromRoot(store.Root, inputPath)
+		if err != nil {
+			continue
+		}
+		u := input.Env["url"]
+		out := input.Outputs["out"]
+		if u == "" || out == nil {
+			continue
+		}
+		ca, ok := out.FixedCA()
+		if !ok {
+			continue
+		}
+		c.Sources = append(c.Sources, sbom.Source{URL: u, Hash: ca.Hash()})
+	}
+	slices.SortFunc(c.Sources, func(a, b sbom.Source) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+}
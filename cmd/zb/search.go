@@ -0,0 +1,209 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type searchOptions struct {
+	query string
+	json  bool
+}
+
+type indexOptions struct {
+	evalOptions
+	files bool
+}
+
+func newIndexCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "index [options] [INSTALLABLE [...]]",
+		Short: "index a package set for zb search",
+		Long: "Evaluate a package set and record the metadata of the derivations in it " +
+			"so that zb search can find them without evaluating again. " +
+			"Tables in the results are searched recursively for derivations, " +
+			"which are indexed by their attribute path. " +
+			"Each run replaces the previous index. " +
+			"With --files, the files in the derivations' outputs are indexed too " +
+			"so that zb locate can find them. " +
+			"Outputs in the store are read directly; " +
+			"others are looked up in the .ls listings of the configured substituters.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(indexOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().BoolVar(&opts.files, "files", false, "also index the files in the packages' outputs for zb locate")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runIndex(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runIndex(ctx context.Context, g *globalConfig, opts *indexOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+
+	var metas []*zbstore.PackageMeta
+	var objects []*zbstore.IndexedObject
+	for i, result := range results {
+		prefix := ""
+		if i < len(opts.installables) {
+			prefix = opts.installables[i]
+		}
+		metas, err = appendPackageMetas(metas, prefix, result)
+		if err != nil {
+			return err
+		}
+		if opts.files {
+			objects = appendFileIndexObjects(ctx, objects, prefix, result)
+		}
+	}
+	if opts.files {
+		objects, err = listIndexObjects(ctx, g, objects)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.ReplacePackageIndex(ctx, metas); err != nil {
+		return err
+	}
+	log.Infof(ctx, "Indexed %d packages", len(metas))
+	if opts.files {
+		if err := db.ReplaceFileIndex(ctx, objects); err != nil {
+			return err
+		}
+		log.Infof(ctx, "Indexed files in %d store objects", len(objects))
+	}
+	return nil
+}
+
+// appendPackageMetas appends the metadata of the derivations in x
+// (found at the attribute path attrPath) to dst.
+func appendPackageMetas(dst []*zbstore.PackageMeta, attrPath string, x any) ([]*zbstore.PackageMeta, error) {
+	switch x := x.(type) {
+	case *zb.Derivation:
+		drvPath, err := x.StorePath()
+		if err != nil {
+			return dst, fmt.Errorf("%s: %v", attrPath, err)
+		}
+		meta := packageMeta(x, drvPath)
+		meta.AttrPath = attrPath
+		return append(dst, meta), nil
+	case map[string]any:
+		for _, k := range sortedKeys(x) {
+			sub := k
+			if attrPath != "" {
+				sub = attrPath + "." + k
+			}
+			var err error
+			dst, err = appendPackageMetas(dst, sub, x[k])
+			if err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	default:
+		return dst, nil
+	}
+}
+
+func newSearchCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "search [options] [REGEXP]",
+		Short: "search the metadata of packages",
+		Long: "List the packages indexed with zb index or built with zb build " +
+			"whose attribute path, name, or description matches the regular expression REGEXP. " +
+			"Metadata comes from the meta argument of derivation " +
+			"and the pname, version, description, license, and homepage attributes. " +
+			"With no REGEXP, all packages are listed.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(searchOptions)
+	c.Flags().BoolVar(&opts.json, "json", false, "print results as JSON, one per line")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			opts.query = args[0]
+		}
+		return runSearch(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runSearch(ctx context.Context, g *globalConfig, opts *searchOptions) error {
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var re *regexp.Regexp
+	if opts.query != "" {
+		var err error
+		re, err = regexp.Compile(opts.query)
+		if err != nil {
+			return err
+		}
+	}
+	metas, err := db.SearchMeta(ctx, re)
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, meta := range metas {
+			if err := enc.Encode(meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, meta := range metas {
+		name := meta.Name
+		if meta.Version != "" {
+			name += " " + meta.Version
+		}
+		if meta.AttrPath != "" {
+			name = meta.AttrPath + " (" + name + ")"
+		}
+		fmt.Printf("* %s\n", name)
+		if meta.Description != "" {
+			fmt.Printf("  %s\n", meta.Description)
+		}
+		if meta.License != "" {
+			fmt.Printf("  License: %s\n", meta.License)
+		}
+		if meta.Homepage != "" {
+			fmt.Printf("  Homepage: %s\n", meta.Homepage)
+		}
+	}
+	return nil
+}
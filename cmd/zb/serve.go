@@ -0,0 +1,139 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type serveOptions struct {
+	socket          string
+	buildUsersGroup string
+	policy          zbstore.AuthPolicy
+	nixSocket       string
+	rootsDB         string
+}
+
+func newServeCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "serve [options]",
+		Short: "run a daemon that performs builds on behalf of zb clients",
+		Long: "Run a long-lived daemon that owns the store and executes builds. " +
+			"zb commands send builds and root registrations to the daemon " +
+			"when --store-socket or $ZB_DAEMON_SOCKET is set. " +
+			"Builds then run with the daemon's privileges rather than the invoking user's. " +
+			"Other commands still access the store directly. " +
+			"Untrusted clients may only register roots in their own roots directory or in directories they own. " +
+			"Named roots (see zb store roots) are recorded in the daemon's --roots-db " +
+			"under the name of the connecting user. " +
+			"When the daemon runs as root, each builder runs as one of the members of " +
+			"the --build-users-group group, so builds cannot tamper with each other.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(serveOptions)
+	c.Flags().StringVar(&opts.socket, "socket", zbstore.DefaultSocket(), "listen on the Unix socket at `path`")
+	c.Flags().StringVar(&opts.buildUsersGroup, "build-users-group", "", "when running as root, run builders as the members of `group`")
+	c.Flags().StringSliceVar(&opts.policy.TrustedUsers, "trusted-users", nil, "trust the listed `users` (user names, @group, or *); "+
+		"only trusted users may register roots outside their own directories (default root)")
+	c.Flags().StringSliceVar(&opts.policy.AllowedUsers, "allowed-users", nil, "only accept connections from the listed `users` "+
+		"(user names, @group, or *) in addition to trusted users (default *)")
+	c.Flags().StringVar(&opts.rootsDB, "roots-db", zbstore.DefaultDBPath(), "record clients' named roots in the database at `path`")
+	c.Flags().StringVar(&opts.nixSocket, "nix-socket", "", "also serve the Nix worker protocol on the Unix socket at `path` "+
+		"so Nix clients can query, download from, and (if trusted) upload to the store")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runServe(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runServe(ctx context.Context, g *globalConfig, opts *serveOptions) error {
+	if g.storeSocket != "" {
+		return fmt.Errorf("cannot serve while using a store daemon (unset --store-socket)")
+	}
+	if opts.buildUsersGroup != "" {
+		if _, err := user.LookupGroup(opts.buildUsersGroup); err != nil {
+			return fmt.Errorf("build users group: %v", err)
+		}
+		if os.Geteuid() != 0 {
+			log.Warnf(ctx, "Not running as root; builders will run as the daemon's user instead of members of %s", opts.buildUsersGroup)
+		}
+	} else if os.Geteuid() == 0 {
+		log.Warnf(ctx, "Running as root without --build-users-group; builders may run as root")
+	}
+	rootsDB, err := zbstore.OpenDB(ctx, opts.rootsDB)
+	if err != nil {
+		return err
+	}
+	defer rootsDB.Close()
+	ln, err := listenUnix(opts.socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(opts.socket)
+	log.Infof(ctx, "Listening on %s", opts.socket)
+	store := g.realisingStore(ctx)
+	store.BuildUsersGroup = opts.buildUsersGroup
+	srv := &zbstore.Server{
+		Store:   store,
+		Policy:  &opts.policy,
+		RootsDB: rootsDB,
+	}
+	if opts.nixSocket == "" {
+		return srv.Serve(ctx, ln)
+	}
+
+	nixLn, err := listenUnix(opts.nixSocket)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	defer os.Remove(opts.nixSocket)
+	log.Infof(ctx, "Serving Nix worker protocol on %s", opts.nixSocket)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	nixDone := make(chan error, 1)
+	go func() {
+		nixDone <- srv.ServeNixProtocol(ctx, nixLn)
+		cancel()
+	}()
+	err = srv.Serve(ctx, ln)
+	cancel()
+	if nixErr := <-nixDone; err == nil {
+		err = nixErr
+	}
+	return err
+}
+
+// listenUnix listens on a Unix socket at path that any local user may connect to,
+// replacing any stale socket.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
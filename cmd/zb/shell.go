@@ -0,0 +1,217 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type shellOptions struct {
+	evalOptions
+	command           string
+	ignoreEnvironment bool
+	builderEnv        []string
+	builderPath       string
+}
+
+func newShellCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:     "shell [options] [INSTALLABLE]",
+		Aliases: []string{"develop"},
+		Short:   "run a shell in a derivation's build environment",
+		Long: "Realize a derivation's inputs and run an interactive shell " +
+			"with the derivation's environment variables set, without running the builder. " +
+			"The derivation's outputs are directed to an outputs directory " +
+			"inside the current directory. " +
+			"The environment is the one a builder would receive " +
+			"(see --builder-env and --builder-path), " +
+			"plus zb's own environment unless --ignore-environment is given.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(shellOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVarP(&opts.command, "command", "c", "", "run `cmd` with the shell instead of starting an interactive session")
+	c.Flags().BoolVarP(&opts.ignoreEnvironment, "ignore-environment", "i", false, "do not inherit environment variables from zb")
+	c.Flags().StringArrayVar(&opts.builderEnv, "builder-env", nil, "add `NAME=VALUE` to the baseline builder environment (may be repeated)")
+	c.Flags().StringVar(&opts.builderPath, "builder-path", "", "use `path` as PATH for derivations that do not set PATH")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runShell(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runShell(ctx context.Context, g *globalConfig, opts *shellOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+
+	store := g.realisingStore(ctx)
+	var rewrites []string
+	var binDirs []string
+	var used []nix.StorePath
+	for _, inputPath := range sortedInputDerivations(drv) {
+		outputs, err := store.RealiseOutputs(ctx, inputPath)
+		if err != nil {
+			return err
+		}
+		outNames := drv.InputDerivations[inputPath]
+		for i := 0; i < outNames.Len(); i++ {
+			outName := outNames.At(i)
+			outPath, ok := outputs[outName]
+			if !ok {
+				return fmt.Errorf("%s did not produce output %q", inputPath, outName)
+			}
+			rewrites = append(rewrites, zb.UnknownCAOutputPlaceholder(inputPath, outName), string(outPath))
+			binDirs = appendBinDir(binDirs, store, string(outPath))
+			used = append(used, outPath)
+		}
+	}
+	g.recordAccess(ctx, used...)
+	for i := 0; i < drv.InputSources.Len(); i++ {
+		binDirs = appendBinDir(binDirs, store, string(drv.InputSources.At(i)))
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	for outName := range drv.Outputs {
+		rewrites = append(rewrites, zb.HashPlaceholder(outName), filepath.Join(wd, "outputs", outName))
+	}
+	rewrite := strings.NewReplacer(rewrites...).Replace
+
+	tmpDir, err := os.MkdirTemp("", "zb-shell-"+drv.Name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	policy := &zb.BuilderEnvPolicy{
+		Baseline: make(map[string]string),
+		Path:     opts.builderPath,
+	}
+	for _, kv := range opts.builderEnv {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("--builder-env %q: missing '='", kv)
+		}
+		policy.Baseline[k] = v
+	}
+	builderEnv, err := policy.Environ(drv, tmpDir, runtime.NumCPU())
+	if err != nil {
+		return err
+	}
+	env := make(map[string]string)
+	if !opts.ignoreEnvironment {
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			env[k] = v
+		}
+	}
+	for k, v := range builderEnv {
+		if _, inherited := env[k]; inherited && (k == "HOME" || k == "TERM") {
+			// Keep interactive sessions usable.
+			continue
+		}
+		env[k] = rewrite(v)
+	}
+	if _, hasPath := drv.Env["PATH"]; !hasPath && len(binDirs) > 0 {
+		env["PATH"] = searchPath(store, binDirs)
+		basePath := opts.builderPath
+		if basePath == "" && !opts.ignoreEnvironment {
+			basePath = os.Getenv("PATH")
+		}
+		if basePath != "" {
+			env["PATH"] += string(filepath.ListSeparator) + basePath
+		}
+	}
+
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	argv := []string{shell}
+	if opts.command != "" {
+		argv = append(argv, "-c", opts.command)
+	}
+	// Match the personality the builder would run under,
+	// so that tools like uname and config.guess report the target architecture.
+	if machine, ok := zbstore.Personality(zbstore.HostSystem(), drv.System); ok {
+		setarch, err := exec.LookPath("setarch")
+		if err != nil {
+			log.Warnf(ctx, "Cannot set %s personality for %s derivation: %v", machine, drv.System, err)
+		} else {
+			argv = append([]string{setarch, machine, "--"}, argv...)
+		}
+	}
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Env = make([]string, 0, len(env))
+	for k, v := range env {
+		c.Env = append(c.Env, k+"="+v)
+	}
+	slices.Sort(c.Env)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+func sortedInputDerivations(drv *zb.Derivation) []nix.StorePath {
+	paths := make([]nix.StorePath, 0, len(drv.InputDerivations))
+	for p := range drv.InputDerivations {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// appendBinDir appends the "bin" subdirectory of path to dirs
+// if it exists.
+// Like path, the appended directory is inside the store directory,
+// which may not be its location in the local file system
+// (see [zbstore.Store.RealPath]).
+func appendBinDir(dirs []string, store *zbstore.Store, path string) []string {
+	bin := filepath.Join(path, "bin")
+	if info, err := os.Stat(store.RealPath(bin)); err == nil && info.IsDir() {
+		return append(dirs, bin)
+	}
+	return dirs
+}
+
+// searchPath returns a PATH value that searches dirs in order
+// at their locations in the local file system.
+func searchPath(store *zbstore.Store, dirs []string) string {
+	realDirs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		realDirs = append(realDirs, store.RealPath(dir))
+	}
+	return strings.Join(realDirs, string(filepath.ListSeparator))
+}
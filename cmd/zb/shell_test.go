@@ -0,0 +1,47 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+func TestAppendBinDir(t *testing.T) {
+	const storeDir nix.StoreDirectory = "/zb/store"
+	const (
+		helloPath = "/zb/store/6bxpd2xvp5hbkfkcaahxkxzx3ja2ck0k-hello"
+		dataPath  = "/zb/store/2sc9kz0ny2wy5xbwj3c8jsmi3jbhl6b0-data"
+	)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, helloPath, "bin"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, dataPath, "share"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	store := &zbstore.Store{Dir: storeDir, Root: root}
+
+	var got []string
+	got = appendBinDir(got, store, helloPath)
+	got = appendBinDir(got, store, dataPath)
+	want := []string{filepath.Join(helloPath, "bin")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("appendBinDir(...) (-want +got):\n%s", diff)
+	}
+
+	if path, want := searchPath(store, got), filepath.Join(root, helloPath, "bin"); path != want {
+		t.Errorf("searchPath(store, %q) = %q; want %q", got, path, want)
+	}
+
+	// Without the root, the store objects are not at their logical location.
+	if got := appendBinDir(nil, &zbstore.Store{Dir: storeDir}, helloPath); len(got) > 0 {
+		t.Errorf("appendBinDir(nil, store without root, %q) = %q; want none", helloPath, got)
+	}
+}
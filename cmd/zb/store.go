@@ -0,0 +1,943 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+func newStoreCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "store COMMAND",
+		Short:                 "inspect and manipulate the store",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(
+		newStoreAddCommand(g),
+		newStoreBuildStatsCommand(g),
+		newStoreCatCommand(g),
+		newStoreExportCommand(g),
+		newStoreExportBundleCommand(g),
+		newStoreImportBundleCommand(g),
+		newStoreImportNixCommand(g),
+		newStoreLsCommand(g),
+		newStoreMountCommand(g),
+		newStoreOptimiseCommand(g),
+		newStorePathInfoCommand(g),
+		newStoreProvenanceCommand(g),
+		newStorePushCommand(g),
+		newStoreQueryCommand(g),
+		newStoreRealizationsCommand(g),
+		newStoreRootsCommand(g),
+		newStoreServeCommand(g),
+		newStoreStatsCommand(g),
+		newStoreVerifyCommand(g),
+	)
+	return c
+}
+
+type storeStatsOptions struct {
+	stale     bool
+	olderThan time.Duration
+}
+
+func newStoreStatsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "stats [options]",
+		Short: "report store object usage",
+		Long: "Report how recently store objects have been used by zb. " +
+			"With --stale, list the objects that have not been used recently, " +
+			"least recently used first. " +
+			"Uses are only recorded when --track-access (or track-access in zb.toml) is enabled.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeStatsOptions)
+	c.Flags().BoolVar(&opts.stale, "stale", false, "list store objects that have not been used recently")
+	c.Flags().DurationVar(&opts.olderThan, "older-than", 30*24*time.Hour, "consider objects unused for `duration` as stale")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreStats(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreStats(ctx context.Context, g *globalConfig, opts *storeStatsOptions) error {
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stale, err := db.StalePaths(ctx, time.Now().Add(-opts.olderThan))
+	if err != nil {
+		return err
+	}
+	// Paths may have been deleted since they were recorded.
+	store := g.store()
+	var gone []*zbstore.PathStats
+	n := 0
+	for _, stats := range stale {
+		if _, err := os.Lstat(store.RealPath(string(stats.Path))); err != nil {
+			gone = append(gone, stats)
+			continue
+		}
+		stale[n] = stats
+		n++
+	}
+	stale = stale[:n]
+	for _, stats := range gone {
+		if err := db.Forget(ctx, stats.Path); err != nil {
+			return err
+		}
+	}
+
+	if !opts.stale {
+		neverUsed := 0
+		for _, stats := range stale {
+			if stats.LastAccessTime.IsZero() {
+				neverUsed++
+			}
+		}
+		fmt.Printf("%d store objects unused in the last %v (%d never used)\n", len(stale), opts.olderThan, neverUsed)
+		return nil
+	}
+	for _, stats := range stale {
+		lastUsed := "never"
+		if !stats.LastAccessTime.IsZero() {
+			lastUsed = stats.LastAccessTime.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\tregistered %s\tlast used %s\n", stats.Path, stats.RegistrationTime.Format(time.RFC3339), lastUsed)
+	}
+	return nil
+}
+
+type storeBuildStatsOptions struct {
+	limit int
+}
+
+func newStoreBuildStatsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "build-stats [options]",
+		Short: "report how long builds take",
+		Long: "List the slowest recorded builds and the cumulative build time of each package, " +
+			"most time first. " +
+			"Builds are only recorded when --track-access (or track-access in zb.toml) is enabled. " +
+			"CPU time and peak memory are only known for builds " +
+			"that ran alone and were not sent to a Nix daemon.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeBuildStatsOptions)
+	c.Flags().IntVarP(&opts.limit, "limit", "n", 10, "list at most `n` builds and packages")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreBuildStats(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreBuildStats(ctx context.Context, g *globalConfig, opts *storeBuildStatsOptions) error {
+	if opts.limit <= 0 {
+		return fmt.Errorf("--limit must be positive")
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	slowest, err := db.SlowestBuilds(ctx, opts.limit)
+	if err != nil {
+		return err
+	}
+	byPackage, err := db.BuildTimeByPackage(ctx)
+	if err != nil {
+		return err
+	}
+	if len(slowest) == 0 {
+		fmt.Println("no builds recorded")
+		return nil
+	}
+
+	fmt.Printf("slowest %d build(s):\n", len(slowest))
+	for _, stats := range slowest {
+		cpu, mem := "-", "-"
+		if stats.CPUTime >= 0 {
+			cpu = stats.CPUTime.Round(time.Second).String()
+		}
+		if stats.PeakMemory >= 0 {
+			mem = formatSize(stats.PeakMemory)
+		}
+		fmt.Printf("  %v\tcpu %s\tmem %s\t%s\n", stats.Duration().Round(time.Second), cpu, mem, stats.DrvPath)
+	}
+	fmt.Printf("time by package (%d total):\n", len(byPackage))
+	for _, pkg := range byPackage[:min(len(byPackage), opts.limit)] {
+		fmt.Printf("  %v\tcpu %v\t%d build(s)\t%s\n", pkg.Time.Round(time.Second), pkg.CPUTime.Round(time.Second), pkg.Builds, pkg.Name)
+	}
+	return nil
+}
+
+type storeVerifyOptions struct {
+	paths  []string
+	repair bool
+}
+
+func newStoreVerifyCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "verify [options] [PATH [...]]",
+		Short: "check store objects for corruption",
+		Long: "Re-hash store objects and compare them against their recorded NAR hashes. " +
+			"If no paths are given, every valid store object is checked. " +
+			"With --repair, corrupted objects are substituted again or rebuilt.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeVerifyOptions)
+	c.Flags().BoolVar(&opts.repair, "repair", false, "repair corrupted store objects")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStoreVerify(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreVerify(ctx context.Context, g *globalConfig, opts *storeVerifyOptions) error {
+	store := g.store()
+	var paths []nix.StorePath
+	if len(opts.paths) == 0 {
+		var err error
+		paths, err = store.ValidPaths(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, arg := range opts.paths {
+			p, err := storePathArg(g.layout.dir, arg)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+		}
+	}
+
+	corrupt, repaired := 0, 0
+	for _, p := range paths {
+		err := store.Verify(ctx, p)
+		if err == nil {
+			continue
+		}
+		if !errors.As(err, new(*zbstore.CorruptPathError)) {
+			return err
+		}
+		corrupt++
+		fmt.Println(err)
+		if !opts.repair {
+			continue
+		}
+		if err := store.Repair(ctx, p); err != nil {
+			log.Errorf(ctx, "Repairing %s: %v", p, err)
+			continue
+		}
+		repaired++
+		fmt.Printf("repaired %s\n", p)
+	}
+	fmt.Printf("%d store objects checked, %d corrupted", len(paths), corrupt)
+	if opts.repair {
+		fmt.Printf(", %d repaired", repaired)
+	}
+	fmt.Println()
+	if corrupt > repaired {
+		return errors.New("store is corrupted")
+	}
+	return nil
+}
+
+func newStoreOptimiseCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:     "optimise",
+		Aliases: []string{"optimize"},
+		Short:   "deduplicate identical files in the store",
+		Long: "Replace identical regular files in the store with hard links to a single copy. " +
+			"Pass --auto-optimise to other commands to deduplicate files as they are added.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreOptimise(cmd.Context(), g)
+	}
+	return c
+}
+
+func runStoreOptimise(ctx context.Context, g *globalConfig) error {
+	stats, err := g.store().Optimise(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s freed by hard-linking %d files\n", formatSize(stats.BytesFreed), stats.FilesLinked)
+	return nil
+}
+
+type storePathInfoOptions struct {
+	paths []string
+	json  bool
+}
+
+func newStorePathInfoCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "path-info [options] PATH [...]",
+		Short: "show metadata about store objects",
+		Long: "Show the metadata recorded for store objects: " +
+			"NAR hash and size, references, deriver, registration time, signatures, " +
+			"whether the object was built locally (ultimate), and content address. " +
+			"The metadata is saved in zb's database.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storePathInfoOptions)
+	c.Flags().BoolVar(&opts.json, "json", false, "print metadata as JSON")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStorePathInfo(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+// pathInfoJSON is the JSON representation of [zbstore.PathInfo]
+// printed by zb store path-info --json.
+type pathInfoJSON struct {
+	Path             nix.StorePath   `json:"path"`
+	NARHash          string          `json:"narHash"`
+	NARSize          int64           `json:"narSize"`
+	References       []nix.StorePath `json:"references"`
+	Deriver          nix.StorePath   `json:"deriver,omitempty"`
+	RegistrationTime int64           `json:"registrationTime,omitempty"`
+	Signatures       []string        `json:"signatures,omitempty"`
+	Ultimate         bool            `json:"ultimate,omitempty"`
+	CA               string          `json:"ca,omitempty"`
+}
+
+func runStorePathInfo(ctx context.Context, g *globalConfig, opts *storePathInfoOptions) error {
+	store := g.store()
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var infos []*zbstore.PathInfo
+	for _, arg := range opts.paths {
+		p, err := storePathArg(g.layout.dir, arg)
+		if err != nil {
+			return err
+		}
+		info, err := store.QueryPathInfo(ctx, p)
+		if err != nil {
+			return err
+		}
+		if err := db.RecordPathInfo(ctx, info); err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	if opts.json {
+		list := make([]*pathInfoJSON, 0, len(infos))
+		for _, info := range infos {
+			j := &pathInfoJSON{
+				Path:       info.Path,
+				NARHash:    info.NARHash.Base32(),
+				NARSize:    info.NARSize,
+				References: info.References,
+				Deriver:    info.Deriver,
+				Ultimate:   info.Ultimate,
+			}
+			if j.References == nil {
+				j.References = []nix.StorePath{}
+			}
+			if !info.RegistrationTime.IsZero() {
+				j.RegistrationTime = info.RegistrationTime.Unix()
+			}
+			for _, sig := range info.Signatures {
+				j.Signatures = append(j.Signatures, sig.String())
+			}
+			if !info.CA.IsZero() {
+				j.CA = info.CA.String()
+			}
+			list = append(list, j)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(info.Path)
+		fmt.Printf("  NAR hash:   %v\n", info.NARHash.Base32())
+		fmt.Printf("  NAR size:   %s\n", formatSize(info.NARSize))
+		if info.Deriver != "" {
+			fmt.Printf("  Deriver:    %s\n", info.Deriver)
+		}
+		if !info.RegistrationTime.IsZero() {
+			fmt.Printf("  Registered: %s\n", info.RegistrationTime.Format(time.RFC3339))
+		}
+		fmt.Printf("  Ultimate:   %t\n", info.Ultimate)
+		if !info.CA.IsZero() {
+			fmt.Printf("  CA:         %v\n", info.CA)
+		}
+		for _, sig := range info.Signatures {
+			fmt.Printf("  Signature:  %v\n", sig)
+		}
+		for _, ref := range info.References {
+			fmt.Printf("  Reference:  %s\n", ref)
+		}
+	}
+	return nil
+}
+
+// storePathArg returns the store object named by a command-line argument.
+// The argument may be a path inside the store
+// or a symlink to a store object, like an out-link.
+func storePathArg(dir nix.StoreDirectory, arg string) (nix.StorePath, error) {
+	resolved, err := filepath.Abs(arg)
+	if err != nil {
+		return "", err
+	}
+	if p, _, err := dir.ParsePath(resolved); err == nil {
+		return p, nil
+	}
+	resolved, err = filepath.EvalSymlinks(resolved)
+	if err != nil {
+		return "", err
+	}
+	p, _, err := dir.ParsePath(resolved)
+	if err != nil {
+		return "", fmt.Errorf("%s is not in the store", arg)
+	}
+	return p, nil
+}
+
+type storeAddOptions struct {
+	path string
+	name string
+	flat bool
+	hash string
+}
+
+func newStoreAddCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "add [options] PATH",
+		Short: "copy a file or directory into the store",
+		Long: "Copy a file or directory into the store as a content-addressed store object " +
+			"and print its store path. " +
+			"With --hash, the content is verified as it is copied " +
+			"and the store object is not created if the hash does not match.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeAddOptions)
+	c.Flags().StringVarP(&opts.name, "name", "n", "", "name of the store object (defaults to the base name of PATH)")
+	c.Flags().BoolVar(&opts.flat, "flat", false, "hash a regular file's contents instead of its NAR serialization")
+	c.Flags().StringVar(&opts.hash, "hash", "", "expected `hash` of the content")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.path = args[0]
+		return runStoreAdd(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreAdd(ctx context.Context, g *globalConfig, opts *storeAddOptions) error {
+	addOpts := &zb.AddOptions{
+		Name:           opts.name,
+		Flat:           opts.flat,
+		AutoOptimise:   g.autoOptimise,
+		StoreRoot:      g.layout.root,
+		LowerStoreRoot: g.layout.lowerRoot,
+		UpperLayer:     g.layout.upperLayer,
+	}
+	if opts.hash != "" {
+		var err error
+		addOpts.ExpectedHash, err = nix.ParseHash(opts.hash)
+		if err != nil {
+			return err
+		}
+	}
+	p, err := zb.AddPath(ctx, g.layout.dir, opts.path, addOpts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(p)
+	g.recordAccess(ctx, p)
+	return nil
+}
+
+type storeQueryOptions struct {
+	paths            []string
+	requisites       bool
+	references       bool
+	referrers        bool
+	referrersClosure bool
+}
+
+func newStoreQueryCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "query [options] PATH [...]",
+		Short: "query the reference graph of store objects",
+		Long: "Print the store objects related to the given paths, one per line. " +
+			"Exactly one query flag must be given.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeQueryOptions)
+	c.Flags().BoolVarP(&opts.requisites, "requisites", "R", false, "print the closure of the paths (e.g. the full runtime closure of an output)")
+	c.Flags().BoolVar(&opts.references, "references", false, "print the paths directly referenced by the paths")
+	c.Flags().BoolVar(&opts.referrers, "referrers", false, "print the paths that directly reference the paths")
+	c.Flags().BoolVar(&opts.referrersClosure, "referrers-closure", false, "print the paths that transitively reference the paths")
+	c.MarkFlagsMutuallyExclusive("requisites", "references", "referrers", "referrers-closure")
+	c.MarkFlagsOneRequired("requisites", "references", "referrers", "referrers-closure")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStoreQuery(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreQuery(ctx context.Context, g *globalConfig, opts *storeQueryOptions) error {
+	paths := make([]nix.StorePath, 0, len(opts.paths))
+	for _, arg := range opts.paths {
+		p, err := storePathArg(g.layout.dir, arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+	}
+
+	store := g.store()
+	var query func(context.Context, ...nix.StorePath) ([]nix.StorePath, error)
+	switch {
+	case opts.requisites:
+		query = store.QueryRequisites
+	case opts.references:
+		query = store.QueryReferences
+	case opts.referrers:
+		query = store.QueryReferrers
+	case opts.referrersClosure:
+		query = store.QueryReferrersClosure
+	}
+	result, err := query(ctx, paths...)
+	if err != nil {
+		return err
+	}
+	slices.Sort(result)
+	for _, p := range slices.Compact(result) {
+		fmt.Println(p)
+	}
+	return nil
+}
+
+func newStoreRealizationsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "realizations COMMAND",
+		Short: "manage recorded derivation realizations",
+		Long: "A realization records the store object that a derivation output was built as, " +
+			"keyed by the derivation's content hash and output name. " +
+			"zb build consults realizations before building " +
+			"and records one for each output it builds. " +
+			"When trusted-public-keys is set, zb build also asks the substituters " +
+			"for signed realizations that it has not recorded " +
+			"(zb store serve serves them, and zb store push --realizations uploads them). " +
+			"An imported realization may carry the IPFS CID of a binary cache directory " +
+			"that serves its output: with the experimental ipfs-substitution setting, " +
+			"zb build downloads missing outputs from there through the IPFS gateway " +
+			"(ipfs-gateway or $IPFS_GATEWAY, default " + zbstore.DefaultIPFSGateway + ").",
+		DisableFlagsInUseLine: true,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	c.AddCommand(
+		newStoreRealizationsExportCommand(g),
+		newStoreRealizationsImportCommand(g),
+	)
+	return c
+}
+
+type storeRealizationsExportOptions struct {
+	secretKeyFile string
+}
+
+func newStoreRealizationsExportCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "export [options]",
+		Short:                 "write all realizations to stdout as JSON lines",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeRealizationsExportOptions)
+	c.Flags().StringVar(&opts.secretKeyFile, "secret-key-file", "", "sign the exported realizations with the Nix signing key in `file`")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreRealizationsExport(cmd.Context(), opts)
+	}
+	return c
+}
+
+func runStoreRealizationsExport(ctx context.Context, opts *storeRealizationsExportOptions) error {
+	var pk *nix.PrivateKey
+	if opts.secretKeyFile != "" {
+		var err error
+		pk, err = readSecretKeyFile(opts.secretKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rs, err := db.Realizations(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range rs {
+		if pk != nil {
+			sig, err := zbstore.SignRealization(pk, r)
+			if err != nil {
+				return err
+			}
+			r.Signatures = slices.DeleteFunc(r.Signatures, func(s *nix.Signature) bool {
+				return s.Name() == sig.Name()
+			})
+			r.Signatures = append(r.Signatures, sig)
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSecretKeyFile reads a Nix signing key from a file,
+// like the ones produced by nix-store --generate-binary-cache-key.
+func readSecretKeyFile(path string) (*nix.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := nix.ParsePrivateKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pk, nil
+}
+
+type storeProvenanceOptions struct {
+	paths       []string
+	trustedKeys []string
+	verify      bool
+}
+
+func newStoreProvenanceCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "provenance [options] PATH [...]",
+		Short: "print the signed provenance of built store objects",
+		Long: "Print the signed SLSA provenance attestations (DSSE envelopes) " +
+			"recorded by zb build --sign-provenance, one JSON object per line. " +
+			"With --verify, the signatures are checked against trusted keys " +
+			"(those listed in $ZB_TRUSTED_PUBLIC_KEYS or given with --trusted-public-key) " +
+			"and the in-toto statements are printed instead.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeProvenanceOptions)
+	c.Flags().BoolVar(&opts.verify, "verify", false, "verify signatures and print the statements")
+	c.Flags().StringArrayVar(&opts.trustedKeys, "trusted-public-key", nil, "trust signatures made by `key` (may be repeated)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStoreProvenance(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreProvenance(ctx context.Context, g *globalConfig, opts *storeProvenanceOptions) error {
+	var trusted []*nix.PublicKey
+	if opts.verify {
+		var err error
+		trusted, err = trustedPublicKeys(opts.trustedKeys)
+		if err != nil {
+			return err
+		}
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, arg := range opts.paths {
+		p, err := storePathArg(g.layout.dir, arg)
+		if err != nil {
+			return err
+		}
+		env, err := db.Provenance(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !opts.verify {
+			if err := enc.Encode(env); err != nil {
+				return err
+			}
+			continue
+		}
+		stmt, err := env.Verify(trusted)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		if err := enc.Encode(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type storeRealizationsImportOptions struct {
+	source        string
+	trustedKeys   []string
+	noRequireSigs bool
+}
+
+// trustedPublicKeys returns the keys
+// whose realization signatures zb trusts:
+// those listed (space-separated) in $ZB_TRUSTED_PUBLIC_KEYS
+// followed by any given as arguments.
+func trustedPublicKeys(extra []string) ([]*nix.PublicKey, error) {
+	var keys []*nix.PublicKey
+	for _, s := range append(strings.Fields(os.Getenv("ZB_TRUSTED_PUBLIC_KEYS")), extra...) {
+		pub, err := nix.ParsePublicKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	return keys, nil
+}
+
+func newStoreRealizationsImportCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "import [options]",
+		Short: "read realizations from stdin as JSON lines",
+		Long: "Read realizations in the format written by zb store realizations export " +
+			"and record them, replacing any realizations for the same derivation outputs. " +
+			"The imported realizations' source is set to the --source name. " +
+			"Each realization must carry a valid signature from a trusted key: " +
+			"one listed in $ZB_TRUSTED_PUBLIC_KEYS or given with --trusted-public-key.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeRealizationsImportOptions)
+	c.Flags().StringVar(&opts.source, "source", "import", "record `name` as the source of the imported realizations")
+	c.Flags().StringArrayVar(&opts.trustedKeys, "trusted-public-key", nil, "trust signatures made by `key` (may be repeated)")
+	c.Flags().BoolVar(&opts.noRequireSigs, "no-require-sigs", false, "import realizations without checking their signatures")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreRealizationsImport(cmd.Context(), opts)
+	}
+	return c
+}
+
+func runStoreRealizationsImport(ctx context.Context, opts *storeRealizationsImportOptions) error {
+	if opts.source == "" || opts.source == zbstore.LocalSource {
+		return fmt.Errorf("--source must be a name other than %q", zbstore.LocalSource)
+	}
+	trusted, err := trustedPublicKeys(opts.trustedKeys)
+	if err != nil {
+		return err
+	}
+	if !opts.noRequireSigs && len(trusted) == 0 {
+		return fmt.Errorf("no trusted public keys (set $ZB_TRUSTED_PUBLIC_KEYS, pass --trusted-public-key, or pass --no-require-sigs)")
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	dec := json.NewDecoder(os.Stdin)
+	n := 0
+	for {
+		r := new(zbstore.Realization)
+		if err := dec.Decode(r); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read realizations: %v", err)
+		}
+		if r.ID.DrvHash.IsZero() || r.ID.OutputName == "" || r.OutPath == "" {
+			return fmt.Errorf("read realizations: record %d is incomplete", n+1)
+		}
+		if !opts.noRequireSigs {
+			if err := zbstore.CheckRealizationTrust(trusted, r); err != nil {
+				return err
+			}
+		}
+		r.Source = opts.source
+		if r.Time.IsZero() {
+			r.Time = time.Now()
+		}
+		if err := db.RecordRealization(ctx, r); err != nil {
+			return err
+		}
+		n++
+	}
+	log.Infof(ctx, "Imported %d realization(s)", n)
+	return nil
+}
+
+type storeServeOptions struct {
+	listen        string
+	secretKeyFile string
+	priority      int
+	chunkDir      string
+	compression   string
+	advertise     bool
+}
+
+func newStoreServeCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "serve [options]",
+		Short: "serve the store as a read-only HTTP binary cache",
+		Long: "Serve the store's objects over HTTP in the Nix binary cache format, " +
+			"so that other machines can use it as a substituter. " +
+			"With --secret-key-file, the served metadata is signed, " +
+			"so clients only need to trust the corresponding public key. " +
+			"NARs are compressed with the --compression algorithm " +
+			"(zstd, xz, gzip, or none). " +
+			"Provenance recorded by zb build --sign-provenance " +
+			"is served at /<hash>.provenance, " +
+			"and recorded realizations of the store's objects " +
+			"at /realisations/<drv-hash>!<output>.doi. " +
+			"With --chunk-dir, NARs are also served as content-defined chunks " +
+			"so that zb clients only download the parts of a NAR they do not already have. " +
+			"Clients that have an older object with the same name " +
+			"can also download a binary delta from it at /delta/<old-hash>/<hash>. " +
+			"With --advertise, the cache is announced on the local network with multicast DNS " +
+			"so that zb clients with peer-substitution enabled can find it.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.NoArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeServeOptions)
+	c.Flags().StringVar(&opts.listen, "listen", "localhost:8080", "listen for HTTP connections on `address`")
+	c.Flags().StringVar(&opts.secretKeyFile, "secret-key-file", "", "sign store object metadata with the Nix signing key in `file`")
+	c.Flags().IntVar(&opts.priority, "priority", 40, "advertise `n` as the cache's priority (lower is preferred)")
+	c.Flags().StringVar(&opts.compression, "compression", string(nix.Zstandard), "compress NARs with `algorithm` (zstd, xz, gzip, or none)")
+	c.Flags().StringVar(&opts.chunkDir, "chunk-dir", "", "store NAR chunks in `dir` and serve them to clients")
+	c.Flags().BoolVar(&opts.advertise, "advertise", false, "announce the cache to peers on the local network")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		return runStoreServe(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreServe(ctx context.Context, g *globalConfig, opts *storeServeOptions) error {
+	compression := nix.CompressionType(opts.compression)
+	switch compression {
+	case nix.Zstandard, nix.XZ, nix.Gzip, nix.NoCompression:
+	default:
+		return fmt.Errorf("unsupported --compression %q (want zstd, xz, gzip, or none)", opts.compression)
+	}
+	cache := &zbstore.BinaryCache{
+		Store:       g.store(),
+		Priority:    opts.priority,
+		Compression: compression,
+	}
+	if opts.chunkDir != "" {
+		cache.Chunks = &zbstore.ChunkStore{Dir: opts.chunkDir}
+	}
+	if opts.secretKeyFile != "" {
+		var err error
+		cache.SecretKey, err = readSecretKeyFile(opts.secretKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath()); err != nil {
+		log.Warnf(ctx, "Provenance and realizations unavailable: %v", err)
+	} else {
+		defer db.Close()
+		cache.Provenance = db
+		cache.Realizations = db
+	}
+	ln, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "Serving binary cache at http://%v/", ln.Addr())
+	if opts.advertise {
+		addr := ln.Addr().(*net.TCPAddr)
+		if addr.IP.IsLoopback() {
+			log.Warnf(ctx, "Advertising a cache that only listens on %v; peers will not be able to reach it (use --listen :%d)", addr, addr.Port)
+		}
+		ad := &zbstore.PeerAdvertisement{
+			Port:     addr.Port,
+			StoreDir: g.layout.dir,
+		}
+		go func() {
+			if err := zbstore.AdvertisePeer(ctx, ad); err != nil {
+				log.Errorf(ctx, "%v", err)
+			}
+		}()
+	}
+	srv := &http.Server{
+		Handler:     cache,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
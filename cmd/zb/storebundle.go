@@ -0,0 +1,220 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storeExportBundleOptions struct {
+	output        string
+	paths         []string
+	compression   string
+	secretKeyFile string
+	realizations  bool
+}
+
+func newStoreExportBundleCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "export-bundle [options] -o FILE PATH [...]",
+		Short: "write store objects to a file for offline transfer",
+		Long: "Write the closure of the given store objects to a single file " +
+			"that zb store import-bundle can read on another machine, " +
+			"such as one without network access. " +
+			"The file is a tar archive laid out like a binary cache: " +
+			"it holds each object's NAR and signed metadata. " +
+			"With --realizations, the recorded realizations that produced the given paths " +
+			"are included too. " +
+			"If FILE is \"-\", the bundle is written to stdout.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MinimumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeExportBundleOptions)
+	c.Flags().StringVarP(&opts.output, "output", "o", "", "write the bundle to `file`")
+	c.Flags().StringVar(&opts.compression, "compression", string(nix.Zstandard), "compress NARs with `algorithm` (zstd, xz, gzip, or none)")
+	c.Flags().StringVar(&opts.secretKeyFile, "secret-key-file", "", "sign the metadata with the Nix signing key in `file`")
+	c.Flags().BoolVar(&opts.realizations, "realizations", false, "also include the realizations of the given paths")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.paths = args
+		return runStoreExportBundle(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreExportBundle(ctx context.Context, g *globalConfig, opts *storeExportBundleOptions) (err error) {
+	if opts.output == "" {
+		return fmt.Errorf("--output not set")
+	}
+	exportOpts := &zbstore.PushOptions{
+		Compression: nix.CompressionType(opts.compression),
+	}
+	switch exportOpts.Compression {
+	case nix.Zstandard, nix.XZ, nix.Gzip, nix.NoCompression:
+	default:
+		return fmt.Errorf("unsupported --compression %q (want zstd, xz, gzip, or none)", opts.compression)
+	}
+	if opts.secretKeyFile != "" {
+		exportOpts.SecretKey, err = readSecretKeyFile(opts.secretKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	paths := make([]nix.StorePath, 0, len(opts.paths))
+	for _, arg := range opts.paths {
+		p, err := storePathArg(g.layout.dir, arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+	}
+	if opts.realizations {
+		db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+		if err != nil {
+			return err
+		}
+		exportOpts.Realizations, err = db.RealizationsOf(ctx, paths...)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		if len(exportOpts.Realizations) == 0 {
+			log.Warnf(ctx, "No realizations recorded for the given paths")
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.output != "-" {
+		f, err := os.Create(opts.output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(opts.output)
+			}
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	if err := zbstore.ExportBundle(ctx, bw, g.store(), paths, exportOpts); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type storeImportBundleOptions struct {
+	file          string
+	source        string
+	trustedKeys   []string
+	noRequireSigs bool
+}
+
+func newStoreImportBundleCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "import-bundle [options] FILE",
+		Short: "copy store objects from a file written by export-bundle",
+		Long: "Copy the store objects in a bundle written by zb store export-bundle " +
+			"into the store and print their paths. " +
+			"Store objects must be signed by one of the configured trusted public keys. " +
+			"Realizations in the bundle are recorded with the --source name " +
+			"and must be signed by a key listed in $ZB_TRUSTED_PUBLIC_KEYS " +
+			"or given with --trusted-public-key. " +
+			"If FILE is \"-\", the bundle is read from stdin.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeImportBundleOptions)
+	c.Flags().StringVar(&opts.source, "source", "bundle", "record `name` as the source of the imported realizations")
+	c.Flags().StringArrayVar(&opts.trustedKeys, "trusted-public-key", nil, "trust realization signatures made by `key` (may be repeated)")
+	c.Flags().BoolVar(&opts.noRequireSigs, "no-require-sigs", false, "import store objects and realizations without checking their signatures")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.file = args[0]
+		return runStoreImportBundle(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreImportBundle(ctx context.Context, g *globalConfig, opts *storeImportBundleOptions) error {
+	if opts.source == "" || opts.source == zbstore.LocalSource {
+		return fmt.Errorf("--source must be a name other than %q", zbstore.LocalSource)
+	}
+	trusted, err := trustedPublicKeys(opts.trustedKeys)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if opts.file != "-" {
+		f, err := os.Open(opts.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	b, err := zbstore.OpenBundle(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if !opts.noRequireSigs {
+		if len(b.Realizations) > 0 && len(trusted) == 0 {
+			return fmt.Errorf("bundle has realizations but there are no trusted public keys (set $ZB_TRUSTED_PUBLIC_KEYS, pass --trusted-public-key, or pass --no-require-sigs)")
+		}
+		for _, r := range b.Realizations {
+			if err := zbstore.CheckRealizationTrust(trusted, r); err != nil {
+				return err
+			}
+		}
+	}
+
+	store := g.store()
+	store.NoRequireSigs = opts.noRequireSigs
+	imported, err := store.ImportBundle(ctx, b)
+	if err != nil {
+		return err
+	}
+	for _, p := range imported {
+		fmt.Println(p)
+	}
+	g.recordAccess(ctx, imported...)
+
+	if len(b.Realizations) == 0 {
+		return nil
+	}
+	db, err := zbstore.OpenDB(ctx, zbstore.DefaultDBPath())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	now := time.Now()
+	for _, r := range b.Realizations {
+		r.Source = opts.source
+		if r.Time.IsZero() {
+			r.Time = now
+		}
+		if err := db.RecordRealization(ctx, r); err != nil {
+			return err
+		}
+	}
+	log.Infof(ctx, "Imported %d realization(s)", len(b.Realizations))
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storeExportOptions struct {
+	path   string
+	output string
+	format string
+	prefix string
+	// prefixSet is whether --prefix was given,
+	// since an empty prefix is meaningful.
+	prefixSet bool
+}
+
+func newStoreExportCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "export [options] PATH",
+		Short: "write a store object's files to a tarball or zip file",
+		Long: "Write the files of a store object to a plain tar, gzip-compressed tar, or zip archive " +
+			"for use by tools that know nothing about stores. " +
+			"The archive is deterministic: entries are sorted, " +
+			"timestamps are fixed, and ownership is omitted. " +
+			"Files are placed in a directory named after the store object (without its digest) " +
+			"unless --prefix is given; pass --prefix='' to put them at the top of the archive. " +
+			"The format is chosen from the output file's extension " +
+			"(.tar, .tar.gz, .tgz, or .zip) unless --format is given.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeExportOptions)
+	c.Flags().StringVarP(&opts.output, "output", "o", "", "write the archive to `file` or - for stdout (default <name>.tar)")
+	c.Flags().StringVar(&opts.format, "format", "", "archive `format` (tar, tar.gz, or zip)")
+	c.Flags().StringVar(&opts.prefix, "prefix", "", "put the files under `dir` in the archive")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.path = args[0]
+		opts.prefixSet = cmd.Flags().Changed("prefix")
+		return runStoreExport(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreExport(ctx context.Context, g *globalConfig, opts *storeExportOptions) (err error) {
+	p, err := storePathArg(g.layout.dir, opts.path)
+	if err != nil {
+		return err
+	}
+	prefix := opts.prefix
+	if !opts.prefixSet {
+		prefix = p.Name()
+	}
+	output := opts.output
+	if output == "" {
+		output = p.Name() + ".tar"
+	}
+	format := opts.format
+	if format == "" {
+		format = archiveFormatForFile(output)
+	}
+	var archiveFormat zbstore.ArchiveFormat
+	compress := false
+	switch format {
+	case "tar":
+		archiveFormat = zbstore.TarArchive
+	case "tar.gz":
+		archiveFormat = zbstore.TarArchive
+		compress = true
+	case "zip":
+		archiveFormat = zbstore.ZipArchive
+	default:
+		return fmt.Errorf("unsupported --format %q (want tar, tar.gz, or zip)", format)
+	}
+
+	store := g.store()
+	if _, err := store.QueryPathInfo(ctx, p); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(nar.DumpPath(pw, store.RealPath(string(p))))
+	}()
+	defer pr.Close()
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(output)
+			}
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	var aw io.Writer = bw
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(bw)
+		aw = zw
+	}
+	if err := zbstore.WriteArchive(aw, archiveFormat, prefix, pr); err != nil {
+		return fmt.Errorf("export %s: %v", p, err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	g.recordAccess(ctx, p)
+	if output != "-" {
+		log.Infof(ctx, "Wrote %s", output)
+	}
+	return nil
+}
+
+// archiveFormatForFile returns the archive format
+// that a file name's extension suggests.
+func archiveFormatForFile(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	default:
+		return "tar"
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	slashpath "path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type storeLsOptions struct {
+	path      string
+	from      string
+	long      bool
+	recursive bool
+}
+
+func newStoreLsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "ls [options] PATH",
+		Short: "list the files in a store object",
+		Long: "List the files in a store object or in a directory inside one. " +
+			"PATH is a store path, optionally followed by a path inside the store object. " +
+			"If the object is not in the store, its NAR is downloaded from the configured substituters " +
+			"(or from the binary cache at --from) and read without importing it.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeLsOptions)
+	c.Flags().StringVar(&opts.from, "from", "", "read the object from the binary cache at `url`")
+	c.Flags().BoolVarP(&opts.long, "long", "l", false, "show file types, sizes, and symlink targets")
+	c.Flags().BoolVarP(&opts.recursive, "recursive", "R", false, "list directories recursively")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.path = args[0]
+		return runStoreLs(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreLs(ctx context.Context, g *globalConfig, opts *storeLsOptions) error {
+	p, sub, err := objectPathArg(g.layout.dir, opts.path)
+	if err != nil {
+		return err
+	}
+	fsys, err := openObjectFS(ctx, g, p, opts.from)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	// printEntry prints the file at path (relative to sub) as name.
+	printEntry := func(name, path string, info fs.FileInfo) error {
+		if !opts.long {
+			fmt.Fprintln(out, name)
+			return nil
+		}
+		fmt.Fprintf(out, "%s %12d %s", objectModeString(info.Mode()), info.Size(), name)
+		if info.Mode().Type() == fs.ModeSymlink {
+			target, err := fsys.ReadLink(slashpath.Join(sub, path))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, " -> %s", target)
+		}
+		fmt.Fprintln(out)
+		return nil
+	}
+
+	info, err := fsys.Stat(sub)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !info.IsDir():
+		info, err := fsys.Lstat(sub)
+		if err != nil {
+			return err
+		}
+		name := slashpath.Base(sub)
+		if sub == "." {
+			name = p.Base()
+		}
+		if err := printEntry(name, ".", info); err != nil {
+			return err
+		}
+	case opts.recursive:
+		root, err := fs.Sub(fsys, sub)
+		if err != nil {
+			return err
+		}
+		err = fs.WalkDir(root, ".", func(path string, ent fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == "." {
+				return nil
+			}
+			info, err := ent.Info()
+			if err != nil {
+				return err
+			}
+			return printEntry(path, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		entries, err := fsys.ReadDir(sub)
+		if err != nil {
+			return err
+		}
+		for _, ent := range entries {
+			info, err := ent.Info()
+			if err != nil {
+				return err
+			}
+			if err := printEntry(ent.Name(), ent.Name(), info); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
+
+type storeCatOptions struct {
+	path string
+	from string
+}
+
+func newStoreCatCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "cat [options] PATH",
+		Short: "print the contents of a file in a store object",
+		Long: "Print the contents of a file in a store object to stdout. " +
+			"PATH is a store path, optionally followed by a path inside the store object. " +
+			"If the object is not in the store, its NAR is downloaded from the configured substituters " +
+			"(or from the binary cache at --from) and read without importing it.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(storeCatOptions)
+	c.Flags().StringVar(&opts.from, "from", "", "read the object from the binary cache at `url`")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.path = args[0]
+		return runStoreCat(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runStoreCat(ctx context.Context, g *globalConfig, opts *storeCatOptions) error {
+	p, sub, err := objectPathArg(g.layout.dir, opts.path)
+	if err != nil {
+		return err
+	}
+	fsys, err := openObjectFS(ctx, g, p, opts.from)
+	if err != nil {
+		return err
+	}
+	defer fsys.Close()
+	f, err := fsys.Open(sub)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.IsDir() {
+		return fmt.Errorf("%s is a directory", opts.path)
+	}
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// objectPathArg parses a store path that may name a file inside a store object.
+// It returns the store object's path
+// and the slash-separated path of the file relative to the object
+// ("." for the object itself).
+func objectPathArg(dir nix.StoreDirectory, arg string) (nix.StorePath, string, error) {
+	resolved, err := filepath.Abs(arg)
+	if err != nil {
+		return "", "", err
+	}
+	if p, sub, err := dir.ParsePath(filepath.ToSlash(resolved)); err == nil {
+		if sub == "" {
+			sub = "."
+		}
+		return p, slashpath.Clean(sub), nil
+	}
+	p, err := storePathArg(dir, arg)
+	if err != nil {
+		return "", "", err
+	}
+	return p, ".", nil
+}
+
+// objectFS is the file system of a store object
+// read by zb store ls and zb store cat.
+type objectFS interface {
+	fs.ReadDirFS
+	fs.StatFS
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+	Close() error
+}
+
+// openObjectFS returns the file system of the store object at p.
+// If from is not empty, the object's NAR is downloaded from the binary cache at that URL.
+// Otherwise, the object is read from the local store if it is valid there
+// and downloaded from the configured substituters if not.
+func openObjectFS(ctx context.Context, g *globalConfig, p nix.StorePath, from string) (objectFS, error) {
+	var subs []*zbstore.Substituter
+	if from != "" {
+		client, err := g.cacheAuth(ctx).Client()
+		if err != nil {
+			return nil, err
+		}
+		subs = []*zbstore.Substituter{{
+			URL:         from,
+			Client:      client,
+			Parallelism: g.downloadSegments,
+		}}
+	} else {
+		store := g.store()
+		if _, err := store.QueryPathInfo(ctx, p); err == nil {
+			g.recordAccess(ctx, p)
+			return localObjectFS(store.RealPath(string(p))), nil
+		} else if !errors.Is(err, zbstore.ErrNotFound) {
+			return nil, err
+		}
+		var err error
+		subs, err = g.substituterClients(ctx)
+		if err != nil {
+			return nil, err
+		}
+		zbstore.SortSubstituters(ctx, subs)
+	}
+
+	for _, sub := range subs {
+		info, err := sub.NARInfo(ctx, p)
+		if errors.Is(err, zbstore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf(ctx, "%v", err)
+			continue
+		}
+		log.Debugf(ctx, "Reading %s from %s", p, sub.URL)
+		fsys, err := sub.OpenNARFS(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+		return fsys, nil
+	}
+	return nil, fmt.Errorf("%s: %w", p, zbstore.ErrNotFound)
+}
+
+// localObjectFS is an [objectFS] for a store object in the local file system.
+type localObjectFS string
+
+func (root localObjectFS) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(root), filepath.FromSlash(name)), nil
+}
+
+func (root localObjectFS) Open(name string) (fs.File, error) {
+	path, err := root.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (root localObjectFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := root.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(path)
+}
+
+func (root localObjectFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := root.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (root localObjectFS) Lstat(name string) (fs.FileInfo, error) {
+	path, err := root.path("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(path)
+}
+
+func (root localObjectFS) ReadLink(name string) (string, error) {
+	path, err := root.path("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(path)
+}
+
+func (root localObjectFS) Close() error {
+	return nil
+}
+
+// objectModeString formats a file mode from a store object
+// the way it is stored in a NAR:
+// only the file type and whether a regular file is executable are significant.
+func objectModeString(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dr-xr-xr-x"
+	case mode.Type() == fs.ModeSymlink:
+		return "lrwxrwxrwx"
+	case mode&0o111 != 0:
+		return "-r-xr-xr-x"
+	default:
+		return "-r--r--r--"
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// tracingShutdownTimeout is how long zb waits to send buffered spans before exiting.
+const tracingShutdownTimeout = 5 * time.Second
+
+// tracer records the spans of zb commands.
+var tracer = otel.Tracer("zombiezen.com/go/zb/cmd/zb")
+
+// initTracing installs an OpenTelemetry tracer provider
+// that exports spans over OTLP/HTTP
+// if an endpoint is set with the standard OTEL_EXPORTER_OTLP_ENDPOINT
+// or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment variables.
+// Otherwise, spans are discarded.
+// The returned function sends any buffered spans
+// and must be called before the program exits.
+func initTracing(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	shutdown = func(context.Context) error { return nil }
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return shutdown, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return shutdown, err
+	}
+	// Attributes from OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME
+	// take precedence over the defaults.
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(semconv.ServiceName("zb")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return shutdown, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	// Allow a CI system to make zb's spans part of a larger trace
+	// with the TRACEPARENT environment variable.
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// traceParentContext returns ctx with the remote span described by
+// the TRACEPARENT environment variable, if set.
+func traceParentContext(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+)
+
+// defaultTestAttr is the attribute path that zb test evaluates
+// when no installables are given.
+const defaultTestAttr = "checks"
+
+type testOptions struct {
+	evalOptions
+	jobs   int
+	logDir string
+}
+
+func newTestCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "test [options] [INSTALLABLE [...]]",
+		Short: "build test derivations and report results",
+		Long: "Build every derivation found in the given installables " +
+			"(by default, the " + defaultTestAttr + " table) and report which ones failed. " +
+			"A failing test does not stop other tests from building. " +
+			"Tests whose derivations have already been built successfully are not rerun.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(testOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().IntVarP(&opts.jobs, "jobs", "j", runtime.NumCPU(), "run up to `n` tests at once")
+	c.Flags().StringVar(&opts.logDir, "log-dir", "", "write test logs into `dir` (default is a temporary directory)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		if len(opts.installables) == 0 {
+			opts.installables = []string{defaultTestAttr}
+		}
+		return runTest(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+type testCase struct {
+	name    string
+	drvPath nix.StorePath
+	logPath string
+	err     error
+}
+
+func runTest(ctx context.Context, g *globalConfig, opts *testOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	var tests []*testCase
+	for i, result := range results {
+		// Without installables, the whole expression is the single result.
+		name := "<expr>"
+		if i < len(opts.installables) {
+			name = opts.installables[i]
+		}
+		err := collectDerivations(name, result, func(name string, drv *zb.Derivation) error {
+			p, err := drv.StorePath()
+			if err != nil {
+				return err
+			}
+			tests = append(tests, &testCase{name: name, drvPath: p})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(tests) == 0 {
+		return fmt.Errorf("no tests found")
+	}
+	slices.SortFunc(tests, func(t1, t2 *testCase) int {
+		return strings.Compare(t1.name, t2.name)
+	})
+
+	logDir := opts.logDir
+	if logDir == "" {
+		logDir, err = os.MkdirTemp("", "zb-test-*")
+		if err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(logDir, 0o777); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(opts.jobs, 1))
+	for i, tc := range tests {
+		tc.logPath = filepath.Join(logDir, fmt.Sprintf("%03d-%s.log", i+1, logFileName(tc.name)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			tc.err = buildTest(ctx, g, tc)
+		}()
+	}
+	wg.Wait()
+
+	failures := 0
+	for _, tc := range tests {
+		if tc.err == nil {
+			fmt.Printf("PASS  %s\n", tc.name)
+			continue
+		}
+		failures++
+		fmt.Printf("FAIL  %s\n", tc.name)
+	}
+	for _, tc := range tests {
+		if tc.err == nil {
+			continue
+		}
+		fmt.Printf("\n--- %s (%s): %v\n", tc.name, tc.drvPath, tc.err)
+		if log, err := os.ReadFile(tc.logPath); err == nil {
+			os.Stdout.Write(log)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed (logs in %s)\n", len(tests)-failures, failures, logDir)
+	if failures > 0 {
+		return errors.New("tests failed")
+	}
+	return nil
+}
+
+func buildTest(ctx context.Context, g *globalConfig, tc *testCase) error {
+	f, err := os.Create(tc.logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	store := g.realisingStore(ctx)
+	store.Stderr = f
+	_, err = store.Realise(ctx, tc.drvPath)
+	return err
+}
+
+// collectDerivations calls f for every derivation in x,
+// descending into lists and tables.
+// name is the attribute path that identifies x.
+func collectDerivations(name string, x any, f func(name string, drv *zb.Derivation) error) error {
+	switch x := x.(type) {
+	case *zb.Derivation:
+		return f(name, x)
+	case []any:
+		for i, elem := range x {
+			if err := collectDerivations(fmt.Sprintf("%s[%d]", name, i+1), elem, f); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			if err := collectDerivations(name+"."+k, x[k], f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._+-]+`)
+
+func logFileName(testName string) string {
+	return unsafeFileNameChars.ReplaceAllString(testName, "_")
+}
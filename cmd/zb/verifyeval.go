@@ -0,0 +1,211 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type verifyEvalOptions struct {
+	evalOptions
+	evalServer string
+}
+
+func newVerifyEvalCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "verify-evaluation [options] [INSTALLABLE [...]]",
+		Short: "check that evaluation is deterministic",
+		Long: "Evaluate installables twice and compare the results. " +
+			"The second evaluation is sent to a zb eval-daemon if --eval-server is given, " +
+			"otherwise it uses a fresh evaluator. " +
+			"For each derivation that differs, the differences in its store derivation are listed.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ArbitraryArgs,
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(verifyEvalOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVar(&opts.evalServer, "eval-server", "", "compare against the zb eval-daemon listening on `socket`")
+	c.Flags().Lookup("eval-server").NoOptDefVal = defaultEvalSocket()
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runVerifyEval(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runVerifyEval(ctx context.Context, g *globalConfig, opts *verifyEvalOptions) error {
+	local, err := evalJSON(ctx, g, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	var other []json.RawMessage
+	if opts.evalServer != "" {
+		other, err = evalRemote(ctx, opts.evalServer, &opts.evalOptions)
+	} else {
+		other, err = evalJSON(ctx, g, &opts.evalOptions)
+	}
+	if err != nil {
+		return err
+	}
+	if len(local) != len(other) {
+		return fmt.Errorf("evaluations produced %d and %d results", len(local), len(other))
+	}
+
+	var diffs []evalDiff
+	for i := range local {
+		var x, y any
+		if err := json.Unmarshal(local[i], &x); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(other[i], &y); err != nil {
+			return err
+		}
+		diffs = diffJSONValues(diffs, "#"+strconv.Itoa(i+1), x, y)
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("%d result(s) match\n", len(local))
+		return nil
+	}
+
+	for _, d := range diffs {
+		fmt.Printf("%s: %s ≠ %s\n", d.path, d.a, d.b)
+		if d.drvA == "" || d.drvB == "" {
+			continue
+		}
+		causes, err := explainEvalDiff(g.store(), d.drvB, d.drvA)
+		if err != nil {
+			fmt.Printf("  (cannot compare derivations: %v)\n", err)
+			continue
+		}
+		for _, cause := range causes {
+			fmt.Printf("  %v\n", cause)
+		}
+	}
+	return fmt.Errorf("evaluation is not deterministic: %d difference(s)", len(diffs))
+}
+
+// evalJSON evaluates the installables in opts with a new evaluator
+// and returns the results in the form produced by zb eval --json.
+func evalJSON(ctx context.Context, g *globalConfig, opts *evalOptions) ([]json.RawMessage, error) {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, opts)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]json.RawMessage, 0, len(results))
+	for _, result := range results {
+		v, err := toJSONValue(result)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, data)
+	}
+	return raw, nil
+}
+
+// An evalDiff is a value that differs between two evaluations.
+type evalDiff struct {
+	// path is the location of the value within the results,
+	// like `#1.pkgs["hello"]`.
+	path string
+	a, b string
+	// drvA and drvB are set if both values are store derivation paths.
+	drvA, drvB nix.StorePath
+}
+
+// diffJSONValues appends the differences between two decoded JSON values to diffs.
+func diffJSONValues(diffs []evalDiff, path string, a, b any) []evalDiff {
+	switch a := a.(type) {
+	case []any:
+		if b, ok := b.([]any); ok && len(a) == len(b) {
+			for i := range a {
+				diffs = diffJSONValues(diffs, path+"["+strconv.Itoa(i+1)+"]", a[i], b[i])
+			}
+			return diffs
+		}
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(a))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, dup := a[k]; !dup {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+			for _, k := range keys {
+				elemPath := path + "[" + strconv.Quote(k) + "]"
+				va, okA := a[k]
+				vb, okB := b[k]
+				switch {
+				case !okA:
+					diffs = append(diffs, evalDiff{path: elemPath, a: "(missing)", b: formatJSONValue(vb)})
+				case !okB:
+					diffs = append(diffs, evalDiff{path: elemPath, a: formatJSONValue(va), b: "(missing)"})
+				default:
+					diffs = diffJSONValues(diffs, elemPath, va, vb)
+				}
+			}
+			return diffs
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return diffs
+	}
+	d := evalDiff{path: path, a: formatJSONValue(a), b: formatJSONValue(b)}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			pa, errA := nix.ParseStorePath(sa)
+			pb, errB := nix.ParseStorePath(sb)
+			if errA == nil && errB == nil && pa.IsDerivation() && pb.IsDerivation() {
+				d.drvA, d.drvB = pa, pb
+			}
+		}
+	}
+	return append(diffs, d)
+}
+
+func formatJSONValue(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// explainEvalDiff reads two store derivations produced by different evaluations
+// and lists the differences between them.
+func explainEvalDiff(store *zbstore.Store, oldPath, newPath nix.StorePath) ([]zb.RebuildCause, error) {
+	readDerivation := storeDerivationReader(store)
+	oldDrv, err := readDerivation(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newDrv, err := readDerivation(newPath)
+	if err != nil {
+		return nil, err
+	}
+	return zb.ExplainRebuild(oldDrv, newDrv, readDerivation, &zb.ExplainRebuildOptions{
+		RealPath: store.RealPath,
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/zb"
+)
+
+// watchDebounce is how long watchBuild waits after a change
+// for further changes before rebuilding,
+// so that saving several files at once causes a single rebuild.
+const watchDebounce = 200 * time.Millisecond
+
+// watchBuild builds the derivations described by opts,
+// then rebuilds them every time one of the sources read during evaluation changes
+// until ctx is canceled.
+// The evaluator is reused between builds,
+// so unchanged sources are not imported again
+// and unchanged derivations are not rebuilt.
+func watchBuild(ctx context.Context, g *globalConfig, opts *buildOptions, eval *zb.Eval) error {
+	var ignore []string
+	if opts.outLink != "" {
+		// Creating the output links must not trigger another build.
+		outLink, err := filepath.Abs(opts.outLink)
+		if err != nil {
+			return err
+		}
+		ignore = append(ignore, outLink)
+	}
+	for {
+		if err := build(ctx, g, opts, eval); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Errorf(ctx, "%v", err)
+		}
+		sources := eval.Sources()
+		if len(sources) == 0 {
+			return errors.New("--watch: evaluation did not read any source files")
+		}
+		log.Infof(ctx, "Watching %d source path(s) for changes...", len(sources))
+		if err := waitForChange(ctx, sources, ignore); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// waitForChange blocks until a file in sources
+// (or anywhere inside the directories in sources) changes
+// or ctx is canceled.
+// Changes to paths that start with any of the strings in ignore
+// and changes inside .git directories are ignored.
+func waitForChange(ctx context.Context, sources []string, ignore []string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	files := make(map[string]struct{})
+	var trees []string
+	for _, src := range sources {
+		info, err := os.Stat(src)
+		if err != nil || !info.IsDir() {
+			// Watch the parent directory so that files
+			// that editors replace (or that don't exist yet) are noticed.
+			files[src] = struct{}{}
+			if err := w.Add(filepath.Dir(src)); err != nil {
+				return err
+			}
+			continue
+		}
+		trees = append(trees, src)
+		err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() {
+				return nil
+			}
+			if entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return w.Add(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	relevant := func(ev fsnotify.Event) bool {
+		if ev.Op == fsnotify.Chmod {
+			return false
+		}
+		for _, prefix := range ignore {
+			if strings.HasPrefix(ev.Name, prefix) {
+				return false
+			}
+		}
+		if _, ok := files[ev.Name]; ok {
+			return true
+		}
+		for _, tree := range trees {
+			rel, err := filepath.Rel(tree, ev.Name)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			if slashRel := filepath.ToSlash(rel); slashRel == ".git" || strings.HasPrefix(slashRel, ".git/") {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-w.Events:
+			if relevant(ev) {
+				log.Debugf(ctx, "Change detected: %v", ev)
+				debounce = time.After(watchDebounce)
+			}
+		case err := <-w.Errors:
+			return err
+		case <-debounce:
+			return nil
+		}
+	}
+}
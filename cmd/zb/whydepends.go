@@ -0,0 +1,140 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+	"zombiezen.com/go/zb/zbstore"
+)
+
+type whyDependsOptions struct {
+	evalOptions
+	all bool
+}
+
+func newWhyDependsCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:   "why-depends [options] PACKAGE DEPENDENCY",
+		Short: "show why a store object depends on another",
+		Long: "Print the shortest chain of references from PACKAGE to DEPENDENCY, " +
+			"along with the files in each store object that contain the reference. " +
+			"Each argument may be a path to a store object (like an out-link) " +
+			"or an installable, whose out output is built if necessary.",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.ExactArgs(2),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(whyDependsOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().BoolVarP(&opts.all, "all", "a", false, "show all shortest chains instead of just one")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runWhyDepends(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runWhyDepends(ctx context.Context, g *globalConfig, opts *whyDependsOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	store := g.realisingStore(ctx)
+	var paths [2]nix.StorePath
+	for i, arg := range opts.installables {
+		var err error
+		paths[i], err = resolveStoreObject(ctx, eval, store, &opts.evalOptions, arg)
+		if err != nil {
+			return err
+		}
+	}
+	from, to := paths[0], paths[1]
+
+	chains, err := zbstore.ShortestReferencePaths(from, to, func(p nix.StorePath) ([]nix.StorePath, error) {
+		return store.QueryReferences(ctx, p)
+	})
+	if err != nil {
+		return err
+	}
+	if len(chains) == 0 {
+		return fmt.Errorf("%s does not depend on %s", from, to)
+	}
+	if !opts.all {
+		chains = chains[:1]
+	}
+	for i, chain := range chains {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(chain[0])
+		for j := 1; j < len(chain); j++ {
+			sites, err := zbstore.FindReferences(string(chain[j-1]), chain[j])
+			if err != nil {
+				return err
+			}
+			for _, site := range sites {
+				kind := "file"
+				if site.IsSymlink {
+					kind = "symlink"
+				}
+				fmt.Printf("    %s %s: …%s…\n", kind, site.Path, site.Context)
+			}
+			fmt.Printf("→ %s\n", chain[j])
+		}
+	}
+	return nil
+}
+
+// resolveStoreObject returns the store object that arg refers to.
+// If arg is a filesystem path that leads into the store,
+// then that store object is returned.
+// Otherwise, arg is evaluated as an installable
+// and the store path of the resulting derivation's out output is returned.
+func resolveStoreObject(ctx context.Context, eval *zb.Eval, store *zbstore.Store, opts *evalOptions, arg string) (nix.StorePath, error) {
+	if _, err := os.Lstat(arg); err == nil {
+		resolved, err := filepath.EvalSymlinks(arg)
+		if err != nil {
+			return "", err
+		}
+		resolved, err = filepath.Abs(resolved)
+		if err != nil {
+			return "", err
+		}
+		storePath, _, err := store.Dir.ParsePath(resolved)
+		if err != nil {
+			return "", fmt.Errorf("%s: not in store", arg)
+		}
+		return storePath, nil
+	}
+
+	argOpts := *opts
+	argOpts.installables = []string{arg}
+	results, err := evaluate(eval, &argOpts)
+	if err != nil {
+		return "", err
+	}
+	drv, _ := results[0].(*zb.Derivation)
+	if drv == nil {
+		return "", fmt.Errorf("%s: %v is not a derivation", arg, results[0])
+	}
+	drvPath, err := drv.StorePath()
+	if err != nil {
+		return "", err
+	}
+	outputs, err := store.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		return "", err
+	}
+	outPath, ok := outputs["out"]
+	if !ok {
+		return "", fmt.Errorf("%s does not have an out output", drvPath)
+	}
+	return outPath, nil
+}
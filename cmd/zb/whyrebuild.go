@@ -0,0 +1,124 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb"
+)
+
+type whyRebuildOptions struct {
+	evalOptions
+	old string
+}
+
+func newWhyRebuildCommand(g *globalConfig) *cobra.Command {
+	c := &cobra.Command{
+		Use:                   "why-rebuild [options] [INSTALLABLE]",
+		Short:                 "explain why a derivation will be rebuilt",
+		DisableFlagsInUseLine: true,
+		Args:                  cobra.MaximumNArgs(1),
+		SilenceErrors:         true,
+		SilenceUsage:          true,
+	}
+	opts := new(whyRebuildOptions)
+	addEvalFlags(c, &opts.evalOptions)
+	c.Flags().StringVar(&opts.old, "old", "result", "compare against the derivation at `path`, "+
+		"which may be a .drv file or a built output (like an out-link)")
+	c.RunE = func(cmd *cobra.Command, args []string) error {
+		opts.installables = args
+		return runWhyRebuild(cmd.Context(), g, opts)
+	}
+	return c
+}
+
+func runWhyRebuild(ctx context.Context, g *globalConfig, opts *whyRebuildOptions) error {
+	eval := g.newEval(ctx)
+	defer eval.Close()
+	results, err := evaluate(eval, &opts.evalOptions)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected a single result (got %d)", len(results))
+	}
+	newDrv, _ := results[0].(*zb.Derivation)
+	if newDrv == nil {
+		return fmt.Errorf("%v is not a derivation", results[0])
+	}
+	newPath, err := newDrv.StorePath()
+	if err != nil {
+		return err
+	}
+
+	oldPath, err := resolveDeriver(ctx, g.layout.dir, opts.old)
+	if err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		fmt.Printf("%s is unchanged\n", newPath)
+		return nil
+	}
+	readDerivation := storeDerivationReader(g.store())
+	oldDrv, err := readDerivation(oldPath)
+	if err != nil {
+		return err
+	}
+	causes, err := zb.ExplainRebuild(oldDrv, newDrv, readDerivation, &zb.ExplainRebuildOptions{
+		RealPath:  g.store().RealPath,
+		SourceDir: eval.SourceDir,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s → %s\n", oldPath, newPath)
+	for _, cause := range causes {
+		fmt.Printf("  %v\n", cause)
+	}
+	return nil
+}
+
+// resolveDeriver returns the store derivation path
+// that produced the given store object or derivation file.
+// path may be a symlink to a store object, like an out-link.
+func resolveDeriver(ctx context.Context, dir nix.StoreDirectory, path string) (nix.StorePath, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+	storePath, sub, err := dir.ParsePath(resolved)
+	if err != nil {
+		return "", err
+	}
+	if sub != "" {
+		return "", fmt.Errorf("%s is not a store object", path)
+	}
+	if storePath.IsDerivation() {
+		return storePath, nil
+	}
+
+	c := exec.CommandContext(ctx, "nix-store", "--query", "--deriver", "--", string(storePath))
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("nix-store --query --deriver: %v", err)
+	}
+	deriver := strings.TrimSpace(string(out))
+	if deriver == "unknown-deriver" {
+		return "", fmt.Errorf("%s has no known deriver", storePath)
+	}
+	return nix.ParseStorePath(deriver)
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// A CycleError is returned when a derivation depends on itself,
+// either directly or through other derivations.
+// Such cycles cannot be produced by evaluation,
+// but can be present in hand-written store derivations.
+type CycleError struct {
+	// Cycle is the chain of derivations that form the cycle.
+	// The first and last elements are the same derivation.
+	Cycle []nix.StorePath
+}
+
+// newCycleError returns a [CycleError] for the cycle formed
+// by depending on p from the innermost derivation in stack.
+// p must be present in stack.
+func newCycleError(stack []nix.StorePath, p nix.StorePath) *CycleError {
+	i := slices.Index(stack, p)
+	cycle := make([]nix.StorePath, 0, len(stack)-i+1)
+	cycle = append(cycle, stack[i:]...)
+	cycle = append(cycle, p)
+	return &CycleError{Cycle: cycle}
+}
+
+func (e *CycleError) Error() string {
+	sb := new(strings.Builder)
+	sb.WriteString("dependency cycle: ")
+	for i, p := range e.Cycle {
+		if i > 0 {
+			sb.WriteString(" → ")
+		}
+		sb.WriteString(string(p))
+	}
+	return sb.String()
+}
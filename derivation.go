@@ -8,9 +8,13 @@ import (
 	"cmp"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 
 	"zombiezen.com/go/nix"
@@ -44,6 +48,61 @@ type Derivation struct {
 	InputDerivations map[nix.StorePath]*sortedset.Set[string]
 	// Outputs is the set of outputs that the derivation produces.
 	Outputs map[string]*DerivationOutput
+
+	// Meta is descriptive information about the derivation
+	// given to the evaluator in the derivation's meta argument.
+	// It is not part of the store derivation,
+	// so it does not affect the derivation's store path
+	// and is nil for derivations read from the store.
+	Meta *DerivationMeta
+}
+
+// DerivationMeta is descriptive information about a [Derivation].
+type DerivationMeta struct {
+	// Description is a short, human-readable summary of the derivation's outputs.
+	Description string
+	// License is an SPDX license expression.
+	License string
+	// Homepage is the URL of the software's website.
+	Homepage string
+	// Maintainers is a list of people responsible for the derivation.
+	Maintainers []string
+}
+
+// Environment variables that describe the platforms involved in cross-compilation.
+const (
+	// hostPlatformVar names the system that the derivation's outputs run on.
+	hostPlatformVar = "hostPlatform"
+	// targetPlatformVar names the system that the derivation's outputs produce code for,
+	// for outputs like compilers.
+	targetPlatformVar = "targetPlatform"
+)
+
+// BuildPlatform returns the system that the derivation's builder runs on,
+// which is the same as drv.System.
+func (drv *Derivation) BuildPlatform() string {
+	return drv.System
+}
+
+// HostPlatform returns the system that the derivation's outputs run on.
+// Unless the derivation sets hostPlatform in its environment,
+// this is the same as its build platform.
+func (drv *Derivation) HostPlatform() string {
+	if p := drv.Env[hostPlatformVar]; p != "" {
+		return p
+	}
+	return drv.BuildPlatform()
+}
+
+// TargetPlatform returns the system that the derivation's outputs produce code for.
+// It is only meaningful for outputs like compilers and linkers.
+// Unless the derivation sets targetPlatform in its environment,
+// this is the same as its host platform.
+func (drv *Derivation) TargetPlatform() string {
+	if p := drv.Env[targetPlatformVar]; p != "" {
+		return p
+	}
+	return drv.HostPlatform()
 }
 
 func (drv *Derivation) StorePath() (nix.StorePath, error) {
@@ -65,7 +124,7 @@ func (drv *Derivation) export() (nix.StorePath, []byte, error) {
 		return "", nil, fmt.Errorf("missing store directory")
 	}
 
-	data, err := drv.marshalText(false)
+	data, err := drv.marshalText(false, nil)
 	if err != nil {
 		return "", nil, err
 	}
@@ -84,6 +143,146 @@ func (drv *Derivation) export() (nix.StorePath, []byte, error) {
 	return p, data, nil
 }
 
+// Hash returns the SHA-256 hash of the derivation's ATerm serialization.
+// It is the hash from which the derivation's store path is computed,
+// so it identifies the derivation by its content.
+func (drv *Derivation) Hash() (nix.Hash, error) {
+	data, err := drv.MarshalText()
+	if err != nil {
+		return nix.Hash{}, err
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(data)
+	return h.SumHash(), nil
+}
+
+// InputAddressedOutputs returns the input-addressed outputs
+// for a derivation whose outputs are all deferred.
+// Their paths are computed from the derivation's hash modulo
+// in the same way as the build backend's classic output scheme,
+// so they match the paths that Nix expressions and caches use.
+// The environment variables for the outputs must be set to empty strings.
+// inputHashModulo returns the hash modulo of an input derivation
+// (see [Derivation.HashModulo]).
+// If the output paths of any of the derivation's inputs are not yet known,
+// then the derivation's outputs cannot be computed either
+// and must stay deferred until the inputs are built and the derivation is resolved.
+func (drv *Derivation) InputAddressedOutputs(inputHashModulo func(nix.StorePath) (nix.Hash, error)) (map[string]*DerivationOutput, error) {
+	for outName, out := range drv.Outputs {
+		if !out.IsDeferred() {
+			return nil, fmt.Errorf("compute %s output paths: output %s is not deferred", drv.Name, outName)
+		}
+		if v, ok := drv.Env[outName]; !ok || v != "" {
+			return nil, fmt.Errorf("compute %s output paths: environment variable %s must be empty", drv.Name, outName)
+		}
+	}
+	h, err := drv.hashModulo(true, inputHashModulo)
+	if err != nil {
+		return nil, fmt.Errorf("compute %s output paths: %w", drv.Name, err)
+	}
+	outputs := make(map[string]*DerivationOutput, len(drv.Outputs))
+	for outName := range drv.Outputs {
+		name := drv.Name
+		if outName != defaultDerivationOutputName {
+			name += "-" + outName
+		}
+		p, err := makeStorePath(drv.Dir, "output:"+outName, h, name, storeReferences{})
+		if err != nil {
+			return nil, fmt.Errorf("compute %s output paths: %v", drv.Name, err)
+		}
+		outputs[outName] = InputAddressed(p)
+	}
+	return outputs, nil
+}
+
+// HashModulo returns the derivation's hash modulo fixed-output derivations,
+// which input-addressed output paths are computed from.
+// The hash modulo of a fixed-output derivation depends only on its output,
+// so that changing how a fixed output is obtained
+// does not change the paths of derivations that depend on it.
+// Other derivations are hashed with the paths of their input derivations
+// replaced by the input derivations' hashes modulo.
+// inputHashModulo returns the hash modulo of an input derivation.
+// Derivations with floating content-addressed or deferred outputs
+// don't have a hash modulo.
+func (drv *Derivation) HashModulo(inputHashModulo func(nix.StorePath) (nix.Hash, error)) (nix.Hash, error) {
+	h, err := drv.hashModulo(false, inputHashModulo)
+	if err != nil {
+		return nix.Hash{}, fmt.Errorf("compute %s hash modulo: %w", drv.Name, err)
+	}
+	return h, nil
+}
+
+// errUnknownOutputs is returned when computing the hash modulo of a derivation
+// whose output paths are not known until it is built.
+var errUnknownOutputs = errors.New("output paths are not known before building")
+
+// hasUnknownOutputs reports whether any of the derivation's output paths
+// are not known until it (or its inputs) are built.
+func (drv *Derivation) hasUnknownOutputs() bool {
+	for _, out := range drv.Outputs {
+		if out.IsDeferred() || out.typ == floatingCAOutputType {
+			return true
+		}
+	}
+	return false
+}
+
+func (drv *Derivation) hashModulo(maskOutputs bool, inputHashModulo func(nix.StorePath) (nix.Hash, error)) (nix.Hash, error) {
+	if out := drv.Outputs[defaultDerivationOutputName]; len(drv.Outputs) == 1 && out != nil && out.typ == fixedCAOutputType {
+		p, ok := out.Path(drv.Dir, drv.Name, defaultDerivationOutputName)
+		if !ok {
+			return nix.Hash{}, fmt.Errorf("invalid fixed output path")
+		}
+		h := nix.NewHasher(nix.SHA256)
+		h.WriteString("fixed:out:")
+		h.WriteString(methodOfContentAddress(out.ca).prefix())
+		h.WriteString(out.ca.Hash().Base16())
+		h.WriteString(":")
+		h.WriteString(string(p))
+		return h.SumHash(), nil
+	}
+	for _, out := range drv.Outputs {
+		// Deferred outputs are masked when computing input-addressed output paths.
+		if !out.IsDeferred() && out.typ == floatingCAOutputType || out.IsDeferred() && !maskOutputs {
+			return nix.Hash{}, errUnknownOutputs
+		}
+	}
+
+	inputs := make(map[nix.StorePath]string, len(drv.InputDerivations))
+	for drvPath := range drv.InputDerivations {
+		h, err := inputHashModulo(drvPath)
+		if err != nil {
+			return nix.Hash{}, err
+		}
+		inputs[drvPath] = h.RawBase16()
+	}
+	data, err := drv.marshalText(maskOutputs, inputs)
+	if err != nil {
+		return nix.Hash{}, err
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(data)
+	return h.SumHash(), nil
+}
+
+// MaxClosureSize returns the value of the derivation's maxClosureSize attribute:
+// the maximum number of bytes that the closure of any one of its outputs may occupy.
+// The limit can only be checked after the build,
+// so zb build removes the outputs of a derivation that exceeds it.
+// ok is false if the derivation does not have such a limit.
+func (drv *Derivation) MaxClosureSize() (n int64, ok bool, err error) {
+	s, ok := drv.Env["maxClosureSize"]
+	if !ok {
+		return 0, false, nil
+	}
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("%s derivation: invalid maxClosureSize %q", drv.Name, s)
+	}
+	return n, true, nil
+}
+
 func (drv *Derivation) references() storeReferences {
 	refs := storeReferences{}
 	refs.others.Grow(drv.InputSources.Len() + len(drv.InputDerivations))
@@ -96,10 +295,14 @@ func (drv *Derivation) references() storeReferences {
 
 // MarshalText converts the derivation to ATerm format.
 func (drv *Derivation) MarshalText() ([]byte, error) {
-	return drv.marshalText(false)
+	return drv.marshalText(false, nil)
 }
 
-func (drv *Derivation) marshalText(maskOutputs bool) ([]byte, error) {
+// marshalText converts the derivation to ATerm format.
+// If maskOutputs is true, the paths of the outputs are written as empty strings.
+// If inputs is not nil, it maps each input derivation
+// to the string written in place of its path.
+func (drv *Derivation) marshalText(maskOutputs bool, inputs map[nix.StorePath]string) ([]byte, error) {
 	if drv.Name == "" {
 		return nil, fmt.Errorf("marshal derivation: missing name")
 	}
@@ -121,19 +324,37 @@ func (drv *Derivation) marshalText(maskOutputs bool) ([]byte, error) {
 	}
 
 	buf = append(buf, "],["...)
-	for i, drvPath := range sortedKeys(drv.InputDerivations) {
-		if i > 0 {
-			buf = append(buf, ',')
-		}
-		buf = append(buf, '(')
+	inputDrvs := make(map[string]*sortedset.Set[string], len(drv.InputDerivations))
+	for drvPath, outputs := range drv.InputDerivations {
 		if got := drvPath.Dir(); got != drv.Dir {
 			return nil, fmt.Errorf("marshal %s derivation: inputs: unexpected store directory %s (using %s)",
 				drv.Name, got, drv.Dir)
 		}
-		buf = appendATermString(buf, string(drvPath))
+		if inputs == nil {
+			inputDrvs[string(drvPath)] = outputs
+			continue
+		}
+		s, ok := inputs[drvPath]
+		if !ok {
+			return nil, fmt.Errorf("marshal %s derivation: inputs: missing replacement for %s", drv.Name, drvPath)
+		}
+		if prev := inputDrvs[s]; prev != nil {
+			// Inputs with the same replacement are merged.
+			merged := prev.Clone()
+			merged.AddSet(outputs)
+			outputs = merged
+		}
+		inputDrvs[s] = outputs
+	}
+	for i, input := range sortedKeys(inputDrvs) {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '(')
+		buf = appendATermString(buf, input)
 		buf = append(buf, ",["...)
 		// TODO(someday): This can be some kind of tree? See DerivedPathMap.
-		outputs := drv.InputDerivations[drvPath]
+		outputs := inputDrvs[input]
 		for j := 0; j < outputs.Len(); j++ {
 			if j > 0 {
 				buf = append(buf, ',')
@@ -186,7 +407,357 @@ func (drv *Derivation) marshalText(maskOutputs bool) ([]byte, error) {
 	return buf, nil
 }
 
-func writeDerivation(ctx context.Context, drv *Derivation) (nix.StorePath, error) {
+// ParseDerivation parses a derivation from ATerm format.
+// name is the derivation's name without the ".drv" suffix.
+func ParseDerivation(dir nix.StoreDirectory, name string, data []byte) (*Derivation, error) {
+	drv := &Derivation{
+		Dir:  dir,
+		Name: name,
+		Env:  make(map[string]string),
+	}
+	p := &atermParser{data: data}
+	if err := drv.parse(p); err != nil {
+		return nil, fmt.Errorf("parse %s derivation: %v", name, err)
+	}
+	return drv, nil
+}
+
+// ReadDerivation reads the store derivation at the given path
+// from the local filesystem.
+func ReadDerivation(path nix.StorePath) (*Derivation, error) {
+	return ReadDerivationFromRoot("", path)
+}
+
+// ReadDerivationFromRoot reads the store derivation at the given path
+// from a store kept under the directory root
+// (see [Eval.SetStoreRoot]).
+// If root is empty, ReadDerivationFromRoot is equivalent to [ReadDerivation].
+func ReadDerivationFromRoot(root string, path nix.StorePath) (*Derivation, error) {
+	name, isDrv := strings.CutSuffix(path.Name(), ".drv")
+	if !isDrv {
+		return nil, fmt.Errorf("read derivation %s: not a derivation", path)
+	}
+	data, err := os.ReadFile(filepath.Join(root, string(path)))
+	if err != nil {
+		return nil, fmt.Errorf("read derivation: %w", err)
+	}
+	drv, err := ParseDerivation(path.Dir(), name, data)
+	if err != nil {
+		return nil, fmt.Errorf("read derivation %s: %v", path, err)
+	}
+	return drv, nil
+}
+
+func (drv *Derivation) parse(p *atermParser) error {
+	if err := p.expect("Derive("); err != nil {
+		return err
+	}
+
+	err := p.list(func() error {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		outName, err := p.string()
+		if err != nil {
+			return err
+		}
+		var fields [3]string
+		for i := range fields {
+			if err := p.expect(","); err != nil {
+				return err
+			}
+			fields[i], err = p.string()
+			if err != nil {
+				return err
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		if _, dup := drv.Outputs[outName]; dup {
+			return fmt.Errorf("outputs: duplicate %q", outName)
+		}
+		out, err := parseDerivationOutput(drv.Dir, drv.Name, outName, fields[0], fields[1], fields[2])
+		if err != nil {
+			return err
+		}
+		if drv.Outputs == nil {
+			drv.Outputs = make(map[string]*DerivationOutput)
+		}
+		drv.Outputs[outName] = out
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("outputs: %v", err)
+	}
+
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	err = p.list(func() error {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		drvPath, err := p.storePath(drv.Dir)
+		if err != nil {
+			return err
+		}
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		outputs := new(sortedset.Set[string])
+		err = p.list(func() error {
+			outName, err := p.string()
+			if err != nil {
+				return err
+			}
+			outputs.Add(outName)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		if drv.InputDerivations == nil {
+			drv.InputDerivations = make(map[nix.StorePath]*sortedset.Set[string])
+		}
+		drv.InputDerivations[drvPath] = outputs
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("input derivations: %v", err)
+	}
+
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	err = p.list(func() error {
+		src, err := p.storePath(drv.Dir)
+		if err != nil {
+			return err
+		}
+		drv.InputSources.Add(src)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("input sources: %v", err)
+	}
+
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	if drv.System, err = p.string(); err != nil {
+		return fmt.Errorf("system: %v", err)
+	}
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	if drv.Builder, err = p.string(); err != nil {
+		return fmt.Errorf("builder: %v", err)
+	}
+
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	err = p.list(func() error {
+		arg, err := p.string()
+		if err != nil {
+			return err
+		}
+		drv.Args = append(drv.Args, arg)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("args: %v", err)
+	}
+
+	if err := p.expect(","); err != nil {
+		return err
+	}
+	err = p.list(func() error {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		k, err := p.string()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		v, err := p.string()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		drv.Env[k] = v
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("env: %v", err)
+	}
+
+	if err := p.expect(")"); err != nil {
+		return err
+	}
+	if p.pos < len(p.data) {
+		return fmt.Errorf("trailing data at offset %d", p.pos)
+	}
+	return nil
+}
+
+func parseDerivationOutput(dir nix.StoreDirectory, drvName, outName, path, hashAlgo, hashHex string) (*DerivationOutput, error) {
+	if hashAlgo == "" {
+		if hashHex != "" {
+			return nil, fmt.Errorf("output %s: hash without algorithm", outName)
+		}
+		if path == "" {
+			return DeferredOutput(), nil
+		}
+		p, err := nix.ParseStorePath(path)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %v", outName, err)
+		}
+		if got := p.Dir(); got != dir {
+			return nil, fmt.Errorf("output %s: unexpected store directory %s (using %s)", outName, got, dir)
+		}
+		return InputAddressed(p), nil
+	}
+
+	method := flatFileIngestionMethod
+	if rest, ok := strings.CutPrefix(hashAlgo, "text:"); ok {
+		method = textIngestionMethod
+		hashAlgo = rest
+	} else if rest, ok := strings.CutPrefix(hashAlgo, "r:"); ok {
+		method = recursiveFileIngestionMethod
+		hashAlgo = rest
+	}
+	htype, err := nix.ParseHashType(hashAlgo)
+	if err != nil {
+		return nil, fmt.Errorf("output %s: %v", outName, err)
+	}
+	if hashHex == "" {
+		if path != "" {
+			return nil, fmt.Errorf("output %s: floating content-addressed output has path", outName)
+		}
+		return &DerivationOutput{
+			typ:      floatingCAOutputType,
+			method:   method,
+			hashAlgo: htype,
+		}, nil
+	}
+
+	h, err := nix.ParseHash(htype.String() + ":" + hashHex)
+	if err != nil {
+		return nil, fmt.Errorf("output %s: %v", outName, err)
+	}
+	var out *DerivationOutput
+	switch method {
+	case textIngestionMethod:
+		out = FixedCAOutput(nix.TextContentAddress(h))
+	case recursiveFileIngestionMethod:
+		out = FixedCAOutput(nix.RecursiveFileContentAddress(h))
+	default:
+		out = FixedCAOutput(nix.FlatFileContentAddress(h))
+	}
+	if want, ok := out.Path(dir, drvName, outName); !ok || string(want) != path {
+		return nil, fmt.Errorf("output %s: path %q does not match content address (expected %s)", outName, path, want)
+	}
+	return out, nil
+}
+
+// atermParser is a cursor over derivation ATerm text.
+type atermParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *atermParser) expect(s string) error {
+	if !bytes.HasPrefix(p.data[p.pos:], []byte(s)) {
+		return fmt.Errorf("expected %q at offset %d", s, p.pos)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// list parses a bracketed, comma-separated list,
+// calling f to parse each element.
+func (p *atermParser) list(f func() error) error {
+	if err := p.expect("["); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		if p.pos < len(p.data) && p.data[p.pos] == ']' {
+			p.pos++
+			return nil
+		}
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return err
+			}
+		}
+		if err := f(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *atermParser) string() (string, error) {
+	if err := p.expect(`"`); err != nil {
+		return "", err
+	}
+	sb := new(strings.Builder)
+	for {
+		if p.pos >= len(p.data) {
+			return "", io.ErrUnexpectedEOF
+		}
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.pos >= len(p.data) {
+				return "", io.ErrUnexpectedEOF
+			}
+			c = p.data[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func (p *atermParser) storePath(dir nix.StoreDirectory) (nix.StorePath, error) {
+	s, err := p.string()
+	if err != nil {
+		return "", err
+	}
+	path, err := nix.ParseStorePath(s)
+	if err != nil {
+		return "", err
+	}
+	if got := path.Dir(); got != dir {
+		return "", fmt.Errorf("unexpected store directory %s (using %s)", got, dir)
+	}
+	return path, nil
+}
+
+func (eval *Eval) writeDerivation(ctx context.Context, drv *Derivation) (nix.StorePath, error) {
 	p, data, err := drv.export()
 	if err != nil {
 		if drv.Name == "" {
@@ -195,7 +766,7 @@ func writeDerivation(ctx context.Context, drv *Derivation) (nix.StorePath, error
 		return "", fmt.Errorf("write %s derivation: %v", drv.Name, err)
 	}
 
-	imp, err := startImport(ctx)
+	imp, err := eval.startImport(ctx)
 	if err != nil {
 		return "", fmt.Errorf("write %s derivation: %v", drv.Name, err)
 	}
@@ -218,6 +789,35 @@ func writeDerivation(ctx context.Context, drv *Derivation) (nix.StorePath, error
 	return p, nil
 }
 
+// derivationHashModulo returns the hash modulo of a derivation
+// (see [Derivation.HashModulo]),
+// reading the derivation from the store if the evaluator has not seen it.
+func (eval *Eval) derivationHashModulo(drvPath nix.StorePath) (nix.Hash, error) {
+	h, ok := eval.hashesModulo[drvPath]
+	if !ok {
+		if slices.Contains(eval.hashingModulo, drvPath) {
+			return nix.Hash{}, newCycleError(eval.hashingModulo, drvPath)
+		}
+		drv, err := ReadDerivationFromRoot(eval.storeRoot, drvPath)
+		if err != nil {
+			return nix.Hash{}, err
+		}
+		if !drv.hasUnknownOutputs() {
+			eval.hashingModulo = append(eval.hashingModulo, drvPath)
+			h, err = drv.HashModulo(eval.derivationHashModulo)
+			eval.hashingModulo = eval.hashingModulo[:len(eval.hashingModulo)-1]
+			if err != nil {
+				return nix.Hash{}, err
+			}
+		}
+		eval.hashesModulo[drvPath] = h
+	}
+	if h.IsZero() {
+		return nix.Hash{}, fmt.Errorf("input %s: %w", drvPath, errUnknownOutputs)
+	}
+	return h, nil
+}
+
 type derivationOutputType int8
 
 const (
@@ -230,7 +830,7 @@ const (
 const defaultDerivationOutputName = "out"
 
 // A DerivationOutput is an output of a [Derivation].
-// A nil DerivationOutput represents a deferred output.
+// A nil DerivationOutput is equivalent to [DeferredOutput].
 type DerivationOutput struct {
 	typ      derivationOutputType
 	path     nix.StorePath
@@ -239,6 +839,18 @@ type DerivationOutput struct {
 	hashAlgo nix.HashType
 }
 
+// DeferredOutput returns an input-addressed output whose path is not yet known
+// because the derivation depends on outputs that are not known until they are built.
+// The path is computed when the derivation is resolved.
+func DeferredOutput() *DerivationOutput {
+	return &DerivationOutput{typ: deferredOutputType}
+}
+
+// IsDeferred reports whether out is a [DeferredOutput].
+func (out *DerivationOutput) IsDeferred() bool {
+	return out == nil || out.typ == deferredOutputType
+}
+
 func InputAddressed(path nix.StorePath) *DerivationOutput {
 	return &DerivationOutput{
 		typ:  inputAddressedOutputType,
@@ -277,6 +889,15 @@ func RecursiveFileFloatingCAOutput(hashAlgo nix.HashType) *DerivationOutput {
 	}
 }
 
+// FixedCA returns the content address of a fixed-output derivation's output.
+// ok is false if the output is not fixed.
+func (out *DerivationOutput) FixedCA() (ca nix.ContentAddress, ok bool) {
+	if out == nil || out.typ != fixedCAOutputType {
+		return nix.ContentAddress{}, false
+	}
+	return out.ca, true
+}
+
 func (out *DerivationOutput) Path(store nix.StoreDirectory, drvName, outputName string) (path nix.StorePath, ok bool) {
 	if out == nil {
 		return "", false
@@ -298,7 +919,7 @@ func (out *DerivationOutput) Path(store nix.StoreDirectory, drvName, outputName
 func (out *DerivationOutput) marshalText(dst []byte, storeDir nix.StoreDirectory, drvName, outName string, maskOutputs bool) ([]byte, error) {
 	dst = append(dst, '(')
 	dst = appendATermString(dst, outName)
-	if out == nil {
+	if out.IsDeferred() {
 		dst = append(dst, `,"","","")`...)
 		return dst, nil
 	}
@@ -433,16 +1054,22 @@ func (m contentAddressMethod) prefix() string {
 	}
 }
 
-func hashPlaceholder(outputName string) string {
+// HashPlaceholder returns the placeholder string
+// that a derivation uses in its environment
+// to refer to one of its own outputs.
+// The builder must substitute the actual output path.
+func HashPlaceholder(outputName string) string {
 	h := nix.NewHasher(nix.SHA256)
 	h.WriteString("nix-output:")
 	h.WriteString(outputName)
 	return "/" + h.SumHash().RawBase32()
 }
 
-// unknownCAOutputPlaceholder returns the placeholder
+// UnknownCAOutputPlaceholder returns the placeholder
 // for an unknown output of a content-addressed derivation.
-func unknownCAOutputPlaceholder(drvPath nix.StorePath, outputName string) string {
+// Dependent derivations refer to the output using this placeholder
+// until the output is realized.
+func UnknownCAOutputPlaceholder(drvPath nix.StorePath, outputName string) string {
 	drvName := strings.TrimSuffix(drvPath.Name(), ".drv")
 	h := nix.NewHasher(nix.SHA256)
 	h.WriteString("nix-upstream-output:")
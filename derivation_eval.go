@@ -4,11 +4,15 @@
 package zb
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"os"
 	"runtime/cgo"
+	"slices"
 	"strings"
+	"time"
 
+	"zombiezen.com/go/log"
 	"zombiezen.com/go/nix"
 	"zombiezen.com/go/zb/internal/lua"
 	"zombiezen.com/go/zb/internal/sortedset"
@@ -32,30 +36,66 @@ func registerDerivationMetatable(l *lua.State) {
 	l.Pop(1)
 }
 
-func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
+func (eval *Eval) derivationFunction(l *lua.State) (nResults int, err error) {
 	if !l.IsTable(1) {
 		return 0, lua.NewTypeError(l, 1, lua.TypeTable.String())
 	}
+	traceName := "(unnamed)"
+	if l.RawField(1, "name") == lua.TypeString {
+		traceName, _ = l.ToString(-1)
+	}
+	l.Pop(1)
+	end := eval.beginDerivation(traceName)
+	defer func() { end(err) }()
+
 	drv := &Derivation{
 		Dir: eval.storeDir,
 		Env: make(map[string]string),
 	}
 
 	// Configure outputs.
+	var hashAlgo nix.HashType
+	switch typ := l.RawField(1, "outputHashAlgo"); typ {
+	case lua.TypeNil:
+	case lua.TypeString:
+		s, _ := l.ToString(-1)
+		var err error
+		hashAlgo, err = nix.ParseHashType(s)
+		if err != nil {
+			return 0, fmt.Errorf("outputHashAlgo argument: %v", err)
+		}
+		if hashAlgo != nix.SHA256 && hashAlgo != nix.SHA512 {
+			return 0, fmt.Errorf("outputHashAlgo argument: %v is not supported (must be %v or %v)", hashAlgo, nix.SHA256, nix.SHA512)
+		}
+	default:
+		return 0, fmt.Errorf("outputHashAlgo argument: %v expected, got %v", lua.TypeString, typ)
+	}
+	l.Pop(1)
+
 	var h nix.Hash
 	switch typ := l.RawField(1, "outputHash"); typ {
 	case lua.TypeNil:
 	case lua.TypeString:
 		s, _ := l.ToString(-1)
+		if hashAlgo.IsValid() && !strings.ContainsAny(s, ":-") {
+			// A hash without a type uses outputHashAlgo.
+			s = hashAlgo.String() + ":" + s
+		}
 		var err error
 		h, err = nix.ParseHash(s)
 		if err != nil {
 			return 0, fmt.Errorf("outputHash argument: %v", err)
 		}
+		if hashAlgo.IsValid() && h.Type() != hashAlgo {
+			return 0, fmt.Errorf("outputHash argument: %v hash does not match outputHashAlgo %v", h.Type(), hashAlgo)
+		}
 	default:
 		return 0, fmt.Errorf("outputHash argument: %v expected, got %v", lua.TypeString, typ)
 	}
 	l.Pop(1)
+	if !hashAlgo.IsValid() {
+		hashAlgo = nix.SHA256
+	}
 
 	switch typ := l.RawField(1, "outputHashMode"); typ {
 	case lua.TypeNil:
@@ -82,11 +122,33 @@ func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
 	}
 	l.Pop(1)
 
+	contentAddressed := true
+	switch typ := l.RawField(1, "__contentAddressed"); typ {
+	case lua.TypeNil:
+	case lua.TypeBoolean:
+		contentAddressed = l.ToBoolean(-1)
+	default:
+		return 0, fmt.Errorf("__contentAddressed argument: %v expected, got %v", lua.TypeBoolean, typ)
+	}
+	l.Pop(1)
+	inputAddressed := !contentAddressed && h.IsZero()
+
+	outputNames, err := derivationOutputNames(l, 1)
+	if err != nil {
+		return 0, err
+	}
 	if h.IsZero() {
-		// TODO(someday): Multiple outputs.
-		drv.Outputs = map[string]*DerivationOutput{
-			defaultDerivationOutputName: RecursiveFileFloatingCAOutput(nix.SHA256),
+		drv.Outputs = make(map[string]*DerivationOutput, len(outputNames))
+		for _, outputName := range outputNames {
+			if inputAddressed {
+				// Computed once the rest of the derivation is known.
+				drv.Outputs[outputName] = DeferredOutput()
+			} else {
+				drv.Outputs[outputName] = RecursiveFileFloatingCAOutput(hashAlgo)
+			}
 		}
+	} else if len(outputNames) != 1 || outputNames[0] != defaultDerivationOutputName {
+		return 0, fmt.Errorf("outputs argument: fixed-output derivations can only have an %q output", defaultDerivationOutputName)
 	}
 
 	// Start a copy of the table.
@@ -130,6 +192,29 @@ func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
 			if err != nil {
 				return 0, fmt.Errorf("%s: %v", k, err)
 			}
+		case "meta":
+			// Metadata is not passed to the builder
+			// so that changing it doesn't cause a rebuild.
+			var err error
+			drv.Meta, err = toDerivationMeta(l, -1)
+			if err != nil {
+				return 0, fmt.Errorf("meta argument: %v", err)
+			}
+			l.Pop(1)
+			continue
+		case hostPlatformVar, targetPlatformVar:
+			if typ := l.Type(-1); typ != lua.TypeString {
+				return 0, fmt.Errorf("%s argument: %v expected, got %v", k, lua.TypeString, typ)
+			}
+		case "maxClosureSize":
+			if !l.IsInteger(-1) {
+				return 0, fmt.Errorf("maxClosureSize argument: integer expected, got %v", l.Type(-1))
+			}
+			if n, _ := l.ToInteger(-1); n < 0 {
+				return 0, fmt.Errorf("maxClosureSize argument: negative size %d", n)
+			}
+		case "outputs":
+			// Validated by derivationOutputNames.
 		case "args":
 			if typ := l.Type(-1); typ != lua.TypeTable {
 				return 0, fmt.Errorf("args argument: %v expected, got %v", lua.TypeTable, typ)
@@ -158,10 +243,12 @@ func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
 	}
 
 	for outputName, outType := range drv.Outputs {
-		switch outType.typ {
-		case floatingCAOutputType:
-			drv.Env[outputName] = hashPlaceholder(outputName)
-		case fixedCAOutputType:
+		switch {
+		case outType.IsDeferred():
+			drv.Env[outputName] = ""
+		case outType.typ == floatingCAOutputType:
+			drv.Env[outputName] = HashPlaceholder(outputName)
+		case outType.typ == fixedCAOutputType:
 			p, ok := outType.Path(eval.storeDir, drv.Name, outputName)
 			if !ok {
 				panic("should have a path")
@@ -171,20 +258,86 @@ func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
 			panic(outputName + " has an unhandled output type")
 		}
 	}
-	drvPath, err := writeDerivation(context.TODO(), drv)
+	if inputAddressed {
+		if drv.Name == "" {
+			return 0, fmt.Errorf("derivation: missing name")
+		}
+		outputs, err := drv.InputAddressedOutputs(eval.derivationHashModulo)
+		switch {
+		case errors.Is(err, errUnknownOutputs):
+			// The output paths can't be known until the inputs are built,
+			// so the builder has to substitute them.
+			for outputName := range drv.Outputs {
+				drv.Env[outputName] = HashPlaceholder(outputName)
+			}
+		case err != nil:
+			return 0, fmt.Errorf("derivation: %v", err)
+		default:
+			drv.Outputs = outputs
+			for outputName, out := range outputs {
+				drv.Env[outputName] = string(out.path)
+			}
+		}
+	}
+	if err := checkAssertUnset(drv); err != nil {
+		return 0, fmt.Errorf("derivation: %v", err)
+	}
+	if eval.lint {
+		home, _ := os.UserHomeDir()
+		lintOpts := &LintOptions{
+			StoreDir: eval.storeDir,
+			HomeDir:  home,
+			Now:      time.Now(),
+		}
+		for _, w := range LintDerivation(drv, lintOpts) {
+			log.Warnf(eval.traceContext(), "Derivation %s: %v", drv.Name, w)
+		}
+	}
+	drvPath, err := eval.writeDerivation(eval.traceContext(), drv)
 	if err != nil {
 		return 0, fmt.Errorf("derivation: %v", err)
 	}
+	if err := eval.Prefetch(eval.traceContext(), drv); err != nil {
+		return 0, fmt.Errorf("derivation: %v", err)
+	}
+	eval.recordLicense(drvPath, drv)
+	if drv.hasUnknownOutputs() {
+		eval.hashesModulo[drvPath] = nix.Hash{}
+	} else {
+		hm, err := drv.HashModulo(eval.derivationHashModulo)
+		if err != nil {
+			return 0, fmt.Errorf("derivation: %v", err)
+		}
+		eval.hashesModulo[drvPath] = hm
+	}
 
 	l.PushStringContext(string(drvPath), []string{string(drvPath)})
 	if err := l.SetField(tableCopyIndex, "drvPath", 0); err != nil {
 		return 0, fmt.Errorf("derivation: %v", err)
 	}
+	// Fill in platform defaults so that Lua code can always read them.
+	for k, v := range map[string]string{
+		"buildPlatform":   drv.BuildPlatform(),
+		hostPlatformVar:   drv.HostPlatform(),
+		targetPlatformVar: drv.TargetPlatform(),
+	} {
+		typ := l.RawField(tableCopyIndex, k)
+		l.Pop(1)
+		if typ != lua.TypeNil {
+			continue
+		}
+		l.PushString(v)
+		if err := l.SetField(tableCopyIndex, k, 0); err != nil {
+			return 0, fmt.Errorf("derivation: %v", err)
+		}
+	}
 	for outputName, outType := range drv.Outputs {
 		var placeholder string
 		switch outType.typ {
-		case floatingCAOutputType:
-			placeholder = unknownCAOutputPlaceholder(drvPath, defaultDerivationOutputName)
+		case floatingCAOutputType, deferredOutputType:
+			placeholder = UnknownCAOutputPlaceholder(drvPath, outputName)
+		case inputAddressedOutputType:
+			placeholder = string(outType.path)
 		case fixedCAOutputType:
 			// TODO(someday): We already computed this earlier.
 			p, ok := outType.Path(eval.storeDir, drv.Name, outputName)
@@ -212,6 +365,134 @@ func (eval *Eval) derivationFunction(l *lua.State) (int, error) {
 	return 1, nil
 }
 
+// toDerivationMeta converts the meta table at the given index to a [DerivationMeta].
+// Fields other than the ones in DerivationMeta are permitted
+// and remain accessible from Lua.
+func toDerivationMeta(l *lua.State, idx int) (*DerivationMeta, error) {
+	idx = l.AbsIndex(idx)
+	if typ := l.Type(idx); typ != lua.TypeTable {
+		return nil, fmt.Errorf("%v expected, got %v", lua.TypeTable, typ)
+	}
+	meta := new(DerivationMeta)
+	for _, field := range []struct {
+		name string
+		dst  *string
+	}{
+		{"description", &meta.Description},
+		{"license", &meta.License},
+		{"homepage", &meta.Homepage},
+	} {
+		typ := l.RawField(idx, field.name)
+		switch typ {
+		case lua.TypeNil:
+		case lua.TypeString:
+			*field.dst, _ = l.ToString(-1)
+		default:
+			l.Pop(1)
+			return nil, fmt.Errorf("%s: %v expected, got %v", field.name, lua.TypeString, typ)
+		}
+		l.Pop(1)
+	}
+
+	switch typ := l.RawField(idx, "maintainers"); typ {
+	case lua.TypeNil:
+	case lua.TypeTable:
+		err := ipairs(l, -1, func(i int64) error {
+			if typ := l.Type(-1); typ != lua.TypeString {
+				return fmt.Errorf("#%d: %v expected, got %v", i, lua.TypeString, typ)
+			}
+			m, _ := l.ToString(-1)
+			meta.Maintainers = append(meta.Maintainers, m)
+			return nil
+		})
+		if err != nil {
+			l.Pop(1)
+			return nil, fmt.Errorf("maintainers %v", err)
+		}
+	default:
+		l.Pop(1)
+		return nil, fmt.Errorf("maintainers: %v expected, got %v", lua.TypeTable, typ)
+	}
+	l.Pop(1)
+	return meta, nil
+}
+
+// derivationOutputNames returns the output names listed
+// in the outputs field of the derivation argument table at the given index.
+// If the field is not set, derivationOutputNames returns ["out"].
+// The first name is the derivation's default output.
+func derivationOutputNames(l *lua.State, idx int) ([]string, error) {
+	idx = l.AbsIndex(idx)
+	typ := l.RawField(idx, "outputs")
+	defer l.Pop(1)
+	switch typ {
+	case lua.TypeNil:
+		return []string{defaultDerivationOutputName}, nil
+	case lua.TypeTable:
+	default:
+		return nil, fmt.Errorf("outputs argument: %v expected, got %v", lua.TypeTable, typ)
+	}
+	var names []string
+	err := ipairs(l, -1, func(i int64) error {
+		if l.Type(-1) != lua.TypeString {
+			return fmt.Errorf("#%d: %v expected, got %v", i, lua.TypeString, l.Type(-1))
+		}
+		name, _ := l.ToString(-1)
+		if err := validateOutputName(name); err != nil {
+			return fmt.Errorf("#%d: %v", i, err)
+		}
+		if slices.Contains(names, name) {
+			return fmt.Errorf("#%d: duplicate output %q", i, name)
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("outputs argument %v", err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("outputs argument: empty")
+	}
+	return names, nil
+}
+
+// validateOutputName returns an error if name cannot be used as an output name.
+// Output names are appended to the derivation name to form store object names,
+// and they become fields of the Lua derivation object.
+func validateOutputName(name string) error {
+	switch name {
+	case "":
+		return fmt.Errorf("empty output name")
+	case "drv", "drvPath", "outputs":
+		return fmt.Errorf("invalid output name %q", name)
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("+-._?=", c)) {
+			return fmt.Errorf("invalid output name %q", name)
+		}
+	}
+	return nil
+}
+
+// pushDefaultOutput pushes the placeholder of the default output
+// of the derivation at the given index.
+func pushDefaultOutput(l *lua.State, idx int) error {
+	l.UserValue(idx, 1) // Push derivation argument table.
+	outputName := defaultDerivationOutputName
+	if l.RawField(-1, "outputs") == lua.TypeTable {
+		if l.RawIndex(-1, 1) == lua.TypeString {
+			outputName, _ = l.ToString(-1)
+		}
+		l.Pop(1)
+	}
+	l.Pop(1)
+	if _, err := l.Field(-1, outputName, 0); err != nil {
+		return err
+	}
+	l.Remove(-2)
+	return nil
+}
+
 func toEnvVar(l *lua.State, drv *Derivation, idx int, allowLists bool) (string, error) {
 	idx = l.AbsIndex(idx)
 	switch typ := l.Type(idx); typ {
@@ -270,21 +551,21 @@ func stringToEnvVar(l *lua.State, drv *Derivation, idx int) (string, error) {
 	defer l.Pop(1)
 	s, _ := l.ToString(-1)
 	for _, dep := range l.StringContext(-1) {
-		if rest, isDrv := strings.CutPrefix(dep, "!"); isDrv {
-			outputName, drvPath, ok := strings.Cut(rest, "!")
-			if !ok {
-				return "", fmt.Errorf("internal error: malformed context %q", dep)
-			}
-			if drv.InputDerivations == nil {
-				drv.InputDerivations = make(map[nix.StorePath]*sortedset.Set[string])
-			}
-			if drv.InputDerivations[nix.StorePath(drvPath)] == nil {
-				drv.InputDerivations[nix.StorePath(drvPath)] = new(sortedset.Set[string])
-			}
-			drv.InputDerivations[nix.StorePath(drvPath)].Add(outputName)
-		} else {
-			drv.InputSources.Add(nix.StorePath(dep))
+		p, outputName, err := parseContext(dep)
+		if err != nil {
+			return "", err
 		}
+		if outputName == "" {
+			drv.InputSources.Add(p)
+			continue
+		}
+		if drv.InputDerivations == nil {
+			drv.InputDerivations = make(map[nix.StorePath]*sortedset.Set[string])
+		}
+		if drv.InputDerivations[p] == nil {
+			drv.InputDerivations[p] = new(sortedset.Set[string])
+		}
+		drv.InputDerivations[p].Add(outputName)
 	}
 	return s, nil
 }
@@ -366,8 +647,7 @@ func derivationToString(l *lua.State) (int, error) {
 	if _, err := toDerivation(l); err != nil {
 		return 0, err
 	}
-	l.UserValue(1, 1) // Push derivation argument table.
-	if _, err := l.Field(-1, "out", 0); err != nil {
+	if err := pushDefaultOutput(l, 1); err != nil {
 		return 0, err
 	}
 	return 1, nil
@@ -377,20 +657,16 @@ func derivationToString(l *lua.State) (int, error) {
 func concatDerivation(l *lua.State) (int, error) {
 	l.SetTop(2)
 	if testDerivation(l, 1) != nil {
-		l.UserValue(1, 1) // Push derivation argument table.
-		if _, err := l.Field(-1, "out", 0); err != nil {
+		if err := pushDefaultOutput(l, 1); err != nil {
 			return 0, err
 		}
 		l.Replace(1)
-		l.Pop(1)
 	}
 	if testDerivation(l, 2) != nil {
-		l.UserValue(2, 1) // Push derivation argument table.
-		if _, err := l.Field(-1, "out", 0); err != nil {
+		if err := pushDefaultOutput(l, 2); err != nil {
 			return 0, err
 		}
 		l.Replace(2)
-		l.Pop(1)
 	}
 	if err := l.Concat(2, 0); err != nil {
 		return 0, err
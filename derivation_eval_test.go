@@ -0,0 +1,474 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+func TestPlaceholder(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	results, err := eval.Expression(`placeholder("out") .. " " .. placeholder("dev")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{HashPlaceholder("out") + " " + HashPlaceholder("dev")}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("placeholder (-want +got):\n%s", diff)
+	}
+
+	if _, err := eval.Expression(`placeholder("")`, nil); err == nil {
+		t.Error(`placeholder("") did not return an error`)
+	}
+}
+
+func TestDerivationOutputInterpolation(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const expr = `
+local dep = derivation { name = "dep"; system = "x86_64-linux"; builder = "/bin/sh" }
+return {
+  dep = dep;
+  user = derivation {
+    name = "user";
+    system = "x86_64-linux";
+    builder = "/bin/sh";
+    field = dep.out .. "/bin";
+    concat = "PATH=" .. dep;
+    tostring = tostring(dep);
+  };
+}
+`
+	results, err := eval.Expression(expr, []string{"dep", "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep := results[0].(*Derivation)
+	user := results[1].(*Derivation)
+	depPath, err := dep.StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := UnknownCAOutputPlaceholder(depPath, "out")
+
+	wantEnv := map[string]string{
+		"field":    out + "/bin",
+		"concat":   "PATH=" + out,
+		"tostring": out,
+	}
+	for k, want := range wantEnv {
+		if got := user.Env[k]; got != want {
+			t.Errorf("user.Env[%q] = %q; want %q", k, got, want)
+		}
+	}
+	wantInputs := map[nix.StorePath]*sortedset.Set[string]{
+		depPath: sortedset.New("out"),
+	}
+	if diff := cmp.Diff(wantInputs, user.InputDerivations, cmp.AllowUnexported(sortedset.Set[string]{})); diff != "" {
+		t.Errorf("user.InputDerivations (-want +got):\n%s", diff)
+	}
+}
+
+func TestMultipleOutputs(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const expr = `
+local lib = derivation {
+  name = "lib";
+  system = "x86_64-linux";
+  builder = "/bin/sh";
+  outputs = { "lib", "dev", "doc" };
+}
+return {
+  lib = lib;
+  dev = lib.dev;
+  default = tostring(lib);
+  concat = lib .. "/lib";
+  user = derivation {
+    name = "user";
+    system = "x86_64-linux";
+    builder = "/bin/sh";
+    include = lib.dev .. "/include";
+  };
+}
+`
+	results, err := eval.Expression(expr, []string{"lib", "dev", "default", "concat", "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib := results[0].(*Derivation)
+	libPath, err := lib.StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantOutputs := map[string]*DerivationOutput{
+		"lib": RecursiveFileFloatingCAOutput(nix.SHA256),
+		"dev": RecursiveFileFloatingCAOutput(nix.SHA256),
+		"doc": RecursiveFileFloatingCAOutput(nix.SHA256),
+	}
+	if diff := cmp.Diff(wantOutputs, lib.Outputs, cmp.AllowUnexported(DerivationOutput{})); diff != "" {
+		t.Errorf("outputs (-want +got):\n%s", diff)
+	}
+	for _, outputName := range []string{"lib", "dev", "doc"} {
+		if got, want := lib.Env[outputName], HashPlaceholder(outputName); got != want {
+			t.Errorf("Env[%q] = %q; want %q", outputName, got, want)
+		}
+	}
+	if got, want := lib.Env["outputs"], "lib dev doc"; got != want {
+		t.Errorf("Env[\"outputs\"] = %q; want %q", got, want)
+	}
+
+	dev := UnknownCAOutputPlaceholder(libPath, "dev")
+	libOut := UnknownCAOutputPlaceholder(libPath, "lib")
+	if got := results[1]; got != dev {
+		t.Errorf("lib.dev = %q; want %q", got, dev)
+	}
+	if got := results[2]; got != libOut {
+		t.Errorf("tostring(lib) = %q; want %q", got, libOut)
+	}
+	if got, want := results[3], libOut+"/lib"; got != want {
+		t.Errorf("lib .. \"/lib\" = %q; want %q", got, want)
+	}
+	user := results[4].(*Derivation)
+	wantInputs := map[nix.StorePath]*sortedset.Set[string]{
+		libPath: sortedset.New("dev"),
+	}
+	if diff := cmp.Diff(wantInputs, user.InputDerivations, cmp.AllowUnexported(sortedset.Set[string]{})); diff != "" {
+		t.Errorf("user.InputDerivations (-want +got):\n%s", diff)
+	}
+}
+
+func TestDerivationOutputsErrors(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	tests := []string{
+		`{}`,
+		`{ "out", "out" }`,
+		`{ "" }`,
+		`{ "drvPath" }`,
+		`{ "a/b" }`,
+		`{ 1 }`,
+		`"out"`,
+	}
+	for _, outputs := range tests {
+		expr := `derivation { name = "x"; system = "x86_64-linux"; builder = "/bin/sh"; outputs = ` + outputs + ` }`
+		if _, err := eval.Expression(expr, nil); err == nil {
+			t.Errorf("outputs = %s did not return an error", outputs)
+		}
+	}
+	const fixed = `derivation { name = "x"; system = "x86_64-linux"; builder = "/bin/sh"; outputs = { "out", "dev" }; outputHash = "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" }`
+	if _, err := eval.Expression(fixed, nil); err == nil {
+		t.Error("fixed-output derivation with multiple outputs did not return an error")
+	}
+}
+
+func TestCrossPlatforms(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const expr = `
+local pkgs = splice(function(pkgs)
+  local p = pkgs.platforms
+  return {
+    cc = derivation {
+      name = "cc";
+      system = p.build;
+      hostPlatform = p.host;
+      targetPlatform = p.target;
+      builder = "/bin/sh";
+    };
+  }
+end, { build = "x86_64-linux"; host = "aarch64-linux" })
+return {
+  cc = pkgs.cc;
+  buildCC = pkgs.buildPackages.cc;
+  fields = {
+    pkgs.cc.buildPlatform,
+    pkgs.cc.hostPlatform,
+    pkgs.cc.targetPlatform,
+    pkgs.buildPackages.cc.hostPlatform,
+    pkgs.buildPackages.cc.targetPlatform,
+  };
+  shared = pkgs.buildPackages.buildPackages == pkgs.buildPackages.buildPackages.buildPackages;
+}
+`
+	results, err := eval.Expression(expr, []string{"cc", "buildCC", "fields", "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type platforms struct {
+		Build, Host, Target string
+	}
+	get := func(drv *Derivation) platforms {
+		return platforms{drv.BuildPlatform(), drv.HostPlatform(), drv.TargetPlatform()}
+	}
+	if got, want := get(results[0].(*Derivation)), (platforms{"x86_64-linux", "aarch64-linux", "aarch64-linux"}); got != want {
+		t.Errorf("pkgs.cc platforms = %+v; want %+v", got, want)
+	}
+	if got, want := get(results[1].(*Derivation)), (platforms{"x86_64-linux", "x86_64-linux", "aarch64-linux"}); got != want {
+		t.Errorf("pkgs.buildPackages.cc platforms = %+v; want %+v", got, want)
+	}
+	wantFields := []any{"x86_64-linux", "aarch64-linux", "aarch64-linux", "x86_64-linux", "aarch64-linux"}
+	if diff := cmp.Diff(wantFields, results[2]); diff != "" {
+		t.Errorf("platform fields (-want +got):\n%s", diff)
+	}
+	if results[3] != true {
+		t.Error("native package set's buildPackages is a different set")
+	}
+}
+
+func TestDerivationPlatformDefaults(t *testing.T) {
+	drv := &Derivation{System: "x86_64-linux"}
+	if got := drv.HostPlatform(); got != "x86_64-linux" {
+		t.Errorf("HostPlatform() = %q; want %q", got, "x86_64-linux")
+	}
+	if got := drv.TargetPlatform(); got != "x86_64-linux" {
+		t.Errorf("TargetPlatform() = %q; want %q", got, "x86_64-linux")
+	}
+	drv.Env = map[string]string{hostPlatformVar: "aarch64-linux"}
+	if got := drv.TargetPlatform(); got != "aarch64-linux" {
+		t.Errorf("TargetPlatform() with hostPlatform = %q; want %q", got, "aarch64-linux")
+	}
+}
+
+func TestCurrentSystem(t *testing.T) {
+	eval := NewEval("/zb/store")
+	defer eval.Close()
+
+	results, err := eval.Expression(`currentSystem`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]any{nil}, results); diff != "" {
+		t.Errorf("currentSystem before SetSystem (-want +got):\n%s", diff)
+	}
+
+	eval.SetSystem("aarch64-linux")
+	results, err = eval.Expression(`currentSystem`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]any{"aarch64-linux"}, results); diff != "" {
+		t.Errorf("currentSystem (-want +got):\n%s", diff)
+	}
+}
+
+func TestDerivationMeta(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const base = `derivation { name = "hello"; system = "x86_64-linux"; builder = "/bin/sh" }`
+	const expr = `
+local drv = derivation {
+  name = "hello";
+  system = "x86_64-linux";
+  builder = "/bin/sh";
+  meta = {
+    description = "Friendly greeter";
+    license = "GPL-3.0-or-later";
+    homepage = "https://www.gnu.org/software/hello/";
+    maintainers = { "Ross Light" };
+    position = "hello.lua:1";
+  };
+}
+return { drv = drv; position = drv.meta.position }
+`
+	results, err := eval.Expression(expr, []string{"drv", "position"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := results[0].(*Derivation)
+	want := &DerivationMeta{
+		Description: "Friendly greeter",
+		License:     "GPL-3.0-or-later",
+		Homepage:    "https://www.gnu.org/software/hello/",
+		Maintainers: []string{"Ross Light"},
+	}
+	if diff := cmp.Diff(want, drv.Meta); diff != "" {
+		t.Errorf("Meta (-want +got):\n%s", diff)
+	}
+	if results[1] != "hello.lua:1" {
+		t.Errorf("drv.meta.position = %v; want %q", results[1], "hello.lua:1")
+	}
+	if _, ok := drv.Env["meta"]; ok {
+		t.Error("meta passed to builder")
+	}
+
+	// Metadata does not affect the store derivation.
+	results, err = eval.Expression(base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotPath, err := drv.StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPath, err := results[0].(*Derivation).StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != wantPath {
+		t.Errorf("derivation with meta has path %s; without meta has path %s", gotPath, wantPath)
+	}
+
+	for _, bad := range []string{`"GPL"`, `{ license = 3 }`, `{ maintainers = "me" }`, `{ maintainers = { 1 } }`} {
+		expr := `derivation { name = "hello"; system = "x86_64-linux"; builder = "/bin/sh"; meta = ` + bad + ` }`
+		if _, err := eval.Expression(expr, nil); err == nil {
+			t.Errorf("meta = %s did not return an error", bad)
+		}
+	}
+}
+
+func TestInputAddressedDerivation(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const expr = `
+local function build(url)
+  local src = derivation {
+    name = "hello.txt";
+    system = "x86_64-linux";
+    builder = "builtin:fetchurl";
+    url = url;
+    outputHash = "sha256:c98c24b677eff44860afea6f493bbaec5bb1c4cbb209c6fc2bbb47f66ff2ad31";
+  }
+  return derivation {
+    name = "hello";
+    system = "x86_64-linux";
+    builder = "/bin/sh";
+    args = { "-c", "cp " .. src .. " $out" };
+    outputs = { "out", "doc" };
+    __contentAddressed = false;
+  }
+end
+local ca = derivation { name = "ca"; system = "x86_64-linux"; builder = "/bin/sh" }
+return {
+  build("https://example.com/hello.txt"),
+  build("https://mirror.example.com/hello.txt"),
+  function()
+    return derivation {
+      name = "user";
+      system = "x86_64-linux";
+      builder = "/bin/sh";
+      dep = ca;
+      __contentAddressed = false;
+    }
+  end,
+}
+`
+	results, err := eval.Expression(expr, []string{"[1]", "[2]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv1 := results[0].(*Derivation)
+	drv2 := results[1].(*Derivation)
+	for _, outName := range []string{"out", "doc"} {
+		out := drv1.Outputs[outName]
+		if out == nil || out.typ != inputAddressedOutputType {
+			t.Errorf("Outputs[%q] = %+v; want input-addressed", outName, out)
+			continue
+		}
+		if got, want := drv1.Env[outName], string(out.path); got != want {
+			t.Errorf("Env[%q] = %q; want %q", outName, got, want)
+		}
+		wantName := "hello"
+		if outName != "out" {
+			wantName += "-" + outName
+		}
+		if got := out.path.Name(); got != wantName {
+			t.Errorf("Outputs[%q] name = %q; want %q", outName, got, wantName)
+		}
+		// Changing how a fixed output is fetched
+		// must not change the paths of derivations that depend on it.
+		if got, want := drv2.Outputs[outName], out; got == nil || got.path != want.path {
+			t.Errorf("Outputs[%q] after changing URL = %+v; want %s", outName, got, want.path)
+		}
+	}
+	if p1, p2 := mustStorePath(t, drv1), mustStorePath(t, drv2); p1 == p2 {
+		t.Errorf("derivation paths are the same after changing URL (%s)", p1)
+	}
+
+	// Depending on a content-addressed derivation defers the output paths.
+	results, err = eval.Expression(expr, []string{"[3]()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := results[0].(*Derivation)
+	if out := user.Outputs["out"]; !out.IsDeferred() || out == nil {
+		t.Errorf("user.Outputs[\"out\"] = %+v; want deferred", out)
+	}
+	if got, want := user.Env["out"], HashPlaceholder("out"); got != want {
+		t.Errorf("user.Env[\"out\"] = %q; want %q", got, want)
+	}
+}
+
+func mustStorePath(tb testing.TB, drv *Derivation) nix.StorePath {
+	tb.Helper()
+	p, err := drv.StorePath()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestOutputHashAlgo(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+
+	const content = "Hello, World!\n"
+	sha512 := hashString(nix.SHA512, content)
+	expr := fmt.Sprintf(`
+local function drv(args)
+  args.name = "hello.txt"
+  args.system = "x86_64-linux"
+  args.builder = "/bin/sh"
+  return derivation(args)
+end
+return {
+  floating = drv { outputHashAlgo = "sha512" };
+  prefixed = drv { outputHash = %q; outputHashMode = "flat" };
+  bare = drv { outputHash = %q; outputHashAlgo = "sha512" };
+  mismatch = function() return drv { outputHash = %[1]q; outputHashAlgo = "sha256" } end;
+  md5 = function() return drv { outputHashAlgo = "md5" } end;
+}
+`, sha512.Base16(), sha512.RawBase16())
+	results, err := eval.Expression(expr, []string{"floating", "prefixed", "bare"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := results[0].(*Derivation).Outputs["out"], RecursiveFileFloatingCAOutput(nix.SHA512); !cmp.Equal(got, want, cmp.AllowUnexported(DerivationOutput{})) {
+		t.Errorf("floating output = %+v; want %+v", got, want)
+	}
+	want := FixedCAOutput(nix.FlatFileContentAddress(sha512))
+	for i, name := range []string{"prefixed", "bare"} {
+		if got := results[i+1].(*Derivation).Outputs["out"]; !cmp.Equal(got, want, cmp.AllowUnexported(DerivationOutput{})) {
+			t.Errorf("%s output = %+v; want %+v", name, got, want)
+		}
+	}
+	if _, err := eval.Expression(expr, []string{"mismatch()"}); err == nil {
+		t.Error("outputHash that does not match outputHashAlgo did not return an error")
+	}
+	if _, err := eval.Expression(expr, []string{"md5()"}); err == nil {
+		t.Error("outputHashAlgo = \"md5\" did not return an error")
+	}
+}
@@ -4,8 +4,10 @@
 package zb
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -116,6 +118,31 @@ func TestDerivationMarshalText(t *testing.T) {
 			want:     readTestdata(t, "0006yk8jxi0nmbz09fq86zl037c1wx9b-automake-1.16.5.tar.xz.drv"),
 			wantPath: "/nix/store/0006yk8jxi0nmbz09fq86zl037c1wx9b-automake-1.16.5.tar.xz.drv",
 		},
+		{
+			name: "Deferred",
+			drv: &Derivation{
+				Dir:     nix.DefaultStoreDirectory,
+				Name:    "greeting",
+				System:  "x86_64-linux",
+				Builder: "/bin/sh",
+				Args:    []string{"-c", "cp /15in8cbg343rb7jylspw0gw7i6dxgkcdn02ypw2ya9kkx158bj76 $out"},
+				Env: map[string]string{
+					"builder": "/bin/sh",
+					"name":    "greeting",
+					"out":     "/1rz4g4znpzjwh1xymhjpm42vipw92pr73vdgl6xs1hycac8kf2n9",
+					"system":  "x86_64-linux",
+				},
+				InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+					"/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv": sortedset.New("out"),
+				},
+				Outputs: map[string]*DerivationOutput{
+					"out": DeferredOutput(),
+				},
+			},
+
+			want:     readTestdata(t, "nvbcsnkc0da9dqsmds5hah1brpal9ack-greeting.drv"),
+			wantPath: "/nix/store/nvbcsnkc0da9dqsmds5hah1brpal9ack-greeting.drv",
+		},
 	}
 
 	t.Run("MarshalText", func(t *testing.T) {
@@ -132,6 +159,25 @@ func TestDerivationMarshalText(t *testing.T) {
 		}
 	})
 
+	t.Run("Parse", func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				got, err := ParseDerivation(test.drv.Dir, test.drv.Name, test.want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				diff := cmp.Diff(test.drv, got,
+					cmp.AllowUnexported(DerivationOutput{}),
+					cmp.AllowUnexported(sortedset.Set[string]{}),
+					cmp.AllowUnexported(sortedset.Set[nix.StorePath]{}),
+				)
+				if diff != "" {
+					t.Errorf("ParseDerivation(...) (-want +got):\n%s", diff)
+				}
+			})
+		}
+	})
+
 	t.Run("StorePath", func(t *testing.T) {
 		for _, test := range tests {
 			t.Run(test.name, func(t *testing.T) {
@@ -229,3 +275,52 @@ func hashString(typ nix.HashType, s string) nix.Hash {
 	h.WriteString(s)
 	return h.SumHash()
 }
+
+func TestDerivationHashModuloCycle(t *testing.T) {
+	dir, err := nix.CleanStoreDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aPath := nix.StorePath(dir.Join("00000000000000000000000000000000-a.drv"))
+	bPath := nix.StorePath(dir.Join("11111111111111111111111111111111-b.drv"))
+	writeDrv := func(drvPath nix.StorePath, inputPath nix.StorePath) {
+		t.Helper()
+		name := drvPath.Name()[:len(drvPath.Name())-len(".drv")]
+		drv := &Derivation{
+			Dir:     dir,
+			Name:    name,
+			System:  "x86_64-linux",
+			Builder: "/bin/sh",
+			Env:     map[string]string{"out": string(dir.Join("22222222222222222222222222222222-" + name))},
+			InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+				inputPath: sortedset.New("out"),
+			},
+			Outputs: map[string]*DerivationOutput{
+				"out": InputAddressed(nix.StorePath(dir.Join("22222222222222222222222222222222-" + name))),
+			},
+		}
+		data, err := drv.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(string(drvPath), data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDrv(aPath, bPath)
+	writeDrv(bPath, aPath)
+
+	eval := NewEval(dir)
+	defer eval.Close()
+	_, err = eval.derivationHashModulo(aPath)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("derivationHashModulo(a) = _, %v; want CycleError", err)
+	}
+	if want := []nix.StorePath{aPath, bPath, aPath}; !slices.Equal(cycleErr.Cycle, want) {
+		t.Errorf("cycle = %v; want %v", cycleErr.Cycle, want)
+	}
+	if len(eval.hashingModulo) != 0 {
+		t.Errorf("after error, eval.hashingModulo = %v; want []", eval.hashingModulo)
+	}
+}
@@ -4,17 +4,20 @@
 package zb
 
 import (
+	"context"
 	_ "embed"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	slashpath "path"
 	"path/filepath"
 	"runtime/cgo"
 	"strings"
 
+	"go.opentelemetry.io/otel/attribute"
 	"zombiezen.com/go/nix"
 	"zombiezen.com/go/zb/internal/lua"
 )
@@ -23,15 +26,143 @@ import (
 var preludeSource string
 
 type Eval struct {
-	l        lua.State
-	storeDir nix.StoreDirectory
+	l            lua.State
+	storeDir     nix.StoreDirectory
+	autoOptimise bool
+	// storeRoot is the directory that holds the store
+	// in place of the file system root.
+	storeRoot string
+	// storeLowerRoot and storeUpperLayer describe
+	// the lower layer of an overlay store.
+	storeLowerRoot  string
+	storeUpperLayer string
+	// dir is the absolute path of the directory
+	// that relative paths not loaded from files are resolved against.
+	// If empty, the process's working directory is used.
+	dir string
+
+	// pathCache records the source trees imported by the path function
+	// so that unchanged trees don't need to be serialized again.
+	pathCache     map[pathCacheKey]pathCacheEntry
+	pathCacheMode PathCacheMode
+
+	licensePolicy *LicensePolicy
+	// licenseViolations maps the paths of derivations created by the evaluator
+	// to the reason they violate licensePolicy, if they do.
+	licenseViolations map[nix.StorePath]*licenseViolation
+
+	// lockfile records the resolved versions of the inputs
+	// passed to the input function.
+	lockfile        *Lockfile
+	lockfilePath    string
+	lockfileChanged bool
+	// updateInputs is the list of inputs whose locked versions are ignored.
+	updateInputs []string
+
+	// pureEval is whether evaluation is restricted to reproducible operations.
+	pureEval bool
+	// lint is whether to check new derivations with [LintDerivation].
+	lint bool
+
+	// memoryLimit is the maximum number of bytes the interpreter may allocate.
+	memoryLimit int64
+	// instructionLimit is the number of instructions
+	// that each evaluation may execute.
+	instructionLimit int64
+
+	// derivationStack is the names of the derivations being instantiated.
+	derivationStack []string
+	// failedDerivations is the value of derivationStack
+	// when the innermost derivation failed to instantiate
+	// and failedDerivationMessage is the error it failed with.
+	failedDerivations       []string
+	failedDerivationMessage string
+	// errorTraceback and errorTraceDerivations are the traceback
+	// and derivation chain recorded by messageHandler.
+	errorTraceback        []TraceFrame
+	errorTraceDerivations []string
+
+	// warnings is the list of warnings issued by the current evaluation.
+	warnings []*Warning
+	// suppressedWarnings is the list of warning categories to discard.
+	suppressedWarnings []string
+	// warningsDisabled is the number of zb.withoutWarnings calls in progress.
+	warningsDisabled int
+
+	// sources is the set of source paths read by the current evaluation.
+	sources map[string]struct{}
+
+	// hashesModulo maps the paths of derivations the evaluator has seen
+	// to their hashes modulo (see [Derivation.HashModulo]).
+	// The zero hash indicates a derivation with floating content-addressed outputs,
+	// which doesn't have a hash modulo.
+	hashesModulo map[nix.StorePath]nix.Hash
+	// hashingModulo is the stack of derivations
+	// whose hashes modulo are being computed.
+	// It is used to detect dependency cycles.
+	hashingModulo []nix.StorePath
+
+	// baseContext is the context set by SetContext.
+	// spanContext is the context of the innermost span
+	// started by the current evaluation.
+	baseContext context.Context
+	spanContext context.Context
+}
+
+// PathCacheMode is a strategy the path function uses
+// to avoid importing source trees that are already in the store.
+type PathCacheMode int8
+
+const (
+	// PathCacheStamp skips importing a source tree
+	// if none of its files' metadata (including modification times)
+	// have changed since the evaluator last imported it.
+	// This is the default.
+	PathCacheStamp PathCacheMode = iota
+	// PathCacheContent hashes a source tree's content
+	// and skips importing it if the resulting store object already exists.
+	// It is slower than PathCacheStamp for unchanged trees,
+	// but it is not affected by modification times
+	// and it works across evaluators,
+	// so it suits fresh checkouts like those in continuous integration.
+	PathCacheContent
+)
+
+// ParsePathCacheMode parses "stamp" or "content" into a [PathCacheMode].
+func ParsePathCacheMode(s string) (PathCacheMode, error) {
+	switch s {
+	case "stamp":
+		return PathCacheStamp, nil
+	case "content":
+		return PathCacheContent, nil
+	default:
+		return 0, fmt.Errorf("unknown path cache mode %q", s)
+	}
+}
+
+// String returns "stamp" or "content".
+func (mode PathCacheMode) String() string {
+	switch mode {
+	case PathCacheStamp:
+		return "stamp"
+	case PathCacheContent:
+		return "content"
+	default:
+		return fmt.Sprintf("PathCacheMode(%d)", int8(mode))
+	}
 }
 
 func NewEval(storeDir nix.StoreDirectory) *Eval {
-	eval := &Eval{storeDir: storeDir}
+	eval := &Eval{
+		storeDir:          storeDir,
+		pathCache:         make(map[pathCacheKey]pathCacheEntry),
+		licenseViolations: make(map[nix.StorePath]*licenseViolation),
+		hashesModulo:      make(map[nix.StorePath]nix.Hash),
+		lockfile:          &Lockfile{Inputs: make(map[string]*LockedInput)},
+	}
 	registerDerivationMetatable(&eval.l)
 
-	base := lua.NewOpenBase(io.Discard, loadfileFunction)
+	base := lua.NewOpenBase(io.Discard, eval.loadfileFunction)
 	if err := lua.Require(&eval.l, lua.GName, true, base); err != nil {
 		eval.l.Close()
 		panic(err)
@@ -50,14 +181,34 @@ func NewEval(storeDir nix.StoreDirectory) *Eval {
 		eval.l.Close()
 		panic("loadfile is not a function")
 	}
-	eval.l.PushClosure(1, dofileFunction)
+	eval.l.PushClosure(1, eval.dofileFunction)
 	eval.l.RawSetField(-2, "dofile")
 
 	// Set other built-ins.
 	err := lua.SetFuncs(&eval.l, 0, map[string]lua.Function{
-		"derivation": eval.derivationFunction,
-		"path":       eval.pathFunction,
-		"toFile":     eval.toFileFunction,
+		"derivation":                 eval.derivationFunction,
+		"path":                       eval.pathFunction,
+		"toFile":                     eval.toFileFunction,
+		"storePath":                  eval.storePathFunction,
+		"readFile":                   eval.readFileFunction,
+		"fetchGit":                   eval.fetchGitFunction,
+		"input":                      eval.inputFunction,
+		"import":                     eval.importFunction,
+		"getContext":                 getContextFunction,
+		"appendContext":              eval.appendContextFunction,
+		"unsafeDiscardStringContext": unsafeDiscardStringContextFunction,
+		"warn":                       eval.warnFunction,
+		"placeholder": func(l *lua.State) (int, error) {
+			outputName, err := lua.CheckString(l, 1)
+			if err != nil {
+				return 0, err
+			}
+			if outputName == "" {
+				return 0, lua.NewArgError(l, 1, "empty output name")
+			}
+			l.PushString(HashPlaceholder(outputName))
+			return 1, nil
+		},
 		"baseNameOf": func(l *lua.State) (int, error) {
 			path, err := lua.CheckString(l, 1)
 			if err != nil {
@@ -85,9 +236,45 @@ func NewEval(storeDir nix.StoreDirectory) *Eval {
 	eval.l.Pop(1)
 
 	// Load other standard libraries.
-	if err := lua.Require(&eval.l, lua.TableLibraryName, true, lua.OpenTable); err != nil {
-		eval.l.Close()
-		panic(err)
+	// Only libraries that can't affect anything outside the evaluator are available:
+	// io, package, and debug are omitted,
+	// and files are read through builtins like readFile and dofile
+	// so that pure evaluation can restrict them.
+	libs := []struct {
+		name  string
+		openf lua.Function
+		// omit lists functions removed from the library.
+		omit []string
+	}{
+		// table, string, and utf8 only operate on values in the interpreter.
+		// string.dump is omitted because the binary chunks it produces can't be loaded.
+		{name: lua.TableLibraryName, openf: lua.OpenTable},
+		{name: lua.StringLibraryName, openf: lua.OpenString, omit: []string{"dump"}},
+		{name: lua.UTF8LibraryName, openf: lua.OpenUTF8},
+		// math is pure computation,
+		// except for its random number generator,
+		// which has a fixed seed so that evaluation is deterministic.
+		// math.randomseed is omitted because it seeds from the operating system
+		// when called without arguments.
+		{name: lua.MathLibraryName, openf: lua.NewOpenMath(rand.NewSource(1)), omit: []string{"randomseed"}},
+		// Coroutines run in the same interpreter,
+		// so the memory and instruction limits still apply.
+		{name: lua.CoroutineLibraryName, openf: lua.OpenCoroutine},
+		// The evaluator's os library only provides getenv,
+		// which pure evaluation forbids.
+		{name: lua.OSLibraryName, openf: eval.openOS},
+		{name: zbLibraryName, openf: eval.openZB},
+	}
+	for _, lib := range libs {
+		if err := lua.Require(&eval.l, lib.name, true, lib.openf); err != nil {
+			eval.l.Close()
+			panic(err)
+		}
+		for _, name := range lib.omit {
+			eval.l.PushNil()
+			eval.l.RawSetField(-2, name)
+		}
+		eval.l.Pop(1)
 	}
 
 	// Run prelude.
@@ -103,32 +290,153 @@ func NewEval(storeDir nix.StoreDirectory) *Eval {
 	return eval
 }
 
+// SetAutoOptimise sets whether files imported into the store during evaluation
+// are hard-linked to identical files already in the store.
+func (eval *Eval) SetAutoOptimise(autoOptimise bool) {
+	eval.autoOptimise = autoOptimise
+}
+
+// SetStoreRoot sets the directory in the local file system
+// that holds the store in place of the file system root
+// (sometimes called a "chroot store"):
+// store paths are still computed against the evaluator's store directory,
+// but store objects are read from root joined with their paths
+// and nix-store is directed to the store under root.
+// An empty root (the default) means the store is at its logical location.
+func (eval *Eval) SetStoreRoot(root string) {
+	eval.storeRoot = root
+}
+
+// SetLowerStore makes the evaluator's store an overlay store
+// whose objects fall through to a read-only lower store
+// kept under the directory lowerRoot
+// (in the same way as [Eval.SetStoreRoot]).
+// New store objects are written to the upperLayer directory.
+// The store directory must already be an overlay file system mount
+// of the two layers.
+// An empty upperLayer (the default) means the store has no lower layer.
+func (eval *Eval) SetLowerStore(lowerRoot, upperLayer string) {
+	eval.storeLowerRoot = lowerRoot
+	eval.storeUpperLayer = upperLayer
+}
+
+// SetDir sets the directory that relative paths are resolved against
+// when they do not come from a file:
+// paths in expressions passed to [Eval.Expression],
+// file names passed to [Eval.File] and [Eval.SetLockfile],
+// and the project root of pure evaluation without a lockfile.
+// dir must be absolute.
+// By default, the process's working directory is used.
+// SetDir must be called before [Eval.SetLockfile].
+func (eval *Eval) SetDir(dir string) {
+	eval.dir = filepath.Clean(dir)
+}
+
+// abs returns an absolute form of path,
+// resolving it against the directory set by [Eval.SetDir].
+func (eval *Eval) abs(path string) (string, error) {
+	switch {
+	case filepath.IsAbs(path):
+		return filepath.Clean(path), nil
+	case eval.dir != "":
+		return filepath.Join(eval.dir, path), nil
+	default:
+		return filepath.Abs(path)
+	}
+}
+
+// SharePathCache makes eval use the same record of imported source trees
+// as other (see [Eval.SetPathCacheMode]),
+// so that source trees imported by either evaluator
+// do not need to be imported again by the other.
+// Evaluators that share a path cache must not be used concurrently.
+func (eval *Eval) SharePathCache(other *Eval) {
+	eval.pathCache = other.pathCache
+}
+
+// SetPathCacheMode sets how the path function
+// avoids re-importing unchanged source trees.
+func (eval *Eval) SetPathCacheMode(mode PathCacheMode) {
+	eval.pathCacheMode = mode
+}
+
+// SetLint sets whether the evaluator logs a warning
+// for each problem [LintDerivation] finds in the derivations it creates.
+// Linting is off by default.
+func (eval *Eval) SetLint(lint bool) {
+	eval.lint = lint
+}
+
+// SetSystem sets the value of the currentSystem global variable,
+// which Lua code uses to select the system to create derivations for.
+// Derivations for other systems can still be created;
+// whether they can be built is only checked when they are built.
+func (eval *Eval) SetSystem(system string) {
+	eval.l.PushString(system)
+	if err := eval.l.SetGlobal("currentSystem", 0); err != nil {
+		eval.l.Pop(1)
+	}
+}
+
 func (eval *Eval) Close() error {
 	return eval.l.Close()
 }
 
-func (eval *Eval) File(exprFile string, attrPaths []string) ([]any, error) {
+func (eval *Eval) File(exprFile string, attrPaths []string) (_ []any, err error) {
 	defer eval.l.SetTop(0)
-	if err := loadFile(&eval.l, exprFile); err != nil {
+	end := eval.startSpan("zb.evaluate", attribute.String("zb.file", exprFile))
+	defer func() { end(err) }()
+	eval.resetLimits()
+	eval.warnings = nil
+	eval.sources = nil
+	exprFile, err = eval.abs(exprFile)
+	if err != nil {
 		return nil, err
 	}
-	if err := eval.l.Call(0, 1, 0); err != nil {
-		eval.l.Pop(1)
-		return nil, err
+	eval.recordSource(exprFile)
+	eval.l.PushClosure(0, eval.messageHandler)
+	if err := loadFile(&eval.l, exprFile); err != nil {
+		return nil, eval.limitError(err)
+	}
+	if err := eval.l.Call(0, 1, -2); err != nil {
+		return nil, eval.evalError(err)
 	}
-	return eval.attrPaths(attrPaths)
+	results, err := eval.results(attrPaths)
+	return results, eval.limitError(err)
 }
 
-func (eval *Eval) Expression(expr string, attrPaths []string) ([]any, error) {
+func (eval *Eval) Expression(expr string, attrPaths []string) (_ []any, err error) {
 	defer eval.l.SetTop(0)
+	end := eval.startSpan("zb.evaluate")
+	defer func() { end(err) }()
+	eval.resetLimits()
+	eval.warnings = nil
+	eval.sources = nil
+	eval.l.PushClosure(0, eval.messageHandler)
 	if err := loadExpression(&eval.l, expr); err != nil {
-		return nil, err
+		return nil, eval.limitError(err)
 	}
-	if err := eval.l.Call(0, 1, 0); err != nil {
-		eval.l.Pop(1)
-		return nil, err
+	if err := eval.l.Call(0, 1, -2); err != nil {
+		return nil, eval.evalError(err)
+	}
+	results, err := eval.results(attrPaths)
+	return results, eval.limitError(err)
+}
+
+// results evaluates all the attribute paths given
+// against the value on the top of the stack
+// and checks them against the evaluator's policies.
+func (eval *Eval) results(paths []string) ([]any, error) {
+	results, err := eval.attrPaths(paths)
+	if err != nil {
+		return results, err
+	}
+	for _, x := range results {
+		if err := eval.checkLicenses(x); err != nil {
+			return nil, err
+		}
 	}
-	return eval.attrPaths(attrPaths)
+	return results, nil
 }
 
 // attrPaths evaluates all the attribute paths given
@@ -180,7 +488,7 @@ func luaToGo(l *lua.State) (any, error) {
 		n, _ := l.ToNumber(-1)
 		return n, nil
 	case lua.TypeBoolean:
-		return l.IsBoolean(-1), nil
+		return l.ToBoolean(-1), nil
 	case lua.TypeString:
 		s, _ := l.ToString(-1)
 		return s, nil
@@ -329,7 +637,7 @@ func loadFunction(l *lua.State) (int, error) {
 }
 
 // loadfileFunction is the global loadfile function implementation.
-func loadfileFunction(l *lua.State) (int, error) {
+func (eval *Eval) loadfileFunction(l *lua.State) (int, error) {
 	filename, err := lua.CheckString(l, 1)
 	if err != nil {
 		return 0, err
@@ -358,12 +666,18 @@ func loadfileFunction(l *lua.State) (int, error) {
 	const envArg = 3
 	hasEnv := l.Type(envArg) != lua.TypeNone
 
-	filename, err = absSourcePath(l, filename)
+	filename, err = eval.absSourcePath(l, filename)
 	if err != nil {
 		l.PushNil()
 		l.PushString(err.Error())
 		return 2, nil
 	}
+	if err := eval.checkPurePath(filename); err != nil {
+		l.PushNil()
+		l.PushString(err.Error())
+		return 2, nil
+	}
+	eval.recordSource(filename)
 	if err := loadFile(l, filename); err != nil {
 		l.PushNil()
 		l.PushString(err.Error())
@@ -383,7 +697,7 @@ func loadfileFunction(l *lua.State) (int, error) {
 
 // dofileFunction is the global dofile function implementation.
 // It assumes that a loadfile function is its first upvalue.
-func dofileFunction(l *lua.State) (int, error) {
+func (eval *Eval) dofileFunction(l *lua.State) (int, error) {
 	filename, err := lua.CheckString(l, 1)
 	if err != nil {
 		return 0, err
@@ -395,7 +709,7 @@ func dofileFunction(l *lua.State) (int, error) {
 
 	// Perform path resolution here instead of at loadfile,
 	// since loadfile would just obtain our call record.
-	resolved, err := absSourcePath(l, filename)
+	resolved, err := eval.absSourcePath(l, filename)
 	if err != nil {
 		return 0, fmt.Errorf("dofile: %v", err)
 	}
@@ -0,0 +1,96 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestStandardLibraries(t *testing.T) {
+	tests := []struct {
+		expr string
+		want any
+	}{
+		// Unavailable libraries and functions.
+		{`io == nil`, true},
+		{`package == nil`, true},
+		{`require == nil`, true},
+		{`debug == nil`, true},
+		{`os.execute == nil`, true},
+		{`os.remove == nil`, true},
+		{`os.rename == nil`, true},
+		{`os.tmpname == nil`, true},
+		{`os.exit == nil`, true},
+		{`string.dump == nil`, true},
+		{`math.randomseed == nil`, true},
+
+		// Available libraries.
+		{`string.upper == nil`, false},
+		{`string.upper("abc")`, "ABC"},
+		{`("abc"):rep(2)`, "abcabc"},
+		{`utf8.char(0x4e16)`, "世"},
+		{`math.max(1, 3, 2)`, int64(3)},
+		{`coroutine.wrap(function() coroutine.yield("x") end)()`, "x"},
+		{`table.concat({"a", "b"}, ",")`, "a,b"},
+	}
+	for _, test := range tests {
+		eval := NewEval(nix.StoreDirectory(t.TempDir()))
+		results, err := eval.Expression(test.expr, nil)
+		eval.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if len(results) != 1 || results[0] != test.want {
+			t.Errorf("%s = %#v; want %#v", test.expr, results, test.want)
+		}
+	}
+}
+
+func TestRandomIsDeterministic(t *testing.T) {
+	const expr = `math.random(1, 1000000)`
+	var first any
+	for i := 0; i < 2; i++ {
+		eval := NewEval(nix.StoreDirectory(t.TempDir()))
+		results, err := eval.Expression(expr, nil)
+		eval.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = results[0]
+		} else if results[0] != first {
+			t.Errorf("second evaluation of %s = %v; first = %v", expr, results[0], first)
+		}
+	}
+}
+
+func TestSetDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "answer.lua"), []byte("return 42\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	eval.SetDir(dir)
+
+	got, err := eval.Expression(`dofile("answer.lua")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != int64(42) {
+		t.Errorf("dofile(\"answer.lua\") = %#v; want 42", got)
+	}
+	got, err = eval.File("answer.lua", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != int64(42) {
+		t.Errorf("File(\"answer.lua\") = %#v; want 42", got)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// A Fetcher downloads resources for a URL scheme.
+type Fetcher interface {
+	// Fetch writes the content of the resource identified by u to w.
+	Fetch(ctx context.Context, w io.Writer, u *url.URL) error
+}
+
+// FetcherFunc is a function that implements [Fetcher].
+type FetcherFunc func(ctx context.Context, w io.Writer, u *url.URL) error
+
+// Fetch calls f(ctx, w, u).
+func (f FetcherFunc) Fetch(ctx context.Context, w io.Writer, u *url.URL) error {
+	return f(ctx, w, u)
+}
+
+// fetcherRegistry is a set of fetchers keyed by lowercase URL scheme.
+// The zero value is an empty registry.
+type fetcherRegistry struct {
+	mu sync.RWMutex
+	m  map[string]Fetcher
+}
+
+// fetchers is the registry used by [RegisterFetcher] and [LookupFetcher].
+var fetchers = &fetcherRegistry{
+	m: map[string]Fetcher{
+		"http":  FetcherFunc(fetchHTTP),
+		"https": FetcherFunc(fetchHTTP),
+		"file":  FetcherFunc(fetchFile),
+	},
+}
+
+// RegisterFetcher makes a fetcher available for URLs with the given scheme.
+// Schemes are case-insensitive.
+// RegisterFetcher returns an error if the scheme already has a fetcher registered
+// or f is nil.
+func RegisterFetcher(scheme string, f Fetcher) error {
+	return fetchers.register(scheme, f)
+}
+
+// LookupFetcher returns the fetcher registered for the given URL scheme
+// or nil if there is none.
+func LookupFetcher(scheme string) Fetcher {
+	return fetchers.lookup(scheme)
+}
+
+func (r *fetcherRegistry) register(scheme string, f Fetcher) error {
+	if f == nil {
+		return fmt.Errorf("register fetcher for %s: nil fetcher", scheme)
+	}
+	scheme = strings.ToLower(scheme)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.m[scheme]; dup {
+		return fmt.Errorf("register fetcher for %s: scheme already has a fetcher", scheme)
+	}
+	if r.m == nil {
+		r.m = make(map[string]Fetcher)
+	}
+	r.m[scheme] = f
+	return nil
+}
+
+func (r *fetcherRegistry) lookup(scheme string) Fetcher {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.m[strings.ToLower(scheme)]
+}
+
+func fetchHTTP(ctx context.Context, w io.Writer, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: http %s", u, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func fetchFile(ctx context.Context, w io.Writer, u *url.URL) error {
+	if u.Host != "" && u.Host != "localhost" {
+		return fmt.Errorf("%v: non-local file URL", u)
+	}
+	f, err := os.Open(filepath.FromSlash(u.Path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// builtinFetchurlSchemes is the set of URL schemes
+// that the build backend's builtin:fetchurl builder understands.
+// Fixed-output derivations using builtin:fetchurl with any other scheme
+// are fetched during evaluation with a registered [Fetcher].
+var builtinFetchurlSchemes = map[string]struct{}{
+	"http":  {},
+	"https": {},
+	"ftp":   {},
+}
+
+// Prefetch fetches the output of a builtin:fetchurl derivation
+// with a registered [Fetcher] if its URL uses a scheme
+// that the build backend does not support
+// and the output is not already in the store.
+// This allows [Fetcher] implementations to extend fetchurl
+// while leaving the derivation unchanged:
+// the backend will find the fixed output already present in the store.
+// Prefetch does nothing for other derivations.
+//
+// The evaluator prefetches each derivation it creates,
+// but the output may have been garbage collected since
+// or the derivation may have been evaluated elsewhere,
+// so callers that build store derivations
+// should call [Eval.PrefetchClosure] first.
+func (eval *Eval) Prefetch(ctx context.Context, drv *Derivation) (err error) {
+	if drv.Builder != "builtin:fetchurl" {
+		return nil
+	}
+	u, err := url.Parse(drv.Env["url"])
+	if err != nil {
+		return fmt.Errorf("fetch %s: %v", drv.Name, err)
+	}
+	if _, ok := builtinFetchurlSchemes[strings.ToLower(u.Scheme)]; ok {
+		return nil
+	}
+	f := LookupFetcher(u.Scheme)
+	if f == nil {
+		return fmt.Errorf("fetch %s: no fetcher registered for %q URLs", drv.Name, u.Scheme)
+	}
+	out := drv.Outputs[defaultDerivationOutputName]
+	if out == nil || out.typ != fixedCAOutputType {
+		return fmt.Errorf("fetch %s: output is not fixed", drv.Name)
+	}
+	storePath, ok := out.Path(eval.storeDir, drv.Name, defaultDerivationOutputName)
+	if !ok {
+		return fmt.Errorf("fetch %s: cannot compute output path", drv.Name)
+	}
+	if _, err := os.Lstat(eval.realPath(string(storePath))); err == nil {
+		// Already present.
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "zb.fetch", trace.WithAttributes(attribute.String("url.full", u.String())))
+	defer func() { spans.End(span, err) }()
+	tf, err := os.CreateTemp("", "zb-fetch-*")
+	if err != nil {
+		return fmt.Errorf("fetch %s: %v", drv.Name, err)
+	}
+	defer func() {
+		name := tf.Name()
+		tf.Close()
+		os.Remove(name)
+	}()
+	if err := f.Fetch(ctx, tf, u); err != nil {
+		return fmt.Errorf("fetch %s: %w", drv.Name, err)
+	}
+	size, err := tf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("fetch %s: %v", drv.Name, err)
+	}
+
+	var mode fs.FileMode
+	if drv.Env["executable"] != "" {
+		mode = 0o555
+	}
+	if err := eval.importFetchedFile(ctx, tf, size, mode, storePath, out.ca); err != nil {
+		return fmt.Errorf("fetch %s: %w", drv.Name, err)
+	}
+	return nil
+}
+
+// PrefetchClosure calls [Eval.Prefetch] on the derivation at drvPath
+// and the derivations it depends on
+// whose outputs are not all present in the store.
+// readDerivation is used to load the derivations.
+func (eval *Eval) PrefetchClosure(ctx context.Context, drvPath nix.StorePath, readDerivation func(nix.StorePath) (*Derivation, error)) error {
+	seen := map[nix.StorePath]struct{}{drvPath: {}}
+	stack := []nix.StorePath{drvPath}
+	for len(stack) > 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		drv, err := readDerivation(curr)
+		if err != nil {
+			return err
+		}
+		if eval.outputsPresent(drv) {
+			continue
+		}
+		if err := eval.Prefetch(ctx, drv); err != nil {
+			return err
+		}
+		for input := range drv.InputDerivations {
+			if _, ok := seen[input]; !ok {
+				seen[input] = struct{}{}
+				stack = append(stack, input)
+			}
+		}
+	}
+	return nil
+}
+
+// outputsPresent reports whether all of drv's outputs are in the store.
+// It returns false if any output's path cannot be known before building.
+func (eval *Eval) outputsPresent(drv *Derivation) bool {
+	for outName, out := range drv.Outputs {
+		p, ok := out.Path(eval.storeDir, drv.Name, outName)
+		if !ok {
+			return false
+		}
+		if _, err := os.Lstat(eval.realPath(string(p))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// importFetchedFile imports the content of f into the store as storePath,
+// verifying that it matches ca as it is streamed to the store.
+// If the content does not match, the import is aborted
+// before the store object is registered.
+func (eval *Eval) importFetchedFile(ctx context.Context, f io.ReadSeeker, size int64, mode fs.FileMode, storePath nix.StorePath, ca nix.ContentAddress) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	imp, err := eval.startImport(ctx)
+	if err != nil {
+		return err
+	}
+	defer imp.Close()
+	h := nix.NewHasher(ca.Hash().Type())
+	if ca.IsRecursiveFile() {
+		err = writeSingleFileNARMode(io.MultiWriter(imp, h), f, size, mode)
+	} else {
+		err = writeSingleFileNARMode(imp, io.TeeReader(f, h), size, mode)
+	}
+	if err != nil {
+		imp.Abort()
+		return err
+	}
+	if got, want := h.SumHash(), ca.Hash(); !got.Equal(want) {
+		imp.Abort()
+		return fmt.Errorf("hash mismatch: got %v (expected %v)", got, want)
+	}
+	if err := imp.Trailer(&nixExportTrailer{storePath: storePath}); err != nil {
+		return err
+	}
+	return imp.Close()
+}
+
+func writeSingleFileNARMode(w io.Writer, r io.Reader, sz int64, mode fs.FileMode) error {
+	nw := nar.NewWriter(w)
+	if err := nw.WriteHeader(&nar.Header{Size: sz, Mode: mode}); err != nil {
+		return err
+	}
+	n, err := io.Copy(nw, r)
+	if err != nil {
+		return err
+	}
+	if n != sz {
+		return errors.New("file changed size during import")
+	}
+	return nw.Close()
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+func TestLookupFetcher(t *testing.T) {
+	for _, scheme := range []string{"http", "HTTPS", "file"} {
+		if LookupFetcher(scheme) == nil {
+			t.Errorf("LookupFetcher(%q) = <nil>; want built-in fetcher", scheme)
+		}
+	}
+	if f := LookupFetcher("zb-test-unregistered"); f != nil {
+		t.Errorf("LookupFetcher(%q) = %v; want <nil>", "zb-test-unregistered", f)
+	}
+}
+
+func TestFetcherRegistry(t *testing.T) {
+	r := new(fetcherRegistry)
+	want := "Hello, World!\n"
+	err := r.register("zb-test", FetcherFunc(func(ctx context.Context, w io.Writer, u *url.URL) error {
+		_, err := io.WriteString(w, want)
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.lookup("ZB-TEST")
+	if f == nil {
+		t.Fatal("lookup(\"ZB-TEST\") = <nil> after registering \"zb-test\"")
+	}
+	buf := new(bytes.Buffer)
+	if err := f.Fetch(context.Background(), buf, &url.URL{Scheme: "zb-test", Opaque: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("fetched %q; want %q", got, want)
+	}
+
+	if err := r.register("zb-test", FetcherFunc(fetchFile)); err == nil {
+		t.Error("registering zb-test twice did not return an error")
+	}
+	if err := r.register("zb-test-nil", nil); err == nil {
+		t.Error("registering a nil fetcher did not return an error")
+	}
+	if f := LookupFetcher("zb-test"); f != nil {
+		t.Errorf("LookupFetcher(\"zb-test\") = %v after registering in another registry; want <nil>", f)
+	}
+}
+
+func TestFetchFile(t *testing.T) {
+	const want = "Hello, World!\n"
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte(want), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+	if err := LookupFetcher("file").Fetch(context.Background(), buf, u); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("fetched %q; want %q", got, want)
+	}
+}
+
+func TestPrefetchClosure(t *testing.T) {
+	dir := nix.StoreDirectory(t.TempDir())
+	eval := NewEval(dir)
+	defer eval.Close()
+
+	fetchDrvPath, err := dir.Object("s5fm3mqx08mlmlbnnvsm2zqfixn1wxma-hello.txt.drv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchDrv := &Derivation{
+		Dir:     dir,
+		Name:    "hello.txt",
+		System:  "builtin",
+		Builder: "builtin:fetchurl",
+		Env:     map[string]string{"url": "zb-test-unregistered:hello.txt"},
+		Outputs: map[string]*DerivationOutput{
+			"out": FixedCAOutput(nix.FlatFileContentAddress(hashString(nix.SHA256, "Hello, World!\n"))),
+		},
+	}
+	drvPath, err := dir.Object("6bxpd2xvp5hbkfkcaahxkxzx3ja2ck0k-hello.drv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := &Derivation{
+		Dir:     dir,
+		Name:    "hello",
+		System:  "x86_64-linux",
+		Builder: "/bin/sh",
+		InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+			fetchDrvPath: sortedset.New("out"),
+		},
+		Outputs: map[string]*DerivationOutput{
+			"out": DeferredOutput(),
+		},
+	}
+	drvs := map[nix.StorePath]*Derivation{
+		fetchDrvPath: fetchDrv,
+		drvPath:      drv,
+	}
+	readDerivation := func(p nix.StorePath) (*Derivation, error) {
+		d := drvs[p]
+		if d == nil {
+			return nil, fmt.Errorf("read %s: not found", p)
+		}
+		return d, nil
+	}
+
+	// The fetchurl output is missing and its scheme has no fetcher,
+	// so PrefetchClosure must try to fetch it.
+	err = eval.PrefetchClosure(context.Background(), drvPath, readDerivation)
+	if err == nil || !strings.Contains(err.Error(), "no fetcher registered") {
+		t.Errorf("PrefetchClosure(...) with missing output = %v; want no fetcher error", err)
+	}
+
+	// Once the output is present, there is nothing to fetch.
+	outPath, ok := fetchDrv.Outputs["out"].Path(dir, fetchDrv.Name, "out")
+	if !ok {
+		t.Fatal("cannot compute fetchurl output path")
+	}
+	if err := os.WriteFile(string(outPath), []byte("Hello, World!\n"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	if err := eval.PrefetchClosure(context.Background(), drvPath, readDerivation); err != nil {
+		t.Error("PrefetchClosure(...) with present output:", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"archive/tar"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/lua"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// defaultImportFile is the file that the import function runs
+// if no file is given.
+const defaultImportFile = "default.lua"
+
+// importFunction implements the import built-in,
+// which runs a Lua file from a remote archive.
+// The archive is unpacked into the store
+// and its hash is pinned in the lockfile under the archive's URL.
+func (eval *Eval) importFunction(l *lua.State) (int, error) {
+	rawURL, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(l.StringContext(1)) > 0 {
+		return 0, errors.New("import: import from derivation not supported")
+	}
+	file := defaultImportFile
+	if !l.IsNoneOrNil(2) {
+		file, err = lua.CheckString(l, 2)
+		if err != nil {
+			return 0, err
+		}
+		file = slashpath.Clean(file)
+		if slashpath.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+			return 0, lua.NewArgError(l, 2, "file must be relative to the archive root")
+		}
+	}
+
+	ctx := eval.traceContext()
+	decl := &LockedInput{URL: rawURL, Unpack: true}
+	locked := eval.lockfile.Inputs[rawURL]
+	if locked != nil && !locked.matches(decl) {
+		locked = nil
+	}
+	var h nix.Hash
+	if locked != nil {
+		h, err = nix.ParseHash(locked.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("import %s: locked hash: %v", rawURL, err)
+		}
+	} else if err := eval.checkPureFetch("import " + rawURL); err != nil {
+		return 0, fmt.Errorf("%v; run zb lock update %s", err, rawURL)
+	}
+	srcDir, storePath, sum, cleanup, err := eval.fetchArchive(ctx, rawURL, h)
+	if err != nil {
+		return 0, fmt.Errorf("import %s: %v", rawURL, err)
+	}
+	defer cleanup()
+	if locked == nil {
+		eval.lockInput(rawURL, &LockedInput{
+			URL:    rawURL,
+			Unpack: true,
+			Hash:   sum.SRI(),
+		})
+	}
+
+	// The source is read from srcDir, which may be a temporary copy,
+	// but named by its store path so that relative paths in the module
+	// resolve to the store object.
+	f, err := os.Open(filepath.Join(srcDir, filepath.FromSlash(file)))
+	if err != nil {
+		return 0, fmt.Errorf("import %s: %v", rawURL, err)
+	}
+	defer f.Close()
+	chunkName := "@" + string(storePath) + "/" + file
+	l.SetTop(0)
+	if err := l.Load(f, chunkName, "t"); err != nil {
+		l.Pop(1)
+		return 0, fmt.Errorf("import %s: %v", rawURL, err)
+	}
+	if err := l.Call(0, lua.MultipleReturns, 0); err != nil {
+		return 0, err
+	}
+	return l.Top(), nil
+}
+
+// fetchArchive downloads and unpacks the archive at rawURL into the store.
+// If h is not zero, it is the expected SHA-256 hash of the unpacked tree's NAR serialization,
+// and the archive is not downloaded if the store object already exists.
+// fetchArchive returns a directory containing the unpacked tree,
+// which is either the store object or a temporary directory
+// that is removed when cleanup is called.
+func (eval *Eval) fetchArchive(ctx context.Context, rawURL string, h nix.Hash) (dir string, storePath nix.StorePath, sum nix.Hash, cleanup func(), err error) {
+	const name = "source"
+	ctx, span := tracer.Start(ctx, "zb.fetch", trace.WithAttributes(attribute.String("url.full", rawURL)))
+	defer func() { spans.End(span, err) }()
+	cleanup = func() {}
+	if !h.IsZero() {
+		storePath, err := fixedCAOutputPath(eval.storeDir, name, nix.RecursiveFileContentAddress(h), storeReferences{})
+		if err != nil {
+			return "", "", nix.Hash{}, cleanup, err
+		}
+		if _, err := os.Lstat(eval.realPath(string(storePath))); err == nil {
+			return string(storePath), storePath, h, cleanup, nil
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", nix.Hash{}, cleanup, err
+	}
+	f := LookupFetcher(u.Scheme)
+	if f == nil {
+		return "", "", nix.Hash{}, cleanup, fmt.Errorf("no fetcher registered for %q URLs", u.Scheme)
+	}
+	tf, err := os.CreateTemp("", "zb-fetch-*")
+	if err != nil {
+		return "", "", nix.Hash{}, cleanup, err
+	}
+	defer func() {
+		name := tf.Name()
+		tf.Close()
+		os.Remove(name)
+	}()
+	if err := f.Fetch(ctx, tf, u); err != nil {
+		return "", "", nix.Hash{}, cleanup, err
+	}
+	if _, err := tf.Seek(0, io.SeekStart); err != nil {
+		return "", "", nix.Hash{}, cleanup, err
+	}
+
+	tempDir, err := os.MkdirTemp("", "zb-import-*")
+	if err != nil {
+		return "", "", nix.Hash{}, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(tempDir) }
+	root, err := unpackArchive(tempDir, tf, u.Path)
+	if err != nil {
+		cleanup()
+		return "", "", nix.Hash{}, func() {}, err
+	}
+	storePath, sum, err = eval.importTree(ctx, name, root, h, nil)
+	if err != nil {
+		cleanup()
+		return "", "", nix.Hash{}, func() {}, err
+	}
+	return root, storePath, sum, cleanup, nil
+}
+
+// unpackArchive extracts the tar archive read from r into dir.
+// The compression is determined by the extension of name
+// (.tar, .tar.gz, .tgz, .tar.bz2, or .tbz2).
+// If the archive contains a single top-level directory (as is conventional),
+// unpackArchive returns the path to that directory.
+// Otherwise, it returns dir.
+func unpackArchive(dir string, r io.Reader, name string) (root string, err error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(name, ".tar.bz2") || strings.HasSuffix(name, ".tbz2"):
+		r = bzip2.NewReader(r)
+	case strings.HasSuffix(name, ".tar"):
+	default:
+		return "", fmt.Errorf("unsupported archive type for %s (want .tar, .tar.gz, or .tar.bz2)", slashpath.Base(name))
+	}
+
+	// Symbolic links are created after all other files
+	// so that extraction never follows them outside dir.
+	var symlinks []*tar.Header
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		p := slashpath.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if p == "." {
+			continue
+		}
+		if slashpath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return "", fmt.Errorf("archive contains invalid path %q", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(p))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0o755); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return "", err
+			}
+			perm := os.FileMode(0o644)
+			if hdr.Mode&0o100 != 0 {
+				perm = 0o755
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return "", err
+			}
+			if closeErr != nil {
+				return "", closeErr
+			}
+		case tar.TypeXGlobalHeader:
+			// Written by git archive. Not a file.
+		case tar.TypeSymlink:
+			hdr.Name = p
+			symlinks = append(symlinks, hdr)
+		default:
+			// Other file types (hard links, devices, etc.) can't be stored.
+			return "", fmt.Errorf("archive contains unsupported file %s", hdr.Name)
+		}
+	}
+	for _, hdr := range symlinks {
+		dst := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.Symlink(hdr.Linkname, dst); err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestImport(t *testing.T) {
+	installFakeNixStore(t)
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "pkgs.tar.gz")
+	lockPath := filepath.Join(dir, LockfileName)
+	storeDir := nix.StoreDirectory(t.TempDir())
+	archiveURL := "file://" + filepath.ToSlash(archivePath)
+
+	writeArchive := func(greeting string) {
+		t.Helper()
+		f, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zw := gzip.NewWriter(f)
+		tw := tar.NewWriter(zw)
+		files := []struct {
+			name    string
+			content string
+		}{
+			{"pkgs-1.0/default.lua", `return { greeting = "` + greeting + `" }`},
+			{"pkgs-1.0/lib/other.lua", `local _, err = pcall(function() return dofile("sibling.lua") end); return err`},
+		}
+		for _, file := range files {
+			err := tw.WriteHeader(&tar.Header{
+				Name: file.name,
+				Mode: 0o644,
+				Size: int64(len(file.content)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(file.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evalImport := func(expr string) (any, error) {
+		eval := NewEval(storeDir)
+		defer eval.Close()
+		if err := eval.SetLockfile(lockPath); err != nil {
+			return nil, err
+		}
+		results, err := eval.Expression(expr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := eval.SaveLockfile(); err != nil {
+			return nil, err
+		}
+		return results[0], nil
+	}
+
+	writeArchive("Hello")
+	got, err := evalImport(`import("` + archiveURL + `").greeting`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Hello" {
+		t.Errorf("import(...).greeting = %#v; want %q", got, "Hello")
+	}
+	lf, err := ReadLockfile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked := lf.Inputs[archiveURL]; locked == nil || !locked.Unpack || locked.Hash == "" {
+		t.Errorf("lockfile entry for %s = %+v; want unpacked archive with hash", archiveURL, locked)
+	}
+
+	got, err = evalImport(`import("` + archiveURL + `", "lib/other.lua")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Relative paths in the module should resolve to the store object.
+	if s, _ := got.(string); !strings.Contains(s, string(storeDir)) || !strings.Contains(s, "-source/lib/sibling.lua") {
+		t.Errorf("dofile(\"sibling.lua\") from lib/other.lua error = %#v; want a path in the store", got)
+	}
+
+	// Changing the archive should fail until the lock is updated.
+	writeArchive("Goodbye")
+	if _, err := evalImport(`import("` + archiveURL + `").greeting`); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("import of changed archive error = %v; want hash mismatch", err)
+	}
+}
+
+func TestUnpackArchiveRejectsEscapes(t *testing.T) {
+	for _, name := range []string{"../evil", "/etc/evil", "a/../../evil"} {
+		archivePath := filepath.Join(t.TempDir(), "bad.tar")
+		f, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(f)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		_, err = unpackArchive(t.TempDir(), f, archivePath)
+		f.Close()
+		if err == nil {
+			t.Errorf("unpackArchive with %q did not return an error", name)
+		}
+	}
+}
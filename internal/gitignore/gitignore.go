@@ -0,0 +1,208 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package gitignore matches paths against the patterns in gitignore files,
+// as described in gitignore(5).
+package gitignore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	slashpath "path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A Pattern is a single line of a gitignore file.
+type Pattern struct {
+	// dir is the slash-separated directory containing the gitignore file,
+	// relative to the root of the matched tree.
+	// It is empty for the root.
+	dir      string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// Parse parses the patterns in a gitignore file
+// located in the given slash-separated directory
+// (relative to the root of the tree to be matched, "" for the root).
+func Parse(data []byte, dir string) []Pattern {
+	var patterns []Pattern
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if p, ok := parseLine(s.Text(), dir); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func parseLine(line string, dir string) (Pattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless they are escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return Pattern{}, false
+	}
+	p := Pattern{dir: dir}
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return Pattern{}, false
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	p.segments = strings.Split(line, "/")
+	return p, true
+}
+
+// Match reports whether the pattern matches the given slash-separated path,
+// relative to the root of the tree.
+func (p *Pattern) Match(path string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.dir != "" {
+		var ok bool
+		path, ok = strings.CutPrefix(path, p.dir+"/")
+		if !ok {
+			return false
+		}
+	}
+	if !p.anchored {
+		ok, _ := slashpath.Match(p.segments[0], slashpath.Base(path))
+		return ok
+	}
+	return matchSegments(p.segments, strings.Split(path, "/"))
+}
+
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				// A trailing "/**" matches everything inside, but not the directory itself.
+				return len(path) > 0
+			}
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := slashpath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// A Matcher reports whether paths in a directory tree are ignored
+// according to the tree's gitignore files.
+// It reads .gitignore files lazily as directories are queried.
+type Matcher struct {
+	root     string
+	patterns map[string][]Pattern
+}
+
+// NewMatcher returns a matcher for the tree rooted at the given directory.
+// If the directory is the top of a Git working tree,
+// the repository's .git/info/exclude file is also consulted.
+func NewMatcher(root string) *Matcher {
+	return &Matcher{
+		root:     root,
+		patterns: make(map[string][]Pattern),
+	}
+}
+
+// Ignored reports whether the given slash-separated path
+// (relative to the matcher's root) is ignored.
+// Ignored does not consider whether the path's parent directories are ignored:
+// callers walking a tree should not descend into ignored directories.
+// .git directories are always ignored.
+func (m *Matcher) Ignored(path string, isDir bool) (bool, error) {
+	if isDir && slashpath.Base(path) == ".git" {
+		return true, nil
+	}
+	// Patterns in deeper directories take precedence,
+	// and later patterns in a file take precedence over earlier ones.
+	var dirs []string
+	for dir := slashpath.Dir(path); dir != "." && dir != "/"; dir = slashpath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, "")
+	slices.Reverse(dirs)
+	ignored := false
+	for _, dir := range dirs {
+		patterns, err := m.load(dir)
+		if err != nil {
+			return false, err
+		}
+		for i := range patterns {
+			if patterns[i].Match(path, isDir) {
+				ignored = !patterns[i].negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+func (m *Matcher) load(dir string) ([]Pattern, error) {
+	if patterns, ok := m.patterns[dir]; ok {
+		return patterns, nil
+	}
+	osDir := filepath.Join(m.root, filepath.FromSlash(dir))
+	var patterns []Pattern
+	if dir == "" {
+		// .git may be a file (as in linked worktrees), so errors are ignored.
+		if data, err := os.ReadFile(filepath.Join(osDir, ".git", "info", "exclude")); err == nil {
+			patterns = Parse(data, dir)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(osDir, ".gitignore"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	patterns = append(patterns, Parse(data, dir)...)
+	m.patterns[dir] = patterns
+	return patterns, nil
+}
+
+// FindRoot returns the top of the Git working tree containing path:
+// the nearest ancestor directory (including path itself) that contains a .git entry.
+// If there is no such directory, FindRoot returns path.
+func FindRoot(path string) string {
+	for dir := path; ; {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path
+		}
+		dir = parent
+	}
+}
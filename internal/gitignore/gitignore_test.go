@@ -0,0 +1,122 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package gitignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dir     string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{pattern: "*.o", path: "foo.o", want: true},
+		{pattern: "*.o", path: "a/b/foo.o", want: true},
+		{pattern: "*.o", path: "foo.c", want: false},
+		{pattern: "build/", path: "build", isDir: true, want: true},
+		{pattern: "build/", path: "build", isDir: false, want: false},
+		{pattern: "build/", path: "src/build", isDir: true, want: true},
+		{pattern: "/build", path: "build", want: true},
+		{pattern: "/build", path: "src/build", want: false},
+		{pattern: "doc/*.txt", path: "doc/notes.txt", want: true},
+		{pattern: "doc/*.txt", path: "doc/sub/notes.txt", want: false},
+		{pattern: "**/foo", path: "foo", want: true},
+		{pattern: "**/foo", path: "a/b/foo", want: true},
+		{pattern: "a/**/b", path: "a/b", want: true},
+		{pattern: "a/**/b", path: "a/x/y/b", want: true},
+		{pattern: "a/**", path: "a/x/y", want: true},
+		{pattern: "a/**", path: "a", isDir: true, want: false},
+		{pattern: "*.log", dir: "sub", path: "sub/x.log", want: true},
+		{pattern: "*.log", dir: "sub", path: "x.log", want: false},
+		{pattern: "/x.log", dir: "sub", path: "sub/x.log", want: true},
+		{pattern: `\#notes`, path: "#notes", want: true},
+		{pattern: "trailing   ", path: "trailing", want: true},
+	}
+	for _, test := range tests {
+		patterns := Parse([]byte(test.pattern+"\n"), test.dir)
+		if len(patterns) != 1 {
+			t.Errorf("Parse(%q) returned %d patterns; want 1", test.pattern, len(patterns))
+			continue
+		}
+		if got := patterns[0].Match(test.path, test.isDir); got != test.want {
+			t.Errorf("pattern %q in %q: Match(%q, %t) = %t; want %t",
+				test.pattern, test.dir, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	patterns := Parse([]byte("# comment\n\n   \n!keep\n"), "")
+	if len(patterns) != 1 || !patterns[0].negate {
+		t.Errorf("Parse(...) = %+v; want single negated pattern", patterns)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":        "*.log\nscratch/\n",
+		"sub/.gitignore":    "!important.log\n/local.txt\n",
+		".git/info/exclude": "secret\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: "main.go", want: false},
+		{path: "debug.log", want: true},
+		{path: "scratch", isDir: true, want: true},
+		{path: ".git", isDir: true, want: true},
+		{path: "secret", want: true},
+		{path: "sub/debug.log", want: true},
+		{path: "sub/important.log", want: false},
+		{path: "sub/local.txt", want: true},
+		{path: "local.txt", want: false},
+	}
+	m := NewMatcher(root)
+	for _, test := range tests {
+		got, err := m.Ignored(test.path, test.isDir)
+		if err != nil {
+			t.Errorf("Ignored(%q, %t): %v", test.path, test.isDir, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Ignored(%q, %t) = %t; want %t", test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestFindRoot(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindRoot(sub); got != sub {
+		t.Errorf("FindRoot(%q) outside a repository = %q; want %q", sub, got, sub)
+	}
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindRoot(sub); got != root {
+		t.Errorf("FindRoot(%q) = %q; want %q", sub, got, root)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/log"
+)
+
+const (
+	httpBatchSize     = 100
+	httpFlushInterval = time.Second
+	httpQueueSize     = 1024
+)
+
+// HTTPEntry is the JSON representation of a log entry
+// sent by the HTTP sink.
+type HTTPEntry struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	File  string    `json:"file,omitempty"`
+	Line  int       `json:"line,omitempty"`
+}
+
+// HTTPSink sends log entries to an HTTP collector.
+// Entries are batched and sent in the body of POST requests
+// as newline-delimited JSON [HTTPEntry] objects
+// with a Content-Type of "application/x-ndjson".
+// Logging never blocks on the network:
+// if the collector falls behind, entries are dropped.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+
+	entries chan HTTPEntry
+	done    chan struct{}
+
+	closeOnce sync.Once
+	dropped   int
+}
+
+// NewHTTP returns a new sink that sends entries to the given URL.
+// If client is nil, [http.DefaultClient] is used.
+func NewHTTP(url string, client *http.Client) *HTTPSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	s := &HTTPSink{
+		url:     url,
+		client:  client,
+		entries: make(chan HTTPEntry, httpQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Log queues the entry to be sent.
+func (s *HTTPSink) Log(ctx context.Context, ent log.Entry) {
+	e := HTTPEntry{
+		Time:  ent.Time,
+		Level: ent.Level.String(),
+		Msg:   message(ent),
+		File:  ent.File,
+		Line:  ent.Line,
+	}
+	select {
+	case s.entries <- e:
+	default:
+	}
+}
+
+// LogEnabled returns true.
+func (s *HTTPSink) LogEnabled(log.Entry) bool {
+	return true
+}
+
+// Close sends any queued entries and stops the sink.
+// Log must not be called after Close.
+func (s *HTTPSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.entries)
+	})
+	<-s.done
+	return nil
+}
+
+func (s *HTTPSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(httpFlushInterval)
+	defer ticker.Stop()
+	var batch []HTTPEntry
+	for {
+		select {
+		case e, ok := <-s.entries:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= httpBatchSize {
+				s.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *HTTPSink) send(batch []HTTPEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	body := new(bytes.Buffer)
+	enc := json.NewEncoder(body)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", body)
+	if err != nil {
+		// The sink can't log its own failures without recursing,
+		// so report them on stderr.
+		fmt.Fprintf(os.Stderr, "log sink %s: %v\n", s.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		fmt.Fprintf(os.Stderr, "log sink %s: http %s\n", s.url, resp.Status)
+	}
+}
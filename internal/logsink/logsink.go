@@ -0,0 +1,110 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package logsink provides destinations for log entries
+// beyond a process's standard error,
+// so that long-running zb processes can integrate with log aggregation systems.
+package logsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"zombiezen.com/go/log"
+)
+
+// A Sink is a [log.Logger] that holds resources
+// that must be released when the sink is no longer needed.
+type Sink interface {
+	log.Logger
+	// Close flushes any buffered entries and releases the sink's resources.
+	Close() error
+}
+
+// Open returns the sink described by spec.
+// The following forms are supported:
+//
+//   - "stderr" writes entries to the process's standard error.
+//   - "syslog" sends entries to the local syslog daemon.
+//   - "syslog://host:port" sends entries to a remote syslog daemon over UDP.
+//     "syslog+tcp://host:port" uses TCP instead.
+//   - "journald" sends entries to the systemd journal.
+//   - "http://..." or "https://..." sends batches of entries to an HTTP collector
+//     as newline-delimited JSON. See [NewHTTP].
+func Open(spec string, tag string) (Sink, error) {
+	switch spec {
+	case "stderr":
+		return nopCloser{log.New(os.Stderr, tag+": ", log.StdFlags, nil)}, nil
+	case "syslog":
+		return newSyslog("", "", tag)
+	case "journald":
+		return newJournald(tag)
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("open log sink %q: unknown sink", spec)
+	}
+	switch u.Scheme {
+	case "syslog":
+		return newSyslog("udp", u.Host, tag)
+	case "syslog+tcp":
+		return newSyslog("tcp", u.Host, tag)
+	case "syslog+udp":
+		return newSyslog("udp", u.Host, tag)
+	case "http", "https":
+		return NewHTTP(u.String(), nil), nil
+	default:
+		return nil, fmt.Errorf("open log sink %q: unknown scheme %s", spec, u.Scheme)
+	}
+}
+
+// Multi returns a sink that sends each entry to all of the given sinks.
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+func (m multiSink) Log(ctx context.Context, ent log.Entry) {
+	for _, s := range m {
+		if s.LogEnabled(ent) {
+			s.Log(ctx, ent)
+		}
+	}
+}
+
+func (m multiSink) LogEnabled(ent log.Entry) bool {
+	for _, s := range m {
+		if s.LogEnabled(ent) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type nopCloser struct {
+	log.Logger
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// message returns the entry's message without a trailing newline.
+func message(ent log.Entry) string {
+	return strings.TrimSuffix(ent.Msg, "\n")
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package logsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/log"
+)
+
+func TestOpenUnknown(t *testing.T) {
+	for _, spec := range []string{"", "bogus", "ftp://example.com/"} {
+		if s, err := Open(spec, "zb"); err == nil {
+			s.Close()
+			t.Errorf("Open(%q, \"zb\") did not return an error", spec)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var mu sync.Mutex
+	var got []HTTPEntry
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method = %s; want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("Content-Type = %q; want \"application/x-ndjson\"", ct)
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var e HTTPEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Error(err)
+				continue
+			}
+			mu.Lock()
+			got = append(got, e)
+			mu.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	now := time.Date(2024, time.March, 14, 15, 9, 26, 0, time.UTC)
+	s := NewHTTP(srv.URL, srv.Client())
+	s.Log(ctx, log.Entry{Time: now, Level: log.Info, Msg: "Listening\n", File: "main.go", Line: 42})
+	s.Log(ctx, log.Entry{Time: now, Level: log.Error, Msg: "Oh no"})
+	if err := s.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+
+	want := []HTTPEntry{
+		{Time: now, Level: "Info", Msg: "Listening", File: "main.go", Line: 42},
+		{Time: now, Level: "Error", Msg: "Oh no"},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("entries (-want +got):\n%s", diff)
+	}
+}
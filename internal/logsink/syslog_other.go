@@ -0,0 +1,16 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build windows || plan9
+
+package logsink
+
+import "errors"
+
+func newSyslog(network, addr, tag string) (Sink, error) {
+	return nil, errors.New("open syslog: not supported on this platform")
+}
+
+func newJournald(tag string) (Sink, error) {
+	return nil, errors.New("open journald: not supported on this platform")
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !windows && !plan9
+
+package logsink
+
+import (
+	"context"
+	"fmt"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/log"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslog(network, addr, tag string) (Sink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("open syslog: %v", err)
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) Log(ctx context.Context, ent log.Entry) {
+	msg := message(ent)
+	switch {
+	case ent.Level >= log.Error:
+		s.w.Err(msg)
+	case ent.Level >= log.Warn:
+		s.w.Warning(msg)
+	case ent.Level >= log.Info:
+		s.w.Info(msg)
+	default:
+		s.w.Debug(msg)
+	}
+}
+
+func (s syslogSink) LogEnabled(log.Entry) bool {
+	return true
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// journaldSocket is the path of the systemd journal's native protocol socket.
+const journaldSocket = "/run/systemd/journal/socket"
+
+type journaldSink struct {
+	tag string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newJournald(tag string) (Sink, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, fmt.Errorf("open journald: %v", err)
+	}
+	return &journaldSink{tag: tag, conn: conn}, nil
+}
+
+func (s *journaldSink) Log(ctx context.Context, ent log.Entry) {
+	msg := appendJournalField(nil, "MESSAGE", message(ent))
+	msg = appendJournalField(msg, "PRIORITY", fmt.Sprint(journalPriority(ent.Level)))
+	msg = appendJournalField(msg, "SYSLOG_IDENTIFIER", s.tag)
+	if ent.File != "" {
+		msg = appendJournalField(msg, "CODE_FILE", ent.File)
+		msg = appendJournalField(msg, "CODE_LINE", fmt.Sprint(ent.Line))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Write(msg)
+}
+
+func (s *journaldSink) LogEnabled(log.Entry) bool {
+	return true
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
+
+// journalPriority returns the syslog priority for a log level.
+func journalPriority(level log.Level) syslog.Priority {
+	switch {
+	case level >= log.Error:
+		return syslog.LOG_ERR
+	case level >= log.Warn:
+		return syslog.LOG_WARNING
+	case level >= log.Info:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+// appendJournalField appends a field in the journal's native protocol format.
+// Values with newlines use the binary-safe length-prefixed form.
+func appendJournalField(dst []byte, name, value string) []byte {
+	dst = append(dst, name...)
+	if !strings.Contains(value, "\n") {
+		dst = append(dst, '=')
+		dst = append(dst, value...)
+		return append(dst, '\n')
+	}
+	dst = append(dst, '\n')
+	n := uint64(len(value))
+	for i := 0; i < 8; i++ {
+		dst = append(dst, byte(n>>(8*i)))
+	}
+	dst = append(dst, value...)
+	return append(dst, '\n')
+}
@@ -764,6 +764,45 @@ func (l *State) Dump(w io.Writer, strip bool) (int64, error) {
 	return l.state.Dump(w, strip)
 }
 
+// SetMemoryLimit sets the maximum number of bytes that the state may allocate,
+// including memory that has already been allocated.
+// Allocations beyond the limit fail with a memory error
+// (see [IsOutOfMemory]).
+// Zero means no limit (the default).
+// SetMemoryLimit also clears the flag reported by [State.MemoryLimitExceeded].
+func (l *State) SetMemoryLimit(n int64) {
+	l.state.SetMemoryLimit(n)
+}
+
+// MemoryLimitExceeded reports whether an allocation has been refused
+// because of the limit set by [State.SetMemoryLimit]
+// since the limit was last set.
+// The limit applies to all threads in the state.
+func (l *State) MemoryLimitExceeded() bool {
+	return l.state.MemoryLimitExceeded()
+}
+
+// SetInstructionLimit sets the number of virtual machine instructions
+// that Lua code may execute from now on,
+// across all threads in the state.
+// Once the budget is spent, Lua code raises an error
+// on every instruction it executes,
+// so catching the error with pcall does not let it continue.
+// The budget is only checked every thousand instructions,
+// so it may be overrun by that many.
+// Zero means no limit (the default).
+// SetInstructionLimit also clears the flag reported by [State.InstructionLimitExceeded].
+func (l *State) SetInstructionLimit(n int64) {
+	l.state.SetInstructionLimit(n)
+}
+
+// InstructionLimitExceeded reports whether Lua code has exhausted
+// the budget set by [State.SetInstructionLimit]
+// since the limit was last set.
+func (l *State) InstructionLimitExceeded() bool {
+	return l.state.InstructionLimitExceeded()
+}
+
 // GC performs a full garbage-collection cycle.
 //
 // This function should not be called by a Lua finalizer.
@@ -391,3 +391,85 @@ func BenchmarkOpenLibraries(b *testing.B) {
 		}
 	}
 }
+
+func TestMemoryLimit(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	state.SetMemoryLimit(state.GCCount() + 1<<20)
+
+	const source = "local t = {}\nfor i = 1, 1e9 do t[i] = i end\n"
+	if err := state.LoadString(source, source, "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	if !IsOutOfMemory(err) {
+		t.Errorf("state.Call(...) = %v; want memory error", err)
+	}
+	if !state.MemoryLimitExceeded() {
+		t.Error("state.MemoryLimitExceeded() = false after exceeding limit")
+	}
+
+	state.SetMemoryLimit(0)
+	if state.MemoryLimitExceeded() {
+		t.Error("state.MemoryLimitExceeded() = true after resetting limit")
+	}
+	state.SetTop(0)
+	if err := state.LoadString("local t = {}\nfor i = 1, 1e6 do t[i] = i end\n", "", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Error("without limit:", err)
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	state := new(State)
+	defer func() {
+		if err := state.Close(); err != nil {
+			t.Error("Close:", err)
+		}
+	}()
+	state.SetInstructionLimit(100_000)
+
+	const source = "while true do end"
+	if err := state.LoadString(source, source, "t"); err != nil {
+		t.Fatal(err)
+	}
+	err := state.Call(0, 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Errorf("state.Call(...) = %v; want instruction limit error", err)
+	}
+	if !state.InstructionLimitExceeded() {
+		t.Error("state.InstructionLimitExceeded() = false after exceeding limit")
+	}
+
+	// Errors caught with pcall should not allow execution to continue.
+	state.SetTop(0)
+	if err := Require(state, GName, true, NewOpenBase(io.Discard, nil)); err != nil {
+		t.Fatal(err)
+	}
+	state.SetInstructionLimit(100_000)
+	const pcallSource = "while true do pcall(function() while true do end end) end"
+	if err := state.LoadString(pcallSource, pcallSource, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Errorf("loop calling pcall = %v; want instruction limit error", err)
+	}
+
+	state.SetTop(0)
+	state.SetInstructionLimit(0)
+	if state.InstructionLimitExceeded() {
+		t.Error("state.InstructionLimitExceeded() = true after resetting limit")
+	}
+	if err := state.LoadString("for i = 1, 1e6 do end", "", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Call(0, 0, 0); err != nil {
+		t.Error("without limit:", err)
+	}
+}
@@ -179,16 +179,121 @@ import (
 //   return (size_t)lua_rawlen(L, index);
 // }
 //
+// #define STEPHOOKCOUNT 1000
+//
+// struct limits {
+//   size_t memused;
+//   size_t memlimit;
+//   int memexceeded;
+//   int64_t steps;
+//   int steplimited;
+//   int stepsexceeded;
+// };
+//
+// static struct limits *getlimits(lua_State *L) {
+//   void *ud;
+//   lua_getallocf(L, &ud);
+//   return (struct limits *)ud;
+// }
+//
+// static void *limitalloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+//   struct limits *lim = (struct limits *)ud;
+//   size_t old = ptr != NULL ? osize : 0;
+//   if (nsize == 0) {
+//     free(ptr);
+//     lim->memused -= old;
+//     return NULL;
+//   }
+//   // Lua assumes that shrinking a block never fails,
+//   // so only growth is checked against the limit.
+//   if (lim->memlimit != 0 && nsize > old && lim->memused - old + nsize > lim->memlimit) {
+//     lim->memexceeded = 1;
+//     return NULL;
+//   }
+//   void *newptr = realloc(ptr, nsize);
+//   if (newptr != NULL) {
+//     lim->memused = lim->memused - old + nsize;
+//   }
+//   return newptr;
+// }
+//
+// static void stephook(lua_State *L, lua_Debug *ar) {
+//   (void)ar;
+//   struct limits *lim = getlimits(L);
+//   if (!lim->steplimited) {
+//     return;
+//   }
+//   lim->steps -= lua_gethookcount(L);
+//   if (lim->steps >= 0) {
+//     if (lua_gethookcount(L) != STEPHOOKCOUNT) {
+//       lua_sethook(L, stephook, LUA_MASKCOUNT, STEPHOOKCOUNT);
+//     }
+//   } else {
+//     // Raise an error on every instruction from now on
+//     // so that code that catches the error with pcall
+//     // fails as soon as it continues.
+//     lim->stepsexceeded = 1;
+//     lua_sethook(L, stephook, LUA_MASKCOUNT, 1);
+//     luaL_where(L, 0);
+//     lua_pushliteral(L, "instruction limit exceeded");
+//     lua_concat(L, 2);
+//     lua_error(L);
+//   }
+// }
+//
+// static int atpanic(lua_State *L) {
+//   const char *msg = lua_tostring(L, -1);
+//   if (msg == NULL) msg = "error object is not a string";
+//   lua_writestringerror("PANIC: unprotected error in call to Lua API (%s)\n", msg);
+//   return 0;
+// }
+//
 // static lua_State *newstate(uintptr_t id) {
-//   lua_State *L = luaL_newstate();
+//   struct limits *lim = calloc(1, sizeof(struct limits));
+//   if (lim == NULL) {
+//     return NULL;
+//   }
+//   lua_State *L = lua_newstate(limitalloc, lim);
 //   if (L == NULL) {
+//     free(lim);
 //     return NULL;
 //   }
+//   lua_atpanic(L, atpanic);
 //   lua_setwarnf(L, NULL, NULL);
+//   // Threads inherit the hook from the main thread when they are created,
+//   // so the hook is always installed and checks whether a limit is set.
+//   lua_sethook(L, stephook, LUA_MASKCOUNT, STEPHOOKCOUNT);
 //   *(uintptr_t *)(lua_getextraspace(L)) = id;
 //   return L;
 // }
 //
+// static void closestate(lua_State *L) {
+//   struct limits *lim = getlimits(L);
+//   lua_close(L);
+//   free(lim);
+// }
+//
+// static void setmemorylimit(lua_State *L, size_t n) {
+//   struct limits *lim = getlimits(L);
+//   lim->memlimit = n;
+//   lim->memexceeded = 0;
+// }
+//
+// static void setsteplimit(lua_State *L, int64_t n) {
+//   struct limits *lim = getlimits(L);
+//   lim->steps = n;
+//   lim->steplimited = n > 0;
+//   lim->stepsexceeded = 0;
+// }
+//
+// static int memoryexceeded(lua_State *L) {
+//   return getlimits(L)->memexceeded;
+// }
+//
+// static int stepsexceeded(lua_State *L) {
+//   return getlimits(L)->stepsexceeded;
+// }
+//
 // static uintptr_t stateid(lua_State *L) {
 //   return *(uintptr_t *)(lua_getextraspace(L));
 // }
@@ -307,7 +412,8 @@ func (l *State) init() {
 			closures: make(map[uint64]Function),
 		})
 		l.ptr = C.newstate(C.uintptr_t(data))
-		if l == nil {
+		if l.ptr == nil {
+			data.Delete()
 			panic("could not allocate memory for new state")
 		}
 		l.top = 0
@@ -322,7 +428,7 @@ func (l *State) Close() error {
 			return errors.New("lua: cannot close non-main thread")
 		}
 		data := cgo.Handle(C.stateid(l.ptr))
-		C.lua_close(l.ptr)
+		C.closestate(l.ptr)
 		data.Delete()
 		*l = State{}
 	}
@@ -1182,6 +1288,32 @@ func (l *State) Dump(w io.Writer, strip bool) (int64, error) {
 	return state.n, err
 }
 
+func (l *State) SetMemoryLimit(n int64) {
+	if n < 0 {
+		panic("negative memory limit")
+	}
+	l.init()
+	C.setmemorylimit(l.ptr, C.size_t(n))
+}
+
+func (l *State) MemoryLimitExceeded() bool {
+	l.init()
+	return C.memoryexceeded(l.ptr) != 0
+}
+
+func (l *State) SetInstructionLimit(n int64) {
+	if n < 0 {
+		panic("negative instruction limit")
+	}
+	l.init()
+	C.setsteplimit(l.ptr, C.int64_t(n))
+}
+
+func (l *State) InstructionLimitExceeded() bool {
+	l.init()
+	return C.stepsexceeded(l.ptr) != 0
+}
+
 func (l *State) GC() {
 	l.init()
 	C.gcniladic(l.ptr, C.LUA_GCCOLLECT)
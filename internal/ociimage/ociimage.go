@@ -0,0 +1,348 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package ociimage writes container images
+// in the OCI image layout format (as a tar archive)
+// from files on the local file system.
+// The output can be loaded with tools like "docker load" or "podman load".
+package ociimage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Media types used in the image.
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// An Image describes a container image to write.
+type Image struct {
+	// RefName is the image's reference name (like "hello:latest").
+	// It is recorded as the "org.opencontainers.image.ref.name" annotation.
+	RefName string
+
+	// OS and Architecture are the platform the image runs on,
+	// using Go's GOOS and GOARCH values.
+	// Variant is the optional CPU variant (like "v7" for arm).
+	OS           string
+	Architecture string
+	Variant      string
+
+	Entrypoint []string
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+
+	// Layers is the list of layers from bottom to top.
+	// Each layer is a list of absolute paths on the local file system
+	// that are copied into the image at the same location, recursively.
+	// Parent directories are created as needed.
+	Layers [][]string
+}
+
+// Write writes the image to w as a tar archive in the OCI image layout format.
+// The output is deterministic: file times and ownership are normalized.
+func Write(w io.Writer, img *Image) error {
+	tw := tar.NewWriter(w)
+	if err := writeFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	// Layers are buffered in temporary files
+	// because their digest must be known before the manifest is written
+	// and the tar header needs their size.
+	layerDescs := make([]descriptor, 0, len(img.Layers))
+	diffIDs := make([]string, 0, len(img.Layers))
+	for i, paths := range img.Layers {
+		desc, err := writeLayerBlob(tw, paths)
+		if err != nil {
+			return fmt.Errorf("write image layer %d: %v", i+1, err)
+		}
+		layerDescs = append(layerDescs, desc)
+		// Layers are uncompressed, so the diff ID is the layer digest.
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+
+	cfg := &imageConfig{
+		Architecture: img.Architecture,
+		OS:           img.OS,
+		Variant:      img.Variant,
+		Config: containerConfig{
+			Entrypoint: img.Entrypoint,
+			Cmd:        img.Cmd,
+			Env:        img.Env,
+			WorkingDir: img.WorkingDir,
+		},
+		RootFS: rootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	cfgDesc, err := writeJSONBlob(tw, MediaTypeConfig, cfg)
+	if err != nil {
+		return fmt.Errorf("write image config: %v", err)
+	}
+	manifestDesc, err := writeJSONBlob(tw, MediaTypeManifest, &manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        cfgDesc,
+		Layers:        layerDescs,
+	})
+	if err != nil {
+		return fmt.Errorf("write image manifest: %v", err)
+	}
+	if img.RefName != "" {
+		manifestDesc.Annotations = map[string]string{
+			"org.opencontainers.image.ref.name": img.RefName,
+		}
+	}
+	indexData, err := json.Marshal(&index{
+		SchemaVersion: 2,
+		Manifests:     []descriptor{manifestDesc},
+	})
+	if err != nil {
+		return fmt.Errorf("write image index: %v", err)
+	}
+	if err := writeFile(tw, "index.json", indexData); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type imageConfig struct {
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       containerConfig `json:"config"`
+	RootFS       rootFS          `json:"rootfs"`
+}
+
+type containerConfig struct {
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+type rootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// epoch is the modification time given to every file in the image.
+var epoch = time.Unix(1, 0).UTC()
+
+func writeFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o644,
+		ModTime:  epoch,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o755,
+		ModTime:  epoch,
+		Format:   tar.FormatPAX,
+	})
+}
+
+func writeJSONBlob(tw *tar.Writer, mediaType string, v any) (descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return descriptor{}, err
+	}
+	sum := sha256.Sum256(data)
+	desc := descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+	if err := writeFile(tw, blobName(desc.Digest), data); err != nil {
+		return descriptor{}, err
+	}
+	return desc, nil
+}
+
+func blobName(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// writeLayerBlob writes a layer containing the given paths as a blob.
+func writeLayerBlob(tw *tar.Writer, paths []string) (descriptor, error) {
+	f, err := os.CreateTemp("", "zb-oci-layer-*.tar")
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	if err := writeLayer(io.MultiWriter(f, h), paths); err != nil {
+		return descriptor{}, err
+	}
+	desc := descriptor{
+		MediaType: MediaTypeLayer,
+		Digest:    digestOf(h),
+	}
+	desc.Size, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return descriptor{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return descriptor{}, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     blobName(desc.Digest),
+		Size:     desc.Size,
+		Mode:     0o644,
+		ModTime:  epoch,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return descriptor{}, err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return descriptor{}, err
+	}
+	return desc, nil
+}
+
+func digestOf(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// writeLayer writes a tar archive of the given paths to w.
+func writeLayer(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	paths = slices.Clone(paths)
+	slices.Sort(paths)
+	dirs := make(map[string]struct{})
+	for _, root := range paths {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("%s is not absolute", root)
+		}
+		// Create parent directories.
+		var parents []string
+		for dir := filepath.Dir(root); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			parents = append(parents, dir)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			name := layerName(parents[i])
+			if _, done := dirs[name]; done {
+				continue
+			}
+			if err := writeDir(tw, name); err != nil {
+				return err
+			}
+			dirs[name] = struct{}{}
+		}
+
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return addLayerEntry(tw, path, entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addLayerEntry(tw *tar.Writer, path string, entry fs.DirEntry) error {
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    layerName(path),
+		ModTime: epoch,
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case info.Mode().IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		hdr.Mode = 0o555
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+		hdr.Mode = 0o444
+		if info.Mode()&0o111 != 0 {
+			hdr.Mode = 0o555
+		}
+	case info.Mode()&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Mode = 0o777
+		hdr.Linkname, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: unsupported file type %v", path, info.Mode().Type())
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// layerName returns the name of a file in a layer archive.
+func layerName(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package ociimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWrite(t *testing.T) {
+	root := t.TempDir()
+	hello := filepath.Join(root, "store", "aaa-hello")
+	lib := filepath.Join(root, "store", "bbb-lib")
+	if err := os.MkdirAll(filepath.Join(hello, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hello, "bin", "hello"), []byte("#!/bin/sh\necho hi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib, []byte("library\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(lib, filepath.Join(hello, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	img := &Image{
+		RefName:      "hello:latest",
+		OS:           "linux",
+		Architecture: "amd64",
+		Entrypoint:   []string{filepath.Join(hello, "bin", "hello")},
+		Layers:       [][]string{{lib}, {hello}},
+	}
+	buf := new(bytes.Buffer)
+	if err := Write(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	files := readTar(t, buf.Bytes())
+
+	// Every blob's name must match its content.
+	for name, data := range files {
+		hexDigest, ok := strings.CutPrefix(name, "blobs/sha256/")
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != hexDigest {
+			t.Errorf("%s has digest %s", name, got)
+		}
+	}
+
+	var idx index
+	if err := json.Unmarshal(files["index.json"], &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("index has %d manifests; want 1", len(idx.Manifests))
+	}
+	if got := idx.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; got != img.RefName {
+		t.Errorf("ref name = %q; want %q", got, img.RefName)
+	}
+	var m manifest
+	if err := json.Unmarshal(files[blobName(idx.Manifests[0].Digest)], &m); err != nil {
+		t.Fatal(err)
+	}
+	var cfg imageConfig
+	if err := json.Unmarshal(files[blobName(m.Config.Digest)], &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(img.Entrypoint, cfg.Config.Entrypoint); diff != "" {
+		t.Errorf("entrypoint (-want +got):\n%s", diff)
+	}
+	if len(m.Layers) != 2 || len(cfg.RootFS.DiffIDs) != 2 {
+		t.Fatalf("image has %d layers and %d diff IDs; want 2", len(m.Layers), len(cfg.RootFS.DiffIDs))
+	}
+
+	layerNames := func(digest string) []string {
+		var names []string
+		for name := range readTar(t, files[blobName(digest)]) {
+			names = append(names, name)
+		}
+		return names
+	}
+	rel := func(path string) string { return layerName(path) }
+	wantTop := []string{rel(hello) + "/", rel(hello) + "/bin/", rel(hello) + "/bin/hello", rel(hello) + "/lib"}
+	gotTop := layerNames(m.Layers[1].Digest)
+	for _, name := range wantTop {
+		if !slices.Contains(gotTop, name) {
+			t.Errorf("top layer missing %s (has %q)", name, gotTop)
+		}
+	}
+	if gotBottom := layerNames(m.Layers[0].Digest); !slices.Contains(gotBottom, rel(lib)) || slices.Contains(gotBottom, rel(hello)+"/") {
+		t.Errorf("bottom layer = %q; want only %s and its parents", gotBottom, rel(lib))
+	}
+
+	// Output is deterministic.
+	buf2 := new(bytes.Buffer)
+	if err := Write(buf2, img); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+		t.Error("writing the same image twice produced different output")
+	}
+}
+
+// readTar returns the contents of each entry in a tar archive.
+func readTar(tb testing.TB, data []byte) map[string][]byte {
+	tb.Helper()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		files[hdr.Name] = content
+	}
+}
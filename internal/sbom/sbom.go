@@ -0,0 +1,328 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package sbom writes software bills of materials
+// in the SPDX and CycloneDX JSON formats.
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+)
+
+// A Document is a bill of materials for a single root component
+// and everything it depends on.
+type Document struct {
+	// Name is the name of the document, usually the root component's name.
+	Name    string
+	Created time.Time
+	// Root is the ID of the component the document describes.
+	Root       string
+	Components []*Component
+}
+
+// A Component is a single piece of software in a [Document].
+type Component struct {
+	// ID uniquely identifies the component within the document.
+	// zb uses the component's store path.
+	ID          string
+	Name        string
+	Version     string
+	Description string
+	Homepage    string
+	// License is an SPDX license expression.
+	License string
+	// Hash is the hash of the component's contents.
+	Hash nix.Hash
+	// Sources are the locations the component was built from.
+	Sources []Source
+	// DependsOn is the list of IDs of components this component requires at runtime.
+	DependsOn []string
+}
+
+// A Source is a downloaded input of a component.
+type Source struct {
+	URL  string
+	Hash nix.Hash
+}
+
+const noAssertion = "NOASSERTION"
+
+// WriteSPDX writes doc to w as an SPDX 2.3 JSON document.
+func WriteSPDX(w io.Writer, doc *Document) error {
+	type checksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+	type externalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		Description      string        `json:"description,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		Homepage         string        `json:"homepage,omitempty"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		CopyrightText    string        `json:"copyrightText"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		Checksums        []checksum    `json:"checksums,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+	}
+	type relationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+	type creationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	type document struct {
+		SPDXVersion       string         `json:"spdxVersion"`
+		DataLicense       string         `json:"dataLicense"`
+		SPDXID            string         `json:"SPDXID"`
+		Name              string         `json:"name"`
+		DocumentNamespace string         `json:"documentNamespace"`
+		CreationInfo      creationInfo   `json:"creationInfo"`
+		Packages          []pkg          `json:"packages"`
+		Relationships     []relationship `json:"relationships"`
+	}
+
+	ids := make(map[string]string, len(doc.Components))
+	for i, c := range doc.Components {
+		ids[c.ID] = fmt.Sprintf("SPDXRef-Package-%d", i+1)
+	}
+	out := &document{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.Name,
+		DocumentNamespace: "urn:zb:spdx:" + doc.contentID(),
+		CreationInfo: creationInfo{
+			Created:  doc.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: zb"},
+		},
+		Packages: []pkg{},
+	}
+	if rootID, ok := ids[doc.Root]; ok {
+		out.Relationships = append(out.Relationships, relationship{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: rootID,
+		})
+	}
+	for _, c := range doc.Components {
+		p := pkg{
+			SPDXID:           ids[c.ID],
+			Name:             c.Name,
+			VersionInfo:      c.Version,
+			Description:      c.Description,
+			DownloadLocation: noAssertion,
+			Homepage:         c.Homepage,
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+		}
+		if c.License != "" {
+			p.LicenseDeclared = c.License
+		}
+		if len(c.Sources) > 0 {
+			p.DownloadLocation = c.Sources[0].URL
+		}
+		if alg, ok := spdxAlgorithm(c.Hash.Type()); ok {
+			p.Checksums = append(p.Checksums, checksum{alg, c.Hash.RawBase16()})
+		}
+		p.ExternalRefs = append(p.ExternalRefs, externalRef{
+			ReferenceCategory: "OTHER",
+			ReferenceType:     "nix-store-path",
+			ReferenceLocator:  c.ID,
+		})
+		out.Packages = append(out.Packages, p)
+		for _, dep := range c.DependsOn {
+			if depID, ok := ids[dep]; ok {
+				out.Relationships = append(out.Relationships, relationship{
+					SPDXElementID:      ids[c.ID],
+					RelationshipType:   "DEPENDS_ON",
+					RelatedSPDXElement: depID,
+				})
+			}
+		}
+	}
+	return writeJSON(w, out)
+}
+
+func spdxAlgorithm(typ nix.HashType) (string, bool) {
+	switch typ {
+	case nix.MD5:
+		return "MD5", true
+	case nix.SHA1:
+		return "SHA1", true
+	case nix.SHA256:
+		return "SHA256", true
+	case nix.SHA512:
+		return "SHA512", true
+	default:
+		return "", false
+	}
+}
+
+// WriteCycloneDX writes doc to w as a CycloneDX 1.5 JSON document.
+func WriteCycloneDX(w io.Writer, doc *Document) error {
+	type hash struct {
+		Alg     string `json:"alg"`
+		Content string `json:"content"`
+	}
+	type license struct {
+		Expression string `json:"expression"`
+	}
+	type externalReference struct {
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Hashes []hash `json:"hashes,omitempty"`
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type               string              `json:"type"`
+		BOMRef             string              `json:"bom-ref"`
+		Name               string              `json:"name"`
+		Version            string              `json:"version,omitempty"`
+		Description        string              `json:"description,omitempty"`
+		Hashes             []hash              `json:"hashes,omitempty"`
+		Licenses           []license           `json:"licenses,omitempty"`
+		ExternalReferences []externalReference `json:"externalReferences,omitempty"`
+		Properties         []property          `json:"properties,omitempty"`
+	}
+	type tool struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	type tools struct {
+		Components []tool `json:"components"`
+	}
+	type metadata struct {
+		Timestamp string     `json:"timestamp"`
+		Tools     tools      `json:"tools"`
+		Component *component `json:"component,omitempty"`
+	}
+	type dependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn"`
+	}
+	type document struct {
+		BOMFormat    string       `json:"bomFormat"`
+		SpecVersion  string       `json:"specVersion"`
+		SerialNumber string       `json:"serialNumber"`
+		Version      int          `json:"version"`
+		Metadata     metadata     `json:"metadata"`
+		Components   []component  `json:"components"`
+		Dependencies []dependency `json:"dependencies"`
+	}
+
+	out := &document{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + doc.contentUUID(),
+		Version:      1,
+		Metadata: metadata{
+			Timestamp: doc.Created.UTC().Format(time.RFC3339),
+			Tools:     tools{Components: []tool{{Type: "application", Name: "zb"}}},
+		},
+		Components:   []component{},
+		Dependencies: []dependency{},
+	}
+	for _, c := range doc.Components {
+		cc := component{
+			Type:        "library",
+			BOMRef:      c.ID,
+			Name:        c.Name,
+			Version:     c.Version,
+			Description: c.Description,
+			Properties:  []property{{Name: "zb:storePath", Value: c.ID}},
+		}
+		if alg, ok := cycloneDXAlgorithm(c.Hash.Type()); ok {
+			cc.Hashes = append(cc.Hashes, hash{alg, c.Hash.RawBase16()})
+		}
+		if c.License != "" {
+			cc.Licenses = append(cc.Licenses, license{Expression: c.License})
+		}
+		if c.Homepage != "" {
+			cc.ExternalReferences = append(cc.ExternalReferences, externalReference{Type: "website", URL: c.Homepage})
+		}
+		for _, src := range c.Sources {
+			ref := externalReference{Type: "distribution", URL: src.URL}
+			if alg, ok := cycloneDXAlgorithm(src.Hash.Type()); ok {
+				ref.Hashes = append(ref.Hashes, hash{alg, src.Hash.RawBase16()})
+			}
+			cc.ExternalReferences = append(cc.ExternalReferences, ref)
+		}
+		if c.ID == doc.Root {
+			cc.Type = "application"
+			out.Metadata.Component = &cc
+		} else {
+			out.Components = append(out.Components, cc)
+		}
+		deps := c.DependsOn
+		if deps == nil {
+			deps = []string{}
+		}
+		out.Dependencies = append(out.Dependencies, dependency{Ref: c.ID, DependsOn: deps})
+	}
+	return writeJSON(w, out)
+}
+
+func cycloneDXAlgorithm(typ nix.HashType) (string, bool) {
+	switch typ {
+	case nix.MD5:
+		return "MD5", true
+	case nix.SHA1:
+		return "SHA-1", true
+	case nix.SHA256:
+		return "SHA-256", true
+	case nix.SHA512:
+		return "SHA-512", true
+	default:
+		return "", false
+	}
+}
+
+// contentID returns a hex string that identifies the document's components,
+// so that the same closure always produces the same document identifiers.
+func (doc *Document) contentID() string {
+	h := sha256.New()
+	io.WriteString(h, doc.Root)
+	for _, c := range doc.Components {
+		io.WriteString(h, "\x00"+c.ID)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// contentUUID formats the first 16 bytes of [Document.contentID] as a version 8 UUID.
+func (doc *Document) contentUUID() string {
+	b, _ := hex.DecodeString(doc.contentID()[:32])
+	b[6] = b[6]&0x0f | 0x80
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b)
+	return strings.Join([]string{s[:8], s[8:12], s[12:16], s[16:20], s[20:]}, "-")
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
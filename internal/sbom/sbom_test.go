@@ -0,0 +1,156 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+const (
+	testHelloPath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-2.12.1"
+	testGlibcPath = "/nix/store/00000000000000000000000000000000-glibc-2.38"
+)
+
+func testDocument(tb testing.TB) *Document {
+	tb.Helper()
+	h, err := nix.ParseHash("sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Document{
+		Name:    "hello-2.12.1",
+		Created: time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC),
+		Root:    testHelloPath,
+		Components: []*Component{
+			{
+				ID:        testHelloPath,
+				Name:      "hello",
+				Version:   "2.12.1",
+				Homepage:  "https://www.gnu.org/software/hello/",
+				License:   "GPL-3.0-or-later",
+				Hash:      h,
+				Sources:   []Source{{URL: "https://ftp.gnu.org/gnu/hello/hello-2.12.1.tar.gz", Hash: h}},
+				DependsOn: []string{testGlibcPath},
+			},
+			{
+				ID:      testGlibcPath,
+				Name:    "glibc",
+				Version: "2.38",
+				Hash:    h,
+			},
+		},
+	}
+}
+
+func TestWriteSPDX(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := WriteSPDX(buf, testDocument(t)); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		SPDXVersion string
+		Packages    []struct {
+			SPDXID           string
+			Name             string
+			VersionInfo      string
+			DownloadLocation string
+			LicenseDeclared  string
+		}
+		Relationships []struct {
+			SPDXElementID      string `json:"spdxElementId"`
+			RelationshipType   string
+			RelatedSPDXElement string `json:"relatedSpdxElement"`
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.SPDXVersion != "SPDX-2.3" {
+		t.Errorf("spdxVersion = %q; want SPDX-2.3", got.SPDXVersion)
+	}
+	if len(got.Packages) != 2 {
+		t.Fatalf("%d packages; want 2", len(got.Packages))
+	}
+	hello, glibc := got.Packages[0], got.Packages[1]
+	if hello.Name != "hello" || hello.VersionInfo != "2.12.1" || hello.LicenseDeclared != "GPL-3.0-or-later" ||
+		hello.DownloadLocation != "https://ftp.gnu.org/gnu/hello/hello-2.12.1.tar.gz" {
+		t.Errorf("hello package = %+v", hello)
+	}
+	if glibc.LicenseDeclared != "NOASSERTION" || glibc.DownloadLocation != "NOASSERTION" {
+		t.Errorf("glibc package = %+v; want NOASSERTION for unknown fields", glibc)
+	}
+	type rel struct{ from, typ, to string }
+	var gotRels []rel
+	for _, r := range got.Relationships {
+		gotRels = append(gotRels, rel{r.SPDXElementID, r.RelationshipType, r.RelatedSPDXElement})
+	}
+	wantRels := []rel{
+		{"SPDXRef-DOCUMENT", "DESCRIBES", hello.SPDXID},
+		{hello.SPDXID, "DEPENDS_ON", glibc.SPDXID},
+	}
+	if diff := cmp.Diff(wantRels, gotRels, cmp.AllowUnexported(rel{})); diff != "" {
+		t.Errorf("relationships (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteCycloneDX(t *testing.T) {
+	doc := testDocument(t)
+	buf := new(bytes.Buffer)
+	if err := WriteCycloneDX(buf, doc); err != nil {
+		t.Fatal(err)
+	}
+	type component struct {
+		BOMRef   string `json:"bom-ref"`
+		Name     string
+		Licenses []struct{ Expression string }
+	}
+	var got struct {
+		BOMFormat    string
+		SerialNumber string
+		Metadata     struct{ Component component }
+		Components   []component
+		Dependencies []struct {
+			Ref       string
+			DependsOn []string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BOMFormat != "CycloneDX" {
+		t.Errorf("bomFormat = %q; want CycloneDX", got.BOMFormat)
+	}
+	if got.Metadata.Component.BOMRef != testHelloPath {
+		t.Errorf("metadata.component.bom-ref = %q; want %q", got.Metadata.Component.BOMRef, testHelloPath)
+	}
+	if len(got.Metadata.Component.Licenses) != 1 || got.Metadata.Component.Licenses[0].Expression != "GPL-3.0-or-later" {
+		t.Errorf("metadata.component.licenses = %+v", got.Metadata.Component.Licenses)
+	}
+	if len(got.Components) != 1 || got.Components[0].BOMRef != testGlibcPath {
+		t.Errorf("components = %+v; want only glibc", got.Components)
+	}
+	if len(got.Dependencies) != 2 || !cmp.Equal(got.Dependencies[0].DependsOn, []string{testGlibcPath}) {
+		t.Errorf("dependencies = %+v", got.Dependencies)
+	}
+
+	// Serial numbers are stable for the same closure.
+	buf2 := new(bytes.Buffer)
+	doc.Created = doc.Created.Add(time.Hour)
+	if err := WriteCycloneDX(buf2, doc); err != nil {
+		t.Fatal(err)
+	}
+	var got2 struct{ SerialNumber string }
+	if err := json.Unmarshal(buf2.Bytes(), &got2); err != nil {
+		t.Fatal(err)
+	}
+	if got.SerialNumber != got2.SerialNumber {
+		t.Errorf("serial numbers differ: %q vs %q", got.SerialNumber, got2.SerialNumber)
+	}
+}
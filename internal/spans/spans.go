@@ -0,0 +1,20 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package spans provides helpers for OpenTelemetry trace spans
+// shared by zb's packages.
+package spans
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// End ends span, marking it as failed if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
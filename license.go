@@ -0,0 +1,246 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// A LicensePolicy restricts the licenses of the derivations
+// that an evaluation may produce.
+// Licenses are given as SPDX license identifiers
+// and compared case-insensitively.
+// A derivation is checked against the policy
+// using the license in its meta argument (or its license attribute),
+// and the evaluation fails if a result depends on a derivation
+// whose license the policy does not permit.
+// Derivations without a license are always permitted.
+type LicensePolicy struct {
+	// Allow is the list of permitted licenses.
+	// If empty, all licenses not listed in Deny are permitted.
+	Allow []string
+	// Deny is the list of forbidden licenses.
+	// Deny takes precedence over Allow.
+	Deny []string
+}
+
+// Check returns an error if the policy does not permit the given
+// SPDX license expression.
+// An expression with OR is permitted if any of its alternatives is permitted;
+// an expression with AND is permitted only if all of its parts are.
+// License exceptions (WITH) are not considered.
+func (policy *LicensePolicy) Check(expr string) error {
+	if policy == nil || strings.TrimSpace(expr) == "" {
+		return nil
+	}
+	p := &licenseParser{tokens: tokenizeLicense(expr)}
+	denied, err := p.or(policy)
+	if err != nil {
+		return fmt.Errorf("license %q: %v", expr, err)
+	}
+	if len(p.tokens) > 0 {
+		return fmt.Errorf("license %q: unexpected %q", expr, p.tokens[0])
+	}
+	if denied != "" {
+		if denied == expr {
+			return fmt.Errorf("license %s is not permitted", expr)
+		}
+		return fmt.Errorf("license %q is not permitted (%s)", expr, denied)
+	}
+	return nil
+}
+
+func (policy *LicensePolicy) permits(id string) bool {
+	id = strings.TrimSuffix(id, "+")
+	match := func(x string) bool {
+		return strings.EqualFold(strings.TrimSuffix(x, "+"), id)
+	}
+	if slices.ContainsFunc(policy.Deny, match) {
+		return false
+	}
+	return len(policy.Allow) == 0 || slices.ContainsFunc(policy.Allow, match)
+}
+
+func tokenizeLicense(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+// licenseParser evaluates an SPDX license expression against a policy.
+// Each method returns the first license that the policy does not permit
+// (or the empty string if the expression is permitted).
+type licenseParser struct {
+	tokens []string
+}
+
+func (p *licenseParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *licenseParser) next() string {
+	tok := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *licenseParser) or(policy *LicensePolicy) (denied string, err error) {
+	denied, err = p.and(policy)
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		d, err := p.and(policy)
+		if err != nil {
+			return "", err
+		}
+		if d == "" {
+			denied = ""
+		}
+	}
+	return denied, nil
+}
+
+func (p *licenseParser) and(policy *LicensePolicy) (denied string, err error) {
+	denied, err = p.with(policy)
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		d, err := p.with(policy)
+		if err != nil {
+			return "", err
+		}
+		if denied == "" {
+			denied = d
+		}
+	}
+	return denied, nil
+}
+
+func (p *licenseParser) with(policy *LicensePolicy) (denied string, err error) {
+	denied, err = p.primary(policy)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(p.peek(), "WITH") {
+		p.next()
+		if exception := p.next(); exception == "" || exception == "(" || exception == ")" {
+			return "", fmt.Errorf("missing exception after WITH")
+		}
+	}
+	return denied, nil
+}
+
+func (p *licenseParser) primary(policy *LicensePolicy) (denied string, err error) {
+	switch tok := p.next(); {
+	case tok == "":
+		return "", fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		denied, err = p.or(policy)
+		if err != nil {
+			return "", err
+		}
+		if p.next() != ")" {
+			return "", fmt.Errorf("missing ')'")
+		}
+		return denied, nil
+	case tok == ")" || strings.EqualFold(tok, "AND") || strings.EqualFold(tok, "OR") || strings.EqualFold(tok, "WITH"):
+		return "", fmt.Errorf("unexpected %q", tok)
+	default:
+		if !policy.permits(tok) {
+			return tok, nil
+		}
+		return "", nil
+	}
+}
+
+// licenseViolation is a dependency on a derivation
+// whose license is not permitted by a [LicensePolicy].
+type licenseViolation struct {
+	// chain is the names of the derivations from the dependent derivation
+	// to the offending one.
+	chain []string
+	err   error
+}
+
+func (v *licenseViolation) Error() string {
+	if len(v.chain) == 1 {
+		return fmt.Sprintf("%s: %v", v.chain[0], v.err)
+	}
+	return fmt.Sprintf("%s depends on %s: %v (%s)",
+		v.chain[0], v.chain[len(v.chain)-1], v.err, strings.Join(v.chain, " -> "))
+}
+
+// SetLicensePolicy sets the policy that derivations produced by evaluation must satisfy.
+// A nil policy permits all licenses.
+func (eval *Eval) SetLicensePolicy(policy *LicensePolicy) {
+	eval.licensePolicy = policy
+}
+
+// recordLicense notes whether drv (located at drvPath) or its dependencies
+// violate the evaluator's license policy.
+func (eval *Eval) recordLicense(drvPath nix.StorePath, drv *Derivation) {
+	if eval.licensePolicy == nil {
+		return
+	}
+	license := drv.Env["license"]
+	if drv.Meta != nil && drv.Meta.License != "" {
+		license = drv.Meta.License
+	}
+	if err := eval.licensePolicy.Check(license); err != nil {
+		eval.licenseViolations[drvPath] = &licenseViolation{
+			chain: []string{drv.Name},
+			err:   err,
+		}
+		return
+	}
+	for _, input := range sortedKeys(drv.InputDerivations) {
+		if v := eval.licenseViolations[input]; v != nil {
+			eval.licenseViolations[drvPath] = &licenseViolation{
+				chain: append([]string{drv.Name}, v.chain...),
+				err:   v.err,
+			}
+			return
+		}
+	}
+}
+
+// checkLicenses returns an error if any of the derivations in the evaluation result x
+// depend on a derivation whose license is not permitted.
+func (eval *Eval) checkLicenses(x any) error {
+	switch x := x.(type) {
+	case *Derivation:
+		p, err := x.StorePath()
+		if err != nil {
+			return err
+		}
+		if v := eval.licenseViolations[p]; v != nil {
+			return v
+		}
+	case []any:
+		for _, elem := range x {
+			if err := eval.checkLicenses(elem); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, k := range sortedKeys(x) {
+			if err := eval.checkLicenses(x[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
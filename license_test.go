@@ -0,0 +1,87 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestLicensePolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *LicensePolicy
+		expr    string
+		wantErr bool
+	}{
+		{name: "NilPolicy", expr: "GPL-3.0-only"},
+		{name: "Empty", policy: &LicensePolicy{Deny: []string{"GPL-3.0-only"}}, expr: ""},
+		{name: "Denied", policy: &LicensePolicy{Deny: []string{"GPL-3.0-only"}}, expr: "GPL-3.0-only", wantErr: true},
+		{name: "DeniedCase", policy: &LicensePolicy{Deny: []string{"gpl-3.0-only"}}, expr: "GPL-3.0-only", wantErr: true},
+		{name: "NotDenied", policy: &LicensePolicy{Deny: []string{"GPL-3.0-only"}}, expr: "MIT"},
+		{name: "Allowed", policy: &LicensePolicy{Allow: []string{"MIT", "Apache-2.0"}}, expr: "MIT"},
+		{name: "NotAllowed", policy: &LicensePolicy{Allow: []string{"MIT"}}, expr: "BSD-3-Clause", wantErr: true},
+		{name: "DenyBeatsAllow", policy: &LicensePolicy{Allow: []string{"MIT"}, Deny: []string{"MIT"}}, expr: "MIT", wantErr: true},
+		{name: "OrOneAllowed", policy: &LicensePolicy{Deny: []string{"GPL-2.0-only"}}, expr: "GPL-2.0-only OR MIT"},
+		{name: "OrNoneAllowed", policy: &LicensePolicy{Allow: []string{"MIT"}}, expr: "GPL-2.0-only OR BSD-3-Clause", wantErr: true},
+		{name: "AndOneDenied", policy: &LicensePolicy{Deny: []string{"GPL-2.0-only"}}, expr: "GPL-2.0-only AND MIT", wantErr: true},
+		{name: "AndAllowed", policy: &LicensePolicy{Allow: []string{"MIT", "Zlib"}}, expr: "MIT AND Zlib"},
+		{name: "Precedence", policy: &LicensePolicy{Deny: []string{"GPL-2.0-only"}}, expr: "MIT OR GPL-2.0-only AND Zlib"},
+		{name: "Parentheses", policy: &LicensePolicy{Deny: []string{"GPL-2.0-only"}}, expr: "(MIT OR GPL-2.0-only) AND Zlib"},
+		{name: "ParenthesesDenied", policy: &LicensePolicy{Deny: []string{"GPL-2.0-only"}}, expr: "(GPL-2.0-only OR GPL-2.0-only) AND Zlib", wantErr: true},
+		{name: "With", policy: &LicensePolicy{Allow: []string{"GPL-2.0-or-later"}}, expr: "GPL-2.0-or-later WITH Classpath-exception-2.0"},
+		{name: "Plus", policy: &LicensePolicy{Deny: []string{"LGPL-2.1"}}, expr: "LGPL-2.1+", wantErr: true},
+		{name: "Malformed", policy: &LicensePolicy{}, expr: "MIT AND", wantErr: true},
+		{name: "Unbalanced", policy: &LicensePolicy{}, expr: "(MIT", wantErr: true},
+		{name: "Trailing", policy: &LicensePolicy{}, expr: "MIT Zlib", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Check(test.expr)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("Check(%q) = %v; want error = %t", test.expr, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLicensePolicyEval(t *testing.T) {
+	installFakeNixStore(t)
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	eval.SetLicensePolicy(&LicensePolicy{Deny: []string{"GPL-3.0-only"}})
+
+	const expr = `
+local function drv(name, license, deps)
+  return derivation {
+    name = name;
+    system = "x86_64-linux";
+    builder = "/bin/sh";
+    deps = deps or {};
+    meta = { license = license };
+  }
+end
+local libfoo = drv("libfoo", "GPL-3.0-only")
+local libbar = drv("libbar", "MIT", { libfoo })
+local app = drv("app", "MIT", { libbar })
+local other = drv("other", "MIT")
+return { app = app; other = other; libbar = libbar }
+`
+	if _, err := eval.Expression(expr, []string{"other"}); err != nil {
+		t.Errorf("evaluating permitted derivation: %v", err)
+	}
+	_, err := eval.Expression(expr, []string{"app"})
+	if err == nil {
+		t.Fatal("evaluating app did not return an error")
+	}
+	const wantChain = "app -> libbar -> libfoo"
+	if got := err.Error(); !strings.Contains(got, wantChain) || !strings.Contains(got, "GPL-3.0-only") {
+		t.Errorf("error = %q; want it to mention %q and the license", got, wantChain)
+	}
+	if _, err := eval.Expression(expr, nil); err == nil {
+		t.Error("evaluating table containing app did not return an error")
+	}
+}
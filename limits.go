@@ -0,0 +1,53 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+)
+
+// SetMemoryLimit sets the maximum number of bytes
+// that the evaluator's Lua interpreter may have allocated at once.
+// Zero means no limit (the default).
+func (eval *Eval) SetMemoryLimit(n int64) {
+	eval.memoryLimit = n
+	eval.l.SetMemoryLimit(n)
+}
+
+// SetInstructionLimit sets the maximum number of Lua virtual machine instructions
+// that each call to [Eval.File] or [Eval.Expression] may execute.
+// Zero means no limit (the default).
+func (eval *Eval) SetInstructionLimit(n int64) {
+	eval.instructionLimit = n
+}
+
+// resetLimits starts a new evaluation's instruction budget.
+func (eval *Eval) resetLimits() {
+	eval.l.SetMemoryLimit(eval.memoryLimit)
+	eval.l.SetInstructionLimit(eval.instructionLimit)
+}
+
+// limitError returns an error that explains which limit was exceeded
+// if err was caused by exceeding one of the evaluator's resource limits.
+// Otherwise, it returns err unchanged.
+// Since errors pass through Go functions as strings,
+// the interpreter is asked whether a limit was hit
+// instead of inspecting err.
+func (eval *Eval) limitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case eval.l.MemoryLimitExceeded():
+		return fmt.Errorf("evaluation exceeded the memory limit of %d MiB "+
+			"(is there unbounded recursion or a runaway loop?); "+
+			"raise it with --eval-memory-limit if needed: %v", eval.memoryLimit>>20, err)
+	case eval.l.InstructionLimitExceeded():
+		return fmt.Errorf("evaluation exceeded the limit of %d instructions "+
+			"(is there an infinite loop or unbounded recursion?); "+
+			"raise it with --eval-instruction-limit if needed: %v", eval.instructionLimit, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestInstructionLimit(t *testing.T) {
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	eval.SetInstructionLimit(1_000_000)
+
+	_, err := eval.Expression(`(function() while true do end end)()`, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the limit of 1000000 instructions") {
+		t.Errorf("infinite loop error = %v; want instruction limit error", err)
+	}
+
+	_, err = eval.Expression(`coroutine.wrap(function() while true do end end)()`, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the limit of 1000000 instructions") {
+		t.Errorf("infinite loop in coroutine error = %v; want instruction limit error", err)
+	}
+
+	// The budget applies to each evaluation separately.
+	for i := 0; i < 3; i++ {
+		results, err := eval.Expression(`(function() local n = 0; for i = 1, 100000 do n = n + i end; return n end)()`, nil)
+		if err != nil {
+			t.Fatalf("evaluation #%d: %v", i+1, err)
+		}
+		if len(results) != 1 || results[0] != int64(5000050000) {
+			t.Errorf("evaluation #%d = %#v; want 5000050000", i+1, results)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	eval.SetMemoryLimit(64 << 20)
+
+	const expr = `(function()
+		local function grow(t) t[#t + 1] = string.rep("x", 1024) .. #t; return grow(t) end
+		return grow({})
+	end)()`
+	_, err := eval.Expression(expr, nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the memory limit of 64 MiB") {
+		t.Errorf("runaway allocation error = %v; want memory limit error", err)
+	}
+
+	results, err := eval.Expression(`#string.rep("x", 1024)`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != int64(1024) {
+		t.Errorf("after memory limit error, result = %#v; want 1024", results)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+)
+
+// A LintWarning is a suspicious value in a derivation's environment
+// that is likely to make the derivation impure or irreproducible.
+type LintWarning struct {
+	// Var is the name of the environment variable.
+	Var string
+	// Message describes the problem.
+	Message string
+}
+
+func (w LintWarning) String() string {
+	return w.Var + ": " + w.Message
+}
+
+// LintOptions is the set of parameters to [LintDerivation].
+type LintOptions struct {
+	// StoreDir is the store directory.
+	// Paths inside it are never reported as host paths,
+	// even if the store is in one of the host directories (like /var).
+	StoreDir nix.StoreDirectory
+	// HomeDir is the current user's home directory.
+	// If empty, home directories are not checked.
+	HomeDir string
+	// Now is the time to consider as the present for detecting timestamps.
+	// If zero, timestamps are not checked.
+	Now time.Time
+	// MaxValueSize is the largest environment variable value in bytes
+	// that does not trigger a warning.
+	// If zero, a default of 1 MiB is used.
+	MaxValueSize int
+}
+
+const defaultMaxLintValueSize = 1 << 20
+
+// hostPathPrefixes is the set of directories
+// whose paths almost certainly refer to the host system
+// and will not exist in a build sandbox.
+var hostPathPrefixes = []string{
+	"/etc/",
+	"/home/",
+	"/opt/",
+	"/root/",
+	"/tmp/",
+	"/Users/",
+	"/usr/",
+	"/var/",
+}
+
+var (
+	unixTimestampPattern = regexp.MustCompile(`\b[0-9]{10}\b`)
+	// datePattern matches YYYY-MM-DD and YYYYMMDD dates in the 20th and 21st centuries.
+	datePattern = regexp.MustCompile(`\b(?:19|20)[0-9]{2}(?:-(?:0[1-9]|1[0-2])-(?:0[1-9]|[12][0-9]|3[01])|(?:0[1-9]|1[0-2])(?:0[1-9]|[12][0-9]|3[01]))\b`)
+)
+
+// LintDerivation checks a derivation's environment for values
+// that usually indicate an impurity:
+// absolute paths on the host outside the store,
+// the user's home directory,
+// timestamps close to the current time,
+// and values large enough that they should be passed as files
+// (by listing the variable in passAsFile).
+// The returned warnings are sorted by variable name.
+func LintDerivation(drv *Derivation, opts *LintOptions) []LintWarning {
+	maxSize := opts.MaxValueSize
+	if maxSize == 0 {
+		maxSize = defaultMaxLintValueSize
+	}
+	passAsFile := strings.Fields(drv.Env["passAsFile"])
+
+	var warnings []LintWarning
+	for _, k := range sortedKeys(drv.Env) {
+		v := drv.Env[k]
+		if len(v) > maxSize && !slices.Contains(passAsFile, k) {
+			warnings = append(warnings, LintWarning{
+				Var:     k,
+				Message: fmt.Sprintf("value is %d bytes; consider listing it in passAsFile", len(v)),
+			})
+		}
+		if opts.HomeDir != "" && strings.Contains(v, opts.HomeDir) {
+			warnings = append(warnings, LintWarning{
+				Var:     k,
+				Message: fmt.Sprintf("mentions home directory %s", opts.HomeDir),
+			})
+		} else if p := findHostPath(v, opts.StoreDir); p != "" {
+			warnings = append(warnings, LintWarning{
+				Var:     k,
+				Message: fmt.Sprintf("mentions host path %s outside the store", p),
+			})
+		}
+		if !opts.Now.IsZero() {
+			if ts := findCurrentTimestamp(v, opts.Now); ts != "" {
+				warnings = append(warnings, LintWarning{
+					Var:     k,
+					Message: fmt.Sprintf("%s looks like the current time", ts),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// findHostPath returns the first absolute path in s
+// that starts with one of [hostPathPrefixes]
+// and is not inside storeDir,
+// or the empty string if none are found.
+func findHostPath(s string, storeDir nix.StoreDirectory) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '/' || (i > 0 && !isPathBoundary(s[i-1])) {
+			continue
+		}
+		end := strings.IndexFunc(s[i:], func(c rune) bool {
+			return c < 0x80 && isPathBoundary(byte(c))
+		})
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += i
+		}
+		path := s[i:end]
+		if storeDir != "" && (path == string(storeDir) || strings.HasPrefix(path, string(storeDir)+"/")) {
+			continue
+		}
+		for _, prefix := range hostPathPrefixes {
+			if strings.HasPrefix(path, prefix) {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+func isPathBoundary(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == ':' || c == '=' || c == '"' || c == '\'' || c == ';'
+}
+
+// findCurrentTimestamp returns the first substring of s
+// that looks like a Unix timestamp within a day of now
+// or the current date,
+// or the empty string if none are found.
+func findCurrentTimestamp(s string, now time.Time) string {
+	for _, m := range unixTimestampPattern.FindAllString(s, -1) {
+		n, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		if d := now.Sub(time.Unix(n, 0)); -24*time.Hour < d && d < 24*time.Hour {
+			return m
+		}
+	}
+	today := now.Format("2006-01-02")
+	for _, m := range datePattern.FindAllString(s, -1) {
+		if m == today || m == strings.ReplaceAll(today, "-", "") {
+			return m
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLintDerivation(t *testing.T) {
+	now := time.Date(2024, time.March, 14, 15, 9, 26, 0, time.UTC)
+	opts := &LintOptions{
+		StoreDir:     "/var/zb/store",
+		HomeDir:      "/home/alice",
+		Now:          now,
+		MaxValueSize: 128,
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []LintWarning
+	}{
+		{
+			name: "Clean",
+			env: map[string]string{
+				"out":  HashPlaceholder("out"),
+				"PATH": "/nix/store/00000000000000000000000000000000-coreutils/bin",
+				"src":  "/bin/sh",
+			},
+		},
+		{
+			name: "HostPath",
+			env: map[string]string{
+				"PATH": "/nix/store/00000000000000000000000000000000-coreutils/bin:/usr/local/bin",
+			},
+			want: []LintWarning{
+				{Var: "PATH", Message: "mentions host path /usr/local/bin outside the store"},
+			},
+		},
+		{
+			name: "StoreUnderHostDir",
+			env: map[string]string{
+				"PATH": "/var/zb/store/00000000000000000000000000000000-coreutils/bin:/var/lib/bin",
+				"src":  "/var/zb/store",
+			},
+			want: []LintWarning{
+				{Var: "PATH", Message: "mentions host path /var/lib/bin outside the store"},
+			},
+		},
+		{
+			name: "HomeDir",
+			env: map[string]string{
+				"config": "--prefix=/home/alice/src",
+			},
+			want: []LintWarning{
+				{Var: "config", Message: "mentions home directory /home/alice"},
+			},
+		},
+		{
+			name: "UnixTimestamp",
+			env: map[string]string{
+				"SOURCE_DATE_EPOCH": "1710428000",
+				"old":               "315532800",
+			},
+			want: []LintWarning{
+				{Var: "SOURCE_DATE_EPOCH", Message: "1710428000 looks like the current time"},
+			},
+		},
+		{
+			name: "Date",
+			env: map[string]string{
+				"version":  "2024-03-14",
+				"released": "20240101",
+				"mixed":    "2024-0314",
+				"serial":   "99999999",
+			},
+			want: []LintWarning{
+				{Var: "version", Message: "2024-03-14 looks like the current time"},
+			},
+		},
+		{
+			name: "Large",
+			env: map[string]string{
+				"script":     strings.Repeat("x", 129),
+				"passAsFile": "text",
+				"text":       strings.Repeat("x", 129),
+			},
+			want: []LintWarning{
+				{Var: "script", Message: "value is 129 bytes; consider listing it in passAsFile"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drv := &Derivation{Name: "test", Env: test.env}
+			got := LintDerivation(drv, opts)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("LintDerivation(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/lua"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// LockfileName is the conventional name of a project's lockfile,
+// which is placed next to the project's Lua file.
+const LockfileName = "zb.lock"
+
+// A Lockfile records the resolved versions of a project's inputs
+// so that evaluation is reproducible.
+// Lockfiles are stored as JSON.
+type Lockfile struct {
+	Inputs map[string]*LockedInput `json:"inputs"`
+}
+
+// LockedInput is a resolved project input.
+// The fields other than Rev and Hash are copied from the input's declaration
+// so that changing the declaration causes the input to be resolved again.
+type LockedInput struct {
+	// URL is the URL of a file input.
+	URL string `json:"url,omitempty"`
+	// Executable is whether a file input is made executable.
+	Executable bool `json:"executable,omitempty"`
+	// Unpack is whether a file input is an archive
+	// whose contents are copied into the store (as by the import function).
+	Unpack bool `json:"unpack,omitempty"`
+	// Git is the URL of a Git repository input.
+	Git string `json:"git,omitempty"`
+	// Ref is the Git ref that was resolved to Rev.
+	// An empty Ref means the repository's HEAD.
+	Ref string `json:"ref,omitempty"`
+	// Rev is the commit hash of a Git repository input.
+	Rev string `json:"rev,omitempty"`
+	// Hash is the SHA-256 hash of the input's content
+	// in the format the input's fetcher expects:
+	// the file content (or its NAR serialization if Executable is true) for a file input,
+	// or the NAR serialization of the source tree
+	// for a Git repository input or an unpacked archive.
+	Hash string `json:"hash"`
+}
+
+// matches reports whether the locked input was resolved from the declaration decl.
+func (locked *LockedInput) matches(decl *LockedInput) bool {
+	return locked.URL == decl.URL &&
+		locked.Executable == decl.Executable &&
+		locked.Unpack == decl.Unpack &&
+		locked.Git == decl.Git &&
+		locked.Ref == decl.Ref
+}
+
+// ReadLockfile reads the lockfile at the given path.
+// If the file does not exist, ReadLockfile returns an empty lockfile.
+func ReadLockfile(path string) (*Lockfile, error) {
+	lf := &Lockfile{Inputs: make(map[string]*LockedInput)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read lockfile: %v", err)
+	}
+	if err := json.Unmarshal(data, lf); err != nil {
+		return nil, fmt.Errorf("read lockfile %s: %v", path, err)
+	}
+	if lf.Inputs == nil {
+		lf.Inputs = make(map[string]*LockedInput)
+	}
+	for name, locked := range lf.Inputs {
+		if locked == nil {
+			delete(lf.Inputs, name)
+		}
+	}
+	return lf, nil
+}
+
+// WriteFile writes the lockfile to the given path.
+func (lf *Lockfile) WriteFile(path string) error {
+	data, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write lockfile %s: %v", path, err)
+	}
+	data = append(data, '\n')
+	if err := os.WriteFile(path, data, 0o666); err != nil {
+		return fmt.Errorf("write lockfile: %v", err)
+	}
+	return nil
+}
+
+// SetLockfile reads the lockfile at the given path (usually named [LockfileName])
+// for use by the input function.
+// Inputs that are not in the lockfile are resolved during evaluation
+// and saved by [Eval.SaveLockfile].
+func (eval *Eval) SetLockfile(path string) error {
+	path, err := eval.abs(path)
+	if err != nil {
+		return err
+	}
+	lf, err := ReadLockfile(path)
+	if err != nil {
+		return err
+	}
+	eval.lockfile = lf
+	eval.lockfilePath = path
+	eval.lockfileChanged = false
+	eval.removeLockedInputs()
+	return nil
+}
+
+// UpdateInputs causes the input function to ignore the locked versions
+// of the named inputs and resolve them again.
+func (eval *Eval) UpdateInputs(names ...string) {
+	eval.updateInputs = append(eval.updateInputs, names...)
+	eval.removeLockedInputs()
+}
+
+func (eval *Eval) removeLockedInputs() {
+	for _, name := range eval.updateInputs {
+		if _, ok := eval.lockfile.Inputs[name]; ok {
+			delete(eval.lockfile.Inputs, name)
+			eval.lockfileChanged = true
+		}
+	}
+}
+
+// SaveLockfile writes the lockfile set by [Eval.SetLockfile]
+// if any inputs were resolved or updated since it was read.
+func (eval *Eval) SaveLockfile() error {
+	if eval.lockfilePath == "" || !eval.lockfileChanged {
+		return nil
+	}
+	if err := eval.lockfile.WriteFile(eval.lockfilePath); err != nil {
+		return err
+	}
+	eval.lockfileChanged = false
+	return nil
+}
+
+// inputFunction implements the input built-in,
+// which fetches a named project input using the version recorded in the lockfile,
+// resolving and recording it if necessary.
+func (eval *Eval) inputFunction(l *lua.State) (int, error) {
+	name, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if name == "" {
+		return 0, lua.NewArgError(l, 1, "empty input name")
+	}
+	if !l.IsTable(2) {
+		return 0, lua.NewTypeError(l, 2, lua.TypeTable.String())
+	}
+	decl := new(LockedInput)
+	for _, field := range []struct {
+		key string
+		dst *string
+	}{
+		{"url", &decl.URL},
+		{"git", &decl.Git},
+		{"ref", &decl.Ref},
+	} {
+		switch typ := l.RawField(2, field.key); typ {
+		case lua.TypeNil:
+		case lua.TypeString:
+			*field.dst, _ = l.ToString(-1)
+		default:
+			l.Pop(1)
+			return 0, fmt.Errorf("input %q: %s argument: %v expected, got %v", name, field.key, lua.TypeString, typ)
+		}
+		l.Pop(1)
+	}
+	l.RawField(2, "executable")
+	decl.Executable = l.ToBoolean(-1)
+	l.Pop(1)
+	switch {
+	case decl.URL == "" && decl.Git == "":
+		return 0, fmt.Errorf("input %q: one of url or git is required", name)
+	case decl.URL != "" && decl.Git != "":
+		return 0, fmt.Errorf("input %q: cannot have both url and git", name)
+	case decl.URL != "" && decl.Ref != "":
+		return 0, fmt.Errorf("input %q: ref can only be used with git", name)
+	case decl.Git != "" && decl.Executable:
+		return 0, fmt.Errorf("input %q: executable can only be used with url", name)
+	}
+
+	ctx := eval.traceContext()
+	locked := eval.lockfile.Inputs[name]
+	if locked != nil && !locked.matches(decl) {
+		locked = nil
+	}
+	var h nix.Hash
+	if locked != nil {
+		h, err = nix.ParseHash(locked.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("input %q: locked hash: %v", name, err)
+		}
+	} else if err := eval.checkPureFetch(fmt.Sprintf("input %q", name)); err != nil {
+		return 0, fmt.Errorf("%v; run zb lock update %s", err, name)
+	}
+
+	if decl.Git != "" {
+		rev := ""
+		if locked != nil {
+			rev = locked.Rev
+		} else {
+			rev, err = gitResolveRef(ctx, decl.Git, decl.Ref)
+			if err != nil {
+				return 0, fmt.Errorf("input %q: %v", name, err)
+			}
+		}
+		storePath, sum, err := eval.fetchGit(ctx, gitSourceName, decl.Git, rev, h)
+		if err != nil {
+			return 0, fmt.Errorf("input %q: %v", name, err)
+		}
+		if locked == nil {
+			locked = &LockedInput{
+				Git:  decl.Git,
+				Ref:  decl.Ref,
+				Rev:  rev,
+				Hash: sum.SRI(),
+			}
+			eval.lockInput(name, locked)
+		}
+		l.PushStringContext(string(storePath), []string{string(storePath)})
+		return 1, nil
+	}
+
+	if locked == nil {
+		h, err = hashURL(ctx, decl.URL, decl.Executable)
+		if err != nil {
+			return 0, fmt.Errorf("input %q: %v", name, err)
+		}
+		locked = &LockedInput{
+			URL:        decl.URL,
+			Executable: decl.Executable,
+			Hash:       h.SRI(),
+		}
+		eval.lockInput(name, locked)
+	}
+	if _, err := l.Global("fetchurl", 0); err != nil {
+		return 0, fmt.Errorf("input %q: %v", name, err)
+	}
+	l.CreateTable(0, 3)
+	l.PushString(locked.URL)
+	l.RawSetField(-2, "url")
+	l.PushString(locked.Hash)
+	l.RawSetField(-2, "hash")
+	l.PushBoolean(locked.Executable)
+	l.RawSetField(-2, "executable")
+	if err := l.Call(1, 1, 0); err != nil {
+		l.Pop(1)
+		return 0, fmt.Errorf("input %q: %v", name, err)
+	}
+	return 1, nil
+}
+
+// lockInput records a newly resolved input in the lockfile.
+func (eval *Eval) lockInput(name string, locked *LockedInput) {
+	eval.lockfile.Inputs[name] = locked
+	eval.lockfileChanged = true
+}
+
+// hashURL downloads the resource at rawURL
+// and returns the hash that fetchurl expects for it.
+func hashURL(ctx context.Context, rawURL string, executable bool) (nix.Hash, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nix.Hash{}, err
+	}
+	f := LookupFetcher(u.Scheme)
+	if f == nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: no fetcher registered for %q URLs", rawURL, u.Scheme)
+	}
+	tf, err := os.CreateTemp("", "zb-fetch-*")
+	if err != nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: %v", rawURL, err)
+	}
+	defer func() {
+		name := tf.Name()
+		tf.Close()
+		os.Remove(name)
+	}()
+	if err := f.Fetch(ctx, tf, u); err != nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: %w", rawURL, err)
+	}
+	size, err := tf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: %v", rawURL, err)
+	}
+	if _, err := tf.Seek(0, io.SeekStart); err != nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: %v", rawURL, err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	if executable {
+		err = writeSingleFileNARMode(h, tf, size, 0o555)
+	} else {
+		_, err = io.Copy(h, tf)
+	}
+	if err != nil {
+		return nix.Hash{}, fmt.Errorf("fetch %s: %v", rawURL, err)
+	}
+	return h.SumHash(), nil
+}
+
+// gitSourceName is the default store object name for Git source trees.
+const gitSourceName = "source"
+
+// fetchGitFunction implements the fetchGit built-in.
+func (eval *Eval) fetchGitFunction(l *lua.State) (int, error) {
+	if !l.IsTable(1) {
+		return 0, lua.NewTypeError(l, 1, lua.TypeTable.String())
+	}
+	args := make(map[string]string)
+	for _, key := range []string{"url", "rev", "hash", "name"} {
+		switch typ := l.RawField(1, key); typ {
+		case lua.TypeNil:
+		case lua.TypeString:
+			args[key], _ = l.ToString(-1)
+		default:
+			l.Pop(1)
+			return 0, fmt.Errorf("fetchGit: %s argument: %v expected, got %v", key, lua.TypeString, typ)
+		}
+		l.Pop(1)
+	}
+	if args["url"] == "" {
+		return 0, fmt.Errorf("fetchGit: missing url")
+	}
+	if args["rev"] == "" {
+		return 0, fmt.Errorf("fetchGit %s: missing rev", args["url"])
+	}
+	name := args["name"]
+	if name == "" {
+		name = gitSourceName
+	}
+	var h nix.Hash
+	if s := args["hash"]; s != "" {
+		var err error
+		h, err = nix.ParseHash(s)
+		if err != nil {
+			return 0, fmt.Errorf("fetchGit %s: hash argument: %v", args["url"], err)
+		}
+	} else if err := eval.checkPureFetch("fetchGit " + args["url"]); err != nil {
+		return 0, err
+	}
+	storePath, _, err := eval.fetchGit(eval.traceContext(), name, args["url"], args["rev"], h)
+	if err != nil {
+		return 0, fmt.Errorf("fetchGit %s: %v", args["url"], err)
+	}
+	l.PushStringContext(string(storePath), []string{string(storePath)})
+	return 1, nil
+}
+
+// fetchGit imports the tree of the commit rev in the Git repository at repoURL
+// into the store, excluding the .git directory.
+// If h is not zero, it is the expected SHA-256 hash
+// of the tree's NAR serialization,
+// and the repository is not cloned if the store object already exists.
+func (eval *Eval) fetchGit(ctx context.Context, name, repoURL, rev string, h nix.Hash) (_ nix.StorePath, _ nix.Hash, err error) {
+	ctx, span := tracer.Start(ctx, "zb.fetchGit", trace.WithAttributes(
+		attribute.String("url.full", repoURL),
+		attribute.String("zb.git.rev", rev),
+	))
+	defer func() { spans.End(span, err) }()
+	if !isGitRev(rev) {
+		return "", nix.Hash{}, fmt.Errorf("rev %q is not a full commit hash", rev)
+	}
+	if !h.IsZero() {
+		storePath, err := fixedCAOutputPath(eval.storeDir, name, nix.RecursiveFileContentAddress(h), storeReferences{})
+		if err != nil {
+			return "", nix.Hash{}, err
+		}
+		if _, err := os.Lstat(eval.realPath(string(storePath))); err == nil {
+			return storePath, h, nil
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "zb-git-*")
+	if err != nil {
+		return "", nix.Hash{}, err
+	}
+	defer os.RemoveAll(dir)
+	if err := runGit(ctx, "", "clone", "--quiet", "--no-checkout", "--", repoURL, dir); err != nil {
+		return "", nix.Hash{}, err
+	}
+	if err := runGit(ctx, dir, "checkout", "--quiet", rev); err != nil {
+		return "", nix.Hash{}, err
+	}
+	gitDir := filepath.Join(dir, ".git")
+	return eval.importTree(ctx, name, dir, h, func(path string, mode fs.FileMode) (bool, error) {
+		return path != gitDir, nil
+	})
+}
+
+// importTree copies the file tree at dir into the store
+// as a recursive content-addressed store object
+// and returns its store path and the SHA-256 hash of its NAR serialization.
+// If h is not zero, the tree must match it.
+// filter may be nil.
+func (eval *Eval) importTree(ctx context.Context, name, dir string, h nix.Hash, filter dumpFilter) (nix.StorePath, nix.Hash, error) {
+	imp, err := eval.startImport(ctx)
+	if err != nil {
+		return "", nix.Hash{}, err
+	}
+	defer imp.Close()
+	hasher := nix.NewHasher(nix.SHA256)
+	err = dumpPathParallel(ctx, io.MultiWriter(hasher, imp), dir, &parallelDumpOptions{
+		Prefilter: filter,
+	})
+	if err != nil {
+		imp.Abort()
+		return "", nix.Hash{}, err
+	}
+	sum := hasher.SumHash()
+	if !h.IsZero() && !sum.Equal(h) {
+		imp.Abort()
+		return "", nix.Hash{}, fmt.Errorf("hash mismatch: got %v (expected %v)", sum.SRI(), h.SRI())
+	}
+	storePath, err := fixedCAOutputPath(eval.storeDir, name, nix.RecursiveFileContentAddress(sum), storeReferences{})
+	if err != nil {
+		imp.Abort()
+		return "", nix.Hash{}, err
+	}
+	if err := imp.Trailer(&nixExportTrailer{storePath: storePath}); err != nil {
+		return "", nix.Hash{}, err
+	}
+	if err := imp.Close(); err != nil {
+		return "", nix.Hash{}, err
+	}
+	return storePath, sum, nil
+}
+
+// gitResolveRef returns the commit hash that ref refers to
+// in the Git repository at repoURL.
+// An empty ref refers to the repository's HEAD.
+func gitResolveRef(ctx context.Context, repoURL, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if isGitRev(ref) {
+		return ref, nil
+	}
+	c := exec.CommandContext(ctx, "git", "ls-remote", "--", repoURL, ref)
+	stderr := new(strings.Builder)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("resolve %s in %s: %s", ref, repoURL, msg)
+		}
+		return "", fmt.Errorf("resolve %s in %s: %v", ref, repoURL, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		rev, _, ok := strings.Cut(line, "\t")
+		if ok && isGitRev(rev) {
+			return rev, nil
+		}
+	}
+	return "", fmt.Errorf("resolve %s in %s: no such ref", ref, repoURL)
+}
+
+// runGit runs a git subcommand in dir,
+// returning its standard error as the error message if it fails.
+func runGit(ctx context.Context, dir string, args ...string) error {
+	c := exec.CommandContext(ctx, "git", args...)
+	c.Dir = dir
+	stderr := new(strings.Builder)
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// isGitRev reports whether s is a full SHA-1 or SHA-256 commit hash.
+func isGitRev(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestInputURL(t *testing.T) {
+	installFakeNixStore(t)
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "hello.txt")
+	lockPath := filepath.Join(dir, LockfileName)
+	storeDir := nix.StoreDirectory(t.TempDir())
+	expr := `return input("hello", { url = "file://` + filepath.ToSlash(filePath) + `" })`
+
+	evalInput := func(update ...string) (*Derivation, error) {
+		eval := NewEval(storeDir)
+		defer eval.Close()
+		if err := eval.SetLockfile(lockPath); err != nil {
+			return nil, err
+		}
+		eval.UpdateInputs(update...)
+		results, err := eval.Expression(expr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := eval.SaveLockfile(); err != nil {
+			return nil, err
+		}
+		drv, ok := results[0].(*Derivation)
+		if !ok {
+			return nil, fmt.Errorf("result = %#v; want derivation", results[0])
+		}
+		return drv, nil
+	}
+	hashOf := func(s string) string {
+		h := nix.NewHasher(nix.SHA256)
+		h.WriteString(s)
+		return h.SumHash().SRI()
+	}
+
+	if err := os.WriteFile(filePath, []byte("Hello, World!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	drv, err := evalInput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := drv.Env["outputHash"], hashOf("Hello, World!\n"); got != want {
+		t.Errorf("first evaluation outputHash = %q; want %q", got, want)
+	}
+	lf, err := ReadLockfile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lf.Inputs["hello"]; got == nil || got.Hash != hashOf("Hello, World!\n") {
+		t.Errorf("lockfile input = %+v; want hash %s", got, hashOf("Hello, World!\n"))
+	}
+
+	// The locked hash should be enforced until the input is updated.
+	if err := os.WriteFile(filePath, []byte("Goodbye!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := evalInput(); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("locked evaluation after change error = %v; want hash mismatch", err)
+	}
+	drv, err = evalInput("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := drv.Env["outputHash"], hashOf("Goodbye!\n"); got != want {
+		t.Errorf("updated evaluation outputHash = %q; want %q", got, want)
+	}
+	lf, err = ReadLockfile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lf.Inputs["hello"]; got == nil || got.Hash != hashOf("Goodbye!\n") {
+		t.Errorf("lockfile input after update = %+v; want hash %s", got, hashOf("Goodbye!\n"))
+	}
+}
+
+func TestInputGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	installFakeNixStore(t)
+	repoDir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		c := exec.Command("git", append([]string{"-c", "user.name=zb", "-c", "user.email=zb@example.com"}, args...)...)
+		c.Dir = repoDir
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(content string) string {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repoDir, "hello.txt"), []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "hello.txt")
+		git("commit", "--quiet", "-m", "Update hello.txt")
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "--quiet")
+	rev1 := commit("Hello, World!\n")
+
+	lockPath := filepath.Join(t.TempDir(), LockfileName)
+	storeDir := nix.StoreDirectory(t.TempDir())
+	expr := `return input("src", { git = "` + filepath.ToSlash(repoDir) + `" })`
+	evalInput := func(t *testing.T, update ...string) string {
+		t.Helper()
+		eval := NewEval(storeDir)
+		defer eval.Close()
+		if err := eval.SetLockfile(lockPath); err != nil {
+			t.Fatal(err)
+		}
+		eval.UpdateInputs(update...)
+		results, err := eval.Expression(expr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := eval.SaveLockfile(); err != nil {
+			t.Fatal(err)
+		}
+		p, ok := results[0].(string)
+		if !ok {
+			t.Fatalf("result = %#v; want string", results[0])
+		}
+		return p
+	}
+	lockedRev := func(t *testing.T) string {
+		t.Helper()
+		lf, err := ReadLockfile(lockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lf.Inputs["src"] == nil {
+			t.Fatal("src not in lockfile")
+		}
+		return lf.Inputs["src"].Rev
+	}
+
+	path1 := evalInput(t)
+	if got := lockedRev(t); got != rev1 {
+		t.Errorf("locked rev = %s; want %s", got, rev1)
+	}
+	rev2 := commit("Goodbye!\n")
+	if got := evalInput(t); got != path1 {
+		t.Errorf("after new commit, locked input = %s; want %s", got, path1)
+	}
+	if got := lockedRev(t); got != rev1 {
+		t.Errorf("after new commit, locked rev = %s; want %s", got, rev1)
+	}
+	if got := evalInput(t, "src"); got == path1 {
+		t.Errorf("updated input = %s; want a different path", got)
+	}
+	if got := lockedRev(t); got != rev2 {
+		t.Errorf("after update, locked rev = %s; want %s", got, rev2)
+	}
+}
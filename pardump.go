@@ -0,0 +1,546 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"zombiezen.com/go/nix/nar"
+)
+
+const (
+	// prefetchMaxSize is the size of the largest file
+	// whose content is read ahead of serialization.
+	// Larger files are streamed.
+	prefetchMaxSize = 256 << 10
+	// dumpWindow is the number of file system objects
+	// that can be read ahead of serialization.
+	// Along with prefetchMaxSize, it bounds the memory used by a dump.
+	dumpWindow = 256
+)
+
+// A dumpFilter reports whether a file should be included in a NAR.
+// It receives the same arguments as a [nar.SourceFilterFunc].
+type dumpFilter func(path string, mode fs.FileMode) (bool, error)
+
+// parallelDumpOptions is the set of parameters to [dumpPathParallel].
+type parallelDumpOptions struct {
+	// Prefilter is called from a background goroutine
+	// in NAR order before any of the file's content is read.
+	// It must not be called concurrently with anything else that uses its state.
+	Prefilter dumpFilter
+	// Filter is called from the goroutine that called [dumpPathParallel]
+	// in NAR order for files accepted by Prefilter.
+	Filter dumpFilter
+	// Workers is the number of goroutines used to read directories and files.
+	// If zero, a number based on GOMAXPROCS is used.
+	Workers int
+	// NormalizeNames is whether file names are converted
+	// to Unicode Normalization Form C in the NAR,
+	// so that trees checked out on file systems that decompose names
+	// (like macOS's HFS+) produce the same NAR as elsewhere.
+	// It is an error for two files in a directory to have the same normalized name.
+	NormalizeNames bool
+	// CaseCollision is called from the goroutine that called [dumpPathParallel]
+	// when a file's name differs from an earlier sibling's only in case.
+	// Such files cannot coexist on case-insensitive file systems.
+	// The paths are slash-separated paths in the NAR.
+	// If CaseCollision is nil, case collisions are permitted.
+	// If CaseCollision returns an error, dumpPathParallel stops and returns it.
+	CaseCollision func(path1, path2 string) error
+}
+
+// dumpPathParallel serializes the file tree at path to NAR format like [nar.DumpPathFilter],
+// but lists directories, stats files, and reads small files concurrently.
+// The output is identical to a sequential dump with the same filters.
+func dumpPathParallel(ctx context.Context, w io.Writer, path string, opts *parallelDumpOptions) (err error) {
+	rootInfo, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("dump nar: %w", err)
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = min(max(2*runtime.GOMAXPROCS(0), 4), 32)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := newWorkerPool(workers)
+	items := make(chan *dumpItem, dumpWindow)
+	var scheduleDone sync.WaitGroup
+	scheduleDone.Add(1)
+	go func() {
+		defer scheduleDone.Done()
+		defer close(items)
+		s := &dumpScheduler{
+			ctx:       ctx,
+			pool:      p,
+			items:     items,
+			prefilter: opts.Prefilter,
+			normalize: opts.NormalizeNames,
+		}
+		s.schedule(path, rootInfo)
+	}()
+	defer func() {
+		cancel()
+		for range items {
+			// Drain so that the scheduler can exit.
+		}
+		scheduleDone.Wait()
+		p.close()
+	}()
+
+	nw := nar.NewWriter(w)
+	var names *nameChecker
+	if opts.NormalizeNames || opts.CaseCollision != nil {
+		names = newNameChecker()
+	}
+	skipPrefix := ""
+	for item := range items {
+		if skipPrefix != "" && len(item.path) > len(skipPrefix) && item.path[:len(skipPrefix)] == skipPrefix {
+			continue
+		}
+		skipPrefix = ""
+		if opts.Filter != nil && (item.path != "" || !item.mode.IsDir()) {
+			ok, err := opts.Filter(item.osPath, item.mode)
+			if err != nil {
+				return fmt.Errorf("dump nar: %w", err)
+			}
+			if !ok {
+				if item.path == "" {
+					return fmt.Errorf("dump nar: entire path is excluded")
+				}
+				if item.mode.IsDir() {
+					skipPrefix = item.path + "/"
+				}
+				continue
+			}
+		}
+		if item.err != nil {
+			return fmt.Errorf("dump nar: %w", item.err)
+		}
+		if names != nil && item.path != "" {
+			prev, caseOnly := names.add(item.path)
+			switch {
+			case prev == "":
+			case !caseOnly:
+				return fmt.Errorf("dump nar: %s: another file has the same name after Unicode normalization", item.osPath)
+			case opts.CaseCollision != nil:
+				if err := opts.CaseCollision(prev, item.path); err != nil {
+					return fmt.Errorf("dump nar: %w", err)
+				}
+			}
+		}
+		if err := item.write(nw); err != nil {
+			return fmt.Errorf("dump nar: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("dump nar: %w", err)
+	}
+	if err := nw.Close(); err != nil {
+		return fmt.Errorf("dump nar: %w", err)
+	}
+	return nil
+}
+
+// canonicalMode returns the mode that a file system object
+// with the given mode has once it is imported into the store.
+// Directories have mode 0555 and symlinks 0777.
+// Regular files have mode 0444, or 0555 if the owner could execute the file.
+// Other permission bits (including setuid, setgid, and sticky)
+// are discarded, as are timestamps, ownership, and extended attributes,
+// since NAR serializations do not record them.
+// This matches how Nix serializes and canonicalizes store objects,
+// so that the same content produces the same store object on every machine.
+func canonicalMode(mode fs.FileMode) fs.FileMode {
+	switch {
+	case mode.IsDir():
+		return fs.ModeDir | 0o555
+	case mode&fs.ModeSymlink != 0:
+		return fs.ModeSymlink | 0o777
+	case mode.IsRegular() && mode&0o100 != 0:
+		return 0o555
+	case mode.IsRegular():
+		return 0o444
+	default:
+		return mode.Type()
+	}
+}
+
+// dumpItem is a file system object to be written to a NAR.
+type dumpItem struct {
+	// path is the slash-separated path of the object in the NAR.
+	path string
+	// osPath is the object's path in the local file system.
+	osPath string
+	mode   fs.FileMode
+	size   int64
+	target string
+	// content is the result of reading a small regular file.
+	// It is nil for files that are streamed.
+	content *future[[]byte]
+	// err is an error encountered while listing or reading the object.
+	// It is only reported if the object is not filtered out.
+	err error
+}
+
+func (item *dumpItem) write(nw *nar.Writer) error {
+	switch {
+	case item.mode.IsRegular():
+		var data []byte
+		var f *os.File
+		if item.content != nil {
+			var err error
+			data, err = item.content.wait()
+			if err != nil {
+				return err
+			}
+		} else {
+			var err error
+			f, err = os.Open(item.osPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+		err := nw.WriteHeader(&nar.Header{
+			Path: item.path,
+			Mode: item.mode,
+			Size: item.size,
+		})
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			_, err = nw.Write(data)
+		} else {
+			_, err = io.Copy(nw, f)
+		}
+		return err
+	case item.mode.IsDir():
+		return nw.WriteHeader(&nar.Header{
+			Path: item.path,
+			Mode: fs.ModeDir,
+		})
+	case item.mode&fs.ModeSymlink != 0:
+		return nw.WriteHeader(&nar.Header{
+			Path:       item.path,
+			Mode:       fs.ModeSymlink,
+			LinkTarget: item.target,
+		})
+	default:
+		return fmt.Errorf("unknown type %v for file %v", item.mode.Type(), item.osPath)
+	}
+}
+
+// dumpScheduler walks a file tree in NAR order,
+// reading ahead of the consumer of its items.
+type dumpScheduler struct {
+	ctx       context.Context
+	pool      *workerPool
+	items     chan<- *dumpItem
+	prefilter dumpFilter
+	normalize bool
+}
+
+// dirListing is a directory's entries in sorted order
+// along with their file information.
+type dirListing struct {
+	entries []fs.FileInfo
+	targets []string
+}
+
+func (s *dumpScheduler) schedule(root string, rootInfo fs.FileInfo) {
+	if !rootInfo.IsDir() {
+		s.send(s.newItem("", root, rootInfo, ""))
+		return
+	}
+	s.scheduleDir("", root, s.list(root))
+}
+
+// scheduleDir sends the items for the directory at osPath
+// (represented by path in the NAR) and its descendants.
+// It reports whether the consumer is still receiving.
+func (s *dumpScheduler) scheduleDir(path, osPath string, listing *future[*dirListing]) bool {
+	item := &dumpItem{path: path, osPath: osPath, mode: fs.ModeDir | 0o555}
+	l, err := listing.wait()
+	if err != nil {
+		item.err = err
+		return s.send(item)
+	}
+	if !s.send(item) {
+		return false
+	}
+
+	// Start reading subdirectories before descending into any of them.
+	type child struct {
+		item    *dumpItem
+		listing *future[*dirListing]
+	}
+	children := make([]child, 0, len(l.entries))
+	for i, info := range l.entries {
+		childPath := info.Name()
+		if s.normalize {
+			childPath = norm.NFC.String(childPath)
+		}
+		if path != "" {
+			childPath = path + "/" + childPath
+		}
+		childOSPath := filepath.Join(osPath, info.Name())
+		if s.prefilter != nil {
+			ok, err := s.prefilter(childOSPath, canonicalMode(info.Mode()))
+			if err != nil {
+				return s.send(&dumpItem{path: childPath, osPath: childOSPath, mode: info.Mode(), err: err})
+			}
+			if !ok {
+				continue
+			}
+		}
+		c := child{item: s.newItem(childPath, childOSPath, info, l.targets[i])}
+		if info.IsDir() {
+			c.listing = s.list(childOSPath)
+		}
+		children = append(children, c)
+	}
+	if s.normalize {
+		// Normalization can change the order of names.
+		slices.SortStableFunc(children, func(c1, c2 child) int {
+			return strings.Compare(c1.item.path, c2.item.path)
+		})
+	}
+
+	for _, c := range children {
+		if c.listing != nil {
+			if !s.scheduleDir(c.item.path, c.item.osPath, c.listing) {
+				return false
+			}
+		} else if !s.send(c.item) {
+			return false
+		}
+	}
+	return true
+}
+
+// newItem returns the item for a file system object.
+func (s *dumpScheduler) newItem(path, osPath string, info fs.FileInfo, target string) *dumpItem {
+	item := &dumpItem{
+		path:   path,
+		osPath: osPath,
+		mode:   canonicalMode(info.Mode()),
+		size:   info.Size(),
+		target: target,
+	}
+	if item.mode&fs.ModeSymlink != 0 && path == "" {
+		item.target, item.err = os.Readlink(osPath)
+	}
+	return item
+}
+
+// list starts reading the directory at osPath.
+func (s *dumpScheduler) list(osPath string) *future[*dirListing] {
+	f := newFuture[*dirListing]()
+	s.pool.submit(func() {
+		f.set(listDir(osPath))
+	})
+	return f
+}
+
+// send starts reading the item's content if it is a small regular file
+// and then sends it to the consumer.
+// Because the items channel is bounded,
+// this limits the amount of file content held in memory.
+func (s *dumpScheduler) send(item *dumpItem) bool {
+	if item.err == nil && item.mode.IsRegular() && item.size <= prefetchMaxSize {
+		item.content = newFuture[[]byte]()
+		s.pool.submit(func() {
+			item.content.set(readFileSize(item.osPath, item.size))
+		})
+	}
+	select {
+	case s.items <- item:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// listDir reads the directory at path,
+// stats its entries, and reads the targets of any symlinks.
+func listDir(path string) (*dirListing, error) {
+	ents, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &dirListing{
+		entries: make([]fs.FileInfo, len(ents)),
+		targets: make([]string, len(ents)),
+	}
+	for i, ent := range ents {
+		l.entries[i], err = ent.Info()
+		if err != nil {
+			return nil, err
+		}
+		if ent.Type()&fs.ModeSymlink != 0 {
+			l.targets[i], err = os.Readlink(filepath.Join(path, ent.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return l, nil
+}
+
+// readFileSize reads the file at path,
+// verifying that it is the expected size.
+func readFileSize(path string, size int64) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("%s changed size during serialization", path)
+	}
+	return data, nil
+}
+
+// future is a value that will be available later.
+type future[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+func newFuture[T any]() *future[T] {
+	return &future[T]{done: make(chan struct{})}
+}
+
+func (f *future[T]) set(value T, err error) {
+	f.value = value
+	f.err = err
+	close(f.done)
+}
+
+func (f *future[T]) wait() (T, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// workerPool runs functions on a fixed number of goroutines.
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), 4*n)}
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			for f := range p.jobs {
+				f()
+			}
+		}()
+	}
+	return p
+}
+
+// submit schedules f to run on the pool,
+// blocking if too many functions are already waiting.
+func (p *workerPool) submit(f func()) {
+	p.jobs <- f
+}
+
+// close waits for all submitted functions to finish
+// and stops the pool's goroutines.
+func (p *workerPool) close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// asyncWriter writes to an underlying writer from a separate goroutine,
+// so that slow consumers (like hashers) overlap with the caller's work.
+type asyncWriter struct {
+	chunks chan []byte
+	done   chan struct{}
+	err    error
+}
+
+func newAsyncWriter(w io.Writer) *asyncWriter {
+	aw := &asyncWriter{
+		chunks: make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(aw.done)
+		for chunk := range aw.chunks {
+			if aw.err == nil {
+				_, aw.err = w.Write(chunk)
+			}
+		}
+	}()
+	return aw
+}
+
+// Write copies p and queues it to be written to the underlying writer.
+// Errors from the underlying writer are reported by Close.
+func (aw *asyncWriter) Write(p []byte) (int, error) {
+	aw.chunks <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// Close waits for queued writes to finish
+// and returns the first error from the underlying writer.
+func (aw *asyncWriter) Close() error {
+	close(aw.chunks)
+	<-aw.done
+	return aw.err
+}
+
+// nameChecker detects files in the same directory
+// whose names are equal after case folding.
+type nameChecker struct {
+	// dirs maps a directory's path in the NAR
+	// to the folded names of its entries
+	// to the first entry's path in the NAR.
+	dirs map[string]map[string]string
+}
+
+func newNameChecker() *nameChecker {
+	return &nameChecker{dirs: make(map[string]map[string]string)}
+}
+
+// add records the NAR path p.
+// If an earlier sibling has the same name after case folding,
+// add returns the sibling's path
+// and reports whether the names differ (i.e. only in case).
+func (nc *nameChecker) add(p string) (prev string, caseOnly bool) {
+	dir, name := "", p
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		dir, name = p[:i], p[i+1:]
+	}
+	entries := nc.dirs[dir]
+	if entries == nil {
+		entries = make(map[string]string)
+		nc.dirs[dir] = entries
+	}
+	key := cases.Fold().String(name)
+	if prev, ok := entries[key]; ok {
+		return prev, prev != p
+	}
+	entries[key] = p
+	return "", false
+}
@@ -0,0 +1,261 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestDumpPathParallel(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":           "Hello\n",
+		"b/c.txt":         "nested\n",
+		"b/d/e.txt":       "deeper\n",
+		"b/d/f.log":       "log\n",
+		"big.bin":         strings.Repeat("x", prefetchMaxSize+1),
+		"junk/scratch":    "scratch\n",
+		"z/y/x/w/v/u.txt": "deep\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(root, "b", "c.txt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	noLogs := func(path string, mode fs.FileMode) bool {
+		return filepath.Ext(path) != ".log"
+	}
+	noJunk := func(path string, mode fs.FileMode) bool {
+		return filepath.Base(path) != "junk"
+	}
+	tests := []struct {
+		name      string
+		path      string
+		prefilter func(string, fs.FileMode) bool
+		filter    func(string, fs.FileMode) bool
+	}{
+		{name: "All", path: root},
+		{name: "File", path: filepath.Join(root, "a.txt")},
+		{name: "BigFile", path: filepath.Join(root, "big.bin")},
+		{name: "Symlink", path: filepath.Join(root, "link")},
+		{name: "Subdirectory", path: filepath.Join(root, "b")},
+		{name: "Prefilter", path: root, prefilter: noLogs},
+		{name: "Filter", path: root, filter: noJunk},
+		{name: "BothFilters", path: root, prefilter: noLogs, filter: noJunk},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := new(bytes.Buffer)
+			err := nar.DumpPathFilter(want, test.path, func(path string, mode fs.FileMode) bool {
+				return (test.prefilter == nil || test.prefilter(path, mode)) &&
+					(test.filter == nil || test.filter(path, mode))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, workers := range []int{1, 4} {
+				opts := &parallelDumpOptions{Workers: workers}
+				if test.prefilter != nil {
+					opts.Prefilter = func(path string, mode fs.FileMode) (bool, error) {
+						return test.prefilter(path, mode), nil
+					}
+				}
+				if test.filter != nil {
+					opts.Filter = func(path string, mode fs.FileMode) (bool, error) {
+						return test.filter(path, mode), nil
+					}
+				}
+				got := new(bytes.Buffer)
+				if err := dumpPathParallel(context.Background(), got, test.path, opts); err != nil {
+					t.Fatalf("workers=%d: %v", workers, err)
+				}
+				if !bytes.Equal(got.Bytes(), want.Bytes()) {
+					t.Errorf("workers=%d: NAR differs from sequential dump (%d bytes vs. %d bytes)",
+						workers, got.Len(), want.Len())
+				}
+			}
+		})
+	}
+
+	t.Run("ExcludedRoot", func(t *testing.T) {
+		opts := &parallelDumpOptions{
+			Filter: func(path string, mode fs.FileMode) (bool, error) { return false, nil },
+		}
+		err := dumpPathParallel(context.Background(), new(bytes.Buffer), filepath.Join(root, "a.txt"), opts)
+		if err == nil {
+			t.Error("dumpPathParallel did not return an error")
+		}
+	})
+}
+
+func TestDumpPathParallelCanonicalizesMetadata(t *testing.T) {
+	tests := []struct {
+		name           string
+		perm           fs.FileMode
+		wantExecutable bool
+	}{
+		{name: "ReadWrite", perm: 0o644},
+		{name: "OwnerOnly", perm: 0o600},
+		{name: "ReadOnly", perm: 0o444},
+		{name: "Executable", perm: 0o755, wantExecutable: true},
+		{name: "OwnerExecutable", perm: 0o700, wantExecutable: true},
+		{name: "Setuid", perm: 0o755 | fs.ModeSetuid, wantExecutable: true},
+		{name: "OthersExecutable", perm: 0o611},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, []byte("Hello\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, test.perm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, time.Unix(1234567890, 0), time.Unix(1234567890, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			wantMode := fs.FileMode(0o444)
+			if test.wantExecutable {
+				wantMode = 0o555
+			}
+			want := new(bytes.Buffer)
+			if err := writeSingleFileNARMode(want, strings.NewReader("Hello\n"), 6, wantMode); err != nil {
+				t.Fatal(err)
+			}
+			var filterMode fs.FileMode
+			opts := &parallelDumpOptions{
+				Filter: func(path string, mode fs.FileMode) (bool, error) {
+					filterMode = mode
+					return true, nil
+				},
+			}
+			got := new(bytes.Buffer)
+			if err := dumpPathParallel(context.Background(), got, path, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("NAR for mode %v differs from NAR for mode %v", test.perm, wantMode)
+			}
+			if filterMode != wantMode {
+				t.Errorf("filter called with mode %v; want %v", filterMode, wantMode)
+			}
+		})
+	}
+}
+
+func TestDumpPathParallelNames(t *testing.T) {
+	const (
+		nfc = "caf\u00e9"
+		nfd = "cafe\u0301"
+	)
+	newTree := func(t *testing.T, names ...string) string {
+		t.Helper()
+		root := t.TempDir()
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return root
+	}
+	dump := func(root string, opts *parallelDumpOptions) ([]byte, error) {
+		buf := new(bytes.Buffer)
+		err := dumpPathParallel(context.Background(), buf, root, opts)
+		return buf.Bytes(), err
+	}
+
+	t.Run("Normalize", func(t *testing.T) {
+		want, err := dump(newTree(t, nfc), new(parallelDumpOptions))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The content is the name, so write the same content for both.
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, nfd), []byte(nfc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := dump(root, &parallelDumpOptions{NormalizeNames: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("NAR with decomposed name differs from NAR with composed name")
+		}
+	})
+
+	t.Run("NormalizedCollision", func(t *testing.T) {
+		root := newTree(t, nfc, nfd)
+		if _, err := dump(root, new(parallelDumpOptions)); err != nil {
+			t.Fatal("without normalization:", err)
+		}
+		if _, err := dump(root, &parallelDumpOptions{NormalizeNames: true}); err == nil {
+			t.Error("dumpPathParallel did not return an error for names that normalize the same")
+		}
+	})
+
+	t.Run("CaseCollision", func(t *testing.T) {
+		root := newTree(t, "README", "a", "readme")
+		var collisions [][2]string
+		opts := &parallelDumpOptions{
+			CaseCollision: func(path1, path2 string) error {
+				collisions = append(collisions, [2]string{path1, path2})
+				return nil
+			},
+		}
+		if _, err := dump(root, opts); err != nil {
+			t.Fatal(err)
+		}
+		want := [][2]string{{"README", "readme"}}
+		if diff := cmp.Diff(want, collisions); diff != "" {
+			t.Errorf("collisions (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestAsyncWriter(t *testing.T) {
+	want := nix.NewHasher(nix.SHA256)
+	h := nix.NewHasher(nix.SHA256)
+	aw := newAsyncWriter(h)
+	buf := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		for j := range buf {
+			buf[j] = byte(i + j)
+		}
+		aw.Write(buf)
+		want.Write(buf)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.SumHash(), want.SumHash(); !got.Equal(want) {
+		t.Errorf("hash = %v; want %v", got, want)
+	}
+}
@@ -7,17 +7,24 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	slashpath "path"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"zombiezen.com/go/nix"
-	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/zb/internal/gitignore"
 	"zombiezen.com/go/zb/internal/lua"
 )
 
-func (eval *Eval) pathFunction(l *lua.State) (int, error) {
+func (eval *Eval) pathFunction(l *lua.State) (nResults int, err error) {
 	var p string
 	var name string
+	var sourceOpts sourceFilterOptions
 	switch l.Type(1) {
 	case lua.TypeString:
 		p, _ = l.ToString(1)
@@ -43,29 +50,139 @@ func (eval *Eval) pathFunction(l *lua.State) (int, error) {
 			name, _ = lua.ToString(l, -1)
 		}
 		l.Pop(1)
+
+		_, err = l.Field(1, "gitignore", 0)
+		if err != nil {
+			return 0, fmt.Errorf("path: %v", err)
+		}
+		sourceOpts.gitignore = l.ToBoolean(-1)
+		l.Pop(1)
+
+		_, err = l.Field(1, "git", 0)
+		if err != nil {
+			return 0, fmt.Errorf("path: %v", err)
+		}
+		sourceOpts.git = l.ToBoolean(-1)
+		l.Pop(1)
+
+		_, err = l.Field(1, "portable", 0)
+		if err != nil {
+			return 0, fmt.Errorf("path: %v", err)
+		}
+		sourceOpts.portable = l.ToBoolean(-1)
+		l.Pop(1)
+
+		// Leave the filter function on the stack for the duration of the call.
+		typ, err = l.Field(1, "filter", 0)
+		if err != nil {
+			return 0, fmt.Errorf("path: %v", err)
+		}
+		switch typ {
+		case lua.TypeNil:
+			l.Pop(1)
+		case lua.TypeFunction:
+			sourceOpts.filterIndex = l.Top()
+		default:
+			return 0, fmt.Errorf("path: filter is a %v (want function)", typ)
+		}
 	default:
 		return 0, lua.NewTypeError(l, 1, "string or table")
 	}
 
-	p, err := absSourcePath(l, p)
+	p, err = eval.absSourcePath(l, p)
 	if err != nil {
 		return 0, fmt.Errorf("path: %v", err)
 	}
+	if err := eval.checkPurePath(p); err != nil {
+		return 0, fmt.Errorf("path: %v", err)
+	}
+	eval.recordSource(p)
 	if name == "" {
 		name = filepath.Base(p)
 	}
+	end := eval.startSpan("zb.path", attribute.String("zb.path", p))
+	defer func() { end(err) }()
+	ctx := eval.traceContext()
+
+	filter, err := newSourceFilter(ctx, l, p, &sourceOpts)
+	if err != nil {
+		return 0, fmt.Errorf("path: %v", err)
+	}
+	filter.caseCollision = func(path1, path2 string) error {
+		if sourceOpts.portable {
+			return fmt.Errorf("%s and %s differ only in case", path1, path2)
+		}
+		eval.warn(&Warning{
+			Category: WarningCategoryPortability,
+			Message: fmt.Sprintf("%s: %s and %s differ only in case "+
+				"and cannot both be checked out on a case-insensitive file system", p, path1, path2),
+			Position: wherePosition(l, 1),
+		})
+		return nil
+	}
+	var stamp pathStamp
+	var cacheKey pathCacheKey
+	// Arbitrary Lua filters may change between calls,
+	// so only imports without them can be cached by stamp.
+	cacheable := sourceOpts.filterIndex == 0 && eval.pathCacheMode == PathCacheStamp
+	if cacheable {
+		cacheKey = pathCacheKey{
+			path:      p,
+			name:      name,
+			gitignore: sourceOpts.gitignore,
+			git:       sourceOpts.git,
+			portable:  sourceOpts.portable,
+		}
+		var stampOK bool
+		stamp, stampOK, err = walkPath(p, time.Now(), filter.gitFilter)
+		if err != nil {
+			return 0, fmt.Errorf("path: %w", err)
+		}
+		if storePath, ok := eval.cachedPath(cacheKey, stamp); ok {
+			l.PushStringContext(string(storePath), []string{string(storePath)})
+			return 1, nil
+		}
+		cacheable = stampOK
+	}
+	var contentHash nix.Hash
+	if eval.pathCacheMode == PathCacheContent {
+		// The store path only depends on the content,
+		// so if the store object exists, there's nothing to import.
+		h := nix.NewHasher(nix.SHA256)
+		if err := filter.dump(ctx, h, p); err != nil {
+			return 0, fmt.Errorf("path: %w", err)
+		}
+		contentHash = h.SumHash()
+		storePath, err := fixedCAOutputPath(eval.storeDir, name, nix.RecursiveFileContentAddress(contentHash), storeReferences{})
+		if err != nil {
+			return 0, fmt.Errorf("path: %w", err)
+		}
+		if _, err := os.Lstat(eval.realPath(string(storePath))); err == nil {
+			l.PushStringContext(string(storePath), []string{string(storePath)})
+			return 1, nil
+		}
+	}
 
-	imp, err := startImport(context.TODO())
+	imp, err := eval.startImport(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("path: %w", err)
 	}
 	defer imp.Close()
 
+	// Hash on a separate goroutine so that it overlaps with the import stream.
 	h := nix.NewHasher(nix.SHA256)
-	if err := nar.DumpPath(io.MultiWriter(h, imp), p); err != nil {
+	hw := newAsyncWriter(h)
+	err = filter.dump(ctx, io.MultiWriter(hw, imp), p)
+	hw.Close()
+	if err != nil {
+		imp.Abort()
 		return 0, fmt.Errorf("path: %w", err)
 	}
 	sum := h.SumHash()
+	if !contentHash.IsZero() && !sum.Equal(contentHash) {
+		imp.Abort()
+		return 0, fmt.Errorf("path: %s changed during import", p)
+	}
 	storePath, err := fixedCAOutputPath(eval.storeDir, name, nix.RecursiveFileContentAddress(sum), storeReferences{})
 	if err != nil {
 		return 0, fmt.Errorf("path: %w", err)
@@ -79,10 +196,159 @@ func (eval *Eval) pathFunction(l *lua.State) (int, error) {
 	if err := imp.Close(); err != nil {
 		return 0, fmt.Errorf("path: %w", err)
 	}
+	if cacheable {
+		eval.pathCache[cacheKey] = pathCacheEntry{stamp: stamp, storePath: storePath}
+	}
 	l.PushStringContext(string(storePath), []string{string(storePath)})
 	return 1, nil
 }
 
+// sourceFilterOptions is the set of filters that the path function applies.
+type sourceFilterOptions struct {
+	// filterIndex is the stack index of a Lua function
+	// that is called with each file's path and type ("regular", "directory", or "symlink")
+	// and returns whether the file should be included.
+	// If zero, no Lua function is called.
+	filterIndex int
+	// gitignore is whether files ignored by Git are excluded.
+	gitignore bool
+	// git is whether only files tracked by Git
+	// (including those staged for the next commit) are included.
+	git bool
+	// portable is whether files whose names differ only in case
+	// are an error rather than a warning.
+	portable bool
+}
+
+// sourceFilter decides which files under a source path are imported.
+type sourceFilter struct {
+	l           *lua.State
+	root        string
+	filterIndex int
+	gitRoot     string
+	gitignore   *gitignore.Matcher
+	// tracked is the set of slash-separated paths relative to root
+	// that are tracked by Git, including their parent directories.
+	// If nil, all files are eligible.
+	tracked map[string]struct{}
+	// caseCollision is called for files whose names differ only in case.
+	caseCollision func(path1, path2 string) error
+}
+
+// newSourceFilter returns a filter for imports of root.
+// ctx is used to list the files tracked by Git.
+func newSourceFilter(ctx context.Context, l *lua.State, root string, opts *sourceFilterOptions) (*sourceFilter, error) {
+	f := &sourceFilter{
+		l:           l,
+		root:        root,
+		filterIndex: opts.filterIndex,
+	}
+	if opts.gitignore {
+		f.gitRoot = gitignore.FindRoot(root)
+		f.gitignore = gitignore.NewMatcher(f.gitRoot)
+	}
+	if opts.git {
+		var err error
+		f.tracked, err = gitTrackedFiles(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// gitTrackedFiles returns the set of files under dir
+// that are in the Git index, along with their parent directories.
+// Paths are slash-separated and relative to dir.
+func gitTrackedFiles(ctx context.Context, dir string) (map[string]struct{}, error) {
+	c := exec.CommandContext(ctx, "git", "ls-files", "-z", "--cached", "--recurse-submodules")
+	c.Dir = dir
+	stderr := new(strings.Builder)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("list files tracked by git in %s: %s", dir, msg)
+		}
+		return nil, fmt.Errorf("list files tracked by git in %s: %v", dir, err)
+	}
+	tracked := make(map[string]struct{})
+	for _, name := range strings.Split(string(out), "\x00") {
+		for ; name != "" && name != "."; name = slashpath.Dir(name) {
+			if _, seen := tracked[name]; seen {
+				break
+			}
+			tracked[name] = struct{}{}
+		}
+	}
+	return tracked, nil
+}
+
+// dump writes the filtered NAR serialization of path to w.
+func (f *sourceFilter) dump(ctx context.Context, w io.Writer, path string) error {
+	opts := &parallelDumpOptions{
+		NormalizeNames: true,
+		CaseCollision:  f.caseCollision,
+	}
+	if f.gitignore != nil || f.tracked != nil {
+		opts.Prefilter = f.gitFilter
+	}
+	if f.filterIndex != 0 {
+		opts.Filter = f.luaFilter
+	}
+	return dumpPathParallel(ctx, w, path, opts)
+}
+
+// luaFilter calls the Lua filter function.
+func (f *sourceFilter) luaFilter(path string, mode fs.FileMode) (bool, error) {
+	f.l.PushValue(f.filterIndex)
+	f.l.PushString(path)
+	switch {
+	case mode.IsRegular():
+		f.l.PushString("regular")
+	case mode.IsDir():
+		f.l.PushString("directory")
+	case mode&fs.ModeSymlink != 0:
+		f.l.PushString("symlink")
+	default:
+		f.l.PushString("unknown")
+	}
+	if err := f.l.Call(2, 1, 0); err != nil {
+		f.l.Pop(1)
+		return false, fmt.Errorf("filter %s: %v", path, err)
+	}
+	ok := f.l.ToBoolean(-1)
+	f.l.Pop(1)
+	return ok, nil
+}
+
+// gitFilter reports whether path is tracked by Git and not ignored,
+// to the extent that the filter checks either.
+// Unlike the Lua filter, gitFilter is only a function of the file system,
+// so it can be used in computing stamps.
+func (f *sourceFilter) gitFilter(path string, mode fs.FileMode) (bool, error) {
+	if f.tracked != nil {
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := f.tracked[filepath.ToSlash(rel)]; !ok {
+			return false, nil
+		}
+	}
+	if f.gitignore != nil {
+		rel, err := filepath.Rel(f.gitRoot, path)
+		if err != nil {
+			return false, err
+		}
+		ignored, err := f.gitignore.Ignored(filepath.ToSlash(rel), mode.IsDir())
+		if ignored || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
 func (eval *Eval) toFileFunction(l *lua.State) (int, error) {
 	name, err := lua.CheckString(l, 1)
 	if err != nil {
@@ -93,13 +359,18 @@ func (eval *Eval) toFileFunction(l *lua.State) (int, error) {
 		return 0, err
 	}
 
+	for _, dep := range l.StringContext(2) {
+		if strings.HasPrefix(dep, "!") {
+			// Outputs that haven't been built yet don't have store paths,
+			// so the file's store path can't be known until build time.
+			return eval.toFileDerivation(l, name)
+		}
+	}
+
 	h := nix.NewHasher(nix.SHA256)
 	h.WriteString(s)
 	var refs storeReferences
 	for _, dep := range l.StringContext(2) {
-		if strings.HasPrefix(dep, "!") {
-			return 0, fmt.Errorf("toFile %q: cannot depend on derivation outputs", name)
-		}
 		refs.others.Add(nix.StorePath(dep))
 	}
 
@@ -108,7 +379,7 @@ func (eval *Eval) toFileFunction(l *lua.State) (int, error) {
 		return 0, fmt.Errorf("toFile %q: %v", name, err)
 	}
 
-	imp, err := startImport(context.TODO())
+	imp, err := eval.startImport(eval.traceContext())
 	if err != nil {
 		return 0, fmt.Errorf("toFile %q: %v", name, err)
 	}
@@ -132,23 +403,126 @@ func (eval *Eval) toFileFunction(l *lua.State) (int, error) {
 	return 1, nil
 }
 
-func writeSingleFileNAR(w io.Writer, r io.Reader, sz int64) error {
-	nw := nar.NewWriter(w)
-	if err := nw.WriteHeader(&nar.Header{Size: sz}); err != nil {
-		return err
+func (eval *Eval) storePathFunction(l *lua.State) (int, error) {
+	p, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	storePath, _, err := eval.storeDir.ParsePath(p)
+	if err != nil {
+		return 0, fmt.Errorf("storePath: %v", err)
+	}
+	if err := eval.ensureValid(eval.traceContext(), storePath); err != nil {
+		return 0, fmt.Errorf("storePath: %v", err)
+	}
+	l.PushStringContext(p, []string{string(storePath)})
+	return 1, nil
+}
+
+// readFileFunction implements the readFile built-in,
+// which returns the content of a source file or a file in the store.
+// The result has the same context as the path,
+// so reading a file from a store object keeps the dependency on it.
+// Files in the store are read from the store's real location
+// (see [Eval.SetStoreRoot]);
+// other files are recorded as sources (see [Eval.Sources]).
+func (eval *Eval) readFileFunction(l *lua.State) (int, error) {
+	p, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	context := l.StringContext(1)
+	for _, dep := range context {
+		if strings.HasPrefix(dep, "!") {
+			return 0, fmt.Errorf("readFile %s: import from derivation not supported", p)
+		}
+	}
+	p, err = eval.absSourcePath(l, p)
+	if err != nil {
+		return 0, fmt.Errorf("readFile: %v", err)
+	}
+	if err := eval.checkPurePath(p); err != nil {
+		return 0, fmt.Errorf("readFile: %v", err)
+	}
+	if storePath, _, err := eval.storeDir.ParsePath(p); err == nil {
+		// Like path, read store objects from where the store keeps them,
+		// substituting them first if necessary.
+		if err := eval.ensureValid(eval.traceContext(), storePath); err != nil {
+			return 0, fmt.Errorf("readFile: %v", err)
+		}
+	} else {
+		eval.recordSource(p)
+	}
+	data, err := os.ReadFile(eval.realPath(p))
+	if err != nil {
+		return 0, fmt.Errorf("readFile: %v", err)
+	}
+	l.PushStringContext(string(data), context)
+	return 1, nil
+}
+
+// textFileScript is the shell script that a derivation created by
+// [Eval.toFileDerivation] runs to write its output.
+const textFileScript = `printf '%s' "$text" > "$out"`
+
+// toFileDerivation creates a derivation that writes the string at index 2
+// to its output, substituting the paths of the derivation outputs it references.
+// The derivation runs /bin/sh, which the build sandbox provides,
+// on the same system as the derivations it depends on.
+// It pushes the output's placeholder with the output as its context.
+func (eval *Eval) toFileDerivation(l *lua.State, name string) (int, error) {
+	drv := &Derivation{
+		Dir:     eval.storeDir,
+		Name:    name,
+		Builder: "/bin/sh",
+		Args:    []string{"-c", textFileScript},
+		Env:     make(map[string]string),
+		Outputs: map[string]*DerivationOutput{
+			defaultDerivationOutputName: RecursiveFileFloatingCAOutput(nix.SHA256),
+		},
+	}
+	text, err := stringToEnvVar(l, drv, 2)
+	if err != nil {
+		return 0, fmt.Errorf("toFile %q: %v", name, err)
 	}
-	if _, err := io.Copy(nw, r); err != nil {
-		return err
+	if strings.Contains(text, "\x00") {
+		return 0, fmt.Errorf("toFile %q: content referencing derivation outputs cannot contain NUL bytes", name)
+	}
+	for drvPath := range drv.InputDerivations {
+		input, err := ReadDerivationFromRoot(eval.storeRoot, drvPath)
+		if err != nil {
+			return 0, fmt.Errorf("toFile %q: %v", name, err)
+		}
+		switch {
+		case drv.System == "":
+			drv.System = input.System
+		case drv.System != input.System:
+			return 0, fmt.Errorf("toFile %q: references outputs for both %s and %s", name, drv.System, input.System)
+		}
 	}
-	if err := nw.Close(); err != nil {
-		return err
+	drv.Env["name"] = drv.Name
+	drv.Env["system"] = drv.System
+	drv.Env["builder"] = drv.Builder
+	drv.Env["text"] = text
+	drv.Env[defaultDerivationOutputName] = HashPlaceholder(defaultDerivationOutputName)
+
+	drvPath, err := eval.writeDerivation(eval.traceContext(), drv)
+	if err != nil {
+		return 0, fmt.Errorf("toFile %q: %v", name, err)
 	}
-	return nil
+	l.PushStringContext(UnknownCAOutputPlaceholder(drvPath, defaultDerivationOutputName), []string{
+		"!" + defaultDerivationOutputName + "!" + string(drvPath),
+	})
+	return 1, nil
+}
+
+func writeSingleFileNAR(w io.Writer, r io.Reader, sz int64) error {
+	return writeSingleFileNARMode(w, r, sz, 0)
 }
 
 // absSourcePath takes a source path passed as an argument from Lua to Go
 // and resolves it relative to the calling function.
-func absSourcePath(l *lua.State, path string) (string, error) {
+func (eval *Eval) absSourcePath(l *lua.State, path string) (string, error) {
 	if filepath.IsAbs(path) {
 		return path, nil
 	}
@@ -164,7 +538,7 @@ func absSourcePath(l *lua.State, path string) (string, error) {
 		// TODO(someday): This is intended for --expr evaluation,
 		// but would take place for any chunk loaded with the "load" built-in.
 		// Perhaps an allow-list of sources?
-		path, err := filepath.Abs(filepath.FromSlash(path))
+		path, err := eval.abs(filepath.FromSlash(path))
 		if err != nil {
 			return "", fmt.Errorf("resolve path: %w", err)
 		}
@@ -0,0 +1,214 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+func TestToFileDerivation(t *testing.T) {
+	storeDir := nix.StoreDirectory(t.TempDir())
+	installFakeNixStore(t)
+	eval := NewEval(storeDir)
+	defer eval.Close()
+	const depExpr = `derivation { name = "dep"; system = "x86_64-linux"; builder = "/bin/sh" }`
+	results, err := eval.Expression(depExpr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dep := results[0].(*Derivation)
+	// The fake nix-store discards imports, so write the derivation to the store directly.
+	depPath, data, err := dep.export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(string(depPath), data, 0o444); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = eval.Expression(`toFile("wrapper.sh", "exec "..(`+depExpr+`).out.."/bin/dep\n")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := "exec " + UnknownCAOutputPlaceholder(depPath, "out") + "/bin/dep\n"
+	wantDrv := &Derivation{
+		Dir:     storeDir,
+		Name:    "wrapper.sh",
+		System:  "x86_64-linux",
+		Builder: "/bin/sh",
+		Args:    []string{"-c", textFileScript},
+		Env: map[string]string{
+			"name":    "wrapper.sh",
+			"system":  "x86_64-linux",
+			"builder": "/bin/sh",
+			"text":    text,
+			"out":     HashPlaceholder("out"),
+		},
+		InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+			depPath: sortedset.New("out"),
+		},
+		Outputs: map[string]*DerivationOutput{
+			"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+		},
+	}
+	wantDrvPath, err := wantDrv.StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{UnknownCAOutputPlaceholder(wantDrvPath, "out")}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("toFile(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestStorePath(t *testing.T) {
+	const storeDir = "/zb/store"
+	const hello = storeDir + "/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"
+	logPath := installFakeNixStore(t)
+	eval := NewEval(storeDir)
+	defer eval.Close()
+
+	results, err := eval.Expression(`storePath("`+hello+`/bin/hello")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]any{hello + "/bin/hello"}, results); diff != "" {
+		t.Errorf("storePath(...) (-want +got):\n%s", diff)
+	}
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(log), "--realise -- "+hello+"\n"; got != want {
+		t.Errorf("nix-store invocations = %q; want %q", got, want)
+	}
+
+	for _, bad := range []string{"/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1", storeDir, "hello"} {
+		if _, err := eval.Expression(`storePath("`+bad+`")`, nil); err == nil {
+			t.Errorf("storePath(%q) did not return an error", bad)
+		}
+	}
+}
+
+// installFakeNixStore puts a nix-store program in PATH
+// that discards the store objects imported into it.
+// It returns the path to a file that the program appends its arguments to,
+// one invocation per line.
+func installFakeNixStore(tb testing.TB) (logPath string) {
+	tb.Helper()
+	if runtime.GOOS == "windows" {
+		tb.Skip("fake nix-store is a shell script")
+	}
+	binDir := tb.TempDir()
+	logPath = filepath.Join(binDir, "nix-store.log")
+	script := "#!/bin/sh\necho \"$*\" >> '" + logPath + "'\ncat > /dev/null\n"
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(script), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Setenv("PATH", binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return logPath
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("Hello, World!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	mainPath := filepath.Join(dir, "main.lua")
+	if err := os.WriteFile(mainPath, []byte(`return readFile("hello.txt")`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	results, err := eval.File(mainPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != "Hello, World!\n" {
+		t.Errorf("readFile(\"hello.txt\") = %#v; want %q", results, "Hello, World!\n")
+	}
+
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	if err := os.WriteFile(outside, []byte("secret\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	eval.SetPureEval(true)
+	if err := eval.SetLockfile(filepath.Join(dir, LockfileName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eval.File(mainPath, nil); err != nil {
+		t.Errorf("pure readFile inside project root: %v", err)
+	}
+	if _, err := eval.Expression(`readFile("`+filepath.ToSlash(outside)+`")`, nil); err == nil {
+		t.Error("pure readFile outside project root did not fail")
+	}
+}
+
+func TestReadFileStoreRoot(t *testing.T) {
+	logPath := installFakeNixStore(t)
+	const storeDir nix.StoreDirectory = "/zb/store"
+	storePath := storeDir.Join("s5fm3mqx08mlmlbnnvsm2zqfixn1wxma-hello")
+	root := t.TempDir()
+	realDir := filepath.Join(root, string(storePath))
+	if err := os.MkdirAll(realDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(realDir, "greeting.txt"), []byte("Hello, World!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	eval := NewEval(storeDir)
+	defer eval.Close()
+	eval.SetStoreRoot(root)
+	results, err := eval.Expression(`readFile("`+string(storePath)+`/greeting.txt")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != "Hello, World!\n" {
+		t.Errorf("readFile(...) = %#v; want %q", results, "Hello, World!\n")
+	}
+	if got := eval.Sources(); len(got) > 0 {
+		t.Errorf("Sources() = %q; want none", got)
+	}
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "--realise -- "+string(storePath)) {
+		t.Errorf("nix-store invocations:\n%s\nwant --realise of %s", log, storePath)
+	}
+}
+
+func TestPathCaseCollision(t *testing.T) {
+	storeDir := nix.StoreDirectory(t.TempDir())
+	installFakeNixStore(t)
+	src := t.TempDir()
+	for _, name := range []string{"README", "readme"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eval := NewEval(storeDir)
+	defer eval.Close()
+
+	if _, err := eval.Expression(`path("`+src+`")`, nil); err != nil {
+		t.Fatal(err)
+	}
+	warnings := eval.Warnings()
+	if len(warnings) != 1 || warnings[0].Category != WarningCategoryPortability {
+		t.Errorf("warnings = %v; want one %s warning", warnings, WarningCategoryPortability)
+	}
+
+	if _, err := eval.Expression(`path { path = "`+src+`"; portable = true }`, nil); err == nil {
+		t.Error("path with portable = true did not return an error")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"zombiezen.com/go/nix"
+)
+
+// racyStampWindow is how close to the time of a walk
+// a file's modification time must be for its stamp to be untrustworthy.
+// A file modified within the file system's timestamp granularity
+// of when it was stamped could change again without changing its stamp.
+const racyStampWindow = 2 * time.Second
+
+// A pathStamp summarizes the metadata of every file in a file tree.
+// If a tree's stamp is unchanged, its contents are assumed to be unchanged.
+type pathStamp [sha256.Size]byte
+
+// walkPath computes the stamp of the file tree rooted at path
+// from the names, types, and permissions of its files
+// and the sizes and modification times of its non-directories.
+// Files for which filter returns false are skipped, as are their children.
+// filter may be nil to include all files.
+// ok is false if any file was modified too recently (relative to now)
+// for the stamp to be trusted.
+func walkPath(path string, now time.Time, filter func(path string, mode fs.FileMode) (bool, error)) (stamp pathStamp, ok bool, err error) {
+	h := sha256.New()
+	ok = true
+	var buf []byte
+	err = filepath.WalkDir(path, func(p string, ent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return err
+		}
+		if filter != nil && p != path {
+			include, err := filter(p, info.Mode())
+			if err != nil {
+				return err
+			}
+			if !include {
+				if ent.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		buf = binary.LittleEndian.AppendUint64(buf[:0], uint64(len(rel)))
+		buf = append(buf, rel...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(info.Mode()))
+		// A directory's contents are captured by its entries.
+		// Its modification time also changes when excluded entries are added,
+		// so it is not part of the stamp.
+		if !ent.IsDir() {
+			mtime := info.ModTime()
+			if now.Sub(mtime) < racyStampWindow {
+				ok = false
+			}
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(info.Size()))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(mtime.UnixNano()))
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(len(target)))
+			buf = append(buf, target...)
+		}
+		h.Write(buf)
+		return nil
+	})
+	if err != nil {
+		return pathStamp{}, false, err
+	}
+	h.Sum(stamp[:0])
+	return stamp, ok, nil
+}
+
+// pathCacheKey identifies a source import.
+type pathCacheKey struct {
+	path      string
+	name      string
+	gitignore bool
+	git       bool
+	portable  bool
+}
+
+// pathCacheEntry is a previously imported source tree.
+type pathCacheEntry struct {
+	stamp     pathStamp
+	storePath nix.StorePath
+}
+
+// cachedPath returns the store path that the given source tree
+// was last imported as if the tree has not changed since
+// and the store object is still present.
+func (eval *Eval) cachedPath(key pathCacheKey, stamp pathStamp) (nix.StorePath, bool) {
+	ent, ok := eval.pathCache[key]
+	if !ok || ent.stamp != stamp {
+		return "", false
+	}
+	if _, err := os.Lstat(eval.realPath(string(ent.storePath))); err != nil {
+		delete(eval.pathCache, key)
+		return "", false
+	}
+	return ent.storePath, true
+}
+
+// SourceDir returns the local file or directory
+// that the path function imported as the given store object,
+// if the evaluator has a record of the import in its path cache
+// (see [Eval.SetPathCacheMode]).
+// Imports with filter functions or in content mode are not recorded.
+func (eval *Eval) SourceDir(storePath nix.StorePath) (string, bool) {
+	for key, ent := range eval.pathCache {
+		if ent.storePath == storePath {
+			return key.path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalkPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-1 * time.Hour)
+	for _, p := range []string{file, filepath.Join(dir, "sub"), dir} {
+		if err := os.Chtimes(p, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	stamp1, ok, err := walkPath(dir, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("walkPath reported an old tree as racy")
+	}
+	stamp2, _, err := walkPath(dir, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp1 != stamp2 {
+		t.Error("stamp changed without modifications")
+	}
+
+	if err := os.WriteFile(file, []byte("Goodbye, World!\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stamp3, ok, err := walkPath(dir, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp3 == stamp1 {
+		t.Error("stamp unchanged after modifying a file")
+	}
+	if ok {
+		t.Error("walkPath did not report a just-modified tree as racy")
+	}
+
+	if err := os.Chtimes(file, past, past); err != nil {
+		t.Fatal(err)
+	}
+	stamp4, _, err := walkPath(dir, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stamp5, _, err := walkPath(dir, time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp5 == stamp4 {
+		t.Error("stamp unchanged after changing a file's permissions")
+	}
+}
+
+func TestWalkPathGitignore(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.tmp\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := newSourceFilter(context.Background(), nil, dir, &sourceFilterOptions{gitignore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamp1, _, err := walkPath(dir, time.Now(), filter.gitFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scratch.tmp"), []byte("junk\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".git", "index"), []byte("junk\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stamp2, _, err := walkPath(dir, time.Now(), filter.gitFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp1 != stamp2 {
+		t.Error("stamp changed after adding ignored files")
+	}
+}
+
+func TestGitTrackedFiles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	runGit := func(args ...string) {
+		t.Helper()
+		c := exec.Command("git", args...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	runGit("init", "--quiet")
+	for _, name := range []string{"main.go", "sub/lib.go", "untracked.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runGit("add", "main.go", "sub/lib.go")
+
+	got, err := gitTrackedFiles(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct{}{
+		"main.go":    {},
+		"sub":        {},
+		"sub/lib.go": {},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("gitTrackedFiles(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestParsePathCacheMode(t *testing.T) {
+	for _, mode := range []PathCacheMode{PathCacheStamp, PathCacheContent} {
+		got, err := ParsePathCacheMode(mode.String())
+		if got != mode || err != nil {
+			t.Errorf("ParsePathCacheMode(%q) = %v, %v; want %v, <nil>", mode.String(), got, err, mode)
+		}
+	}
+	if got, err := ParsePathCacheMode("mtime"); err == nil {
+		t.Errorf("ParsePathCacheMode(\"mtime\") = %v, <nil>; want error", got)
+	}
+}
+
+func TestSourceDir(t *testing.T) {
+	const storePath = "/nix/store/00000000000000000000000000000000-src"
+	eval := &Eval{
+		pathCache: map[pathCacheKey]pathCacheEntry{
+			{path: "/home/alice/proj/src", name: "src"}: {storePath: storePath},
+		},
+	}
+	if got, ok := eval.SourceDir(storePath); got != "/home/alice/proj/src" || !ok {
+		t.Errorf("SourceDir(%q) = %q, %t; want \"/home/alice/proj/src\", true", storePath, got, ok)
+	}
+	const other = "/nix/store/11111111111111111111111111111111-src"
+	if got, ok := eval.SourceDir(other); ok {
+		t.Errorf("SourceDir(%q) = %q, true; want false", other, got)
+	}
+}
@@ -59,3 +59,32 @@ function table.concatLists(...)
   end
   return result
 end
+
+---@param f fun(pkgs: table): table
+---@param platforms {build: string, host: string?, target: string?}
+---@return table
+function splice(f, platforms)
+  local sets = {}
+  local function get(build, host, target)
+    local key = build.."\0"..host.."\0"..target
+    local pkgs = sets[key]
+    if pkgs then return pkgs end
+    pkgs = setmetatable({
+      platforms = { build = build; host = host; target = target };
+    }, {
+      __index = function(t, k)
+        if k ~= "buildPackages" then return nil end
+        local buildPkgs = get(build, build, host)
+        rawset(t, k, buildPkgs)
+        return buildPkgs
+      end;
+    })
+    sets[key] = pkgs
+    for k, v in pairs(f(pkgs)) do
+      pkgs[k] = v
+    end
+    return pkgs
+  end
+  local host = platforms.host or platforms.build
+  return get(platforms.build, host, platforms.target or host)
+end
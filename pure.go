@@ -0,0 +1,126 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"zombiezen.com/go/zb/internal/lua"
+)
+
+// SetPureEval sets whether evaluation is restricted to operations
+// that produce the same results on any machine.
+// In pure evaluation mode:
+//
+//   - Lua files and sources passed to path must be inside the project root
+//     (the directory containing the lockfile passed to [Eval.SetLockfile],
+//     or the working directory if there is none)
+//     or the store.
+//   - os.getenv raises an error.
+//   - Inputs and imports must be recorded in the lockfile,
+//     and fetchGit must be given a hash.
+func (eval *Eval) SetPureEval(pure bool) {
+	eval.pureEval = pure
+}
+
+// projectRoot returns the directory that pure evaluation is restricted to.
+func (eval *Eval) projectRoot() (string, error) {
+	if eval.lockfilePath != "" {
+		return filepath.Dir(eval.lockfilePath), nil
+	}
+	if eval.dir != "" {
+		return eval.dir, nil
+	}
+	return os.Getwd()
+}
+
+// checkPurePath returns an error if the evaluator is in pure evaluation mode
+// and the absolute path p is outside the project root and the store.
+// Symlinks in p and the project root are resolved before comparing,
+// so a symlink inside the project cannot point outside of it.
+func (eval *Eval) checkPurePath(p string) error {
+	if !eval.pureEval {
+		return nil
+	}
+	if isSubpath(string(eval.storeDir), p) {
+		// Store objects are immutable,
+		// so reading through their symlinks is still pure.
+		return nil
+	}
+	root, err := eval.projectRoot()
+	if err != nil {
+		return fmt.Errorf("pure evaluation: %v", err)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("pure evaluation: %v", err)
+	}
+	realP, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing can be read from a path that does not exist,
+		// so report the error from the read instead.
+		realP, err = p, nil
+		realRoot = root
+	}
+	if err != nil {
+		return fmt.Errorf("pure evaluation: %v", err)
+	}
+	if !isSubpath(realRoot, realP) {
+		return fmt.Errorf("%s is outside the project root %s (not allowed in pure evaluation mode)", p, root)
+	}
+	return nil
+}
+
+// checkPureFetch returns an error if the evaluator is in pure evaluation mode,
+// which forbids fetching resources that are not pinned to a hash.
+// what describes the fetch for the error message.
+func (eval *Eval) checkPureFetch(what string) error {
+	if !eval.pureEval {
+		return nil
+	}
+	return fmt.Errorf("%s is not pinned (not allowed in pure evaluation mode)", what)
+}
+
+// isSubpath reports whether the absolute path p is dir or inside dir.
+func isSubpath(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// openOS loads the evaluator's os library,
+// which only provides access to environment variables.
+func (eval *Eval) openOS(l *lua.State) (int, error) {
+	err := lua.NewLib(l, map[string]lua.Function{
+		"getenv": eval.getenvFunction,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (eval *Eval) getenvFunction(l *lua.State) (int, error) {
+	k, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if eval.pureEval {
+		return 0, fmt.Errorf("os.getenv %q: not allowed in pure evaluation mode", k)
+	}
+	v, ok := os.LookupEnv(k)
+	if !ok {
+		l.PushNil()
+		return 1, nil
+	}
+	l.PushString(v)
+	return 1, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestPureEval(t *testing.T) {
+	dir := t.TempDir()
+	projectDir := filepath.Join(dir, "project")
+	if err := os.Mkdir(projectDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(projectDir, "lib.lua"): `return "inside"`,
+		filepath.Join(dir, "outside.lua"):    `return "outside"`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(projectDir, "escape.lua"): filepath.Join("..", "outside.lua"),
+		filepath.Join(projectDir, "parent"):     "..",
+		filepath.Join(projectDir, "alias.lua"):  "lib.lua",
+	}
+	for path, target := range links {
+		if err := os.Symlink(target, path); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	t.Setenv("ZB_TEST_PURE", "hello")
+
+	tests := []struct {
+		name       string
+		source     string
+		want       any
+		pureErr    string
+		impureWant any
+	}{
+		{
+			name:   "InsideFile",
+			source: `return dofile("lib.lua")`,
+			want:   "inside",
+		},
+		{
+			name:       "OutsideFile",
+			source:     `return dofile("../outside.lua")`,
+			pureErr:    "outside the project root",
+			impureWant: "outside",
+		},
+		{
+			name:       "OutsidePath",
+			source:     `return path("../outside.lua")`,
+			pureErr:    "outside the project root",
+			impureWant: nil,
+		},
+		{
+			name:       "SymlinkOutsideFile",
+			source:     `return dofile("escape.lua")`,
+			pureErr:    "outside the project root",
+			impureWant: "outside",
+		},
+		{
+			name:       "SymlinkOutsideDirectory",
+			source:     `return readFile("parent/outside.lua")`,
+			pureErr:    "outside the project root",
+			impureWant: `return "outside"`,
+		},
+		{
+			name:   "SymlinkInsideFile",
+			source: `return dofile("alias.lua")`,
+			want:   "inside",
+		},
+		{
+			name:       "Getenv",
+			source:     `return os.getenv("ZB_TEST_PURE")`,
+			pureErr:    "not allowed in pure evaluation mode",
+			impureWant: "hello",
+		},
+		{
+			name:       "UnlockedInput",
+			source:     `return input("foo", { url = "zb-test-unregistered:foo" })`,
+			pureErr:    "not pinned",
+			impureWant: nil,
+		},
+		{
+			name:       "UnpinnedGit",
+			source:     `return fetchGit({ url = "/nonexistent", rev = "` + strings.Repeat("0", 40) + `" })`,
+			pureErr:    "not pinned",
+			impureWant: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mainPath := filepath.Join(projectDir, "main.lua")
+			if err := os.WriteFile(mainPath, []byte(test.source), 0o666); err != nil {
+				t.Fatal(err)
+			}
+			for _, pure := range []bool{true, false} {
+				eval := NewEval(nix.StoreDirectory(t.TempDir()))
+				if err := eval.SetLockfile(filepath.Join(projectDir, LockfileName)); err != nil {
+					t.Fatal(err)
+				}
+				eval.SetPureEval(pure)
+				results, err := eval.File(mainPath, nil)
+				eval.Close()
+
+				if pure && test.pureErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.pureErr) {
+						t.Errorf("pure evaluation error = %v; want %q", err, test.pureErr)
+					}
+					continue
+				}
+				want := test.want
+				if !pure && test.pureErr != "" {
+					want = test.impureWant
+					if want == nil {
+						// Only checking that pure mode was the cause of the failure.
+						if err != nil && strings.Contains(err.Error(), test.pureErr) {
+							t.Errorf("impure evaluation error = %v", err)
+						}
+						continue
+					}
+				}
+				if err != nil {
+					t.Errorf("evaluation (pure=%t): %v", pure, err)
+					continue
+				}
+				if len(results) != 1 || results[0] != want {
+					t.Errorf("evaluation (pure=%t) = %#v; want [%#v]", pure, results, want)
+				}
+			}
+		})
+	}
+}
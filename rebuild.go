@@ -0,0 +1,343 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// A RebuildCause is a single difference between two versions of a derivation
+// that causes the newer version to be rebuilt.
+type RebuildCause struct {
+	// Chain is the sequence of derivation names
+	// from the requested derivation to the derivation that differs.
+	Chain []string
+	// Reason is a human-readable description of the difference.
+	Reason string
+}
+
+func (cause RebuildCause) String() string {
+	return strings.Join(cause.Chain, " → ") + ": " + cause.Reason
+}
+
+// ExplainRebuildOptions is the set of optional parameters to [ExplainRebuild].
+type ExplainRebuildOptions struct {
+	// RealPath returns the location in the local file system
+	// of the absolute path p inside the store directory.
+	// If nil, store objects are read from their store paths.
+	RealPath func(p string) string
+	// SourceDir returns the local file or directory
+	// that a source store object was imported from, if known
+	// (see [Eval.SourceDir]).
+	// It is used to name changed files by their location in the project
+	// rather than in the store.
+	// If nil, changed files are named relative to the source.
+	SourceDir func(path nix.StorePath) (string, bool)
+}
+
+// maxSourceFileChanges is the number of changed files
+// that ExplainRebuild lists for each source.
+const maxSourceFileChanges = 10
+
+// ExplainRebuild compares a derivation against an older version of itself
+// and returns the differences that cause the derivation to be rebuilt.
+// Input derivations that differ are compared recursively
+// (matching inputs by name),
+// so the returned causes point at the deepest changes.
+// If both versions of a changed source are present in the store,
+// their files are compared to name the files that changed.
+// readDerivation is used to load input derivations.
+// opts may be nil to use the defaults.
+// ExplainRebuild returns an empty list if the derivations are identical.
+func ExplainRebuild(oldDrv, newDrv *Derivation, readDerivation func(nix.StorePath) (*Derivation, error), opts *ExplainRebuildOptions) ([]RebuildCause, error) {
+	e := &rebuildExplainer{
+		read:    readDerivation,
+		visited: make(map[[2]nix.StorePath]struct{}),
+	}
+	if opts != nil {
+		e.opts = *opts
+	}
+	if err := e.compare([]string{newDrv.Name}, oldDrv, newDrv); err != nil {
+		return e.causes, err
+	}
+	return e.causes, nil
+}
+
+type rebuildExplainer struct {
+	read    func(nix.StorePath) (*Derivation, error)
+	opts    ExplainRebuildOptions
+	visited map[[2]nix.StorePath]struct{}
+	causes  []RebuildCause
+}
+
+func (e *rebuildExplainer) add(chain []string, format string, args ...any) {
+	e.causes = append(e.causes, RebuildCause{
+		Chain:  slices.Clone(chain),
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func (e *rebuildExplainer) compare(chain []string, oldDrv, newDrv *Derivation) error {
+	// Strings in the new derivation will naturally refer to the new inputs.
+	// Build a replacer that maps references to old inputs to their new counterparts
+	// so that only changes introduced by this derivation are reported below.
+	var rewrites []string
+
+	oldInputs := inputDerivationsByName(oldDrv)
+	newInputs := inputDerivationsByName(newDrv)
+	for _, name := range sortedKeys(oldInputs) {
+		oldPath := oldInputs[name]
+		newPath, ok := newInputs[name]
+		if !ok {
+			e.add(chain, "input derivation %s removed", oldPath)
+			continue
+		}
+		if oldPath == newPath {
+			continue
+		}
+		outputs := oldDrv.InputDerivations[oldPath]
+		for i := 0; i < outputs.Len(); i++ {
+			outName := outputs.At(i)
+			rewrites = append(rewrites,
+				UnknownCAOutputPlaceholder(oldPath, outName),
+				UnknownCAOutputPlaceholder(newPath, outName),
+			)
+		}
+		rewrites = append(rewrites, string(oldPath), string(newPath))
+
+		key := [2]nix.StorePath{oldPath, newPath}
+		if _, seen := e.visited[key]; seen {
+			continue
+		}
+		e.visited[key] = struct{}{}
+		oldInput, err := e.read(oldPath)
+		if err != nil {
+			return err
+		}
+		newInput, err := e.read(newPath)
+		if err != nil {
+			return err
+		}
+		n := len(e.causes)
+		if err := e.compare(append(chain, name), oldInput, newInput); err != nil {
+			return err
+		}
+		if len(e.causes) == n {
+			e.add(chain, "input derivation %s changed to %s", oldPath, newPath)
+		}
+	}
+	for _, name := range sortedKeys(newInputs) {
+		if _, ok := oldInputs[name]; !ok {
+			e.add(chain, "input derivation %s added", newInputs[name])
+		}
+	}
+
+	oldSources := inputSourcesByName(oldDrv)
+	newSources := inputSourcesByName(newDrv)
+	for _, name := range sortedKeys(oldSources) {
+		oldPath := oldSources[name]
+		newPath, ok := newSources[name]
+		switch {
+		case !ok:
+			e.add(chain, "source %s removed", oldPath)
+		case oldPath != newPath:
+			e.compareSources(chain, name, oldPath, newPath)
+			rewrites = append(rewrites, string(oldPath), string(newPath))
+		}
+	}
+	for _, name := range sortedKeys(newSources) {
+		if _, ok := oldSources[name]; !ok {
+			e.add(chain, "source %s added", newSources[name])
+		}
+	}
+
+	rewrite := strings.NewReplacer(rewrites...).Replace
+	if oldDrv.System != newDrv.System {
+		e.add(chain, "system changed from %q to %q", oldDrv.System, newDrv.System)
+	}
+	if rewrite(oldDrv.Builder) != newDrv.Builder {
+		e.add(chain, "builder changed from %q to %q", oldDrv.Builder, newDrv.Builder)
+	}
+	if !slices.EqualFunc(oldDrv.Args, newDrv.Args, func(oldArg, newArg string) bool {
+		return rewrite(oldArg) == newArg
+	}) {
+		e.add(chain, "arguments changed")
+	}
+	for _, k := range sortedKeys(oldDrv.Env) {
+		newValue, ok := newDrv.Env[k]
+		switch {
+		case !ok:
+			e.add(chain, "environment variable %s removed", k)
+		case rewrite(oldDrv.Env[k]) != newValue:
+			e.add(chain, "environment variable %s changed from %q to %q", k, oldDrv.Env[k], newValue)
+		}
+	}
+	for _, k := range sortedKeys(newDrv.Env) {
+		if _, ok := oldDrv.Env[k]; !ok {
+			e.add(chain, "environment variable %s added", k)
+		}
+	}
+	return nil
+}
+
+// compareSources adds the differences between two versions of a source.
+func (e *rebuildExplainer) compareSources(chain []string, name string, oldPath, newPath nix.StorePath) {
+	realPath := e.opts.RealPath
+	if realPath == nil {
+		realPath = func(p string) string { return p }
+	}
+	changes, err := diffSourceTrees(realPath(string(oldPath)), realPath(string(newPath)))
+	if err != nil || len(changes) == 0 {
+		// The old version is usually gone after garbage collection.
+		e.add(chain, "source %s changed (%s → %s)", name, oldPath.Digest(), newPath.Digest())
+		return
+	}
+	localDir, hasLocalDir := "", false
+	if e.opts.SourceDir != nil {
+		localDir, hasLocalDir = e.opts.SourceDir(newPath)
+	}
+	for i, c := range changes {
+		if i == maxSourceFileChanges {
+			e.add(chain, "source %s changed: %d more files differ", name, len(changes)-i)
+			break
+		}
+		file := c.name
+		switch {
+		case hasLocalDir:
+			file = filepath.Join(localDir, filepath.FromSlash(c.name))
+		case c.name == ".":
+			file = name
+		default:
+			file = name + "/" + c.name
+		}
+		e.add(chain, "source %s changed: %s %s", name, file, c.kind)
+	}
+}
+
+// A sourceFileChange is a difference between two versions of a source tree.
+type sourceFileChange struct {
+	// name is the slash-separated path of the file relative to the tree's root.
+	// It is "." for the root itself.
+	name string
+	// kind is "added", "removed", "modified", or "changed type".
+	kind string
+}
+
+// diffSourceTrees compares the files in two file trees
+// and returns the files that differ, sorted by name.
+func diffSourceTrees(oldRoot, newRoot string) ([]sourceFileChange, error) {
+	oldFiles, err := sourceTreeDigests(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := sourceTreeDigests(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	var changes []sourceFileChange
+	for _, name := range sortedKeys(oldFiles) {
+		newFile, ok := newFiles[name]
+		oldFile := oldFiles[name]
+		switch {
+		case !ok:
+			changes = append(changes, sourceFileChange{name, "removed"})
+		case oldFile.mode.Type() != newFile.mode.Type():
+			changes = append(changes, sourceFileChange{name, "changed type"})
+		case oldFile != newFile:
+			changes = append(changes, sourceFileChange{name, "modified"})
+		}
+	}
+	for _, name := range sortedKeys(newFiles) {
+		if _, ok := oldFiles[name]; !ok {
+			changes = append(changes, sourceFileChange{name, "added"})
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b sourceFileChange) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return changes, nil
+}
+
+// sourceFileDigest summarizes the parts of a file that a store object preserves.
+type sourceFileDigest struct {
+	mode fs.FileMode
+	// hash is the SHA-256 hash of a regular file's content
+	// or a symlink's target.
+	hash [sha256.Size]byte
+}
+
+// sourceTreeDigests returns the digests of every file in the tree at root
+// keyed by their slash-separated path relative to root.
+// Directories are only recorded by their presence.
+func sourceTreeDigests(root string) (map[string]sourceFileDigest, error) {
+	files := make(map[string]sourceFileDigest)
+	err := filepath.WalkDir(root, func(p string, ent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return err
+		}
+		// Store objects only preserve the executable bit.
+		d := sourceFileDigest{mode: info.Mode().Type()}
+		switch {
+		case ent.Type() == fs.ModeSymlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			d.hash = sha256.Sum256([]byte(target))
+		case ent.Type().IsRegular():
+			d.mode |= info.Mode().Perm() & 0o100
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			h.Sum(d.hash[:0])
+		}
+		files[filepath.ToSlash(rel)] = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func inputDerivationsByName(drv *Derivation) map[string]nix.StorePath {
+	m := make(map[string]nix.StorePath, len(drv.InputDerivations))
+	for p := range drv.InputDerivations {
+		m[strings.TrimSuffix(p.Name(), ".drv")] = p
+	}
+	return m
+}
+
+func inputSourcesByName(drv *Derivation) map[string]nix.StorePath {
+	m := make(map[string]nix.StorePath, drv.InputSources.Len())
+	for i := 0; i < drv.InputSources.Len(); i++ {
+		p := drv.InputSources.At(i)
+		m[p.Name()] = p
+	}
+	return m
+}
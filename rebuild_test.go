@@ -0,0 +1,166 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+func TestExplainRebuild(t *testing.T) {
+	const dir = nix.DefaultStoreDirectory
+	newSource := func(name, content string) nix.StorePath {
+		p, err := fixedCAOutputPath(dir, name, nix.TextContentAddress(hashString(nix.SHA256, content)), storeReferences{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newLeaf := func(src nix.StorePath) *Derivation {
+		return &Derivation{
+			Dir:          dir,
+			Name:         "leaf",
+			System:       "x86_64-linux",
+			Builder:      "/bin/sh",
+			Args:         []string{"-c", "cp $src $out"},
+			Env:          map[string]string{"src": string(src), "out": HashPlaceholder("out")},
+			InputSources: *sortedset.New(src),
+			Outputs: map[string]*DerivationOutput{
+				"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+			},
+		}
+	}
+	newTop := func(leafPath nix.StorePath, extra string) *Derivation {
+		return &Derivation{
+			Dir:     dir,
+			Name:    "top",
+			System:  "x86_64-linux",
+			Builder: "/bin/sh",
+			Args:    []string{"-c", "cp $leaf $out"},
+			Env: map[string]string{
+				"leaf":  UnknownCAOutputPlaceholder(leafPath, "out"),
+				"extra": extra,
+				"out":   HashPlaceholder("out"),
+			},
+			InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+				leafPath: sortedset.New("out"),
+			},
+			Outputs: map[string]*DerivationOutput{
+				"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+			},
+		}
+	}
+
+	oldLeaf := newLeaf(newSource("hello.txt", "Hello\n"))
+	newLeafDrv := newLeaf(newSource("hello.txt", "Hello, World!\n"))
+	drvs := make(map[nix.StorePath]*Derivation)
+	for _, drv := range []*Derivation{oldLeaf, newLeafDrv} {
+		p, err := drv.StorePath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		drvs[p] = drv
+	}
+	read := func(p nix.StorePath) (*Derivation, error) {
+		drv := drvs[p]
+		if drv == nil {
+			return nil, fmt.Errorf("%s not found", p)
+		}
+		return drv, nil
+	}
+	oldLeafPath, _ := oldLeaf.StorePath()
+	newLeafPath, _ := newLeafDrv.StorePath()
+
+	got, err := ExplainRebuild(newTop(oldLeafPath, "a"), newTop(newLeafPath, "b"), read, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RebuildCause{
+		{
+			Chain:  []string{"top", "leaf"},
+			Reason: fmt.Sprintf("source hello.txt changed (%s → %s)", oldLeaf.InputSources.At(0).Digest(), newLeafDrv.InputSources.At(0).Digest()),
+		},
+		{
+			Chain:  []string{"top"},
+			Reason: `environment variable extra changed from "a" to "b"`,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExplainRebuild(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestExplainRebuildSourceFiles(t *testing.T) {
+	const dir = nix.DefaultStoreDirectory
+	const (
+		oldSrc nix.StorePath = "/nix/store/00000000000000000000000000000000-src"
+		newSrc nix.StorePath = "/nix/store/11111111111111111111111111111111-src"
+	)
+	root := t.TempDir()
+	writeFiles := func(storePath nix.StorePath, files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			p := filepath.Join(root, string(storePath), filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0o777); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte(content), 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeFiles(oldSrc, map[string]string{
+		"a.txt":     "1",
+		"b.txt":     "same",
+		"sub/c.txt": "gone",
+	})
+	writeFiles(newSrc, map[string]string{
+		"a.txt": "2",
+		"b.txt": "same",
+		"d.txt": "new",
+	})
+	newDrv := func(src nix.StorePath) *Derivation {
+		return &Derivation{
+			Dir:          dir,
+			Name:         "leaf",
+			System:       "x86_64-linux",
+			Builder:      "/bin/sh",
+			Args:         []string{"-c", "cp -r $src $out"},
+			Env:          map[string]string{"src": string(src), "out": HashPlaceholder("out")},
+			InputSources: *sortedset.New(src),
+			Outputs: map[string]*DerivationOutput{
+				"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+			},
+		}
+	}
+	read := func(p nix.StorePath) (*Derivation, error) {
+		return nil, fmt.Errorf("%s not found", p)
+	}
+
+	got, err := ExplainRebuild(newDrv(oldSrc), newDrv(newSrc), read, &ExplainRebuildOptions{
+		RealPath: func(p string) string { return filepath.Join(root, p) },
+		SourceDir: func(p nix.StorePath) (string, bool) {
+			return filepath.Join("proj", "src"), p == newSrc
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []string{"leaf"}
+	want := []RebuildCause{
+		{Chain: chain, Reason: "source src changed: " + filepath.Join("proj", "src", "a.txt") + " modified"},
+		{Chain: chain, Reason: "source src changed: " + filepath.Join("proj", "src", "d.txt") + " added"},
+		{Chain: chain, Reason: "source src changed: " + filepath.Join("proj", "src", "sub") + " removed"},
+		{Chain: chain, Reason: "source src changed: " + filepath.Join("proj", "src", "sub", "c.txt") + " removed"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ExplainRebuild(...) (-want +got):\n%s", diff)
+	}
+}
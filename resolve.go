@@ -0,0 +1,194 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// ResolveDerivation returns a copy of drv that refers to the outputs
+// of its input derivations by their store paths
+// instead of through the input derivations.
+// Placeholders for the outputs of floating content-addressed input derivations
+// are replaced by the outputs' realized paths
+// and the paths are moved to the resolved derivation's input sources.
+// The paths of deferred outputs (see [DeferredOutput])
+// are computed from the resolved derivation.
+//
+// Resolution is applied recursively:
+// the realization of a floating content-addressed input derivation's output
+// is looked up by the hash of the resolved input derivation,
+// so a change to a deep dependency that produces identical output
+// does not change the hash of the resolved derivation.
+// readDerivation is used to load input derivations.
+// realization returns the path that the output of a derivation
+// with the given hash was realized as
+// or false if the output has not been realized.
+//
+// ok is false if the path of any input derivation output that drv uses
+// is not known.
+func ResolveDerivation(drv *Derivation, readDerivation func(nix.StorePath) (*Derivation, error), realization func(drvHash nix.Hash, outputName string) (nix.StorePath, bool, error)) (resolved *Derivation, ok bool, err error) {
+	r := &resolver{
+		read:        readDerivation,
+		realization: realization,
+		inputs:      make(map[nix.StorePath]*resolverInput),
+	}
+	return r.resolve(drv)
+}
+
+type resolver struct {
+	read        func(nix.StorePath) (*Derivation, error)
+	realization func(drvHash nix.Hash, outputName string) (nix.StorePath, bool, error)
+	inputs      map[nix.StorePath]*resolverInput
+	// stack is the chain of input derivations being resolved.
+	stack []nix.StorePath
+}
+
+// resolverInput is an input derivation that the resolver has read.
+type resolverInput struct {
+	drv *Derivation
+	// resolved is the resolved derivation
+	// or nil if the derivation cannot be resolved.
+	resolved *Derivation
+	// hashes is the list of hashes to look up realizations by:
+	// the hash of the resolved derivation
+	// followed by the hash of the original derivation if they differ.
+	// hashes is nil until the derivation has been resolved
+	// and empty if the derivation cannot be resolved.
+	hashes []nix.Hash
+}
+
+func (r *resolver) resolve(drv *Derivation) (*Derivation, bool, error) {
+	resolved := &Derivation{
+		Dir:          drv.Dir,
+		Name:         drv.Name,
+		System:       drv.System,
+		Builder:      drv.Builder,
+		Args:         slices.Clone(drv.Args),
+		Env:          maps.Clone(drv.Env),
+		InputSources: *drv.InputSources.Clone(),
+		Outputs:      drv.Outputs,
+		Meta:         drv.Meta,
+	}
+	var rewrites []string
+	for _, inputPath := range sortedKeys(drv.InputDerivations) {
+		outNames := drv.InputDerivations[inputPath]
+		for i := 0; i < outNames.Len(); i++ {
+			outName := outNames.At(i)
+			outPath, ok, err := r.outputPath(inputPath, outName)
+			if err != nil {
+				return nil, false, fmt.Errorf("resolve %s: %w", drv.Name, err)
+			}
+			if !ok {
+				return nil, false, nil
+			}
+			rewrites = append(rewrites, UnknownCAOutputPlaceholder(inputPath, outName), string(outPath))
+			resolved.InputSources.Add(outPath)
+		}
+	}
+
+	rewrite := strings.NewReplacer(rewrites...).Replace
+	resolved.Builder = rewrite(resolved.Builder)
+	for i, arg := range resolved.Args {
+		resolved.Args[i] = rewrite(arg)
+	}
+	for k, v := range resolved.Env {
+		resolved.Env[k] = rewrite(v)
+	}
+
+	if err := fillDeferredOutputs(resolved); err != nil {
+		return nil, false, fmt.Errorf("resolve %s: %w", drv.Name, err)
+	}
+	return resolved, true, nil
+}
+
+// fillDeferredOutputs replaces the deferred outputs of a resolved derivation
+// with input-addressed outputs.
+// It does nothing if the derivation's outputs are not deferred.
+func fillDeferredOutputs(drv *Derivation) error {
+	for _, out := range drv.Outputs {
+		if !out.IsDeferred() {
+			return nil
+		}
+	}
+	for outName := range drv.Outputs {
+		drv.Env[outName] = ""
+	}
+	outputs, err := drv.InputAddressedOutputs(func(drvPath nix.StorePath) (nix.Hash, error) {
+		return nix.Hash{}, fmt.Errorf("unresolved input %s", drvPath)
+	})
+	if err != nil {
+		return err
+	}
+	drv.Outputs = outputs
+	for outName, out := range outputs {
+		drv.Env[outName] = string(out.path)
+	}
+	return nil
+}
+
+// outputPath returns the path of an output of an input derivation.
+func (r *resolver) outputPath(drvPath nix.StorePath, outputName string) (_ nix.StorePath, ok bool, err error) {
+	if slices.Contains(r.stack, drvPath) {
+		return "", false, newCycleError(r.stack, drvPath)
+	}
+	input := r.inputs[drvPath]
+	if input == nil {
+		drv, err := r.read(drvPath)
+		if err != nil {
+			return "", false, err
+		}
+		input = &resolverInput{drv: drv}
+		r.inputs[drvPath] = input
+	}
+	out := input.drv.Outputs[outputName]
+	if out == nil {
+		return "", false, fmt.Errorf("%s does not have output %q", drvPath, outputName)
+	}
+	if p, ok := out.Path(input.drv.Dir, input.drv.Name, outputName); ok {
+		return p, true, nil
+	}
+
+	if input.hashes == nil {
+		input.hashes = []nix.Hash{}
+		r.stack = append(r.stack, drvPath)
+		resolved, ok, err := r.resolve(input.drv)
+		r.stack = r.stack[:len(r.stack)-1]
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			input.resolved = resolved
+			resolvedHash, err := resolved.Hash()
+			if err != nil {
+				return "", false, fmt.Errorf("%s: %v", drvPath, err)
+			}
+			originalHash, err := input.drv.Hash()
+			if err != nil {
+				return "", false, fmt.Errorf("%s: %v", drvPath, err)
+			}
+			input.hashes = append(input.hashes, resolvedHash)
+			if !originalHash.Equal(resolvedHash) {
+				input.hashes = append(input.hashes, originalHash)
+			}
+		}
+	}
+	if input.resolved != nil {
+		if p, ok := input.resolved.Outputs[outputName].Path(input.drv.Dir, input.drv.Name, outputName); ok {
+			return p, true, nil
+		}
+	}
+	for _, h := range input.hashes {
+		p, ok, err := r.realization(h, outputName)
+		if err != nil || ok {
+			return p, ok, err
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+func TestResolveDerivation(t *testing.T) {
+	const dir = nix.DefaultStoreDirectory
+	drvs := make(map[nix.StorePath]*Derivation)
+	add := func(drv *Derivation) nix.StorePath {
+		t.Helper()
+		p, err := drv.StorePath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		drvs[p] = drv
+		return p
+	}
+	read := func(p nix.StorePath) (*Derivation, error) {
+		drv := drvs[p]
+		if drv == nil {
+			return nil, fmt.Errorf("%s not found", p)
+		}
+		return drv, nil
+	}
+
+	// A fixed-output derivation whose URL changes
+	// but whose output stays the same.
+	newFetch := func(url string) *Derivation {
+		return &Derivation{
+			Dir:     dir,
+			Name:    "hello.txt",
+			System:  "x86_64-linux",
+			Builder: "builtin:fetchurl",
+			Env:     map[string]string{"url": url, "out": HashPlaceholder("out")},
+			Outputs: map[string]*DerivationOutput{
+				"out": FixedCAOutput(nix.FlatFileContentAddress(hashString(nix.SHA256, "Hello, World!\n"))),
+			},
+		}
+	}
+	newDependent := func(name string, inputPath nix.StorePath, input string) *Derivation {
+		return &Derivation{
+			Dir:     dir,
+			Name:    name,
+			System:  "x86_64-linux",
+			Builder: "/bin/sh",
+			Args:    []string{"-c", "cp $input $out"},
+			Env: map[string]string{
+				"input": input,
+				"out":   HashPlaceholder("out"),
+			},
+			InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+				inputPath: sortedset.New("out"),
+			},
+			Outputs: map[string]*DerivationOutput{
+				"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+			},
+		}
+	}
+	newChain := func(url string) (leafPath nix.StorePath, top *Derivation) {
+		fetch := newFetch(url)
+		fetchPath := add(fetch)
+		fetchOut, _ := fetch.Outputs["out"].Path(dir, fetch.Name, "out")
+		leafPath = add(newDependent("leaf", fetchPath, string(fetchOut)))
+		top = newDependent("top", leafPath, UnknownCAOutputPlaceholder(leafPath, "out"))
+		return leafPath, top
+	}
+
+	oldLeafPath, oldTop := newChain("https://example.com/hello.txt")
+	newLeafPath, newTop := newChain("https://mirror.example.com/hello.txt")
+	if oldLeafPath == newLeafPath {
+		t.Fatal("changing the fetch URL did not change the leaf derivation")
+	}
+
+	// Only the old leaf has been realized, keyed by its resolved hash.
+	oldLeafResolved, ok, err := ResolveDerivation(drvs[oldLeafPath], read, noRealizations)
+	if err != nil || !ok {
+		t.Fatalf("ResolveDerivation(leaf) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	if oldLeafResolved.InputDerivations != nil {
+		t.Errorf("resolved leaf InputDerivations = %v; want none", oldLeafResolved.InputDerivations)
+	}
+	oldLeafHash, err := oldLeafResolved.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafOut := nix.StorePath(dir.Join("qg2pnqx3n6gxcmqvcjjjpmcnfvn4lycm-leaf"))
+	realization := func(drvHash nix.Hash, outputName string) (nix.StorePath, bool, error) {
+		if drvHash.Equal(oldLeafHash) && outputName == "out" {
+			return leafOut, true, nil
+		}
+		return "", false, nil
+	}
+
+	oldResolved, ok, err := ResolveDerivation(oldTop, read, realization)
+	if err != nil || !ok {
+		t.Fatalf("ResolveDerivation(old top) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	if got, want := oldResolved.Env["input"], string(leafOut); got != want {
+		t.Errorf("resolved old top $input = %q; want %q", got, want)
+	}
+	if got, want := oldResolved.InputSources.Len(), 1; got != want || oldResolved.InputSources.At(0) != leafOut {
+		t.Errorf("resolved old top has %d input sources; want [%s]", got, leafOut)
+	}
+	newResolved, ok, err := ResolveDerivation(newTop, read, realization)
+	if err != nil || !ok {
+		t.Fatalf("ResolveDerivation(new top) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	oldHash, err := oldResolved.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHash, err := newResolved.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oldHash.Equal(newHash) {
+		t.Errorf("resolved hashes differ after changing fetch URL: %v != %v", oldHash, newHash)
+	}
+	if h, _ := newTop.Hash(); h.Equal(newHash) {
+		t.Error("resolved hash is the same as the unresolved hash")
+	}
+
+	if _, ok, err := ResolveDerivation(newTop, read, noRealizations); err != nil || ok {
+		t.Errorf("ResolveDerivation(new top) without realizations = _, %t, %v; want _, false, <nil>", ok, err)
+	}
+
+	// Resolving a derivation with deferred outputs computes their paths.
+	deferred := newDependent("deferred", oldLeafPath, UnknownCAOutputPlaceholder(oldLeafPath, "out"))
+	deferred.Outputs = map[string]*DerivationOutput{"out": DeferredOutput()}
+	deferredResolved, ok, err := ResolveDerivation(deferred, read, realization)
+	if err != nil || !ok {
+		t.Fatalf("ResolveDerivation(deferred) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	if out := deferredResolved.Outputs["out"]; out.IsDeferred() || out.typ != inputAddressedOutputType {
+		t.Errorf("resolved deferred output = %+v; want input-addressed", out)
+	} else if got, want := deferredResolved.Env["out"], string(out.path); got != want {
+		t.Errorf("resolved deferred $out = %q; want %q", got, want)
+	}
+	if !deferred.Outputs["out"].IsDeferred() {
+		t.Error("ResolveDerivation modified its argument's outputs")
+	}
+}
+
+func TestResolveDerivationCycle(t *testing.T) {
+	const dir = nix.DefaultStoreDirectory
+	aPath := nix.StorePath(dir.Join("00000000000000000000000000000000-a.drv"))
+	bPath := nix.StorePath(dir.Join("11111111111111111111111111111111-b.drv"))
+	newDrv := func(name string, inputPath nix.StorePath) *Derivation {
+		return &Derivation{
+			Dir:     dir,
+			Name:    name,
+			System:  "x86_64-linux",
+			Builder: "/bin/sh",
+			Env: map[string]string{
+				"input": UnknownCAOutputPlaceholder(inputPath, "out"),
+				"out":   HashPlaceholder("out"),
+			},
+			InputDerivations: map[nix.StorePath]*sortedset.Set[string]{
+				inputPath: sortedset.New("out"),
+			},
+			Outputs: map[string]*DerivationOutput{
+				"out": RecursiveFileFloatingCAOutput(nix.SHA256),
+			},
+		}
+	}
+	drvs := map[nix.StorePath]*Derivation{
+		aPath: newDrv("a", bPath),
+		bPath: newDrv("b", aPath),
+	}
+	read := func(p nix.StorePath) (*Derivation, error) {
+		return drvs[p], nil
+	}
+
+	_, _, err := ResolveDerivation(drvs[aPath], read, noRealizations)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("ResolveDerivation(a) = _, _, %v; want CycleError", err)
+	}
+	if want := []nix.StorePath{bPath, aPath, bPath}; !slices.Equal(cycleErr.Cycle, want) {
+		t.Errorf("cycle = %v; want %v", cycleErr.Cycle, want)
+	}
+}
+
+func noRealizations(drvHash nix.Hash, outputName string) (nix.StorePath, bool, error) {
+	return "", false, nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"slices"
+)
+
+// Sources returns the absolute paths of the files and directories
+// that the most recent call to [Eval.File] or [Eval.Expression] read:
+// Lua files that were loaded,
+// files read with readFile,
+// and the files and directories imported with path.
+// Paths in the store are not included.
+// The paths are sorted.
+func (eval *Eval) Sources() []string {
+	paths := make([]string, 0, len(eval.sources))
+	for p := range eval.sources {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// recordSource adds the absolute path p to the set returned by [Eval.Sources].
+func (eval *Eval) recordSource(p string) {
+	if isSubpath(string(eval.storeDir), p) {
+		return
+	}
+	if eval.sources == nil {
+		eval.sources = make(map[string]struct{})
+	}
+	eval.sources[p] = struct{}{}
+}
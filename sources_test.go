@@ -0,0 +1,56 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestSources(t *testing.T) {
+	installFakeNixStore(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.lua":      `dofile("lib.lua"); return { readFile("data.txt"), path("src") }`,
+		"lib.lua":       `return 1`,
+		"data.txt":      "hello\n",
+		"src/hello.txt": "Hello, World!\n",
+		"unused.lua":    `return 2`,
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	if _, err := eval.File(filepath.Join(dir, "main.lua"), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "data.txt"),
+		filepath.Join(dir, "lib.lua"),
+		filepath.Join(dir, "main.lua"),
+		filepath.Join(dir, "src"),
+	}
+	if diff := cmp.Diff(want, eval.Sources()); diff != "" {
+		t.Errorf("Sources() (-want +got):\n%s", diff)
+	}
+
+	if _, err := eval.Expression(`1 + 1`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := eval.Sources(); len(got) > 0 {
+		t.Errorf("after evaluating expression, Sources() = %q; want none", got)
+	}
+}
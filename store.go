@@ -9,8 +9,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 
 	"zombiezen.com/go/nix"
 	"zombiezen.com/go/zb/internal/sortedset"
@@ -22,8 +24,90 @@ type nixImporter struct {
 	header bool
 }
 
-func startImport(ctx context.Context) (*nixImporter, error) {
-	c := exec.CommandContext(ctx, "nix-store", "--import")
+// storeOptions is the configuration of the store that nix-store commands operate on.
+type storeOptions struct {
+	dir nix.StoreDirectory
+	// root is the directory that holds the store in place of the file system root
+	// (see [Eval.SetStoreRoot]).
+	// If empty, the store is at its logical location.
+	root string
+	// lowerRoot and upperLayer describe the read-only lower layer
+	// of an overlay store (see [Eval.SetLowerStore]).
+	// If upperLayer is empty, the store has no lower layer.
+	lowerRoot  string
+	upperLayer string
+	// autoOptimise is whether imported files are hard-linked
+	// to identical files already in the store.
+	autoOptimise bool
+}
+
+// args returns the nix-store options that apply opts.
+func (opts storeOptions) args() []string {
+	var args []string
+	switch {
+	case opts.upperLayer != "":
+		lowerParams := localStoreParams(opts.dir, opts.lowerRoot)
+		lowerParams.Set("read-only", "true")
+		params := localStoreParams(opts.dir, opts.root)
+		params.Set("lower-store", "local?"+lowerParams.Encode())
+		params.Set("upper-layer", opts.upperLayer)
+		args = append(args,
+			"--option", "store", "local-overlay://?"+params.Encode(),
+			"--option", "extra-experimental-features", "local-overlay-store",
+		)
+	case opts.root != "":
+		args = append(args, "--option", "store", "local?"+localStoreParams(opts.dir, opts.root).Encode())
+	}
+	if opts.autoOptimise {
+		args = append(args, "--option", "auto-optimise-store", "true")
+	}
+	return args
+}
+
+// localStoreParams returns the nix-store local store parameters
+// for a store directory kept under root.
+func localStoreParams(dir nix.StoreDirectory, root string) url.Values {
+	params := make(url.Values)
+	if root != "" {
+		params.Set("root", root)
+	}
+	if dir != "" {
+		params.Set("store", string(dir))
+	}
+	return params
+}
+
+// storeOptions returns the evaluator's store settings.
+func (eval *Eval) storeOptions() storeOptions {
+	return storeOptions{
+		dir:          eval.storeDir,
+		root:         eval.storeRoot,
+		lowerRoot:    eval.storeLowerRoot,
+		upperLayer:   eval.storeUpperLayer,
+		autoOptimise: eval.autoOptimise,
+	}
+}
+
+// realPath returns the location in the local file system
+// of the absolute path p, taking the store root into account.
+func (eval *Eval) realPath(p string) string {
+	if eval.storeRoot == "" || !isSubpath(string(eval.storeDir), p) {
+		return p
+	}
+	return filepath.Join(eval.storeRoot, p)
+}
+
+// startImport starts a nix-store --import process
+// configured with the evaluator's store settings.
+func (eval *Eval) startImport(ctx context.Context) (*nixImporter, error) {
+	return startImport(ctx, eval.storeOptions())
+}
+
+// startImport starts a nix-store --import process.
+func startImport(ctx context.Context, opts storeOptions) (*nixImporter, error) {
+	args := opts.args()
+	args = append(args, "--import")
+	c := exec.CommandContext(ctx, "nix-store", args...)
 	c.Stderr = os.Stderr
 	stdin, err := c.StdinPipe()
 	if err != nil {
@@ -38,6 +122,19 @@ func startImport(ctx context.Context) (*nixImporter, error) {
 	}, nil
 }
 
+// ensureValid makes path valid in the store,
+// substituting it if it is not already present.
+func (eval *Eval) ensureValid(ctx context.Context, path nix.StorePath) error {
+	args := eval.storeOptions().args()
+	args = append(args, "--realise", "--", string(path))
+	c := exec.CommandContext(ctx, "nix-store", args...)
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("nix-store --realise %s: %v", path, err)
+	}
+	return nil
+}
+
 func (imp *nixImporter) Write(p []byte) (int, error) {
 	if !imp.header {
 		if _, err := io.WriteString(imp.stdin, "\x01\x00\x00\x00\x00\x00\x00\x00"); err != nil {
@@ -98,6 +195,16 @@ func (imp *nixImporter) Close() error {
 	return nil
 }
 
+// Abort stops the import without registering the store object
+// whose contents are currently being written.
+func (imp *nixImporter) Abort() {
+	if imp.cmd == nil {
+		return
+	}
+	imp.cmd.Process.Kill()
+	imp.close()
+}
+
 func (imp *nixImporter) close() error {
 	var errs [2]error
 	errs[0] = imp.stdin.Close()
@@ -0,0 +1,158 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/lua"
+	"zombiezen.com/go/zb/internal/sortedset"
+)
+
+// parseContext splits a string context value into its store path
+// and derivation output name.
+// outputName is empty if the value refers to the store object as a whole.
+func parseContext(dep string) (path nix.StorePath, outputName string, err error) {
+	rest, isDrv := strings.CutPrefix(dep, "!")
+	if !isDrv {
+		return nix.StorePath(dep), "", nil
+	}
+	outputName, drvPath, ok := strings.Cut(rest, "!")
+	if !ok {
+		return "", "", fmt.Errorf("internal error: malformed context %q", dep)
+	}
+	return nix.StorePath(drvPath), outputName, nil
+}
+
+// getContextFunction implements the getContext builtin.
+// It returns a table that maps each store path in the string's context
+// to a table with either path = true (for a dependency on the store object itself)
+// or outputs = {...} (for a dependency on a derivation's outputs), or both.
+func getContextFunction(l *lua.State) (int, error) {
+	if _, err := lua.CheckString(l, 1); err != nil {
+		return 0, err
+	}
+	paths := make(map[nix.StorePath]bool)
+	outputs := make(map[nix.StorePath]*sortedset.Set[string])
+	var order sortedset.Set[nix.StorePath]
+	for _, dep := range l.StringContext(1) {
+		p, outputName, err := parseContext(dep)
+		if err != nil {
+			return 0, fmt.Errorf("getContext: %v", err)
+		}
+		order.Add(p)
+		if outputName == "" {
+			paths[p] = true
+			continue
+		}
+		if outputs[p] == nil {
+			outputs[p] = new(sortedset.Set[string])
+		}
+		outputs[p].Add(outputName)
+	}
+
+	l.CreateTable(0, order.Len())
+	for i := 0; i < order.Len(); i++ {
+		p := order.At(i)
+		l.CreateTable(0, 2)
+		if paths[p] {
+			l.PushBoolean(true)
+			l.RawSetField(-2, "path")
+		}
+		if outs := outputs[p]; outs != nil {
+			l.CreateTable(outs.Len(), 0)
+			for j := 0; j < outs.Len(); j++ {
+				l.PushString(outs.At(j))
+				l.RawSetIndex(-2, int64(j+1))
+			}
+			l.RawSetField(-2, "outputs")
+		}
+		l.RawSetField(-2, string(p))
+	}
+	return 1, nil
+}
+
+// unsafeDiscardStringContextFunction implements the unsafeDiscardStringContext builtin.
+func unsafeDiscardStringContextFunction(l *lua.State) (int, error) {
+	s, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	l.PushString(s)
+	return 1, nil
+}
+
+// appendContextFunction implements the appendContext builtin.
+// Its second argument is a table in the format returned by getContext.
+func (eval *Eval) appendContextFunction(l *lua.State) (int, error) {
+	s, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	if !l.IsTable(2) {
+		return 0, lua.NewTypeError(l, 2, lua.TypeTable.String())
+	}
+	context := sortedset.New(l.StringContext(1)...)
+
+	l.PushNil()
+	for l.Next(2) {
+		if l.Type(-2) != lua.TypeString {
+			return 0, fmt.Errorf("appendContext: keys must be store paths")
+		}
+		k, _ := l.ToString(-2)
+		p, err := nix.ParseStorePath(k)
+		if err != nil {
+			return 0, fmt.Errorf("appendContext: %v", err)
+		}
+		if p.Dir() != eval.storeDir {
+			return 0, fmt.Errorf("appendContext: %s is not in %s", p, eval.storeDir)
+		}
+		if !l.IsTable(-1) {
+			return 0, fmt.Errorf("appendContext: [%q]: %v expected, got %v", k, lua.TypeTable, l.Type(-1))
+		}
+
+		l.RawField(-1, "path")
+		if l.ToBoolean(-1) {
+			context.Add(string(p))
+		}
+		l.Pop(1)
+
+		switch typ := l.RawField(-1, "outputs"); typ {
+		case lua.TypeNil:
+		case lua.TypeTable:
+			if !p.IsDerivation() {
+				return 0, fmt.Errorf("appendContext: [%q]: outputs given for a path that is not a derivation", k)
+			}
+			err := ipairs(l, -1, func(i int64) error {
+				if l.Type(-1) != lua.TypeString {
+					return fmt.Errorf("#%d: output name expected", i)
+				}
+				outputName, _ := l.ToString(-1)
+				if outputName == "" {
+					return fmt.Errorf("#%d: empty output name", i)
+				}
+				context.Add("!" + outputName + "!" + string(p))
+				return nil
+			})
+			if err != nil {
+				return 0, fmt.Errorf("appendContext: [%q].outputs %v", k, err)
+			}
+		default:
+			return 0, fmt.Errorf("appendContext: [%q].outputs: %v expected, got %v", k, lua.TypeTable, typ)
+		}
+		l.Pop(1)
+
+		// Remove value, keeping key for the next iteration.
+		l.Pop(1)
+	}
+
+	contextList := make([]string, 0, context.Len())
+	for i := 0; i < context.Len(); i++ {
+		contextList = append(contextList, context.At(i))
+	}
+	l.PushStringContext(s, contextList)
+	return 1, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestStringContext(t *testing.T) {
+	installFakeNixStore(t)
+	storeDir := nix.StoreDirectory(t.TempDir())
+	eval := NewEval(storeDir)
+	defer eval.Close()
+
+	const expr = `
+local dep = derivation { name = "dep"; system = "x86_64-linux"; builder = "/bin/sh" }
+local s = dep.drvPath .. " " .. dep.out
+local bare = unsafeDiscardStringContext(s)
+return {
+  dep = dep;
+  context = getContext(s);
+  bareContext = getContext(bare);
+  equal = bare == s;
+  roundTrip = getContext(appendContext(bare, getContext(s)));
+}
+`
+	results, err := eval.Expression(expr, []string{"dep", "context", "bareContext", "equal", "roundTrip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drvPath, err := results[0].(*Derivation).StorePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantContext := map[string]any{
+		string(drvPath): map[string]any{
+			"path":    true,
+			"outputs": []any{"out"},
+		},
+	}
+	if diff := cmp.Diff(wantContext, results[1]); diff != "" {
+		t.Errorf("getContext(s) (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]any{}, results[2]); diff != "" {
+		t.Errorf("getContext(unsafeDiscardStringContext(s)) (-want +got):\n%s", diff)
+	}
+	if results[3] != true {
+		t.Error("unsafeDiscardStringContext(s) != s")
+	}
+	if diff := cmp.Diff(wantContext, results[4]); diff != "" {
+		t.Errorf("getContext(appendContext(...)) (-want +got):\n%s", diff)
+	}
+}
+
+func TestAppendContextErrors(t *testing.T) {
+	eval := NewEval("/zb/store")
+	defer eval.Close()
+
+	tests := []string{
+		`appendContext("x", { ["/nix/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"] = { path = true } })`,
+		`appendContext("x", { ["hello"] = { path = true } })`,
+		`appendContext("x", { ["/zb/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"] = { outputs = { "out" } } })`,
+		`appendContext("x", { ["/zb/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1.drv"] = { outputs = { 1 } } })`,
+		`appendContext("x", { ["/zb/store/s66mzxpvicwk07gjbjfw9izjfa797vsw-hello-2.12.1"] = true })`,
+	}
+	for _, expr := range tests {
+		if _, err := eval.Expression(expr, nil); err == nil {
+			t.Errorf("%s did not return an error", expr)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// tracer records spans with the global OpenTelemetry tracer provider,
+// which discards them unless the program installs a provider.
+var tracer = otel.Tracer("zombiezen.com/go/zb")
+
+// SetContext sets the context that the spans of later evaluations descend from.
+// By default, each evaluation starts a new trace.
+func (eval *Eval) SetContext(ctx context.Context) {
+	eval.baseContext = ctx
+}
+
+// traceContext returns the context for work done by the current evaluation.
+func (eval *Eval) traceContext() context.Context {
+	if eval.spanContext != nil {
+		return eval.spanContext
+	}
+	if eval.baseContext != nil {
+		return eval.baseContext
+	}
+	return context.Background()
+}
+
+// startSpan starts a span that lasts until the returned function is called.
+// Spans started before the returned function is called are children of the span.
+func (eval *Eval) startSpan(name string, attrs ...attribute.KeyValue) (end func(err error)) {
+	parent := eval.spanContext
+	ctx, span := tracer.Start(eval.traceContext(), name, trace.WithAttributes(attrs...))
+	eval.spanContext = ctx
+	return func(err error) {
+		spans.End(span, err)
+		eval.spanContext = parent
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"zombiezen.com/go/nix"
+)
+
+func TestEvalSpans(t *testing.T) {
+	installFakeNixStore(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldTracer := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = oldTracer })
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "hello.txt"), []byte("Hello, World!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	mainPath := filepath.Join(dir, "main.lua")
+	const mainSource = `return derivation { name = "x"; system = "x86_64-linux"; builder = "/bin/sh"; src = path("src") }`
+	if err := os.WriteFile(mainPath, []byte(mainSource), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := provider.Tracer("test").Start(context.Background(), "test")
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	eval.SetContext(ctx)
+	if _, err := eval.File(mainPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	parents := map[string]string{
+		"zb.evaluate":   "test",
+		"zb.path":       "zb.evaluate",
+		"zb.derivation": "zb.evaluate",
+	}
+	for name, parentName := range parents {
+		span := spans[name]
+		if span == nil {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		parent := spans[parentName]
+		if parent == nil {
+			continue
+		}
+		if got, want := span.Parent().SpanID(), parent.SpanContext().SpanID(); got != want {
+			t.Errorf("%s span's parent = %v; want %s (%v)", name, got, parentName, want)
+		}
+	}
+}
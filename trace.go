@@ -0,0 +1,174 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"zombiezen.com/go/zb/internal/lua"
+)
+
+// An EvalError is an error that occurred while running Lua code
+// during [Eval.File] or [Eval.Expression].
+type EvalError struct {
+	// Err is the error raised by the Lua code or built-in function.
+	Err error
+	// Traceback is the Lua call stack at the point where the error was raised,
+	// innermost call first.
+	Traceback []TraceFrame
+	// Derivations is the names of the derivations
+	// that were being instantiated when the error occurred,
+	// outermost first.
+	Derivations []string
+}
+
+// A TraceFrame is a single function call in an [EvalError]'s traceback.
+type TraceFrame struct {
+	// Source is the file (or other chunk) that the function is defined in.
+	// It is "[Go]" for built-in functions.
+	Source string
+	// Line is the line number in Source that was executing,
+	// or zero if unknown.
+	Line int
+	// Function describes the function that was called,
+	// like "function 'derivation'" or "main chunk".
+	Function string
+	// TailCall is true if the function was called by a tail call,
+	// in which case its caller is not in the traceback.
+	TailCall bool
+}
+
+// String formats the frame as in a standard Lua traceback.
+func (frame TraceFrame) String() string {
+	if frame.Line > 0 {
+		return fmt.Sprintf("%s:%d: in %s", frame.Source, frame.Line, frame.Function)
+	}
+	return fmt.Sprintf("%s: in %s", frame.Source, frame.Function)
+}
+
+// Tracebacks with more frames than this are abbreviated in [EvalError.Error].
+// The numbers match those used by the standard Lua traceback.
+const (
+	tracebackFirstFrames = 10
+	tracebackLastFrames  = 11
+)
+
+// Error returns the error message
+// followed by the derivation chain and the traceback.
+func (e *EvalError) Error() string {
+	sb := new(strings.Builder)
+	sb.WriteString(e.Err.Error())
+	for i := len(e.Derivations) - 1; i >= 0; i-- {
+		fmt.Fprintf(sb, "\nwhile instantiating derivation %q", e.Derivations[i])
+	}
+	if len(e.Traceback) > 0 {
+		sb.WriteString("\nstack traceback:")
+		for i, frame := range e.Traceback {
+			n := len(e.Traceback)
+			if n > tracebackFirstFrames+tracebackLastFrames && i >= tracebackFirstFrames && i < n-tracebackLastFrames {
+				if i == tracebackFirstFrames {
+					fmt.Fprintf(sb, "\n\t...\t(skipping %d levels)", n-tracebackFirstFrames-tracebackLastFrames)
+				}
+				continue
+			}
+			sb.WriteString("\n\t")
+			sb.WriteString(frame.String())
+			if frame.TailCall {
+				sb.WriteString("\n\t(...tail calls...)")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Unwrap returns e.Err.
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// messageHandler is the message handler used to call Lua code.
+// It records the traceback and derivation chain at the point the error was raised
+// for [Eval.evalError] and returns the error value unchanged.
+func (eval *Eval) messageHandler(l *lua.State) (int, error) {
+	eval.errorTraceback = traceback(l, 1)
+	// The chain of failed derivations is only relevant
+	// if this error was caused by the derivation's failure
+	// and not some later error after the failure was caught by pcall.
+	if msg, ok := l.ToString(1); ok && eval.failedDerivations != nil && strings.Contains(msg, eval.failedDerivationMessage) {
+		eval.errorTraceDerivations = eval.failedDerivations
+	}
+	eval.failedDerivations = nil
+	eval.failedDerivationMessage = ""
+	l.SetTop(1)
+	return 1, nil
+}
+
+// evalError converts an error from calling Lua code with [Eval.messageHandler]
+// into an [*EvalError].
+func (eval *Eval) evalError(err error) error {
+	e := &EvalError{
+		Err:         eval.limitError(err),
+		Traceback:   eval.errorTraceback,
+		Derivations: eval.errorTraceDerivations,
+	}
+	eval.errorTraceback = nil
+	eval.errorTraceDerivations = nil
+	return e
+}
+
+// traceback returns the call stack starting at the given level.
+func traceback(l *lua.State, level int) []TraceFrame {
+	var frames []TraceFrame
+	for ; ; level++ {
+		ar := l.Stack(level)
+		if ar == nil {
+			return frames
+		}
+		info := ar.Info("Slnt")
+		frame := TraceFrame{
+			Source:   info.ShortSource,
+			Line:     max(info.CurrentLine, 0),
+			TailCall: info.IsTailCall,
+		}
+		if info.What == "C" {
+			frame.Source = "[Go]"
+		}
+		switch {
+		case info.Name != "":
+			frame.Function = fmt.Sprintf("function '%s'", info.Name)
+		case info.What == "main":
+			frame.Function = "main chunk"
+		case info.What == "Lua":
+			frame.Function = fmt.Sprintf("function <%s:%d>", info.ShortSource, info.LineDefined)
+		default:
+			frame.Function = "?"
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// beginDerivation records that the derivation with the given name
+// is being instantiated until the returned function is called.
+// If err is not nil when the returned function is called,
+// then the current chain of derivations is recorded for [Eval.messageHandler].
+func (eval *Eval) beginDerivation(name string) (end func(err error)) {
+	if len(eval.derivationStack) == 0 {
+		// Discard chains from errors that were caught by pcall.
+		eval.failedDerivations = nil
+		eval.failedDerivationMessage = ""
+	}
+	eval.derivationStack = append(eval.derivationStack, name)
+	endSpan := eval.startSpan("zb.derivation", attribute.String("zb.derivation.name", name))
+	return func(err error) {
+		endSpan(err)
+		if err != nil && eval.failedDerivations == nil {
+			eval.failedDerivations = slices.Clone(eval.derivationStack)
+			eval.failedDerivationMessage = err.Error()
+		}
+		eval.derivationStack = eval.derivationStack[:len(eval.derivationStack)-1]
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestEvalErrorTraceback(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.lua")
+	const source = "local function mkbar()\n" +
+		"  local drv = derivation {\n" +
+		"    name = \"bar\",\n" +
+		"    system = \"x86_64-linux\",\n" +
+		"    builder = \"/bin/sh\",\n" +
+		"    outputHash = \"bogus\",\n" +
+		"  }\n" +
+		"  return drv\n" +
+		"end\n" +
+		"local x = mkbar()\n" +
+		"return x\n"
+	if err := os.WriteFile(mainPath, []byte(source), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	_, err := eval.File(mainPath, nil)
+	if err == nil {
+		t.Fatal("File did not return an error")
+	}
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("File(...) = %v (type %T); want *EvalError", err, err)
+	}
+	if got := evalErr.Err.Error(); !strings.Contains(got, "outputHash") {
+		t.Errorf("Err = %q; want to mention outputHash", got)
+	}
+	if want := []string{"bar"}; !cmp.Equal(evalErr.Derivations, want) {
+		t.Errorf("Derivations = %q; want %q", evalErr.Derivations, want)
+	}
+	shortMain := evalErr.Traceback[len(evalErr.Traceback)-1].Source
+	want := []TraceFrame{
+		{Source: "[Go]", Function: "function 'derivation'"},
+		{Source: shortMain, Line: 2, Function: "function 'mkbar'"},
+		{Source: shortMain, Line: 10, Function: "main chunk"},
+	}
+	if diff := cmp.Diff(want, evalErr.Traceback); diff != "" {
+		t.Errorf("Traceback (-want +got):\n%s", diff)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "while instantiating derivation \"bar\"") ||
+		!strings.Contains(msg, "stack traceback:\n\t[Go]: in function 'derivation'") {
+		t.Errorf("error message = %q; want derivation chain and traceback", msg)
+	}
+
+	// Errors after a failed evaluation should not reuse its trace.
+	_, err = eval.Expression(`error("oops")`, nil)
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("Expression(...) = %v (type %T); want *EvalError", err, err)
+	}
+	if len(evalErr.Derivations) > 0 {
+		t.Errorf("Derivations = %q; want none", evalErr.Derivations)
+	}
+}
+
+func TestEvalErrorCaughtDerivation(t *testing.T) {
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	const expr = `(function()
+		pcall(derivation, { name = "caught", system = "x86_64-linux", builder = "/bin/sh", outputHash = "bogus" })
+		error("later")
+	end)()`
+	_, err := eval.Expression(expr, nil)
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("Expression(...) = %v (type %T); want *EvalError", err, err)
+	}
+	if len(evalErr.Derivations) > 0 {
+		t.Errorf("Derivations = %q; want none", evalErr.Derivations)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/zb/internal/lua"
+)
+
+// Warning categories used by the built-in functions.
+const (
+	// WarningCategoryDefault is the category of warnings
+	// issued by warn and zb.warn without a category.
+	WarningCategoryDefault = "warning"
+	// WarningCategoryDeprecated is the category of warnings
+	// issued by zb.deprecated.
+	WarningCategoryDeprecated = "deprecated"
+	// WarningCategoryPortability is the category of warnings
+	// about imported files that would not be reproducible on other systems,
+	// like files whose names differ only in case.
+	WarningCategoryPortability = "portability"
+)
+
+// SuppressAllWarnings can be passed to [Eval.SuppressWarnings]
+// to suppress warnings of every category.
+const SuppressAllWarnings = "all"
+
+// A Warning is a message issued by Lua code during evaluation.
+type Warning struct {
+	// Category is the kind of warning,
+	// like [WarningCategoryDefault] or [WarningCategoryDeprecated].
+	Category string
+	// Message is the text of the warning.
+	Message string
+	// Position is the location in Lua source that the warning applies to
+	// in the form "file:line".
+	// It is empty if the position is not known.
+	Position string
+	// Count is the number of times the warning was issued.
+	Count int
+}
+
+// String formats the warning for display.
+func (w *Warning) String() string {
+	sb := new(strings.Builder)
+	if w.Position != "" {
+		sb.WriteString(w.Position)
+		sb.WriteString(": ")
+	}
+	sb.WriteString(w.Category)
+	sb.WriteString(": ")
+	sb.WriteString(w.Message)
+	if w.Count > 1 {
+		fmt.Fprintf(sb, " (%d times)", w.Count)
+	}
+	return sb.String()
+}
+
+// SuppressWarnings discards warnings in the given categories.
+// Passing [SuppressAllWarnings] discards all warnings.
+func (eval *Eval) SuppressWarnings(categories ...string) {
+	eval.suppressedWarnings = append(eval.suppressedWarnings, categories...)
+}
+
+// Warnings returns the warnings issued during the most recent call
+// to [Eval.File] or [Eval.Expression],
+// in the order they were first issued.
+// Identical warnings from the same position are only reported once.
+func (eval *Eval) Warnings() []*Warning {
+	return slices.Clone(eval.warnings)
+}
+
+// warn records a warning.
+func (eval *Eval) warn(w *Warning) {
+	if eval.warningsDisabled > 0 ||
+		slices.Contains(eval.suppressedWarnings, SuppressAllWarnings) ||
+		slices.Contains(eval.suppressedWarnings, w.Category) {
+		return
+	}
+	for _, prev := range eval.warnings {
+		if prev.Category == w.Category && prev.Message == w.Message && prev.Position == w.Position {
+			prev.Count++
+			return
+		}
+	}
+	w.Count = 1
+	eval.warnings = append(eval.warnings, w)
+}
+
+// zbLibraryName is the name of the global table
+// that holds the functions loaded by [Eval.openZB].
+const zbLibraryName = "zb"
+
+// openZB loads the zb library,
+// which contains functions for communicating with zb
+// rather than for creating derivations.
+func (eval *Eval) openZB(l *lua.State) (int, error) {
+	err := lua.NewLib(l, map[string]lua.Function{
+		"warn":            eval.zbWarnFunction,
+		"deprecated":      eval.deprecatedFunction,
+		"withoutWarnings": eval.withoutWarningsFunction,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// warnFunction replaces the standard Lua warn function
+// to record warnings with [Eval.warn].
+func (eval *Eval) warnFunction(l *lua.State) (int, error) {
+	n := l.Top()
+	sb := new(strings.Builder)
+	for i := 1; i <= n; i++ {
+		s, err := lua.CheckString(l, i)
+		if err != nil {
+			return 0, err
+		}
+		sb.WriteString(s)
+	}
+	msg := sb.String()
+	if n == 1 && strings.HasPrefix(msg, "@") {
+		// Control message like "@on" or "@off".
+		// Warnings are always collected, so these are ignored.
+		return 0, nil
+	}
+	eval.warn(&Warning{
+		Category: WarningCategoryDefault,
+		Message:  msg,
+		Position: wherePosition(l, 1),
+	})
+	return 0, nil
+}
+
+// zbWarnFunction implements zb.warn.
+func (eval *Eval) zbWarnFunction(l *lua.State) (int, error) {
+	return eval.issueWarning(l, WarningCategoryDefault, 1)
+}
+
+// deprecatedFunction implements zb.deprecated.
+// The warning's position is the caller of the function
+// that called zb.deprecated by default,
+// since that is the code that needs to change.
+func (eval *Eval) deprecatedFunction(l *lua.State) (int, error) {
+	return eval.issueWarning(l, WarningCategoryDeprecated, 2)
+}
+
+// issueWarning records a warning with the message at index 1
+// and the options table at index 2 (if present).
+func (eval *Eval) issueWarning(l *lua.State, category string, level int64) (int, error) {
+	msg, err := lua.CheckString(l, 1)
+	if err != nil {
+		return 0, err
+	}
+	switch l.Type(2) {
+	case lua.TypeNone, lua.TypeNil:
+	case lua.TypeTable:
+		switch typ := l.RawField(2, "level"); typ {
+		case lua.TypeNil:
+		case lua.TypeNumber:
+			var ok bool
+			level, ok = l.ToInteger(-1)
+			if !ok || level < 0 {
+				return 0, lua.NewArgError(l, 2, "level must be a non-negative integer")
+			}
+		default:
+			return 0, lua.NewArgError(l, 2, fmt.Sprintf("level: %v expected, got %v", lua.TypeNumber, typ))
+		}
+		l.Pop(1)
+		if category == WarningCategoryDefault {
+			switch typ := l.RawField(2, "category"); typ {
+			case lua.TypeNil:
+			case lua.TypeString:
+				category, _ = l.ToString(-1)
+			default:
+				return 0, lua.NewArgError(l, 2, fmt.Sprintf("category: %v expected, got %v", lua.TypeString, typ))
+			}
+			l.Pop(1)
+		}
+	default:
+		return 0, lua.NewTypeError(l, 2, lua.TypeTable.String())
+	}
+	eval.warn(&Warning{
+		Category: category,
+		Message:  msg,
+		Position: wherePosition(l, int(level)),
+	})
+	return 0, nil
+}
+
+// withoutWarningsFunction implements zb.withoutWarnings,
+// which calls a function with warnings discarded.
+func (eval *Eval) withoutWarningsFunction(l *lua.State) (int, error) {
+	if !l.IsFunction(1) {
+		return 0, lua.NewTypeError(l, 1, lua.TypeFunction.String())
+	}
+	eval.warningsDisabled++
+	defer func() { eval.warningsDisabled-- }()
+	if err := l.Call(l.Top()-1, lua.MultipleReturns, 0); err != nil {
+		return 0, err
+	}
+	return l.Top(), nil
+}
+
+// wherePosition returns the "file:line" position
+// of the function at the given level of the call stack
+// or the empty string if it is not known.
+func wherePosition(l *lua.State, level int) string {
+	if level == 0 || l.Stack(level) == nil {
+		return ""
+	}
+	return strings.TrimSuffix(lua.Where(l, level), ": ")
+}
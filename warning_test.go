@@ -0,0 +1,93 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestWarnings(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.lua")
+	const source = "local function oldAPI()\n" +
+		"  zb.deprecated(\"oldAPI is deprecated; use newAPI\")\n" +
+		"  return 42\n" +
+		"end\n" +
+		"for i = 1, 3 do oldAPI() end\n" +
+		"zb.warn(\"something is odd\", { category = \"odd\" })\n" +
+		"warn(\"plain \", \"warning\")\n" +
+		"zb.withoutWarnings(zb.warn, \"should not appear\")\n" +
+		"zb.warn(\"no position\", { level = 0 })\n" +
+		"local x = oldAPI()\n" +
+		"return x\n"
+	if err := os.WriteFile(mainPath, []byte(source), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	eval := NewEval(nix.StoreDirectory(t.TempDir()))
+	defer eval.Close()
+	results, err := eval.File(mainPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != int64(42) {
+		t.Errorf("results = %#v; want 42", results)
+	}
+	got := eval.Warnings()
+	if len(got) == 0 {
+		t.Fatal("no warnings")
+	}
+	chunk := got[0].Position[:len(got[0].Position)-len(":5")]
+	want := []*Warning{
+		{Category: WarningCategoryDeprecated, Message: "oldAPI is deprecated; use newAPI", Position: chunk + ":5", Count: 3},
+		{Category: "odd", Message: "something is odd", Position: chunk + ":6", Count: 1},
+		{Category: WarningCategoryDefault, Message: "plain warning", Position: chunk + ":7", Count: 1},
+		{Category: WarningCategoryDefault, Message: "no position", Count: 1},
+		{Category: WarningCategoryDeprecated, Message: "oldAPI is deprecated; use newAPI", Position: chunk + ":10", Count: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("warnings (-want +got):\n%s", diff)
+	}
+	if got, want := got[0].String(), chunk+":5: deprecated: oldAPI is deprecated; use newAPI (3 times)"; got != want {
+		t.Errorf("warning.String() = %q; want %q", got, want)
+	}
+
+	// Warnings are collected per evaluation.
+	if _, err := eval.Expression(`1`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := eval.Warnings(); len(got) > 0 {
+		t.Errorf("after second evaluation, warnings = %v; want none", got)
+	}
+
+	t.Run("Suppress", func(t *testing.T) {
+		eval := NewEval(nix.StoreDirectory(t.TempDir()))
+		defer eval.Close()
+		eval.SuppressWarnings(WarningCategoryDeprecated)
+		if _, err := eval.File(mainPath, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range eval.Warnings() {
+			if w.Category == WarningCategoryDeprecated {
+				t.Errorf("got suppressed warning %v", w)
+			}
+		}
+		if got := len(eval.Warnings()); got != 3 {
+			t.Errorf("len(eval.Warnings()) = %d; want 3", got)
+		}
+
+		eval.SuppressWarnings(SuppressAllWarnings)
+		if _, err := eval.File(mainPath, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := eval.Warnings(); len(got) > 0 {
+			t.Errorf("with all warnings suppressed, warnings = %v; want none", got)
+		}
+	})
+}
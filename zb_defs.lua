@@ -3,32 +3,157 @@
 
 ---@meta
 
+---The system type that the evaluation targets, like `"x86_64-linux"`.
+---It is the host's system type unless `--system` is passed to zb.
+---Expressions can return a table keyed by system type
+---(with a derivation for each supported system)
+---and `zb build` will build the derivation for `currentSystem`.
+---@type string
+currentSystem = nil
+
 ---@class derivation: userdata
 ---@field name string
 ---@field system string
+---@field buildPlatform string
+---@field hostPlatform string
+---@field targetPlatform string
 ---@field builder string
 ---@field args string[]
 ---@field drvPath string
 ---@field out string
+---@field meta {description: string?, license: string?, homepage: string?, maintainers: string[]?}?
 ---@field [string] string|number|boolean|derivation|(string|number|boolean|derivation)[]
 ---@operator concat:string
 
 ---Create a derivation (a buildable target).
----@param args { name: string, system: string, builder: string, args: string[], [string]: string|number|boolean|(string|number|boolean)[] }
+---If `maxClosureSize` is given, `zb build` fails
+---if the closure of any of the derivation's outputs exceeds that many bytes.
+---`assertUnset` lists environment variables that must not be set
+---in the builder's environment,
+---either by the derivation itself or by the builder environment policy.
+---`system` is the platform that the builder runs on (the build platform).
+---When cross-compiling, `hostPlatform` names the platform that the outputs run on
+---and `targetPlatform` names the platform that the outputs produce code for
+---(for compilers and similar tools).
+---They default to `system` and `hostPlatform`, respectively,
+---and are passed to the builder as environment variables if set.
+---`outputs` names the derivation's outputs (by default, just `"out"`).
+---The builder receives each output's store path in the environment variable of the same name,
+---and each output is available as a field of the returned derivation.
+---The first output is the default used when the derivation is converted to a string.
+---Fixed-output derivations (those with `outputHash`) can only have an `"out"` output.
+---`outputHashAlgo` names the hash algorithm (`"sha256"` or `"sha512"`)
+---used to content-address the outputs (SHA-256 by default)
+---and to interpret an `outputHash` given without a type prefix.
+---The build backend does not let SHA-512 content-addressed outputs
+---refer to other store objects,
+---so builds of such outputs with references fail.
+---The derivation itself is always addressed by SHA-256.
+---Outputs are content-addressed by default.
+---If `__contentAddressed` is `false`, the output paths are instead computed
+---from the derivation's inputs in the same way as classic Nix derivations,
+---for compatibility with existing Nix expressions and binary caches.
+---If such a derivation depends on a content-addressed derivation,
+---its output paths are deferred until the inputs are built.
+---`meta` describes the derivation for `zb search` (and `zb index`) and license reporting:
+---its `description`, `license` (an SPDX license expression), `homepage`, and `maintainers`
+---are recorded when the derivation is built.
+---`meta` is not passed to the builder,
+---so changing it does not change the derivation.
+---If zb is run with `--allow-license` or `--deny-license`,
+---evaluation fails when a result depends on a derivation
+---whose license is not permitted.
+---`pname`, `version`, `license` (an SPDX license expression),
+---`homepage`, and `description` are recorded in bills of materials produced by `zb sbom`.
+---@param args { name: string, system: string, hostPlatform: string?, targetPlatform: string?, builder: string, args: string[], outputs: string[]?, meta: {description: string?, license: string?, homepage: string?, maintainers: string[]?}?, maxClosureSize: integer?, assertUnset: string[]?, __contentAddressed: boolean?, pname: string?, version: string?, license: string?, homepage: string?, description: string?, [string]: string|number|boolean|(string|number|boolean)[] }
 ---@return derivation
 function derivation(args) end
 
+---Return the placeholder for an output of the derivation being defined.
+---Passed to `derivation`, the placeholder is replaced
+---with the output's store path at build time.
+---The derivation's `out` field (also produced by concatenating or `tostring`-ing the derivation)
+---is the corresponding reference from other derivations' point of view:
+---the output's store path if it is known ahead of time, or a placeholder otherwise,
+---with the derivation output as context.
+---@param outputName string
+---@return string
+function placeholder(outputName) end
+
 ---Make a file or directory available to a derivation.
----@param p (string|{path: string, name: string?}) path to import, relative to the source file that called `path`
+---If `filter` is given, it is called with the absolute path
+---and type (`"regular"`, `"directory"`, or `"symlink"`) of each file under `path`,
+---and only files for which it returns true are imported.
+---Excluding a directory excludes everything inside it.
+---If `gitignore` is true, files ignored by Git
+---(according to `.gitignore` files and the repository's `.git/info/exclude`)
+---and `.git` directories are excluded.
+---If `git` is true, only the files that `git ls-files` reports
+---(files committed or staged in the index) are imported,
+---so untracked files never change the result.
+---Only contents, symlink targets, and whether the owner can execute a file
+---are preserved: imported files are read-only,
+---and timestamps, ownership, other permission bits, and extended attributes
+---are discarded, so the same tree imports identically on every machine.
+---File names are converted to Unicode Normalization Form C,
+---and it is an error for two files in a directory to have the same normalized name.
+---Files in the same directory whose names differ only in case
+---produce a `portability` warning,
+---or an error if `portable` is true.
+---@param p (string|{path: string, name: string?, filter: (fun(path: string, type: string): boolean)?, gitignore: boolean?, git: boolean?, portable: boolean?}) path to import, relative to the source file that called `path`
 ---@return string # store path of the copied file or directory
 function path(p) end
 
+---Return the content of a file.
+---The result depends on the same store objects as `p`,
+---so reading a file from a store object keeps the dependency on it.
+---Files produced by derivations cannot be read during evaluation.
+---@param p string path to read, relative to the source file that called `readFile`
+---@return string
+function readFile(p) end
+
 ---Store a plain file in the store.
+---If `s` references the outputs of derivations,
+---the file cannot be written until those outputs are built,
+---so `toFile` instead creates a derivation that writes the file
+---(running `/bin/sh` on the same system as the referenced derivations)
+---and returns its output's placeholder.
 ---@param name string
 ---@param s string File contents
 ---@return string # store path
 function toFile(name, s) end
 
+---Reference a store object that was created outside the evaluator.
+---`storePath` makes sure the store object is valid in the local store,
+---substituting it if necessary.
+---`p` may name a file inside the store object.
+---@param p string absolute path in the store directory
+---@return string # `p` with the store object as its context
+function storePath(p) end
+
+---Return the store objects and derivation outputs that a string depends on.
+---The result maps each store path to a table
+---with `path = true` if the string depends on the store object itself
+---and `outputs` listing the derivation outputs the string depends on.
+---@param s string
+---@return {[string]: {path: boolean?, outputs: string[]?}}
+function getContext(s) end
+
+---Return a copy of `s` that depends on the given store objects and derivation outputs
+---in addition to its existing dependencies.
+---@param s string
+---@param context {[string]: {path: boolean?, outputs: string[]?}} dependencies in the format returned by `getContext`
+---@return string
+function appendContext(s, context) end
+
+---Return a copy of `s` without any dependencies.
+---Derivations that use the result will not depend on
+---(and will not be able to access) the store objects that `s` refers to,
+---so this should only be used to deliberately break a dependency.
+---@param s string
+---@return string
+function unsafeDiscardStringContext(s) end
+
 --- baseNameOf returns the last element of path.
 --- Trailing slashes are removed before extracting the last element.
 --- If the path is empty, baseNameOf returns "".
@@ -38,10 +163,64 @@ function toFile(name, s) end
 function baseNameOf(path) end
 
 ---Create a derivation that downloads a URL.
+---URLs with schemes other than http, https, or ftp
+---are downloaded during evaluation
+---by the fetcher registered for the scheme in the zb binary.
 ---@param args {url: string, hash: string, name: string?, executable: boolean?}
 ---@return derivation
 function fetchurl(args) end
 
+---Copy the tree of a Git commit (without the `.git` directory) into the store.
+---`rev` must be a full commit hash.
+---If `hash` (the hash of the tree's NAR serialization) is given,
+---the repository is not cloned when the store object already exists,
+---and the tree must match the hash.
+---@param args {url: string, rev: string, hash: string?, name: string?}
+---@return string # store path
+function fetchGit(args) end
+
+---Fetch a named project input at the version recorded in the project's lockfile (`zb.lock`).
+---An input is either a file (`url`, fetched like `fetchurl`)
+---or a Git repository (`git`, fetched like `fetchGit`),
+---optionally at a branch or tag (`ref`, by default the repository's `HEAD`).
+---If the input is not in the lockfile or its declaration has changed,
+---it is resolved to its current revision and hash, which are added to the lockfile.
+---Use `zb lock update` to resolve inputs again.
+---@param name string
+---@param args {url: string?, executable: boolean?, git: string?, ref: string?}
+---@return derivation|string # the `fetchurl` derivation for a file or the store path of a Git tree
+function input(name, args) end
+
+---Run a Lua file from a remote `.tar`, `.tar.gz`, or `.tar.bz2` archive
+---(for example, a package set shared between projects)
+---and return its results.
+---The archive is unpacked (removing its top-level directory, if it has exactly one)
+---and copied into the store,
+---and the hash of its contents is recorded in the project's lockfile under the URL,
+---so later evaluations fail if the archive changes
+---until `zb lock update URL` is run.
+---Relative paths in the imported file resolve to the copy in the store.
+---@param url string
+---@param file string? path of the Lua file in the archive (default `"default.lua"`)
+---@return any ...
+function import(url, file) end
+
+---Build a package set for the given platforms
+---in a way that lets packages distinguish tools that run at build time
+---from code that runs on the host platform.
+---`f` is called with the package set being defined,
+---which has a `platforms` field ({build, host, target})
+---and a `buildPackages` field:
+---the package set whose packages run on the build platform
+---and produce code for the host platform (like a cross-compiler).
+---`f` returns a table of packages, which are added to the set.
+---Package sets are created lazily and shared between identical platforms,
+---so `buildPackages` of a native package set is the set itself.
+---@param f fun(pkgs: table): table
+---@param platforms {build: string, host: string?, target: string?}
+---@return table
+function splice(f, platforms) end
+
 ---Apply the function f to each element in list.
 ---@generic T, U
 ---@param f fun(T): U
@@ -61,3 +240,35 @@ function table.elem(x, xs) end
 ---@param ... T[]
 ---@return T[]
 function table.concatLists(...) end
+
+---Functions for communicating with zb.
+zb = {}
+
+---Issue a warning, which zb prints after evaluation finishes.
+---Identical warnings from the same position are only printed once.
+---`level` chooses the position reported with the warning like `error`'s level:
+---1 (the default) is the position where `zb.warn` was called,
+---2 is the position where the function that called `zb.warn` was called, and so on.
+---Level 0 omits the position.
+---`category` (by default `"warning"`) can be used to suppress the warning
+---with `zb --suppress-warnings`.
+---The standard `warn` function issues warnings in the `"warning"` category.
+---@param message string
+---@param opts {level: integer?, category: string?}?
+function zb.warn(message, opts) end
+
+---Issue a warning in the `"deprecated"` category
+---for a function or field that should no longer be used.
+---By default, the warning's position is where the function that called `zb.deprecated` was called,
+---since that is the code that needs to change.
+---@param message string
+---@param opts {level: integer?}?
+function zb.deprecated(message, opts) end
+
+---Call `f` with the given arguments, discarding any warnings it issues,
+---and return its results.
+---@generic T
+---@param f fun(...): T
+---@param ... any
+---@return T
+function zb.withoutWarnings(f, ...) end
@@ -0,0 +1,42 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// hostSupportsAArch32 reports whether the running system
+// can execute 32-bit ARM programs natively.
+// It finds out by running the program from [aarch32ProbeProgram].
+// If a binfmt_misc emulator is registered for 32-bit ARM,
+// the emulator would run the program instead,
+// so hostSupportsAArch32 conservatively reports false.
+var hostSupportsAArch32 = sync.OnceValue(func() bool {
+	emulators, _ := Emulators(DefaultBinfmtDir)
+	for _, emu := range emulators {
+		if emu.System == "armv7l-linux" {
+			return false
+		}
+	}
+
+	f, err := os.CreateTemp("", "zb-aarch32-probe-*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(aarch32ProbeProgram())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false
+	}
+	if err := os.Chmod(f.Name(), 0o700); err != nil {
+		return false
+	}
+	return exec.Command(f.Name()).Run() == nil
+})
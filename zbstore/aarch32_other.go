@@ -0,0 +1,13 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !linux || !arm64
+
+package zbstore
+
+// hostSupportsAArch32 reports whether the running system
+// can execute 32-bit ARM programs natively,
+// which only 64-bit ARM Linux systems are checked for.
+func hostSupportsAArch32() bool {
+	return false
+}
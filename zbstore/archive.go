@@ -0,0 +1,166 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix/nar"
+)
+
+// ArchiveFormat is a file format that [WriteArchive] can produce.
+type ArchiveFormat string
+
+// Archive formats.
+const (
+	TarArchive ArchiveFormat = "tar"
+	ZipArchive ArchiveFormat = "zip"
+)
+
+// archiveTime is the modification time of every file in archives
+// produced by [WriteArchive].
+// It is the earliest time that zip files can represent.
+var archiveTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// WriteArchive converts the NAR read from r
+// (such as one written by [nar.DumpPath] for a store object)
+// to a tar or zip archive written to w.
+// Files are placed under the directory prefix in the archive,
+// or at the top of the archive if prefix is empty.
+// If the NAR holds a single file rather than a directory,
+// prefix is used as the file's name and must not be empty.
+//
+// The output is deterministic:
+// entries are sorted by name (as in the NAR),
+// every entry has the same modification time,
+// and ownership is omitted.
+// Directories and executable files have mode 0755
+// and other files have mode 0644.
+func WriteArchive(w io.Writer, format ArchiveFormat, prefix string, r io.Reader) error {
+	var aw archiveWriter
+	switch format {
+	case TarArchive:
+		aw = tarArchiveWriter{tar.NewWriter(w)}
+	case ZipArchive:
+		aw = zipArchiveWriter{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("write archive: unknown format %q", format)
+	}
+	if prefix != "" && (!fs.ValidPath(prefix) || prefix == ".") {
+		return fmt.Errorf("write archive: invalid prefix %q", prefix)
+	}
+
+	nr := nar.NewReader(r)
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("write archive: %v", err)
+		}
+		name := path.Join(prefix, hdr.Path)
+		if name == "" {
+			if hdr.Mode.IsDir() {
+				// The root directory has no entry of its own.
+				continue
+			}
+			return fmt.Errorf("write archive: prefix required for a single file")
+		}
+		if err := aw.add(name, hdr, nr); err != nil {
+			return fmt.Errorf("write archive: %s: %v", name, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("write archive: %v", err)
+	}
+	return nil
+}
+
+// archivePerm returns the permission bits of a NAR entry in an archive.
+func archivePerm(hdr *nar.Header) fs.FileMode {
+	if hdr.Mode.IsDir() || hdr.Mode&0o111 != 0 {
+		return 0o755
+	}
+	return 0o644
+}
+
+type archiveWriter interface {
+	add(name string, hdr *nar.Header, content io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (tw tarArchiveWriter) add(name string, hdr *nar.Header, content io.Reader) error {
+	th := &tar.Header{
+		Name:    name,
+		Mode:    int64(archivePerm(hdr)),
+		ModTime: archiveTime,
+		Format:  tar.FormatPAX,
+	}
+	switch hdr.Mode.Type() {
+	case fs.ModeDir:
+		th.Typeflag = tar.TypeDir
+		th.Name += "/"
+	case fs.ModeSymlink:
+		th.Typeflag = tar.TypeSymlink
+		th.Mode = 0o777
+		th.Linkname = hdr.LinkTarget
+	default:
+		th.Typeflag = tar.TypeReg
+		th.Size = hdr.Size
+	}
+	if err := tw.WriteHeader(th); err != nil {
+		return err
+	}
+	if th.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(tw, content)
+	return err
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (zw zipArchiveWriter) add(name string, hdr *nar.Header, content io.Reader) error {
+	zh := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: archiveTime,
+	}
+	switch hdr.Mode.Type() {
+	case fs.ModeDir:
+		zh.Name += "/"
+		zh.Method = zip.Store
+		zh.SetMode(fs.ModeDir | archivePerm(hdr))
+	case fs.ModeSymlink:
+		zh.Method = zip.Store
+		zh.SetMode(fs.ModeSymlink | 0o777)
+		content = strings.NewReader(hdr.LinkTarget)
+	default:
+		zh.SetMode(archivePerm(hdr))
+	}
+	fw, err := zw.CreateHeader(zh)
+	if err != nil {
+		return err
+	}
+	if hdr.Mode.IsDir() {
+		return nil
+	}
+	_, err = io.Copy(fw, content)
+	return err
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestWriteArchive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "hello"), []byte("#!/bin/sh\necho hi\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("Hello, World!\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/hello", filepath.Join(dir, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	narData := new(bytes.Buffer)
+	if err := nar.DumpPath(narData, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []archiveEntry{
+		{name: "hello-1.0/", mode: fs.ModeDir | 0o755},
+		{name: "hello-1.0/README", mode: 0o644, content: "Hello, World!\n"},
+		{name: "hello-1.0/bin/", mode: fs.ModeDir | 0o755},
+		{name: "hello-1.0/bin/hello", mode: 0o755, content: "#!/bin/sh\necho hi\n"},
+		{name: "hello-1.0/hello", mode: fs.ModeSymlink | 0o777, content: "bin/hello"},
+	}
+	for _, format := range []ArchiveFormat{TarArchive, ZipArchive} {
+		t.Run(string(format), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := WriteArchive(buf, format, "hello-1.0", bytes.NewReader(narData.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			got := readArchive(t, format, buf.Bytes())
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(archiveEntry{})); diff != "" {
+				t.Errorf("entries (-want +got):\n%s", diff)
+			}
+
+			buf2 := new(bytes.Buffer)
+			if err := WriteArchive(buf2, format, "hello-1.0", bytes.NewReader(narData.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), buf2.Bytes()) {
+				t.Error("archive is not deterministic")
+			}
+		})
+	}
+}
+
+func TestWriteArchiveFile(t *testing.T) {
+	narData := new(bytes.Buffer)
+	nw := nar.NewWriter(narData)
+	if err := nw.WriteHeader(&nar.Header{Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(nw, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteArchive(io.Discard, TarArchive, "", bytes.NewReader(narData.Bytes())); err == nil {
+		t.Error("WriteArchive with empty prefix did not return an error")
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteArchive(buf, TarArchive, "foo.txt", bytes.NewReader(narData.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	want := []archiveEntry{{name: "foo.txt", mode: 0o644, content: "foo"}}
+	if diff := cmp.Diff(want, readArchive(t, TarArchive, buf.Bytes()), cmp.AllowUnexported(archiveEntry{})); diff != "" {
+		t.Errorf("entries (-want +got):\n%s", diff)
+	}
+}
+
+type archiveEntry struct {
+	name    string
+	mode    fs.FileMode
+	content string
+}
+
+func readArchive(tb testing.TB, format ArchiveFormat, data []byte) []archiveEntry {
+	tb.Helper()
+	var entries []archiveEntry
+	switch format {
+	case TarArchive:
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if !hdr.ModTime.Equal(archiveTime) || hdr.Uid != 0 || hdr.Uname != "" {
+				tb.Errorf("%s: time = %v, uid = %d, uname = %q", hdr.Name, hdr.ModTime, hdr.Uid, hdr.Uname)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				content = []byte(hdr.Linkname)
+			}
+			entries = append(entries, archiveEntry{
+				name:    hdr.Name,
+				mode:    hdr.FileInfo().Mode(),
+				content: string(content),
+			})
+		}
+	case ZipArchive:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if !f.Modified.Equal(archiveTime) {
+				tb.Errorf("%s: time = %v", f.Name, f.Modified.In(time.UTC))
+			}
+			r, err := f.Open()
+			if err != nil {
+				tb.Fatal(err)
+			}
+			content, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				tb.Fatal(err)
+			}
+			entries = append(entries, archiveEntry{
+				name:    f.Name,
+				mode:    f.Mode(),
+				content: string(content),
+			})
+		}
+	}
+	return entries
+}
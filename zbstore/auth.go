@@ -0,0 +1,135 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// An AuthPolicy decides which clients may use a [Server]
+// and which of them are trusted.
+// Allowed clients may build and query the store
+// and may register garbage collector roots in locations they own.
+// Trusted clients may additionally register roots anywhere.
+//
+// Each list entry is a user name, "@" followed by a group name
+// (matching every member of the group), or "*" (matching everyone).
+type AuthPolicy struct {
+	// TrustedUsers is the list of trusted clients.
+	// If nil, only root is trusted.
+	TrustedUsers []string
+	// AllowedUsers is the list of clients that may connect.
+	// Trusted users are always allowed.
+	// If nil, everyone is allowed.
+	AllowedUsers []string
+}
+
+// A ClientIdentity is the user behind a connection to a [Server].
+type ClientIdentity struct {
+	// Peer is the connecting process.
+	// It is nil if the platform cannot identify the peer.
+	Peer *Peer
+	// User is the name of the peer's user.
+	// It is empty if the peer is unknown.
+	User string
+	// Groups are the names of the groups the user belongs to.
+	Groups []string
+	// Trusted is whether the policy trusts the user.
+	Trusted bool
+}
+
+func (id *ClientIdentity) String() string {
+	if id.User == "" {
+		return id.Peer.String()
+	}
+	return fmt.Sprintf("%s (%v)", id.User, id.Peer)
+}
+
+// Authorize identifies the user behind peer
+// and checks whether the policy allows it to connect.
+// A nil policy uses the defaults described in [AuthPolicy].
+func (p *AuthPolicy) Authorize(peer *Peer) (*ClientIdentity, error) {
+	id := &ClientIdentity{Peer: peer}
+	if peer != nil {
+		u, err := user.LookupId(strconv.Itoa(peer.UID))
+		if err != nil {
+			return nil, fmt.Errorf("authorize %v: %v", peer, err)
+		}
+		id.User = u.Username
+		gids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("authorize %v: %v", peer, err)
+		}
+		for _, gid := range gids {
+			if g, err := user.LookupGroupId(gid); err == nil {
+				id.Groups = append(id.Groups, g.Name)
+			}
+		}
+	}
+	if err := p.check(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// check fills in id.Trusted and reports an error if id may not connect.
+func (p *AuthPolicy) check(id *ClientIdentity) error {
+	trusted := []string{"root"}
+	allowed := []string{"*"}
+	if p != nil && p.TrustedUsers != nil {
+		trusted = p.TrustedUsers
+	}
+	if p != nil && p.AllowedUsers != nil {
+		allowed = p.AllowedUsers
+	}
+	id.Trusted = id.User != "" && matchUser(trusted, id.User, id.Groups)
+	if id.Trusted {
+		return nil
+	}
+	if !matchUser(allowed, id.User, id.Groups) {
+		return fmt.Errorf("%v is not an allowed user", id)
+	}
+	return nil
+}
+
+func matchUser(list []string, name string, groups []string) bool {
+	for _, entry := range list {
+		switch {
+		case entry == "*":
+			return true
+		case name == "":
+			// Only wildcards match unknown users.
+		case strings.HasPrefix(entry, "@"):
+			if slices.Contains(groups, entry[1:]) {
+				return true
+			}
+		case entry == name:
+			return true
+		}
+	}
+	return false
+}
+
+// userRootsDirPath reports whether dir is inside the client's [Store.UserRootsDir].
+// If so, it returns dir relative to the backend's per-user roots directory,
+// which only the backend can write to.
+func (id *ClientIdentity) userRootsDirPath(s *Store, dir string) (perUserDir, rel string, ok bool) {
+	if id.User == "" {
+		return "", "", false
+	}
+	if rel, err := filepath.Rel(s.UserRootsDir(id.User), dir); err != nil || !filepath.IsLocal(rel) {
+		return "", "", false
+	}
+	perUserDir = filepath.Join(s.stateDir(), "gcroots", "per-user")
+	rel, err := filepath.Rel(perUserDir, dir)
+	if err != nil {
+		return "", "", false
+	}
+	return perUserDir, rel, true
+}
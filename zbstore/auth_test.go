@@ -0,0 +1,204 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAuthPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      *AuthPolicy
+		user        string
+		groups      []string
+		wantAllowed bool
+		wantTrusted bool
+	}{
+		{
+			name:        "DefaultRoot",
+			user:        "root",
+			groups:      []string{"root"},
+			wantAllowed: true,
+			wantTrusted: true,
+		},
+		{
+			name:        "DefaultUser",
+			user:        "alice",
+			groups:      []string{"users"},
+			wantAllowed: true,
+		},
+		{
+			name:        "DefaultUnknown",
+			wantAllowed: true,
+		},
+		{
+			name:        "TrustedGroup",
+			policy:      &AuthPolicy{TrustedUsers: []string{"root", "@wheel"}},
+			user:        "alice",
+			groups:      []string{"users", "wheel"},
+			wantAllowed: true,
+			wantTrusted: true,
+		},
+		{
+			name:        "TrustedImpliesAllowed",
+			policy:      &AuthPolicy{TrustedUsers: []string{"ci"}, AllowedUsers: []string{"@builders"}},
+			user:        "ci",
+			wantAllowed: true,
+			wantTrusted: true,
+		},
+		{
+			name:        "AllowedGroup",
+			policy:      &AuthPolicy{AllowedUsers: []string{"@builders"}},
+			user:        "bob",
+			groups:      []string{"builders"},
+			wantAllowed: true,
+		},
+		{
+			name:   "NotAllowed",
+			policy: &AuthPolicy{AllowedUsers: []string{"@builders"}},
+			user:   "mallory",
+			groups: []string{"users"},
+		},
+		{
+			name:   "UnknownNotAllowed",
+			policy: &AuthPolicy{AllowedUsers: []string{"@builders"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := &ClientIdentity{User: test.user, Groups: test.groups}
+			err := test.policy.check(id)
+			if allowed := err == nil; allowed != test.wantAllowed {
+				t.Errorf("check(...) = %v; want allowed=%t", err, test.wantAllowed)
+			}
+			if err == nil && id.Trusted != test.wantTrusted {
+				t.Errorf("Trusted = %t; want %t", id.Trusted, test.wantTrusted)
+			}
+		})
+	}
+}
+
+func TestOpenRootDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership not available")
+	}
+	store := &Store{Root: t.TempDir()}
+	for _, user := range []string{"alice", "bob"} {
+		if err := os.MkdirAll(store.UserRootsDir(user), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ownDir := t.TempDir()
+	// A symlink in alice's roots directory must not lead elsewhere.
+	if err := os.Symlink(ownDir, filepath.Join(store.UserRootsDir("alice"), "escape")); err != nil {
+		t.Fatal(err)
+	}
+	ownDirLink := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(ownDir, ownDirLink); err != nil {
+		t.Fatal(err)
+	}
+	peer := &Peer{UID: os.Getuid()}
+	otherPeer := &Peer{UID: os.Getuid() + 1}
+	alice := &ClientIdentity{Peer: peer, User: "alice"}
+	// The test's files all belong to the same user,
+	// so the roots directory checks use a peer that doesn't own them.
+	aliceElsewhere := &ClientIdentity{Peer: otherPeer, User: "alice"}
+	mallory := &ClientIdentity{Peer: otherPeer, User: "mallory"}
+
+	tests := []struct {
+		client *ClientIdentity
+		link   string
+		want   string
+	}{
+		{alice, filepath.Join(ownDir, "result"), ownDir},
+		{alice, filepath.Join(ownDirLink, "result"), ""},
+		{aliceElsewhere, filepath.Join(store.UserRootsDir("alice"), "hello"), store.UserRootsDir("alice")},
+		{aliceElsewhere, filepath.Join(store.UserRootsDir("alice"), "escape", "hello"), ""},
+		{aliceElsewhere, filepath.Join(store.UserRootsDir("bob"), "hello"), ""},
+		{aliceElsewhere, filepath.Join(store.UserRootsDir("alice"), "..", "bob", "hello"), ""},
+		{mallory, filepath.Join(ownDir, "result"), ""},
+		{mallory, filepath.Join(store.UserRootsDir("alice"), "hello"), ""},
+	}
+	for _, test := range tests {
+		link := filepath.Clean(test.link)
+		f, err := test.client.openRootDir(store, link)
+		if err != nil {
+			if test.want != "" {
+				t.Errorf("(%s).openRootDir(%q): %v", test.client.User, link, err)
+			}
+			continue
+		}
+		got := f.Name()
+		f.Close()
+		if test.want == "" {
+			t.Errorf("(%s).openRootDir(%q) = %q, <nil>; want error", test.client.User, link, got)
+		} else if got != test.want {
+			t.Errorf("(%s).openRootDir(%q) = %q, <nil>; want %q", test.client.User, link, got, test.want)
+		}
+	}
+}
+
+func TestAddRootAt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks not available")
+	}
+	ctx := context.Background()
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	store := &Store{Root: t.TempDir()}
+	client := &ClientIdentity{Peer: &Peer{UID: os.Getuid()}, User: "alice"}
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "project")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "result")
+	f, err := client.openRootDir(store, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Replace the directory with a symlink after it was checked.
+	elsewhere := t.TempDir()
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(elsewhere, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.addRootAt(ctx, f, "result", link, testHelloPath, os.Getuid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(elsewhere, "result")); err == nil {
+		t.Error("root was created through the replaced directory")
+	}
+	if got, err := os.Readlink(filepath.Join(dir+".old", "result")); err != nil {
+		t.Error(err)
+	} else if got != string(testHelloPath) {
+		t.Errorf("root points to %q; want %q", got, testHelloPath)
+	}
+	autoRoots, err := os.ReadDir(filepath.Join(store.stateDir(), "gcroots", "auto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(autoRoots) != 1 {
+		t.Fatalf("%d indirect roots; want 1", len(autoRoots))
+	}
+	if got, err := os.Readlink(filepath.Join(store.stateDir(), "gcroots", "auto", autoRoots[0].Name())); err != nil {
+		t.Error(err)
+	} else if got != link {
+		t.Errorf("indirect root points to %q; want %q", got, link)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultBinfmtDir is the directory where Linux exposes
+// its binfmt_misc registrations.
+const DefaultBinfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// An Emulator is a binfmt_misc registration
+// that lets the kernel run programs built for another system type,
+// typically with QEMU user-mode emulation.
+type Emulator struct {
+	// System is the system type (e.g. "aarch64-linux")
+	// whose programs the emulator runs.
+	System string
+	// Name is the name of the registration.
+	Name string
+	// Interpreter is the path to the emulator program.
+	Interpreter string
+	// FixBinary is true if the kernel opened the interpreter when it was registered
+	// (the "F" flag), so the interpreter does not need to be visible
+	// inside the build sandbox.
+	FixBinary bool
+}
+
+// qemuSystems maps QEMU's architecture names to system types.
+var qemuSystems = map[string]string{
+	"aarch64":     "aarch64-linux",
+	"arm":         "armv7l-linux",
+	"i386":        "i686-linux",
+	"x86_64":      "x86_64-linux",
+	"riscv64":     "riscv64-linux",
+	"ppc64le":     "powerpc64le-linux",
+	"s390x":       "s390x-linux",
+	"mips64el":    "mips64el-linux",
+	"loongarch64": "loongarch64-linux",
+}
+
+// Emulators returns the enabled binfmt_misc registrations
+// in the given directory (usually [DefaultBinfmtDir])
+// that emulate a known Linux system type.
+// Registrations are recognized by name:
+// either QEMU's naming convention (e.g. "qemu-aarch64")
+// or the system type itself (e.g. "aarch64-linux", as NixOS registers them).
+// If the directory does not exist, Emulators returns an empty list.
+func Emulators(dir string) ([]Emulator, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list emulators: %v", err)
+	}
+	var emulators []Emulator
+	for _, ent := range entries {
+		name := ent.Name()
+		if name == "register" || name == "status" {
+			continue
+		}
+		system, ok := emulatedSystem(name)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("list emulators: %v", err)
+		}
+		emu, enabled := parseBinfmtEntry(data)
+		if !enabled {
+			continue
+		}
+		emu.System = system
+		emu.Name = name
+		emulators = append(emulators, emu)
+	}
+	return emulators, nil
+}
+
+// EmulatedSystems returns the system types that the given emulators can run,
+// excluding host and the systems it can run natively (see [CompatibleSystems]).
+func EmulatedSystems(host string, emulators []Emulator) []string {
+	native := append([]string{host}, CompatibleSystems(host)...)
+	var systems []string
+	for _, emu := range emulators {
+		if !slices.Contains(native, emu.System) && !slices.Contains(systems, emu.System) {
+			systems = append(systems, emu.System)
+		}
+	}
+	slices.Sort(systems)
+	return systems
+}
+
+func emulatedSystem(name string) (system string, ok bool) {
+	if arch, ok := strings.CutPrefix(name, "qemu-"); ok {
+		system, ok = qemuSystems[arch]
+		return system, ok
+	}
+	for _, system := range qemuSystems {
+		if name == system {
+			return system, true
+		}
+	}
+	return "", false
+}
+
+// parseBinfmtEntry parses the contents of a binfmt_misc registration file.
+func parseBinfmtEntry(data []byte) (emu Emulator, enabled bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case line == "enabled":
+			enabled = true
+		case strings.HasPrefix(line, "interpreter "):
+			emu.Interpreter = strings.TrimPrefix(line, "interpreter ")
+		case strings.HasPrefix(line, "flags:"):
+			emu.FixBinary = strings.Contains(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), "F")
+		}
+	}
+	return emu, enabled
+}
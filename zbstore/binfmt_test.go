@@ -0,0 +1,84 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEmulators(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"register": "",
+		"status":   "enabled\n",
+		"qemu-aarch64": "enabled\n" +
+			"interpreter /usr/bin/qemu-aarch64-static\n" +
+			"flags: OCF\n" +
+			"offset 0\n" +
+			"magic 7f454c460201010000000000000000000200b700\n" +
+			"mask ffffffffffffff00fffffffffffffffffeffffff\n",
+		"riscv64-linux": "enabled\n" +
+			"interpreter /run/binfmt/riscv64-linux\n" +
+			"flags: P\n",
+		"qemu-s390x": "disabled\n" +
+			"interpreter /usr/bin/qemu-s390x-static\n" +
+			"flags: F\n",
+		"qemu-i386": "enabled\n" +
+			"interpreter /usr/bin/qemu-i386-static\n" +
+			"flags: F\n",
+		"python3.11": "enabled\n" +
+			"interpreter /usr/bin/python3.11\n" +
+			"flags: \n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Emulators(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries are listed in directory order.
+	want := []Emulator{
+		{
+			System:      "aarch64-linux",
+			Name:        "qemu-aarch64",
+			Interpreter: "/usr/bin/qemu-aarch64-static",
+			FixBinary:   true,
+		},
+		{
+			System:      "i686-linux",
+			Name:        "qemu-i386",
+			Interpreter: "/usr/bin/qemu-i386-static",
+			FixBinary:   true,
+		},
+		{
+			System:      "riscv64-linux",
+			Name:        "riscv64-linux",
+			Interpreter: "/run/binfmt/riscv64-linux",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Emulators(...) (-want +got):\n%s", diff)
+	}
+
+	gotSystems := EmulatedSystems("x86_64-linux", got)
+	wantSystems := []string{"aarch64-linux", "riscv64-linux"}
+	if diff := cmp.Diff(wantSystems, gotSystems); diff != "" {
+		t.Errorf("EmulatedSystems(\"x86_64-linux\", ...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestEmulatorsMissingDir(t *testing.T) {
+	got, err := Emulators(filepath.Join(t.TempDir(), "binfmt_misc"))
+	if len(got) != 0 || err != nil {
+		t.Errorf("Emulators(<missing>) = %v, %v; want [], <nil>", got, err)
+	}
+}
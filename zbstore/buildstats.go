@@ -0,0 +1,235 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BuildStats is the time and resources that a derivation's build used.
+type BuildStats struct {
+	DrvPath nix.StorePath
+	// Name is the package name: the derivation's name without its version.
+	Name  string
+	Start time.Time
+	End   time.Time
+	// CPUTime is the user and system CPU time that the build used,
+	// or -1 if unknown.
+	CPUTime time.Duration
+	// PeakMemory is the maximum resident memory that the build used in bytes,
+	// or -1 if unknown.
+	PeakMemory int64
+}
+
+// Duration returns the wall-clock time that the build took.
+func (stats *BuildStats) Duration() time.Duration {
+	return stats.End.Sub(stats.Start)
+}
+
+// PackageName returns the name of a derivation without its version,
+// splitting at the first dash that is not followed by a letter
+// in the same way as the build backend.
+// For example, the package name of "hello-2.12.1" is "hello".
+func PackageName(drvName string) string {
+	for i := 0; i+1 < len(drvName); i++ {
+		if drvName[i] == '-' && !isASCIILetter(drvName[i+1]) {
+			return drvName[:i]
+		}
+	}
+	return drvName
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// buildTimer records the start and end times and the failures of builds
+// from [BuildEvent] values.
+type buildTimer struct {
+	next     func(*BuildEvent)
+	started  map[uint64]*BuildStats
+	finished []*BuildStats
+	// failed maps the derivations that error messages mention
+	// to the first such message.
+	failed map[nix.StorePath]string
+}
+
+func newBuildTimer(next func(*BuildEvent)) *buildTimer {
+	return &buildTimer{
+		next:    next,
+		started: make(map[uint64]*BuildStats),
+		failed:  make(map[nix.StorePath]string),
+	}
+}
+
+func (bt *buildTimer) event(ev *BuildEvent) {
+	switch ev.Kind {
+	case BuildStarted:
+		bt.started[ev.ID] = &BuildStats{
+			DrvPath:    ev.DrvPath,
+			Name:       PackageName(strings.TrimSuffix(ev.DrvPath.Name(), ".drv")),
+			Start:      time.Now(),
+			CPUTime:    -1,
+			PeakMemory: -1,
+		}
+	case BuildFinished:
+		if stats := bt.started[ev.ID]; stats != nil {
+			stats.End = time.Now()
+			bt.finished = append(bt.finished, stats)
+			delete(bt.started, ev.ID)
+		}
+	case Message:
+		if ev.Error {
+			// Failures are reported after the build finishes.
+			for _, stats := range bt.finished {
+				_, seen := bt.failed[stats.DrvPath]
+				if !seen && strings.Contains(ev.Text, string(stats.DrvPath)) {
+					bt.failed[stats.DrvPath] = ev.Text
+				}
+			}
+		}
+	}
+	bt.next(ev)
+}
+
+// results returns the statistics of the builds that finished successfully.
+// If usage is not nil and only one build ran,
+// the build is charged with the usage.
+// Otherwise, the usage cannot be divided among the builds
+// and their CPU time and peak memory are unknown.
+func (bt *buildTimer) results(usage *processUsage) []*BuildStats {
+	if usage != nil && len(bt.finished) == 1 && len(bt.started) == 0 {
+		bt.finished[0].CPUTime = usage.cpuTime
+		bt.finished[0].PeakMemory = usage.peakMemory
+	}
+	var results []*BuildStats
+	for _, stats := range bt.finished {
+		if _, failed := bt.failed[stats.DrvPath]; !failed {
+			results = append(results, stats)
+		}
+	}
+	return results
+}
+
+// failures returns the builds that failed
+// along with the error message for each.
+func (bt *buildTimer) failures() []*BuildFailure {
+	var failures []*BuildFailure
+	for _, stats := range bt.finished {
+		if msg, failed := bt.failed[stats.DrvPath]; failed {
+			failures = append(failures, &BuildFailure{
+				DrvPath: stats.DrvPath,
+				Message: msg,
+				Time:    stats.End,
+			})
+		}
+	}
+	return failures
+}
+
+// processUsage is the resources used by a process and its children.
+type processUsage struct {
+	cpuTime    time.Duration
+	peakMemory int64
+}
+
+// RecordBuild saves the statistics of a build.
+func (db *DB) RecordBuild(ctx context.Context, stats *BuildStats) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var cpuTime, peakMemory any
+	if stats.CPUTime >= 0 {
+		cpuTime = stats.CPUTime.Microseconds()
+	}
+	if stats.PeakMemory >= 0 {
+		peakMemory = stats.PeakMemory
+	}
+	err := sqlitex.Execute(db.conn, `insert into "builds" ("drv_path", "name", "start_time", "end_time", "cpu_time", "peak_memory") values (?, ?, ?, ?, ?, ?);`, &sqlitex.ExecOptions{
+		Args: []any{
+			string(stats.DrvPath),
+			stats.Name,
+			stats.Start.UnixMilli(),
+			stats.End.UnixMilli(),
+			cpuTime,
+			peakMemory,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("record build of %s: %v", stats.DrvPath, err)
+	}
+	return nil
+}
+
+// SlowestBuilds returns the n recorded builds that took the longest,
+// longest first.
+func (db *DB) SlowestBuilds(ctx context.Context, n int) ([]*BuildStats, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var result []*BuildStats
+	err := sqlitex.Execute(db.conn, `select "drv_path", "name", "start_time", "end_time", "cpu_time", "peak_memory" from "builds" `+
+		`order by "end_time" - "start_time" desc, "drv_path" limit ?;`, &sqlitex.ExecOptions{
+		Args: []any{n},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stats := &BuildStats{
+				DrvPath:    nix.StorePath(stmt.ColumnText(0)),
+				Name:       stmt.ColumnText(1),
+				Start:      time.UnixMilli(stmt.ColumnInt64(2)),
+				End:        time.UnixMilli(stmt.ColumnInt64(3)),
+				CPUTime:    -1,
+				PeakMemory: -1,
+			}
+			if stmt.ColumnType(4) != sqlite.TypeNull {
+				stats.CPUTime = time.Duration(stmt.ColumnInt64(4)) * time.Microsecond
+			}
+			if stmt.ColumnType(5) != sqlite.TypeNull {
+				stats.PeakMemory = stmt.ColumnInt64(5)
+			}
+			result = append(result, stats)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query slowest builds: %v", err)
+	}
+	return result, nil
+}
+
+// PackageBuildTime is the cumulative time spent building a package.
+type PackageBuildTime struct {
+	Name string
+	// Builds is the number of recorded builds of the package.
+	Builds int
+	// Time is the total wall-clock time of the builds.
+	Time time.Duration
+	// CPUTime is the total CPU time of the builds whose CPU time is known.
+	CPUTime time.Duration
+}
+
+// BuildTimeByPackage returns the cumulative build time of each package name,
+// most time first.
+func (db *DB) BuildTimeByPackage(ctx context.Context) ([]*PackageBuildTime, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var result []*PackageBuildTime
+	err := sqlitex.Execute(db.conn, `select "name", count(*), sum("end_time" - "start_time"), coalesce(sum("cpu_time"), 0) from "builds" `+
+		`group by "name" order by 3 desc, 1;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			result = append(result, &PackageBuildTime{
+				Name:    stmt.ColumnText(0),
+				Builds:  stmt.ColumnInt(1),
+				Time:    time.Duration(stmt.ColumnInt64(2)) * time.Millisecond,
+				CPUTime: time.Duration(stmt.ColumnInt64(3)) * time.Microsecond,
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query build time by package: %v", err)
+	}
+	return result, nil
+}
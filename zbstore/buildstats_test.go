@@ -0,0 +1,136 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestPackageName(t *testing.T) {
+	tests := []struct {
+		drvName string
+		want    string
+	}{
+		{"hello", "hello"},
+		{"hello-2.12.1", "hello"},
+		{"gnu-hello-2.12.1", "gnu-hello"},
+		{"source", "source"},
+		{"foo-", "foo-"},
+		{"python3.11-requests-2.31.0", "python3.11-requests"},
+	}
+	for _, test := range tests {
+		if got := PackageName(test.drvName); got != test.want {
+			t.Errorf("PackageName(%q) = %q; want %q", test.drvName, got, test.want)
+		}
+	}
+}
+
+func TestBuildTimer(t *testing.T) {
+	const (
+		hello nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-2.12.drv"
+		bad   nix.StorePath = "/nix/store/00000000000000000000000000000000-bad-1.0.drv"
+	)
+	var forwarded int
+	bt := newBuildTimer(func(*BuildEvent) { forwarded++ })
+	events := []*BuildEvent{
+		{Kind: BuildStarted, ID: 1, DrvPath: hello},
+		{Kind: BuildStarted, ID: 2, DrvPath: bad},
+		{Kind: BuildFinished, ID: 1, DrvPath: hello},
+		{Kind: BuildFinished, ID: 2, DrvPath: bad},
+		{Kind: Message, Text: "error: builder for '" + string(bad) + "' failed with exit code 1", Error: true},
+	}
+	for _, ev := range events {
+		bt.event(ev)
+	}
+	if forwarded != len(events) {
+		t.Errorf("forwarded %d events; want %d", forwarded, len(events))
+	}
+	got := bt.results(&processUsage{cpuTime: time.Second, peakMemory: 1 << 20})
+	if len(got) != 1 {
+		t.Fatalf("results = %d builds; want 1", len(got))
+	}
+	if got[0].DrvPath != hello || got[0].Name != "hello" {
+		t.Errorf("results[0] = %s (%q); want %s (%q)", got[0].DrvPath, got[0].Name, hello, "hello")
+	}
+	failures := bt.failures()
+	if len(failures) != 1 || failures[0].DrvPath != bad || !strings.Contains(failures[0].Message, "exit code 1") {
+		t.Errorf("failures = %+v; want failure of %s", failures, bad)
+	}
+	// Usage can't be divided between concurrent builds.
+	if got[0].CPUTime != -1 || got[0].PeakMemory != -1 {
+		t.Errorf("results[0] CPU time, peak memory = %v, %d; want -1, -1", got[0].CPUTime, got[0].PeakMemory)
+	}
+
+	bt = newBuildTimer(func(*BuildEvent) {})
+	bt.event(&BuildEvent{Kind: BuildStarted, ID: 1, DrvPath: hello})
+	bt.event(&BuildEvent{Kind: BuildFinished, ID: 1, DrvPath: hello})
+	got = bt.results(&processUsage{cpuTime: time.Second, peakMemory: 1 << 20})
+	if len(got) != 1 || got[0].CPUTime != time.Second || got[0].PeakMemory != 1<<20 {
+		t.Errorf("results for single build = %+v; want CPU time 1s and peak memory 1 MiB", got)
+	}
+}
+
+func TestBuildStatsDB(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	t0 := time.UnixMilli(1700000000000)
+	builds := []*BuildStats{
+		{
+			DrvPath:    "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-2.12.drv",
+			Name:       "hello",
+			Start:      t0,
+			End:        t0.Add(10 * time.Second),
+			CPUTime:    -1,
+			PeakMemory: -1,
+		},
+		{
+			DrvPath:    "/nix/store/00000000000000000000000000000000-hello-2.13.drv",
+			Name:       "hello",
+			Start:      t0,
+			End:        t0.Add(30 * time.Second),
+			CPUTime:    20 * time.Second,
+			PeakMemory: 1 << 30,
+		},
+		{
+			DrvPath:    "/nix/store/11111111111111111111111111111111-gcc-13.drv",
+			Name:       "gcc",
+			Start:      t0,
+			End:        t0.Add(time.Minute),
+			CPUTime:    4 * time.Minute,
+			PeakMemory: 2 << 30,
+		},
+	}
+	for _, stats := range builds {
+		if err := db.RecordBuild(ctx, stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slowest, err := db.SlowestBuilds(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*BuildStats{builds[2], builds[1]}, slowest); diff != "" {
+		t.Errorf("SlowestBuilds(ctx, 2) (-want +got):\n%s", diff)
+	}
+
+	byPackage, err := db.BuildTimeByPackage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*PackageBuildTime{
+		{Name: "gcc", Builds: 1, Time: time.Minute, CPUTime: 4 * time.Minute},
+		{Name: "hello", Builds: 2, Time: 40 * time.Second, CPUTime: 20 * time.Second},
+	}
+	if diff := cmp.Diff(want, byPackage); diff != "" {
+		t.Errorf("BuildTimeByPackage(ctx) (-want +got):\n%s", diff)
+	}
+}
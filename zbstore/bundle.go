@@ -0,0 +1,275 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// ExportBundle writes the closure of the given store objects to w
+// as a bundle: a tar archive laid out like a binary cache,
+// with the NARs, .narinfo files (with their signatures),
+// and the given realizations (opts.Realizations),
+// for carrying store objects to a machine without network access.
+// Store derivations cannot be bundled,
+// since the backend would build them instead of copying them on import.
+// The options are interpreted like those of [Push].
+// Use [OpenBundle] and [Store.ImportBundle] to read the bundle.
+func ExportBundle(ctx context.Context, w io.Writer, store *Store, paths []nix.StorePath, opts *PushOptions) error {
+	if opts == nil {
+		opts = new(PushOptions)
+	}
+	if len(opts.Realizations) > 0 {
+		paths = slices.Clone(paths)
+		for _, r := range opts.Realizations {
+			paths = append(paths, r.OutPath)
+		}
+	}
+	closure, err := ComputeClosure(paths, func(path nix.StorePath) (*PathInfo, error) {
+		return store.QueryPathInfo(ctx, path)
+	})
+	if err != nil {
+		return fmt.Errorf("export bundle: %v", err)
+	}
+	for _, info := range closure {
+		if info.Path.IsDerivation() {
+			return fmt.Errorf("export bundle: %s is a store derivation", info.Path)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	put := func(ctx context.Context, name string, contentType string, body io.Reader, size int64) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     0o644,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, body)
+		return err
+	}
+	cacheInfo, err := (&nix.CacheInfo{StoreDirectory: store.dir()}).MarshalText()
+	if err != nil {
+		return fmt.Errorf("export bundle: %v", err)
+	}
+	if err := put(ctx, nix.CacheInfoName, nix.CacheInfoMIMEType, bytes.NewReader(cacheInfo), int64(len(cacheInfo))); err != nil {
+		return fmt.Errorf("export bundle: %v", err)
+	}
+	for _, info := range closure {
+		log.Debugf(ctx, "Adding %s to bundle", info.Path)
+		if err := pushObject(ctx, store, put, info, opts); err != nil {
+			return fmt.Errorf("export bundle: %s: %v", info.Path, err)
+		}
+	}
+	for _, r := range opts.Realizations {
+		if err := pushRealization(ctx, put, r, opts.SecretKey); err != nil {
+			return fmt.Errorf("export bundle: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("export bundle: %v", err)
+	}
+	return nil
+}
+
+// Bundle is a bundle written by [ExportBundle]
+// that has been unpacked into a temporary directory.
+type Bundle struct {
+	dir string
+
+	// StoreDir is the store directory of the bundle's store objects.
+	StoreDir nix.StoreDirectory
+	// Paths is the list of store objects in the bundle,
+	// sorted by path.
+	Paths []nix.StorePath
+	// Realizations is the list of realizations in the bundle.
+	// Their signatures have not been checked.
+	Realizations []*Realization
+}
+
+// OpenBundle unpacks a bundle written by [ExportBundle]
+// into a temporary directory.
+// The caller is responsible for calling [Bundle.Close]
+// to remove the directory.
+func OpenBundle(r io.Reader) (_ *Bundle, err error) {
+	dir, err := os.MkdirTemp("", "zb-bundle-*")
+	if err != nil {
+		return nil, fmt.Errorf("open bundle: %v", err)
+	}
+	b := &Bundle{dir: dir}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+	if err := b.unpack(r); err != nil {
+		return nil, fmt.Errorf("open bundle: %v", err)
+	}
+	return b, nil
+}
+
+func (b *Bundle) unpack(r io.Reader) error {
+	tr := tar.NewReader(r)
+	hasCacheInfo := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := hdr.Name
+		if hdr.Typeflag != tar.TypeReg || !isBundleFile(name) {
+			return fmt.Errorf("unexpected file %q", name)
+		}
+		if dir, _ := path.Split(name); dir != "" {
+			if err := os.MkdirAll(filepath.Join(b.dir, filepath.FromSlash(dir)), 0o755); err != nil {
+				return err
+			}
+		}
+		f, err := os.OpenFile(filepath.Join(b.dir, filepath.FromSlash(name)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		var buf *bytes.Buffer
+		var w io.Writer = f
+		if !strings.HasPrefix(name, "nar/") {
+			buf = new(bytes.Buffer)
+			w = io.MultiWriter(f, buf)
+		}
+		_, err = io.Copy(w, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		switch {
+		case name == nix.CacheInfoName:
+			info := new(nix.CacheInfo)
+			if err := info.UnmarshalText(buf.Bytes()); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			b.StoreDir = info.StoreDirectory
+			hasCacheInfo = true
+		case strings.HasSuffix(name, nix.NARInfoExtension):
+			info := new(nix.NARInfo)
+			if err := info.UnmarshalText(buf.Bytes()); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if info.StorePath.Digest()+nix.NARInfoExtension != name {
+				return fmt.Errorf("%s: describes %s", name, info.StorePath)
+			}
+			if info.StorePath.IsDerivation() {
+				return fmt.Errorf("%s: %s is a store derivation", name, info.StorePath)
+			}
+			b.Paths = append(b.Paths, info.StorePath)
+		case strings.HasPrefix(name, realizationCacheDir+"/"):
+			r := new(Realization)
+			if err := json.Unmarshal(buf.Bytes(), r); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if realizationCachePath(r.ID) != name {
+				return fmt.Errorf("%s: describes %v", name, r.ID)
+			}
+			b.Realizations = append(b.Realizations, r)
+		}
+	}
+	if !hasCacheInfo {
+		return fmt.Errorf("missing %s (not a bundle?)", nix.CacheInfoName)
+	}
+	for _, p := range b.Paths {
+		if p.Dir() != b.StoreDir {
+			return fmt.Errorf("%s is not in %s", p, b.StoreDir)
+		}
+	}
+	slices.Sort(b.Paths)
+	return nil
+}
+
+// isBundleFile reports whether name is the name of a file
+// that [ExportBundle] writes.
+func isBundleFile(name string) bool {
+	dir, base := path.Split(name)
+	if base == "" || base == "." || base == ".." || strings.HasPrefix(base, ".") {
+		return false
+	}
+	switch dir {
+	case "":
+		return base == nix.CacheInfoName ||
+			strings.HasSuffix(base, nix.NARInfoExtension) ||
+			strings.HasSuffix(base, nar.ListingExtension)
+	case "nar/":
+		return strings.Contains(base, ".nar")
+	case realizationCacheDir + "/":
+		return strings.HasSuffix(base, realizationExtension)
+	default:
+		return false
+	}
+}
+
+// URL returns the file:// URL of the unpacked bundle,
+// which the backend can use as a binary cache.
+func (b *Bundle) URL() string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(b.dir)}).String()
+}
+
+// Close removes the bundle's temporary directory.
+func (b *Bundle) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+// ImportBundle copies all the store objects in the bundle into s,
+// skipping those that are already valid.
+// Unless s.NoRequireSigs is set,
+// the backend only accepts store objects signed by s.TrustedPublicKeys.
+// ImportBundle always runs the backend directly,
+// even if s.Socket is set,
+// and does not record the bundle's realizations:
+// see [CheckRealizationTrust] and [DB.RecordRealization].
+func (s *Store) ImportBundle(ctx context.Context, b *Bundle) ([]nix.StorePath, error) {
+	if b.StoreDir != s.dir() {
+		return nil, fmt.Errorf("import bundle: bundle is for %s, not %s", b.StoreDir, s.dir())
+	}
+	if len(b.Paths) == 0 {
+		return nil, nil
+	}
+	local := new(Store)
+	*local = *s
+	local.Socket = ""
+	local.Substituters = []string{b.URL()}
+	local.ExtraSubstituters = nil
+	local.NoSubstitutes = false
+	local.NARInfoPositiveTTL = -1
+	local.NARInfoNegativeTTL = -1
+	paths, err := local.realise(ctx, nil, derivedPaths(b.Paths))
+	if err != nil {
+		return nil, fmt.Errorf("import bundle: %v", err)
+	}
+	return paths, nil
+}
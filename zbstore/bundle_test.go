@@ -0,0 +1,100 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestBundle(t *testing.T) {
+	ctx := context.Background()
+
+	nixStore := newTestNixStore(t, nil)
+	storeDir, path := nixStore.dir, nixStore.path
+
+	pk := testSigningKey(t)
+	realization := testRealization(t)
+	realization.OutPath = path
+	realization.Signatures = nil
+	bundleData := new(bytes.Buffer)
+	err := ExportBundle(ctx, bundleData, &Store{Dir: storeDir}, nil, &PushOptions{
+		SecretKey:    pk,
+		Realizations: []*Realization{realization},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := OpenBundle(bytes.NewReader(bundleData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	if b.StoreDir != storeDir {
+		t.Errorf("b.StoreDir = %q; want %q", b.StoreDir, storeDir)
+	}
+	if len(b.Paths) != 1 || b.Paths[0] != path {
+		t.Errorf("b.Paths = %q; want [%q]", b.Paths, path)
+	}
+	if len(b.Realizations) != 1 {
+		t.Errorf("len(b.Realizations) = %d; want 1", len(b.Realizations))
+	} else if err := CheckRealizationTrust([]*nix.PublicKey{pk.PublicKey()}, b.Realizations[0]); err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(b.URL(), "file:///") {
+		t.Errorf("b.URL() = %q; want file:// URL", b.URL())
+	}
+
+	// The unpacked bundle is a binary cache.
+	srv := httptest.NewServer(http.FileServer(http.Dir(b.dir)))
+	t.Cleanup(srv.Close)
+	sub := &Substituter{
+		URL:               srv.URL,
+		TrustedPublicKeys: []*nix.PublicKey{pk.PublicKey()},
+	}
+	info, err := sub.NARInfo(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAllNAR(t, sub, info); !bytes.Equal(got, nixStore.nar) {
+		t.Error("NAR read from bundle does not match")
+	}
+	if _, err := sub.Realization(ctx, realization.ID); err != nil {
+		t.Error(err)
+	}
+
+	// Importing into a different store directory is rejected.
+	if _, err := (&Store{Dir: "/zb/store"}).ImportBundle(ctx, b); err == nil {
+		t.Error("ImportBundle into /zb/store did not return an error")
+	}
+}
+
+func TestOpenBundleRejectsUnexpectedFiles(t *testing.T) {
+	for _, name := range []string{"../evil", "nar/../../evil", "/etc/passwd", "foo/bar", ".hidden.narinfo"} {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := OpenBundle(buf); err == nil {
+			b.Close()
+			t.Errorf("OpenBundle with %q did not return an error", name)
+		}
+	}
+}
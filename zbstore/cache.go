@@ -0,0 +1,493 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BinaryCache is an [http.Handler] that serves a store's objects
+// in the Nix binary cache format,
+// so that other machines can use the store as a substituter.
+// It only serves store objects: it does not accept uploads.
+type BinaryCache struct {
+	Store *Store
+	// Compression is the algorithm used to compress the NARs
+	// that the served .narinfo files point to:
+	// [nix.Zstandard], [nix.XZ], [nix.Gzip], or [nix.NoCompression].
+	// If empty, [nix.Zstandard] is used.
+	Compression nix.CompressionType
+	// SecretKey signs the served .narinfo files if not nil.
+	SecretKey *nix.PrivateKey
+	// Priority is the priority advertised to clients.
+	// Lower values mean higher priority.
+	Priority int
+	// Provenance is consulted for /<hash>.provenance requests if not nil.
+	// See [DB.Provenance].
+	Provenance *DB
+	// Chunks stores the content-defined chunks of served NARs if not nil.
+	// When set, the cache also serves /<hash>.chunks indexes
+	// and /chunks/<hash> files
+	// so that a [Substituter] with its own [ChunkStore]
+	// only downloads the chunks it does not have.
+	Chunks *ChunkStore
+	// Realizations is consulted for /realisations/<drv-hash>!<output>.doi requests
+	// if not nil.
+	// Only realizations of outputs present in Store are served,
+	// and they are signed with SecretKey if it is set.
+	// It may be the same database as Provenance.
+	Realizations *DB
+
+	// dbMu guards access to Provenance and Realizations.
+	dbMu sync.Mutex
+}
+
+// ServeHTTP serves /nix-cache-info, /<hash>.narinfo, /<hash>.provenance, /<hash>.ls,
+// /nar/<hash>.nar (optionally compressed as .nar.zst, .nar.xz, or .nar.gz), and if Chunks is set, /<hash>.chunks and /chunks/<hash>.
+// It also serves /delta/<base-hash>/<hash>,
+// a delta (see [WriteDelta]) that produces the NAR of the second store object
+// from the NAR of the first.
+// Deltas are only served between objects with the same name
+// and only when the delta is smaller than the NAR.
+// If Realizations is set, it also serves /realisations/<drv-hash>!<output>.doi
+// (see [Substituter.Realization]).
+func (c *BinaryCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	switch name := strings.TrimPrefix(r.URL.Path, "/"); {
+	case name == "nix-cache-info":
+		info := &nix.CacheInfo{
+			StoreDirectory: c.Store.dir(),
+			Priority:       c.Priority,
+			WantMassQuery:  true,
+		}
+		data, err := info.MarshalText()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-nix-cache-info")
+		w.Write(data)
+	case strings.HasSuffix(name, ".narinfo") && !strings.Contains(name, "/"):
+		c.serveNARInfo(ctx, w, strings.TrimSuffix(name, ".narinfo"))
+	case strings.HasSuffix(name, ".provenance") && !strings.Contains(name, "/"):
+		c.serveProvenance(ctx, w, strings.TrimSuffix(name, ".provenance"))
+	case strings.HasSuffix(name, nar.ListingExtension) && !strings.Contains(name, "/"):
+		c.serveListing(ctx, w, strings.TrimSuffix(name, nar.ListingExtension))
+	case strings.HasPrefix(name, "nar/") && !strings.Contains(strings.TrimPrefix(name, "nar/"), "/"):
+		hashPart, compression, ok := compressionForNARFile(strings.TrimPrefix(name, "nar/"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		c.serveNAR(ctx, w, r, hashPart, compression)
+	case strings.HasSuffix(name, ".chunks") && !strings.Contains(name, "/"):
+		c.serveChunkIndex(ctx, w, strings.TrimSuffix(name, ".chunks"))
+	case strings.HasPrefix(name, "chunks/"):
+		c.serveChunk(w, r, strings.TrimPrefix(name, "chunks/"))
+	case strings.HasPrefix(name, "delta/") && strings.Count(name, "/") == 2:
+		baseHashPart, hashPart, _ := strings.Cut(strings.TrimPrefix(name, "delta/"), "/")
+		c.serveDelta(ctx, w, baseHashPart, hashPart)
+	case strings.HasPrefix(name, realizationCacheDir+"/") && strings.HasSuffix(name, realizationExtension):
+		c.serveRealization(ctx, w, strings.TrimSuffix(strings.TrimPrefix(name, realizationCacheDir+"/"), realizationExtension))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *BinaryCache) serveNARInfo(ctx context.Context, w http.ResponseWriter, hashPart string) {
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.narinfo: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	info, err := c.Store.QueryPathInfo(ctx, path)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.narinfo: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	compression := c.Compression
+	if compression == "" {
+		compression = nix.Zstandard
+	}
+	ext, err := narFileExtension(compression)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.narinfo: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	narInfo := &nix.NARInfo{
+		StorePath:   info.Path,
+		URL:         "nar/" + hashPart + ext,
+		Compression: compression,
+		NARHash:     info.NARHash,
+		NARSize:     info.NARSize,
+		References:  info.References,
+		Deriver:     info.Deriver,
+		Sig:         info.Signatures,
+		CA:          info.CA,
+	}
+	if c.SecretKey != nil {
+		sig, err := nix.SignNARInfo(c.SecretKey, narInfo)
+		if err != nil {
+			log.Errorf(ctx, "Serving %s.narinfo: %v", hashPart, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		narInfo.AddSignatures(sig)
+	}
+	data, err := narInfo.MarshalText()
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.narinfo: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-nix-narinfo")
+	w.Write(data)
+}
+
+func (c *BinaryCache) serveListing(ctx context.Context, w http.ResponseWriter, hashPart string) {
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.ls: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ls, err := c.Store.ListObject(ctx, path)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.ls: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	data, err := encodeListing(ls)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.ls: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", nar.ListingMIMEType)
+	w.Header().Set("Content-Encoding", "br")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (c *BinaryCache) serveProvenance(ctx context.Context, w http.ResponseWriter, hashPart string) {
+	if c.Provenance == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.provenance: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	c.dbMu.Lock()
+	env, err := c.Provenance.Provenance(ctx, path)
+	c.dbMu.Unlock()
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.provenance: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.provenance: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.dsse.envelope.v1+json")
+	w.Write(data)
+}
+
+func (c *BinaryCache) serveRealization(ctx context.Context, w http.ResponseWriter, idString string) {
+	if c.Realizations == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	id, err := ParseDrvOutput(idString)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	c.dbMu.Lock()
+	r, err := c.Realizations.Realization(ctx, id)
+	c.dbMu.Unlock()
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving realization %v: %v", id, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := c.Store.QueryPathInfo(ctx, r.OutPath); errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Serving realization %v: %v", id, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if c.SecretKey != nil && !hasSignatureFrom(r.Signatures, c.SecretKey.Name()) {
+		sig, err := SignRealization(c.SecretKey, r)
+		if err != nil {
+			log.Errorf(ctx, "Serving realization %v: %v", id, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		r.Signatures = append(r.Signatures, sig)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf(ctx, "Serving realization %v: %v", id, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (c *BinaryCache) serveNAR(ctx context.Context, w http.ResponseWriter, r *http.Request, hashPart string, compression nix.CompressionType) {
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.nar: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// Dump into memory first so that errors can be reported with a status code.
+	buf := new(bytes.Buffer)
+	zw, err := compressNAR(buf, compression)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.nar: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	err = nar.DumpPath(zw, c.Store.RealPath(string(path)))
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.nar: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-nix-nar")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+func (c *BinaryCache) serveChunkIndex(ctx context.Context, w http.ResponseWriter, hashPart string) {
+	if c.Chunks == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.chunks: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	info, err := c.Store.QueryPathInfo(ctx, path)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.chunks: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	idx, err := c.Chunks.Index(hashPart)
+	if err != nil || !idx.NARHash.Equal(info.NARHash) {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Warnf(ctx, "%v", err)
+		}
+		idx, err = c.chunkNAR(path)
+		if err != nil {
+			log.Errorf(ctx, "Serving %s.chunks: %v", hashPart, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !idx.NARHash.Equal(info.NARHash) {
+			log.Errorf(ctx, "Serving %s.chunks: %s has been modified (NAR hash is %v, expected %v)", hashPart, path, idx.NARHash, info.NARHash)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := c.Chunks.SaveIndex(hashPart, idx); err != nil {
+			log.Warnf(ctx, "%v", err)
+		}
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		log.Errorf(ctx, "Serving %s.chunks: %v", hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// chunkNAR splits the NAR of the given store object into c.Chunks.
+func (c *BinaryCache) chunkNAR(path nix.StorePath) (*ChunkIndex, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(nar.DumpPath(pw, c.Store.RealPath(string(path))))
+	}()
+	idx, err := c.Chunks.AddNAR(pr)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return idx, nil
+}
+
+func (c *BinaryCache) serveDelta(ctx context.Context, w http.ResponseWriter, baseHashPart, hashPart string) {
+	basePath, err := c.Store.QueryPathFromHashPart(ctx, baseHashPart)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving delta from %s to %s: %v", baseHashPart, hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	path, err := c.Store.QueryPathFromHashPart(ctx, hashPart)
+	if errors.Is(err, ErrNotFound) || err == nil && path.Name() != basePath.Name() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "Serving delta from %s to %s: %v", baseHashPart, hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	baseNAR := new(bytes.Buffer)
+	if err := nar.DumpPath(baseNAR, c.Store.RealPath(string(basePath))); err != nil {
+		log.Errorf(ctx, "Serving delta from %s to %s: %v", baseHashPart, hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	targetNAR := new(bytes.Buffer)
+	if err := nar.DumpPath(targetNAR, c.Store.RealPath(string(path))); err != nil {
+		log.Errorf(ctx, "Serving delta from %s to %s: %v", baseHashPart, hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	delta := new(bytes.Buffer)
+	if err := WriteDelta(delta, baseNAR.Bytes(), targetNAR.Bytes()); err != nil {
+		log.Errorf(ctx, "Serving delta from %s to %s: %v", baseHashPart, hashPart, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if delta.Len() >= targetNAR.Len() {
+		// Not worth it: the client should download the NAR instead.
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", deltaMIMEType)
+	w.Write(delta.Bytes())
+}
+
+func (c *BinaryCache) serveChunk(w http.ResponseWriter, r *http.Request, name string) {
+	if c.Chunks == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, ok := c.Chunks.chunkPathFromName(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, p)
+}
+
+// QueryPathFromHashPart returns the valid store path
+// whose digest (see [nix.StorePath.Digest]) is hashPart.
+// If there is no such path, QueryPathFromHashPart returns an error
+// that wraps [ErrNotFound].
+func (s *Store) QueryPathFromHashPart(ctx context.Context, hashPart string) (nix.StorePath, error) {
+	if hashPart == "" || strings.Trim(hashPart, "0123456789abcdefghijklmnopqrstuvwxyz") != "" {
+		return "", fmt.Errorf("query path from hash %q: %w", hashPart, ErrNotFound)
+	}
+	prefix := s.dir().Join(hashPart) + "-"
+	conn, err := sqlite.OpenConn(filepath.Join(s.stateDir(), "db", "db.sqlite"), sqlite.OpenReadOnly)
+	if err != nil {
+		// Fall back to the file system, which may include invalid paths.
+		matches, _ := filepath.Glob(s.RealPath(prefix) + "*")
+		if len(matches) == 0 {
+			return "", fmt.Errorf("query path from hash %s: %w", hashPart, ErrNotFound)
+		}
+		return s.dir().Object(filepath.Base(matches[0]))
+	}
+	defer conn.Close()
+	conn.SetBusyTimeout(10 * time.Second)
+	defer conn.SetInterrupt(conn.SetInterrupt(ctx.Done()))
+
+	var path nix.StorePath
+	err = sqlitex.Execute(conn, `select "path" from "ValidPaths" where "path" >= ? order by "path" limit 1;`, &sqlitex.ExecOptions{
+		Args: []any{prefix},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if p := stmt.ColumnText(0); strings.HasPrefix(p, prefix) {
+				path = nix.StorePath(p)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("query path from hash %s: %v", hashPart, err)
+	}
+	if path == "" {
+		if s.Lower != nil {
+			return s.Lower.QueryPathFromHashPart(ctx, hashPart)
+		}
+		return "", fmt.Errorf("query path from hash %s: %w", hashPart, ErrNotFound)
+	}
+	return path, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestBinaryCache(t *testing.T) {
+	nixStore := newTestNixStore(t, nil)
+	storeDir, path := nixStore.dir, nixStore.path
+	digest := path.Digest()
+	narData, narHash := nixStore.nar, nixStore.narHash
+
+	pub, pk, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t)
+	env, err := SignStatement(pk, &Statement{Type: InTotoStatementType, PredicateType: SLSAProvenanceType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordProvenance(context.Background(), env, path); err != nil {
+		t.Fatal(err)
+	}
+	realization := testRealization(t)
+	realization.OutPath = path
+	realization.Signatures = nil
+	if err := db.RecordRealization(context.Background(), realization); err != nil {
+		t.Fatal(err)
+	}
+	missingRealization := testRealization(t)
+	missingRealization.ID.OutputName = "dev"
+	missingRealization.OutPath, err = storeDir.Object("22222222222222222222222222222222-hello-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordRealization(context.Background(), missingRealization); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&BinaryCache{
+		Store:        &Store{Dir: storeDir},
+		SecretKey:    pk,
+		Provenance:   db,
+		Realizations: db,
+	})
+	defer srv.Close()
+	get := func(name string) (int, []byte) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if code, body := get("nix-cache-info"); code != http.StatusOK {
+		t.Errorf("GET /nix-cache-info = %d %s", code, body)
+	} else {
+		info := new(nix.CacheInfo)
+		if err := info.UnmarshalText(body); err != nil {
+			t.Error(err)
+		} else if info.StoreDirectory != storeDir {
+			t.Errorf("StoreDir = %q; want %q", info.StoreDirectory, storeDir)
+		}
+	}
+
+	code, body := get(digest + ".narinfo")
+	if code != http.StatusOK {
+		t.Fatalf("GET /%s.narinfo = %d %s", digest, code, body)
+	}
+	info := new(nix.NARInfo)
+	if err := info.UnmarshalText(body); err != nil {
+		t.Fatal(err)
+	}
+	if info.StorePath != path || !info.NARHash.Equal(narHash) || info.NARSize != int64(len(narData)) {
+		t.Errorf("narinfo = %+v; want path=%s narHash=%v narSize=%d", info, path, narHash, len(narData))
+	}
+	if len(info.Sig) != 1 {
+		t.Errorf("narinfo has %d signatures; want 1", len(info.Sig))
+	} else if err := nix.VerifyNARInfo([]*nix.PublicKey{pub}, info, info.Sig[0]); err != nil {
+		t.Error(err)
+	}
+
+	if info.Compression != nix.Zstandard {
+		t.Errorf("narinfo Compression = %q; want %q", info.Compression, nix.Zstandard)
+	}
+	if code, body := get(info.URL); code != http.StatusOK {
+		t.Errorf("GET /%s = %d %s", info.URL, code, body)
+	} else if zr, err := decompressNAR(bytes.NewReader(body), info.Compression); err != nil {
+		t.Errorf("GET /%s: %v", info.URL, err)
+	} else {
+		got, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil || !bytes.Equal(got, narData) {
+			t.Errorf("GET /%s = %d decompressed bytes, %v; want NAR (%d bytes)", info.URL, len(got), err, len(narData))
+		}
+	}
+	if code, body := get("nar/" + digest + ".nar"); code != http.StatusOK || !bytes.Equal(body, narData) {
+		t.Errorf("GET /nar/%s.nar = %d, %d bytes; want 200, NAR (%d bytes)", digest, code, len(body), len(narData))
+	}
+	if code, body := get(digest + ".provenance"); code != http.StatusOK {
+		t.Errorf("GET /%s.provenance = %d %s", digest, code, body)
+	} else {
+		got := new(Envelope)
+		if err := json.Unmarshal(body, got); err != nil {
+			t.Error(err)
+		} else if _, err := got.Verify([]*nix.PublicKey{pub}); err != nil {
+			t.Error(err)
+		}
+	}
+	if code, _ := get("00000000000000000000000000000000.narinfo"); code != http.StatusNotFound {
+		t.Errorf("GET missing narinfo = %d; want 404", code)
+	}
+
+	sub := &Substituter{URL: srv.URL, TrustedPublicKeys: []*nix.PublicKey{pub}}
+	if got, err := sub.Realization(context.Background(), realization.ID); err != nil {
+		t.Error(err)
+	} else if got.OutPath != path || got.Source != srv.URL {
+		t.Errorf("sub.Realization(ctx, %v) = {OutPath: %s, Source: %q}; want {OutPath: %s, Source: %q}",
+			realization.ID, got.OutPath, got.Source, path, srv.URL)
+	}
+	if ls, err := sub.Listing(context.Background(), path); err != nil {
+		t.Error(err)
+	} else if ls.Root.Size != int64(len("Hello, World!\n")) {
+		t.Errorf("sub.Listing(ctx, %s).Root.Size = %d; want %d", path, ls.Root.Size, len("Hello, World!\n"))
+	}
+	// Realizations of objects that are not in the store are not served.
+	if _, err := sub.Realization(context.Background(), missingRealization.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("sub.Realization(ctx, %v) error = %v; want %v", missingRealization.ID, err, ErrNotFound)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CacheAuth is the set of credentials used to access binary caches.
+type CacheAuth struct {
+	// Tokens maps a host name (with an optional port)
+	// to the bearer token sent in the Authorization header of requests to it.
+	// A token that starts with "@" is the path of a file containing the token.
+	// The file is read for every request,
+	// so short-lived tokens (like OIDC tokens refreshed by another program)
+	// stay current.
+	Tokens map[string]string
+	// Netrc provides user names and passwords for HTTP basic authentication
+	// to hosts that do not have a token.
+	Netrc *Netrc
+	// CertFile and KeyFile are paths to a PEM-encoded certificate and private key
+	// to present to caches that require mutual TLS.
+	CertFile string
+	KeyFile  string
+}
+
+// Client returns an HTTP client that authenticates its requests
+// with the credentials in auth.
+// Credentials are chosen by the host of each request,
+// so they are not sent to other hosts that a cache redirects to.
+func (auth *CacheAuth) Client() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if auth.CertFile != "" || auth.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	return &http.Client{
+		Transport: &authTransport{auth: auth, base: transport},
+	}, nil
+}
+
+// authTransport is an [http.RoundTripper]
+// that adds credentials to requests.
+type authTransport struct {
+	auth *CacheAuth
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.auth.token(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+		return t.base.RoundTrip(req)
+	}
+	if login, password, ok := t.auth.Netrc.Login(req.URL.Hostname()); ok {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(login, password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// token returns the bearer token for the given host,
+// or the empty string if there is none.
+func (auth *CacheAuth) token(host string) (string, error) {
+	token, ok := auth.Tokens[host]
+	if !ok {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			token = auth.Tokens[h]
+		}
+	}
+	path, isFile := strings.CutPrefix(token, "@")
+	if !isFile {
+		return token, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read token for %s: %v", host, err)
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// Netrc is a parsed .netrc file.
+type Netrc struct {
+	machines []netrcMachine
+}
+
+type netrcMachine struct {
+	// name is the host name, or empty for the default entry.
+	name     string
+	login    string
+	password string
+}
+
+// ParseNetrc parses the contents of a .netrc file.
+// macdef entries are skipped.
+func ParseNetrc(data []byte) (*Netrc, error) {
+	n := new(Netrc)
+	var m *netrcMachine
+	s := bufio.NewScanner(bytes.NewReader(data))
+	inMacro := false
+	for s.Scan() {
+		line := s.Text()
+		if inMacro {
+			// Macro definitions end at a blank line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			switch fields[i] {
+			case "machine", "default":
+				n.machines = append(n.machines, netrcMachine{})
+				m = &n.machines[len(n.machines)-1]
+				if fields[i] == "default" {
+					continue
+				}
+				i++
+				if i >= len(fields) {
+					return nil, fmt.Errorf("parse netrc: machine missing name")
+				}
+				m.name = fields[i]
+			case "login", "password", "account":
+				key := fields[i]
+				i++
+				if i >= len(fields) {
+					return nil, fmt.Errorf("parse netrc: %s missing value", key)
+				}
+				if m == nil {
+					return nil, fmt.Errorf("parse netrc: %s outside machine", key)
+				}
+				switch key {
+				case "login":
+					m.login = fields[i]
+				case "password":
+					m.password = fields[i]
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			default:
+				return nil, fmt.Errorf("parse netrc: unknown token %q", fields[i])
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("parse netrc: %v", err)
+	}
+	return n, nil
+}
+
+// Login returns the user name and password for the given host name.
+// If the file has no entry for the host, its default entry is used.
+// Login returns false if there is neither.
+// It is safe to call Login on a nil Netrc.
+func (n *Netrc) Login(host string) (login, password string, ok bool) {
+	if n == nil {
+		return "", "", false
+	}
+	var def *netrcMachine
+	for i := range n.machines {
+		m := &n.machines[i]
+		if m.name == host {
+			return m.login, m.password, true
+		}
+		if m.name == "" && def == nil {
+			def = m
+		}
+	}
+	if def == nil {
+		return "", "", false
+	}
+	return def.login, def.password, true
+}
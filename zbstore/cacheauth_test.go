@@ -0,0 +1,127 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	const data = `# Credentials for caches
+machine cache.example.com login alice password hunter2
+machine other.example.com
+	login bob
+	password swordfish
+
+macdef init
+cd /pub
+quit
+
+default login anonymous password guest
+`
+	n, err := ParseNetrc([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		login    string
+		password string
+	}{
+		{"cache.example.com", "alice", "hunter2"},
+		{"other.example.com", "bob", "swordfish"},
+		{"unknown.example.com", "anonymous", "guest"},
+	}
+	for _, test := range tests {
+		login, password, ok := n.Login(test.host)
+		if login != test.login || password != test.password || !ok {
+			t.Errorf("Login(%q) = %q, %q, %t; want %q, %q, true",
+				test.host, login, password, ok, test.login, test.password)
+		}
+	}
+
+	if _, _, ok := (*Netrc)(nil).Login("cache.example.com"); ok {
+		t.Error("nil Netrc returned a login")
+	}
+	if _, err := ParseNetrc([]byte("machine")); err == nil {
+		t.Error("ParseNetrc with missing machine name did not return an error")
+	}
+}
+
+func TestCacheAuth(t *testing.T) {
+	var gotAuth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	hostname, _, _ := strings.Cut(host, ":")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	netrc, err := ParseNetrc([]byte("machine " + hostname + " login alice password hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		auth *CacheAuth
+		want string
+	}{
+		{
+			name: "None",
+			auth: &CacheAuth{},
+			want: "",
+		},
+		{
+			name: "Token",
+			auth: &CacheAuth{Tokens: map[string]string{host: "xyzzy"}, Netrc: netrc},
+			want: "Bearer xyzzy",
+		},
+		{
+			name: "TokenForHostname",
+			auth: &CacheAuth{Tokens: map[string]string{hostname: "xyzzy"}},
+			want: "Bearer xyzzy",
+		},
+		{
+			name: "TokenFile",
+			auth: &CacheAuth{Tokens: map[string]string{host: "@" + tokenFile}},
+			want: "Bearer from-file",
+		},
+		{
+			name: "OtherHostToken",
+			auth: &CacheAuth{Tokens: map[string]string{"cache.example.com": "xyzzy"}},
+			want: "",
+		},
+		{
+			name: "Netrc",
+			auth: &CacheAuth{Netrc: netrc},
+			want: "Basic YWxpY2U6aHVudGVyMg==",
+		},
+	}
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := test.auth.Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotAuth = ""
+			resp, err := client.Get(srv.URL + "/nix-cache-info")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if gotAuth != test.want {
+				t.Errorf("Authorization = %q; want %q", gotAuth, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// Chunk sizes used by [SplitChunks].
+// Changing them (or the gear table) changes where NARs are split,
+// so previously stored chunks would no longer be reused.
+const (
+	minChunkSize = 16 << 10
+	avgChunkSize = 64 << 10
+	maxChunkSize = 256 << 10
+)
+
+// Masks for normalized chunking:
+// before a chunk reaches avgChunkSize,
+// a boundary needs more of the fingerprint's bits to be zero
+// than after it,
+// which pulls chunk sizes toward the average.
+const (
+	chunkMaskSmall uint64 = (1<<18 - 1) << (64 - 18)
+	chunkMaskLarge uint64 = (1<<14 - 1) << (64 - 14)
+)
+
+// gearTable maps bytes to the random values
+// that are rolled into the chunking fingerprint.
+// It is generated deterministically so that chunk boundaries are stable.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	x := uint64(0x7a62_6e61_7263_6463)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkBoundary returns the length of the chunk at the start of data
+// using FastCDC content-defined chunking.
+// data should hold at least maxChunkSize bytes
+// unless it is the end of the input.
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	n = min(n, maxChunkSize)
+	normal := min(n, avgChunkSize)
+	var fp uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// SplitChunks splits the data read from r into content-defined chunks
+// and calls fn with each chunk in order.
+// Because chunk boundaries depend on the data around them
+// rather than on offsets,
+// a small change to a large input only changes the chunks near the change.
+// The slice passed to fn is only valid until fn returns.
+func SplitChunks(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, 2*maxChunkSize)
+	start, end := 0, 0
+	eof := false
+	for {
+		if !eof && end-start < maxChunkSize {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		n := chunkBoundary(buf[start:end])
+		if err := fn(buf[start : start+n]); err != nil {
+			return err
+		}
+		start += n
+	}
+}
+
+// A Chunk identifies a piece of a NAR by its content.
+type Chunk struct {
+	Hash nix.Hash `json:"hash"`
+	Size int64    `json:"size"`
+}
+
+// A ChunkIndex lists the chunks that a NAR is split into.
+// Concatenating the chunks in order produces the NAR.
+type ChunkIndex struct {
+	NARHash nix.Hash `json:"narHash"`
+	NARSize int64    `json:"narSize"`
+	Chunks  []Chunk  `json:"chunks"`
+}
+
+// A ChunkStore is a directory of NAR chunks named by their hashes.
+// Binary caches use a ChunkStore to serve NARs as chunks (see [BinaryCache.Chunks])
+// and substituters use one to avoid downloading chunks they already have
+// (see [Substituter.Chunks]).
+type ChunkStore struct {
+	Dir string
+}
+
+// chunkHashType is the hash algorithm used to name chunks.
+const chunkHashType = nix.SHA256
+
+func (cs *ChunkStore) chunkPath(h nix.Hash) string {
+	p, _ := cs.chunkPathFromName(h.RawBase32())
+	return p
+}
+
+// chunkPathFromName returns the path of the chunk file
+// whose name is the unpadded base-32 encoding of its hash.
+// ok is false if name is not such an encoding.
+func (cs *ChunkStore) chunkPathFromName(name string) (_ string, ok bool) {
+	if len(name) != nix.SHA256.Size()*8/5+1 || strings.Trim(name, nixBase32Alphabet) != "" {
+		return "", false
+	}
+	return filepath.Join(cs.Dir, "chunks", name[:2], name), true
+}
+
+// nixBase32Alphabet is the set of characters used in Nix's base-32 encoding.
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+func (cs *ChunkStore) indexPath(hashPart string) string {
+	return filepath.Join(cs.Dir, "indexes", hashPart+".json")
+}
+
+// Put stores a chunk if it is not already present.
+func (cs *ChunkStore) Put(data []byte) (Chunk, error) {
+	h := nix.NewHasher(chunkHashType)
+	h.Write(data)
+	c := Chunk{Hash: h.SumHash(), Size: int64(len(data))}
+	p := cs.chunkPath(c.Hash)
+	if _, err := os.Stat(p); err == nil {
+		return c, nil
+	}
+	if err := writeFileAtomic(p, data); err != nil {
+		return Chunk{}, fmt.Errorf("store chunk %v: %v", c.Hash, err)
+	}
+	return c, nil
+}
+
+// Get returns the content of the chunk with the given hash.
+// If the chunk is not present, Get returns an error that wraps [ErrNotFound].
+func (cs *ChunkStore) Get(h nix.Hash) ([]byte, error) {
+	data, err := os.ReadFile(cs.chunkPath(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read chunk %v: %w", h, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read chunk %v: %v", h, err)
+	}
+	return data, nil
+}
+
+// AddNAR splits the NAR read from r into chunks,
+// stores the chunks that are not already present,
+// and returns the NAR's index.
+func (cs *ChunkStore) AddNAR(r io.Reader) (*ChunkIndex, error) {
+	idx := new(ChunkIndex)
+	narHasher := nix.NewHasher(nix.SHA256)
+	err := SplitChunks(r, func(data []byte) error {
+		narHasher.Write(data)
+		c, err := cs.Put(data)
+		if err != nil {
+			return err
+		}
+		idx.Chunks = append(idx.Chunks, c)
+		idx.NARSize += c.Size
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("chunk nar: %v", err)
+	}
+	idx.NARHash = narHasher.SumHash()
+	return idx, nil
+}
+
+// Index returns the saved index of the NAR of the store object
+// whose digest is hashPart.
+// If there is no saved index,
+// Index returns an error that wraps [ErrNotFound].
+func (cs *ChunkStore) Index(hashPart string) (*ChunkIndex, error) {
+	data, err := os.ReadFile(cs.indexPath(hashPart))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read chunk index for %s: %w", hashPart, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read chunk index for %s: %v", hashPart, err)
+	}
+	idx := new(ChunkIndex)
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("read chunk index for %s: %v", hashPart, err)
+	}
+	return idx, nil
+}
+
+// SaveIndex saves the index of the NAR of the store object
+// whose digest is hashPart.
+func (cs *ChunkStore) SaveIndex(hashPart string, idx *ChunkIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("save chunk index for %s: %v", hashPart, err)
+	}
+	if err := writeFileAtomic(cs.indexPath(hashPart), data); err != nil {
+		return fmt.Errorf("save chunk index for %s: %v", hashPart, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a new file at path,
+// creating its parent directories as needed.
+// Readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// chunkedNARReader reads a NAR by concatenating its chunks,
+// downloading the chunks that are not in a local [ChunkStore].
+type chunkedNARReader struct {
+	ctx    context.Context
+	sub    *Substituter
+	chunks []Chunk
+	buf    bytes.Reader
+	// fetched is the number of bytes downloaded rather than read locally.
+	fetched int64
+}
+
+func (r *chunkedNARReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.chunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.chunks = r.chunks[1:]
+		r.buf.Reset(data)
+	}
+	return r.buf.Read(p)
+}
+
+// chunk returns the content of c from the local chunk store,
+// downloading it if necessary.
+func (r *chunkedNARReader) chunk(c Chunk) ([]byte, error) {
+	if data, err := r.sub.Chunks.Get(c.Hash); err == nil {
+		return data, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	resp, err := r.sub.get(r.ctx, "chunks/"+c.Hash.RawBase32())
+	if err != nil {
+		return nil, fmt.Errorf("download chunk %v: %w", c.Hash, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("download chunk %v: %v", c.Hash, err)
+	}
+	h := nix.NewHasher(c.Hash.Type())
+	h.Write(data)
+	if !h.SumHash().Equal(c.Hash) || int64(len(data)) != c.Size {
+		return nil, fmt.Errorf("download chunk %v: content does not match hash", c.Hash)
+	}
+	if _, err := r.sub.Chunks.Put(data); err != nil {
+		return nil, err
+	}
+	r.fetched += c.Size
+	return data, nil
+}
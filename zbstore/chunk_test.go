@@ -0,0 +1,187 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	original := splitChunkHashes(t, data)
+	if len(original) < 2 {
+		t.Fatalf("SplitChunks produced %d chunk(s) for %d bytes", len(original), len(data))
+	}
+	if again := splitChunkHashes(t, data); !slices.Equal(again, original) {
+		t.Error("SplitChunks is not deterministic")
+	}
+
+	// Changing a single byte in the middle should leave most chunks intact.
+	edited := bytes.Clone(data)
+	edited[len(edited)/2] ^= 0xff
+	changed := splitChunkHashes(t, edited)
+	seen := make(map[string]bool)
+	for _, h := range original {
+		seen[h] = true
+	}
+	newChunks := 0
+	for _, h := range changed {
+		if !seen[h] {
+			newChunks++
+		}
+	}
+	if newChunks > 2 {
+		t.Errorf("after changing 1 byte, %d of %d chunks are new; want <= 2", newChunks, len(changed))
+	}
+}
+
+func splitChunkHashes(tb testing.TB, data []byte) []string {
+	tb.Helper()
+	var hashes []string
+	total := 0
+	err := SplitChunks(bytes.NewReader(data), func(chunk []byte) error {
+		if len(chunk) > maxChunkSize {
+			tb.Errorf("chunk of %d bytes is larger than %d", len(chunk), maxChunkSize)
+		}
+		total += len(chunk)
+		h := nix.NewHasher(nix.SHA256)
+		h.Write(chunk)
+		hashes = append(hashes, h.SumHash().RawBase32())
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if total != len(data) {
+		tb.Errorf("chunks total %d bytes; want %d", total, len(data))
+	}
+	return hashes
+}
+
+func TestChunkStoreAddNAR(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	cs := &ChunkStore{Dir: t.TempDir()}
+	idx, err := cs.AddNAR(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.NARSize != int64(len(data)) {
+		t.Errorf("NARSize = %d; want %d", idx.NARSize, len(data))
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(data)
+	if want := h.SumHash(); !idx.NARHash.Equal(want) {
+		t.Errorf("NARHash = %v; want %v", idx.NARHash, want)
+	}
+
+	if err := cs.SaveIndex("abc", idx); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = cs.Index("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(bytes.Buffer)
+	for _, c := range idx.Chunks {
+		chunk, err := cs.Get(c.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Write(chunk)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Error("concatenated chunks do not match the NAR")
+	}
+}
+
+func TestSubstituterChunks(t *testing.T) {
+	ctx := context.Background()
+	sub, _ := newTestSubstituter(t, nil)
+	info, err := sub.NARInfo(ctx, testSubstituterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	narData := readAllNAR(t, sub, info)
+
+	// Serve the NAR's chunks alongside the test cache.
+	serverChunks := &ChunkStore{Dir: t.TempDir()}
+	idx, err := serverChunks.AddNAR(bytes.NewReader(narData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxData, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := sub.URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/"+testSubstituterPath.Digest()+".chunks":
+			w.Write(idxData)
+		case strings.HasPrefix(r.URL.Path, "/chunks/"):
+			p, ok := serverChunks.chunkPathFromName(strings.TrimPrefix(r.URL.Path, "/chunks/"))
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeFile(w, r, p)
+		case r.URL.Path == "/nar/hello.nar":
+			t.Error("Full NAR requested")
+			http.NotFound(w, r)
+		default:
+			http.Redirect(w, r, next+r.URL.Path, http.StatusFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	sub = &Substituter{
+		URL:    srv.URL,
+		Client: srv.Client(),
+		Chunks: &ChunkStore{Dir: t.TempDir()},
+	}
+
+	for i, wantFetched := range []int64{info.NARSize, 0} {
+		r, err := sub.DownloadNAR(ctx, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("download #%d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, narData) {
+			t.Errorf("download #%d does not match the NAR", i+1)
+		}
+		if fetched := r.(*verifyingReader).r.(*chunkedNARReader).fetched; fetched != wantFetched {
+			t.Errorf("download #%d fetched %d bytes; want %d", i+1, fetched, wantFetched)
+		}
+	}
+}
+
+func readAllNAR(tb testing.TB, sub *Substituter, info *nix.NARInfo) []byte {
+	tb.Helper()
+	r, err := sub.DownloadNAR(context.Background(), info)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
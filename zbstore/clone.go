@@ -0,0 +1,294 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// cloneNixObjects copies store objects from a Nix store
+// directly into s's store directory,
+// cloning their files (see [cloneFile]) instead of streaming their NARs,
+// and then registers them as valid.
+// infos are the objects' new path information
+// (sorted such that references precede their referrers)
+// and oldInfos maps their new paths to their information in src.
+// The source and destination directories must have the same length.
+// Stores with a daemon or a custom layout are not written to directly.
+// If an object cannot be cloned,
+// because the store is not writable
+// or because the file system does not support cloning,
+// cloneNixObjects stops and returns the objects from that one onward,
+// so that the caller can import them by other means.
+// The objects are locked (see [Store.LockPaths])
+// from before they are cloned until they are registered.
+// Objects that another process imports in the meantime are skipped.
+func (s *Store) cloneNixObjects(ctx context.Context, src *NixSource, infos []*PathInfo, oldInfos map[nix.StorePath]*PathInfo) ([]*PathInfo, error) {
+	if len(infos) == 0 || s.Socket != "" || s.hasCustomLayout() {
+		return infos, nil
+	}
+	realDir := s.RealPath(string(s.dir()))
+	tempDir, err := os.MkdirTemp(realDir, ".zb-clone-*")
+	if err != nil {
+		log.Debugf(ctx, "Not cloning store objects: %v", err)
+		return infos, nil
+	}
+	defer os.RemoveAll(tempDir)
+
+	paths := make([]nix.StorePath, 0, len(infos))
+	for _, info := range infos {
+		paths = append(paths, info.Path)
+	}
+	lock, err := s.LockPaths(ctx, paths...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Debugf(ctx, "Not cloning store objects: %v", err)
+		return infos, nil
+	}
+	// nix-store locks the objects it imports,
+	// so the locks must be released before the caller imports the rest.
+	defer lock.Unlock()
+
+	from := []byte(src.dir() + "/")
+	to := []byte(s.dir() + "/")
+	var cloned []*PathInfo
+	for len(infos) > 0 {
+		info := infos[0]
+		oldInfo := oldInfos[info.Path]
+		if ok, err := s.prepareLockedPath(ctx, info.Path); err != nil {
+			log.Debugf(ctx, "Cloning %s: %v (falling back to copying)", oldInfo.Path, err)
+			break
+		} else if !ok {
+			log.Debugf(ctx, "%s imported by another process", info.Path)
+			infos = infos[1:]
+			continue
+		}
+		newInfo, err := cloneNixObject(realDir, tempDir, src.realPath(oldInfo.Path), info, from, to)
+		if err != nil {
+			log.Debugf(ctx, "Cloning %s: %v (falling back to copying)", oldInfo.Path, err)
+			break
+		}
+		if src.dir() == s.dir() && !newInfo.NARHash.Equal(oldInfo.NARHash) {
+			return nil, fmt.Errorf("%s: NAR hash mismatch (got %v, database has %v)", oldInfo.Path, newInfo.NARHash, oldInfo.NARHash)
+		}
+		log.Debugf(ctx, "Cloned %s", info.Path)
+		cloned = append(cloned, newInfo)
+		infos = infos[1:]
+	}
+	if len(cloned) == 0 {
+		return infos, nil
+	}
+	if err := s.registerValidity(ctx, cloned); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// prepareLockedPath prepares to write the store object at path,
+// which the caller must have locked.
+// If the object is already valid, prepareLockedPath returns false.
+// Otherwise, it removes anything left at path by a process
+// that stopped before registering the object
+// and returns true.
+func (s *Store) prepareLockedPath(ctx context.Context, path nix.StorePath) (bool, error) {
+	realPath := s.RealPath(string(path))
+	if _, err := os.Lstat(realPath); errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if _, err := s.QueryPathInfo(ctx, path); err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	log.Debugf(ctx, "Removing stale %s", path)
+	if err := removeAll(realPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// cloneNixObject clones the store object at srcPath into realDir
+// under info's base name by way of tempDir
+// and returns info with the NAR hash and size of the clone filled in.
+func cloneNixObject(realDir, tempDir, srcPath string, info *PathInfo, from, to []byte) (*PathInfo, error) {
+	dst := filepath.Join(realDir, info.Path.Base())
+	if _, err := os.Lstat(dst); err == nil {
+		return nil, fmt.Errorf("%s exists", dst)
+	}
+	tempPath := filepath.Join(tempDir, info.Path.Base())
+	if err := cloneStoreObject(tempPath, srcPath, from, to); err != nil {
+		os.RemoveAll(tempPath)
+		return nil, err
+	}
+	h := nix.NewHasher(nix.SHA256)
+	cw := &countWriter{w: h}
+	if err := nar.DumpPath(cw, tempPath); err != nil {
+		os.RemoveAll(tempPath)
+		return nil, err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.RemoveAll(tempPath)
+		return nil, err
+	}
+	newInfo := *info
+	newInfo.NARHash = h.SumHash()
+	newInfo.NARSize = cw.n
+	return &newInfo, nil
+}
+
+// cloneStoreObject copies the file or directory tree at src to dst,
+// which must not exist.
+// Occurrences of from in symlink targets and file contents
+// are replaced with to, which must have the same length.
+// Regular files that do not contain from are cloned with [cloneFile];
+// the others are copied.
+// Permissions and modification times are not preserved:
+// the backend canonicalizes them when the object is registered.
+func cloneStoreObject(dst, src string, from, to []byte) error {
+	return filepath.WalkDir(src, func(path string, ent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := dst
+		if path != src {
+			target = filepath.Join(dst, strings.TrimPrefix(path, src+string(filepath.Separator)))
+		}
+		switch ent.Type() {
+		case fs.ModeDir:
+			return os.Mkdir(target, 0o755)
+		case fs.ModeSymlink:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if string(from) != string(to) {
+				link = strings.ReplaceAll(link, string(from), string(to))
+			}
+			return os.Symlink(link, target)
+		case 0:
+			info, err := ent.Info()
+			if err != nil {
+				return err
+			}
+			perm := fs.FileMode(0o644)
+			if info.Mode()&0o111 != 0 {
+				perm = 0o755
+			}
+			if string(from) == string(to) {
+				return cloneFile(target, path, perm)
+			}
+			found, err := fileContains(path, from)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return cloneFile(target, path, perm)
+			}
+			return copyRewrittenFile(target, path, perm, from, to)
+		default:
+			return fmt.Errorf("%s: unsupported file type %v", path, ent.Type())
+		}
+	})
+}
+
+// fileContains reports whether the file at path contains b.
+func fileContains(path string, b []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	found := false
+	rw := newRewriteWriter(io.Discard, b, b)
+	rw.match = func(int64) { found = true }
+	if _, err := io.Copy(rw, f); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// copyRewrittenFile copies the file at src to a new file at dst,
+// replacing occurrences of from with to.
+func copyRewrittenFile(dst, src string, perm fs.FileMode, from, to []byte) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(dstFile)
+	rw := newRewriteWriter(bw, from, to)
+	_, err = io.Copy(rw, srcFile)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// registerValidity registers store objects
+// that have been written to the store directory as valid
+// with nix-store --register-validity.
+// infos must be sorted such that references precede their referrers
+// and must have their NAR hashes and sizes filled in.
+func (s *Store) registerValidity(ctx context.Context, infos []*PathInfo) error {
+	c := s.command(ctx, "--register-validity", "--hash-given")
+	c.Stdin = strings.NewReader(string(appendValidityRegistrations(nil, infos)))
+	c.Stdout = s.stderr()
+	c.Stderr = s.stderr()
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("nix-store --register-validity: %v", err)
+	}
+	return nil
+}
+
+// appendValidityRegistrations appends the input to
+// nix-store --register-validity --hash-given
+// that registers the given store objects.
+func appendValidityRegistrations(dst []byte, infos []*PathInfo) []byte {
+	for _, info := range infos {
+		dst = append(dst, info.Path...)
+		dst = append(dst, '\n')
+		dst = append(dst, info.NARHash.Base16()...)
+		dst = append(dst, '\n')
+		dst = strconv.AppendInt(dst, info.NARSize, 10)
+		dst = append(dst, '\n')
+		dst = append(dst, info.Deriver...)
+		dst = append(dst, '\n')
+		dst = strconv.AppendInt(dst, int64(len(info.References)), 10)
+		dst = append(dst, '\n')
+		for _, ref := range info.References {
+			dst = append(dst, ref...)
+			dst = append(dst, '\n')
+		}
+	}
+	return dst
+}
+
+// errCloneUnsupported is returned by [cloneFile]
+// when the file system does not support cloning.
+var errCloneUnsupported = fmt.Errorf("cloning files: %w", errors.ErrUnsupported)
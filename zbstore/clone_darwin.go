@@ -0,0 +1,33 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates a new file at dst that shares its data blocks
+// with the file at src, using clonefile(2).
+// If the file system does not support cloning
+// (or src and dst are on different file systems),
+// cloneFile returns an error that wraps [errors.ErrUnsupported]
+// and does not leave a file at dst.
+func cloneFile(dst, src string, perm fs.FileMode) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW|unix.CLONE_NOOWNERCOPY)
+	switch {
+	case errors.Is(err, unix.ENOTSUP), errors.Is(err, unix.EXDEV):
+		return errCloneUnsupported
+	case err != nil:
+		return &os.PathError{Op: "clonefile", Path: src, Err: err}
+	}
+	if err := os.Chmod(dst, perm); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates a new file at dst that shares its data blocks
+// with the file at src (a reflink), using the FICLONE ioctl.
+// If the file system does not support reflinks
+// (or src and dst are on different file systems),
+// cloneFile returns an error that wraps [errors.ErrUnsupported]
+// and does not leave a file at dst.
+func cloneFile(dst, src string, perm fs.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd()))
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		switch {
+		case errors.Is(err, unix.EOPNOTSUPP),
+			errors.Is(err, unix.EXDEV),
+			errors.Is(err, unix.EINVAL),
+			errors.Is(err, unix.ENOTTY),
+			errors.Is(err, unix.ENOSYS):
+			return errCloneUnsupported
+		default:
+			return &os.PathError{Op: "clone", Path: src, Err: err}
+		}
+	}
+	return nil
+}
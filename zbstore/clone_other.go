@@ -0,0 +1,14 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !linux && !darwin
+
+package zbstore
+
+import "io/fs"
+
+// cloneFile returns an error that wraps [errors.ErrUnsupported]:
+// cloning files is only supported on Linux and macOS.
+func cloneFile(dst, src string, perm fs.FileMode) error {
+	return errCloneUnsupported
+}
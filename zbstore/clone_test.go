@@ -0,0 +1,114 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestCloneStoreObject(t *testing.T) {
+	const oldDir, newDir = "/a/store/", "/b/store/"
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "app"), []byte("#!"+oldDir+"xyz-lib\n"), 0o555); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "config"), []byte("lib="+oldDir+"xyz-lib\n"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(oldDir+"xyz-lib/lib", filepath.Join(src, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every file refers to the old directory,
+	// so they are all copied rather than cloned.
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := cloneStoreObject(dst, src, []byte(oldDir), []byte(newDir)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "bin", "app")); err != nil {
+		t.Error(err)
+	} else if want := "#!" + newDir + "xyz-lib\n"; string(got) != want {
+		t.Errorf("bin/app = %q; want %q", got, want)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "bin", "app")); err != nil {
+		t.Error(err)
+	} else if info.Mode()&0o111 == 0 {
+		t.Errorf("bin/app mode = %v; want executable", info.Mode())
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "config")); err != nil {
+		t.Error(err)
+	} else if want := "lib=" + newDir + "xyz-lib\n"; string(got) != want {
+		t.Errorf("config = %q; want %q", got, want)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "config")); err != nil {
+		t.Error(err)
+	} else if info.Mode()&0o111 != 0 {
+		t.Errorf("config mode = %v; want not executable", info.Mode())
+	}
+	if got, err := os.Readlink(filepath.Join(dst, "lib")); err != nil {
+		t.Error(err)
+	} else if want := newDir + "xyz-lib/lib"; got != want {
+		t.Errorf("lib -> %q; want %q", got, want)
+	}
+
+	// Without rewriting, the files are cloned.
+	dst2 := filepath.Join(t.TempDir(), "dst")
+	err := cloneStoreObject(dst2, src, []byte(oldDir), []byte(oldDir))
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("File system does not support cloning:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst2, "bin", "app")); err != nil {
+		t.Error(err)
+	} else if want := "#!" + oldDir + "xyz-lib\n"; string(got) != want {
+		t.Errorf("cloned bin/app = %q; want %q", got, want)
+	}
+}
+
+func TestAppendValidityRegistrations(t *testing.T) {
+	const dir nix.StoreDirectory = "/zb/store"
+	lib, err := dir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := dir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv, err := dir.Object("ffffffffffffffffffffffffffffffff-app.drv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	hash := h.SumHash()
+	got := string(appendValidityRegistrations(nil, []*PathInfo{
+		{Path: lib, NARHash: hash, NARSize: 120},
+		{Path: app, NARHash: hash, NARSize: 456, Deriver: drv, References: []nix.StorePath{lib, app}},
+	}))
+	want := string(lib) + "\n" +
+		hash.Base16() + "\n" +
+		"120\n" +
+		"\n" +
+		"0\n" +
+		string(app) + "\n" +
+		hash.Base16() + "\n" +
+		"456\n" +
+		string(drv) + "\n" +
+		"2\n" +
+		string(lib) + "\n" +
+		string(app) + "\n"
+	if got != want {
+		t.Errorf("appendValidityRegistrations(...) = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/nix"
+)
+
+// WalkReferences calls fn for each store object in the closure of the given paths.
+// Objects are visited in topological order:
+// every object is visited after the objects it references.
+// Objects are visited once each,
+// in depth-first order starting from paths in the order given.
+// info is called to obtain the metadata of each store object.
+// If info or fn return an error, WalkReferences stops and returns that error.
+func WalkReferences(paths []nix.StorePath, info func(nix.StorePath) (*PathInfo, error), fn func(*PathInfo) error) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[nix.StorePath]int)
+	var visit func(p nix.StorePath) error
+	visit = func(p nix.StorePath) error {
+		switch state[p] {
+		case visiting:
+			return fmt.Errorf("walk references: cycle through %s", p)
+		case visited:
+			return nil
+		}
+		state[p] = visiting
+		pi, err := info(p)
+		if err != nil {
+			return err
+		}
+		for _, ref := range pi.References {
+			if ref == p {
+				// Self-references do not affect ordering.
+				continue
+			}
+			if err := visit(ref); err != nil {
+				return err
+			}
+		}
+		state[p] = visited
+		return fn(pi)
+	}
+	for _, p := range paths {
+		if err := visit(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ComputeClosure returns the metadata of every store object
+// in the closure of the given paths.
+// The returned list is sorted such that references precede their referrers.
+// See [WalkReferences] for details.
+func ComputeClosure(paths []nix.StorePath, info func(nix.StorePath) (*PathInfo, error)) ([]*PathInfo, error) {
+	var closure []*PathInfo
+	err := WalkReferences(paths, info, func(pi *PathInfo) error {
+		closure = append(closure, pi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return closure, nil
+}
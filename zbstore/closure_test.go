@@ -0,0 +1,68 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestComputeClosure(t *testing.T) {
+	const (
+		a nix.StorePath = "/nix/store/00000000000000000000000000000000-a"
+		b nix.StorePath = "/nix/store/11111111111111111111111111111111-b"
+		c nix.StorePath = "/nix/store/22222222222222222222222222222222-c"
+		d nix.StorePath = "/nix/store/33333333333333333333333333333333-d"
+		e nix.StorePath = "/nix/store/44444444444444444444444444444444-e"
+		f nix.StorePath = "/nix/store/55555555555555555555555555555555-f"
+	)
+	graph := map[nix.StorePath][]nix.StorePath{
+		a: {a, b, c},
+		b: {d},
+		c: {d, e},
+		d: {e},
+		e: {},
+		f: {e},
+	}
+	info := func(p nix.StorePath) (*PathInfo, error) {
+		refs, ok := graph[p]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", p, ErrNotFound)
+		}
+		return &PathInfo{Path: p, References: refs}, nil
+	}
+
+	tests := []struct {
+		paths []nix.StorePath
+		want  []nix.StorePath
+	}{
+		{paths: nil, want: nil},
+		{paths: []nix.StorePath{e}, want: []nix.StorePath{e}},
+		{paths: []nix.StorePath{a}, want: []nix.StorePath{e, d, b, c, a}},
+		{paths: []nix.StorePath{c, f}, want: []nix.StorePath{e, d, c, f}},
+		{paths: []nix.StorePath{f, f}, want: []nix.StorePath{e, f}},
+	}
+	for _, test := range tests {
+		closure, err := ComputeClosure(test.paths, info)
+		if err != nil {
+			t.Errorf("ComputeClosure(%v, ...): %v", test.paths, err)
+			continue
+		}
+		var got []nix.StorePath
+		for _, pi := range closure {
+			got = append(got, pi.Path)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("ComputeClosure(%v, ...) (-want +got):\n%s", test.paths, diff)
+		}
+	}
+
+	graph[e] = []nix.StorePath{c}
+	if _, err := ComputeClosure([]nix.StorePath{a}, info); err == nil {
+		t.Error("ComputeClosure did not return an error for a reference cycle")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"zombiezen.com/go/nix"
+)
+
+// narFileExtension returns the file extension
+// of a NAR compressed with the given algorithm.
+func narFileExtension(compression nix.CompressionType) (string, error) {
+	switch compression {
+	case nix.NoCompression, "":
+		return ".nar", nil
+	case nix.Zstandard:
+		return ".nar.zst", nil
+	case nix.XZ:
+		return ".nar.xz", nil
+	case nix.Gzip:
+		return ".nar.gz", nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// compressionForNARFile returns the compression algorithm
+// of a NAR file name produced with [narFileExtension].
+func compressionForNARFile(name string) (hashPart string, compression nix.CompressionType, ok bool) {
+	for _, ct := range []nix.CompressionType{nix.Zstandard, nix.XZ, nix.Gzip, nix.NoCompression} {
+		ext, _ := narFileExtension(ct)
+		if len(name) > len(ext) && name[len(name)-len(ext):] == ext {
+			return name[:len(name)-len(ext)], ct, true
+		}
+	}
+	return "", "", false
+}
+
+// compressNAR returns a writer that compresses the data written to it
+// with the given .narinfo compression algorithm and writes it to w.
+// The caller must close the returned writer to flush the compressed data.
+func compressNAR(w io.Writer, compression nix.CompressionType) (io.WriteCloser, error) {
+	switch compression {
+	case nix.NoCompression, "":
+		return nopWriteCloser{w}, nil
+	case nix.Zstandard:
+		return zstd.NewWriter(w)
+	case nix.XZ:
+		return xz.NewWriter(w)
+	case nix.Gzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// decompressNAR returns a reader that decompresses r
+// with the given .narinfo compression algorithm.
+// Closing the returned reader releases the decompressor's resources,
+// but does not close r.
+func decompressNAR(r io.Reader, compression nix.CompressionType) (io.ReadCloser, error) {
+	switch compression {
+	case nix.NoCompression, "":
+		return io.NopCloser(r), nil
+	case nix.Gzip:
+		return gzip.NewReader(r)
+	case nix.Bzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case nix.XZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case nix.Zstandard:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,71 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestCompressNAR(t *testing.T) {
+	data := bytes.Repeat([]byte("nix-archive-1 hello world\n"), 1000)
+	for _, compression := range []nix.CompressionType{nix.NoCompression, nix.Zstandard, nix.XZ, nix.Gzip} {
+		t.Run(string(compression), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			zw, err := compressNAR(buf, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := zw.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if compression != nix.NoCompression && buf.Len() >= len(data) {
+				t.Errorf("compressed size = %d; want < %d", buf.Len(), len(data))
+			}
+
+			zr, err := decompressNAR(buf, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("decompressed data does not match")
+			}
+		})
+	}
+}
+
+func TestCompressionForNARFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		hashPart    string
+		compression nix.CompressionType
+		ok          bool
+	}{
+		{name: "abc.nar", hashPart: "abc", compression: nix.NoCompression, ok: true},
+		{name: "abc.nar.zst", hashPart: "abc", compression: nix.Zstandard, ok: true},
+		{name: "abc.nar.xz", hashPart: "abc", compression: nix.XZ, ok: true},
+		{name: "abc.nar.gz", hashPart: "abc", compression: nix.Gzip, ok: true},
+		{name: "abc.nar.bz2"},
+		{name: ".nar"},
+		{name: "abc"},
+	}
+	for _, test := range tests {
+		hashPart, compression, ok := compressionForNARFile(test.name)
+		if hashPart != test.hashPart || compression != test.compression || ok != test.ok {
+			t.Errorf("compressionForNARFile(%q) = %q, %q, %t; want %q, %q, %t",
+				test.name, hashPart, compression, ok, test.hashPart, test.compression, test.ok)
+		}
+	}
+}
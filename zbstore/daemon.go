@@ -0,0 +1,292 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+)
+
+// DefaultSocket returns the default path of the store daemon's socket.
+// It is $ZB_DAEMON_SOCKET if set,
+// otherwise a socket in the backend's state directory.
+func DefaultSocket() string {
+	if path := os.Getenv("ZB_DAEMON_SOCKET"); path != "" {
+		return path
+	}
+	return filepath.Join(nixStateDir(), "zb", "daemon.sock")
+}
+
+// A Server performs store operations on behalf of clients
+// that connect to it over a Unix socket.
+// Clients are [Store] values with Socket set.
+// Running builds in a single long-lived server
+// lets the server own the store and run builders with its own privileges
+// instead of those of the invoking user.
+type Server struct {
+	// Store is the store that requests are performed on.
+	// Its Socket field must be empty.
+	Store *Store
+	// Policy decides which clients may connect
+	// and what they may do.
+	// If nil, the defaults described in [AuthPolicy] are used.
+	Policy *AuthPolicy
+	// RootsDB is the database that records clients' named roots
+	// (see [NamedRoot]).
+	// Each client may only change the roots in its own user's namespace.
+	// If nil, clients cannot manage named roots through the server.
+	RootsDB *DB
+
+	rootsMu sync.Mutex // serializes use of RootsDB
+}
+
+// Serve accepts connections on ln until ctx is done
+// or ln returns an error.
+func (srv *Server) Serve(ctx context.Context, ln net.Listener) error {
+	if srv.Store.socket() != "" {
+		return fmt.Errorf("serve store: store is itself a daemon client")
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go srv.serveConn(ctx, conn)
+	}
+}
+
+func (srv *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	client, err := srv.authorizeConn(conn)
+	if err != nil {
+		log.Warnf(ctx, "Rejecting connection: %v", err)
+		return
+	}
+	log.Debugf(ctx, "Accepted connection from %v (trusted=%t)", client, client.Trusted)
+	rpcServer := rpc.NewServer()
+	svc := &daemonService{ctx: ctx, srv: srv, store: srv.Store, client: client}
+	if err := rpcServer.RegisterName(daemonServiceName, svc); err != nil {
+		log.Errorf(ctx, "Serving %v: %v", client, err)
+		return
+	}
+	rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// authorizeConn identifies the client on the other end of conn
+// and checks it against the server's policy.
+func (srv *Server) authorizeConn(conn net.Conn) (*ClientIdentity, error) {
+	peer, err := PeerCredentials(conn)
+	if err != nil && !errors.Is(err, errNoPeerCredentials) {
+		return nil, err
+	}
+	return srv.Policy.Authorize(peer)
+}
+
+// Peer identifies the process on the other end of a Unix socket.
+// A nil *Peer represents a client that could not be identified.
+type Peer struct {
+	PID int
+	UID int
+	GID int
+}
+
+func (p *Peer) String() string {
+	if p == nil {
+		return "unknown peer"
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", p.PID, p.UID, p.GID)
+}
+
+// errNoPeerCredentials is returned by [PeerCredentials]
+// on platforms that cannot identify socket peers.
+var errNoPeerCredentials = errors.New("peer credentials not supported on this platform")
+
+const daemonServiceName = "Store"
+
+// RealiseRequest is the argument to the Store.Realise RPC.
+type RealiseRequest struct {
+	Paths []DerivedPath
+	// Rebuild is whether to build the derivations
+	// even if their outputs are valid (see [Store.Rebuild]).
+	Rebuild bool
+}
+
+// RealiseResponse is the result of the Store.Realise RPC.
+type RealiseResponse struct {
+	OutputPaths []nix.StorePath
+}
+
+// AddRootRequest is the argument to the Store.AddRoot RPC.
+type AddRootRequest struct {
+	Link string
+	Path nix.StorePath
+}
+
+// AddNamedRootRequest is the argument to the Store.AddNamedRoot RPC.
+// The root is always in the connecting user's namespace.
+type AddNamedRootRequest struct {
+	Name string
+	Path nix.StorePath
+}
+
+// RemoveNamedRootRequest is the argument to the Store.RemoveNamedRoot RPC.
+// The root is always in the connecting user's namespace.
+type RemoveNamedRootRequest struct {
+	Name string
+}
+
+// NamedRootsRequest is the argument to the Store.NamedRoots RPC.
+type NamedRootsRequest struct {
+	// All is whether to list every user's roots
+	// instead of only the connecting user's.
+	All bool
+}
+
+// NamedRootsResponse is the result of the Store.NamedRoots RPC.
+type NamedRootsResponse struct {
+	Roots []*NamedRoot
+}
+
+// daemonService is the RPC service exposed by a [Server]
+// to a single connection.
+type daemonService struct {
+	ctx    context.Context
+	srv    *Server
+	store  *Store
+	client *ClientIdentity
+}
+
+// Realise builds derivations.
+func (svc *daemonService) Realise(req *RealiseRequest, resp *RealiseResponse) error {
+	var err error
+	if req.Rebuild {
+		drvPaths := make([]nix.StorePath, 0, len(req.Paths))
+		for _, p := range req.Paths {
+			if len(p.Outputs) > 0 {
+				return fmt.Errorf("rebuild %v: cannot rebuild individual outputs", p)
+			}
+			drvPaths = append(drvPaths, p.Path)
+		}
+		log.Infof(svc.ctx, "Rebuilding %v for %v", drvPaths, svc.client)
+		resp.OutputPaths, err = svc.store.Rebuild(svc.ctx, drvPaths...)
+	} else {
+		log.Infof(svc.ctx, "Realising %v for %v", req.Paths, svc.client)
+		resp.OutputPaths, err = svc.store.RealisePaths(svc.ctx, req.Paths...)
+	}
+	return err
+}
+
+// AddRoot registers a garbage collector root.
+func (svc *daemonService) AddRoot(req *AddRootRequest, resp *struct{}) error {
+	if !filepath.IsAbs(req.Link) {
+		return fmt.Errorf("add root %s: link is not absolute", req.Link)
+	}
+	link := filepath.Clean(req.Link)
+	if svc.client.Trusted {
+		log.Infof(svc.ctx, "Adding root %s → %s for %v", link, req.Path, svc.client)
+		return svc.store.AddRoot(svc.ctx, link, req.Path)
+	}
+	dir, err := svc.client.openRootDir(svc.store, link)
+	if err != nil {
+		log.Warnf(svc.ctx, "Denied root %s → %s: %v", link, req.Path, err)
+		return err
+	}
+	defer dir.Close()
+	uid := -1
+	if svc.client.Peer != nil {
+		uid = svc.client.Peer.UID
+	}
+	log.Infof(svc.ctx, "Adding root %s → %s for %v", link, req.Path, svc.client)
+	return svc.store.addRootAt(svc.ctx, dir, filepath.Base(link), link, req.Path, uid)
+}
+
+// AddNamedRoot creates or updates one of the client's named roots.
+func (svc *daemonService) AddNamedRoot(req *AddNamedRootRequest, resp *NamedRoot) error {
+	db, owner, unlock, err := svc.rootsDB()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	log.Infof(svc.ctx, "Adding root %q → %s for %v", req.Name, req.Path, svc.client)
+	r, err := svc.store.AddNamedRoot(svc.ctx, db, owner, req.Name, req.Path)
+	if err != nil {
+		return err
+	}
+	*resp = *r
+	return nil
+}
+
+// RemoveNamedRoot removes one of the client's named roots.
+func (svc *daemonService) RemoveNamedRoot(req *RemoveNamedRootRequest, resp *struct{}) error {
+	db, owner, unlock, err := svc.rootsDB()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	log.Infof(svc.ctx, "Removing root %q for %v", req.Name, svc.client)
+	return svc.store.RemoveNamedRoot(svc.ctx, db, owner, req.Name)
+}
+
+// NamedRoots lists the client's named roots or every user's named roots.
+func (svc *daemonService) NamedRoots(req *NamedRootsRequest, resp *NamedRootsResponse) error {
+	db, owner, unlock, err := svc.rootsDB()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if req.All {
+		owner = ""
+	}
+	resp.Roots, err = db.NamedRoots(svc.ctx, owner)
+	return err
+}
+
+// rootsDB locks the server's roots database
+// and returns it along with the namespace the client owns.
+// The caller must call unlock when it is done with the database.
+func (svc *daemonService) rootsDB() (db *DB, owner string, unlock func(), err error) {
+	if svc.srv.RootsDB == nil {
+		return nil, "", nil, fmt.Errorf("named roots: store daemon has no roots database")
+	}
+	if svc.client.User == "" {
+		return nil, "", nil, fmt.Errorf("named roots: cannot identify %v", svc.client)
+	}
+	svc.srv.rootsMu.Lock()
+	return svc.srv.RootsDB, svc.client.User, svc.srv.rootsMu.Unlock, nil
+}
+
+// call sends a request to the store's daemon.
+func (s *Store) call(ctx context.Context, method string, req, resp any) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", s.socket())
+	if err != nil {
+		return fmt.Errorf("connect to store daemon: %w", err)
+	}
+	client := jsonrpc.NewClient(conn)
+	defer client.Close()
+	call := client.Go(daemonServiceName+"."+method, req, resp, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
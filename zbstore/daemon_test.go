@@ -0,0 +1,120 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestDaemonRealise(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets and shell scripts required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stand in for nix-store with a script that prints an output path.
+	binDir := t.TempDir()
+	const outPath nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"
+	script := "#!/bin/sh\necho " + string(outPath) + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Store: new(Store)}
+	done := make(chan error)
+	go func() { done <- srv.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error("Serve:", err)
+		}
+	}()
+
+	client := &Store{Socket: socket}
+	const drvPath nix.StorePath = "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv"
+	got, err := client.RealiseOutputs(ctx, drvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]nix.StorePath{"out": outPath}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RealiseOutputs(ctx, %q) (-want +got):\n%s", drvPath, diff)
+	}
+}
+
+func TestDaemonNamedRoots(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stand in for nix-store with a script that accepts any arguments.
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+
+	socket := filepath.Join(t.TempDir(), "daemon.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Store:   &Store{Root: t.TempDir()},
+		RootsDB: openTestDB(t),
+	}
+	done := make(chan error)
+	go func() { done <- srv.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error("Serve:", err)
+		}
+	}()
+
+	// The owner passed by the client is ignored in favor of the peer's user.
+	client := &Store{Socket: socket}
+	r, err := client.AddNamedRoot(ctx, nil, "mallory", "hello", testHelloPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Owner == "mallory" {
+		t.Errorf("AddNamedRoot(...).Owner = %q; want connecting user", r.Owner)
+	}
+	if want := filepath.Join(srv.Store.UserRootsDir(r.Owner), "hello"); r.Link != want {
+		t.Errorf("AddNamedRoot(...).Link = %q; want %q", r.Link, want)
+	}
+	got, err := client.NamedRoots(ctx, nil, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*NamedRoot{r}, got); diff != "" {
+		t.Errorf("NamedRoots(...) (-want +got):\n%s", diff)
+	}
+	if err := client.RemoveNamedRoot(ctx, nil, "mallory", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := srv.RootsDB.NamedRoots(ctx, ""); err != nil {
+		t.Error(err)
+	} else if len(got) > 0 {
+		t.Errorf("after RemoveNamedRoot, roots = %v; want none", got)
+	}
+}
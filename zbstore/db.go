@@ -0,0 +1,181 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+//go:embed schema/*.sql
+var schemaFiles embed.FS
+
+func loadSchema() sqlitemigration.Schema {
+	names, err := fs.Glob(schemaFiles, "schema/*.sql")
+	if err != nil {
+		panic(err)
+	}
+	slices.Sort(names)
+	var schema sqlitemigration.Schema
+	for _, name := range names {
+		data, err := schemaFiles.ReadFile(name)
+		if err != nil {
+			panic(err)
+		}
+		schema.Migrations = append(schema.Migrations, string(data))
+	}
+	return schema
+}
+
+// DB is zb's database of information about store objects.
+// It records information that the store backend does not track.
+// A DB is not safe to use from multiple goroutines concurrently.
+type DB struct {
+	conn *sqlite.Conn
+}
+
+// DefaultDBPath returns the path of the database used by zb.
+// It is located in $ZB_STATE_DIR if set,
+// otherwise in $XDG_STATE_HOME/zb or ~/.local/state/zb.
+func DefaultDBPath() string {
+	return filepath.Join(defaultStateDir(), "zb.db")
+}
+
+func defaultStateDir() string {
+	if dir := os.Getenv("ZB_STATE_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "zb")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "zb")
+	}
+	return filepath.Join(home, ".local", "state", "zb")
+}
+
+// OpenDB opens the database at the given path,
+// creating it if it does not exist.
+func OpenDB(ctx context.Context, path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return nil, fmt.Errorf("open database: %v", err)
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite, sqlite.OpenCreate, sqlite.OpenWAL)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %v", err)
+	}
+	conn.SetBusyTimeout(10 * time.Second)
+	if err := sqlitemigration.Migrate(ctx, conn, loadSchema()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("open database %s: %v", path, err)
+	}
+	return &DB{conn: conn}, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
+
+// Register records that the given paths are present in the store.
+// Paths that have been registered before keep their original registration time.
+func (db *DB) Register(ctx context.Context, t time.Time, paths ...nix.StorePath) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	for _, p := range paths {
+		err := sqlitex.Execute(db.conn, `insert into "paths" ("path", "registration_time") values (?, ?) on conflict do nothing;`, &sqlitex.ExecOptions{
+			Args: []any{string(p), t.Unix()},
+		})
+		if err != nil {
+			return fmt.Errorf("register %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// Touch records that the given paths were used at time t,
+// registering them if necessary.
+// All the paths are updated in a single transaction,
+// so callers should batch accesses where possible.
+func (db *DB) Touch(ctx context.Context, t time.Time, paths ...nix.StorePath) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	for _, p := range paths {
+		err := sqlitex.Execute(db.conn, `insert into "paths" ("path", "registration_time", "last_access_time") values (?1, ?2, ?2) `+
+			`on conflict ("path") do update set "last_access_time" = max(coalesce("last_access_time", 0), excluded."last_access_time");`, &sqlitex.ExecOptions{
+			Args: []any{string(p), t.Unix()},
+		})
+		if err != nil {
+			return fmt.Errorf("touch %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// PathStats is the usage information recorded for a store object.
+type PathStats struct {
+	Path             nix.StorePath
+	RegistrationTime time.Time
+	// LastAccessTime is the zero time if the path has never been used.
+	LastAccessTime time.Time
+}
+
+// StalePaths returns the paths that have not been used since the given time,
+// ordered from least recently used to most recently used.
+// Paths that have never been used are listed first.
+func (db *DB) StalePaths(ctx context.Context, since time.Time) ([]*PathStats, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var result []*PathStats
+	err := sqlitex.Execute(db.conn, `select "path", "registration_time", "last_access_time" from "paths" `+
+		`where coalesce("last_access_time", "registration_time") < ? `+
+		`order by "last_access_time" nulls first, "registration_time", "path";`, &sqlitex.ExecOptions{
+		Args: []any{since.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stats := &PathStats{
+				Path:             nix.StorePath(stmt.ColumnText(0)),
+				RegistrationTime: time.Unix(stmt.ColumnInt64(1), 0),
+			}
+			if stmt.ColumnType(2) != sqlite.TypeNull {
+				stats.LastAccessTime = time.Unix(stmt.ColumnInt64(2), 0)
+			}
+			result = append(result, stats)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query stale paths: %v", err)
+	}
+	return result, nil
+}
+
+// Forget removes any information recorded about the given paths.
+// It is used when paths are deleted from the store.
+func (db *DB) Forget(ctx context.Context, paths ...nix.StorePath) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	for _, p := range paths {
+		err := sqlitex.Execute(db.conn, `delete from "paths" where "path" = ?;`, &sqlitex.ExecOptions{
+			Args: []any{string(p)},
+		})
+		if err != nil {
+			return fmt.Errorf("forget %s: %v", p, err)
+		}
+		if err := deletePathInfo(db.conn, p); err != nil {
+			return fmt.Errorf("forget %s: %v", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func openTestDB(tb testing.TB) *DB {
+	tb.Helper()
+	db, err := OpenDB(context.Background(), filepath.Join(tb.TempDir(), "zb.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+	return db
+}
+
+func TestStalePaths(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const (
+		neverUsed nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-never"
+		oldUsed   nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-old"
+		newUsed   nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-new"
+	)
+	t0 := time.Unix(1700000000, 0)
+	if err := db.Register(ctx, t0, neverUsed, oldUsed, newUsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Touch(ctx, t0.Add(1*time.Hour), oldUsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Touch(ctx, t0.Add(10*time.Hour), newUsed); err != nil {
+		t.Fatal(err)
+	}
+	// Re-registering must not reset the registration time.
+	if err := db.Register(ctx, t0.Add(20*time.Hour), neverUsed); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.StalePaths(ctx, t0.Add(5*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*PathStats{
+		{Path: neverUsed, RegistrationTime: t0},
+		{Path: oldUsed, RegistrationTime: t0, LastAccessTime: t0.Add(1 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("StalePaths (-want +got):\n%s", diff)
+	}
+}
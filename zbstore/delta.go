@@ -0,0 +1,216 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// deltaMagic is the first bytes of a delta produced by [WriteDelta].
+const deltaMagic = "zb-delta-1\n"
+
+// deltaBlockSize is the size of the blocks of the base
+// that [WriteDelta] looks for in the target.
+const deltaBlockSize = 2048
+
+// Delta operations.
+const (
+	deltaOpCopy   = 'c' // offset and length in the base
+	deltaOpInsert = 'i' // length followed by literal bytes
+	deltaOpEnd    = 'e'
+)
+
+// MIME type for deltas served by [BinaryCache].
+const deltaMIMEType = "application/x-zb-nar-delta"
+
+// WriteDelta writes a binary delta to w
+// that [ApplyDelta] uses to produce target from base.
+// Like rsync, it finds blocks of base in target with a rolling checksum,
+// so data that moved or was surrounded by changes is still reused.
+func WriteDelta(w io.Writer, base, target []byte) error {
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	dw.w.WriteString(deltaMagic)
+
+	blocks := make(map[uint32][]int)
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		sum := newRollingSum(base[off : off+deltaBlockSize])
+		blocks[sum.value()] = append(blocks[sum.value()], off)
+	}
+
+	literalStart := 0
+	pos := 0
+	var sum rollingSum
+	if len(target) >= deltaBlockSize {
+		sum = newRollingSum(target[:deltaBlockSize])
+	}
+	for pos+deltaBlockSize <= len(target) {
+		baseOff, n := matchBlock(base, target, pos, blocks[sum.value()])
+		if n == 0 {
+			if pos+deltaBlockSize < len(target) {
+				sum.roll(target[pos], target[pos+deltaBlockSize])
+			}
+			pos++
+			continue
+		}
+		dw.insert(target[literalStart:pos])
+		dw.copy(baseOff, n)
+		pos += n
+		literalStart = pos
+		if pos+deltaBlockSize <= len(target) {
+			sum = newRollingSum(target[pos : pos+deltaBlockSize])
+		}
+	}
+	dw.insert(target[literalStart:])
+	dw.flushCopy()
+	dw.w.WriteByte(deltaOpEnd)
+	return dw.w.Flush()
+}
+
+// matchBlock returns the offset in base and the length
+// of the longest match for the data starting at target[pos]
+// among the candidate blocks.
+// The returned length is zero if none of the candidates match.
+func matchBlock(base, target []byte, pos int, candidates []int) (baseOff, n int) {
+	for _, off := range candidates {
+		if !bytes.Equal(base[off:off+deltaBlockSize], target[pos:pos+deltaBlockSize]) {
+			continue
+		}
+		// Extend the match past the block.
+		m := deltaBlockSize
+		for off+m < len(base) && pos+m < len(target) && base[off+m] == target[pos+m] {
+			m++
+		}
+		if m > n {
+			baseOff, n = off, m
+		}
+	}
+	return baseOff, n
+}
+
+type deltaWriter struct {
+	w *bufio.Writer
+	// pendingOff and pendingLen are a copy operation
+	// that has not been written yet
+	// so that it can be merged with the next one.
+	pendingOff, pendingLen int
+}
+
+func (dw *deltaWriter) copy(off, n int) {
+	if dw.pendingLen > 0 && dw.pendingOff+dw.pendingLen == off {
+		dw.pendingLen += n
+		return
+	}
+	dw.flushCopy()
+	dw.pendingOff, dw.pendingLen = off, n
+}
+
+func (dw *deltaWriter) insert(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	dw.flushCopy()
+	dw.w.WriteByte(deltaOpInsert)
+	dw.w.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	dw.w.Write(data)
+}
+
+func (dw *deltaWriter) flushCopy() {
+	if dw.pendingLen == 0 {
+		return
+	}
+	dw.w.WriteByte(deltaOpCopy)
+	dw.w.Write(binary.AppendUvarint(nil, uint64(dw.pendingOff)))
+	dw.w.Write(binary.AppendUvarint(nil, uint64(dw.pendingLen)))
+	dw.pendingLen = 0
+}
+
+// ApplyDelta writes the target of a delta produced by [WriteDelta] to dst.
+// base must be the same data that the delta was created from.
+func ApplyDelta(dst io.Writer, base io.ReaderAt, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("apply delta: not a delta")
+	}
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("apply delta: %v", unexpectedEOF(err))
+		}
+		switch op {
+		case deltaOpCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("apply delta: %v", unexpectedEOF(err))
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("apply delta: %v", unexpectedEOF(err))
+			}
+			if off > 1<<62 || n > 1<<62 {
+				return fmt.Errorf("apply delta: copy out of range")
+			}
+			copied, err := io.Copy(dst, io.NewSectionReader(base, int64(off), int64(n)))
+			if err != nil {
+				return fmt.Errorf("apply delta: %v", err)
+			}
+			if copied != int64(n) {
+				return fmt.Errorf("apply delta: copy past end of base")
+			}
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("apply delta: %v", unexpectedEOF(err))
+			}
+			if n > 1<<62 {
+				return fmt.Errorf("apply delta: insert too large")
+			}
+			if _, err := io.CopyN(dst, r, int64(n)); err != nil {
+				return fmt.Errorf("apply delta: %v", unexpectedEOF(err))
+			}
+		case deltaOpEnd:
+			return nil
+		default:
+			return fmt.Errorf("apply delta: unknown operation %#02x", op)
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// rollingSum is an Adler-32-style checksum over a window of bytes
+// that can be moved forward one byte at a time.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	s := rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		s.a += uint32(c)
+		s.b += uint32(len(window)-i) * uint32(c)
+	}
+	return s
+}
+
+// roll removes out from the start of the window and appends in to the end.
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s rollingSum) value() uint32 {
+	return s.a&0xffff | s.b<<16
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestDelta(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	base := randomBytes(256 << 10)
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+		// maxSize is the largest acceptable delta size, or 0 for no limit.
+		maxSize int
+	}{
+		{name: "Empty"},
+		{name: "EmptyBase", target: base},
+		{name: "EmptyTarget", base: base, maxSize: 64},
+		{name: "Identical", base: base, target: base, maxSize: 64},
+		{
+			name:    "Insert",
+			base:    base,
+			target:  concat(base[:100_000], []byte("hello, world"), base[100_000:]),
+			maxSize: 64 + deltaBlockSize,
+		},
+		{
+			name:    "Delete",
+			base:    base,
+			target:  concat(base[:100_000], base[150_000:]),
+			maxSize: 64 + deltaBlockSize,
+		},
+		{
+			name:    "Move",
+			base:    base,
+			target:  concat(base[128<<10:], base[:128<<10]),
+			maxSize: 64,
+		},
+		{name: "Unrelated", base: base, target: randomBytes(10_000)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delta := new(bytes.Buffer)
+			if err := WriteDelta(delta, test.base, test.target); err != nil {
+				t.Fatal("WriteDelta:", err)
+			}
+			if test.maxSize > 0 && delta.Len() > test.maxSize {
+				t.Errorf("delta is %d bytes; want <= %d", delta.Len(), test.maxSize)
+			}
+			got := new(bytes.Buffer)
+			if err := ApplyDelta(got, bytes.NewReader(test.base), delta); err != nil {
+				t.Fatal("ApplyDelta:", err)
+			}
+			if !bytes.Equal(got.Bytes(), test.target) {
+				t.Error("ApplyDelta did not produce the target")
+			}
+		})
+	}
+}
+
+func TestApplyDeltaWrongBase(t *testing.T) {
+	base := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(base)
+	delta := new(bytes.Buffer)
+	if err := WriteDelta(delta, base, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyDelta(io.Discard, bytes.NewReader(base[:1000]), delta); err == nil {
+		t.Error("ApplyDelta with a truncated base did not return an error")
+	}
+}
+
+func TestSubstituterDelta(t *testing.T) {
+	ctx := context.Background()
+	const basePath nix.StorePath = "/nix/store/0kv3nsbc4pxhcr4lfgsh48ds5wz8z5h9-data"
+	const targetPath nix.StorePath = "/nix/store/3hjkj9nxq6sxp2sczxrf6h7kfv3jzdg1-data"
+	baseNAR := make([]byte, 128<<10)
+	rand.New(rand.NewSource(1)).Read(baseNAR)
+	targetNAR := bytes.Clone(baseNAR)
+	copy(targetNAR[50_000:], "hello")
+	delta := new(bytes.Buffer)
+	if err := WriteDelta(delta, baseNAR, targetNAR); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/delta/"+basePath.Digest()+"/"+targetPath.Digest(), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", deltaMIMEType)
+		w.Write(delta.Bytes())
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	sub := &Substituter{URL: srv.URL, Client: srv.Client()}
+
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(targetNAR)
+	info := &nix.NARInfo{
+		StorePath: targetPath,
+		NARHash:   h.SumHash(),
+		NARSize:   int64(len(targetNAR)),
+	}
+	r, err := sub.DownloadNARDelta(ctx, info, basePath, bytes.NewReader(baseNAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, targetNAR) {
+		t.Error("DownloadNARDelta did not produce the target NAR")
+	}
+
+	// Applying the delta to the wrong base fails verification.
+	wrongBase := make([]byte, len(baseNAR))
+	r, err = sub.DownloadNARDelta(ctx, info, basePath, bytes.NewReader(wrongBase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.Close()
+	if err == nil {
+		t.Error("Reading NAR from delta applied to wrong base did not return an error")
+	}
+
+	const otherPath nix.StorePath = "/nix/store/6ab0yk7h1xzb8bqx0lx5w3dy1xpxz8n8-data"
+	if _, err := sub.DownloadNARDelta(ctx, info, otherPath, bytes.NewReader(baseNAR)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DownloadNARDelta from unknown base error = %v; want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// A DerivedPath refers to a store object
+// or to specific outputs of a derivation.
+// Its string form is either a store path
+// or a derivation's store path followed by "!"
+// and a comma-separated list of output names,
+// like "/nix/store/xxx-hello.drv!out,doc".
+type DerivedPath struct {
+	Path nix.StorePath
+	// Outputs is the sorted list of output names of the derivation at Path.
+	// If empty, the DerivedPath refers to the store object at Path itself.
+	Outputs []string
+}
+
+// ParseDerivedPath parses the string form of a [DerivedPath].
+func ParseDerivedPath(s string) (DerivedPath, error) {
+	pathPart, outputsPart, hasOutputs := strings.Cut(s, "!")
+	p, err := nix.ParseStorePath(pathPart)
+	if err != nil {
+		return DerivedPath{}, fmt.Errorf("parse derived path %q: %v", s, err)
+	}
+	dp := DerivedPath{Path: p}
+	if !hasOutputs {
+		return dp, nil
+	}
+	if !p.IsDerivation() {
+		return DerivedPath{}, fmt.Errorf("parse derived path %q: outputs given for %s, which is not a derivation", s, p)
+	}
+	for _, name := range strings.Split(outputsPart, ",") {
+		if name == "" {
+			return DerivedPath{}, fmt.Errorf("parse derived path %q: empty output name", s)
+		}
+		if strings.ContainsAny(name, "!/") {
+			return DerivedPath{}, fmt.Errorf("parse derived path %q: invalid output name %q", s, name)
+		}
+		dp.Outputs = append(dp.Outputs, name)
+	}
+	slices.Sort(dp.Outputs)
+	dp.Outputs = slices.Compact(dp.Outputs)
+	return dp, nil
+}
+
+// String returns the string form of the path.
+func (dp DerivedPath) String() string {
+	if len(dp.Outputs) == 0 {
+		return string(dp.Path)
+	}
+	return string(dp.Path) + "!" + strings.Join(dp.Outputs, ",")
+}
+
+// MarshalText returns the string form of the path.
+func (dp DerivedPath) MarshalText() ([]byte, error) {
+	if dp.Path == "" {
+		return nil, fmt.Errorf("marshal derived path: missing store path")
+	}
+	return []byte(dp.String()), nil
+}
+
+// UnmarshalText parses the string form of a [DerivedPath] into dp.
+func (dp *DerivedPath) UnmarshalText(data []byte) error {
+	var err error
+	*dp, err = ParseDerivedPath(string(data))
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDerivedPath(t *testing.T) {
+	const drvPath = "/nix/store/ffffffffffffffffffffffffffffffff-hello.drv"
+	const srcPath = "/nix/store/ffffffffffffffffffffffffffffffff-hello.txt"
+	tests := []struct {
+		s          string
+		want       DerivedPath
+		wantString string
+		wantErr    bool
+	}{
+		{
+			s:          srcPath,
+			want:       DerivedPath{Path: srcPath},
+			wantString: srcPath,
+		},
+		{
+			s:          drvPath,
+			want:       DerivedPath{Path: drvPath},
+			wantString: drvPath,
+		},
+		{
+			s:          drvPath + "!out",
+			want:       DerivedPath{Path: drvPath, Outputs: []string{"out"}},
+			wantString: drvPath + "!out",
+		},
+		{
+			s:          drvPath + "!out,doc,out",
+			want:       DerivedPath{Path: drvPath, Outputs: []string{"doc", "out"}},
+			wantString: drvPath + "!doc,out",
+		},
+		{s: "", wantErr: true},
+		{s: "hello", wantErr: true},
+		{s: srcPath + "!out", wantErr: true},
+		{s: drvPath + "!", wantErr: true},
+		{s: drvPath + "!out,", wantErr: true},
+		{s: drvPath + "!out!doc", wantErr: true},
+		{s: drvPath + "!out/bin", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseDerivedPath(test.s)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("ParseDerivedPath(%q): %v", test.s, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("ParseDerivedPath(%q) = %v, <nil>; want error", test.s, got)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("ParseDerivedPath(%q) (-want +got):\n%s", test.s, diff)
+		}
+		if s := got.String(); s != test.wantString {
+			t.Errorf("ParseDerivedPath(%q).String() = %q; want %q", test.s, s, test.wantString)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/log"
+)
+
+// maxDownloadResumes is the number of times that a download
+// is resumed after a failure before giving up.
+const maxDownloadResumes = 5
+
+// minDownloadSegmentSize is the smallest segment
+// that a parallel download (see [Substituter.Parallelism]) is split into.
+// Files smaller than twice this size are downloaded in one request.
+var minDownloadSegmentSize int64 = 16 << 20
+
+// open downloads the cache file at the given relative path.
+// If the connection fails partway through the file,
+// the download is resumed with a range request.
+// Large files are downloaded in parallel segments
+// if sub.Parallelism is greater than 1.
+func (sub *Substituter) open(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := sub.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	u := resp.Request.URL.String()
+	validator := rangeValidator(resp)
+	if sub.Parallelism > 1 &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.ContentLength >= 2*minDownloadSegmentSize {
+		resp.Body.Close()
+		return sub.downloadParallel(ctx, u, resp.ContentLength, validator)
+	}
+	return &resumingReader{
+		ctx:       ctx,
+		sub:       sub,
+		url:       u,
+		validator: validator,
+		size:      resp.ContentLength,
+		body:      resp.Body,
+	}, nil
+}
+
+// rangeValidator returns the value to use in the If-Range header
+// when resuming the download that resp started,
+// or the empty string if the response has no suitable validator.
+func rangeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// getRange sends a GET request for the bytes of u starting at start.
+// If end is not negative, the response stops after the byte at end.
+// The server must honor the range:
+// getRange returns an error if it responds with the whole file.
+func (sub *Substituter) getRange(ctx context.Context, u string, start, end int64, validator string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := sub.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("%s: server does not support range requests or file changed", u)
+		}
+		return nil, fmt.Errorf("%s: http %s", u, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// resumingReader reads an HTTP response body,
+// resuming with a range request if the connection fails.
+type resumingReader struct {
+	ctx       context.Context
+	sub       *Substituter
+	url       string
+	validator string
+	// size is the size of the file or -1 if unknown.
+	size    int64
+	body    io.ReadCloser
+	n       int64
+	resumes int
+}
+
+func (rr *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := rr.body.Read(p)
+		rr.n += int64(n)
+		if err == io.EOF && rr.size >= 0 && rr.n < rr.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if rr.ctx.Err() != nil || rr.resumes >= maxDownloadResumes {
+			return n, fmt.Errorf("%s: %w", rr.url, err)
+		}
+		rr.body.Close()
+		rr.resumes++
+		log.Debugf(rr.ctx, "Resuming download of %s at byte %d after error: %v", rr.url, rr.n, err)
+		body, resumeErr := rr.sub.getRange(rr.ctx, rr.url, rr.n, -1, rr.validator)
+		if resumeErr != nil {
+			rr.body = errorReader{err}
+			return n, fmt.Errorf("%s: %v (resume failed: %v)", rr.url, err, resumeErr)
+		}
+		rr.body = body
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (rr *resumingReader) Close() error {
+	return rr.body.Close()
+}
+
+// errorReader is an [io.ReadCloser] that always returns the same error.
+type errorReader struct {
+	err error
+}
+
+func (er errorReader) Read(p []byte) (int, error) { return 0, er.err }
+func (er errorReader) Close() error               { return nil }
+
+// downloadParallel downloads the size-byte file at u
+// in concurrent segments to a temporary file,
+// then returns a reader for the file.
+// Closing the reader deletes the file.
+func (sub *Substituter) downloadParallel(ctx context.Context, u string, size int64, validator string) (_ io.ReadCloser, err error) {
+	f, err := os.CreateTemp("", "zb-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	segments := min(int64(sub.Parallelism), size/minDownloadSegmentSize)
+	segmentSize := (size + segments - 1) / segments
+	log.Debugf(ctx, "Downloading %s in %d segments", u, segments)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, segments)
+	var wg sync.WaitGroup
+	for i := range segments {
+		start := i * segmentSize
+		end := min(start+segmentSize, size) - 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = sub.downloadSegment(ctx, io.NewOffsetWriter(f, start), u, start, end, validator)
+			if errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	return tempFileReader{f}, nil
+}
+
+// downloadSegment writes the bytes of u in the range [start, end] to w,
+// resuming the request if the connection fails.
+func (sub *Substituter) downloadSegment(ctx context.Context, w io.Writer, u string, start, end int64, validator string) error {
+	var lastErr error
+	for attempt := 0; attempt <= maxDownloadResumes; attempt++ {
+		if attempt > 0 {
+			log.Debugf(ctx, "Resuming download of %s at byte %d after error: %v", u, start, lastErr)
+		}
+		body, err := sub.getRange(ctx, u, start, end, validator)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, io.LimitReader(body, end-start+1))
+		body.Close()
+		start += n
+		if start > end {
+			return nil
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: %w", u, err)
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("%s: %w", u, lastErr)
+}
+
+// tempFileReader is an [io.ReadCloser] that deletes its file when closed.
+type tempFileReader struct {
+	f *os.File
+}
+
+func (tf tempFileReader) Read(p []byte) (int, error) {
+	return tf.f.Read(p)
+}
+
+func (tf tempFileReader) Close() error {
+	err := tf.f.Close()
+	os.Remove(tf.f.Name())
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRangeServer serves data at /file with support for range requests.
+// If failFirst is true, the first request for the whole file
+// is aborted halfway through.
+// The returned counter is incremented for each range request.
+func newRangeServer(tb testing.TB, data []byte, failFirst bool) (*Substituter, *atomic.Int32) {
+	tb.Helper()
+	rangeRequests := new(atomic.Int32)
+	failed := new(atomic.Bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		if r.Header.Get("Range") != "" {
+			rangeRequests.Add(1)
+		} else if failFirst && !failed.Swap(true) {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/2])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	tb.Cleanup(srv.Close)
+	return &Substituter{URL: srv.URL, Client: srv.Client()}, rangeRequests
+}
+
+func TestSubstituterResume(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	sub, rangeRequests := newRangeServer(t, data, true)
+
+	r, err := sub.open(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+	if n := rangeRequests.Load(); n != 1 {
+		t.Errorf("made %d range requests; want 1", n)
+	}
+}
+
+func TestSubstituterParallel(t *testing.T) {
+	oldSegmentSize := minDownloadSegmentSize
+	minDownloadSegmentSize = 64 << 10
+	t.Cleanup(func() { minDownloadSegmentSize = oldSegmentSize })
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	sub, rangeRequests := newRangeServer(t, data, false)
+	sub.Parallelism = 4
+
+	r, err := sub.open(context.Background(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data does not match")
+	}
+	if n := rangeRequests.Load(); n != 4 {
+		t.Errorf("made %d range requests; want 4", n)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// A BuildFailure records that a derivation's builder failed.
+type BuildFailure struct {
+	DrvPath nix.StorePath
+	// Message is the error message that the backend reported.
+	Message string
+	// Time is when the build failed.
+	Time time.Time
+}
+
+// RecordBuildFailure saves a build failure,
+// replacing any failure previously recorded for the same derivation.
+func (db *DB) RecordBuildFailure(ctx context.Context, f *BuildFailure) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	err := sqlitex.Execute(db.conn, `insert into "failed_builds" ("drv_path", "message", "time") values (?, ?, ?) `+
+		`on conflict ("drv_path") do update set "message" = excluded."message", "time" = excluded."time";`, &sqlitex.ExecOptions{
+		Args: []any{string(f.DrvPath), f.Message, f.Time.Unix()},
+	})
+	if err != nil {
+		return fmt.Errorf("record build failure of %s: %v", f.DrvPath, err)
+	}
+	return nil
+}
+
+// BuildFailure returns the most recent failure recorded for the given derivation.
+// If none has been recorded, BuildFailure returns an error that wraps [ErrNotFound].
+func (db *DB) BuildFailure(ctx context.Context, drvPath nix.StorePath) (*BuildFailure, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var f *BuildFailure
+	err := sqlitex.Execute(db.conn, `select "message", "time" from "failed_builds" where "drv_path" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{string(drvPath)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			f = &BuildFailure{
+				DrvPath: drvPath,
+				Message: stmt.ColumnText(0),
+				Time:    time.Unix(stmt.ColumnInt64(1), 0),
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read build failure of %s: %v", drvPath, err)
+	}
+	if f == nil {
+		return nil, fmt.Errorf("read build failure of %s: %w", drvPath, ErrNotFound)
+	}
+	return f, nil
+}
+
+// ForgetBuildFailures removes any failures recorded for the given derivations.
+func (db *DB) ForgetBuildFailures(ctx context.Context, drvPaths ...nix.StorePath) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	for _, p := range drvPaths {
+		err := sqlitex.Execute(db.conn, `delete from "failed_builds" where "drv_path" = ?;`, &sqlitex.ExecOptions{
+			Args: []any{string(p)},
+		})
+		if err != nil {
+			return fmt.Errorf("forget build failure of %s: %v", p, err)
+		}
+	}
+	return nil
+}
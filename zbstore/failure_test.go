@@ -0,0 +1,52 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildFailures(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const drvPath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-2.12.drv"
+	if _, err := db.BuildFailure(ctx, drvPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("BuildFailure(ctx, %q) before recording: error = %v; want %v", drvPath, err, ErrNotFound)
+	}
+	for _, msg := range []string{"first failure", "second failure"} {
+		err := db.RecordBuildFailure(ctx, &BuildFailure{
+			DrvPath: drvPath,
+			Message: msg,
+			Time:    time.Unix(1700000000, 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := db.BuildFailure(ctx, drvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BuildFailure{
+		DrvPath: drvPath,
+		Message: "second failure",
+		Time:    time.Unix(1700000000, 0),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("BuildFailure(ctx, %q) (-want +got):\n%s", drvPath, diff)
+	}
+
+	if err := db.ForgetBuildFailures(ctx, drvPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BuildFailure(ctx, drvPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("BuildFailure(ctx, %q) after forgetting: error = %v; want %v", drvPath, err, ErrNotFound)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// A GCRoot is a garbage collector root:
+// a reference from outside the store that keeps a store object alive.
+type GCRoot struct {
+	// Link is the location of the root, usually a symlink.
+	// Roots held by running processes may have a link like "/proc/123/maps".
+	Link string
+	// Path is the store object kept alive by the root.
+	Path nix.StorePath
+}
+
+// Roots returns the garbage collector's roots.
+func (s *Store) Roots(ctx context.Context) ([]GCRoot, error) {
+	out, err := s.nixStore(ctx, "--gc", "--print-roots")
+	if err != nil {
+		return nil, err
+	}
+	return parseRoots(out)
+}
+
+// parseRoots parses the output of nix-store --gc --print-roots.
+func parseRoots(out []byte) ([]GCRoot, error) {
+	var roots []GCRoot
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		link, path, ok := strings.Cut(string(line), " -> ")
+		if !ok {
+			return roots, fmt.Errorf("parse roots: invalid line %q", line)
+		}
+		p, err := nix.ParseStorePath(path)
+		if err != nil {
+			return roots, fmt.Errorf("parse roots: %v", err)
+		}
+		roots = append(roots, GCRoot{Link: link, Path: p})
+	}
+	return roots, nil
+}
+
+// DeadPaths returns the store objects that are not reachable from any root
+// and would be deleted by [Store.CollectGarbage] if it were run now.
+func (s *Store) DeadPaths(ctx context.Context) ([]nix.StorePath, error) {
+	return s.nixStorePaths(ctx, "--gc", "--print-dead")
+}
+
+// CollectGarbage deletes every store object that is not reachable from a root.
+// It returns the number of bytes freed.
+func (s *Store) CollectGarbage(ctx context.Context) (int64, error) {
+	c := s.command(ctx, "--gc")
+	// nix-store prints its "N store paths deleted, X MiB freed" summary to stdout.
+	stdout := new(bytes.Buffer)
+	c.Stdout = stdout
+	c.Stderr = s.stderr()
+	err := c.Run()
+	s.stderr().Write(stdout.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("nix-store --gc: %v", err)
+	}
+	return parseGCFreed(stdout.Bytes()), nil
+}
+
+// Delete deletes the given store objects.
+// Unlike [Store.CollectGarbage], it only considers the named objects,
+// but it fails without deleting anything
+// if any of them are still reachable from a root or another store object.
+func (s *Store) Delete(ctx context.Context, paths ...nix.StorePath) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	args := []string{"--delete"}
+	for _, p := range paths {
+		args = append(args, string(p))
+	}
+	c := s.command(ctx, args...)
+	c.Stdout = s.stderr()
+	c.Stderr = s.stderr()
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("nix-store --delete: %v", err)
+	}
+	return nil
+}
+
+// parseGCFreed returns the number of bytes freed
+// reported in the output of nix-store --gc
+// or zero if the output does not say.
+func parseGCFreed(out []byte) int64 {
+	m := gcFreedPattern.FindSubmatch(out)
+	if m == nil {
+		return 0
+	}
+	return parseMiB(string(m[1]))
+}
+
+var gcFreedPattern = regexp.MustCompile(`([0-9.]+) MiB freed`)
+
+// GCPlan describes what garbage collection would delete
+// and what each root is keeping alive.
+type GCPlan struct {
+	// Dead is the set of store objects that garbage collection would delete.
+	// It comes from its own traversal of the store (see [Store.DeadPaths]),
+	// not the one a later [Store.CollectGarbage] performs,
+	// so roots or store objects added or removed in between
+	// make the two disagree.
+	Dead []nix.StorePath
+	// DeadSize is the total NAR size of Dead in bytes.
+	DeadSize int64
+	// Roots lists the roots in descending order of how much space
+	// would be freed by removing them.
+	Roots []*RootUsage
+}
+
+// RootUsage is the amount of store space kept alive by a root.
+type RootUsage struct {
+	GCRoot
+	// ClosureSize is the total NAR size in bytes of the root's closure.
+	ClosureSize int64
+	// UniqueSize is the number of bytes that would be freed
+	// by removing the root alone:
+	// the size of the store objects in its closure
+	// that no other root keeps alive.
+	UniqueSize int64
+}
+
+// PlanGC computes what garbage collection would delete
+// without deleting anything.
+func (s *Store) PlanGC(ctx context.Context) (*GCPlan, error) {
+	plan := new(GCPlan)
+	var err error
+	plan.Dead, err = s.DeadPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := s.Roots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	closures := make(map[nix.StorePath][]nix.StorePath)
+	for _, root := range roots {
+		if _, done := closures[root.Path]; done {
+			continue
+		}
+		closures[root.Path], err = s.QueryRequisites(ctx, root.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sizes := make(map[nix.StorePath]int64)
+	var unsized []nix.StorePath
+	for _, closure := range closures {
+		for _, p := range closure {
+			if _, ok := sizes[p]; !ok {
+				sizes[p] = 0
+				unsized = append(unsized, p)
+			}
+		}
+	}
+	unsized = append(unsized, plan.Dead...)
+	sizeList, err := s.QuerySizes(ctx, unsized...)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range unsized {
+		sizes[p] = sizeList[i]
+	}
+	for _, p := range plan.Dead {
+		plan.DeadSize += sizes[p]
+	}
+	plan.Roots = rootUsage(roots, closures, sizes)
+	return plan, nil
+}
+
+// rootUsage computes the space used by each root
+// given the closure of each root's store path and the size of every store object.
+// Multiple roots that refer to the same store object
+// are considered to share its closure.
+func rootUsage(roots []GCRoot, closures map[nix.StorePath][]nix.StorePath, sizes map[nix.StorePath]int64) []*RootUsage {
+	// Count how many distinct root paths keep each store object alive.
+	refCounts := make(map[nix.StorePath]int)
+	for _, closure := range closures {
+		for _, p := range closure {
+			refCounts[p]++
+		}
+	}
+	linkCounts := make(map[nix.StorePath]int)
+	for _, root := range roots {
+		linkCounts[root.Path]++
+	}
+
+	usage := make([]*RootUsage, 0, len(roots))
+	for _, root := range roots {
+		u := &RootUsage{GCRoot: root}
+		for _, p := range closures[root.Path] {
+			u.ClosureSize += sizes[p]
+			if refCounts[p] == 1 && linkCounts[root.Path] == 1 {
+				u.UniqueSize += sizes[p]
+			}
+		}
+		usage = append(usage, u)
+	}
+	slices.SortStableFunc(usage, func(u1, u2 *RootUsage) int {
+		switch {
+		case u1.UniqueSize != u2.UniqueSize:
+			return cmp.Compare(u2.UniqueSize, u1.UniqueSize)
+		case u1.ClosureSize != u2.ClosureSize:
+			return cmp.Compare(u2.ClosureSize, u1.ClosureSize)
+		default:
+			return strings.Compare(u1.Link, u2.Link)
+		}
+	})
+	return usage
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestParseRoots(t *testing.T) {
+	const out = "/home/alice/src/result -> /nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello\n" +
+		"/proc/123/maps -> /nix/store/00000000000000000000000000000000-glibc\n"
+	got, err := parseRoots([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []GCRoot{
+		{Link: "/home/alice/src/result", Path: "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"},
+		{Link: "/proc/123/maps", Path: "/nix/store/00000000000000000000000000000000-glibc"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseRoots(...) (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseGCFreed(t *testing.T) {
+	tests := []struct {
+		out  string
+		want int64
+	}{
+		{out: "", want: 0},
+		{out: "0 store paths deleted, 0.00 MiB freed\n", want: 0},
+		{out: "finding garbage collector roots...\n3 store paths deleted, 1.50 MiB freed\n", want: 3 << 19},
+	}
+	for _, test := range tests {
+		if got := parseGCFreed([]byte(test.out)); got != test.want {
+			t.Errorf("parseGCFreed(%q) = %d; want %d", test.out, got, test.want)
+		}
+	}
+}
+
+func TestPathBatches(t *testing.T) {
+	paths := make([]nix.StorePath, 2*maxPathArgs+1)
+	for i := range paths {
+		paths[i] = nix.StorePath(fmt.Sprintf("/nix/store/%032d-p", i))
+	}
+	batches := pathBatches(paths)
+	if len(batches) != 3 {
+		t.Fatalf("len(pathBatches(%d paths)) = %d; want 3", len(paths), len(batches))
+	}
+	if diff := cmp.Diff(paths, slices.Concat(batches...)); diff != "" {
+		t.Errorf("batches do not concatenate to input (-want +got):\n%s", diff)
+	}
+	if got := pathBatches(nil); len(got) != 0 {
+		t.Errorf("pathBatches(nil) = %v; want []", got)
+	}
+}
+
+func TestRootUsage(t *testing.T) {
+	const (
+		glibc nix.StorePath = "/nix/store/00000000000000000000000000000000-glibc"
+		hello nix.StorePath = "/nix/store/11111111111111111111111111111111-hello"
+		gcc   nix.StorePath = "/nix/store/22222222222222222222222222222222-gcc"
+		doc   nix.StorePath = "/nix/store/33333333333333333333333333333333-doc"
+	)
+	roots := []GCRoot{
+		{Link: "/src/hello/result", Path: hello},
+		{Link: "/src/gcc/result", Path: gcc},
+		{Link: "/src/doc/result", Path: doc},
+		{Link: "/src/doc/result-2", Path: doc},
+	}
+	closures := map[nix.StorePath][]nix.StorePath{
+		hello: {hello, glibc},
+		gcc:   {gcc, glibc},
+		doc:   {doc},
+	}
+	sizes := map[nix.StorePath]int64{
+		glibc: 1000,
+		hello: 10,
+		gcc:   500,
+		doc:   2000,
+	}
+	got := rootUsage(roots, closures, sizes)
+	want := []*RootUsage{
+		{GCRoot: roots[1], ClosureSize: 1500, UniqueSize: 500},
+		{GCRoot: roots[0], ClosureSize: 1010, UniqueSize: 10},
+		{GCRoot: roots[2], ClosureSize: 2000, UniqueSize: 0},
+		{GCRoot: roots[3], ClosureSize: 2000, UniqueSize: 0},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("rootUsage(...) (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Bounds on how long a failing substituter is skipped.
+// The time doubles with each consecutive failure.
+const (
+	minSubstituterBackoff = 30 * time.Second
+	maxSubstituterBackoff = 1 * time.Hour
+)
+
+// A SubstituterFailure records that a substituter has been failing.
+type SubstituterFailure struct {
+	URL string
+	// Count is the number of consecutive failures.
+	Count int
+	// Message is the error from the most recent failure.
+	Message string
+	// DisabledUntil is when the substituter may be tried again.
+	DisabledUntil time.Time
+}
+
+// Disabled reports whether the substituter should be skipped at the given time.
+func (f *SubstituterFailure) Disabled(now time.Time) bool {
+	return now.Before(f.DisabledUntil)
+}
+
+// substituterBackoff returns how long to skip a substituter
+// after the given number of consecutive failures.
+func substituterBackoff(count int) time.Duration {
+	d := minSubstituterBackoff
+	for i := 1; i < count && d < maxSubstituterBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxSubstituterBackoff)
+}
+
+// RecordSubstituterFailure records that the substituter at the given URL failed at now
+// and returns its updated record.
+// Each consecutive failure disables the substituter for twice as long as the last,
+// up to an hour.
+func (db *DB) RecordSubstituterFailure(ctx context.Context, url string, failure error, now time.Time) (_ *SubstituterFailure, err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	f, err := db.substituterFailure(url)
+	if err != nil {
+		return nil, fmt.Errorf("record failure of %s: %v", url, err)
+	}
+	if f == nil {
+		f = &SubstituterFailure{URL: url}
+	}
+	f.Count++
+	f.Message = failure.Error()
+	f.DisabledUntil = now.Add(substituterBackoff(f.Count))
+	err = sqlitex.Execute(db.conn, `insert into "substituter_failures" ("url", "count", "message", "disabled_until") values (?, ?, ?, ?) `+
+		`on conflict ("url") do update set "count" = excluded."count", "message" = excluded."message", "disabled_until" = excluded."disabled_until";`, &sqlitex.ExecOptions{
+		Args: []any{url, f.Count, f.Message, f.DisabledUntil.Unix()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("record failure of %s: %v", url, err)
+	}
+	return f, nil
+}
+
+// SubstituterFailure returns the failures recorded for the substituter at the given URL.
+// If the substituter has not failed since it last succeeded,
+// SubstituterFailure returns an error that wraps [ErrNotFound].
+func (db *DB) SubstituterFailure(ctx context.Context, url string) (*SubstituterFailure, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	f, err := db.substituterFailure(url)
+	if err != nil {
+		return nil, fmt.Errorf("read failures of %s: %v", url, err)
+	}
+	if f == nil {
+		return nil, fmt.Errorf("read failures of %s: %w", url, ErrNotFound)
+	}
+	return f, nil
+}
+
+func (db *DB) substituterFailure(url string) (*SubstituterFailure, error) {
+	var f *SubstituterFailure
+	err := sqlitex.Execute(db.conn, `select "count", "message", "disabled_until" from "substituter_failures" where "url" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{url},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			f = &SubstituterFailure{
+				URL:           url,
+				Count:         stmt.ColumnInt(0),
+				Message:       stmt.ColumnText(1),
+				DisabledUntil: time.Unix(stmt.ColumnInt64(2), 0),
+			}
+			return nil
+		},
+	})
+	return f, err
+}
+
+// RecordSubstituterSuccess forgets the failures of the substituter at the given URL.
+func (db *DB) RecordSubstituterSuccess(ctx context.Context, url string) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	err := sqlitex.Execute(db.conn, `delete from "substituter_failures" where "url" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{url},
+	})
+	if err != nil {
+		return fmt.Errorf("record success of %s: %v", url, err)
+	}
+	return nil
+}
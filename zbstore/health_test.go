@@ -0,0 +1,107 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSubstituterFailures(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const url = "https://cache.example.com"
+	if _, err := db.SubstituterFailure(ctx, url); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SubstituterFailure(ctx, %q) before recording: error = %v; want %v", url, err, ErrNotFound)
+	}
+	now := time.Unix(1700000000, 0)
+	wantBackoffs := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute}
+	for i, wantBackoff := range wantBackoffs {
+		f, err := db.RecordSubstituterFailure(ctx, url, fmt.Errorf("failure %d", i+1), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.DisabledUntil.Sub(now); got != wantBackoff {
+			t.Errorf("after %d failures, disabled for %v; want %v", i+1, got, wantBackoff)
+		}
+	}
+	got, err := db.SubstituterFailure(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &SubstituterFailure{
+		URL:           url,
+		Count:         len(wantBackoffs),
+		Message:       "failure 3",
+		DisabledUntil: now.Add(2 * time.Minute),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SubstituterFailure(ctx, %q) (-want +got):\n%s", url, diff)
+	}
+	if !got.Disabled(now.Add(time.Minute)) {
+		t.Error("Disabled(now+1m) = false; want true")
+	}
+	if got.Disabled(now.Add(2 * time.Minute)) {
+		t.Error("Disabled(now+2m) = true; want false")
+	}
+
+	if err := db.RecordSubstituterSuccess(ctx, url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SubstituterFailure(ctx, url); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SubstituterFailure(ctx, %q) after success: error = %v; want %v", url, err, ErrNotFound)
+	}
+}
+
+func TestSubstituterBackoff(t *testing.T) {
+	if got := substituterBackoff(100); got != maxSubstituterBackoff {
+		t.Errorf("substituterBackoff(100) = %v; want %v", got, maxSubstituterBackoff)
+	}
+}
+
+func TestSortSubstituters(t *testing.T) {
+	newCache := func(priority int) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/nix-cache-info" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "StoreDir: /nix/store\nPriority: %d\n", priority)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	a := &Substituter{URL: newCache(40)}
+	b := &Substituter{URL: newCache(40) + "?priority=10"}
+	c := &Substituter{URL: newCache(10), Priority: 45}
+	d := &Substituter{URL: down.URL}
+	e := &Substituter{URL: newCache(30)}
+	subs := []*Substituter{a, b, c, d, e}
+	SortSubstituters(context.Background(), subs)
+	want := []*Substituter{b, e, a, c, d}
+	for i := range want {
+		if subs[i] != want[i] {
+			got := make([]string, len(subs))
+			for j, sub := range subs {
+				got[j] = sub.URL
+			}
+			t.Fatalf("SortSubstituters order = %q", got)
+		}
+	}
+
+	if got, err := b.resolve("nix-cache-info"); err != nil || got != b.URL[:len(b.URL)-len("?priority=10")]+"/nix-cache-info" {
+		t.Errorf("b.resolve(\"nix-cache-info\") = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// IPFS URL schemes supported by [Substituter].
+const (
+	ipfsScheme = "ipfs"
+	ipnsScheme = "ipns"
+)
+
+// DefaultIPFSGateway is the address of the HTTP gateway
+// that a local IPFS node (such as Kubo) serves by default.
+const DefaultIPFSGateway = "http://127.0.0.1:8080"
+
+// IPFSCacheURL returns the URL of the binary cache
+// published to IPFS as the directory with the given CID.
+func IPFSCacheURL(cid string) string {
+	return ipfsScheme + "://" + cid
+}
+
+// GatewayURL translates an ipfs:// or ipns:// binary cache URL
+// to the URL of the cache on the given IPFS HTTP gateway.
+// If gateway is empty, [DefaultIPFSGateway] is used.
+// ok is false if rawURL does not use one of those schemes.
+//
+// ipfs://cid/path refers to a directory published to IPFS,
+// and ipns://name/path refers to a directory
+// whose CID is looked up with IPNS or DNSLink.
+func GatewayURL(gateway, rawURL string) (_ string, ok bool, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false, err
+	}
+	endpoint, ok, err := ipfsEndpoint(gateway, u)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	return endpoint.String(), true, nil
+}
+
+func ipfsEndpoint(gateway string, u *url.URL) (endpoint *url.URL, ok bool, err error) {
+	if u.Scheme != ipfsScheme && u.Scheme != ipnsScheme {
+		return nil, false, nil
+	}
+	if u.Host == "" {
+		return nil, true, fmt.Errorf("%v: missing CID", u.Redacted())
+	}
+	if u.Scheme == ipfsScheme && !isCID(u.Host) {
+		return nil, true, fmt.Errorf("%v: %q is not a CID", u.Redacted(), u.Host)
+	}
+	if gateway == "" {
+		gateway = DefaultIPFSGateway
+	}
+	p := "/" + u.Scheme + "/" + u.Host
+	if rest := strings.Trim(u.Path, "/"); rest != "" {
+		p += "/" + rest
+	}
+	endpoint, err = url.Parse(strings.TrimSuffix(gateway, "/") + p + "/")
+	if err != nil {
+		return nil, true, fmt.Errorf("%v: %v", u.Redacted(), err)
+	}
+	return endpoint, true, nil
+}
+
+// isCID reports whether s looks like an IPFS content identifier:
+// either a base58 CIDv0 ("Qm...")
+// or a CIDv1 in a case-insensitive multibase encoding like base32 ("bafy...").
+// isCID does not decode the multihash.
+func isCID(s string) bool {
+	if len(s) < 46 || len(s) > 128 {
+		return false
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	if strings.HasPrefix(s, "Qm") {
+		return len(s) == 46
+	}
+	return s[0] == 'b' || s[0] == 'B' || s[0] == 'k' || s[0] == 'z' || s[0] == 'f'
+}
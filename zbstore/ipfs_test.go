@@ -0,0 +1,71 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import "testing"
+
+const testCID = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+
+func TestGatewayURL(t *testing.T) {
+	tests := []struct {
+		gateway string
+		url     string
+		want    string
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			url:    "ipfs://" + testCID,
+			want:   DefaultIPFSGateway + "/ipfs/" + testCID + "/",
+			wantOK: true,
+		},
+		{
+			gateway: "https://ipfs.example.com/",
+			url:     "ipfs://QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/cache/",
+			want:    "https://ipfs.example.com/ipfs/QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG/cache/",
+			wantOK:  true,
+		},
+		{
+			url:    "ipns://cache.example.com",
+			want:   DefaultIPFSGateway + "/ipns/cache.example.com/",
+			wantOK: true,
+		},
+		{
+			url:     "ipfs://not-a-cid",
+			wantOK:  true,
+			wantErr: true,
+		},
+		{
+			url:     "ipfs:///",
+			wantOK:  true,
+			wantErr: true,
+		},
+		{
+			url:    "https://cache.example.com",
+			wantOK: false,
+		},
+	}
+	for _, test := range tests {
+		got, ok, err := GatewayURL(test.gateway, test.url)
+		if got != test.want || ok != test.wantOK || (err != nil) != test.wantErr {
+			errString := "<nil>"
+			if test.wantErr {
+				errString = "<error>"
+			}
+			t.Errorf("GatewayURL(%q, %q) = %q, %t, %v; want %q, %t, %s",
+				test.gateway, test.url, got, ok, err, test.want, test.wantOK, errString)
+		}
+	}
+}
+
+func TestSubstituterIPFS(t *testing.T) {
+	sub := &Substituter{
+		URL:         IPFSCacheURL(testCID),
+		IPFSGateway: "http://localhost:5001",
+	}
+	got, err := sub.resolve("nix-cache-info")
+	if want := "http://localhost:5001/ipfs/" + testCID + "/nix-cache-info"; got != want || err != nil {
+		t.Errorf("sub.resolve(\"nix-cache-info\") = %q, %v; want %q, <nil>", got, err, want)
+	}
+}
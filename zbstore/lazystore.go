@@ -0,0 +1,320 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// A LazyStore presents the store objects that its substituters provide
+// as a read-only file system (see [LazyStore.Mount]),
+// downloading each object the first time it is accessed.
+// Programs in a large closure can start
+// without waiting for the whole closure to be downloaded.
+type LazyStore struct {
+	// Dir is the store directory of the objects.
+	// If empty, [nix.DefaultStoreDirectory] is used.
+	Dir nix.StoreDirectory
+	// Substituters is the list of caches to download objects from,
+	// in order of preference.
+	Substituters []*Substituter
+	// CacheDir is the directory where downloaded objects are unpacked.
+	// Objects in CacheDir are served without being downloaded again.
+	CacheDir string
+
+	mu      sync.Mutex
+	pending map[string]*lazyFetch
+}
+
+// lazyFetch is an in-progress download of a store object.
+type lazyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (ls *LazyStore) dir() nix.StoreDirectory {
+	if ls.Dir == "" {
+		return nix.DefaultStoreDirectory
+	}
+	return ls.Dir
+}
+
+// materialize returns the path in the cache directory
+// of the store object with the given base name,
+// downloading the object if it has not been downloaded yet.
+// Concurrent calls for the same object share a single download.
+// If no substituter has the object,
+// materialize returns an error that wraps [ErrNotFound].
+func (ls *LazyStore) materialize(ctx context.Context, name string) (string, error) {
+	storePath, err := ls.dir().Object(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	dst := filepath.Join(ls.CacheDir, name)
+	for {
+		if _, err := os.Lstat(dst); err == nil {
+			return dst, nil
+		}
+
+		ls.mu.Lock()
+		f := ls.pending[name]
+		if f == nil {
+			f = &lazyFetch{done: make(chan struct{})}
+			if ls.pending == nil {
+				ls.pending = make(map[string]*lazyFetch)
+			}
+			ls.pending[name] = f
+			ls.mu.Unlock()
+
+			f.err = ls.fetch(ctx, storePath, dst)
+			ls.mu.Lock()
+			delete(ls.pending, name)
+			ls.mu.Unlock()
+			close(f.done)
+			if f.err != nil {
+				return "", f.err
+			}
+			return dst, nil
+		}
+		ls.mu.Unlock()
+
+		select {
+		case <-f.done:
+			if f.err != nil {
+				return "", f.err
+			}
+		case <-ctx.Done():
+			return "", fmt.Errorf("fetch %s: %w", storePath, ctx.Err())
+		}
+	}
+}
+
+// fetch downloads a store object from the first substituter that has it
+// and unpacks it at dst.
+// The object is locked while it is downloaded
+// so that processes sharing the cache directory download it only once.
+func (ls *LazyStore) fetch(ctx context.Context, storePath nix.StorePath, dst string) error {
+	if err := os.MkdirAll(ls.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("fetch %s: %v", storePath, err)
+	}
+	lock, err := lockFile(ctx, filepath.Join(ls.CacheDir, "."+storePath.Base()+".lock"))
+	if err != nil {
+		return fmt.Errorf("fetch %s: %w", storePath, err)
+	}
+	defer lock.unlock()
+	if _, err := os.Lstat(dst); err == nil {
+		log.Debugf(ctx, "%s downloaded by another process", storePath)
+		return nil
+	}
+
+	for _, sub := range ls.Substituters {
+		info, err := sub.NARInfo(ctx, storePath)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warnf(ctx, "%v", err)
+			continue
+		}
+		log.Debugf(ctx, "Downloading %s from %s", storePath, sub.URL)
+		if err := ls.unpack(ctx, sub, info, dst); err != nil {
+			log.Warnf(ctx, "%v", err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("fetch %s: %w", storePath, ErrNotFound)
+}
+
+// unpack downloads the NAR described by info
+// and extracts it to dst.
+// The NAR is extracted to a temporary directory
+// and only moved to dst once its hash has been verified.
+func (ls *LazyStore) unpack(ctx context.Context, sub *Substituter, info *nix.NARInfo, dst string) error {
+	body, err := ls.download(ctx, sub, info)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(ls.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	tempDir, err := os.MkdirTemp(ls.CacheDir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	defer removeAll(tempDir)
+	tempPath := filepath.Join(tempDir, "object")
+	if err := extractNAR(tempPath, body); err != nil {
+		return fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	// Read to the end so that the hash is checked.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		return fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	return nil
+}
+
+// download downloads the NAR described by info.
+// If an older version of the store object
+// (an object with the same name) has already been downloaded,
+// download first tries to download a delta from it.
+func (ls *LazyStore) download(ctx context.Context, sub *Substituter, info *nix.NARInfo) (io.ReadCloser, error) {
+	base, err := ls.deltaBase(info.StorePath)
+	if err != nil {
+		log.Debugf(ctx, "Finding delta base for %s: %v", info.StorePath, err)
+	}
+	if base == "" {
+		return sub.DownloadNAR(ctx, info)
+	}
+	baseNAR := new(bytes.Buffer)
+	if err := nar.DumpPath(baseNAR, filepath.Join(ls.CacheDir, base.Base())); err != nil {
+		log.Debugf(ctx, "Reading delta base for %s: %v", info.StorePath, err)
+		return sub.DownloadNAR(ctx, info)
+	}
+	body, err := sub.DownloadNARDelta(ctx, info, base, bytes.NewReader(baseNAR.Bytes()))
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Debugf(ctx, "%v", err)
+		}
+		return sub.DownloadNAR(ctx, info)
+	}
+	log.Debugf(ctx, "Downloading %s as delta from %s", info.StorePath, base)
+	return body, nil
+}
+
+// deltaBase returns the most recently downloaded store object
+// with the same name as path, or the empty string if there is none.
+func (ls *LazyStore) deltaBase(path nix.StorePath) (nix.StorePath, error) {
+	names, err := ls.cachedObjects()
+	if err != nil {
+		return "", err
+	}
+	var base nix.StorePath
+	var baseTime time.Time
+	for _, name := range names {
+		p, err := ls.dir().Object(name)
+		if err != nil || p == path || p.Name() != path.Name() {
+			continue
+		}
+		info, err := os.Lstat(filepath.Join(ls.CacheDir, name))
+		if err != nil {
+			continue
+		}
+		if base == "" || info.ModTime().After(baseTime) {
+			base, baseTime = p, info.ModTime()
+		}
+	}
+	return base, nil
+}
+
+// extractNAR writes the file system object in the NAR read from r
+// to dst, which must not exist.
+// As in a store, files and directories are made read-only.
+func extractNAR(dst string, r io.Reader) error {
+	nr := nar.NewReader(r)
+	var dirs []string
+	for {
+		hdr, err := nr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		p := dst
+		if hdr.Path != "" {
+			p = filepath.Join(dst, filepath.FromSlash(hdr.Path))
+		}
+		switch hdr.Mode.Type() {
+		case fs.ModeDir:
+			if err := os.Mkdir(p, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, p)
+		case fs.ModeSymlink:
+			if err := os.Symlink(hdr.LinkTarget, p); err != nil {
+				return err
+			}
+		default:
+			perm := fs.FileMode(0o444)
+			if hdr.Mode&0o111 != 0 {
+				perm = 0o555
+			}
+			if err := writeExtractedFile(p, perm, nr); err != nil {
+				return err
+			}
+		}
+	}
+	// Make directories read-only after their contents have been written.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], 0o555); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExtractedFile(path string, perm fs.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm|0o200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// removeAll removes path and its contents,
+// making read-only directories writable as needed.
+func removeAll(path string) error {
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0o755)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// cachedObjects returns the base names of the store objects
+// that have already been downloaded.
+func (ls *LazyStore) cachedObjects() ([]string, error) {
+	entries, err := os.ReadDir(ls.CacheDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, ent := range entries {
+		if name := ent.Name(); !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
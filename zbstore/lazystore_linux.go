@@ -0,0 +1,121 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"zombiezen.com/go/log"
+)
+
+// Mount serves the lazy store as a read-only FUSE file system
+// at mountpoint until ctx is done.
+// Looking up a store object's name in the mounted directory
+// downloads the object into [LazyStore.CacheDir] if needed.
+// Listing the directory only shows the objects that have been downloaded.
+// To make store paths resolve to the file system,
+// mountpoint is usually the store directory
+// (for example, inside a private mount namespace).
+func (ls *LazyStore) Mount(ctx context.Context, mountpoint string) error {
+	if err := os.MkdirAll(ls.CacheDir, 0o755); err != nil {
+		return fmt.Errorf("mount lazy store: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(ls.CacheDir, &st); err != nil {
+		return fmt.Errorf("mount lazy store: %v", err)
+	}
+	root := &lazyRoot{store: ls}
+	root.loopback = &fs.LoopbackRoot{
+		Path:     ls.CacheDir,
+		Dev:      uint64(st.Dev),
+		RootNode: root,
+	}
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:  "zb",
+			Name:    "zb-lazy",
+			Options: []string{"ro"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mount lazy store: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		if err := server.Unmount(); err != nil {
+			log.Errorf(ctx, "Unmount %s: %v", mountpoint, err)
+		}
+	})
+	defer stop()
+	server.Wait()
+	return nil
+}
+
+// lazyRoot is the root directory of a mounted [LazyStore].
+// Its children are loopback nodes for the downloaded objects.
+type lazyRoot struct {
+	fs.Inode
+	store    *LazyStore
+	loopback *fs.LoopbackRoot
+}
+
+var (
+	_ fs.NodeLookuper  = (*lazyRoot)(nil)
+	_ fs.NodeReaddirer = (*lazyRoot)(nil)
+	_ fs.NodeGetattrer = (*lazyRoot)(nil)
+)
+
+func (r *lazyRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p, err := r.store.materialize(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, syscall.ENOENT
+	}
+	if err != nil {
+		log.Errorf(ctx, "%v", err)
+		return nil, syscall.EIO
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	node := &fs.LoopbackNode{RootData: r.loopback}
+	return r.NewInode(ctx, node, fs.StableAttr{
+		Mode: st.Mode,
+		Gen:  1,
+		Ino:  st.Ino,
+	}), fs.OK
+}
+
+func (r *lazyRoot) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	names, err := r.store.cachedObjects()
+	if err != nil {
+		log.Errorf(ctx, "%v", err)
+		return nil, syscall.EIO
+	}
+	entries := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(r.store.CacheDir, name), &st); err != nil {
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: st.Mode,
+			Ino:  st.Ino,
+		})
+	}
+	return fs.NewListDirStream(entries), fs.OK
+}
+
+func (r *lazyRoot) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0o555
+	return fs.OK
+}
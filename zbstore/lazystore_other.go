@@ -0,0 +1,19 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// Mount serves the lazy store as a read-only FUSE file system
+// at mountpoint until ctx is done.
+// It is only supported on Linux.
+func (ls *LazyStore) Mount(ctx context.Context, mountpoint string) error {
+	return fmt.Errorf("mount lazy store: not supported on %s", runtime.GOOS)
+}
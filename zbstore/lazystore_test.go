@@ -0,0 +1,54 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestLazyStoreMaterialize(t *testing.T) {
+	ctx := context.Background()
+	sub, _ := newTestSubstituter(t, nil)
+	ls := &LazyStore{
+		Substituters: []*Substituter{sub},
+		CacheDir:     filepath.Join(t.TempDir(), "cache"),
+	}
+	t.Cleanup(func() { removeAll(ls.CacheDir) })
+
+	p, err := ls.materialize(ctx, testSubstituterPath.Base())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(ls.CacheDir, testSubstituterPath.Base()); p != want {
+		t.Errorf("materialize(...) = %q; want %q", p, want)
+	}
+	info, err := os.Stat(filepath.Join(p, "bin", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode(), os.FileMode(0o555); got != want {
+		t.Errorf("mode of bin/hello = %v; want %v", got, want)
+	}
+	if got, err := os.Readlink(filepath.Join(p, "hello")); err != nil || got != "bin/hello" {
+		t.Errorf("readlink hello = %q, %v; want %q, <nil>", got, err, "bin/hello")
+	}
+	names, err := ls.cachedObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != testSubstituterPath.Base() {
+		t.Errorf("cachedObjects() = %q; want [%q]", names, testSubstituterPath.Base())
+	}
+
+	missing := nix.StorePath("/nix/store/22222222222222222222222222222222-missing")
+	if _, err := ls.materialize(ctx, missing.Base()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("materialize(ctx, %q) error = %v; want %v", missing.Base(), err, ErrNotFound)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// maxListingSize is the largest decompressed .ls file
+// that [Substituter.Listing] reads.
+const maxListingSize = 64 << 20
+
+// listingCachePath returns the path of a store object's .ls file
+// relative to the root of a binary cache.
+func listingCachePath(path nix.StorePath) string {
+	return path.Digest() + nar.ListingExtension
+}
+
+// encodeListing returns the contents of a .ls file for the given listing:
+// the listing's JSON, compressed with Brotli as Nix does.
+func encodeListing(ls *nar.Listing) ([]byte, error) {
+	data, err := json.Marshal(ls)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	bw := brotli.NewWriterLevel(buf, brotli.DefaultCompression)
+	bw.Write(data)
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeListing parses the contents of a .ls file.
+// The file may be Brotli-compressed or plain JSON
+// (if an HTTP client has already removed the Brotli content encoding).
+func decodeListing(r io.Reader) (*nar.Listing, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxListingSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+		data, err = io.ReadAll(io.LimitReader(brotli.NewReader(bytes.NewReader(data)), maxListingSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %v", err)
+		}
+	}
+	if len(data) > maxListingSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxListingSize)
+	}
+	ls := new(nar.Listing)
+	if err := json.Unmarshal(data, ls); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// Listing downloads the cache's listing of the files in the given store object
+// (the .ls file that [Push] uploads alongside each NAR).
+// Listings let tools find which store object provides a file
+// without downloading NARs.
+// If the cache does not have a listing for the object,
+// Listing returns an error that wraps [ErrNotFound].
+func (sub *Substituter) Listing(ctx context.Context, path nix.StorePath) (*nar.Listing, error) {
+	resp, err := sub.get(ctx, listingCachePath(path))
+	if err != nil {
+		return nil, fmt.Errorf("query listing of %s from %s: %w", path, sub.URL, err)
+	}
+	defer resp.Body.Close()
+	ls, err := decodeListing(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("query listing of %s from %s: %v", path, sub.URL, err)
+	}
+	return ls, nil
+}
+
+// ListObject returns the listing of the files in a store object in s.
+func (s *Store) ListObject(ctx context.Context, path nix.StorePath) (*nar.Listing, error) {
+	ls, err := dumpAndList(io.Discard, s.RealPath(string(path)))
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %v", path, err)
+	}
+	return ls, nil
+}
+
+// dumpAndList writes the NAR serialization of the file at path to w
+// and returns the listing of its files.
+func dumpAndList(w io.Writer, path string) (*nar.Listing, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var ls *nar.Listing
+	var listErr error
+	go func() {
+		defer close(done)
+		ls, listErr = nar.List(pr)
+		if listErr != nil {
+			// Unblock the writer.
+			pr.CloseWithError(listErr)
+			return
+		}
+		io.Copy(io.Discard, pr)
+	}()
+	err := nar.DumpPath(io.MultiWriter(w, pw), path)
+	pw.CloseWithError(err)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	if listErr != nil {
+		return nil, listErr
+	}
+	return ls, nil
+}
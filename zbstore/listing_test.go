@@ -0,0 +1,141 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestEncodeListing(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "hello"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/hello", filepath.Join(dir, "hello")); err != nil {
+		t.Fatal(err)
+	}
+	narData := new(bytes.Buffer)
+	if err := nar.DumpPath(narData, dir); err != nil {
+		t.Fatal(err)
+	}
+	want, err := nar.List(bytes.NewReader(narData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := encodeListing(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(data, []byte("{")) {
+		t.Error("encodeListing(...) is not compressed")
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"Brotli", data},
+		{"JSON", wantJSON},
+	} {
+		got, err := decodeListing(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("decodeListing(%s): %v", test.name, err)
+			continue
+		}
+		gotJSON, err := json.Marshal(got)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if diff := cmp.Diff(string(wantJSON), string(gotJSON)); diff != "" {
+			t.Errorf("decodeListing(%s) (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestSubstituterListing(t *testing.T) {
+	ctx := context.Background()
+	ls := &nar.Listing{Root: nar.ListingNode{Header: nar.Header{Mode: 0o555, Size: 3}}}
+	data, err := encodeListing(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+testSubstituterPath.Digest()+nar.ListingExtension, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", nar.ListingMIMEType)
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(data)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	sub := &Substituter{URL: srv.URL, Client: srv.Client()}
+
+	got, err := sub.Listing(ctx, testSubstituterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Root.Mode.Type() != 0 || got.Root.Mode&0o111 == 0 || got.Root.Size != 3 {
+		t.Errorf("sub.Listing(ctx, %s).Root = mode %v, size %d; want executable file with size 3",
+			testSubstituterPath, got.Root.Mode, got.Root.Size)
+	}
+
+	missing, err := nix.StoreDirectory("/nix/store").Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Listing(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("sub.Listing(ctx, %s) = _, %v; want %v", missing, err, ErrNotFound)
+	}
+}
+
+func TestStoreListObject(t *testing.T) {
+	storeDir, err := nix.CleanStoreDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := storeDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(string(path), "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(string(path), "bin", "hello"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := (&Store{Dir: storeDir}).ListObject(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := NewNARFS(nil, ls)
+	if info, err := fsys.Stat("bin/hello"); err != nil {
+		t.Error(err)
+	} else if info.Mode().Type() != 0 || info.Size() != int64(len("#!/bin/sh\n")) {
+		t.Errorf("bin/hello = mode %v, size %d; want regular file with size %d", info.Mode(), info.Size(), len("#!/bin/sh\n"))
+	}
+	if _, err := fsys.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(\"missing\") = _, %v; want %v", err, fs.ErrNotExist)
+	}
+}
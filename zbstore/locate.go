@@ -0,0 +1,163 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	slashpath "path"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// IndexedObject is a store object whose files are recorded
+// by [DB.ReplaceFileIndex].
+type IndexedObject struct {
+	StorePath nix.StorePath
+	// AttrPath is the attribute path of the package that produced the object.
+	AttrPath string
+	// Listing is the listing of the object's files,
+	// as returned by [Store.ListObject] or [Substituter.Listing].
+	Listing *nar.Listing
+}
+
+// IndexedFile is a file found by [DB.LocateFile].
+type IndexedFile struct {
+	// StorePath is the store object that contains the file.
+	StorePath nix.StorePath `json:"storePath"`
+	// AttrPath is the attribute path of the package that produced the object.
+	AttrPath string `json:"attrPath,omitempty"`
+	// Path is the slash-separated path of the file relative to the store object.
+	Path string `json:"path"`
+	// Mode is the file's type and, for a regular file, whether it is executable.
+	Mode fs.FileMode `json:"mode"`
+	// Size is the size of a regular file in bytes.
+	Size int64 `json:"size,omitempty"`
+	// LinkTarget is the target of a symlink.
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// ReplaceFileIndex replaces the index of files
+// with the files in the given store objects,
+// which must have distinct store paths.
+// Only the files inside a store object are indexed:
+// an object that is itself a regular file or a symlink contributes no files.
+func (db *DB) ReplaceFileIndex(ctx context.Context, objects []*IndexedObject) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	if err := sqlitex.Execute(db.conn, `delete from "file_index";`, nil); err != nil {
+		return fmt.Errorf("index files: %v", err)
+	}
+	for _, obj := range objects {
+		if err := db.insertIndexedFiles(obj, "", &obj.Listing.Root); err != nil {
+			return fmt.Errorf("index files: %s: %v", obj.StorePath, err)
+		}
+	}
+	return nil
+}
+
+// insertIndexedFiles inserts the entries of the directory node at dir into the file index.
+func (db *DB) insertIndexedFiles(obj *IndexedObject, dir string, node *nar.ListingNode) error {
+	names := make([]string, 0, len(node.Entries))
+	for name := range node.Entries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		child := node.Entries[name]
+		path := slashpath.Join(dir, name)
+		var typ string
+		switch {
+		case child.Mode.IsDir():
+			typ = "directory"
+		case child.Mode.Type() == fs.ModeSymlink:
+			typ = "symlink"
+		case child.Mode&0o111 != 0:
+			typ = "executable"
+		default:
+			typ = "regular"
+		}
+		err := sqlitex.Execute(db.conn, `insert into "file_index" `+
+			`("store_path", "path", "name", "attr_path", "type", "size", "link_target") `+
+			`values (?, ?, ?, ?, ?, ?, ?);`, &sqlitex.ExecOptions{
+			Args: []any{
+				string(obj.StorePath),
+				path,
+				name,
+				obj.AttrPath,
+				typ,
+				child.Size,
+				child.LinkTarget,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if child.Mode.IsDir() {
+			if err := db.insertIndexedFiles(obj, path, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LocateFile returns the indexed files whose path ends with the given slash-separated path,
+// matching whole path elements.
+// For example, "bin/protoc" matches "bin/protoc" and "opt/bin/protoc", but not "bin/xprotoc".
+// If the path starts with a slash,
+// it must match the file's whole path inside its store object.
+// Results are sorted by attribute path, then store path, then file path.
+func (db *DB) LocateFile(ctx context.Context, path string) ([]*IndexedFile, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	whole := strings.HasPrefix(path, "/")
+	query := strings.TrimPrefix(slashpath.Clean("/"+path), "/")
+	if query == "" {
+		return nil, fmt.Errorf("locate %q: empty path", path)
+	}
+
+	var files []*IndexedFile
+	err := sqlitex.Execute(db.conn, `select "store_path", "attr_path", "path", "type", "size", "link_target" `+
+		`from "file_index" where "name" = ? order by "attr_path", "store_path", "path";`, &sqlitex.ExecOptions{
+		Args: []any{slashpath.Base(query)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			filePath := stmt.ColumnText(2)
+			if filePath != query && (whole || !strings.HasSuffix(filePath, "/"+query)) {
+				return nil
+			}
+			f := &IndexedFile{
+				StorePath:  nix.StorePath(stmt.ColumnText(0)),
+				AttrPath:   stmt.ColumnText(1),
+				Path:       filePath,
+				Size:       stmt.ColumnInt64(4),
+				LinkTarget: stmt.ColumnText(5),
+			}
+			switch typ := stmt.ColumnText(3); typ {
+			case "directory":
+				f.Mode = fs.ModeDir | 0o555
+			case "symlink":
+				f.Mode = fs.ModeSymlink | 0o777
+			case "executable":
+				f.Mode = 0o555
+			case "regular":
+				f.Mode = 0o444
+			default:
+				return fmt.Errorf("%s: unknown file type %q", filePath, typ)
+			}
+			files = append(files, f)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("locate %s: %v", path, err)
+	}
+	return files, nil
+}
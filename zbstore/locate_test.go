@@ -0,0 +1,117 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestLocateFile(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const protobufPath = "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-protobuf-25.3"
+	const grpcPath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-grpc-1.62.1"
+	protobuf := &nar.Listing{Root: nar.ListingNode{
+		Header: nar.Header{Mode: fs.ModeDir | 0o555},
+		Entries: map[string]*nar.ListingNode{
+			"bin": {
+				Header: nar.Header{Path: "bin", Mode: fs.ModeDir | 0o555},
+				Entries: map[string]*nar.ListingNode{
+					"protoc":  {Header: nar.Header{Path: "bin/protoc", Mode: 0o555, Size: 1234}},
+					"xprotoc": {Header: nar.Header{Path: "bin/xprotoc", Mode: 0o555, Size: 5}},
+				},
+			},
+		},
+	}}
+	grpc := &nar.Listing{Root: nar.ListingNode{
+		Header: nar.Header{Mode: fs.ModeDir | 0o555},
+		Entries: map[string]*nar.ListingNode{
+			"libexec": {
+				Header: nar.Header{Path: "libexec", Mode: fs.ModeDir | 0o555},
+				Entries: map[string]*nar.ListingNode{
+					"bin": {
+						Header: nar.Header{Path: "libexec/bin", Mode: fs.ModeDir | 0o555},
+						Entries: map[string]*nar.ListingNode{
+							"protoc": {Header: nar.Header{Path: "libexec/bin/protoc", Mode: fs.ModeSymlink | 0o777, LinkTarget: protobufPath + "/bin/protoc"}},
+						},
+					},
+				},
+			},
+			"README": {Header: nar.Header{Path: "README", Mode: 0o444, Size: 42}},
+		},
+	}}
+	// Indexing twice replaces the first index.
+	if err := db.ReplaceFileIndex(ctx, []*IndexedObject{{StorePath: grpcPath, Listing: protobuf}}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.ReplaceFileIndex(ctx, []*IndexedObject{
+		{StorePath: protobufPath, AttrPath: "protobuf", Listing: protobuf},
+		{StorePath: grpcPath, AttrPath: "grpc", Listing: grpc},
+		{StorePath: "/nix/store/ffffffffffffffffffffffffffffffff-script", AttrPath: "script", Listing: &nar.Listing{
+			Root: nar.ListingNode{Header: nar.Header{Mode: 0o555, Size: 10}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grpcProtoc := &IndexedFile{
+		StorePath:  grpcPath,
+		AttrPath:   "grpc",
+		Path:       "libexec/bin/protoc",
+		Mode:       fs.ModeSymlink | 0o777,
+		LinkTarget: protobufPath + "/bin/protoc",
+	}
+	protobufProtoc := &IndexedFile{
+		StorePath: protobufPath,
+		AttrPath:  "protobuf",
+		Path:      "bin/protoc",
+		Mode:      0o555,
+		Size:      1234,
+	}
+	tests := []struct {
+		query string
+		want  []*IndexedFile
+	}{
+		{"protoc", []*IndexedFile{grpcProtoc, protobufProtoc}},
+		{"bin/protoc", []*IndexedFile{grpcProtoc, protobufProtoc}},
+		{"/bin/protoc", []*IndexedFile{protobufProtoc}},
+		{"./bin//protoc", []*IndexedFile{grpcProtoc, protobufProtoc}},
+		{"in/protoc", nil},
+		{"README", []*IndexedFile{{
+			StorePath: grpcPath,
+			AttrPath:  "grpc",
+			Path:      "README",
+			Mode:      0o444,
+			Size:      42,
+		}}},
+		{"libexec/bin", []*IndexedFile{{
+			StorePath: grpcPath,
+			AttrPath:  "grpc",
+			Path:      "libexec/bin",
+			Mode:      fs.ModeDir | 0o555,
+		}}},
+		{"script", nil},
+	}
+	for _, test := range tests {
+		got, err := db.LocateFile(ctx, test.query)
+		if err != nil {
+			t.Errorf("LocateFile(ctx, %q): %v", test.query, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("LocateFile(ctx, %q) (-want +got):\n%s", test.query, diff)
+		}
+	}
+
+	if _, err := db.LocateFile(ctx, "/"); err == nil {
+		t.Error("LocateFile(ctx, \"/\") did not return an error")
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package zbstore
+
+import "os"
+
+// lockHolder returns 0:
+// the system does not report which process holds a lock.
+func lockHolder(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// PackageMeta is descriptive metadata about a derivation.
+type PackageMeta struct {
+	// AttrPath is the attribute path that evaluates to the derivation
+	// in an indexed package set (see [DB.ReplacePackageIndex]).
+	// It is empty for metadata recorded when the derivation was built.
+	AttrPath string `json:"attrPath,omitempty"`
+	// DrvPath is the path of the store derivation.
+	DrvPath nix.StorePath `json:"drvPath"`
+	// Name is the name of the package.
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// Description is a short, human-readable summary of the package.
+	Description string `json:"description,omitempty"`
+	// License is an SPDX license expression.
+	License     string   `json:"license,omitempty"`
+	Homepage    string   `json:"homepage,omitempty"`
+	Maintainers []string `json:"maintainers,omitempty"`
+}
+
+// RecordMeta saves metadata about a derivation,
+// replacing any metadata previously recorded for it.
+func (db *DB) RecordMeta(ctx context.Context, meta *PackageMeta) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	maintainersJSON, err := marshalMaintainers(meta.Maintainers)
+	if err != nil {
+		return fmt.Errorf("record metadata for %s: %v", meta.DrvPath, err)
+	}
+	err = sqlitex.Execute(db.conn, `insert into "derivation_meta" `+
+		`("drv_path", "name", "version", "description", "license", "homepage", "maintainers", "time") `+
+		`values (?, ?, ?, ?, ?, ?, ?, ?) `+
+		`on conflict ("drv_path") do update set `+
+		`"name" = excluded."name", "version" = excluded."version", "description" = excluded."description", `+
+		`"license" = excluded."license", "homepage" = excluded."homepage", "maintainers" = excluded."maintainers", `+
+		`"time" = excluded."time";`, &sqlitex.ExecOptions{
+		Args: []any{
+			string(meta.DrvPath),
+			meta.Name,
+			meta.Version,
+			meta.Description,
+			meta.License,
+			meta.Homepage,
+			maintainersJSON,
+			time.Now().Unix(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("record metadata for %s: %v", meta.DrvPath, err)
+	}
+	return nil
+}
+
+// Meta returns the metadata recorded for the given derivation.
+// If none has been recorded, Meta returns an error that wraps [ErrNotFound].
+func (db *DB) Meta(ctx context.Context, drvPath nix.StorePath) (*PackageMeta, error) {
+	metas, err := db.queryMeta(ctx, `where "drv_path" = ?`, string(drvPath))
+	if err != nil {
+		return nil, fmt.Errorf("read metadata for %s: %v", drvPath, err)
+	}
+	if len(metas) == 0 {
+		return nil, fmt.Errorf("read metadata for %s: %w", drvPath, ErrNotFound)
+	}
+	return metas[0], nil
+}
+
+// ReplacePackageIndex replaces the index of evaluated packages
+// with the given metadata, which must have distinct attribute paths.
+func (db *DB) ReplacePackageIndex(ctx context.Context, metas []*PackageMeta) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	if err := sqlitex.Execute(db.conn, `delete from "package_index";`, nil); err != nil {
+		return fmt.Errorf("index packages: %v", err)
+	}
+	for _, meta := range metas {
+		maintainersJSON, err := marshalMaintainers(meta.Maintainers)
+		if err != nil {
+			return fmt.Errorf("index packages: %s: %v", meta.AttrPath, err)
+		}
+		err = sqlitex.Execute(db.conn, `insert into "package_index" `+
+			`("attr_path", "drv_path", "name", "version", "description", "license", "homepage", "maintainers") `+
+			`values (?, ?, ?, ?, ?, ?, ?, ?);`, &sqlitex.ExecOptions{
+			Args: []any{
+				meta.AttrPath,
+				string(meta.DrvPath),
+				meta.Name,
+				meta.Version,
+				meta.Description,
+				meta.License,
+				meta.Homepage,
+				maintainersJSON,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("index packages: %s: %v", meta.AttrPath, err)
+		}
+	}
+	return nil
+}
+
+// SearchMeta returns the indexed packages and the recorded metadata of built derivations
+// whose attribute path, name, or description matches the given regular expression.
+// A nil regular expression matches everything.
+// Indexed packages are listed first, sorted by attribute path,
+// followed by built derivations sorted by name, then version.
+func (db *DB) SearchMeta(ctx context.Context, re *regexp.Regexp) ([]*PackageMeta, error) {
+	indexed, err := db.queryMetaTable(ctx, "package_index", `order by "attr_path"`)
+	if err != nil {
+		return nil, fmt.Errorf("search metadata: %v", err)
+	}
+	built, err := db.queryMeta(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("search metadata: %v", err)
+	}
+	var metas []*PackageMeta
+	for _, meta := range append(indexed, built...) {
+		if re == nil || re.MatchString(meta.AttrPath) || re.MatchString(meta.Name) || re.MatchString(meta.Description) {
+			metas = append(metas, meta)
+		}
+	}
+	return metas, nil
+}
+
+func (db *DB) queryMeta(ctx context.Context, where string, args ...any) ([]*PackageMeta, error) {
+	return db.queryMetaTable(ctx, "derivation_meta", where+` order by "name", "version", "drv_path"`, args...)
+}
+
+// queryMetaTable reads rows from derivation_meta or package_index.
+func (db *DB) queryMetaTable(ctx context.Context, table string, suffix string, args ...any) ([]*PackageMeta, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	attrPathColumn := `''`
+	if table == "package_index" {
+		attrPathColumn = `"attr_path"`
+	}
+	var metas []*PackageMeta
+	err := sqlitex.Execute(db.conn, `select "drv_path", "name", "version", "description", "license", "homepage", "maintainers", `+attrPathColumn+` `+
+		`from "`+table+`" `+suffix+`;`, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			meta := &PackageMeta{
+				DrvPath:     nix.StorePath(stmt.ColumnText(0)),
+				Name:        stmt.ColumnText(1),
+				Version:     stmt.ColumnText(2),
+				Description: stmt.ColumnText(3),
+				License:     stmt.ColumnText(4),
+				Homepage:    stmt.ColumnText(5),
+				AttrPath:    stmt.ColumnText(7),
+			}
+			if err := json.Unmarshal([]byte(stmt.ColumnText(6)), &meta.Maintainers); err != nil {
+				return fmt.Errorf("%s maintainers: %v", meta.DrvPath, err)
+			}
+			if len(meta.Maintainers) == 0 {
+				meta.Maintainers = nil
+			}
+			metas = append(metas, meta)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+func marshalMaintainers(maintainers []string) (string, error) {
+	if maintainers == nil {
+		maintainers = []string{}
+	}
+	data, err := json.Marshal(maintainers)
+	return string(data), err
+}
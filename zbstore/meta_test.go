@@ -0,0 +1,141 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMeta(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	hello := &PackageMeta{
+		DrvPath:     "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello-2.12.1.drv",
+		Name:        "hello",
+		Version:     "2.12.1",
+		Description: "Program that produces a familiar, friendly greeting",
+		License:     "GPL-3.0-or-later",
+		Homepage:    "https://www.gnu.org/software/hello/",
+		Maintainers: []string{"Ross Light"},
+	}
+	glibc := &PackageMeta{
+		DrvPath:     "/nix/store/7x4hfv2f0p3jv6b27xmqs4ajqhl8fn1k-glibc-2.38-44.drv",
+		Name:        "glibc",
+		Version:     "2.38-44",
+		Description: "GNU C Library",
+		License:     "LGPL-2.1-or-later",
+	}
+	for _, meta := range []*PackageMeta{hello, glibc} {
+		if err := db.RecordMeta(ctx, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.Meta(ctx, hello.DrvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(hello, got); diff != "" {
+		t.Errorf("Meta(ctx, %s) (-want +got):\n%s", hello.DrvPath, diff)
+	}
+	if _, err := db.Meta(ctx, "/nix/store/00000000000000000000000000000000-missing.drv"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Meta(ctx, <missing>) error = %v; want %v", err, ErrNotFound)
+	}
+
+	tests := []struct {
+		query string
+		want  []*PackageMeta
+	}{
+		{"", []*PackageMeta{glibc, hello}},
+		{"(?i)HELLO", []*PackageMeta{hello}},
+		{"C Library$", []*PackageMeta{glibc}},
+		{"^g.ibc$", []*PackageMeta{glibc}},
+		{"^ibc", nil},
+	}
+	for _, test := range tests {
+		got, err := db.SearchMeta(ctx, regexp.MustCompile(test.query))
+		if err != nil {
+			t.Errorf("SearchMeta(ctx, %q): %v", test.query, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("SearchMeta(ctx, %q) (-want +got):\n%s", test.query, diff)
+		}
+	}
+
+	// Recording again replaces the metadata.
+	hello2 := *hello
+	hello2.Description = "Friendly greeter"
+	hello2.Maintainers = nil
+	if err := db.RecordMeta(ctx, &hello2); err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.Meta(ctx, hello.DrvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&hello2, got); diff != "" {
+		t.Errorf("Meta(ctx, %s) after update (-want +got):\n%s", hello.DrvPath, diff)
+	}
+}
+
+func TestPackageIndex(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	built := &PackageMeta{
+		DrvPath: "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello-2.12.1.drv",
+		Name:    "hello",
+		Version: "2.12.1",
+	}
+	if err := db.RecordMeta(ctx, built); err != nil {
+		t.Fatal(err)
+	}
+	old := &PackageMeta{
+		AttrPath: "old",
+		DrvPath:  "/nix/store/00000000000000000000000000000000-old.drv",
+		Name:     "old",
+	}
+	if err := db.ReplacePackageIndex(ctx, []*PackageMeta{old}); err != nil {
+		t.Fatal(err)
+	}
+	hello := &PackageMeta{
+		AttrPath:    "gnu.hello",
+		DrvPath:     "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello-2.12.1.drv",
+		Name:        "hello",
+		Version:     "2.12.1",
+		Description: "Friendly greeter",
+		Maintainers: []string{"Ross Light"},
+	}
+	glibc := &PackageMeta{
+		AttrPath: "gnu.glibc",
+		DrvPath:  "/nix/store/7x4hfv2f0p3jv6b27xmqs4ajqhl8fn1k-glibc-2.38-44.drv",
+		Name:     "glibc",
+	}
+	if err := db.ReplacePackageIndex(ctx, []*PackageMeta{hello, glibc}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.SearchMeta(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*PackageMeta{glibc, hello, built}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SearchMeta(ctx, nil) (-want +got):\n%s", diff)
+	}
+	got, err = db.SearchMeta(ctx, regexp.MustCompile(`^gnu\.h`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*PackageMeta{hello}, got); diff != "" {
+		t.Errorf("SearchMeta(ctx, `^gnu\\.h`) (-want +got):\n%s", diff)
+	}
+}
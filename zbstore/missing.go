@@ -0,0 +1,114 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/nix"
+)
+
+// MissingPaths is the result of [Store.QueryMissing].
+type MissingPaths struct {
+	// WillBuild is the set of derivations that must be built.
+	WillBuild []nix.StorePath
+	// WillSubstitute is the set of store objects
+	// that will be downloaded from substituters.
+	WillSubstitute []nix.StorePath
+	// Unknown is the set of store objects that can be neither built nor substituted.
+	Unknown []nix.StorePath
+
+	// DownloadSize is the approximate number of bytes
+	// that will be downloaded for WillSubstitute
+	// or -1 if unknown.
+	DownloadSize int64
+	// NARSize is the approximate number of bytes
+	// that WillSubstitute will occupy once unpacked
+	// or -1 if unknown.
+	NARSize int64
+}
+
+// QueryMissing reports the work needed to realise the given derivations
+// without building or downloading anything.
+func (s *Store) QueryMissing(ctx context.Context, drvPaths ...nix.StorePath) (*MissingPaths, error) {
+	if len(drvPaths) == 0 {
+		return &MissingPaths{DownloadSize: -1, NARSize: -1}, nil
+	}
+	args := make([]string, 0, len(drvPaths)+3)
+	args = append(args, "--realise", "--dry-run", "--")
+	for _, p := range drvPaths {
+		args = append(args, string(p))
+	}
+	c := s.command(ctx, args...)
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		s.stderr().Write(stderr.Bytes())
+		return nil, fmt.Errorf("nix-store --realise --dry-run: %v", err)
+	}
+	missing, err := parseDryRun(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --realise --dry-run: %v", err)
+	}
+	return missing, nil
+}
+
+var dryRunSizesPattern = regexp.MustCompile(`\(([0-9.]+) MiB download, ([0-9.]+) MiB unpacked\)`)
+
+// parseDryRun parses the report printed by nix-store --realise --dry-run.
+func parseDryRun(report []byte) (*MissingPaths, error) {
+	missing := &MissingPaths{
+		DownloadSize: -1,
+		NARSize:      -1,
+	}
+	var dst *[]nix.StorePath
+	s := bufio.NewScanner(bytes.NewReader(report))
+	for s.Scan() {
+		line := s.Text()
+		if item, isItem := strings.CutPrefix(line, "  "); isItem {
+			if dst == nil {
+				continue
+			}
+			p, err := nix.ParseStorePath(strings.TrimSpace(item))
+			if err != nil {
+				return missing, err
+			}
+			*dst = append(*dst, p)
+			continue
+		}
+
+		switch {
+		case strings.Contains(line, "will be built"):
+			dst = &missing.WillBuild
+		case strings.Contains(line, "will be fetched"):
+			dst = &missing.WillSubstitute
+			if m := dryRunSizesPattern.FindStringSubmatch(line); m != nil {
+				missing.DownloadSize = parseMiB(m[1])
+				missing.NARSize = parseMiB(m[2])
+			}
+		case strings.HasPrefix(line, "don't know how to build"):
+			dst = &missing.Unknown
+		default:
+			dst = nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return missing, err
+	}
+	return missing, nil
+}
+
+func parseMiB(s string) int64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return -1
+	}
+	return int64(f * (1 << 20))
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestParseDryRun(t *testing.T) {
+	const report = "these 2 derivations will be built:\n" +
+		"  /nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv\n" +
+		"  /nix/store/0006yk8jxi0nmbz09fq86zl037c1wx9b-automake-1.16.5.tar.xz.drv\n" +
+		"these 1 paths will be fetched (0.50 MiB download, 2.00 MiB unpacked):\n" +
+		"  /nix/store/1b9p07z77phvv2hf6gm9f28syp39f1ag-bash-5.1-p16\n"
+	got, err := parseDryRun([]byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &MissingPaths{
+		WillBuild: []nix.StorePath{
+			"/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv",
+			"/nix/store/0006yk8jxi0nmbz09fq86zl037c1wx9b-automake-1.16.5.tar.xz.drv",
+		},
+		WillSubstitute: []nix.StorePath{
+			"/nix/store/1b9p07z77phvv2hf6gm9f28syp39f1ag-bash-5.1-p16",
+		},
+		DownloadSize: 512 << 10,
+		NARSize:      2 << 20,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseDryRun(...) (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	slashpath "path"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// A NARFS is a read-only [fs.FS] of the files in a store object's NAR serialization.
+// The file named "." is the store object itself,
+// which may be a regular file or a symlink rather than a directory.
+// Open, Stat, and ReadDir follow symlinks
+// whose targets are relative paths inside the store object.
+// Symlinks to absolute paths cannot be followed,
+// but can be read with [NARFS.ReadLink].
+type NARFS struct {
+	r  io.ReaderAt
+	ls *nar.Listing
+	// close is called by Close if not nil.
+	close func() error
+}
+
+// NewNARFS returns a file system of the NAR in r, as indexed by ls.
+// The listing should not be modified while the file system is in use.
+func NewNARFS(r io.ReaderAt, ls *nar.Listing) *NARFS {
+	return &NARFS{r: r, ls: ls}
+}
+
+// ReadNARFS indexes the size-byte NAR in r
+// and returns a file system of its files.
+func ReadNARFS(r io.ReaderAt, size int64) (*NARFS, error) {
+	ls, err := nar.List(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return NewNARFS(r, ls), nil
+}
+
+// OpenNARFS downloads the NAR of the store object described by info
+// (as returned by [Substituter.NARInfo])
+// to a temporary file
+// and returns a file system of its files.
+// The caller is responsible for calling [NARFS.Close]
+// to delete the temporary file.
+func (sub *Substituter) OpenNARFS(ctx context.Context, info *nix.NARInfo) (_ *NARFS, err error) {
+	body, err := sub.DownloadNAR(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	f, err := os.CreateTemp("", "zb-nar-*")
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := io.Copy(f, body); err != nil {
+		return nil, fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	fsys, err := ReadNARFS(f, info.NARSize)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %v", info.StorePath, err)
+	}
+	fsys.close = func() error {
+		err := f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return fsys, nil
+}
+
+// Listing returns the index of the file system's NAR.
+// It should not be modified.
+func (fsys *NARFS) Listing() *nar.Listing {
+	return fsys.ls
+}
+
+// Close releases any resources associated with the file system.
+// Files opened from the file system must not be used after Close.
+func (fsys *NARFS) Close() error {
+	if fsys.close == nil {
+		return nil
+	}
+	return fsys.close()
+}
+
+// Open opens the named file.
+func (fsys *NARFS) Open(name string) (fs.File, error) {
+	node, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	switch node.Mode.Type() {
+	case fs.ModeDir:
+		return &narFSDir{node: node, entries: narDirEntries(node)}, nil
+	case fs.ModeSymlink:
+		// Only possible for a store object that is itself a symlink.
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("cannot follow symlink to %s", node.LinkTarget)}
+	}
+	return &narFSFile{
+		node: node,
+		r:    io.NewSectionReader(fsys.r, node.ContentOffset, node.Size),
+	}, nil
+}
+
+// Stat returns a [fs.FileInfo] describing the named file,
+// following symlinks.
+func (fsys *NARFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return node.FileInfo(), nil
+}
+
+// Lstat returns a [fs.FileInfo] describing the named file.
+// If the file is a symlink,
+// the returned FileInfo describes the symlink
+// and Lstat makes no attempt to follow it.
+func (fsys *NARFS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return node.FileInfo(), nil
+}
+
+// ReadDir reads the named directory
+// and returns a list of directory entries sorted by filename.
+func (fsys *NARFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if !node.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return narDirEntries(node), nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (fsys *NARFS) ReadLink(name string) (string, error) {
+	node, err := fsys.lookup(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	if node.Mode.Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.LinkTarget, nil
+}
+
+// maxSymlinks is the maximum number of symlinks
+// that [NARFS] follows while looking up a single name.
+const maxSymlinks = 40
+
+var errNotDir = errors.New("not a directory")
+
+// lookup returns the listing node for the named file.
+// Symlinks in the name's directories are always followed.
+// If follow is true, a symlink at the end of the name is followed too.
+func (fsys *NARFS) lookup(name string, follow bool) (*nar.ListingNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	// stack is the chain of directories from the root to the current file.
+	stack := []*nar.ListingNode{&fsys.ls.Root}
+	todo := strings.Split(name, "/")
+	links := 0
+	for len(todo) > 0 {
+		elem := todo[0]
+		todo = todo[1:]
+		curr := stack[len(stack)-1]
+		switch elem {
+		case ".", "":
+			continue
+		case "..":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("symlink leaves store object")
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if !curr.Mode.IsDir() {
+			return nil, errNotDir
+		}
+		next := curr.Entries[elem]
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		if next.Mode.Type() == fs.ModeSymlink && (len(todo) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, fmt.Errorf("too many levels of symbolic links")
+			}
+			if slashpath.IsAbs(next.LinkTarget) {
+				return nil, fmt.Errorf("cannot follow symlink to %s", next.LinkTarget)
+			}
+			todo = append(strings.Split(next.LinkTarget, "/"), todo...)
+			continue
+		}
+		stack = append(stack, next)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// narDirEntries returns the entries of a directory node sorted by name.
+func narDirEntries(node *nar.ListingNode) []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(node.Entries))
+	for _, child := range node.Entries {
+		entries = append(entries, fs.FileInfoToDirEntry(child.FileInfo()))
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries
+}
+
+// narFSFile is a regular file opened from a [NARFS].
+type narFSFile struct {
+	node *nar.ListingNode
+	r    *io.SectionReader
+}
+
+func (f *narFSFile) Stat() (fs.FileInfo, error) {
+	return f.node.FileInfo(), nil
+}
+
+func (f *narFSFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *narFSFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.r.ReadAt(p, off)
+}
+
+func (f *narFSFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *narFSFile) Close() error {
+	return nil
+}
+
+// narFSDir is a directory opened from a [NARFS].
+type narFSDir struct {
+	node    *nar.ListingNode
+	entries []fs.DirEntry
+}
+
+func (d *narFSDir) Stat() (fs.FileInfo, error) {
+	return d.node.FileInfo(), nil
+}
+
+func (d *narFSDir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *narFSDir) Close() error {
+	return nil
+}
+
+func (d *narFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
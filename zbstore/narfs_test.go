@@ -0,0 +1,149 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestNARFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "share", "doc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "share", "doc", "README"), []byte("Hello, World!\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "hello"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../share/doc", filepath.Join(dir, "bin", "doc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/zb/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib", filepath.Join(dir, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../..", filepath.Join(dir, "up")); err != nil {
+		t.Fatal(err)
+	}
+	narData := new(bytes.Buffer)
+	if err := nar.DumpPath(narData, dir); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := ReadNARFS(bytes.NewReader(narData.Bytes()), int64(narData.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+
+	if got, err := fs.ReadFile(fsys, "share/doc/README"); err != nil {
+		t.Error(err)
+	} else if want := "Hello, World!\n"; string(got) != want {
+		t.Errorf("share/doc/README = %q; want %q", got, want)
+	}
+	if got, err := fs.ReadFile(fsys, "bin/doc/README"); err != nil {
+		t.Error(err)
+	} else if want := "Hello, World!\n"; string(got) != want {
+		t.Errorf("bin/doc/README = %q; want %q", got, want)
+	}
+
+	var names []string
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range entries {
+		names = append(names, ent.Name())
+	}
+	if diff := cmp.Diff([]string{"bin", "lib", "share", "up"}, names); diff != "" {
+		t.Errorf("ReadDir(\".\") names (-want +got):\n%s", diff)
+	}
+
+	if info, err := fsys.Stat("bin/hello"); err != nil {
+		t.Error(err)
+	} else if info.Mode()&0o111 == 0 || info.Size() != int64(len("#!/bin/sh\n")) {
+		t.Errorf("Stat(\"bin/hello\") = mode %v, size %d; want executable with size %d", info.Mode(), info.Size(), len("#!/bin/sh\n"))
+	}
+	if info, err := fsys.Stat("bin/doc"); err != nil {
+		t.Error(err)
+	} else if !info.IsDir() {
+		t.Errorf("Stat(\"bin/doc\").Mode() = %v; want directory", info.Mode())
+	}
+	if info, err := fsys.Lstat("bin/doc"); err != nil {
+		t.Error(err)
+	} else if info.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("Lstat(\"bin/doc\").Mode() = %v; want symlink", info.Mode())
+	}
+	if got, err := fsys.ReadLink("lib"); err != nil {
+		t.Error(err)
+	} else if want := "/zb/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib"; got != want {
+		t.Errorf("ReadLink(\"lib\") = %q; want %q", got, want)
+	}
+
+	for _, name := range []string{"lib", "up", "missing", "bin/hello/x"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("Open(%q) did not return an error", name)
+		}
+	}
+	if _, err := fsys.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(\"missing\") = _, %v; want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestNARFSFile(t *testing.T) {
+	narData := new(bytes.Buffer)
+	nw := nar.NewWriter(narData)
+	if err := nw.WriteHeader(&nar.Header{Mode: 0o444, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	nw.Write([]byte("foo"))
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := ReadNARFS(bytes.NewReader(narData.Bytes()), int64(narData.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(fsys, "."); err != nil {
+		t.Error(err)
+	} else if string(got) != "foo" {
+		t.Errorf("ReadFile(\".\") = %q; want \"foo\"", got)
+	}
+	if _, err := fs.ReadDir(fsys, "."); err == nil {
+		t.Error("ReadDir(\".\") did not return an error")
+	}
+}
+
+func TestSubstituterOpenNARFS(t *testing.T) {
+	ctx := context.Background()
+	sub, _ := newTestSubstituter(t, nil)
+	info, err := sub.NARInfo(ctx, testSubstituterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := sub.OpenNARFS(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(fsys, "hello"); err != nil {
+		t.Error(err)
+	} else if want := "#!/bin/sh\necho Hello\n"; string(got) != want {
+		t.Errorf("hello = %q; want %q", got, want)
+	}
+	if err := fsys.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitemigration"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Default lifetimes of [NARInfoCache] entries.
+// They match Nix's narinfo-cache-positive-ttl and narinfo-cache-negative-ttl defaults.
+const (
+	DefaultNARInfoPositiveTTL = 30 * 24 * time.Hour
+	DefaultNARInfoNegativeTTL = 1 * time.Hour
+)
+
+// narInfoCacheSchema is the schema of a [NARInfoCache] database.
+// Since the database only holds cached data,
+// it is kept apart from [DB].
+var narInfoCacheSchema = sqlitemigration.Schema{
+	Migrations: []string{
+		`create table "narinfos" (` +
+			`"cache_url" text not null, ` +
+			`"hash_part" text not null, ` +
+			// .narinfo file contents, or null if the cache does not have the object.
+			`"narinfo" text, ` +
+			// Time of the lookup, in Unix seconds.
+			`"time" integer not null, ` +
+			`primary key ("cache_url", "hash_part"));`,
+	},
+}
+
+// A NARInfoCache remembers the results of [Substituter.NARInfo] lookups
+// on disk, so that repeated queries do not contact the binary cache again.
+// Both the objects that a cache has (positive results)
+// and the objects it does not have (negative results) are remembered,
+// each for their own time to live.
+// Other errors are not remembered.
+// A NARInfoCache is safe to use from multiple goroutines concurrently.
+type NARInfoCache struct {
+	// PositiveTTL is how long the information about an object that a cache has
+	// is remembered.
+	// If zero, [DefaultNARInfoPositiveTTL] is used.
+	// If negative, positive results are not remembered.
+	PositiveTTL time.Duration
+	// NegativeTTL is how long the absence of an object from a cache
+	// is remembered.
+	// If zero, [DefaultNARInfoNegativeTTL] is used.
+	// If negative, negative results are not remembered.
+	NegativeTTL time.Duration
+
+	mu   sync.Mutex
+	conn *sqlite.Conn
+}
+
+// DefaultNARInfoCachePath returns the path of the [NARInfoCache] used by zb.
+// It is located in the user's cache directory.
+func DefaultNARInfoCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "zb", "narinfo.db")
+}
+
+// OpenNARInfoCache opens the cache database at the given path,
+// creating it if it does not exist.
+func OpenNARInfoCache(ctx context.Context, path string) (*NARInfoCache, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return nil, fmt.Errorf("open narinfo cache: %v", err)
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite, sqlite.OpenCreate, sqlite.OpenWAL)
+	if err != nil {
+		return nil, fmt.Errorf("open narinfo cache: %v", err)
+	}
+	conn.SetBusyTimeout(10 * time.Second)
+	if err := sqlitemigration.Migrate(ctx, conn, narInfoCacheSchema); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("open narinfo cache %s: %v", path, err)
+	}
+	return &NARInfoCache{conn: conn}, nil
+}
+
+// Close closes the cache database.
+func (c *NARInfoCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *NARInfoCache) positiveTTL() time.Duration {
+	if c.PositiveTTL == 0 {
+		return DefaultNARInfoPositiveTTL
+	}
+	return c.PositiveTTL
+}
+
+func (c *NARInfoCache) negativeTTL() time.Duration {
+	if c.NegativeTTL == 0 {
+		return DefaultNARInfoNegativeTTL
+	}
+	return c.NegativeTTL
+}
+
+// lookup returns the remembered result of looking up hashPart in the cache at cacheURL.
+// ok is false if there is no unexpired result.
+// If ok is true and data is nil, the cache did not have the object.
+func (c *NARInfoCache) lookup(ctx context.Context, cacheURL, hashPart string, now time.Time) (data []byte, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.conn.SetInterrupt(c.conn.SetInterrupt(ctx.Done()))
+	err = sqlitex.Execute(c.conn, `select "narinfo", "time" from "narinfos" where "cache_url" = ? and "hash_part" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{cacheURL, hashPart},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found := stmt.ColumnType(0) != sqlite.TypeNull
+			ttl := c.negativeTTL()
+			if found {
+				ttl = c.positiveTTL()
+			}
+			if ttl < 0 || !now.Before(time.Unix(stmt.ColumnInt64(1), 0).Add(ttl)) {
+				return nil
+			}
+			ok = true
+			if found {
+				data = []byte(stmt.ColumnText(0))
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("look up %s in narinfo cache: %v", hashPart, err)
+	}
+	return data, ok, nil
+}
+
+// put remembers the result of looking up hashPart in the cache at cacheURL.
+// A nil data means that the cache did not have the object.
+func (c *NARInfoCache) put(ctx context.Context, cacheURL, hashPart string, data []byte, now time.Time) error {
+	if data == nil && c.negativeTTL() < 0 || data != nil && c.positiveTTL() < 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.conn.SetInterrupt(c.conn.SetInterrupt(ctx.Done()))
+	var narinfo any
+	if data != nil {
+		narinfo = string(data)
+	}
+	err := sqlitex.Execute(c.conn, `insert into "narinfos" ("cache_url", "hash_part", "narinfo", "time") values (?, ?, ?, ?) `+
+		`on conflict ("cache_url", "hash_part") do update set "narinfo" = excluded."narinfo", "time" = excluded."time";`, &sqlitex.ExecOptions{
+		Args: []any{cacheURL, hashPart, narinfo, now.Unix()},
+	})
+	if err != nil {
+		return fmt.Errorf("save %s to narinfo cache: %v", hashPart, err)
+	}
+	return nil
+}
+
+// Forget removes every remembered result for the cache at cacheURL,
+// or for all caches if cacheURL is empty.
+func (c *NARInfoCache) Forget(ctx context.Context, cacheURL string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.conn.SetInterrupt(c.conn.SetInterrupt(ctx.Done()))
+	query := `delete from "narinfos";`
+	var args []any
+	if cacheURL != "" {
+		query = `delete from "narinfos" where "cache_url" = ?;`
+		args = []any{cacheURL}
+	}
+	if err := sqlitex.Execute(c.conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+		return fmt.Errorf("clear narinfo cache: %v", err)
+	}
+	return nil
+}
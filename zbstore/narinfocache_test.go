@@ -0,0 +1,86 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestNARInfoCache(t *testing.T) {
+	ctx := context.Background()
+	cache, err := OpenNARInfoCache(ctx, filepath.Join(t.TempDir(), "narinfo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := cache.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	sub, _ := newTestSubstituter(t, nil)
+	var requests atomic.Int32
+	sub.Client.Transport = countingTransport{sub.Client.Transport, &requests}
+	sub.NARInfoCache = cache
+
+	missing := nix.StorePath("/nix/store/22222222222222222222222222222222-missing")
+	for i := range 2 {
+		info, err := sub.NARInfo(ctx, testSubstituterPath)
+		if err != nil {
+			t.Fatalf("NARInfo(ctx, %q) #%d: %v", testSubstituterPath, i+1, err)
+		}
+		if info.StorePath != testSubstituterPath {
+			t.Errorf("NARInfo(ctx, %q) #%d returned information for %s", testSubstituterPath, i+1, info.StorePath)
+		}
+		if _, err := sub.NARInfo(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("NARInfo(ctx, %q) #%d: error = %v; want %v", missing, i+1, err, ErrNotFound)
+		}
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("made %d requests; want 2", got)
+	}
+
+	// Expired and disabled results are looked up again.
+	if _, ok, err := cache.lookup(ctx, sub.URL, missing.Digest(), time.Now().Add(DefaultNARInfoNegativeTTL)); ok || err != nil {
+		t.Errorf("lookup of negative result after TTL = _, %t, %v; want _, false, <nil>", ok, err)
+	}
+	if _, ok, err := cache.lookup(ctx, sub.URL, testSubstituterPath.Digest(), time.Now().Add(DefaultNARInfoNegativeTTL)); !ok || err != nil {
+		t.Errorf("lookup of positive result after negative TTL = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	cache.NegativeTTL = -1
+	if _, err := sub.NARInfo(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("NARInfo(ctx, %q) with negative caching disabled: error = %v; want %v", missing, err, ErrNotFound)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("made %d requests; want 3", got)
+	}
+
+	if err := cache.Forget(ctx, sub.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.NARInfo(ctx, testSubstituterPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("made %d requests after Forget; want 4", got)
+	}
+}
+
+// countingTransport counts the requests sent through it.
+type countingTransport struct {
+	base http.RoundTripper
+	n    *atomic.Int32
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.n.Add(1)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,483 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// NixSource describes an existing Nix store to import store objects from.
+type NixSource struct {
+	// Dir is the source store's logical store directory,
+	// i.e. the directory that its store paths begin with.
+	// If empty, [nix.DefaultStoreDirectory] is used.
+	Dir nix.StoreDirectory
+	// RealDir is where the source store's objects are located on disk.
+	// It differs from Dir for stores mounted at a different location
+	// (like a chroot store).
+	// If empty, Dir is used.
+	RealDir string
+	// DB is the path to the source store's SQLite database.
+	// If empty, it is located at var/nix/db/db.sqlite
+	// relative to the parent directory of RealDir.
+	DB string
+}
+
+func (src *NixSource) dir() nix.StoreDirectory {
+	if src.Dir == "" {
+		return nix.DefaultStoreDirectory
+	}
+	return src.Dir
+}
+
+func (src *NixSource) realPath(path nix.StorePath) string {
+	if src.RealDir == "" {
+		return string(path)
+	}
+	return filepath.Join(src.RealDir, path.Base())
+}
+
+func (src *NixSource) dbPath() string {
+	if src.DB != "" {
+		return src.DB
+	}
+	realDir := src.RealDir
+	if realDir == "" {
+		realDir = string(src.dir())
+	}
+	return filepath.Join(filepath.Dir(realDir), "var", "nix", "db", "db.sqlite")
+}
+
+// ImportNix copies the closures of the given valid paths in a Nix store
+// (including store derivations) into s.
+// If the source store's directory differs from s's,
+// the store objects are rewritten to refer to s's directory.
+// If the two directories have the same length,
+// the objects' digests are preserved so that references can be rewritten in place,
+// and if s's store directory is writable and on a file system that supports it
+// (like Btrfs, XFS, or APFS),
+// the objects' files are cloned from the source store
+// instead of being copied through the backend.
+// Otherwise, the objects are moved with [Rewrite],
+// which recomputes the paths of content-addressed objects.
+// Store objects that are already valid in s are skipped.
+// Objects are locked while they are written (see [Store.LockPaths]),
+// so concurrent imports of the same objects are safe.
+// ImportNix returns the paths in s of the given paths, in the same order.
+func (s *Store) ImportNix(ctx context.Context, src *NixSource, paths ...nix.StorePath) ([]nix.StorePath, error) {
+	srcDir, dstDir := src.dir(), s.dir()
+	infos, err := readNixClosure(ctx, src.dbPath(), paths)
+	if err != nil {
+		return nil, fmt.Errorf("import from %s: %v", srcDir, err)
+	}
+	var newPaths map[nix.StorePath]nix.StorePath
+	if len(srcDir) == len(dstDir) {
+		newPaths, err = s.importNixInPlace(ctx, src, infos)
+	} else {
+		newPaths, err = s.importNixRewritten(ctx, src, infos)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("import from %s: %v", srcDir, err)
+	}
+	result := make([]nix.StorePath, len(paths))
+	for i, p := range paths {
+		result[i] = newPaths[p]
+	}
+	return result, nil
+}
+
+// importNixInPlace imports store objects from a Nix store
+// whose directory has the same length as s's,
+// keeping the objects' digests.
+// infos must be sorted such that references precede their referrers.
+// It returns a map of the objects' old paths to their new paths.
+func (s *Store) importNixInPlace(ctx context.Context, src *NixSource, infos []*PathInfo) (map[nix.StorePath]nix.StorePath, error) {
+	srcDir, dstDir := src.dir(), s.dir()
+	rewrite := func(p nix.StorePath) nix.StorePath {
+		if p == "" || srcDir == dstDir {
+			return p
+		}
+		return nix.StorePath(dstDir.Join(p.Base()))
+	}
+	newPaths := make(map[nix.StorePath]nix.StorePath, len(infos))
+	var toImport []*PathInfo
+	oldInfos := make(map[nix.StorePath]*PathInfo)
+	for _, info := range infos {
+		newPath := rewrite(info.Path)
+		newPaths[info.Path] = newPath
+		if _, err := s.QueryPathInfo(ctx, newPath); err == nil {
+			log.Debugf(ctx, "%s already valid", newPath)
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		newInfo := &PathInfo{
+			Path:    newPath,
+			NARHash: info.NARHash,
+			Deriver: rewrite(info.Deriver),
+		}
+		for _, ref := range info.References {
+			newInfo.References = append(newInfo.References, rewrite(ref))
+		}
+		toImport = append(toImport, newInfo)
+		oldInfos[newPath] = info
+	}
+	toImport, err := s.cloneNixObjects(ctx, src, toImport, oldInfos)
+	if err != nil {
+		return nil, err
+	}
+	if len(toImport) == 0 {
+		return newPaths, nil
+	}
+	err = s.importObjects(ctx, toImport, func(w io.Writer, newInfo *PathInfo) error {
+		info := oldInfos[newInfo.Path]
+		var narWriter io.Writer = w
+		var rw *rewriteWriter
+		if srcDir != dstDir {
+			rw = newRewriteWriter(w, []byte(srcDir+"/"), []byte(dstDir+"/"))
+			narWriter = rw
+		}
+		h := nix.NewHasher(info.NARHash.Type())
+		if err := nar.DumpPath(io.MultiWriter(narWriter, h), src.realPath(info.Path)); err != nil {
+			return err
+		}
+		if rw != nil {
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+		}
+		if got := h.SumHash(); !got.Equal(info.NARHash) {
+			return fmt.Errorf("NAR hash mismatch (got %v, database has %v)", got, info.NARHash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newPaths, nil
+}
+
+// importNixRewritten imports store objects from a Nix store
+// whose directory has a different length than s's
+// by moving each object with [Rewrite].
+// infos must be sorted such that references precede their referrers.
+// It returns a map of the objects' old paths to their new paths.
+func (s *Store) importNixRewritten(ctx context.Context, src *NixSource, infos []*PathInfo) (map[nix.StorePath]nix.StorePath, error) {
+	tempDir, err := os.MkdirTemp("", "zb-import-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	newPaths := make(map[nix.StorePath]nix.StorePath, len(infos))
+	var toImport []*PathInfo
+	narFiles := make(map[nix.StorePath]string)
+	inputAddressed := 0
+	for i, info := range infos {
+		narFile := filepath.Join(tempDir, strconv.Itoa(i)+".nar")
+		newInfo, err := rewriteNixObject(narFile, src, info, s.dir(), newPaths)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", info.Path, err)
+		}
+		newPaths[info.Path] = newInfo.Path
+		if info.CA.IsZero() {
+			inputAddressed++
+		}
+		if _, err := s.QueryPathInfo(ctx, newInfo.Path); err == nil {
+			log.Debugf(ctx, "%s already valid", newInfo.Path)
+			os.Remove(narFile)
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		toImport = append(toImport, newInfo)
+		narFiles[newInfo.Path] = narFile
+	}
+	if inputAddressed > 0 {
+		log.Warnf(ctx, "%d input-addressed store objects were moved to %s without their derivations; "+
+			"their paths are not the ones building them in %[2]s would produce", inputAddressed, s.dir())
+	}
+	if len(toImport) == 0 {
+		return newPaths, nil
+	}
+	err = s.importObjects(ctx, toImport, func(w io.Writer, newInfo *PathInfo) error {
+		f, err := os.Open(narFiles[newInfo.Path])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newPaths, nil
+}
+
+// rewriteNixObject writes the NAR of a store object in a Nix store
+// moved to dir with [Rewrite] to the file at dstPath.
+func rewriteNixObject(dstPath string, src *NixSource, info *PathInfo, dir nix.StoreDirectory, newPaths map[nix.StorePath]nix.StorePath) (*PathInfo, error) {
+	srcNAR, err := os.CreateTemp(filepath.Dir(dstPath), "src-*.nar")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		srcNAR.Close()
+		os.Remove(srcNAR.Name())
+	}()
+	h := nix.NewHasher(info.NARHash.Type())
+	cw := &countWriter{w: io.MultiWriter(srcNAR, h)}
+	if err := nar.DumpPath(cw, src.realPath(info.Path)); err != nil {
+		return nil, err
+	}
+	if got := h.SumHash(); !got.Equal(info.NARHash) {
+		return nil, fmt.Errorf("NAR hash mismatch (got %v, database has %v)", got, info.NARHash)
+	}
+	srcInfo := *info
+	srcInfo.NARSize = cw.n
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(dst)
+	newInfo, err := Rewrite(bw, srcNAR, &srcInfo, dir, newPaths)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newInfo, nil
+}
+
+// importObjects streams the given store objects to nix-store --import
+// in the Nix export format.
+// infos must be sorted such that references precede their referrers.
+// writeNAR is called to write each object's NAR serialization.
+func (s *Store) importObjects(ctx context.Context, infos []*PathInfo, writeNAR func(w io.Writer, info *PathInfo) error) error {
+	imp, err := s.startImport(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := imp.add(ctx, info, writeNAR); err != nil {
+			imp.abort()
+			return err
+		}
+	}
+	return imp.finish()
+}
+
+// A nixImporter streams store objects to a running nix-store --import
+// in the Nix export format.
+// Objects must be added such that references precede their referrers.
+type nixImporter struct {
+	c     *exec.Cmd
+	stdin io.WriteCloser
+	w     *bufio.Writer
+}
+
+// startImport starts nix-store --import.
+// The caller must call finish or abort on the returned importer.
+func (s *Store) startImport(ctx context.Context) (*nixImporter, error) {
+	c := s.command(ctx, "--import")
+	c.Stdout = s.stderr()
+	c.Stderr = s.stderr()
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --import: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("nix-store --import: %v", err)
+	}
+	return &nixImporter{
+		c:     c,
+		stdin: stdin,
+		w:     bufio.NewWriter(stdin),
+	}, nil
+}
+
+// add writes a store object to the import.
+// writeNAR is called to write the object's NAR serialization.
+func (imp *nixImporter) add(ctx context.Context, info *PathInfo, writeNAR func(w io.Writer, info *PathInfo) error) error {
+	log.Debugf(ctx, "Importing %s", info.Path)
+	imp.w.Write(binary.LittleEndian.AppendUint64(nil, 1))
+	if err := writeNAR(imp.w, info); err != nil {
+		return fmt.Errorf("%s: %v", info.Path, err)
+	}
+	trailer := []byte("NIXE\x00\x00\x00\x00")
+	trailer = appendExportString(trailer, string(info.Path))
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(len(info.References)))
+	for _, ref := range info.References {
+		trailer = appendExportString(trailer, string(ref))
+	}
+	trailer = appendExportString(trailer, string(info.Deriver))
+	trailer = binary.LittleEndian.AppendUint64(trailer, 0)
+	if _, err := imp.w.Write(trailer); err != nil {
+		return fmt.Errorf("nix-store --import: %v", err)
+	}
+	return nil
+}
+
+// finish ends the import and waits for nix-store to register the objects.
+func (imp *nixImporter) finish() (err error) {
+	defer func() {
+		if err != nil {
+			imp.abort()
+		}
+	}()
+	imp.w.Write(binary.LittleEndian.AppendUint64(nil, 0))
+	if err := imp.w.Flush(); err != nil {
+		return fmt.Errorf("nix-store --import: %v", err)
+	}
+	if err := imp.stdin.Close(); err != nil {
+		return fmt.Errorf("nix-store --import: %v", err)
+	}
+	if err := imp.c.Wait(); err != nil {
+		return fmt.Errorf("nix-store --import: %v", err)
+	}
+	return nil
+}
+
+// abort stops the import without registering any of the objects.
+func (imp *nixImporter) abort() {
+	if imp.c.ProcessState != nil {
+		return
+	}
+	imp.c.Process.Kill()
+	imp.stdin.Close()
+	imp.c.Wait()
+}
+
+// readNixClosure reads the metadata of the closure of the given paths
+// from the Nix database at dbPath.
+// The returned list is sorted such that references precede their referrers.
+func readNixClosure(ctx context.Context, dbPath string, paths []nix.StorePath) ([]*PathInfo, error) {
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetBusyTimeout(10 * time.Second)
+	defer conn.SetInterrupt(conn.SetInterrupt(ctx.Done()))
+
+	return ComputeClosure(paths, func(p nix.StorePath) (*PathInfo, error) {
+		return queryNixPathInfo(conn, dbPath, p)
+	})
+}
+
+// ValidPaths returns all the valid paths in the source store.
+func (src *NixSource) ValidPaths(ctx context.Context) ([]nix.StorePath, error) {
+	dbPath := src.dbPath()
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("list valid paths: %v", err)
+	}
+	defer conn.Close()
+	conn.SetBusyTimeout(10 * time.Second)
+	defer conn.SetInterrupt(conn.SetInterrupt(ctx.Done()))
+
+	var paths []nix.StorePath
+	err = sqlitex.Execute(conn, `select "path" from "ValidPaths" order by 1;`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			paths = append(paths, nix.StorePath(stmt.ColumnText(0)))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list valid paths in %s: %v", dbPath, err)
+	}
+	return paths, nil
+}
+
+func appendExportString(dst []byte, s string) []byte {
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(len(s)))
+	dst = append(dst, s...)
+	if off := len(s) % 8; off != 0 {
+		dst = append(dst, make([]byte, 8-off)...)
+	}
+	return dst
+}
+
+// rewriteWriter replaces occurrences of a byte string
+// with another of the same length in the data written to it.
+type rewriteWriter struct {
+	w        io.Writer
+	from, to []byte
+	buf      []byte
+	// off is the offset in the stream of buf[0].
+	off int64
+	// match is called with the offset of each replaced occurrence, if not nil.
+	match func(off int64)
+}
+
+func newRewriteWriter(w io.Writer, from, to []byte) *rewriteWriter {
+	if len(from) != len(to) {
+		panic("rewrite strings must have the same length")
+	}
+	return &rewriteWriter{w: w, from: from, to: to}
+}
+
+func (rw *rewriteWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf, p...)
+	end := rw.replace()
+	// Hold back a potential partial match at the end.
+	n := max(len(rw.buf)-(len(rw.from)-1), end)
+	if n <= 0 {
+		return len(p), nil
+	}
+	if _, err := rw.w.Write(rw.buf[:n]); err != nil {
+		return 0, err
+	}
+	rw.buf = append(rw.buf[:0], rw.buf[n:]...)
+	rw.off += int64(n)
+	return len(p), nil
+}
+
+// Flush writes any held-back bytes.
+func (rw *rewriteWriter) Flush() error {
+	_, err := rw.w.Write(rw.buf)
+	rw.off += int64(len(rw.buf))
+	rw.buf = rw.buf[:0]
+	return err
+}
+
+// replace replaces all occurrences of rw.from with rw.to in rw.buf
+// and returns the end of the last replacement.
+func (rw *rewriteWriter) replace() int {
+	for i := 0; ; {
+		j := bytes.Index(rw.buf[i:], rw.from)
+		if j < 0 {
+			return i
+		}
+		i += j
+		if rw.match != nil {
+			rw.match(rw.off + int64(i))
+		}
+		copy(rw.buf[i:], rw.to)
+		i += len(rw.to)
+	}
+}
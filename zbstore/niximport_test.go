@@ -0,0 +1,149 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestRewriteWriter(t *testing.T) {
+	const oldDir, newDir = "/a/store/", "/b/store/"
+	tests := []string{
+		"",
+		"hello",
+		"/a/store/abc",
+		"x/a/store/abc/a/store/def/a/sto",
+		"/a/st/a/store/",
+		strings.Repeat("/a/store/", 10),
+	}
+	for _, input := range tests {
+		want := strings.ReplaceAll(input, oldDir, newDir)
+		for chunk := 1; chunk <= len(input)+1; chunk++ {
+			buf := new(bytes.Buffer)
+			rw := newRewriteWriter(buf, []byte(oldDir), []byte(newDir))
+			for s := input; len(s) > 0; {
+				n := min(chunk, len(s))
+				if _, err := rw.Write([]byte(s[:n])); err != nil {
+					t.Fatal(err)
+				}
+				s = s[n:]
+			}
+			if err := rw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != want {
+				t.Errorf("rewrite %q in chunks of %d = %q; want %q", input, chunk, got, want)
+			}
+		}
+	}
+}
+
+func TestImportNix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts required")
+	}
+	// The second destination's directory has a different length than the source's,
+	// so the objects are moved with Rewrite instead of rewritten in place.
+	for _, dstName := range []string{"b", "longer"} {
+		t.Run(dstName, func(t *testing.T) {
+			ctx := context.Background()
+			root := t.TempDir()
+			srcDir := nix.StoreDirectory(filepath.Join(root, "a", "store"))
+			dstDir := nix.StoreDirectory(filepath.Join(root, dstName, "store"))
+			if err := os.MkdirAll(string(srcDir), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			// Populate a source store with a library and a program that refers to it.
+			libPath, err := srcDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib")
+			if err != nil {
+				t.Fatal(err)
+			}
+			appPath, err := srcDir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(string(libPath), []byte("library\n"), 0o444); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(string(appPath), []byte("#!"+string(libPath)+"\n"), 0o555); err != nil {
+				t.Fatal(err)
+			}
+			narHash := func(path nix.StorePath) string {
+				h := nix.NewHasher(nix.SHA256)
+				if err := nar.DumpPath(h, string(path)); err != nil {
+					t.Fatal(err)
+				}
+				return h.SumHash().String()
+			}
+			srcDB := filepath.Join(root, "a", "var", "nix", "db", "db.sqlite")
+			writeFakeNixDB(t, srcDB, `
+				insert into ValidPaths (id, path, hash, registrationTime, narSize) values (1, :lib, :libHash, 1700000000, 0);
+				insert into ValidPaths (id, path, hash, registrationTime, narSize) values (2, :app, :appHash, 1700000000, 0);
+				insert into Refs values (2, 1);
+			`, map[string]any{
+				":lib":     string(libPath),
+				":libHash": narHash(libPath),
+				":app":     string(appPath),
+				":appHash": narHash(appPath),
+			})
+			stateDir := filepath.Join(root, dstName, "var", "nix")
+			writeFakeNixDB(t, filepath.Join(stateDir, "db", "db.sqlite"), "", nil)
+			t.Setenv("NIX_STATE_DIR", stateDir)
+
+			// Stand in for nix-store with a script that saves its input.
+			binDir := t.TempDir()
+			exportFile := filepath.Join(t.TempDir(), "export")
+			script := "#!/bin/sh\ncat > '" + exportFile + "'\n"
+			if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+			store := &Store{Dir: dstDir}
+			got, err := store.ImportNix(ctx, &NixSource{Dir: srcDir}, appPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newApp := nix.StorePath(dstDir.Join(appPath.Base()))
+			newLib := nix.StorePath(dstDir.Join(libPath.Base()))
+			if diff := cmp.Diff([]nix.StorePath{newApp}, got); diff != "" {
+				t.Errorf("ImportNix(...) (-want +got):\n%s", diff)
+			}
+
+			export, err := os.ReadFile(exportFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(export, []byte(srcDir)) {
+				t.Errorf("export contains source store directory %s", srcDir)
+			}
+			libIndex := bytes.Index(export, []byte("NIXE\x00\x00\x00\x00"+string(appendExportString(nil, string(newLib)))))
+			appIndex := bytes.Index(export, []byte("NIXE\x00\x00\x00\x00"+string(appendExportString(nil, string(newApp)))))
+			switch {
+			case libIndex < 0:
+				t.Errorf("export does not include %s", newLib)
+			case appIndex < 0:
+				t.Errorf("export does not include %s", newApp)
+			case appIndex < libIndex:
+				t.Errorf("export includes %s before its reference %s", newApp, newLib)
+			}
+			// NAR strings use the same length-prefixed encoding as the export trailer,
+			// so this also checks that the file's size matches its new contents.
+			if !bytes.Contains(export, appendExportString(nil, "#!"+string(newLib)+"\n")) {
+				t.Errorf("export does not rewrite %s's contents", appPath)
+			}
+		})
+	}
+}
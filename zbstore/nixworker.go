@@ -0,0 +1,747 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// Nix worker protocol constants.
+// See worker-protocol.hh in the Nix source.
+const (
+	nixWorkerMagic1 = 0x6e697863
+	nixWorkerMagic2 = 0x6478696f
+
+	// nixProtocolVersion is the version of the worker protocol
+	// that [Server.ServeNixProtocol] speaks (1.35).
+	nixProtocolVersion = 1<<8 | 35
+	// nixMinProtocolVersion is the oldest client protocol version accepted
+	// (1.21, used by Nix 2.3).
+	nixMinProtocolVersion = 1<<8 | 21
+
+	nixStderrLast  = 0x616c7473
+	nixStderrError = 0x63787470
+)
+
+// Nix worker protocol operations that [Server.ServeNixProtocol] supports.
+const (
+	nixOpIsValidPath           = 1
+	nixOpQueryReferrers        = 6
+	nixOpSetOptions            = 19
+	nixOpQueryPathInfo         = 26
+	nixOpQueryPathFromHashPart = 29
+	nixOpQueryValidPaths       = 31
+	nixOpNarFromPath           = 38
+	nixOpAddToStoreNar         = 39
+	nixOpAddMultipleToStore    = 44
+)
+
+// maxNixWireString is the longest string a Nix protocol client may send.
+const maxNixWireString = 1 << 20
+
+// ServeNixProtocol accepts Nix worker protocol connections on ln
+// until ctx is done or ln returns an error.
+// This lets Nix clients (like nix-copy-closure or nix copy)
+// query, download from, and upload to the server's store.
+//
+// ServeNixProtocol implements the protocol itself
+// rather than relaying to a Nix daemon,
+// so clients act with their own permissions rather than the server's:
+// any client that srv.Policy allows may query the store and read store objects,
+// but only trusted clients may add store objects.
+// Added objects are imported with nix-store --import,
+// so their signatures and content addresses are not preserved.
+// Building and other operations are not supported.
+func (srv *Server) ServeNixProtocol(ctx context.Context, ln net.Listener) error {
+	if srv.Store.socket() != "" {
+		return fmt.Errorf("serve nix protocol: store is itself a daemon client")
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go srv.serveNixConn(ctx, conn)
+	}
+}
+
+func (srv *Server) serveNixConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	client, err := srv.authorizeConn(conn)
+	if err != nil {
+		log.Warnf(ctx, "Rejecting Nix protocol connection: %v", err)
+		return
+	}
+	wc := &nixWorkerConn{
+		ctx:    ctx,
+		store:  srv.Store,
+		client: client,
+		r:      nixWireReader{r: bufio.NewReader(conn)},
+		w:      nixWireWriter{w: bufio.NewWriter(conn)},
+	}
+	if err := wc.handshake(); err != nil {
+		log.Debugf(ctx, "Nix protocol handshake with %v: %v", client, err)
+		return
+	}
+	log.Debugf(ctx, "Accepted Nix protocol %d.%d connection from %v (trusted=%t)",
+		wc.version>>8, wc.version&0xff, client, client.Trusted)
+	for {
+		op := wc.r.uint64()
+		if wc.r.err != nil {
+			if !errors.Is(wc.r.err, io.EOF) {
+				log.Debugf(ctx, "Nix protocol connection from %v: %v", client, wc.r.err)
+			}
+			return
+		}
+		if err := wc.serveOp(op); err != nil {
+			log.Debugf(ctx, "Nix protocol connection from %v: %v", client, err)
+			return
+		}
+	}
+}
+
+// nixWorkerConn is the state of a single Nix worker protocol connection.
+type nixWorkerConn struct {
+	ctx    context.Context
+	store  *Store
+	client *ClientIdentity
+	r      nixWireReader
+	w      nixWireWriter
+
+	// version is the negotiated protocol version.
+	version uint64
+	// workStopped is whether the current operation
+	// has sent the end of its log messages.
+	// Errors can only be reported to the client before then.
+	workStopped bool
+	// broken is whether the current operation failed
+	// in a way that leaves the connection unusable.
+	broken bool
+}
+
+// handshake negotiates the protocol version with the client.
+func (wc *nixWorkerConn) handshake() error {
+	magic := wc.r.uint64()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	if magic != nixWorkerMagic1 {
+		return fmt.Errorf("bad magic number %#x", magic)
+	}
+	wc.w.uint64(nixWorkerMagic2)
+	wc.w.uint64(nixProtocolVersion)
+	if err := wc.w.flush(); err != nil {
+		return err
+	}
+	clientVersion := wc.r.uint64()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	if clientVersion>>8 != 1 || clientVersion < nixMinProtocolVersion {
+		return fmt.Errorf("unsupported client protocol version %d.%d", clientVersion>>8, clientVersion&0xff)
+	}
+	wc.version = min(clientVersion, nixProtocolVersion)
+	if wc.atLeast(14) && wc.r.bool() {
+		wc.r.uint64() // CPU affinity (obsolete)
+	}
+	if wc.atLeast(11) {
+		wc.r.bool() // reserve space (obsolete)
+	}
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	if wc.atLeast(33) {
+		wc.w.string("zb")
+	}
+	if wc.atLeast(35) {
+		if wc.client.Trusted {
+			wc.w.uint64(1)
+		} else {
+			wc.w.uint64(2)
+		}
+	}
+	wc.stopWork()
+	return wc.w.flush()
+}
+
+// atLeast reports whether the negotiated protocol version
+// is at least 1.minor.
+func (wc *nixWorkerConn) atLeast(minor uint64) bool {
+	return wc.version >= 1<<8|minor
+}
+
+// serveOp reads the arguments of the given operation,
+// performs it, and writes its result.
+// Errors that the client can recover from are sent to the client;
+// serveOp only returns an error if the connection must be closed.
+func (wc *nixWorkerConn) serveOp(op uint64) error {
+	wc.workStopped = false
+	wc.broken = false
+	var err error
+	switch op {
+	case nixOpIsValidPath:
+		err = wc.isValidPath()
+	case nixOpQueryReferrers:
+		err = wc.queryReferrers()
+	case nixOpSetOptions:
+		err = wc.setOptions()
+	case nixOpQueryPathInfo:
+		err = wc.queryPathInfo()
+	case nixOpQueryPathFromHashPart:
+		err = wc.queryPathFromHashPart()
+	case nixOpQueryValidPaths:
+		err = wc.queryValidPaths()
+	case nixOpNarFromPath:
+		err = wc.narFromPath()
+	case nixOpAddToStoreNar:
+		err = wc.addToStoreNar()
+	case nixOpAddMultipleToStore:
+		err = wc.addMultipleToStore()
+	default:
+		// The arguments of an unknown operation can't be skipped.
+		wc.broken = true
+		err = fmt.Errorf("unsupported operation %d", op)
+	}
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	if err != nil {
+		if wc.workStopped {
+			return err
+		}
+		wc.sendError(err)
+		if flushErr := wc.w.flush(); flushErr != nil {
+			return flushErr
+		}
+		if wc.broken {
+			return err
+		}
+		return nil
+	}
+	return wc.w.flush()
+}
+
+// stopWork sends the end of the current operation's log messages.
+// The operation's results follow.
+func (wc *nixWorkerConn) stopWork() {
+	wc.w.uint64(nixStderrLast)
+	wc.workStopped = true
+}
+
+// sendError reports the failure of the current operation to the client.
+func (wc *nixWorkerConn) sendError(err error) {
+	wc.w.uint64(nixStderrError)
+	if !wc.atLeast(26) {
+		wc.w.string(err.Error())
+		wc.w.uint64(1) // exit status
+		return
+	}
+	wc.w.string("Error")
+	wc.w.uint64(0) // level
+	wc.w.string("Error")
+	wc.w.string(err.Error())
+	wc.w.uint64(0) // no position
+	wc.w.uint64(0) // no traces
+}
+
+// storePath reads a store path in the server's store directory.
+func (wc *nixWorkerConn) storePath() nix.StorePath {
+	s := wc.r.string()
+	if wc.r.err != nil {
+		return ""
+	}
+	p, err := nix.ParseStorePath(s)
+	if err != nil {
+		wc.r.fail(err)
+		return ""
+	}
+	if p.Dir() != wc.store.dir() {
+		wc.r.fail(fmt.Errorf("%s is not in %s", p, wc.store.dir()))
+		return ""
+	}
+	return p
+}
+
+// storePaths reads a list of store paths in the server's store directory.
+func (wc *nixWorkerConn) storePaths() []nix.StorePath {
+	n := wc.r.uint64()
+	var paths []nix.StorePath
+	for i := uint64(0); i < n && wc.r.err == nil; i++ {
+		paths = append(paths, wc.storePath())
+	}
+	return paths
+}
+
+// pathInfo reads the metadata of a store object
+// after its path has been read.
+func (wc *nixWorkerConn) pathInfo(path nix.StorePath) *PathInfo {
+	info := &PathInfo{Path: path}
+	if deriver := wc.r.string(); deriver != "" && wc.r.err == nil {
+		var err error
+		info.Deriver, err = nix.ParseStorePath(deriver)
+		if err != nil {
+			wc.r.fail(fmt.Errorf("deriver: %v", err))
+		}
+	}
+	if narHash := wc.r.string(); wc.r.err == nil {
+		if !strings.Contains(narHash, ":") {
+			narHash = "sha256:" + narHash
+		}
+		var err error
+		info.NARHash, err = nix.ParseHash(narHash)
+		if err != nil {
+			wc.r.fail(fmt.Errorf("nar hash: %v", err))
+		}
+	}
+	info.References = wc.storePaths()
+	slices.Sort(info.References)
+	if t := wc.r.uint64(); t != 0 {
+		info.RegistrationTime = time.Unix(int64(t), 0)
+	}
+	info.NARSize = int64(wc.r.uint64())
+	if wc.atLeast(16) {
+		info.Ultimate = wc.r.bool()
+		n := wc.r.uint64()
+		for i := uint64(0); i < n && wc.r.err == nil; i++ {
+			sig, err := nix.ParseSignature(wc.r.string())
+			if err != nil && wc.r.err == nil {
+				wc.r.fail(fmt.Errorf("signature: %v", err))
+			}
+			info.Signatures = append(info.Signatures, sig)
+		}
+		if ca := wc.r.string(); ca != "" && wc.r.err == nil {
+			var err error
+			info.CA, err = nix.ParseContentAddress(ca)
+			if err != nil {
+				wc.r.fail(fmt.Errorf("content address: %v", err))
+			}
+		}
+	}
+	if info.NARSize < 0 {
+		wc.r.fail(fmt.Errorf("negative NAR size"))
+	}
+	return info
+}
+
+// writePathInfo writes the metadata of a store object without its path.
+func (wc *nixWorkerConn) writePathInfo(info *PathInfo) {
+	wc.w.string(string(info.Deriver))
+	wc.w.string(info.NARHash.RawBase16())
+	wc.w.uint64(uint64(len(info.References)))
+	for _, ref := range info.References {
+		wc.w.string(string(ref))
+	}
+	var regTime uint64
+	if !info.RegistrationTime.IsZero() {
+		regTime = uint64(info.RegistrationTime.Unix())
+	}
+	wc.w.uint64(regTime)
+	wc.w.uint64(uint64(info.NARSize))
+	if wc.atLeast(16) {
+		wc.w.bool(info.Ultimate)
+		wc.w.uint64(uint64(len(info.Signatures)))
+		for _, sig := range info.Signatures {
+			wc.w.string(sig.String())
+		}
+		if info.CA.IsZero() {
+			wc.w.string("")
+		} else {
+			wc.w.string(info.CA.String())
+		}
+	}
+}
+
+// validPath returns the metadata of path
+// or nil if path is not valid.
+func (wc *nixWorkerConn) validPath(path nix.StorePath) (*PathInfo, error) {
+	info, err := wc.store.QueryPathInfo(wc.ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return info, err
+}
+
+func (wc *nixWorkerConn) isValidPath() error {
+	path := wc.storePath()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	info, err := wc.validPath(path)
+	if err != nil {
+		return err
+	}
+	wc.stopWork()
+	wc.w.bool(info != nil)
+	return nil
+}
+
+func (wc *nixWorkerConn) queryValidPaths() error {
+	paths := wc.storePaths()
+	if wc.atLeast(27) {
+		wc.r.bool() // substitute
+	}
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	infos, err := wc.store.QueryPathInfos(wc.ctx, paths...)
+	if err != nil {
+		return err
+	}
+	valid := make([]nix.StorePath, 0, len(infos))
+	for _, info := range infos {
+		valid = append(valid, info.Path)
+	}
+	slices.Sort(valid)
+	valid = slices.Compact(valid)
+	wc.stopWork()
+	wc.w.uint64(uint64(len(valid)))
+	for _, p := range valid {
+		wc.w.string(string(p))
+	}
+	return nil
+}
+
+func (wc *nixWorkerConn) queryPathInfo() error {
+	path := wc.storePath()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	info, err := wc.validPath(path)
+	if err != nil {
+		return err
+	}
+	if info == nil && !wc.atLeast(17) {
+		return fmt.Errorf("path '%s' is not valid", path)
+	}
+	wc.stopWork()
+	if wc.atLeast(17) {
+		wc.w.bool(info != nil)
+	}
+	if info != nil {
+		wc.writePathInfo(info)
+	}
+	return nil
+}
+
+func (wc *nixWorkerConn) queryReferrers() error {
+	path := wc.storePath()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	referrers, err := wc.store.QueryReferrers(wc.ctx, path)
+	if err != nil {
+		return err
+	}
+	wc.stopWork()
+	wc.w.uint64(uint64(len(referrers)))
+	for _, p := range referrers {
+		wc.w.string(string(p))
+	}
+	return nil
+}
+
+func (wc *nixWorkerConn) queryPathFromHashPart() error {
+	hashPart := wc.r.string()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	path, err := wc.store.QueryPathFromHashPart(wc.ctx, hashPart)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	wc.stopWork()
+	wc.w.string(string(path))
+	return nil
+}
+
+// setOptions reads the client's settings.
+// The server's settings are used for all operations,
+// so they are ignored.
+func (wc *nixWorkerConn) setOptions() error {
+	// keepFailed, keepGoing, tryFallback, verbosity, maxBuildJobs,
+	// maxSilentTime, useBuildHook, verboseBuild, logType,
+	// printBuildTrace, buildCores, useSubstitutes
+	for i := 0; i < 12; i++ {
+		wc.r.uint64()
+	}
+	if wc.atLeast(12) {
+		n := wc.r.uint64()
+		for i := uint64(0); i < n && wc.r.err == nil; i++ {
+			wc.r.string() // name
+			wc.r.string() // value
+		}
+	}
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	wc.stopWork()
+	return nil
+}
+
+func (wc *nixWorkerConn) narFromPath() error {
+	path := wc.storePath()
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	info, err := wc.validPath(path)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("path '%s' is not valid", path)
+	}
+	wc.stopWork()
+	return wc.w.nar(wc.store.RealPath(string(path)))
+}
+
+func (wc *nixWorkerConn) addToStoreNar() error {
+	info := wc.pathInfo(wc.storePath())
+	wc.r.bool() // repair
+	wc.r.bool() // dontCheckSigs
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	if !wc.atLeast(23) {
+		// Older clients tunnel the NAR through log messages.
+		wc.broken = true
+		return fmt.Errorf("adding store objects requires protocol version 1.23 or later")
+	}
+	nars := &nixFramedReader{r: wc.r.r}
+	err := wc.checkMayAdd()
+	if err == nil {
+		log.Infof(wc.ctx, "Adding %s for %v", info.Path, wc.client)
+		err = wc.store.importObjects(wc.ctx, []*PathInfo{info}, func(w io.Writer, info *PathInfo) error {
+			return copyNAR(w, nars, info)
+		})
+	}
+	if _, drainErr := io.Copy(io.Discard, nars); drainErr != nil {
+		wc.broken = true
+		if err == nil {
+			err = drainErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	wc.stopWork()
+	return nil
+}
+
+func (wc *nixWorkerConn) addMultipleToStore() error {
+	wc.r.bool() // repair
+	wc.r.bool() // dontCheckSigs
+	if wc.r.err != nil {
+		return wc.r.err
+	}
+	stream := &nixFramedReader{r: wc.r.r}
+	err := wc.checkMayAdd()
+	if err == nil {
+		err = wc.importStream(stream)
+	}
+	if _, drainErr := io.Copy(io.Discard, stream); drainErr != nil {
+		wc.broken = true
+		if err == nil {
+			err = drainErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	wc.stopWork()
+	return nil
+}
+
+// importStream imports the store objects
+// sent as part of an AddMultipleToStore operation.
+func (wc *nixWorkerConn) importStream(stream io.Reader) error {
+	sub := &nixWorkerConn{
+		ctx:     wc.ctx,
+		store:   wc.store,
+		version: wc.version,
+		r:       nixWireReader{r: stream},
+	}
+	n := sub.r.uint64()
+	if sub.r.err != nil {
+		return sub.r.err
+	}
+	imp, err := wc.store.startImport(wc.ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof(wc.ctx, "Adding %d store objects for %v", n, wc.client)
+	for i := uint64(0); i < n; i++ {
+		info := sub.pathInfo(sub.storePath())
+		if sub.r.err != nil {
+			imp.abort()
+			return sub.r.err
+		}
+		err := imp.add(wc.ctx, info, func(w io.Writer, info *PathInfo) error {
+			return copyNAR(w, stream, info)
+		})
+		if err != nil {
+			imp.abort()
+			return err
+		}
+	}
+	return imp.finish()
+}
+
+// checkMayAdd returns an error if the client may not add store objects.
+func (wc *nixWorkerConn) checkMayAdd() error {
+	if !wc.client.Trusted {
+		return fmt.Errorf("only trusted users may add store objects through zb")
+	}
+	return nil
+}
+
+// copyNAR copies the NAR serialization of info from r to w,
+// checking that it matches info's size and hash.
+func copyNAR(w io.Writer, r io.Reader, info *PathInfo) error {
+	h := nix.NewHasher(info.NARHash.Type())
+	if _, err := io.CopyN(io.MultiWriter(w, h), r, info.NARSize); err != nil {
+		return fmt.Errorf("read nar: %v", err)
+	}
+	if got := h.SumHash(); !got.Equal(info.NARHash) {
+		return fmt.Errorf("NAR hash mismatch (got %v, client sent %v)", got, info.NARHash)
+	}
+	return nil
+}
+
+// nixWireReader reads values in the Nix worker protocol's serialization.
+// After the first error, all methods return zero values
+// and the error is kept in err.
+type nixWireReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *nixWireReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *nixWireReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		r.err = err
+		return 0
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (r *nixWireReader) bool() bool {
+	return r.uint64() != 0
+}
+
+func (r *nixWireReader) string() string {
+	n := r.uint64()
+	if r.err != nil {
+		return ""
+	}
+	if n > maxNixWireString {
+		r.err = fmt.Errorf("string too long (%d bytes)", n)
+		return ""
+	}
+	buf := make([]byte, (n+7)&^7)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// nixWireWriter writes values in the Nix worker protocol's serialization.
+// Errors are reported by flush.
+type nixWireWriter struct {
+	w *bufio.Writer
+}
+
+func (w nixWireWriter) uint64(x uint64) {
+	w.w.Write(binary.LittleEndian.AppendUint64(nil, x))
+}
+
+func (w nixWireWriter) bool(b bool) {
+	if b {
+		w.uint64(1)
+	} else {
+		w.uint64(0)
+	}
+}
+
+func (w nixWireWriter) string(s string) {
+	w.w.Write(appendExportString(nil, s))
+}
+
+// nar writes the NAR serialization of the file at path.
+func (w nixWireWriter) nar(path string) error {
+	if err := nar.DumpPath(w.w, path); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+func (w nixWireWriter) flush() error {
+	return w.w.Flush()
+}
+
+// nixFramedReader reads a stream sent as a sequence of length-prefixed frames
+// that ends with an empty frame.
+type nixFramedReader struct {
+	r         io.Reader
+	remaining uint64
+	eof       bool
+}
+
+func (fr *nixFramedReader) Read(p []byte) (int, error) {
+	for fr.remaining == 0 {
+		if fr.eof {
+			return 0, io.EOF
+		}
+		var buf [8]byte
+		if _, err := io.ReadFull(fr.r, buf[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		fr.remaining = binary.LittleEndian.Uint64(buf[:])
+		fr.eof = fr.remaining == 0
+	}
+	if uint64(len(p)) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	n, err := fr.r.Read(p)
+	fr.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,353 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestServeNixProtocol(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials and shell scripts required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.Setenv("NIX_STATE_DIR", "/nix/var/nix")
+	dir := t.TempDir()
+
+	// Create a store with a single valid object.
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "nix", "store"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, string(testHelloPath)), []byte("Hello, World!\n"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	helloNAR := new(bytes.Buffer)
+	if err := nar.DumpPath(helloNAR, filepath.Join(root, string(testHelloPath))); err != nil {
+		t.Fatal(err)
+	}
+	helloHash := nix.NewHasher(nix.SHA256)
+	helloHash.Write(helloNAR.Bytes())
+	writeFakeNixDB(t, filepath.Join(root, "nix", "var", "nix", "db", "db.sqlite"), `
+		insert into ValidPaths (id, path, hash, registrationTime, narSize) values (1, :path, :hash, 1700000000, :size);
+	`, map[string]any{
+		":path": string(testHelloPath),
+		":hash": helloHash.SumHash().String(),
+		":size": helloNAR.Len(),
+	})
+
+	// Stand in for nix-store --import with a script that saves its input.
+	binDir := filepath.Join(dir, "bin")
+	if err := os.Mkdir(binDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	importFile := filepath.Join(dir, "import")
+	script := "#!/bin/sh\ncat > '" + importFile + "'\n"
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	store := &Store{Root: root}
+	trustedSocket := startNixWorkerServer(ctx, t, filepath.Join(dir, "trusted.sock"), store, &AuthPolicy{
+		TrustedUsers: []string{"*"},
+	})
+	untrustedSocket := startNixWorkerServer(ctx, t, filepath.Join(dir, "untrusted.sock"), store, &AuthPolicy{
+		TrustedUsers: []string{"nobody-" + strconv.Itoa(os.Getuid())},
+	})
+	const missingPath nix.StorePath = "/nix/store/22222222222222222222222222222222-missing"
+
+	t.Run("Query", func(t *testing.T) {
+		c := dialNixWorker(t, trustedSocket, nixProtocolVersion, true)
+
+		c.w.uint64(nixOpSetOptions)
+		for i := 0; i < 12; i++ {
+			c.w.uint64(0)
+		}
+		c.w.uint64(1)
+		c.w.string("substituters")
+		c.w.string("")
+		c.finishOp(t)
+
+		for _, p := range []nix.StorePath{testHelloPath, missingPath} {
+			c.w.uint64(nixOpIsValidPath)
+			c.w.string(string(p))
+			c.finishOp(t)
+			if got, want := c.r.bool(), p == testHelloPath; got != want {
+				t.Errorf("IsValidPath(%s) = %t; want %t", p, got, want)
+			}
+		}
+
+		c.w.uint64(nixOpQueryValidPaths)
+		c.w.uint64(2)
+		c.w.string(string(missingPath))
+		c.w.string(string(testHelloPath))
+		c.w.bool(false)
+		c.finishOp(t)
+		if n := c.r.uint64(); n != 1 {
+			t.Errorf("QueryValidPaths returned %d paths; want 1", n)
+		} else if got := c.r.string(); got != string(testHelloPath) {
+			t.Errorf("QueryValidPaths = [%s]; want [%s]", got, testHelloPath)
+		}
+
+		c.w.uint64(nixOpQueryPathInfo)
+		c.w.string(string(testHelloPath))
+		c.finishOp(t)
+		if !c.r.bool() {
+			t.Fatal("QueryPathInfo reported path as invalid")
+		}
+		info := (&nixWorkerConn{r: c.r, version: nixProtocolVersion}).pathInfo(testHelloPath)
+		if !info.NARHash.Equal(helloHash.SumHash()) || info.NARSize != int64(helloNAR.Len()) {
+			t.Errorf("QueryPathInfo = %v (%d bytes); want %v (%d bytes)",
+				info.NARHash, info.NARSize, helloHash.SumHash(), helloNAR.Len())
+		}
+
+		c.w.uint64(nixOpNarFromPath)
+		c.w.string(string(testHelloPath))
+		c.finishOp(t)
+		got := make([]byte, helloNAR.Len())
+		if _, err := io.ReadFull(c.r.r, got); err != nil || !bytes.Equal(got, helloNAR.Bytes()) {
+			t.Errorf("NarFromPath = %q, %v; want %q", got, err, helloNAR.Bytes())
+		}
+
+		c.w.uint64(nixOpNarFromPath)
+		c.w.string(string(missingPath))
+		if msg := c.finishOpError(t); !strings.Contains(msg, "not valid") {
+			t.Errorf("NarFromPath(missing) error = %q; want it to mention \"not valid\"", msg)
+		}
+	})
+
+	newPath := nix.StorePath("/nix/store/3333333333333333333333333333333x-new")
+	addToStoreNar := func(c *nixTestClient) {
+		c.w.uint64(nixOpAddToStoreNar)
+		c.w.string(string(newPath))
+		c.w.string("")
+		c.w.string(helloHash.SumHash().RawBase16())
+		c.w.uint64(1)
+		c.w.string(string(testHelloPath))
+		c.w.uint64(0)
+		c.w.uint64(uint64(helloNAR.Len()))
+		c.w.bool(false)
+		c.w.uint64(0)
+		c.w.string("")
+		c.w.bool(false)
+		c.w.bool(false)
+		// Send the NAR in two frames.
+		half := helloNAR.Len() / 2
+		c.w.uint64(uint64(half))
+		c.w.w.Write(helloNAR.Bytes()[:half])
+		c.w.uint64(uint64(helloNAR.Len() - half))
+		c.w.w.Write(helloNAR.Bytes()[half:])
+		c.w.uint64(0)
+	}
+
+	t.Run("AddToStoreNar", func(t *testing.T) {
+		c := dialNixWorker(t, trustedSocket, nixProtocolVersion, true)
+		addToStoreNar(c)
+		c.finishOp(t)
+		imported, err := os.ReadFile(importFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(imported, helloNAR.Bytes()) || !bytes.Contains(imported, []byte(newPath)) {
+			t.Errorf("nix-store --import input does not contain the NAR and path:\n%q", imported)
+		}
+	})
+
+	t.Run("AddMultipleToStore", func(t *testing.T) {
+		os.Remove(importFile)
+		stream := new(bytes.Buffer)
+		sw := nixWireWriter{w: bufio.NewWriter(stream)}
+		sw.uint64(1)
+		sw.string(string(newPath))
+		(&nixWorkerConn{w: sw, version: nixProtocolVersion}).writePathInfo(&PathInfo{
+			NARHash:    helloHash.SumHash(),
+			NARSize:    int64(helloNAR.Len()),
+			References: []nix.StorePath{testHelloPath},
+		})
+		sw.w.Write(helloNAR.Bytes())
+		sw.flush()
+
+		c := dialNixWorker(t, trustedSocket, nixProtocolVersion, true)
+		c.w.uint64(nixOpAddMultipleToStore)
+		c.w.bool(false)
+		c.w.bool(false)
+		c.w.uint64(uint64(stream.Len()))
+		c.w.w.Write(stream.Bytes())
+		c.w.uint64(0)
+		c.finishOp(t)
+		imported, err := os.ReadFile(importFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(imported, helloNAR.Bytes()) || !bytes.Contains(imported, []byte(newPath)) {
+			t.Errorf("nix-store --import input does not contain the NAR and path:\n%q", imported)
+		}
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		c := dialNixWorker(t, untrustedSocket, nixProtocolVersion, false)
+		addToStoreNar(c)
+		if msg := c.finishOpError(t); !strings.Contains(msg, "trusted") {
+			t.Errorf("AddToStoreNar error = %q; want it to mention trust", msg)
+		}
+
+		// The connection should still be usable.
+		c.w.uint64(nixOpIsValidPath)
+		c.w.string(string(testHelloPath))
+		c.finishOp(t)
+		if !c.r.bool() {
+			t.Errorf("IsValidPath(%s) = false after rejected add", testHelloPath)
+		}
+	})
+
+	t.Run("OldClient", func(t *testing.T) {
+		c := dialNixWorker(t, trustedSocket, 1<<8|25, true)
+		c.w.uint64(nixOpIsValidPath)
+		c.w.string(string(missingPath))
+		c.finishOp(t)
+		if c.r.bool() {
+			t.Errorf("IsValidPath(%s) = true", missingPath)
+		}
+		c.w.uint64(nixOpQueryPathInfo)
+		c.w.string(string(missingPath))
+		c.finishOp(t)
+		if c.r.bool() {
+			t.Errorf("QueryPathInfo(%s) reported path as valid", missingPath)
+		}
+	})
+
+	t.Run("UnknownOp", func(t *testing.T) {
+		c := dialNixWorker(t, trustedSocket, nixProtocolVersion, true)
+		c.w.uint64(9) // BuildPaths
+		if msg := c.finishOpError(t); !strings.Contains(msg, "unsupported") {
+			t.Errorf("error = %q; want it to mention \"unsupported\"", msg)
+		}
+		if c.r.uint64(); c.r.err == nil {
+			t.Error("connection still open after unsupported operation")
+		}
+	})
+}
+
+func startNixWorkerServer(ctx context.Context, tb testing.TB, socket string, store *Store, policy *AuthPolicy) string {
+	tb.Helper()
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := &Server{
+		Store:  store,
+		Policy: policy,
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- srv.ServeNixProtocol(ctx, ln) }()
+	tb.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			tb.Error("ServeNixProtocol:", err)
+		}
+	})
+	return socket
+}
+
+// nixTestClient is the client side of a Nix worker protocol connection.
+type nixTestClient struct {
+	r nixWireReader
+	w nixWireWriter
+}
+
+// dialNixWorker connects to the Unix socket and performs the handshake
+// with the given protocol version.
+func dialNixWorker(tb testing.TB, socket string, version uint64, wantTrusted bool) *nixTestClient {
+	tb.Helper()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	c := &nixTestClient{
+		r: nixWireReader{r: bufio.NewReader(conn)},
+		w: nixWireWriter{w: bufio.NewWriter(conn)},
+	}
+	c.w.uint64(nixWorkerMagic1)
+	c.w.flush()
+	if magic := c.r.uint64(); magic != nixWorkerMagic2 {
+		tb.Fatalf("server magic = %#x, %v; want %#x", magic, c.r.err, nixWorkerMagic2)
+	}
+	if got := c.r.uint64(); got != nixProtocolVersion {
+		tb.Errorf("server protocol version = %#x; want %#x", got, nixProtocolVersion)
+	}
+	c.w.uint64(version)
+	c.w.uint64(0) // CPU affinity
+	c.w.uint64(0) // reserve space
+	c.w.flush()
+	minor := version & 0xff
+	if minor >= 33 {
+		c.r.string()
+	}
+	if minor >= 35 {
+		trusted := c.r.uint64()
+		if want := map[bool]uint64{true: 1, false: 2}[wantTrusted]; trusted != want {
+			tb.Errorf("server trust status = %d; want %d", trusted, want)
+		}
+	}
+	if got := c.r.uint64(); got != nixStderrLast {
+		tb.Fatalf("handshake ended with %#x, %v; want %#x", got, c.r.err, nixStderrLast)
+	}
+	return c
+}
+
+// finishOp sends the operation written so far
+// and waits for the server to indicate success.
+func (c *nixTestClient) finishOp(tb testing.TB) {
+	tb.Helper()
+	if err := c.w.flush(); err != nil {
+		tb.Fatal(err)
+	}
+	switch got := c.r.uint64(); got {
+	case nixStderrLast:
+	case nixStderrError:
+		c.r.string() // type
+		c.r.uint64() // level
+		c.r.string() // name
+		tb.Fatalf("server error: %s", c.r.string())
+	default:
+		tb.Fatalf("server sent %#x, %v; want %#x", got, c.r.err, nixStderrLast)
+	}
+}
+
+// finishOpError sends the operation written so far,
+// waits for the server to report an error,
+// and returns its message.
+func (c *nixTestClient) finishOpError(tb testing.TB) string {
+	tb.Helper()
+	if err := c.w.flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if got := c.r.uint64(); got != nixStderrError {
+		tb.Fatalf("server sent %#x, %v; want %#x", got, c.r.err, nixStderrError)
+	}
+	c.r.string() // type
+	c.r.uint64() // level
+	c.r.string() // name
+	msg := c.r.string()
+	c.r.uint64() // position
+	c.r.uint64() // traces
+	return msg
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Object storage URL schemes supported by [Substituter].
+const (
+	gcsScheme   = "gs"
+	azureScheme = "azblob"
+)
+
+// azureStorageVersion is the Azure Storage REST API version used for requests.
+const azureStorageVersion = "2023-11-03"
+
+// objectStoreTokenSource returns the source of the bearer tokens
+// used to access the object storage service for the given URL scheme.
+// It is a variable so that tests can avoid looking up ambient credentials.
+var objectStoreTokenSource = func(ctx context.Context, scheme string) (oauth2.TokenSource, error) {
+	switch scheme {
+	case gcsScheme:
+		return google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	case azureScheme:
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, err
+		}
+		return azureTokenSource{cred}, nil
+	default:
+		return nil, fmt.Errorf("unknown object storage scheme %q", scheme)
+	}
+}
+
+// objectStoreEndpoint translates a gs:// or azblob:// binary cache URL
+// to the HTTPS URL of the cache's directory in the service's API.
+// ok is false if u does not use one of those schemes.
+//
+// gs://bucket/prefix refers to objects in a Google Cloud Storage bucket,
+// and azblob://account/container/prefix refers to blobs
+// in an Azure Storage account's container.
+// The endpoint query parameter overrides the service's address,
+// for example to use a local emulator.
+func objectStoreEndpoint(u *url.URL) (endpoint *url.URL, ok bool, err error) {
+	var base string
+	var pathParts []string
+	switch u.Scheme {
+	case gcsScheme:
+		if u.Host == "" {
+			return nil, true, fmt.Errorf("%v: missing bucket", u.Redacted())
+		}
+		base = "https://storage.googleapis.com"
+		pathParts = []string{u.Host}
+	case azureScheme:
+		container, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+		if u.Host == "" || container == "" {
+			return nil, true, fmt.Errorf("%v: want azblob://account/container", u.Redacted())
+		}
+		base = "https://" + u.Host + ".blob.core.windows.net"
+	default:
+		return nil, false, nil
+	}
+	if e := u.Query().Get("endpoint"); e != "" {
+		base = strings.TrimSuffix(e, "/")
+	}
+	if u.Scheme == azureScheme && u.Query().Get("endpoint") != "" {
+		// Emulators like Azurite put the account name in the path.
+		pathParts = append(pathParts, u.Host)
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		pathParts = append(pathParts, p)
+	}
+	endpoint, err = url.Parse(base + "/" + strings.Join(pathParts, "/") + "/")
+	if err != nil {
+		return nil, true, fmt.Errorf("%v: %v", u.Redacted(), err)
+	}
+	return endpoint, true, nil
+}
+
+// objectStoreClient returns an HTTP client that authenticates requests
+// to the object storage service for the given URL scheme
+// with ambient credentials,
+// sending the requests over base.
+func objectStoreClient(ctx context.Context, scheme string, base *http.Client) (*http.Client, error) {
+	src, err := objectStoreTokenSource(ctx, scheme)
+	if err != nil {
+		return nil, fmt.Errorf("%s credentials: %v", scheme, err)
+	}
+	var transport http.RoundTripper = &oauth2.Transport{
+		Source: oauth2.ReuseTokenSource(nil, src),
+		Base:   base.Transport,
+	}
+	if scheme == azureScheme {
+		transport = azureHeaderTransport{transport}
+	}
+	c := new(http.Client)
+	*c = *base
+	c.Transport = transport
+	return c, nil
+}
+
+// azureTokenSource adapts an Azure credential to [oauth2.TokenSource].
+type azureTokenSource struct {
+	cred *azidentity.DefaultAzureCredential
+}
+
+func (src azureTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := src.cred.GetToken(context.Background(), policy.TokenRequestOptions{
+		Scopes: []string{"https://storage.azure.com/.default"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken: tok.Token,
+		TokenType:   "Bearer",
+		Expiry:      tok.ExpiresOn,
+	}, nil
+}
+
+// azureHeaderTransport adds the headers
+// that the Azure Storage REST API requires.
+type azureHeaderTransport struct {
+	base http.RoundTripper
+}
+
+func (t azureHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("x-ms-version", azureStorageVersion)
+	if req.Method == http.MethodPut {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	return t.base.RoundTrip(req)
+}
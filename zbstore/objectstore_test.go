@@ -0,0 +1,174 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"zombiezen.com/go/nix"
+)
+
+func TestObjectStoreEndpoint(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+		ok   bool
+		err  bool
+	}{
+		{url: "https://cache.example.com", ok: false},
+		{url: "gs://my-bucket", want: "https://storage.googleapis.com/my-bucket/", ok: true},
+		{url: "gs://my-bucket/zb/cache/", want: "https://storage.googleapis.com/my-bucket/zb/cache/", ok: true},
+		{url: "gs://my-bucket?endpoint=http://localhost:4443", want: "http://localhost:4443/my-bucket/", ok: true},
+		{url: "gs:///foo", ok: true, err: true},
+		{url: "azblob://myaccount/cache", want: "https://myaccount.blob.core.windows.net/cache/", ok: true},
+		{url: "azblob://myaccount/cache/zb", want: "https://myaccount.blob.core.windows.net/cache/zb/", ok: true},
+		{url: "azblob://devstoreaccount1/cache?endpoint=http://127.0.0.1:10000", want: "http://127.0.0.1:10000/devstoreaccount1/cache/", ok: true},
+		{url: "azblob://myaccount", ok: true, err: true},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := objectStoreEndpoint(u)
+		if ok != test.ok || (err != nil) != test.err {
+			t.Errorf("objectStoreEndpoint(%q) = _, %t, %v; want _, %t, error=%t", test.url, ok, err, test.ok, test.err)
+			continue
+		}
+		if test.want != "" && (got == nil || got.String() != test.want) {
+			t.Errorf("objectStoreEndpoint(%q) = %v; want %s", test.url, got, test.want)
+		}
+	}
+}
+
+// fakeObjectStore is an in-memory object storage service
+// that requires a bearer token.
+type fakeObjectStore struct {
+	token string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func (s *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := s.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.objects == nil {
+			s.objects = make(map[string][]byte)
+			s.headers = make(map[string]http.Header)
+		}
+		s.objects[r.URL.Path] = data
+		s.headers[r.URL.Path] = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPushObjectStore(t *testing.T) {
+	ctx := context.Background()
+	oldTokenSource := objectStoreTokenSource
+	objectStoreTokenSource = func(ctx context.Context, scheme string) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "xyzzy"}), nil
+	}
+	t.Cleanup(func() { objectStoreTokenSource = oldTokenSource })
+
+	nixStore := newTestNixStore(t, nil)
+	storeDir, path := nixStore.dir, nixStore.path
+
+	for _, scheme := range []string{"gs", "azblob"} {
+		t.Run(scheme, func(t *testing.T) {
+			objects := &fakeObjectStore{token: "xyzzy"}
+			srv := httptest.NewServer(objects)
+			t.Cleanup(srv.Close)
+			sub := &Substituter{URL: scheme + "://acct/bucket/cache?endpoint=" + url.QueryEscape(srv.URL)}
+
+			pk := testSigningKey(t)
+			realization := testRealization(t)
+			realization.OutPath = path
+			realization.Signatures = nil
+			n, err := Push(ctx, &Store{Dir: storeDir}, sub, nil, &PushOptions{
+				SecretKey:    pk,
+				Realizations: []*Realization{realization},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("Push(...) = %d; want 1", n)
+			}
+			for name, h := range objects.headers {
+				if scheme == "azblob" && h.Get("x-ms-blob-type") != "BlockBlob" {
+					t.Errorf("PUT %s x-ms-blob-type = %q; want BlockBlob", name, h.Get("x-ms-blob-type"))
+				}
+			}
+
+			// Read the object back from the cache.
+			sub = &Substituter{URL: sub.URL}
+			info, err := sub.NARInfo(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Compression != nix.Zstandard || !strings.HasSuffix(info.URL, ".nar.zst") {
+				t.Errorf("narinfo Compression = %q, URL = %q; want zstd", info.Compression, info.URL)
+			}
+			if got := readAllNAR(t, sub, info); !bytes.Equal(got, nixStore.nar) {
+				t.Error("NAR downloaded from cache does not match")
+			}
+			if ls, err := sub.Listing(ctx, path); err != nil {
+				t.Error(err)
+			} else if ls.Root.Size != int64(len("Hello, World!\n")) {
+				t.Errorf("sub.Listing(ctx, %s).Root.Size = %d; want %d", path, ls.Root.Size, len("Hello, World!\n"))
+			}
+			sub.TrustedPublicKeys = []*nix.PublicKey{pk.PublicKey()}
+			if got, err := sub.Realization(ctx, realization.ID); err != nil {
+				t.Error(err)
+			} else if got.OutPath != path {
+				t.Errorf("sub.Realization(ctx, %v).OutPath = %s; want %s", realization.ID, got.OutPath, path)
+			}
+
+			// Pushing again skips the object.
+			if n, err := Push(ctx, &Store{Dir: storeDir}, sub, []nix.StorePath{path}, nil); err != nil || n != 0 {
+				t.Errorf("second Push(...) = %d, %v; want 0, <nil>", n, err)
+			}
+		})
+	}
+}
+
+func testSigningKey(tb testing.TB) *nix.PrivateKey {
+	tb.Helper()
+	_, pk, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pk
+}
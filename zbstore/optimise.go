@@ -0,0 +1,57 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// OptimiseStats is the result of [Store.Optimise].
+type OptimiseStats struct {
+	// FilesLinked is the number of files replaced by hard links.
+	FilesLinked int64
+	// BytesFreed is the approximate number of bytes of disk space reclaimed.
+	BytesFreed int64
+}
+
+// Optimise deduplicates the regular files in the store:
+// every file is replaced by a hard link to a file in the store's .links directory
+// named by the hash of its contents,
+// so identical files across store objects share the same disk blocks.
+func (s *Store) Optimise(ctx context.Context) (*OptimiseStats, error) {
+	c := s.command(ctx, "--optimise")
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	err := c.Run()
+	s.stderr().Write(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --optimise: %v", err)
+	}
+	stats, err := parseOptimiseStats(stderr.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --optimise: %v", err)
+	}
+	return stats, nil
+}
+
+var optimiseStatsPattern = regexp.MustCompile(`(?m)^([0-9.]+) MiB freed by hard-linking ([0-9]+) files`)
+
+// parseOptimiseStats parses the summary printed by nix-store --optimise.
+func parseOptimiseStats(out []byte) (*OptimiseStats, error) {
+	m := optimiseStatsPattern.FindSubmatch(out)
+	if m == nil {
+		return nil, fmt.Errorf("summary not found in output")
+	}
+	stats := &OptimiseStats{BytesFreed: parseMiB(string(m[1]))}
+	var err error
+	stats.FilesLinked, err = strconv.ParseInt(string(m[2]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse files linked: %v", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseOptimiseStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    *OptimiseStats
+		wantErr bool
+	}{
+		{
+			name: "Linked",
+			out:  "hashing files in '/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello'\n2.50 MiB freed by hard-linking 42 files\n",
+			want: &OptimiseStats{
+				FilesLinked: 42,
+				BytesFreed:  5 << 19,
+			},
+		},
+		{
+			name: "Nothing",
+			out:  "0.00 MiB freed by hard-linking 0 files\n",
+			want: &OptimiseStats{},
+		},
+		{
+			name:    "Missing",
+			out:     "error: cannot open connection\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseOptimiseStats([]byte(test.out))
+			if err != nil {
+				if !test.wantErr {
+					t.Error("Unexpected error:", err)
+				}
+				return
+			}
+			if test.wantErr {
+				t.Errorf("parseOptimiseStats(...) = %+v; want error", got)
+				return
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("parseOptimiseStats(...) (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !unix
+
+package zbstore
+
+// linkOwner returns the user ID that owns the file at path
+// without following symlinks.
+func linkOwner(path string) (uid int, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,25 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build unix
+
+package zbstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkOwner returns the user ID that owns the file at path
+// without following symlinks.
+func linkOwner(path string) (uid int, ok bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
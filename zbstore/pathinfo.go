@@ -0,0 +1,422 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// PathInfo is the metadata that the store records about a valid store object.
+type PathInfo struct {
+	Path    nix.StorePath
+	NARHash nix.Hash
+	NARSize int64
+	// References is the sorted set of store objects that the object refers to.
+	References []nix.StorePath
+	// Deriver is the store derivation that produced the object.
+	// It is empty if the deriver is unknown.
+	Deriver nix.StorePath
+	// RegistrationTime is the time that the object became valid.
+	// It is the zero time if unknown.
+	RegistrationTime time.Time
+	// Signatures is the set of signatures that attest to the object's contents.
+	Signatures []*nix.Signature
+	// Ultimate is true if the object was built locally
+	// rather than obtained from a substituter.
+	Ultimate bool
+	// CA is the object's content address, if it is content-addressed.
+	CA nix.ContentAddress
+}
+
+// ErrNotFound is returned when a store object has no recorded information.
+var ErrNotFound = errors.New("not found")
+
+// nixStateDir returns the directory where the Nix backend keeps its state.
+func nixStateDir() string {
+	if dir := os.Getenv("NIX_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return "/nix/var/nix"
+}
+
+// QueryPathInfo returns the backend's metadata for the given store object.
+// If the backend's database cannot be read directly,
+// QueryPathInfo falls back to asking nix-store,
+// in which case the registration time, signatures, ultimate flag,
+// and content address are not available.
+// Objects that are not in the store
+// are looked up in the store's [Store.Lower] layer.
+func (s *Store) QueryPathInfo(ctx context.Context, path nix.StorePath) (*PathInfo, error) {
+	info, err := readNixPathInfo(ctx, filepath.Join(s.stateDir(), "db", "db.sqlite"), path)
+	if errors.Is(err, ErrNotFound) && s != nil && s.Lower != nil {
+		return s.Lower.QueryPathInfo(ctx, path)
+	}
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+	out, err := s.nixStore(ctx, "--dump-db", "--", string(path))
+	if err != nil {
+		return nil, err
+	}
+	infos, err := parseDumpDB(out)
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --dump-db: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Path != path {
+		return nil, fmt.Errorf("nix-store --dump-db: unexpected output for %s", path)
+	}
+	return infos[0], nil
+}
+
+// QueryPathInfos returns the backend's metadata for the given store objects
+// in the same way as [Store.QueryPathInfo],
+// but reads all of them over a single database connection
+// (or, in the fallback, with one nix-store invocation per batch of paths).
+// Objects that are not valid are omitted from the result.
+func (s *Store) QueryPathInfos(ctx context.Context, paths ...nix.StorePath) ([]*PathInfo, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	infos, missing, err := readNixPathInfos(ctx, filepath.Join(s.stateDir(), "db", "db.sqlite"), paths)
+	if err != nil {
+		return s.dumpPathInfos(ctx, paths)
+	}
+	if len(missing) > 0 && s != nil && s.Lower != nil {
+		lowerInfos, err := s.Lower.QueryPathInfos(ctx, missing...)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, lowerInfos...)
+	}
+	return infos, nil
+}
+
+// dumpPathInfos reads store objects' metadata with nix-store --dump-db.
+// If a batch fails (usually because one of its paths is invalid),
+// its paths are queried individually.
+func (s *Store) dumpPathInfos(ctx context.Context, paths []nix.StorePath) ([]*PathInfo, error) {
+	var infos []*PathInfo
+	for _, batch := range pathBatches(paths) {
+		args := make([]string, 0, len(batch)+2)
+		args = append(args, "--dump-db", "--")
+		for _, p := range batch {
+			args = append(args, string(p))
+		}
+		out, err := s.nixStore(ctx, args...)
+		if err == nil {
+			batchInfos, err := parseDumpDB(out)
+			if err != nil {
+				return infos, fmt.Errorf("nix-store --dump-db: %v", err)
+			}
+			infos = append(infos, batchInfos...)
+			continue
+		}
+		for _, p := range batch {
+			info, err := s.QueryPathInfo(ctx, p)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return infos, err
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// readNixPathInfos reads the metadata of several store objects
+// from the Nix database at dbPath.
+// missing is the subset of paths that the database does not have.
+func readNixPathInfos(ctx context.Context, dbPath string, paths []nix.StorePath) (infos []*PathInfo, missing []nix.StorePath, err error) {
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetBusyTimeout(10 * time.Second)
+	defer conn.SetInterrupt(conn.SetInterrupt(ctx.Done()))
+	for _, p := range paths {
+		info, err := queryNixPathInfo(conn, dbPath, p)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, p)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, missing, nil
+}
+
+// readNixPathInfo reads a store object's metadata from the Nix database at dbPath.
+func readNixPathInfo(ctx context.Context, dbPath string, path nix.StorePath) (_ *PathInfo, err error) {
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetBusyTimeout(10 * time.Second)
+	defer conn.SetInterrupt(conn.SetInterrupt(ctx.Done()))
+	return queryNixPathInfo(conn, dbPath, path)
+}
+
+// queryNixPathInfo reads a store object's metadata
+// from a connection to the Nix database at dbPath.
+func queryNixPathInfo(conn *sqlite.Conn, dbPath string, path nix.StorePath) (*PathInfo, error) {
+	var info *PathInfo
+	var id int64
+	err := sqlitex.Execute(conn, `select "id", "hash", "narSize", "deriver", "registrationTime", "ultimate", "sigs", "ca" from "ValidPaths" where "path" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{string(path)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = stmt.ColumnInt64(0)
+			var err error
+			info, err = scanPathInfo(path, stmt, 1)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read %s info from %s: %v", path, dbPath, err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("read %s info: %w", path, ErrNotFound)
+	}
+	err = sqlitex.Execute(conn, `select "ValidPaths"."path" from "Refs" join "ValidPaths" on "Refs"."reference" = "ValidPaths"."id" where "Refs"."referrer" = ? order by 1;`, &sqlitex.ExecOptions{
+		Args: []any{id},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			info.References = append(info.References, nix.StorePath(stmt.ColumnText(0)))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read %s references from %s: %v", path, dbPath, err)
+	}
+	return info, nil
+}
+
+// scanPathInfo reads the columns nar hash, NAR size, deriver,
+// registration time, ultimate, signatures, and content address
+// starting at column i.
+func scanPathInfo(path nix.StorePath, stmt *sqlite.Stmt, i int) (*PathInfo, error) {
+	info := &PathInfo{
+		Path:     path,
+		NARSize:  stmt.ColumnInt64(i + 1),
+		Deriver:  nix.StorePath(stmt.ColumnText(i + 2)),
+		Ultimate: stmt.ColumnBool(i + 4),
+	}
+	var err error
+	info.NARHash, err = nix.ParseHash(stmt.ColumnText(i))
+	if err != nil {
+		return nil, fmt.Errorf("nar hash: %v", err)
+	}
+	if t := stmt.ColumnInt64(i + 3); t != 0 {
+		info.RegistrationTime = time.Unix(t, 0)
+	}
+	for _, s := range strings.Fields(stmt.ColumnText(i + 5)) {
+		sig, err := nix.ParseSignature(s)
+		if err != nil {
+			return nil, err
+		}
+		info.Signatures = append(info.Signatures, sig)
+	}
+	if ca := stmt.ColumnText(i + 6); ca != "" {
+		info.CA, err = nix.ParseContentAddress(ca)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// parseDumpDB parses the validity registration format
+// printed by nix-store --dump-db.
+func parseDumpDB(out []byte) ([]*PathInfo, error) {
+	lines := strings.Split(string(bytes.TrimSuffix(out, []byte("\n"))), "\n")
+	if len(out) == 0 {
+		return nil, nil
+	}
+	var infos []*PathInfo
+	for len(lines) > 0 {
+		if len(lines) < 5 {
+			return infos, fmt.Errorf("unexpected end of registration")
+		}
+		info := new(PathInfo)
+		var err error
+		info.Path, err = nix.ParseStorePath(lines[0])
+		if err != nil {
+			return infos, err
+		}
+		info.NARHash, err = nix.ParseHash("sha256:" + lines[1])
+		if err != nil {
+			return infos, fmt.Errorf("%s: nar hash: %v", info.Path, err)
+		}
+		info.NARSize, err = strconv.ParseInt(lines[2], 10, 64)
+		if err != nil {
+			return infos, fmt.Errorf("%s: nar size: %v", info.Path, err)
+		}
+		if lines[3] != "" {
+			info.Deriver, err = nix.ParseStorePath(lines[3])
+			if err != nil {
+				return infos, fmt.Errorf("%s: deriver: %v", info.Path, err)
+			}
+		}
+		n, err := strconv.Atoi(lines[4])
+		if err != nil || n < 0 {
+			return infos, fmt.Errorf("%s: invalid reference count %q", info.Path, lines[4])
+		}
+		lines = lines[5:]
+		if len(lines) < n {
+			return infos, fmt.Errorf("%s: unexpected end of references", info.Path)
+		}
+		for _, line := range lines[:n] {
+			ref, err := nix.ParseStorePath(line)
+			if err != nil {
+				return infos, fmt.Errorf("%s: reference: %v", info.Path, err)
+			}
+			info.References = append(info.References, ref)
+		}
+		slices.Sort(info.References)
+		lines = lines[n:]
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RecordPathInfos saves the metadata of several store objects
+// in a single transaction as in [DB.RecordPathInfo].
+func (db *DB) RecordPathInfos(ctx context.Context, infos []*PathInfo) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	for _, info := range infos {
+		if err := db.RecordPathInfo(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordPathInfo saves the metadata of a store object,
+// replacing any previously recorded metadata.
+func (db *DB) RecordPathInfo(ctx context.Context, info *PathInfo) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	if err := deletePathInfo(db.conn, info.Path); err != nil {
+		return fmt.Errorf("record %s info: %v", info.Path, err)
+	}
+	var deriver, ca any
+	if info.Deriver != "" {
+		deriver = string(info.Deriver)
+	}
+	if !info.CA.IsZero() {
+		ca = info.CA.String()
+	}
+	var regTime int64
+	if !info.RegistrationTime.IsZero() {
+		regTime = info.RegistrationTime.Unix()
+	}
+	err = sqlitex.Execute(db.conn, `insert into "path_info" ("path", "nar_hash", "nar_size", "deriver", "registration_time", "ultimate", "ca") values (?, ?, ?, ?, ?, ?, ?);`, &sqlitex.ExecOptions{
+		Args: []any{string(info.Path), info.NARHash.Base32(), info.NARSize, deriver, regTime, info.Ultimate, ca},
+	})
+	if err != nil {
+		return fmt.Errorf("record %s info: %v", info.Path, err)
+	}
+	for _, ref := range info.References {
+		err := sqlitex.Execute(db.conn, `insert into "path_references" ("path", "reference") values (?, ?) on conflict do nothing;`, &sqlitex.ExecOptions{
+			Args: []any{string(info.Path), string(ref)},
+		})
+		if err != nil {
+			return fmt.Errorf("record %s info: %v", info.Path, err)
+		}
+	}
+	for _, sig := range info.Signatures {
+		err := sqlitex.Execute(db.conn, `insert into "path_signatures" ("path", "signature") values (?, ?) on conflict do nothing;`, &sqlitex.ExecOptions{
+			Args: []any{string(info.Path), sig.String()},
+		})
+		if err != nil {
+			return fmt.Errorf("record %s info: %v", info.Path, err)
+		}
+	}
+	return nil
+}
+
+// PathInfo returns the metadata recorded for a store object.
+// If no metadata has been recorded, PathInfo returns an error
+// that wraps [ErrNotFound].
+func (db *DB) PathInfo(ctx context.Context, path nix.StorePath) (_ *PathInfo, err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	var info *PathInfo
+	err = sqlitex.Execute(db.conn, `select "nar_hash", "nar_size", "deriver", "registration_time", "ultimate", `+
+		`(select group_concat("signature", ' ') from "path_signatures" where "path_signatures"."path" = "path_info"."path"), `+
+		`"ca" from "path_info" where "path" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{string(path)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			var err error
+			info, err = scanPathInfo(path, stmt, 0)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read %s info: %v", path, err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("read %s info: %w", path, ErrNotFound)
+	}
+	err = sqlitex.Execute(db.conn, `select "reference" from "path_references" where "path" = ? order by 1;`, &sqlitex.ExecOptions{
+		Args: []any{string(path)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			info.References = append(info.References, nix.StorePath(stmt.ColumnText(0)))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read %s info: %v", path, err)
+	}
+	return info, nil
+}
+
+// Referrers returns the recorded store objects that refer to path.
+func (db *DB) Referrers(ctx context.Context, path nix.StorePath) ([]nix.StorePath, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var referrers []nix.StorePath
+	err := sqlitex.Execute(db.conn, `select "path" from "path_references" where "reference" = ? and "path" <> "reference" order by 1;`, &sqlitex.ExecOptions{
+		Args: []any{string(path)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			referrers = append(referrers, nix.StorePath(stmt.ColumnText(0)))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query %s referrers: %v", path, err)
+	}
+	return referrers, nil
+}
+
+func deletePathInfo(conn *sqlite.Conn, path nix.StorePath) error {
+	for _, table := range []string{"path_info", "path_references", "path_signatures"} {
+		err := sqlitex.Execute(conn, `delete from "`+table+`" where "path" = ?;`, &sqlitex.ExecOptions{
+			Args: []any{string(path)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
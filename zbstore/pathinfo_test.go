@@ -0,0 +1,295 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	testHelloPath   nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"
+	testGlibcPath   nix.StorePath = "/nix/store/00000000000000000000000000000000-glibc"
+	testDeriverPath nix.StorePath = "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv"
+	testNARHash                   = "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s"
+	testSignature                 = "cache.nixos.org-1:TsTTb3WGTZKphvYdBHXwo6weVILmTytUjLB+vcX89fOjjRicCHmKA4RCPMVLkj6TMJ4GMX3HPVWRdD1hkeKZBQ=="
+)
+
+var pathInfoCompareOptions = cmp.Options{
+	cmp.Comparer(func(h1, h2 nix.Hash) bool { return h1.Equal(h2) }),
+	cmp.Comparer(func(ca1, ca2 nix.ContentAddress) bool { return ca1.Equal(ca2) }),
+	cmp.Comparer(func(s1, s2 *nix.Signature) bool { return s1.String() == s2.String() }),
+}
+
+func testPathInfo(tb testing.TB) *PathInfo {
+	tb.Helper()
+	h, err := nix.ParseHash(testNARHash)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sig, err := nix.ParseSignature(testSignature)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &PathInfo{
+		Path:             testHelloPath,
+		NARHash:          h,
+		NARSize:          226560,
+		References:       []nix.StorePath{testGlibcPath, testHelloPath},
+		Deriver:          testDeriverPath,
+		RegistrationTime: time.Unix(1700000000, 0),
+		Signatures:       []*nix.Signature{sig},
+	}
+}
+
+func TestParseDumpDB(t *testing.T) {
+	want := testPathInfo(t)
+	want.RegistrationTime = time.Time{}
+	want.Signatures = nil
+	out := string(want.Path) + "\n" +
+		want.NARHash.RawBase16() + "\n" +
+		"226560\n" +
+		string(want.Deriver) + "\n" +
+		"2\n" +
+		string(testHelloPath) + "\n" +
+		string(testGlibcPath) + "\n"
+	got, err := parseDumpDB([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*PathInfo{want}, got, pathInfoCompareOptions); diff != "" {
+		t.Errorf("parseDumpDB(...) (-want +got):\n%s", diff)
+	}
+}
+
+// fakeNixSchema is the subset of the Nix database schema that zbstore reads.
+const fakeNixSchema = `
+	create table ValidPaths (
+		id integer primary key autoincrement not null,
+		path text unique not null,
+		hash text not null,
+		registrationTime integer not null,
+		deriver text,
+		narSize integer,
+		ultimate integer,
+		sigs text,
+		ca text
+	);
+	create table Refs (
+		referrer integer not null,
+		reference integer not null,
+		primary key (referrer, reference)
+	);
+`
+
+// writeFakeNixDB creates a Nix database at path
+// and runs the given script against it.
+func writeFakeNixDB(tb testing.TB, path string, script string, args map[string]any) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite, sqlite.OpenCreate)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = sqlitex.ExecuteScript(conn, fakeNixSchema+script, &sqlitex.ExecOptions{Named: args})
+	conn.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// A testNixStore is a store with a single object
+// registered in a fake Nix database.
+type testNixStore struct {
+	dir     nix.StoreDirectory
+	path    nix.StorePath
+	nar     []byte
+	narHash nix.Hash
+}
+
+// newTestNixStore creates a store in a temporary directory
+// with the object "1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"
+// and sets NIX_STATE_DIR to a fake Nix database that registers it.
+// populate creates the object's files at the given path.
+// If populate is nil, the object is a file containing "Hello, World!\n".
+func newTestNixStore(tb testing.TB, populate func(path string) error) *testNixStore {
+	tb.Helper()
+	storeDir, err := nix.CleanStoreDirectory(filepath.Join(tb.TempDir(), "store"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	path, err := storeDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.MkdirAll(string(storeDir), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	if populate == nil {
+		populate = func(path string) error {
+			return os.WriteFile(path, []byte("Hello, World!\n"), 0o644)
+		}
+	}
+	if err := populate(string(path)); err != nil {
+		tb.Fatal(err)
+	}
+	narData := new(bytes.Buffer)
+	if err := nar.DumpPath(narData, string(path)); err != nil {
+		tb.Fatal(err)
+	}
+	narHasher := nix.NewHasher(nix.SHA256)
+	narHasher.Write(narData.Bytes())
+	narHash := narHasher.SumHash()
+
+	stateDir := tb.TempDir()
+	tb.Setenv("NIX_STATE_DIR", stateDir)
+	writeFakeNixDB(tb, filepath.Join(stateDir, "db", "db.sqlite"), `
+		insert into ValidPaths (id, path, hash, registrationTime, narSize) values (1, :path, :hash, 1700000000, :size);
+	`, map[string]any{
+		":path": string(path),
+		":hash": "sha256:" + narHash.RawBase16(),
+		":size": narData.Len(),
+	})
+	return &testNixStore{
+		dir:     storeDir,
+		path:    path,
+		nar:     narData.Bytes(),
+		narHash: narHash,
+	}
+}
+
+func TestReadNixPathInfo(t *testing.T) {
+	ctx := context.Background()
+	want := testPathInfo(t)
+	want.Ultimate = true
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	conn, err := sqlite.OpenConn(dbPath, sqlite.OpenReadWrite, sqlite.OpenCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.ExecuteScript(conn, fakeNixSchema+`
+		insert into ValidPaths (id, path, hash, registrationTime, narSize) values (1, :glibc, :hash, 1600000000, 1000);
+		insert into ValidPaths (id, path, hash, registrationTime, deriver, narSize, ultimate, sigs)
+			values (2, :hello, :hash, 1700000000, :deriver, 226560, 1, :sig);
+		insert into Refs values (2, 1), (2, 2);
+	`, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":glibc":   string(testGlibcPath),
+			":hello":   string(testHelloPath),
+			":hash":    "sha256:" + want.NARHash.RawBase16(),
+			":deriver": string(testDeriverPath),
+			":sig":     testSignature,
+		},
+	})
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readNixPathInfo(ctx, dbPath, testHelloPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+		t.Errorf("readNixPathInfo(...) (-want +got):\n%s", diff)
+	}
+
+	if _, err := readNixPathInfo(ctx, dbPath, "/nix/store/22222222222222222222222222222222-missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("readNixPathInfo(missing) error = %v; want %v", err, ErrNotFound)
+	}
+}
+
+func TestQueryPathInfoLower(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("NIX_STATE_DIR", "/nix/var/nix")
+	newRoot := func(path nix.StorePath, registrationTime int64) string {
+		t.Helper()
+		root := t.TempDir()
+		writeFakeNixDB(t, filepath.Join(root, "nix", "var", "nix", "db", "db.sqlite"), `
+			insert into ValidPaths (id, path, hash, registrationTime) values (1, :path, :hash, :time);
+		`, map[string]any{
+			":path": string(path),
+			":hash": testNARHash,
+			":time": registrationTime,
+		})
+		return root
+	}
+	store := &Store{
+		Root: newRoot(testHelloPath, 1700000000),
+		Lower: &Store{
+			Root: newRoot(testGlibcPath, 1600000000),
+		},
+		UpperLayer: t.TempDir(),
+	}
+
+	for _, p := range []nix.StorePath{testHelloPath, testGlibcPath} {
+		info, err := store.QueryPathInfo(ctx, p)
+		if err != nil {
+			t.Errorf("QueryPathInfo(ctx, %q): %v", p, err)
+		} else if info.Path != p {
+			t.Errorf("QueryPathInfo(ctx, %q).Path = %q", p, info.Path)
+		}
+	}
+	const missingPath nix.StorePath = "/nix/store/22222222222222222222222222222222-missing"
+	if _, err := store.QueryPathInfo(ctx, missingPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("QueryPathInfo(ctx, missing) error = %v; want %v", err, ErrNotFound)
+	}
+
+	infos, err := store.QueryPathInfos(ctx, testHelloPath, missingPath, testGlibcPath)
+	if err != nil {
+		t.Fatal("QueryPathInfos:", err)
+	}
+	var got []nix.StorePath
+	for _, info := range infos {
+		got = append(got, info.Path)
+	}
+	want := []nix.StorePath{testHelloPath, testGlibcPath}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("QueryPathInfos(...) paths (-want +got):\n%s", diff)
+	}
+}
+
+func TestDBPathInfo(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	want := testPathInfo(t)
+	if err := db.RecordPathInfo(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.PathInfo(ctx, want.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+		t.Errorf("db.PathInfo(...) (-want +got):\n%s", diff)
+	}
+
+	referrers, err := db.Referrers(ctx, testGlibcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]nix.StorePath{testHelloPath}, referrers); diff != "" {
+		t.Errorf("db.Referrers(...) (-want +got):\n%s", diff)
+	}
+
+	if err := db.Forget(ctx, want.Path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PathInfo(ctx, want.Path); !errors.Is(err, ErrNotFound) {
+		t.Errorf("db.PathInfo(...) after Forget error = %v; want %v", err, ErrNotFound)
+	}
+}
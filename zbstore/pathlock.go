@@ -0,0 +1,162 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+)
+
+// PathLock is a set of exclusive locks on store paths
+// acquired with [Store.LockPaths].
+type PathLock struct {
+	locks []*fileLock
+}
+
+// LockPaths acquires exclusive locks on the given store paths,
+// waiting for any other process that holds one of them
+// until it releases the lock or ctx is done.
+// A path does not need to be valid to be locked:
+// holding the lock is what allows a process to write a store object
+// without another zb process, nix-store, or nix-daemon writing it at the same time.
+// The locks are held on lock files next to the store objects
+// (the store path followed by ".lock")
+// using the same protocol as Nix.
+// Paths are locked in sorted order so that concurrent callers do not deadlock.
+// The caller is responsible for calling [PathLock.Unlock].
+func (s *Store) LockPaths(ctx context.Context, paths ...nix.StorePath) (*PathLock, error) {
+	paths = slices.Clone(paths)
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+	pl := new(PathLock)
+	for _, p := range paths {
+		l, err := lockFile(ctx, s.RealPath(string(p))+".lock")
+		if err != nil {
+			pl.Unlock()
+			return nil, fmt.Errorf("lock %s: %w", p, err)
+		}
+		pl.locks = append(pl.locks, l)
+	}
+	return pl, nil
+}
+
+// Unlock releases the locks and removes their lock files.
+func (pl *PathLock) Unlock() error {
+	var errs []error
+	for _, l := range pl.locks {
+		if err := l.unlock(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	pl.locks = nil
+	return errors.Join(errs...)
+}
+
+// Bounds on how often lockFile checks a lock held by another process.
+const (
+	lockPollMinDelay = 10 * time.Millisecond
+	lockPollMaxDelay = 1 * time.Second
+)
+
+// fileLock is an exclusive lock on a lock file.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile acquires an exclusive lock on the lock file at path,
+// creating the file if necessary.
+// If another process holds the lock,
+// lockFile logs the holder (see [lockHolder])
+// and checks again with increasing delays until the lock is released or ctx is done.
+// Lock files removed by their previous holder are stale
+// (see [fileLock.unlock]),
+// so lockFile opens the path again when it acquires one.
+// Locks are released when the process that holds them exits,
+// so a process that crashes cannot leave a lock held.
+func lockFile(ctx context.Context, path string) (*fileLock, error) {
+	delay := lockPollMinDelay
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			if info.Size() == 0 {
+				return &fileLock{f: f}, nil
+			}
+			log.Debugf(ctx, "Lock file %s is stale; opening again", path)
+			f.Close()
+			continue
+		}
+		if !waiting {
+			if pid := lockHolder(f); pid > 0 {
+				log.Infof(ctx, "Waiting for lock on %s held by process %d", path, pid)
+			} else {
+				log.Infof(ctx, "Waiting for lock on %s", path)
+			}
+			waiting = true
+		}
+		f.Close()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		delay = min(delay*2, lockPollMaxDelay)
+	}
+}
+
+// unlock removes the lock file and releases the lock.
+// Like Nix, unlock writes a byte to the file after removing it
+// and before releasing the lock,
+// which tells processes waiting on the removed file that it is stale.
+func (l *fileLock) unlock() error {
+	removeErr := os.Remove(l.f.Name())
+	_, writeErr := l.f.Write([]byte("d"))
+	closeErr := l.f.Close()
+	return errors.Join(removeErr, writeErr, closeErr)
+}
+
+// parseProcLocks returns the ID of the process
+// that holds a flock lock on the file identified by fileID
+// (its device major and minor numbers in hexadecimal and its inode number,
+// like "fd:01:1234")
+// from the contents of Linux's /proc/locks,
+// or 0 if no process holds one.
+func parseProcLocks(data []byte, fileID string) int {
+	for _, line := range strings.Split(string(data), "\n") {
+		// Lines look like "1: FLOCK  ADVISORY  WRITE 1234 fd:01:5678 0 EOF".
+		// Processes waiting on a lock have "->" after the lock number.
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != fileID {
+			continue
+		}
+		if pid, err := strconv.Atoi(fields[4]); err == nil && pid > 0 {
+			return pid
+		}
+	}
+	return 0
+}
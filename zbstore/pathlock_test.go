@@ -0,0 +1,125 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestLockPaths(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("Lock files do not exclude other processes on", runtime.GOOS)
+	}
+	ctx := context.Background()
+	storeDir, err := nix.CleanStoreDirectory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Store{Dir: storeDir}
+	hello, err := storeDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := storeDir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := store.LockPaths(ctx, hello, lib, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []nix.StorePath{hello, lib} {
+		if _, err := os.Stat(string(p) + ".lock"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A second lock on either path waits for the first.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = store.LockPaths(timeoutCtx, lib)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LockPaths(ctx, %s) while locked = _, %v; want %v", lib, err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() {
+		lock2, err := store.LockPaths(ctx, hello)
+		if err == nil {
+			err = lock2.Unlock()
+		}
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := lock.Unlock(); err != nil {
+		t.Error("Unlock:", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("LockPaths(ctx, %s) after Unlock: %v", hello, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("LockPaths(ctx, %s) did not return after Unlock", hello)
+	}
+	for _, p := range []nix.StorePath{hello, lib} {
+		if _, err := os.Stat(string(p) + ".lock"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("after Unlock, os.Stat(%q) = _, %v; want %v", string(p)+".lock", err, os.ErrNotExist)
+		}
+	}
+}
+
+func TestLockFileHolder(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Lock holders are only reported on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "x.lock")
+	lock, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if ok, err := tryLockFile(f); err != nil || ok {
+		t.Fatalf("tryLockFile(f) = %t, %v; want false, <nil>", ok, err)
+	}
+	if got, want := lockHolder(f), os.Getpid(); got != want {
+		t.Errorf("lockHolder(f) = %d; want %d", got, want)
+	}
+}
+
+func TestParseProcLocks(t *testing.T) {
+	const procLocks = "1: POSIX  ADVISORY  WRITE 100 fd:01:1234 0 EOF\n" +
+		"2: FLOCK  ADVISORY  WRITE 200 fd:01:5678 0 EOF\n" +
+		"2: -> FLOCK  ADVISORY  WRITE 300 fd:01:5678 0 EOF\n" +
+		"3: OFDLCK ADVISORY  READ  -1 00:05:42 0 EOF\n"
+	tests := []struct {
+		fileID string
+		want   int
+	}{
+		{"fd:01:5678", 200},
+		{"fd:01:1234", 0},
+		{"00:05:42", 0},
+		{"fd:01:9999", 0},
+	}
+	for _, test := range tests {
+		if got := parseProcLocks([]byte(procLocks), test.fileID); got != test.want {
+			t.Errorf("parseProcLocks(..., %q) = %d; want %d", test.fileID, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/dns/dnsmessage"
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// peerServiceName is the DNS-SD service type
+// under which binary caches are advertised on the local network.
+const peerServiceName = "_zb-cache._tcp.local."
+
+// mdnsAddr is the IPv4 multicast DNS group address.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// A PeerAdvertisement describes a binary cache
+// (usually a [BinaryCache] being served over HTTP)
+// to advertise on the local network with [AdvertisePeer].
+type PeerAdvertisement struct {
+	// Port is the TCP port that the cache is served on.
+	Port int
+	// StoreDir is the store directory of the cache's objects.
+	// If empty, [nix.DefaultStoreDirectory] is used.
+	StoreDir nix.StoreDirectory
+	// Instance is the name of the cache on the network.
+	// If empty, the host name is used.
+	Instance string
+}
+
+func (ad *PeerAdvertisement) storeDir() nix.StoreDirectory {
+	if ad.StoreDir == "" {
+		return nix.DefaultStoreDirectory
+	}
+	return ad.StoreDir
+}
+
+func (ad *PeerAdvertisement) instance() string {
+	if ad.Instance != "" {
+		return ad.Instance
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "zb"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return host
+}
+
+// AdvertisePeer answers multicast DNS queries for zb binary caches
+// on the local network with the given advertisement
+// until ctx is done.
+// Peers find advertised caches with [DiscoverPeers].
+// Advertising a cache does not make its objects trusted:
+// peers should only accept objects signed by keys they trust.
+func AdvertisePeer(ctx context.Context, ad *PeerAdvertisement) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return fmt.Errorf("advertise cache: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if stop() {
+			conn.Close()
+		}
+	}()
+	return servePeerQueries(ctx, conn, ad)
+}
+
+// servePeerQueries responds to the queries for zb binary caches
+// received on conn.
+// Responses are sent directly to the querier.
+func servePeerQueries(ctx context.Context, conn net.PacketConn, ad *PeerAdvertisement) error {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("advertise cache: %v", err)
+		}
+		resp, ok, err := peerResponse(buf[:n], ad)
+		if err != nil {
+			log.Debugf(ctx, "Ignoring multicast DNS message from %v: %v", src, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, src); err != nil {
+			log.Debugf(ctx, "Answering cache query from %v: %v", src, err)
+		}
+	}
+}
+
+// peerQuery returns a DNS query message for zb binary caches.
+func peerQuery(id uint16) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(peerServiceName),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// peerResponse returns the response to a DNS query message.
+// ok is false if the message is not a query for zb binary caches.
+func peerResponse(query []byte, ad *PeerAdvertisement) (resp []byte, ok bool, err error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, false, err
+	}
+	if hdr.Response {
+		return nil, false, nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, err
+	}
+	var q *dnsmessage.Question
+	for i := range questions {
+		if (questions[i].Type == dnsmessage.TypePTR || questions[i].Type == dnsmessage.TypeALL) &&
+			strings.EqualFold(questions[i].Name.String(), peerServiceName) {
+			q = &questions[i]
+			break
+		}
+	}
+	if q == nil {
+		return nil, false, nil
+	}
+
+	instanceName, err := dnsmessage.NewName(dnsLabel(ad.instance()) + "." + peerServiceName)
+	if err != nil {
+		return nil, false, err
+	}
+	targetName, err := dnsmessage.NewName(dnsLabel(ad.instance()) + ".local.")
+	if err != nil {
+		return nil, false, err
+	}
+	const ttl = 120
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            hdr.ID,
+		Response:      true,
+		Authoritative: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false, err
+	}
+	if err := b.Question(*q); err != nil {
+		return nil, false, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false, err
+	}
+	err = b.PTRResource(dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}, dnsmessage.PTRResource{PTR: instanceName})
+	if err != nil {
+		return nil, false, err
+	}
+	err = b.SRVResource(dnsmessage.ResourceHeader{
+		Name:  instanceName,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}, dnsmessage.SRVResource{Target: targetName, Port: uint16(ad.Port)})
+	if err != nil {
+		return nil, false, err
+	}
+	err = b.TXTResource(dnsmessage.ResourceHeader{
+		Name:  instanceName,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}, dnsmessage.TXTResource{TXT: []string{"dir=" + string(ad.storeDir())}})
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err = b.Finish()
+	return resp, err == nil, err
+}
+
+// dnsLabel replaces characters in s that are not valid in a DNS label.
+func dnsLabel(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' {
+			return c
+		}
+		return '-'
+	}, s)
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// A peerAnswer is the information about a cache in a response to [peerQuery].
+type peerAnswer struct {
+	port     int
+	storeDir nix.StoreDirectory
+}
+
+// parsePeerResponse parses a response to a query for zb binary caches.
+// ok is false if the message is not a response for the query with the given ID.
+func parsePeerResponse(msg []byte, id uint16) (_ peerAnswer, ok bool, err error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil {
+		return peerAnswer{}, false, err
+	}
+	if !hdr.Response || hdr.ID != id {
+		return peerAnswer{}, false, nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return peerAnswer{}, false, err
+	}
+	var ans peerAnswer
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return peerAnswer{}, false, err
+		}
+		switch h.Type {
+		case dnsmessage.TypeSRV:
+			srv, err := p.SRVResource()
+			if err != nil {
+				return peerAnswer{}, false, err
+			}
+			ans.port = int(srv.Port)
+		case dnsmessage.TypeTXT:
+			txt, err := p.TXTResource()
+			if err != nil {
+				return peerAnswer{}, false, err
+			}
+			for _, s := range txt.TXT {
+				if dir, ok := strings.CutPrefix(s, "dir="); ok {
+					ans.storeDir = nix.StoreDirectory(dir)
+				}
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return peerAnswer{}, false, err
+			}
+		}
+	}
+	if ans.port == 0 || ans.storeDir == "" {
+		return peerAnswer{}, false, fmt.Errorf("incomplete answer")
+	}
+	return ans, true, nil
+}
+
+// DiscoverPeers asks the local network for zb binary caches
+// advertised with [AdvertisePeer]
+// and returns the URLs of those that serve objects for the given store directory.
+// It collects responses until ctx is done,
+// so ctx should have a short deadline.
+func DiscoverPeers(ctx context.Context, dir nix.StoreDirectory) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "zbstore.DiscoverPeers")
+	defer func() { spans.End(span, err) }()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("discover peers: %v", err)
+	}
+	defer conn.Close()
+	peers, err := discoverPeers(ctx, conn, mdnsAddr, dir)
+	span.SetAttributes(attribute.Int("zb.peer.count", len(peers)))
+	return peers, err
+}
+
+func discoverPeers(ctx context.Context, conn *net.UDPConn, dst net.Addr, dir nix.StoreDirectory) ([]string, error) {
+	if dir == "" {
+		dir = nix.DefaultStoreDirectory
+	}
+	id := uint16(rand.N(1 << 16))
+	query, err := peerQuery(id)
+	if err != nil {
+		return nil, fmt.Errorf("discover peers: %v", err)
+	}
+	if _, err := conn.WriteTo(query, dst); err != nil {
+		return nil, fmt.Errorf("discover peers: %v", err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	var urls []string
+	seen := make(map[string]struct{})
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return urls, nil
+			}
+			return urls, fmt.Errorf("discover peers: %v", err)
+		}
+		ans, ok, err := parsePeerResponse(buf[:n], id)
+		if err != nil {
+			log.Debugf(ctx, "Ignoring response from %v: %v", src, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if ans.storeDir != dir {
+			log.Debugf(ctx, "Ignoring cache at %v: store directory is %s", src, ans.storeDir)
+			continue
+		}
+		u := "http://" + net.JoinHostPort(src.IP.String(), strconv.Itoa(ans.port))
+		if _, dup := seen[u]; !dup {
+			seen[u] = struct{}{}
+			urls = append(urls, u)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestDiscoverPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listen := func(t *testing.T) *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	serverConn := listen(t)
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- servePeerQueries(ctx, serverConn, &PeerAdvertisement{
+			Port:     8080,
+			StoreDir: "/zb/store",
+			Instance: "my.laptop",
+		})
+	}()
+	defer func() {
+		cancel()
+		serverConn.Close()
+		if err := <-serveDone; err != nil {
+			t.Error("servePeerQueries:", err)
+		}
+	}()
+
+	tests := []struct {
+		dir  nix.StoreDirectory
+		want []string
+	}{
+		{
+			dir:  "/zb/store",
+			want: []string{"http://127.0.0.1:8080"},
+		},
+		{
+			dir:  "/nix/store",
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		clientConn := listen(t)
+		discoverCtx, cancelDiscover := context.WithTimeout(ctx, 500*time.Millisecond)
+		got, err := discoverPeers(discoverCtx, clientConn, serverConn.LocalAddr(), test.dir)
+		cancelDiscover()
+		if err != nil {
+			t.Errorf("discoverPeers(ctx, conn, %v, %q): %v", serverConn.LocalAddr(), test.dir, err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("discoverPeers(ctx, conn, %v, %q) (-want +got):\n%s", serverConn.LocalAddr(), test.dir, diff)
+		}
+	}
+}
+
+func TestPeerResponse(t *testing.T) {
+	const id = 42
+	query, err := peerQuery(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := &PeerAdvertisement{Port: 1234, StoreDir: "/nix/store", Instance: "foo"}
+	resp, ok, err := peerResponse(query, ad)
+	if err != nil || !ok {
+		t.Fatalf("peerResponse(...) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	if _, ok, err := peerResponse(resp, ad); ok || err != nil {
+		t.Errorf("peerResponse(response) = _, %t, %v; want _, false, <nil>", ok, err)
+	}
+	if _, ok, _ := parsePeerResponse(resp, id+1); ok {
+		t.Error("parsePeerResponse accepted response with wrong ID")
+	}
+	got, ok, err := parsePeerResponse(resp, id)
+	if err != nil || !ok {
+		t.Fatalf("parsePeerResponse(...) = _, %t, %v; want _, true, <nil>", ok, err)
+	}
+	if want := (peerAnswer{port: 1234, storeDir: "/nix/store"}); got != want {
+		t.Errorf("parsePeerResponse(...) = %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// PeerCredentials returns the identity of the process
+// on the other end of a Unix socket connection.
+func PeerCredentials(conn net.Conn) (*Peer, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("peer credentials: %v is not a Unix socket", conn.RemoteAddr())
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("peer credentials: %v", err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("peer credentials: %v", err)
+	}
+	return &Peer{
+		PID: int(cred.Pid),
+		UID: int(cred.Uid),
+		GID: int(cred.Gid),
+	}, nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !linux
+
+package zbstore
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerCredentials returns the identity of the process
+// on the other end of a Unix socket connection.
+func PeerCredentials(conn net.Conn) (*Peer, error) {
+	return nil, fmt.Errorf("peer credentials: %w", errNoPeerCredentials)
+}
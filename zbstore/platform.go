@@ -0,0 +1,133 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"encoding/binary"
+	"runtime"
+	"strings"
+)
+
+// HostSystem returns the system type string (e.g. "x86_64-linux")
+// for the machine the current process is running on.
+// HostSystem returns the empty string
+// if the Go architecture or OS does not have a known equivalent.
+func HostSystem() string {
+	var arch string
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i686"
+	case "arm64":
+		arch = "aarch64"
+	case "arm":
+		arch = "armv7l"
+	case "riscv64":
+		arch = "riscv64"
+	default:
+		return ""
+	}
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "openbsd", "netbsd":
+		return arch + "-" + runtime.GOOS
+	default:
+		return ""
+	}
+}
+
+// CompatibleSystems returns the system types other than host
+// whose programs can run natively on a host of the given system type.
+// On Linux, this covers 32-bit programs on 64-bit hosts.
+// The build backend runs such derivations under a 32-bit personality
+// so that uname(2) reports the derivation's architecture,
+// and zb shell does the same with setarch(8) (see [Personality]).
+// Many 64-bit ARM processors cannot run 32-bit ARM programs,
+// so "armv7l-linux" is only included for an "aarch64-linux" host
+// if host is the running system and it has been found to support AArch32.
+func CompatibleSystems(host string) []string {
+	arch, os, ok := strings.Cut(host, "-")
+	if !ok || os != "linux" {
+		return nil
+	}
+	switch arch {
+	case "x86_64":
+		return []string{"i686-linux"}
+	case "aarch64":
+		if host != HostSystem() || !hostSupportsAArch32() {
+			return nil
+		}
+		return []string{"armv7l-linux"}
+	default:
+		return nil
+	}
+}
+
+// aarch32ProbeProgram returns a minimal statically linked 32-bit ARM ELF executable
+// that exits with status 0.
+// Running it reveals whether the host can execute 32-bit ARM programs.
+func aarch32ProbeProgram() []byte {
+	const (
+		headerSize        = 52
+		programHeaderSize = 32
+		codeOffset        = headerSize + programHeaderSize
+		baseAddress       = 0x10000
+	)
+	code := []uint32{
+		0xe3a00000, // mov r0, #0
+		0xe3a07001, // mov r7, #1 (exit)
+		0xef000000, // svc #0
+	}
+	size := uint32(codeOffset + 4*len(code))
+
+	le := binary.LittleEndian
+	b := []byte{0x7f, 'E', 'L', 'F', 1 /* 32-bit */, 1 /* little-endian */, 1 /* version */}
+	b = append(b, make([]byte, 16-len(b))...)
+	b = le.AppendUint16(b, 2)                      // e_type = ET_EXEC
+	b = le.AppendUint16(b, 40)                     // e_machine = EM_ARM
+	b = le.AppendUint32(b, 1)                      // e_version
+	b = le.AppendUint32(b, baseAddress+codeOffset) // e_entry
+	b = le.AppendUint32(b, headerSize)             // e_phoff
+	b = le.AppendUint32(b, 0)                      // e_shoff
+	b = le.AppendUint32(b, 0x05000000)             // e_flags = EABI version 5
+	b = le.AppendUint16(b, headerSize)             // e_ehsize
+	b = le.AppendUint16(b, programHeaderSize)      // e_phentsize
+	b = le.AppendUint16(b, 1)                      // e_phnum
+	b = le.AppendUint16(b, 0)                      // e_shentsize
+	b = le.AppendUint16(b, 0)                      // e_shnum
+	b = le.AppendUint16(b, 0)                      // e_shstrndx
+	b = le.AppendUint32(b, 1)                      // p_type = PT_LOAD
+	b = le.AppendUint32(b, 0)                      // p_offset
+	b = le.AppendUint32(b, baseAddress)            // p_vaddr
+	b = le.AppendUint32(b, baseAddress)            // p_paddr
+	b = le.AppendUint32(b, size)                   // p_filesz
+	b = le.AppendUint32(b, size)                   // p_memsz
+	b = le.AppendUint32(b, 5)                      // p_flags = PF_R | PF_X
+	b = le.AppendUint32(b, 0x1000)                 // p_align
+	for _, insn := range code {
+		b = le.AppendUint32(b, insn)
+	}
+	return b
+}
+
+// Personality returns the machine name that uname(2) should report
+// when building a derivation for system on a host of type host,
+// as accepted by setarch(8).
+// ok is false if no personality change is needed or none is known.
+func Personality(host, system string) (machine string, ok bool) {
+	if host == system {
+		return "", false
+	}
+	switch system {
+	case "i686-linux":
+		if host == "x86_64-linux" {
+			return "i686", true
+		}
+	case "armv7l-linux":
+		if host == "aarch64-linux" {
+			return "armv7l", true
+		}
+	}
+	return "", false
+}
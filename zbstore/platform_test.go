@@ -0,0 +1,75 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompatibleSystems(t *testing.T) {
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{host: "x86_64-linux", want: []string{"i686-linux"}},
+		{host: "aarch64-linux", want: nil},
+		{host: "i686-linux", want: nil},
+		{host: "aarch64-darwin", want: nil},
+		{host: "", want: nil},
+	}
+	if HostSystem() == "aarch64-linux" && hostSupportsAArch32() {
+		tests[1].want = []string{"armv7l-linux"}
+	}
+	for _, test := range tests {
+		if got := CompatibleSystems(test.host); !cmp.Equal(test.want, got) {
+			t.Errorf("CompatibleSystems(%q) = %q; want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestAArch32ProbeProgram(t *testing.T) {
+	f, err := elf.NewFile(bytes.NewReader(aarch32ProbeProgram()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Class != elf.ELFCLASS32 || f.Data != elf.ELFDATA2LSB || f.Machine != elf.EM_ARM || f.Type != elf.ET_EXEC {
+		t.Errorf("header = %+v; want 32-bit little-endian ARM executable", f.FileHeader)
+	}
+	if len(f.Progs) != 1 {
+		t.Fatalf("len(f.Progs) = %d; want 1", len(f.Progs))
+	}
+	prog := f.Progs[0]
+	if prog.Type != elf.PT_LOAD || prog.Flags != elf.PF_R|elf.PF_X {
+		t.Errorf("program header = %+v; want loadable and executable", prog.ProgHeader)
+	}
+	if f.Entry < prog.Vaddr || f.Entry >= prog.Vaddr+prog.Memsz {
+		t.Errorf("entry point %#x outside of segment [%#x, %#x)", f.Entry, prog.Vaddr, prog.Vaddr+prog.Memsz)
+	}
+}
+
+func TestPersonality(t *testing.T) {
+	tests := []struct {
+		host    string
+		system  string
+		machine string
+		ok      bool
+	}{
+		{host: "x86_64-linux", system: "x86_64-linux", ok: false},
+		{host: "x86_64-linux", system: "i686-linux", machine: "i686", ok: true},
+		{host: "aarch64-linux", system: "armv7l-linux", machine: "armv7l", ok: true},
+		{host: "aarch64-linux", system: "i686-linux", ok: false},
+		{host: "x86_64-linux", system: "builtin", ok: false},
+	}
+	for _, test := range tests {
+		machine, ok := Personality(test.host, test.system)
+		if machine != test.machine || ok != test.ok {
+			t.Errorf("Personality(%q, %q) = %q, %t; want %q, %t", test.host, test.system, machine, ok, test.machine, test.ok)
+		}
+	}
+}
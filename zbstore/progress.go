@@ -0,0 +1,291 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"zombiezen.com/go/nix"
+)
+
+// BuildEventKind is the type of a [BuildEvent].
+type BuildEventKind int
+
+// Build event kinds.
+const (
+	// BuildStarted is sent when a derivation's builder starts.
+	// The event's DrvPath is set.
+	BuildStarted BuildEventKind = 1 + iota
+	// BuildFinished is sent when a derivation's builder exits,
+	// whether or not it succeeded.
+	BuildFinished
+	// BuildLog is sent for each line that a builder writes.
+	// The event's Text is the line without a trailing newline.
+	BuildLog
+	// BuildPhase is sent when a builder starts a new phase
+	// (like "buildPhase"), which is in the event's Text.
+	BuildPhase
+	// DownloadStarted is sent when a store object starts being substituted.
+	// The event's StorePath is set.
+	DownloadStarted
+	// DownloadFinished is sent when a substitution ends,
+	// whether or not it succeeded.
+	DownloadFinished
+	// Progress is sent when the counts of builds or downloads change.
+	// The event's Done, Expected, Running, and Failed are set,
+	// and either DrvPath or StorePath is set for progress of a single activity
+	// or neither is set for overall build progress.
+	Progress
+	// Message is sent for diagnostics from the backend,
+	// like errors explaining why a build failed.
+	// The event's Text is the message.
+	Message
+)
+
+// String returns the name of the kind.
+func (k BuildEventKind) String() string {
+	switch k {
+	case BuildStarted:
+		return "BuildStarted"
+	case BuildFinished:
+		return "BuildFinished"
+	case BuildLog:
+		return "BuildLog"
+	case BuildPhase:
+		return "BuildPhase"
+	case DownloadStarted:
+		return "DownloadStarted"
+	case DownloadFinished:
+		return "DownloadFinished"
+	case Progress:
+		return "Progress"
+	case Message:
+		return "Message"
+	default:
+		return fmt.Sprintf("BuildEventKind(%d)", int(k))
+	}
+}
+
+// A BuildEvent is a notification of progress during [Store.Realise].
+type BuildEvent struct {
+	Kind BuildEventKind
+	// ID identifies the build or download that the event pertains to.
+	// Events for the same build or download have the same ID.
+	ID uint64
+	// DrvPath is the derivation being built.
+	DrvPath nix.StorePath
+	// StorePath is the store object being downloaded.
+	StorePath nix.StorePath
+	// Text is the log line, build phase, or message.
+	Text string
+	// Error is true for a Message event that reports an error.
+	Error bool
+	// Done, Expected, Running, and Failed are counts for a Progress event.
+	// For overall progress, they count derivations.
+	// For downloads, Done and Expected count bytes.
+	Done     int64
+	Expected int64
+	Running  int64
+	Failed   int64
+}
+
+// plainLog returns a callback that writes the log lines and messages
+// of [BuildEvent] values to w, like the backend's default log format.
+func plainLog(w io.Writer) func(*BuildEvent) {
+	return func(ev *BuildEvent) {
+		if ev.Kind == BuildLog || ev.Kind == Message {
+			fmt.Fprintln(w, ev.Text)
+		}
+	}
+}
+
+// Activity and result types in the backend's internal-json log format.
+const (
+	nixActivityFileTransfer = 101
+	nixActivityBuilds       = 104
+	nixActivityBuild        = 105
+	nixActivitySubstitute   = 108
+
+	nixResultBuildLogLine = 101
+	nixResultSetPhase     = 104
+	nixResultProgress     = 105
+
+	nixLevelError = 0
+)
+
+// nixLogPrefix starts each line of the backend's internal-json log format.
+const nixLogPrefix = "@nix "
+
+// nixLogEntry is a line of the backend's internal-json log format.
+type nixLogEntry struct {
+	Action string            `json:"action"`
+	ID     uint64            `json:"id"`
+	Parent uint64            `json:"parent"`
+	Level  int               `json:"level"`
+	Type   int               `json:"type"`
+	Text   string            `json:"text"`
+	Msg    string            `json:"msg"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+func (entry *nixLogEntry) stringField(i int) string {
+	if i >= len(entry.Fields) {
+		return ""
+	}
+	var s string
+	json.Unmarshal(entry.Fields[i], &s)
+	return s
+}
+
+func (entry *nixLogEntry) intField(i int) int64 {
+	if i >= len(entry.Fields) {
+		return 0
+	}
+	var n int64
+	json.Unmarshal(entry.Fields[i], &n)
+	return n
+}
+
+// nixActivity is a running activity from the backend's log.
+type nixActivity struct {
+	typ       int
+	parent    uint64
+	drvPath   nix.StorePath
+	storePath nix.StorePath
+}
+
+// progressWriter is an [io.Writer] that parses the backend's internal-json log format
+// and sends the corresponding [BuildEvent] values to a callback.
+// Lines that are not in the log format are written to an underlying writer.
+type progressWriter struct {
+	progress   func(*BuildEvent)
+	other      io.Writer
+	buf        []byte
+	activities map[uint64]*nixActivity
+}
+
+func newProgressWriter(progress func(*BuildEvent), other io.Writer) *progressWriter {
+	return &progressWriter{
+		progress:   progress,
+		other:      other,
+		activities: make(map[uint64]*nixActivity),
+	}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		pw.line(pw.buf[:i])
+		pw.buf = pw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush processes any incomplete final line.
+func (pw *progressWriter) Flush() {
+	if len(pw.buf) > 0 {
+		pw.line(pw.buf)
+		pw.buf = nil
+	}
+}
+
+func (pw *progressWriter) line(line []byte) {
+	rest, ok := bytes.CutPrefix(line, []byte(nixLogPrefix))
+	if !ok {
+		pw.other.Write(append(line[:len(line):len(line)], '\n'))
+		return
+	}
+	entry := new(nixLogEntry)
+	if err := json.Unmarshal(rest, entry); err != nil {
+		pw.other.Write(append(line[:len(line):len(line)], '\n'))
+		return
+	}
+	if ev := pw.event(entry); ev != nil {
+		pw.progress(ev)
+	}
+}
+
+// event updates the writer's state with the log entry
+// and returns the corresponding event, if any.
+func (pw *progressWriter) event(entry *nixLogEntry) *BuildEvent {
+	switch entry.Action {
+	case "msg":
+		return &BuildEvent{
+			Kind:  Message,
+			Text:  entry.Msg,
+			Error: entry.Level == nixLevelError,
+		}
+	case "start":
+		act := &nixActivity{typ: entry.Type, parent: entry.Parent}
+		pw.activities[entry.ID] = act
+		switch entry.Type {
+		case nixActivityBuild:
+			act.drvPath, _ = nix.ParseStorePath(entry.stringField(0))
+			return &BuildEvent{Kind: BuildStarted, ID: entry.ID, DrvPath: act.drvPath}
+		case nixActivitySubstitute:
+			act.storePath, _ = nix.ParseStorePath(entry.stringField(0))
+			return &BuildEvent{Kind: DownloadStarted, ID: entry.ID, StorePath: act.storePath}
+		case nixActivityFileTransfer:
+			// Attribute a download's transfer to the substitution it's part of.
+			if parent := pw.activities[entry.Parent]; parent != nil && parent.typ == nixActivitySubstitute {
+				act.storePath = parent.storePath
+			}
+		}
+		return nil
+	case "stop":
+		act := pw.activities[entry.ID]
+		delete(pw.activities, entry.ID)
+		if act == nil {
+			return nil
+		}
+		switch act.typ {
+		case nixActivityBuild:
+			return &BuildEvent{Kind: BuildFinished, ID: entry.ID, DrvPath: act.drvPath}
+		case nixActivitySubstitute:
+			return &BuildEvent{Kind: DownloadFinished, ID: entry.ID, StorePath: act.storePath}
+		}
+		return nil
+	case "result":
+		act := pw.activities[entry.ID]
+		if act == nil {
+			return nil
+		}
+		switch {
+		case entry.Type == nixResultBuildLogLine && act.typ == nixActivityBuild:
+			return &BuildEvent{Kind: BuildLog, ID: entry.ID, DrvPath: act.drvPath, Text: entry.stringField(0)}
+		case entry.Type == nixResultSetPhase && act.typ == nixActivityBuild:
+			return &BuildEvent{Kind: BuildPhase, ID: entry.ID, DrvPath: act.drvPath, Text: entry.stringField(0)}
+		case entry.Type == nixResultProgress:
+			ev := &BuildEvent{
+				Kind:     Progress,
+				Done:     entry.intField(0),
+				Expected: entry.intField(1),
+				Running:  entry.intField(2),
+				Failed:   entry.intField(3),
+			}
+			switch act.typ {
+			case nixActivityBuilds:
+			case nixActivityFileTransfer:
+				if act.storePath == "" {
+					return nil
+				}
+				ev.ID = act.parent
+				ev.StorePath = act.storePath
+			default:
+				return nil
+			}
+			return ev
+		}
+		return nil
+	default:
+		return nil
+	}
+}
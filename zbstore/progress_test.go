@@ -0,0 +1,64 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProgressWriter(t *testing.T) {
+	const (
+		drvPath  = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello.drv"
+		openssl  = "/nix/store/00000000000000000000000000000000-openssl"
+		cacheURL = "https://cache.example.com"
+	)
+	log := `@nix {"action":"start","id":1,"level":0,"type":104,"text":"","fields":[],"parent":0}` + "\n" +
+		`@nix {"action":"start","id":2,"level":3,"type":108,"text":"copying path","fields":["` + openssl + `","` + cacheURL + `"],"parent":1}` + "\n" +
+		`@nix {"action":"start","id":3,"level":4,"type":101,"text":"downloading","fields":["` + cacheURL + `/nar/x.nar.xz"],"parent":2}` + "\n" +
+		`@nix {"action":"result","id":3,"type":105,"fields":[512,1024,0,0]}` + "\n" +
+		`@nix {"action":"stop","id":3}` + "\n" +
+		`@nix {"action":"stop","id":2}` + "\n" +
+		`@nix {"action":"start","id":4,"level":3,"type":105,"text":"building","fields":["` + drvPath + `","",1,1],"parent":1}` + "\n" +
+		`@nix {"action":"result","id":4,"type":104,"fields":["buildPhase"]}` + "\n" +
+		`@nix {"action":"result","id":4,"type":101,"fields":["make: Nothing to be done."]}` + "\n" +
+		"not a log entry\n" +
+		`@nix {"action":"result","id":1,"type":105,"fields":[0,1,1,0]}` + "\n" +
+		`@nix {"action":"stop","id":4}` + "\n" +
+		`@nix {"action":"msg","level":0,"msg":"error: build failed"}` + "\n" +
+		`@nix {"action":"stop","id":1}`
+
+	var got []*BuildEvent
+	other := new(strings.Builder)
+	pw := newProgressWriter(func(ev *BuildEvent) { got = append(got, ev) }, other)
+	// Write in small pieces to exercise line buffering.
+	for len(log) > 0 {
+		n := min(len(log), 17)
+		if _, err := pw.Write([]byte(log[:n])); err != nil {
+			t.Fatal(err)
+		}
+		log = log[n:]
+	}
+	pw.Flush()
+
+	want := []*BuildEvent{
+		{Kind: DownloadStarted, ID: 2, StorePath: openssl},
+		{Kind: Progress, ID: 2, StorePath: openssl, Done: 512, Expected: 1024},
+		{Kind: DownloadFinished, ID: 2, StorePath: openssl},
+		{Kind: BuildStarted, ID: 4, DrvPath: drvPath},
+		{Kind: BuildPhase, ID: 4, DrvPath: drvPath, Text: "buildPhase"},
+		{Kind: BuildLog, ID: 4, DrvPath: drvPath, Text: "make: Nothing to be done."},
+		{Kind: Progress, Expected: 1, Running: 1},
+		{Kind: BuildFinished, ID: 4, DrvPath: drvPath},
+		{Kind: Message, Text: "error: build failed", Error: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("events (-want +got):\n%s", diff)
+	}
+	if got, want := other.String(), "not a log entry\n"; got != want {
+		t.Errorf("other output = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Identifiers used in provenance statements.
+const (
+	InTotoStatementType   = "https://in-toto.io/Statement/v1"
+	SLSAProvenanceType    = "https://slsa.dev/provenance/v1"
+	ProvenanceBuildType   = "https://zombiezen.com/zb/build/v1"
+	InTotoPayloadType     = "application/vnd.in-toto+json"
+	defaultProvenanceHost = "zb"
+)
+
+// A Statement is an in-toto attestation statement
+// whose predicate is SLSA build provenance.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+// A ResourceDescriptor identifies an artifact by name and digest.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs to a build.
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]any       `json:"externalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// RunDetails describes who performed a build and when.
+type RunDetails struct {
+	Builder  ProvenanceBuilder  `json:"builder"`
+	Metadata ProvenanceMetadata `json:"metadata"`
+}
+
+// ProvenanceBuilder identifies the entity that performed a build.
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+// ProvenanceMetadata holds a build's timestamps.
+type ProvenanceMetadata struct {
+	InvocationID string    `json:"invocationId,omitempty"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// ProvenanceOptions is the information about a build
+// that [NewProvenanceStatement] records.
+type ProvenanceOptions struct {
+	// Realizations are the derivation outputs the build produced.
+	// They must all be from the same derivation.
+	Realizations []*Realization
+	// OutputHashes are the NAR hashes of the realizations' output paths.
+	OutputHashes map[nix.StorePath]nix.Hash
+	// Inputs are the store paths the derivation depended on.
+	Inputs []nix.StorePath
+	// BuilderID identifies the machine or service that performed the build.
+	BuilderID string
+	// StartedOn and FinishedOn are the times the build began and ended.
+	StartedOn  time.Time
+	FinishedOn time.Time
+}
+
+// NewProvenanceStatement returns a SLSA provenance statement
+// for the outputs of a single derivation.
+func NewProvenanceStatement(opts *ProvenanceOptions) (*Statement, error) {
+	if len(opts.Realizations) == 0 {
+		return nil, fmt.Errorf("new provenance statement: no realizations")
+	}
+	first := opts.Realizations[0]
+	stmt := &Statement{
+		Type:          InTotoStatementType,
+		PredicateType: SLSAProvenanceType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType: ProvenanceBuildType,
+				ExternalParameters: map[string]any{
+					"derivation": string(first.DrvPath),
+				},
+				ResolvedDependencies: []ResourceDescriptor{{
+					URI:    string(first.DrvPath),
+					Digest: hashDigest(first.ID.DrvHash),
+				}},
+			},
+			RunDetails: RunDetails{
+				Builder: ProvenanceBuilder{ID: opts.BuilderID},
+				Metadata: ProvenanceMetadata{
+					StartedOn:  opts.StartedOn.UTC(),
+					FinishedOn: opts.FinishedOn.UTC(),
+				},
+			},
+		},
+	}
+	if stmt.Predicate.RunDetails.Builder.ID == "" {
+		stmt.Predicate.RunDetails.Builder.ID = defaultProvenanceHost
+	}
+	for _, r := range opts.Realizations {
+		if !r.ID.DrvHash.Equal(first.ID.DrvHash) {
+			return nil, fmt.Errorf("new provenance statement: realizations are from different derivations")
+		}
+		h, ok := opts.OutputHashes[r.OutPath]
+		if !ok {
+			return nil, fmt.Errorf("new provenance statement: missing hash for %s", r.OutPath)
+		}
+		stmt.Subject = append(stmt.Subject, ResourceDescriptor{
+			Name:   string(r.OutPath),
+			Digest: hashDigest(h),
+		})
+	}
+	for _, input := range opts.Inputs {
+		stmt.Predicate.BuildDefinition.ResolvedDependencies = append(
+			stmt.Predicate.BuildDefinition.ResolvedDependencies,
+			ResourceDescriptor{URI: string(input)},
+		)
+	}
+	return stmt, nil
+}
+
+// hashDigest converts a hash to an in-toto digest set.
+func hashDigest(h nix.Hash) map[string]string {
+	if h.IsZero() {
+		return nil
+	}
+	return map[string]string{h.Type().String(): h.RawBase16()}
+}
+
+// An Envelope is a signed DSSE envelope.
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is a signature in an [Envelope].
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// SignStatement serializes a statement and signs it with a Nix signing key.
+func SignStatement(pk *nix.PrivateKey, stmt *Statement) (*Envelope, error) {
+	payload, err := json.Marshal(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("sign statement: %v", err)
+	}
+	_, keyData, err := decodeKey(pk.String(), ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("sign statement with %s: %v", pk.Name(), err)
+	}
+	env := &Envelope{
+		PayloadType: InTotoPayloadType,
+		Payload:     payload,
+	}
+	env.Signatures = append(env.Signatures, EnvelopeSignature{
+		KeyID: pk.Name(),
+		Sig:   ed25519.Sign(ed25519.PrivateKey(keyData), env.pae()),
+	})
+	return env, nil
+}
+
+// Verify checks that at least one of the envelope's signatures
+// was made by a trusted key and returns the statement it contains.
+func (env *Envelope) Verify(trusted []*nix.PublicKey) (*Statement, error) {
+	if env.PayloadType != InTotoPayloadType {
+		return nil, fmt.Errorf("verify envelope: unexpected payload type %q", env.PayloadType)
+	}
+	msg := env.pae()
+	verified := false
+	for _, sig := range env.Signatures {
+		for _, pub := range trusted {
+			if pub.Name() != sig.KeyID {
+				continue
+			}
+			_, keyData, err := decodeKey(pub.String(), ed25519.PublicKeySize)
+			if err == nil && ed25519.Verify(ed25519.PublicKey(keyData), msg, sig.Sig) {
+				verified = true
+			}
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("verify envelope: no valid signature from a trusted key")
+	}
+	stmt := new(Statement)
+	if err := json.Unmarshal(env.Payload, stmt); err != nil {
+		return nil, fmt.Errorf("verify envelope: %v", err)
+	}
+	return stmt, nil
+}
+
+// pae returns the DSSE pre-authentication encoding of the envelope's payload,
+// which is the message that signatures sign.
+func (env *Envelope) pae() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("DSSEv1 ")
+	buf.WriteString(strconv.Itoa(len(env.PayloadType)))
+	buf.WriteString(" ")
+	buf.WriteString(env.PayloadType)
+	buf.WriteString(" ")
+	buf.WriteString(strconv.Itoa(len(env.Payload)))
+	buf.WriteString(" ")
+	buf.Write(env.Payload)
+	return buf.Bytes()
+}
+
+// RecordProvenance saves a signed provenance attestation for the given store paths,
+// replacing any previously recorded for them.
+func (db *DB) RecordProvenance(ctx context.Context, env *Envelope, paths ...nix.StorePath) (err error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("record provenance: %v", err)
+	}
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+	now := time.Now().Unix()
+	for _, p := range paths {
+		err := sqlitex.Execute(db.conn, `insert into "provenance" ("path", "envelope", "time") values (?, ?, ?) `+
+			`on conflict ("path") do update set "envelope" = excluded."envelope", "time" = excluded."time";`, &sqlitex.ExecOptions{
+			Args: []any{string(p), string(data), now},
+		})
+		if err != nil {
+			return fmt.Errorf("record provenance for %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// Provenance returns the signed provenance attestation recorded for a store path.
+// If none has been recorded, Provenance returns an error that wraps [ErrNotFound].
+func (db *DB) Provenance(ctx context.Context, path nix.StorePath) (*Envelope, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var data string
+	found := false
+	err := sqlitex.Execute(db.conn, `select "envelope" from "provenance" where "path" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{string(path)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			data = stmt.ColumnText(0)
+			found = true
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read provenance for %s: %v", path, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("read provenance for %s: %w", path, ErrNotFound)
+	}
+	env := new(Envelope)
+	if err := json.Unmarshal([]byte(data), env); err != nil {
+		return nil, fmt.Errorf("read provenance for %s: %v", path, err)
+	}
+	return env, nil
+}
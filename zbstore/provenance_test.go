@@ -0,0 +1,135 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func testProvenanceStatement(tb testing.TB) *Statement {
+	tb.Helper()
+	narHash, err := nix.ParseHash(testNARHash)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stmt, err := NewProvenanceStatement(&ProvenanceOptions{
+		Realizations: []*Realization{testRealization(tb)},
+		OutputHashes: map[nix.StorePath]nix.Hash{testHelloPath: narHash},
+		Inputs:       []nix.StorePath{testGlibcPath},
+		BuilderID:    "zb://example.com",
+		StartedOn:    time.Unix(1700000000, 0),
+		FinishedOn:   time.Unix(1700000060, 0),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return stmt
+}
+
+func TestNewProvenanceStatement(t *testing.T) {
+	got := testProvenanceStatement(t)
+	narHash, _ := nix.ParseHash(testNARHash)
+	drvHash, _ := nix.ParseHash(testDrvHash)
+	want := &Statement{
+		Type: InTotoStatementType,
+		Subject: []ResourceDescriptor{{
+			Name:   string(testHelloPath),
+			Digest: map[string]string{"sha256": narHash.RawBase16()},
+		}},
+		PredicateType: SLSAProvenanceType,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType:          ProvenanceBuildType,
+				ExternalParameters: map[string]any{"derivation": string(testDeriverPath)},
+				ResolvedDependencies: []ResourceDescriptor{
+					{URI: string(testDeriverPath), Digest: map[string]string{"sha256": drvHash.RawBase16()}},
+					{URI: string(testGlibcPath)},
+				},
+			},
+			RunDetails: RunDetails{
+				Builder: ProvenanceBuilder{ID: "zb://example.com"},
+				Metadata: ProvenanceMetadata{
+					StartedOn:  time.Unix(1700000000, 0).UTC(),
+					FinishedOn: time.Unix(1700000060, 0).UTC(),
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("statement (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewProvenanceStatement(&ProvenanceOptions{Realizations: []*Realization{testRealization(t)}}); err == nil {
+		t.Error("NewProvenanceStatement without output hashes did not return an error")
+	}
+}
+
+func TestSignStatement(t *testing.T) {
+	pub, pk, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testProvenanceStatement(t)
+	env, err := SignStatement(pk, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := env.Verify([]*nix.PublicKey{pub})
+	if err != nil {
+		t.Fatal("Verify:", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("verified statement (-want +got):\n%s", diff)
+	}
+
+	if _, err := env.Verify([]*nix.PublicKey{otherPub}); err == nil {
+		t.Error("Verify with a different key of the same name did not return an error")
+	}
+	if _, err := env.Verify(nil); err == nil {
+		t.Error("Verify with no trusted keys did not return an error")
+	}
+	tampered := *env
+	tampered.Payload = append([]byte(nil), env.Payload...)
+	tampered.Payload[len(tampered.Payload)-2] ^= 1
+	if _, err := tampered.Verify([]*nix.PublicKey{pub}); err == nil {
+		t.Error("Verify of tampered payload did not return an error")
+	}
+}
+
+func TestDBProvenance(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	if _, err := db.Provenance(ctx, testHelloPath); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Provenance(ctx, %s) on empty database = _, %v; want %v", testHelloPath, err, ErrNotFound)
+	}
+
+	_, pk, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := SignStatement(pk, testProvenanceStatement(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordProvenance(ctx, want, testHelloPath); err != nil {
+		t.Fatal("RecordProvenance:", err)
+	}
+	got, err := db.Provenance(ctx, testHelloPath)
+	if err != nil {
+		t.Fatal("Provenance:", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Provenance(ctx, %s) (-want +got):\n%s", testHelloPath, diff)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// PushOptions is the set of optional parameters to [Push].
+type PushOptions struct {
+	// Compression is the algorithm used to compress the uploaded NARs.
+	// If empty, [nix.Zstandard] is used.
+	Compression nix.CompressionType
+	// SecretKey signs the uploaded .narinfo files
+	// and realizations if not nil.
+	SecretKey *nix.PrivateKey
+	// Realizations is a list of realizations to upload
+	// (see [Substituter.Realization]).
+	// Their outputs are pushed along with the given store objects,
+	// and the realizations are uploaded after all the objects.
+	Realizations []*Realization
+	// NoListings disables uploading a listing of each object's files
+	// (see [Substituter.Listing]) alongside its NAR.
+	NoListings bool
+}
+
+// Push uploads the closure of the given store objects
+// from store to the binary cache at sub.URL.
+// Objects that the cache already has are skipped.
+// Each object's NAR is uploaded before its .narinfo file,
+// and objects are uploaded after the objects they reference,
+// so the cache never advertises an object that it cannot serve.
+func Push(ctx context.Context, store *Store, sub *Substituter, paths []nix.StorePath, opts *PushOptions) (pushed int, err error) {
+	if opts == nil {
+		opts = new(PushOptions)
+	}
+	if u, err := url.Parse(sub.URL); err == nil && (u.Scheme == ipfsScheme || u.Scheme == ipnsScheme) {
+		return 0, fmt.Errorf("push to %s: IPFS caches are read-only (publish the cache directory with ipfs add instead)", sub.URL)
+	}
+	if len(opts.Realizations) > 0 {
+		paths = slices.Clone(paths)
+		for _, r := range opts.Realizations {
+			paths = append(paths, r.OutPath)
+		}
+	}
+	closure, err := ComputeClosure(paths, func(path nix.StorePath) (*PathInfo, error) {
+		return store.QueryPathInfo(ctx, path)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("push to %s: %v", sub.URL, err)
+	}
+	for _, info := range closure {
+		if _, err := sub.NARInfo(ctx, info.Path); err == nil {
+			log.Debugf(ctx, "%s already has %s", sub.URL, info.Path)
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return pushed, fmt.Errorf("push to %s: %w", sub.URL, err)
+		}
+		log.Infof(ctx, "Uploading %s to %s", info.Path, sub.URL)
+		if err := pushObject(ctx, store, sub.put, info, opts); err != nil {
+			return pushed, fmt.Errorf("push %s to %s: %w", info.Path, sub.URL, err)
+		}
+		pushed++
+	}
+	for _, r := range opts.Realizations {
+		log.Debugf(ctx, "Uploading realization %v to %s", r.ID, sub.URL)
+		if err := pushRealization(ctx, sub.put, r, opts.SecretKey); err != nil {
+			return pushed, fmt.Errorf("push to %s: %w", sub.URL, err)
+		}
+	}
+	return pushed, nil
+}
+
+// putFunc stores a file in a binary cache at the given relative path.
+type putFunc func(ctx context.Context, path string, contentType string, body io.Reader, size int64) error
+
+// pushRealization stores a realization in a binary cache with put,
+// adding a signature from secretKey if it is not nil.
+func pushRealization(ctx context.Context, put putFunc, r *Realization, secretKey *nix.PrivateKey) error {
+	if secretKey != nil && !hasSignatureFrom(r.Signatures, secretKey.Name()) {
+		sig, err := SignRealization(secretKey, r)
+		if err != nil {
+			return err
+		}
+		r = &Realization{
+			ID:         r.ID,
+			OutPath:    r.OutPath,
+			DrvPath:    r.DrvPath,
+			Source:     r.Source,
+			Time:       r.Time,
+			Signatures: append(slices.Clip(r.Signatures), sig),
+			CID:        r.CID,
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("upload realization %v: %v", r.ID, err)
+	}
+	if err := put(ctx, realizationCachePath(r.ID), "application/json", bytes.NewReader(data), int64(len(data))); err != nil {
+		return fmt.Errorf("upload realization %v: %v", r.ID, err)
+	}
+	return nil
+}
+
+// pushObject stores a store object's NAR, listing, and .narinfo file
+// in a binary cache with put.
+func pushObject(ctx context.Context, store *Store, put putFunc, info *PathInfo, opts *PushOptions) error {
+	compression := opts.Compression
+	if compression == "" {
+		compression = nix.Zstandard
+	}
+	ext, err := narFileExtension(compression)
+	if err != nil {
+		return err
+	}
+
+	// Compress to a temporary file
+	// so that the NAR can be named by the hash of the compressed file.
+	f, err := os.CreateTemp("", "zb-push-*"+ext)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	fileHasher := nix.NewHasher(nix.SHA256)
+	zw, err := compressNAR(io.MultiWriter(f, fileHasher), compression)
+	if err != nil {
+		return err
+	}
+	narHasher := nix.NewHasher(info.NARHash.Type())
+	narWriter := io.MultiWriter(zw, narHasher)
+	var listing *nar.Listing
+	if opts.NoListings {
+		err = nar.DumpPath(narWriter, store.RealPath(string(info.Path)))
+	} else {
+		listing, err = dumpAndList(narWriter, store.RealPath(string(info.Path)))
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if got := narHasher.SumHash(); !got.Equal(info.NARHash) {
+		return fmt.Errorf("store object has been modified (NAR hash is %v, expected %v)", got, info.NARHash)
+	}
+	fileSize, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fileHash := fileHasher.SumHash()
+
+	narInfo := &nix.NARInfo{
+		StorePath:   info.Path,
+		URL:         "nar/" + fileHash.RawBase32() + ext,
+		Compression: compression,
+		FileHash:    fileHash,
+		FileSize:    fileSize,
+		NARHash:     info.NARHash,
+		NARSize:     info.NARSize,
+		References:  info.References,
+		Deriver:     info.Deriver,
+		Sig:         info.Signatures,
+		CA:          info.CA,
+	}
+	if opts.SecretKey != nil {
+		sig, err := nix.SignNARInfo(opts.SecretKey, narInfo)
+		if err != nil {
+			return err
+		}
+		narInfo.AddSignatures(sig)
+	}
+	narInfoData, err := narInfo.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	if err := put(ctx, narInfo.URL, nar.MIMEType, f, fileSize); err != nil {
+		return err
+	}
+	if listing != nil {
+		data, err := encodeListing(listing)
+		if err != nil {
+			return err
+		}
+		if err := put(ctx, listingCachePath(info.Path), nar.ListingMIMEType, bytes.NewReader(data), int64(len(data))); err != nil {
+			return err
+		}
+	}
+	return put(ctx, info.Path.Digest()+nix.NARInfoExtension, nix.NARInfoMIMEType, bytes.NewReader(narInfoData), int64(len(narInfoData)))
+}
+
+// put uploads a file to the cache at the given relative path
+// with an HTTP PUT request,
+// which HTTP binary caches, Google Cloud Storage, and Azure Storage accept.
+func (sub *Substituter) put(ctx context.Context, path string, contentType string, body io.Reader, size int64) error {
+	u, err := sub.resolve(path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := sub.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("upload %s: http %s", u, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// LocalSource is the [Realization] source
+// for realizations produced on this machine.
+const LocalSource = "local"
+
+// Binary caches serve realizations as JSON files
+// named realisations/<drv-output>.doi,
+// following the layout that Nix uses.
+const (
+	realizationCacheDir  = "realisations"
+	realizationExtension = ".doi"
+)
+
+// realizationCachePath returns the path of a realization's file
+// relative to the root of a binary cache.
+func realizationCachePath(id DrvOutput) string {
+	return realizationCacheDir + "/" + id.String() + realizationExtension
+}
+
+// DrvOutput identifies an output of a derivation by content.
+// Its string form is "<drvHash>!<outputName>".
+type DrvOutput struct {
+	// DrvHash is the derivation's content hash.
+	// See [zombiezen.com/go/zb.Derivation.Hash].
+	DrvHash    nix.Hash
+	OutputName string
+}
+
+// ParseDrvOutput parses the string form of a [DrvOutput].
+func ParseDrvOutput(s string) (DrvOutput, error) {
+	h, name, ok := strings.Cut(s, "!")
+	if !ok || name == "" {
+		return DrvOutput{}, fmt.Errorf("parse derivation output %q: missing output name", s)
+	}
+	var id DrvOutput
+	var err error
+	id.DrvHash, err = nix.ParseHash(h)
+	if err != nil {
+		return DrvOutput{}, fmt.Errorf("parse derivation output %q: %v", s, err)
+	}
+	id.OutputName = name
+	return id, nil
+}
+
+func (id DrvOutput) String() string {
+	return id.DrvHash.Base32() + "!" + id.OutputName
+}
+
+// MarshalText returns the string form of id.
+func (id DrvOutput) MarshalText() ([]byte, error) {
+	if id.DrvHash.IsZero() || id.OutputName == "" {
+		return nil, fmt.Errorf("marshal derivation output: incomplete")
+	}
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText parses the string form of a [DrvOutput] into id.
+func (id *DrvOutput) UnmarshalText(data []byte) error {
+	var err error
+	*id, err = ParseDrvOutput(string(data))
+	return err
+}
+
+// A Realization records the store object
+// that a derivation output was realized as.
+type Realization struct {
+	ID      DrvOutput     `json:"id"`
+	OutPath nix.StorePath `json:"outPath"`
+
+	// DrvPath is the store derivation that was realized, if known.
+	DrvPath nix.StorePath `json:"drvPath,omitempty"`
+	// Source is where the realization came from:
+	// [LocalSource] for realizations built or substituted on this machine,
+	// or a name for the place it was imported from.
+	Source string `json:"source"`
+	// Time is when the realization was recorded.
+	Time time.Time `json:"time"`
+	// Signatures is the set of signatures that vouch for the realization.
+	Signatures []*nix.Signature `json:"signatures,omitempty"`
+	// CID is the IPFS content identifier of a binary cache directory
+	// that serves OutPath (see [IPFSCacheURL]), if it has been published to IPFS.
+	// (Experimental.)
+	// The CID is a location hint, not part of what the signatures vouch for:
+	// objects downloaded through it are verified like any other substitution.
+	CID string `json:"cid,omitempty"`
+}
+
+// Fingerprint returns the message that realization signatures sign.
+// It covers the derivation output and the output path,
+// but not provenance like the source or time.
+func (r *Realization) Fingerprint() string {
+	return "zb-realization-1;" + r.ID.String() + ";" + string(r.OutPath)
+}
+
+// SignRealization signs the given realization with a private key.
+// The caller is responsible for adding the signature to r.Signatures.
+func SignRealization(pk *nix.PrivateKey, r *Realization) (*nix.Signature, error) {
+	_, data, err := decodeKey(pk.String(), ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("sign realization %v with %s: %v", r.ID, pk.Name(), err)
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(data), []byte(r.Fingerprint()))
+	return nix.ParseSignature(pk.Name() + ":" + base64.StdEncoding.EncodeToString(sig))
+}
+
+// VerifyRealization verifies that a signature for a realization
+// was produced by the key of the same name in a list of trusted keys.
+func VerifyRealization(trusted []*nix.PublicKey, r *Realization, sig *nix.Signature) error {
+	var pub *nix.PublicKey
+	for _, k := range trusted {
+		if k.Name() == sig.Name() {
+			pub = k
+			break
+		}
+	}
+	if pub == nil {
+		return fmt.Errorf("verify realization %v: key %s unknown", r.ID, sig.Name())
+	}
+	_, pubData, err := decodeKey(pub.String(), ed25519.PublicKeySize)
+	if err != nil {
+		return fmt.Errorf("verify realization %v: %v", r.ID, err)
+	}
+	_, sigData, err := decodeKey(sig.String(), ed25519.SignatureSize)
+	if err != nil {
+		return fmt.Errorf("verify realization %v: %v", r.ID, err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubData), []byte(r.Fingerprint()), sigData) {
+		return fmt.Errorf("verify realization %v: signature for key %s is invalid", r.ID, sig.Name())
+	}
+	return nil
+}
+
+// CheckRealizationTrust reports an error
+// unless at least one of the realization's signatures
+// is a valid signature from a trusted key.
+func CheckRealizationTrust(trusted []*nix.PublicKey, r *Realization) error {
+	if len(r.Signatures) == 0 {
+		return fmt.Errorf("realization %v is not signed", r.ID)
+	}
+	var firstErr error
+	for _, sig := range r.Signatures {
+		err := VerifyRealization(trusted, r, sig)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// hasSignatureFrom reports whether sigs includes a signature
+// from the key with the given name.
+func hasSignatureFrom(sigs []*nix.Signature, keyName string) bool {
+	for _, sig := range sigs {
+		if sig.Name() == keyName {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeKey splits the "<name>:<base64 data>" encoding
+// that Nix uses for keys and signatures.
+func decodeKey(s string, wantSize int) (name string, data []byte, err error) {
+	name, b64, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", nil, fmt.Errorf("missing ':'")
+	}
+	data, err = base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data) != wantSize {
+		return "", nil, fmt.Errorf("expected %d bytes (got %d)", wantSize, len(data))
+	}
+	return name, data, nil
+}
+
+// RecordRealization saves a realization,
+// replacing any realization previously recorded for the same derivation output.
+func (db *DB) RecordRealization(ctx context.Context, r *Realization) (err error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	defer sqlitex.Save(db.conn)(&err)
+
+	hash := r.ID.DrvHash.Base32()
+	var drvPath, cid any
+	if r.DrvPath != "" {
+		drvPath = string(r.DrvPath)
+	}
+	if r.CID != "" {
+		if !isCID(r.CID) {
+			return fmt.Errorf("record realization %v: %q is not a CID", r.ID, r.CID)
+		}
+		cid = r.CID
+	}
+	err = sqlitex.Execute(db.conn, `insert into "realizations" ("drv_hash", "output_name", "out_path", "drv_path", "source", "time", "cid") values (?, ?, ?, ?, ?, ?, ?) `+
+		`on conflict ("drv_hash", "output_name") do update set "out_path" = excluded."out_path", "drv_path" = excluded."drv_path", "source" = excluded."source", "time" = excluded."time", "cid" = excluded."cid";`, &sqlitex.ExecOptions{
+		Args: []any{hash, r.ID.OutputName, string(r.OutPath), drvPath, r.Source, r.Time.Unix(), cid},
+	})
+	if err != nil {
+		return fmt.Errorf("record realization %v: %v", r.ID, err)
+	}
+	err = sqlitex.Execute(db.conn, `delete from "realization_signatures" where "drv_hash" = ? and "output_name" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{hash, r.ID.OutputName},
+	})
+	if err != nil {
+		return fmt.Errorf("record realization %v: %v", r.ID, err)
+	}
+	for _, sig := range r.Signatures {
+		err := sqlitex.Execute(db.conn, `insert into "realization_signatures" ("drv_hash", "output_name", "signature") values (?, ?, ?) on conflict do nothing;`, &sqlitex.ExecOptions{
+			Args: []any{hash, r.ID.OutputName, sig.String()},
+		})
+		if err != nil {
+			return fmt.Errorf("record realization %v: %v", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// Realization returns the realization recorded for the given derivation output.
+// If none has been recorded, Realization returns an error that wraps [ErrNotFound].
+func (db *DB) Realization(ctx context.Context, id DrvOutput) (*Realization, error) {
+	rs, err := db.queryRealizations(ctx, `where "drv_hash" = ? and "output_name" = ?`, id.DrvHash.Base32(), id.OutputName)
+	if err != nil {
+		return nil, fmt.Errorf("read realization %v: %v", id, err)
+	}
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("read realization %v: %w", id, ErrNotFound)
+	}
+	return rs[0], nil
+}
+
+// Realizations returns every recorded realization,
+// ordered by derivation output.
+func (db *DB) Realizations(ctx context.Context) ([]*Realization, error) {
+	rs, err := db.queryRealizations(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("read realizations: %v", err)
+	}
+	return rs, nil
+}
+
+// RealizationsOf returns the recorded realizations
+// whose output is one of the given paths,
+// ordered by derivation output.
+func (db *DB) RealizationsOf(ctx context.Context, paths ...nix.StorePath) ([]*Realization, error) {
+	var result []*Realization
+	for _, p := range paths {
+		rs, err := db.queryRealizations(ctx, `where "out_path" = ?`, string(p))
+		if err != nil {
+			return nil, fmt.Errorf("read realizations of %s: %v", p, err)
+		}
+		result = append(result, rs...)
+	}
+	slices.SortFunc(result, func(a, b *Realization) int {
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+	return result, nil
+}
+
+func (db *DB) queryRealizations(ctx context.Context, where string, args ...any) ([]*Realization, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var rs []*Realization
+	err := sqlitex.Execute(db.conn, `select "drv_hash", "output_name", "out_path", "drv_path", "source", "time", `+
+		`(select group_concat("signature", ' ') from "realization_signatures" s where s."drv_hash" = r."drv_hash" and s."output_name" = r."output_name"), `+
+		`"cid" `+
+		`from "realizations" r `+where+` order by 1, 2;`, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			r := &Realization{
+				ID:      DrvOutput{OutputName: stmt.ColumnText(1)},
+				OutPath: nix.StorePath(stmt.ColumnText(2)),
+				DrvPath: nix.StorePath(stmt.ColumnText(3)),
+				Source:  stmt.ColumnText(4),
+				Time:    time.Unix(stmt.ColumnInt64(5), 0),
+				CID:     stmt.ColumnText(7),
+			}
+			var err error
+			r.ID.DrvHash, err = nix.ParseHash(stmt.ColumnText(0))
+			if err != nil {
+				return err
+			}
+			for _, s := range strings.Fields(stmt.ColumnText(6)) {
+				sig, err := nix.ParseSignature(s)
+				if err != nil {
+					return err
+				}
+				r.Signatures = append(r.Signatures, sig)
+			}
+			rs = append(rs, r)
+			return nil
+		},
+	})
+	return rs, err
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+const testDrvHash = "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s"
+
+func testRealization(tb testing.TB) *Realization {
+	tb.Helper()
+	h, err := nix.ParseHash(testDrvHash)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sig, err := nix.ParseSignature(testSignature)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Realization{
+		ID:         DrvOutput{DrvHash: h, OutputName: "out"},
+		OutPath:    testHelloPath,
+		DrvPath:    testDeriverPath,
+		Source:     LocalSource,
+		Time:       time.Unix(1700000000, 0),
+		Signatures: []*nix.Signature{sig},
+		CID:        testCID,
+	}
+}
+
+func TestParseDrvOutput(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantErr bool
+	}{
+		{s: testDrvHash + "!out"},
+		{s: testDrvHash + "!dev"},
+		{s: testDrvHash, wantErr: true},
+		{s: testDrvHash + "!", wantErr: true},
+		{s: "foo!out", wantErr: true},
+	}
+	for _, test := range tests {
+		id, err := ParseDrvOutput(test.s)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("ParseDrvOutput(%q): %v", test.s, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("ParseDrvOutput(%q) = %v, <nil>; want error", test.s, id)
+			continue
+		}
+		if got := id.String(); got != test.s {
+			t.Errorf("ParseDrvOutput(%q).String() = %q", test.s, got)
+		}
+	}
+}
+
+func TestRealizationJSON(t *testing.T) {
+	want := testRealization(t)
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(Realization)
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+		t.Errorf("round trip of %s (-want +got):\n%s", data, diff)
+	}
+}
+
+func TestRealizationDB(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	want := testRealization(t)
+
+	if got, err := db.Realization(ctx, want.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Realization(ctx, %v) before recording = %+v, %v; want ErrNotFound", want.ID, got, err)
+	}
+	if err := db.RecordRealization(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Realization(ctx, want.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+		t.Errorf("Realization(ctx, %v) (-want +got):\n%s", want.ID, diff)
+	}
+
+	// Recording again replaces the previous realization.
+	want.Source = "cache.example.com"
+	want.DrvPath = ""
+	want.Signatures = nil
+	if err := db.RecordRealization(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	all, err := db.Realizations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*Realization{want}, all, pathInfoCompareOptions); diff != "" {
+		t.Errorf("Realizations(ctx) (-want +got):\n%s", diff)
+	}
+}
+
+func TestRealizationSignatures(t *testing.T) {
+	pub, pk, err := nix.GenerateKey("test-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPK, err := nix.GenerateKey("other-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testRealization(t)
+	r.Signatures = nil
+	if err := CheckRealizationTrust([]*nix.PublicKey{pub}, r); err == nil {
+		t.Error("CheckRealizationTrust accepted an unsigned realization")
+	}
+
+	sig, err := SignRealization(pk, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Name() != "test-1" {
+		t.Errorf("signature name = %q; want %q", sig.Name(), "test-1")
+	}
+	if err := VerifyRealization([]*nix.PublicKey{otherPub, pub}, r, sig); err != nil {
+		t.Error("VerifyRealization with signing key:", err)
+	}
+	if err := VerifyRealization([]*nix.PublicKey{otherPub}, r, sig); err == nil {
+		t.Error("VerifyRealization without signing key did not return an error")
+	}
+
+	otherSig, err := SignRealization(otherPK, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Signatures = []*nix.Signature{otherSig, sig}
+	if err := CheckRealizationTrust([]*nix.PublicKey{pub}, r); err != nil {
+		t.Error("CheckRealizationTrust:", err)
+	}
+
+	// Provenance is not covered by the signature, but the output path is.
+	r.Source = "cache.example.com"
+	if err := VerifyRealization([]*nix.PublicKey{pub}, r, sig); err != nil {
+		t.Error("VerifyRealization after changing source:", err)
+	}
+	r.OutPath = testGlibcPath
+	if err := CheckRealizationTrust([]*nix.PublicKey{pub}, r); err == nil {
+		t.Error("CheckRealizationTrust accepted a realization with a tampered output path")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// Rewrite copies the NAR serialization of a store object from src to dst,
+// moving the object from its store directory to dir.
+// info describes the object and src must hold info.NARSize bytes.
+// paths maps the object's references (other than itself)
+// to their paths in dir:
+// callers rewriting a closure should call Rewrite
+// on each object after the objects it refers to
+// and add the returned path to paths.
+// Occurrences of the references' paths in the object's files and symlinks
+// are replaced with the new paths,
+// which may have a different length.
+//
+// Content-addressed objects have their content addresses and paths recomputed
+// from the rewritten NAR (see [FixedCAOutputPath]).
+// Input-addressed objects (those with a zero content address) keep their digests,
+// since computing an input-addressed path requires the object's derivation.
+// The resulting path is therefore not the path that building
+// the object's derivation in dir would produce,
+// and callers should tell the user as much.
+// The returned [PathInfo] describes the rewritten object.
+// Its deriver is translated with paths if present and cleared otherwise.
+func Rewrite(dst io.Writer, src io.ReaderAt, info *PathInfo, dir nix.StoreDirectory, paths map[nix.StorePath]nix.StorePath) (*PathInfo, error) {
+	oldDir := info.Path.Dir()
+	tempPath, err := dir.Object(info.Path.Base())
+	if err != nil {
+		return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+	}
+	// Self-references are rewritten to tempPath,
+	// which is correct for input-addressed objects
+	// and is the placeholder that content-addressed objects are hashed modulo.
+	digests := map[string]string{info.Path.Digest(): tempPath.Digest()}
+	var refs []nix.StorePath
+	self := false
+	for _, ref := range info.References {
+		if ref == info.Path {
+			self = true
+			continue
+		}
+		newRef, ok := paths[ref]
+		if !ok {
+			return nil, fmt.Errorf("rewrite %s: new path of reference %s unknown", info.Path, ref)
+		}
+		if newRef.Dir() != dir || newRef.Name() != ref.Name() {
+			return nil, fmt.Errorf("rewrite %s: reference %s cannot be moved to %s", info.Path, ref, newRef)
+		}
+		digests[ref.Digest()] = newRef.Digest()
+		refs = append(refs, newRef)
+	}
+	slices.Sort(refs)
+	deriver := paths[info.Deriver]
+	newNAR := func(w io.Writer) error {
+		return rewriteNAR(w, io.NewSectionReader(src, 0, info.NARSize), oldDir, dir, digests)
+	}
+
+	if info.CA.IsZero() {
+		h := nix.NewHasher(nix.SHA256)
+		cw := &countWriter{w: io.MultiWriter(dst, h)}
+		if err := newNAR(cw); err != nil {
+			return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+		}
+		newInfo := &PathInfo{
+			Path:       tempPath,
+			NARHash:    h.SumHash(),
+			NARSize:    cw.n,
+			References: refs,
+			Deriver:    deriver,
+		}
+		if self {
+			newInfo.References = append(newInfo.References, tempPath)
+			slices.Sort(newInfo.References)
+		}
+		return newInfo, nil
+	}
+
+	f, err := os.CreateTemp("", "zb-rewrite-*.nar")
+	if err != nil {
+		return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if err := newNAR(f); err != nil {
+		return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+	}
+	var newInfo *PathInfo
+	switch {
+	case info.CA.IsText():
+		newInfo, err = rewriteText(dst, f, tempPath.Name(), dir, refs)
+	case info.CA.IsRecursiveFile() && info.CA.Hash().Type() == nix.SHA256:
+		newInfo, err = MakeContentAddressed(dst, f, tempPath, tempPath.Name(), refs)
+	case len(refs) > 0 || self:
+		// Store paths only account for references
+		// in text and recursive SHA-256 content addresses.
+		err = fmt.Errorf("content address %v cannot have references", info.CA)
+	default:
+		// Without references, the content is unchanged.
+		h := nix.NewHasher(nix.SHA256)
+		cw := &countWriter{w: io.MultiWriter(dst, h)}
+		if _, err := io.Copy(cw, f); err != nil {
+			return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+		}
+		newInfo = &PathInfo{
+			NARHash: h.SumHash(),
+			NARSize: cw.n,
+			CA:      info.CA,
+		}
+		newInfo.Path, err = FixedCAOutputPath(dir, tempPath.Name(), info.CA, StoreReferences{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rewrite %s: %v", info.Path, err)
+	}
+	newInfo.Deriver = deriver
+	return newInfo, nil
+}
+
+// rewriteText writes the NAR of a text store object read from f to dst
+// and computes its new content address.
+func rewriteText(dst io.Writer, f io.ReadSeeker, name string, dir nix.StoreDirectory, refs []nix.StorePath) (*PathInfo, error) {
+	nr := nar.NewReader(f)
+	hdr, err := nr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !hdr.Mode.IsRegular() {
+		return nil, fmt.Errorf("text is not a regular file")
+	}
+	textHasher := nix.NewHasher(nix.SHA256)
+	if _, err := io.Copy(textHasher, nr); err != nil {
+		return nil, err
+	}
+	ca := nix.TextContentAddress(textHasher.SumHash())
+	p, err := FixedCAOutputPath(dir, name, ca, StoreReferences{Others: refs})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := nix.NewHasher(nix.SHA256)
+	cw := &countWriter{w: io.MultiWriter(dst, h)}
+	if _, err := io.Copy(cw, f); err != nil {
+		return nil, err
+	}
+	return &PathInfo{
+		Path:       p,
+		NARHash:    h.SumHash(),
+		NARSize:    cw.n,
+		References: refs,
+		CA:         ca,
+	}, nil
+}
+
+// rewriteNAR copies the NAR in src to dst,
+// replacing occurrences of store paths in oldDir
+// whose digests are keys in digests
+// with the corresponding paths in newDir.
+func rewriteNAR(dst io.Writer, src *io.SectionReader, oldDir, newDir nix.StoreDirectory, digests map[string]string) error {
+	from := []byte(oldDir + "/")
+	to := []byte(newDir + "/")
+	rewrite := func(w io.Writer) *storePathRewriter {
+		return &storePathRewriter{w: w, from: from, to: to, digests: digests}
+	}
+	nr := nar.NewReader(src)
+	nw := nar.NewWriter(dst)
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		newHeader := &nar.Header{
+			Path: hdr.Path,
+			Mode: hdr.Mode,
+		}
+		switch hdr.Mode.Type() {
+		case fs.ModeDir:
+			if err := nw.WriteHeader(newHeader); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			buf := new(bytes.Buffer)
+			pr := rewrite(buf)
+			pr.Write([]byte(hdr.LinkTarget))
+			pr.Flush()
+			newHeader.LinkTarget = buf.String()
+			if err := nw.WriteHeader(newHeader); err != nil {
+				return err
+			}
+		default:
+			// Rewriting can change the file's size,
+			// which the NAR header precedes,
+			// so count the rewritten content before copying it.
+			content := io.NewSectionReader(src, hdr.ContentOffset, hdr.Size)
+			cw := &countWriter{w: io.Discard}
+			pr := rewrite(cw)
+			if _, err := io.Copy(pr, content); err != nil {
+				return err
+			}
+			pr.Flush()
+			newHeader.Size = cw.n
+			if err := nw.WriteHeader(newHeader); err != nil {
+				return err
+			}
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			pr = rewrite(nw)
+			if _, err := io.Copy(pr, content); err != nil {
+				return err
+			}
+			if err := pr.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nw.Close()
+}
+
+// storePathRewriter replaces store paths in the data written to it.
+// A path is replaced if it starts with from
+// and is followed by a digest that is a key in digests:
+// from and the digest are replaced with to and the digest's value.
+type storePathRewriter struct {
+	w       io.Writer
+	from    []byte
+	to      []byte
+	digests map[string]string
+	buf     []byte
+}
+
+// digestLength is the length of a store path digest.
+const digestLength = 32
+
+func (pr *storePathRewriter) Write(p []byte) (int, error) {
+	pr.buf = append(pr.buf, p...)
+	if err := pr.process(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any held-back bytes.
+func (pr *storePathRewriter) Flush() error {
+	return pr.process(true)
+}
+
+// process writes out as much of pr.buf as possible.
+// Unless final is true, it holds back bytes that could be the start of a path.
+func (pr *storePathRewriter) process(final bool) error {
+	var out []byte
+	i := 0
+	for {
+		j := bytes.Index(pr.buf[i:], pr.from)
+		if j < 0 {
+			break
+		}
+		j += i
+		end := j + len(pr.from) + digestLength
+		if end > len(pr.buf) {
+			if !final {
+				out = append(out, pr.buf[i:j]...)
+				i = j
+				return pr.emit(out, i)
+			}
+			break
+		}
+		out = append(out, pr.buf[i:j]...)
+		if newDigest, ok := pr.digests[string(pr.buf[j+len(pr.from):end])]; ok {
+			out = append(out, pr.to...)
+			out = append(out, newDigest...)
+			i = end
+		} else {
+			out = append(out, pr.from...)
+			i = j + len(pr.from)
+		}
+	}
+	n := len(pr.buf)
+	if !final {
+		// Hold back a potential partial match of from at the end.
+		n = max(i, len(pr.buf)-(len(pr.from)-1))
+	}
+	out = append(out, pr.buf[i:n]...)
+	return pr.emit(out, n)
+}
+
+// emit writes out and discards the first n bytes of pr.buf.
+func (pr *storePathRewriter) emit(out []byte, n int) error {
+	pr.buf = append(pr.buf[:0], pr.buf[n:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := pr.w.Write(out)
+	return err
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestStorePathRewriter(t *testing.T) {
+	const (
+		oldDigest   = "1rz4g4znpzjwh1xymhjpm42vipw92pr7"
+		newDigest   = "cs4n5mbm46xwzb9yxm983gzqh0k5b2hp"
+		otherDigest = "ffffffffffffffffffffffffffffffff"
+	)
+	digests := map[string]string{oldDigest: newDigest}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"hello", "hello"},
+		{"/a/store/" + oldDigest + "-lib", "/opt/b/store/" + newDigest + "-lib"},
+		{"/a/store/" + otherDigest + "-lib", "/a/store/" + otherDigest + "-lib"},
+		{
+			"x/a/store/" + oldDigest + "/a/store/" + oldDigest + "/a/sto",
+			"x/opt/b/store/" + newDigest + "/opt/b/store/" + newDigest + "/a/sto",
+		},
+		{"/a/store/" + oldDigest[:10], "/a/store/" + oldDigest[:10]},
+		{"/a/st/a/store/" + oldDigest, "/a/st/opt/b/store/" + newDigest},
+	}
+	for _, test := range tests {
+		for chunk := 1; chunk <= len(test.input)+1; chunk++ {
+			buf := new(bytes.Buffer)
+			pr := &storePathRewriter{
+				w:       buf,
+				from:    []byte("/a/store/"),
+				to:      []byte("/opt/b/store/"),
+				digests: digests,
+			}
+			for s := test.input; len(s) > 0; {
+				n := min(chunk, len(s))
+				if _, err := pr.Write([]byte(s[:n])); err != nil {
+					t.Fatal(err)
+				}
+				s = s[n:]
+			}
+			if err := pr.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("rewrite %q in chunks of %d = %q; want %q", test.input, chunk, got, test.want)
+			}
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	const (
+		oldDir nix.StoreDirectory = "/a/store"
+		newDir nix.StoreDirectory = "/opt/zb/store"
+	)
+	oldLib, err := oldDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLib, err := newDir.Object("1rz4g4znpzjwh1xymhjpm42vipw92pr7-lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// makeApp returns the NAR of a program that refers to lib and itself.
+	makeApp := func(lib, self nix.StorePath) []byte {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "app"), []byte("#!"+string(lib)+"\nexec "+string(self)+"/app\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(string(lib), filepath.Join(dir, "lib")); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := nar.DumpPath(buf, dir); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	paths := map[nix.StorePath]nix.StorePath{oldLib: newLib}
+
+	t.Run("InputAddressed", func(t *testing.T) {
+		oldApp, err := oldDir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		newApp, err := newDir.Object(oldApp.Base())
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldNAR := makeApp(oldLib, oldApp)
+		info := &PathInfo{
+			Path:       oldApp,
+			NARSize:    int64(len(oldNAR)),
+			References: []nix.StorePath{oldLib, oldApp},
+		}
+		buf := new(bytes.Buffer)
+		got, err := Rewrite(buf, bytes.NewReader(oldNAR), info, newDir, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantNAR := makeApp(newLib, newApp)
+		if !bytes.Equal(buf.Bytes(), wantNAR) {
+			t.Errorf("rewritten NAR does not match NAR of program built in %s", newDir)
+		}
+		h := nix.NewHasher(nix.SHA256)
+		h.Write(wantNAR)
+		want := &PathInfo{
+			Path:       newApp,
+			NARHash:    h.SumHash(),
+			NARSize:    int64(len(wantNAR)),
+			References: []nix.StorePath{newLib, newApp},
+		}
+		if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+			t.Errorf("Rewrite(...) (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ContentAddressed", func(t *testing.T) {
+		// Compute the paths that the program would have
+		// if it had been built in each store.
+		makeCA := func(dir nix.StoreDirectory, lib nix.StorePath) (*PathInfo, []byte) {
+			tempPath, err := dir.Object("00000000000000000000000000000000-app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := new(bytes.Buffer)
+			info, err := MakeContentAddressed(buf, bytes.NewReader(makeApp(lib, tempPath)), tempPath, "app", []nix.StorePath{lib})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return info, buf.Bytes()
+		}
+		oldInfo, oldNAR := makeCA(oldDir, oldLib)
+		want, wantNAR := makeCA(newDir, newLib)
+		if oldInfo.Path.Digest() == want.Path.Digest() {
+			t.Fatal("test program has same digest in both stores")
+		}
+
+		buf := new(bytes.Buffer)
+		got, err := Rewrite(buf, bytes.NewReader(oldNAR), oldInfo, newDir, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got, pathInfoCompareOptions); diff != "" {
+			t.Errorf("Rewrite(...) (-want +got):\n%s", diff)
+		}
+		if !bytes.Equal(buf.Bytes(), wantNAR) {
+			t.Errorf("rewritten NAR does not match NAR of program built in %s", newDir)
+		}
+	})
+
+	t.Run("ReferencesNotAllowed", func(t *testing.T) {
+		oldApp, err := oldDir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldNAR := makeApp(oldLib, oldApp)
+		h := nix.NewHasher(nix.SHA512)
+		h.Write(oldNAR)
+		cas := []nix.ContentAddress{
+			nix.FlatFileContentAddress(h.SumHash()),
+			nix.RecursiveFileContentAddress(h.SumHash()),
+		}
+		for _, ca := range cas {
+			info := &PathInfo{
+				Path:       oldApp,
+				NARSize:    int64(len(oldNAR)),
+				References: []nix.StorePath{oldLib},
+				CA:         ca,
+			}
+			if _, err := Rewrite(new(bytes.Buffer), bytes.NewReader(oldNAR), info, newDir, paths); err == nil {
+				t.Errorf("Rewrite(...) with content address %v did not return an error", ca)
+			}
+		}
+	})
+
+	t.Run("MissingReference", func(t *testing.T) {
+		oldApp, err := oldDir.Object("cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldNAR := makeApp(oldLib, oldApp)
+		info := &PathInfo{
+			Path:       oldApp,
+			NARSize:    int64(len(oldNAR)),
+			References: []nix.StorePath{oldLib},
+		}
+		_, err = Rewrite(new(bytes.Buffer), bytes.NewReader(oldNAR), info, newDir, nil)
+		if err == nil || !strings.Contains(err.Error(), string(oldLib)) {
+			t.Errorf("Rewrite(...) error = %v; want to mention %s", err, oldLib)
+		}
+	})
+}
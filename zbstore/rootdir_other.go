@@ -0,0 +1,27 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !unix
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"zombiezen.com/go/nix"
+)
+
+// openRootDir opens the directory that will hold the client's root at link.
+// Untrusted clients cannot add roots on this platform,
+// since the directory's owner cannot be checked.
+func (id *ClientIdentity) openRootDir(s *Store, link string) (*os.File, error) {
+	return nil, fmt.Errorf("%v may not add a root at %s", id, link)
+}
+
+// addRootAt registers path as a garbage collector root
+// with a symlink called name in dir.
+func (s *Store) addRootAt(ctx context.Context, dir *os.File, name, link string, path nix.StorePath, uid int) error {
+	return fmt.Errorf("add root %s: not supported on this platform", link)
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build unix
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"zombiezen.com/go/nix"
+)
+
+// openRootDir opens the directory that will hold the client's root at link.
+// Untrusted clients may only add roots in their [Store.UserRootsDir]
+// or in directories they own.
+// The checks are made on the opened directory
+// rather than on its path,
+// so the client cannot replace the directory with a symlink
+// between the check and the creation of the root.
+func (id *ClientIdentity) openRootDir(s *Store, link string) (*os.File, error) {
+	dir := filepath.Dir(link)
+	if perUserDir, rel, ok := id.userRootsDirPath(s, dir); ok {
+		// The per-user roots directory belongs to the backend,
+		// but the directories below it belong to users,
+		// so refuse to follow symlinks from there on.
+		f, err := openDirNoFollow(perUserDir, rel)
+		if err != nil {
+			return nil, fmt.Errorf("%v may not add a root at %s: %v", id, link, err)
+		}
+		return f, nil
+	}
+	if id.Peer != nil {
+		fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%v may not add a root at %s: %v", id, link, &os.PathError{Op: "open", Path: dir, Err: err})
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err == nil && int(st.Uid) == id.Peer.UID {
+			return os.NewFile(uintptr(fd), dir), nil
+		}
+		unix.Close(fd)
+	}
+	return nil, fmt.Errorf("%v may not add a root at %s", id, link)
+}
+
+// openDirNoFollow opens the directory rel inside base
+// without following any symlinks in rel.
+func openDirNoFollow(base, rel string) (*os.File, error) {
+	fd, err := unix.Open(base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: base, Err: err}
+	}
+	curr := base
+	for _, elem := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		if elem == "." {
+			continue
+		}
+		curr = filepath.Join(curr, elem)
+		next, err := unix.Openat(fd, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: curr, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), curr), nil
+}
+
+// addRootAt registers path as a garbage collector root
+// with a symlink called name in dir,
+// the directory at filepath.Dir(link).
+// If uid is not negative, the symlink is owned by that user.
+// Unlike [Store.AddRoot], the symlink is created relative to dir,
+// so it cannot be redirected by changes to the directories above it.
+func (s *Store) addRootAt(ctx context.Context, dir *os.File, name, link string, path nix.StorePath, uid int) error {
+	if _, err := s.nixStore(ctx, "--realise", "--", string(path)); err != nil {
+		return fmt.Errorf("add root %s: %v", link, err)
+	}
+	fd := int(dir.Fd())
+	tmp := "." + name + ".tmp" + strconv.FormatUint(rand.Uint64(), 36)
+	if err := unix.Symlinkat(string(path), fd, tmp); err != nil {
+		return fmt.Errorf("add root %s: %v", link, err)
+	}
+	if uid >= 0 && uid != os.Geteuid() {
+		if err := unix.Fchownat(fd, tmp, uid, -1, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			unix.Unlinkat(fd, tmp, 0)
+			return fmt.Errorf("add root %s: %v", link, err)
+		}
+	}
+	if err := unix.Renameat(fd, tmp, fd, name); err != nil {
+		unix.Unlinkat(fd, tmp, 0)
+		return fmt.Errorf("add root %s: %v", link, err)
+	}
+	if err := s.addIndirectRoot(link); err != nil {
+		return fmt.Errorf("add root %s: %v", link, err)
+	}
+	return nil
+}
+
+// addIndirectRoot registers the symlink at link with the backend
+// so that the garbage collector keeps its target alive
+// for as long as link exists.
+// It uses the same naming scheme as nix-store --add-root.
+func (s *Store) addIndirectRoot(link string) error {
+	autoDir := filepath.Join(s.stateDir(), "gcroots", "auto")
+	if err := os.MkdirAll(autoDir, 0o755); err != nil {
+		return err
+	}
+	h := nix.NewHasher(nix.SHA1)
+	io.WriteString(h, link)
+	root := filepath.Join(autoDir, h.SumHash().RawBase32())
+	tmp := root + ".tmp" + strconv.FormatUint(rand.Uint64(), 36)
+	if err := os.Symlink(link, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
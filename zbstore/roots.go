@@ -0,0 +1,203 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// A NamedRoot is a garbage collector root that belongs to a user.
+// Each user has their own namespace of root names,
+// so users on a shared machine cannot remove or shadow each other's roots.
+type NamedRoot struct {
+	Owner string
+	Name  string
+	Path  nix.StorePath
+	// Link is the symlink that registers the root with the backend.
+	// It is located in the owner's [Store.UserRootsDir].
+	Link string
+	Time time.Time
+}
+
+// UserRootsDir returns the directory that holds the given user's named roots.
+// It is in the backend's per-user roots directory,
+// which only the user (and the backend) can write to.
+// If the store has a [Store.Root], the directory is under the root.
+func (s *Store) UserRootsDir(user string) string {
+	return filepath.Join(s.stateDir(), "gcroots", "per-user", user, "zb")
+}
+
+// ValidateRootName reports an error if name cannot be used as a root name.
+func ValidateRootName(name string) error {
+	if name == "" {
+		return fmt.Errorf("root name is empty")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid root name %q", name)
+	}
+	return nil
+}
+
+// AddNamedRoot creates or updates the root with the given name
+// in owner's namespace so that it keeps path alive,
+// and records it in db.
+//
+// If the store has a Socket, the daemon records the root in its own database
+// in the namespace of the connecting user
+// and db and owner are ignored.
+// This lets users on a shared machine see each other's roots
+// without being able to change them.
+func (s *Store) AddNamedRoot(ctx context.Context, db *DB, owner, name string, path nix.StorePath) (*NamedRoot, error) {
+	if s.socket() != "" {
+		r := new(NamedRoot)
+		if err := s.call(ctx, "AddNamedRoot", &AddNamedRootRequest{Name: name, Path: path}, r); err != nil {
+			return nil, fmt.Errorf("add root %q: %w", name, err)
+		}
+		return r, nil
+	}
+	if owner == "" {
+		return nil, fmt.Errorf("add root %q: no owner", name)
+	}
+	if err := ValidateRootName(name); err != nil {
+		return nil, fmt.Errorf("add root: %v", err)
+	}
+	dir := s.UserRootsDir(owner)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("add root %q: %v", name, err)
+	}
+	r := &NamedRoot{
+		Owner: owner,
+		Name:  name,
+		Path:  path,
+		Link:  filepath.Join(dir, name),
+		// The database records times to the second.
+		Time: time.Now().Truncate(time.Second),
+	}
+	if err := s.AddRoot(ctx, r.Link, path); err != nil {
+		return nil, fmt.Errorf("add root %q: %v", name, err)
+	}
+	if err := db.recordRoot(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RemoveNamedRoot removes the root with the given name from owner's namespace,
+// allowing the store object it kept alive to be collected.
+// If owner has no such root, RemoveNamedRoot returns an error that wraps [ErrNotFound].
+// If the store has a Socket, db and owner are ignored
+// as in [Store.AddNamedRoot].
+func (s *Store) RemoveNamedRoot(ctx context.Context, db *DB, owner, name string) error {
+	if s.socket() != "" {
+		if err := s.call(ctx, "RemoveNamedRoot", &RemoveNamedRootRequest{Name: name}, new(struct{})); err != nil {
+			return fmt.Errorf("remove root %q: %w", name, err)
+		}
+		return nil
+	}
+	r, err := db.NamedRoot(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(r.Link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove root %q: %v", name, err)
+	}
+	return db.deleteRoot(ctx, owner, name)
+}
+
+// NamedRoots returns the roots in owner's namespace from db
+// as in [DB.NamedRoots].
+// If the store has a Socket, NamedRoots asks the daemon instead,
+// and any non-empty owner is replaced by the connecting user.
+func (s *Store) NamedRoots(ctx context.Context, db *DB, owner string) ([]*NamedRoot, error) {
+	if s.socket() != "" {
+		resp := new(NamedRootsResponse)
+		if err := s.call(ctx, "NamedRoots", &NamedRootsRequest{All: owner == ""}, resp); err != nil {
+			return nil, fmt.Errorf("read roots: %w", err)
+		}
+		return resp.Roots, nil
+	}
+	return db.NamedRoots(ctx, owner)
+}
+
+func (db *DB) recordRoot(ctx context.Context, r *NamedRoot) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	err := sqlitex.Execute(db.conn, `insert into "roots" ("owner", "name", "path", "link", "time") values (?, ?, ?, ?, ?) `+
+		`on conflict ("owner", "name") do update set "path" = excluded."path", "link" = excluded."link", "time" = excluded."time";`, &sqlitex.ExecOptions{
+		Args: []any{r.Owner, r.Name, string(r.Path), r.Link, r.Time.Unix()},
+	})
+	if err != nil {
+		return fmt.Errorf("record root %q for %s: %v", r.Name, r.Owner, err)
+	}
+	return nil
+}
+
+func (db *DB) deleteRoot(ctx context.Context, owner, name string) error {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	err := sqlitex.Execute(db.conn, `delete from "roots" where "owner" = ? and "name" = ?;`, &sqlitex.ExecOptions{
+		Args: []any{owner, name},
+	})
+	if err != nil {
+		return fmt.Errorf("remove root %q for %s: %v", name, owner, err)
+	}
+	return nil
+}
+
+// NamedRoot returns the root with the given name in owner's namespace.
+// If owner has no such root, NamedRoot returns an error that wraps [ErrNotFound].
+func (db *DB) NamedRoot(ctx context.Context, owner, name string) (*NamedRoot, error) {
+	roots, err := db.queryRoots(ctx, `where "owner" = ? and "name" = ?`, owner, name)
+	if err != nil {
+		return nil, fmt.Errorf("read root %q for %s: %v", name, owner, err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("read root %q for %s: %w", name, owner, ErrNotFound)
+	}
+	return roots[0], nil
+}
+
+// NamedRoots returns the roots in owner's namespace sorted by name.
+// If owner is empty, NamedRoots returns every user's roots
+// sorted by owner, then name.
+func (db *DB) NamedRoots(ctx context.Context, owner string) ([]*NamedRoot, error) {
+	var roots []*NamedRoot
+	var err error
+	if owner == "" {
+		roots, err = db.queryRoots(ctx, "")
+	} else {
+		roots, err = db.queryRoots(ctx, `where "owner" = ?`, owner)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read roots: %v", err)
+	}
+	return roots, nil
+}
+
+func (db *DB) queryRoots(ctx context.Context, where string, args ...any) ([]*NamedRoot, error) {
+	defer db.conn.SetInterrupt(db.conn.SetInterrupt(ctx.Done()))
+	var roots []*NamedRoot
+	err := sqlitex.Execute(db.conn, `select "owner", "name", "path", "link", "time" from "roots" `+where+` order by 1, 2;`, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			roots = append(roots, &NamedRoot{
+				Owner: stmt.ColumnText(0),
+				Name:  stmt.ColumnText(1),
+				Path:  nix.StorePath(stmt.ColumnText(2)),
+				Link:  stmt.ColumnText(3),
+				Time:  time.Unix(stmt.ColumnInt64(4), 0),
+			})
+			return nil
+		},
+	})
+	return roots, err
+}
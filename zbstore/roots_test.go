@@ -0,0 +1,95 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidateRootName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{name: "hello", ok: true},
+		{name: "hello-2.12.1", ok: true},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "a/b"},
+		{name: "a\x00b"},
+	}
+	for _, test := range tests {
+		if err := ValidateRootName(test.name); (err == nil) != test.ok {
+			t.Errorf("ValidateRootName(%q) = %v; want ok=%t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestUserRootsDir(t *testing.T) {
+	s := &Store{Root: "/srv/zb"}
+	want := filepath.Join("/srv/zb", nixStateDir(), "gcroots", "per-user", "alice", "zb")
+	if got := s.UserRootsDir("alice"); got != want {
+		t.Errorf("UserRootsDir(\"alice\") = %q; want %q", got, want)
+	}
+}
+
+func TestNamedRootsDB(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	alice := &NamedRoot{
+		Owner: "alice",
+		Name:  "hello",
+		Path:  testHelloPath,
+		Link:  new(Store).UserRootsDir("alice") + "/hello",
+		Time:  time.Unix(1700000000, 0),
+	}
+	bob := &NamedRoot{
+		Owner: "bob",
+		Name:  "hello",
+		Path:  testGlibcPath,
+		Link:  new(Store).UserRootsDir("bob") + "/hello",
+		Time:  time.Unix(1700000100, 0),
+	}
+	for _, r := range []*NamedRoot{alice, bob} {
+		if err := db.recordRoot(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same name in different namespaces refers to different roots.
+	got, err := db.NamedRoot(ctx, "alice", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(alice, got); diff != "" {
+		t.Errorf("NamedRoot(ctx, \"alice\", \"hello\") (-want +got):\n%s", diff)
+	}
+	if got, err := db.NamedRoots(ctx, "bob"); err != nil {
+		t.Error(err)
+	} else if diff := cmp.Diff([]*NamedRoot{bob}, got); diff != "" {
+		t.Errorf("NamedRoots(ctx, \"bob\") (-want +got):\n%s", diff)
+	}
+	if got, err := db.NamedRoots(ctx, ""); err != nil {
+		t.Error(err)
+	} else if diff := cmp.Diff([]*NamedRoot{alice, bob}, got); diff != "" {
+		t.Errorf("NamedRoots(ctx, \"\") (-want +got):\n%s", diff)
+	}
+
+	if err := db.deleteRoot(ctx, "alice", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NamedRoot(ctx, "alice", "hello"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("NamedRoot(ctx, \"alice\", \"hello\") after delete error = %v; want ErrNotFound", err)
+	}
+	if _, err := db.NamedRoot(ctx, "bob", "hello"); err != nil {
+		t.Errorf("bob's root after deleting alice's: %v", err)
+	}
+}
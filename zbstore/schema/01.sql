@@ -0,0 +1,12 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+create table "paths" (
+  "path" text not null primary key,
+  -- Time that zb first saw the path in the store, in Unix seconds.
+  "registration_time" integer not null,
+  -- Time that zb last used the path, in Unix seconds.
+  "last_access_time" integer
+);
+
+create index "paths_by_last_access_time" on "paths" ("last_access_time");
@@ -0,0 +1,30 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+create table "path_info" (
+  "path" text not null primary key,
+  -- NAR hash in "<type>:<base32>" format.
+  "nar_hash" text not null,
+  "nar_size" integer not null,
+  "deriver" text,
+  -- Time that the store backend registered the path, in Unix seconds.
+  "registration_time" integer not null,
+  -- Whether the path was built locally (as opposed to substituted).
+  "ultimate" integer not null default false,
+  -- Content address, if the path is content-addressed.
+  "ca" text
+);
+
+create table "path_references" (
+  "path" text not null,
+  "reference" text not null,
+  primary key ("path", "reference")
+);
+
+create index "path_references_by_reference" on "path_references" ("reference");
+
+create table "path_signatures" (
+  "path" text not null,
+  "signature" text not null,
+  primary key ("path", "signature")
+);
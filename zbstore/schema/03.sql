@@ -0,0 +1,26 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+create table "realizations" (
+  -- Derivation hash in "<type>:<base32>" format.
+  "drv_hash" text not null,
+  "output_name" text not null,
+  "out_path" text not null,
+  -- Provenance: the derivation that was realized,
+  -- where the realization came from,
+  -- and when it was recorded (in Unix seconds).
+  "drv_path" text,
+  "source" text not null,
+  "time" integer not null,
+
+  primary key ("drv_hash", "output_name")
+);
+
+create index "realizations_by_out_path" on "realizations" ("out_path");
+
+create table "realization_signatures" (
+  "drv_hash" text not null,
+  "output_name" text not null,
+  "signature" text not null,
+  primary key ("drv_hash", "output_name", "signature")
+);
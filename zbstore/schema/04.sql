@@ -0,0 +1,17 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Named garbage collector roots, namespaced by the user that owns them.
+create table "roots" (
+  "owner" text not null,
+  "name" text not null,
+  "path" text not null,
+  -- Location of the symlink that registers the root with the backend.
+  "link" text not null,
+  -- Time that the root was created or last updated, in Unix seconds.
+  "time" integer not null,
+
+  primary key ("owner", "name")
+);
+
+create index "roots_by_path" on "roots" ("path");
@@ -0,0 +1,11 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Signed provenance attestations (DSSE envelopes) for built store objects.
+create table "provenance" (
+  "path" text not null primary key,
+  -- DSSE envelope in JSON format.
+  "envelope" text not null,
+  -- Time that the attestation was recorded, in Unix seconds.
+  "time" integer not null
+);
@@ -0,0 +1,17 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Descriptive metadata of built derivations, for search and license reporting.
+create table "derivation_meta" (
+  "drv_path" text not null primary key,
+  "name" text not null,
+  "version" text not null default '',
+  "description" text not null default '',
+  -- SPDX license expression.
+  "license" text not null default '',
+  "homepage" text not null default '',
+  -- JSON array of strings.
+  "maintainers" text not null default '[]',
+  -- Time that the metadata was recorded, in Unix seconds.
+  "time" integer not null
+);
@@ -0,0 +1,17 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Packages found by evaluating a package set with zb index.
+-- The table is replaced wholesale on each indexing run.
+create table "package_index" (
+  "attr_path" text not null primary key,
+  "drv_path" text not null,
+  "name" text not null,
+  "version" text not null default '',
+  "description" text not null default '',
+  -- SPDX license expression.
+  "license" text not null default '',
+  "homepage" text not null default '',
+  -- JSON array of strings.
+  "maintainers" text not null default '[]'
+);
@@ -0,0 +1,21 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Time and resources used by derivations built on this machine,
+-- for zb store build-stats.
+create table "builds" (
+  "id" integer not null primary key,
+  "drv_path" text not null,
+  -- Package name: the derivation name without its version.
+  "name" text not null,
+  -- Start and end of the build, in Unix milliseconds.
+  "start_time" integer not null,
+  "end_time" integer not null,
+  -- User and system CPU time used by the build in microseconds, if known.
+  "cpu_time" integer,
+  -- Peak resident memory used by the build in bytes, if known.
+  "peak_memory" integer
+);
+
+create index "builds_by_drv_path" on "builds" ("drv_path");
+create index "builds_by_name" on "builds" ("name");
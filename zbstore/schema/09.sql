@@ -0,0 +1,12 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Derivations whose builds failed,
+-- so that zb build can fail fast instead of building them again.
+create table "failed_builds" (
+  "drv_path" text not null primary key,
+  -- Error message that the backend reported for the build.
+  "message" text not null,
+  -- Time that the build failed, in Unix seconds.
+  "time" integer not null
+);
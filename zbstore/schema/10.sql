@@ -0,0 +1,6 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- IPFS CID of a binary cache directory that serves the realization's output,
+-- or null if the output has not been published to IPFS.
+alter table "realizations" add column "cid" text;
@@ -0,0 +1,15 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Substituters that failed recently,
+-- so that zb can skip them instead of waiting on them again.
+-- A substituter's row is removed once it responds again.
+create table "substituter_failures" (
+  "url" text not null primary key,
+  -- Number of consecutive failures.
+  "count" integer not null,
+  -- Error from the most recent failure.
+  "message" text not null,
+  -- Time that the substituter may be tried again, in Unix seconds.
+  "disabled_until" integer not null
+);
@@ -0,0 +1,24 @@
+-- Copyright 2024 Ross Light
+-- SPDX-License-Identifier: MIT
+
+-- Files in the outputs of the packages indexed with zb index --files,
+-- so that zb locate can find which store object provides a file.
+-- The table is replaced wholesale on each indexing run.
+create table "file_index" (
+  "store_path" text not null,
+  -- Slash-separated path of the file relative to the store object.
+  "path" text not null,
+  -- Final element of "path".
+  "name" text not null,
+  -- Attribute path of the package that produced the store object.
+  "attr_path" text not null default '',
+  "type" text not null
+    check ("type" in ('regular', 'executable', 'directory', 'symlink')),
+  -- Size of a regular file in bytes.
+  "size" integer not null default 0,
+  "link_target" text not null default '',
+
+  primary key ("store_path", "path")
+);
+
+create index "file_index_by_name" on "file_index" ("name");
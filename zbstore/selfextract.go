@@ -0,0 +1,392 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// selfExtractMagic marks the end of a self-extracting executable.
+// It is preceded by the little-endian offset of the payload.
+const selfExtractMagic = "zbbundle"
+
+const selfExtractTrailerSize = 8 + len(selfExtractMagic)
+
+const maxSelfExtractManifestSize = 16 << 20
+
+// selfExtractLinkParent is the directory that holds the symlinks
+// that extracted store objects refer to in place of the store directory.
+// Its length must be fixed so that references can be rewritten in place.
+const selfExtractLinkParent = "/tmp/"
+
+// minSelfExtractLinkName is the shortest symlink name
+// that is unlikely to collide with other bundles.
+const minSelfExtractLinkName = 4
+
+// maxSelfExtractLinkAttempts is the number of symlink names
+// that [ExtractSelf] tries for a bundle
+// before giving up because other users have taken them.
+const maxSelfExtractLinkAttempts = 16
+
+// errSelfExtractLinkTaken is returned by claimSelfExtractLink
+// if the symlink name is in use by something else.
+var errSelfExtractLinkTaken = errors.New("link name taken")
+
+// selfExtractManifest describes the payload of a self-extracting executable.
+// The payload is a zstd-compressed stream
+// of the length-prefixed manifest JSON
+// followed by the NARs of the objects in order.
+type selfExtractManifest struct {
+	StoreDir nix.StoreDirectory  `json:"storeDir"`
+	Objects  []selfExtractObject `json:"objects"`
+	Program  string              `json:"program"`
+}
+
+type selfExtractObject struct {
+	Path    nix.StorePath `json:"path"`
+	NARSize int64         `json:"narSize"`
+}
+
+// WriteSelfExtracting writes an executable to w
+// that unpacks the closure of the given store objects
+// and runs program, a file inside the closure.
+// exe is a zb executable for the target machine,
+// which handles unpacking with [ExtractSelf]
+// before acting as the zb command-line interface.
+// If exe is itself a self-extracting executable,
+// its payload is replaced.
+//
+// Since the store objects cannot be unpacked into the store directory
+// on a machine without a store,
+// references to the store directory are rewritten
+// to a symlink of the same length in /tmp
+// that points to the unpacked objects.
+// Since /tmp is shared with other users,
+// [ExtractSelf] only uses a symlink that the current user owns,
+// and picks a different name if another user has taken it.
+// The store directory must therefore be at least
+// 4 bytes longer than "/tmp/".
+func WriteSelfExtracting(ctx context.Context, w io.Writer, store *Store, exe *os.File, paths []nix.StorePath, program string) error {
+	dir := store.dir()
+	if len(dir)-len(selfExtractLinkParent) < minSelfExtractLinkName {
+		return fmt.Errorf("write self-extracting executable: store directory %s is too short to relocate", dir)
+	}
+	programObject, _, err := dir.ParsePath(program)
+	if err != nil {
+		return fmt.Errorf("write self-extracting executable: program: %v", err)
+	}
+	closure, err := ComputeClosure(paths, func(path nix.StorePath) (*PathInfo, error) {
+		return store.QueryPathInfo(ctx, path)
+	})
+	if err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	if !slices.ContainsFunc(closure, func(info *PathInfo) bool { return info.Path == programObject }) {
+		return fmt.Errorf("write self-extracting executable: program %s is not in the closure", program)
+	}
+	manifest := &selfExtractManifest{
+		StoreDir: dir,
+		Program:  program,
+	}
+	for _, info := range closure {
+		manifest.Objects = append(manifest.Objects, selfExtractObject{
+			Path:    info.Path,
+			NARSize: info.NARSize,
+		})
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+
+	exeSize, _, err := selfExtractPayloadOffset(exe)
+	if err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(exe, 0, exeSize)); err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	zw, err := compressNAR(w, nix.Zstandard)
+	if err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	zw.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(manifestData))))
+	zw.Write(manifestData)
+	for _, info := range closure {
+		log.Debugf(ctx, "Adding %s to self-extracting executable", info.Path)
+		h := nix.NewHasher(info.NARHash.Type())
+		if err := nar.DumpPath(io.MultiWriter(zw, h), store.RealPath(string(info.Path))); err != nil {
+			return fmt.Errorf("write self-extracting executable: %s: %v", info.Path, err)
+		}
+		if got := h.SumHash(); !got.Equal(info.NARHash) {
+			return fmt.Errorf("write self-extracting executable: store object %s has been modified (NAR hash is %v, expected %v)", info.Path, got, info.NARHash)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	trailer := binary.LittleEndian.AppendUint64(nil, uint64(exeSize))
+	trailer = append(trailer, selfExtractMagic...)
+	if _, err := w.Write(trailer); err != nil {
+		return fmt.Errorf("write self-extracting executable: %v", err)
+	}
+	return nil
+}
+
+// selfExtractPayloadOffset returns the offset of the payload
+// appended to the executable f
+// or the size of f if it does not have a payload.
+func selfExtractPayloadOffset(f *os.File) (offset int64, hasPayload bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := info.Size()
+	if size < int64(selfExtractTrailerSize) {
+		return size, false, nil
+	}
+	var trailer [selfExtractTrailerSize]byte
+	if _, err := f.ReadAt(trailer[:], size-int64(len(trailer))); err != nil {
+		return 0, false, err
+	}
+	if string(trailer[8:]) != selfExtractMagic {
+		return size, false, nil
+	}
+	offset = int64(binary.LittleEndian.Uint64(trailer[:8]))
+	if offset < 0 || offset > size-int64(len(trailer)) {
+		return 0, false, fmt.Errorf("%s: corrupt payload offset", f.Name())
+	}
+	return offset, true, nil
+}
+
+// ExtractSelf checks whether the executable at exePath
+// was written by [WriteSelfExtracting].
+// If so, ExtractSelf unpacks its store objects into cacheDir
+// (unless a previous run already did)
+// and returns the location of the program to run.
+// If the executable does not have a payload,
+// ExtractSelf returns ok = false and a nil error.
+func ExtractSelf(exePath string, cacheDir string) (program string, ok bool, err error) {
+	f, err := os.Open(exePath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	offset, ok, err := selfExtractPayloadOffset(f)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", true, err
+	}
+	payloadSize := info.Size() - int64(selfExtractTrailerSize) - offset
+	zr, err := decompressNAR(bufio.NewReader(io.NewSectionReader(f, offset, payloadSize)), nix.Zstandard)
+	if err != nil {
+		return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+	}
+	defer zr.Close()
+
+	var manifestSize [8]byte
+	if _, err := io.ReadFull(zr, manifestSize[:]); err != nil {
+		return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+	}
+	n := binary.LittleEndian.Uint64(manifestSize[:])
+	if n > maxSelfExtractManifestSize {
+		return "", true, fmt.Errorf("extract %s: manifest too large", exePath)
+	}
+	manifestData := make([]byte, n)
+	if _, err := io.ReadFull(zr, manifestData); err != nil {
+		return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+	}
+	manifest := new(selfExtractManifest)
+	if err := json.Unmarshal(manifestData, manifest); err != nil {
+		return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+	}
+	id := sha256.Sum256(manifestData)
+	if len(manifest.StoreDir)-len(selfExtractLinkParent) < minSelfExtractLinkName {
+		return "", true, fmt.Errorf("extract %s: store directory %s is too short to relocate", exePath, manifest.StoreDir)
+	}
+
+	// The link name is written into the extracted files,
+	// so claim it before extracting.
+	// Each name gets its own extraction.
+	var linkName, prefix string
+	for attempt := 0; ; attempt++ {
+		if attempt >= maxSelfExtractLinkAttempts {
+			return "", true, fmt.Errorf("extract %s: no free symlink name in %s", exePath, selfExtractLinkParent)
+		}
+		linkName = selfExtractLinkName(manifest.StoreDir, id[:], attempt)
+		prefix = filepath.Join(cacheDir, hex.EncodeToString(id[:]))
+		if attempt > 0 {
+			prefix += "-" + strconv.Itoa(attempt)
+		}
+		err := claimSelfExtractLink(filepath.Join(prefix, "store"), linkName)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errSelfExtractLinkTaken) {
+			return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+		}
+	}
+	program = linkName + strings.TrimPrefix(manifest.Program, string(manifest.StoreDir))
+
+	if _, err := os.Stat(filepath.Join(prefix, "store")); errors.Is(err, os.ErrNotExist) {
+		if err := extractSelfObjects(zr, manifest, prefix, linkName); err != nil {
+			return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+		}
+	} else if err != nil {
+		return "", true, fmt.Errorf("extract %s: %v", exePath, err)
+	}
+	return program, true, nil
+}
+
+// selfExtractLinkName returns the path of the symlink
+// that stands in for dir in a bundle with the given ID.
+// It has the same length as dir
+// and is specific to the current user and attempt number.
+func selfExtractLinkName(dir nix.StoreDirectory, id []byte, attempt int) string {
+	n := len(dir) - len(selfExtractLinkParent)
+	if n < minSelfExtractLinkName {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(id)
+	h.Write([]byte(strconv.Itoa(os.Getuid())))
+	if attempt > 0 {
+		h.Write([]byte("-" + strconv.Itoa(attempt)))
+	}
+	name := hex.EncodeToString(h.Sum(nil))
+	for len(name) < n {
+		name += name
+	}
+	return selfExtractLinkParent + name[:n]
+}
+
+// extractSelfObjects unpacks the NARs read from r into prefix/store,
+// rewriting references to the manifest's store directory to linkName.
+func extractSelfObjects(r io.Reader, manifest *selfExtractManifest, prefix, linkName string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(prefix), 0o755); err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp(filepath.Dir(prefix), filepath.Base(prefix)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tempDir)
+		}
+	}()
+	from := []byte(manifest.StoreDir + "/")
+	to := []byte(linkName + "/")
+	for _, obj := range manifest.Objects {
+		if obj.Path.Dir() != manifest.StoreDir {
+			return fmt.Errorf("%s is not in %s", obj.Path, manifest.StoreDir)
+		}
+		dst := filepath.Join(tempDir, "store", obj.Path.Base())
+		if err := restoreNAR(dst, io.LimitReader(r, obj.NARSize), from, to); err != nil {
+			return fmt.Errorf("%s: %v", obj.Path, err)
+		}
+	}
+	if err := os.Rename(tempDir, prefix); err != nil {
+		if _, statErr := os.Stat(filepath.Join(prefix, "store")); statErr == nil {
+			// Another process extracted the bundle first.
+			os.RemoveAll(tempDir)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreNAR writes the file system object in the NAR read from r to dst,
+// replacing occurrences of from with to in files and symlink targets.
+func restoreNAR(dst string, r io.Reader, from, to []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	nr := nar.NewReader(r)
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dst, filepath.FromSlash(hdr.Path))
+		switch hdr.Mode.Type() {
+		case fs.ModeDir:
+			if err := os.Mkdir(path, 0o755); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			target := string(bytes.ReplaceAll([]byte(hdr.LinkTarget), from, to))
+			if err := os.Symlink(target, path); err != nil {
+				return err
+			}
+		default:
+			perm := fs.FileMode(0o644)
+			if hdr.Mode&0o111 != 0 {
+				perm = 0o755
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+			if err != nil {
+				return err
+			}
+			rw := newRewriteWriter(f, from, to)
+			_, err = io.Copy(rw, nr)
+			if err == nil {
+				err = rw.Flush()
+			}
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// claimSelfExtractLink creates a symlink at link pointing to target
+// unless the current user already has one.
+// It returns [errSelfExtractLinkTaken]
+// if link exists and is not such a symlink.
+func claimSelfExtractLink(target, link string) error {
+	err := os.Symlink(target, link)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if uid, ok := linkOwner(link); ok && uid != os.Getuid() {
+		return fmt.Errorf("%s: %w", link, errSelfExtractLinkTaken)
+	}
+	if got, err := os.Readlink(link); err != nil || got != target {
+		return fmt.Errorf("%s: %w", link, errSelfExtractLinkTaken)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestSelfExtracting(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a store with a single program registered in a fake Nix database.
+	nixStore := newTestNixStore(t, func(path string) error {
+		if err := os.MkdirAll(filepath.Join(path, "bin"), 0o755); err != nil {
+			return err
+		}
+		script := "#!/bin/sh\nexec " + path + "/share/greeting\n"
+		if err := os.WriteFile(filepath.Join(path, "bin", "hello"), []byte(script), 0o755); err != nil {
+			return err
+		}
+		return os.Symlink(path+"/bin/hello", filepath.Join(path, "hi"))
+	})
+	storeDir, path := nixStore.dir, nixStore.path
+
+	const exeContent = "\x7fELF pretend this is zb"
+	exePath := filepath.Join(t.TempDir(), "zb")
+	if err := os.WriteFile(exePath, []byte(exeContent), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := ExtractSelf(exePath, t.TempDir()); ok || err != nil {
+		t.Errorf("ExtractSelf(plain executable) = _, %t, %v; want _, false, <nil>", ok, err)
+	}
+
+	writeBundle := func(exePath string) string {
+		t.Helper()
+		exe, err := os.Open(exePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer exe.Close()
+		bundlePath := filepath.Join(t.TempDir(), "hello")
+		out, err := os.Create(bundlePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		program := string(path) + "/bin/hello"
+		if err := WriteSelfExtracting(ctx, out, &Store{Dir: storeDir}, exe, []nix.StorePath{path}, program); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return bundlePath
+	}
+	bundlePath := writeBundle(exePath)
+	bundleData, err := os.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bundleData, []byte(exeContent)) {
+		t.Error("bundle does not start with executable")
+	}
+	// Bundling with a bundle replaces its payload.
+	if rebundled, err := os.ReadFile(writeBundle(bundlePath)); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(rebundled, bundleData) {
+		t.Error("bundle written from bundle differs from original")
+	}
+
+	cacheDir := t.TempDir()
+	program, ok, err := ExtractSelf(bundlePath, cacheDir)
+	if !ok || err != nil {
+		t.Fatalf("ExtractSelf(...) = %q, %t, %v; want _, true, <nil>", program, ok, err)
+	}
+	link, _, _ := strings.Cut(strings.TrimPrefix(program, selfExtractLinkParent), "/")
+	link = selfExtractLinkParent + link
+	t.Cleanup(func() { os.Remove(link) })
+	if len(link) != len(storeDir) {
+		t.Errorf("link %s has length %d; want %d", link, len(link), len(storeDir))
+	}
+	if want := link + "/" + path.Base() + "/bin/hello"; program != want {
+		t.Errorf("program = %q; want %q", program, want)
+	}
+	got, err := os.ReadFile(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "#!/bin/sh\nexec " + link + "/" + path.Base() + "/share/greeting\n"; string(got) != want {
+		t.Errorf("program content = %q; want %q", got, want)
+	}
+	if info, err := os.Stat(program); err != nil {
+		t.Error(err)
+	} else if info.Mode()&0o111 == 0 {
+		t.Errorf("program mode = %v; want executable", info.Mode())
+	}
+	if target, err := os.Readlink(filepath.Join(link, path.Base(), "hi")); err != nil {
+		t.Error(err)
+	} else if want := link + "/" + path.Base() + "/bin/hello"; target != want {
+		t.Errorf("symlink target = %q; want %q", target, want)
+	}
+
+	// Running again uses the extracted files.
+	if program2, ok, err := ExtractSelf(bundlePath, cacheDir); !ok || err != nil || program2 != program {
+		t.Errorf("second ExtractSelf(...) = %q, %t, %v; want %q, true, <nil>", program2, ok, err, program)
+	}
+
+	// A link name taken by something else is not reused.
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), link); err != nil {
+		t.Fatal(err)
+	}
+	program3, ok, err := ExtractSelf(bundlePath, t.TempDir())
+	if !ok || err != nil {
+		t.Fatalf("ExtractSelf(...) with taken link = %q, %t, %v; want _, true, <nil>", program3, ok, err)
+	}
+	link3, _, _ := strings.Cut(strings.TrimPrefix(program3, selfExtractLinkParent), "/")
+	link3 = selfExtractLinkParent + link3
+	t.Cleanup(func() { os.Remove(link3) })
+	if link3 == link {
+		t.Errorf("ExtractSelf(...) with taken link used %s again", link)
+	}
+	if len(link3) != len(storeDir) {
+		t.Errorf("link %s has length %d; want %d", link3, len(link3), len(storeDir))
+	}
+	if got, err := os.ReadFile(program3); err != nil {
+		t.Error(err)
+	} else if want := "#!/bin/sh\nexec " + link3 + "/" + path.Base() + "/share/greeting\n"; string(got) != want {
+		t.Errorf("program content = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"zombiezen.com/go/nix"
+)
+
+// A ModuloHasher computes the hash of a byte stream
+// modulo the occurrences of a store path digest,
+// as Nix does to compute the content address
+// of a store object that refers to itself.
+// Occurrences of the digest are hashed as zero bytes
+// and their offsets are appended to the hashed data
+// so that a stream that already contains zeroes
+// in place of the digest hashes differently.
+type ModuloHasher struct {
+	h       *nix.Hasher
+	rw      *rewriteWriter
+	matches []int64
+}
+
+// NewModuloHasher returns a new [ModuloHasher]
+// that hashes with the given algorithm modulo the given store path digest.
+func NewModuloHasher(typ nix.HashType, digest string) *ModuloHasher {
+	mh := &ModuloHasher{h: nix.NewHasher(typ)}
+	mh.rw = newRewriteWriter(mh.h, []byte(digest), make([]byte, len(digest)))
+	mh.rw.match = func(off int64) {
+		mh.matches = append(mh.matches, off)
+	}
+	return mh
+}
+
+// Write adds more data to the running hash. It never returns an error.
+func (mh *ModuloHasher) Write(p []byte) (n int, err error) {
+	return mh.rw.Write(p)
+}
+
+// SumHash returns the hash of the data written
+// and reports whether the data contained the digest.
+// The ModuloHasher must not be written to after calling SumHash.
+func (mh *ModuloHasher) SumHash() (_ nix.Hash, found bool) {
+	mh.rw.Flush()
+	for _, off := range mh.matches {
+		fmt.Fprintf(mh.h, "|%d", off)
+	}
+	return mh.h.SumHash(), len(mh.matches) > 0
+}
+
+// MakeContentAddressed computes the content-addressed store path
+// of a store object that was built at tempPath
+// and whose NAR serialization is read from nar.
+// Occurrences of tempPath's digest in the NAR are treated as self-references:
+// the content address is computed modulo the digest (see [ModuloHasher])
+// and a copy of the NAR with the occurrences rewritten to the final path's digest
+// is written to dst.
+// references is the set of other store objects that the object refers to;
+// tempPath is ignored if present.
+// The returned [PathInfo] describes the rewritten NAR.
+func MakeContentAddressed(dst io.Writer, nar io.ReadSeeker, tempPath nix.StorePath, name string, references []nix.StorePath) (*PathInfo, error) {
+	tempDigest := tempPath.Digest()
+	mh := NewModuloHasher(nix.SHA256, tempDigest)
+	if _, err := io.Copy(mh, nar); err != nil {
+		return nil, fmt.Errorf("make %s content-addressed: %v", tempPath, err)
+	}
+	caHash, self := mh.SumHash()
+	ca := nix.RecursiveFileContentAddress(caHash)
+	refs := StoreReferences{Self: self}
+	for _, ref := range references {
+		if ref != tempPath {
+			refs.Others = append(refs.Others, ref)
+		}
+	}
+	slices.Sort(refs.Others)
+	refs.Others = slices.Compact(refs.Others)
+	finalPath, err := FixedCAOutputPath(tempPath.Dir(), name, ca, refs)
+	if err != nil {
+		return nil, fmt.Errorf("make %s content-addressed: %v", tempPath, err)
+	}
+
+	if _, err := nar.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("make %s content-addressed: %v", tempPath, err)
+	}
+	narHasher := nix.NewHasher(nix.SHA256)
+	cw := &countWriter{w: io.MultiWriter(dst, narHasher)}
+	rw := newRewriteWriter(cw, []byte(tempDigest), []byte(finalPath.Digest()))
+	if _, err := io.Copy(rw, nar); err != nil {
+		return nil, fmt.Errorf("make %s content-addressed: %v", tempPath, err)
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, fmt.Errorf("make %s content-addressed: %v", tempPath, err)
+	}
+
+	info := &PathInfo{
+		Path:       finalPath,
+		NARHash:    narHasher.SumHash(),
+		NARSize:    cw.n,
+		References: refs.Others,
+		CA:         ca,
+	}
+	if self {
+		info.References = append(slices.Clone(refs.Others), finalPath)
+		slices.Sort(info.References)
+	}
+	return info, nil
+}
+
+// countWriter counts the bytes written to an underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+func TestFixedCAOutputPath(t *testing.T) {
+	const content = "Hello, World!\n"
+	h := sha256.Sum256([]byte(content))
+	contentHash := nix.NewHash(nix.SHA256, h[:])
+	narData := singleFileNAR(t, content)
+	narHash := sha256.Sum256(narData)
+
+	tests := []struct {
+		name string
+		ca   nix.ContentAddress
+		want nix.StorePath
+	}{
+		{
+			name: "Text",
+			ca:   nix.TextContentAddress(contentHash),
+			want: "/nix/store/q4dz47g15qmlsm01aijr737w8avkaac6-hello.txt",
+		},
+		{
+			name: "FlatFile",
+			ca:   nix.FlatFileContentAddress(contentHash),
+			want: "/nix/store/22lrzcnq9ch2f3sz8d2idrm9gn72vcy2-hello.txt",
+		},
+		{
+			name: "RecursiveFile",
+			ca:   nix.RecursiveFileContentAddress(nix.NewHash(nix.SHA256, narHash[:])),
+			want: "/nix/store/8dh7w49x7r3xkwz39vavcq6znygmzrp0-hello.txt",
+		},
+	}
+	for _, test := range tests {
+		got, err := FixedCAOutputPath(nix.DefaultStoreDirectory, "hello.txt", test.ca, StoreReferences{})
+		if got != test.want || err != nil {
+			t.Errorf("FixedCAOutputPath(%q, %q, %v, {}) = %q, %v; want %q, <nil>",
+				nix.DefaultStoreDirectory, "hello.txt", test.ca, got, err, test.want)
+		}
+	}
+}
+
+func TestMakeContentAddressed(t *testing.T) {
+	const (
+		temp1 nix.StorePath = "/nix/store/00000000000000000000000000000000-hello"
+		temp2 nix.StorePath = "/nix/store/11111111111111111111111111111111-hello"
+		dep   nix.StorePath = "/nix/store/22222222222222222222222222222222-dep"
+	)
+	script := func(self nix.StorePath) string {
+		return "#!" + string(dep) + "/bin/sh\nexec " + string(self) + "/libexec/hello\n"
+	}
+
+	info1, out1 := makeContentAddressed(t, singleFileNAR(t, script(temp1)), temp1, []nix.StorePath{dep, temp1})
+	info2, out2 := makeContentAddressed(t, singleFileNAR(t, script(temp2)), temp2, []nix.StorePath{temp2, dep})
+	if info1.Path != info2.Path {
+		t.Errorf("paths differ for different temporary paths: %s != %s", info1.Path, info2.Path)
+	}
+	if !bytes.Equal(out1, out2) {
+		t.Error("rewritten NARs differ for different temporary paths")
+	}
+	if want := singleFileNAR(t, script(info1.Path)); !bytes.Equal(out1, want) {
+		t.Errorf("rewritten NAR = %q; want %q", out1, want)
+	}
+	if got, want := info1.NARHash, nixSHA256(out1); !got.Equal(want) {
+		t.Errorf("NARHash = %v; want %v", got, want)
+	}
+	if got, want := info1.NARSize, int64(len(out1)); got != want {
+		t.Errorf("NARSize = %d; want %d", got, want)
+	}
+	wantRefs := []nix.StorePath{dep, info1.Path}
+	if info1.Path < dep {
+		wantRefs = []nix.StorePath{info1.Path, dep}
+	}
+	if !slices.Equal(info1.References, wantRefs) {
+		t.Errorf("References = %v; want %v", info1.References, wantRefs)
+	}
+	if !info1.CA.IsRecursiveFile() {
+		t.Errorf("CA = %v; want recursive file", info1.CA)
+	}
+
+	// Without self-references, the content address is the NAR hash.
+	plain := singleFileNAR(t, "Hello, World!\n")
+	info, out := makeContentAddressed(t, plain, temp1, nil)
+	if !bytes.Equal(out, plain) {
+		t.Errorf("NAR without self-references was rewritten to %q", out)
+	}
+	if got, want := info.CA.Hash(), nixSHA256(plain); !got.Equal(want) {
+		t.Errorf("CA hash = %v; want %v", got, want)
+	}
+	if len(info.References) != 0 {
+		t.Errorf("References = %v; want []", info.References)
+	}
+}
+
+func TestModuloHasher(t *testing.T) {
+	const digest = "00000000000000000000000000000000"
+	zeroed := strings.Repeat("\x00", len(digest))
+	hash := func(s string) nix.Hash {
+		mh := NewModuloHasher(nix.SHA256, digest)
+		// Write a byte at a time to exercise matches that span writes.
+		for i := 0; i < len(s); i++ {
+			mh.Write([]byte{s[i]})
+		}
+		h, _ := mh.SumHash()
+		return h
+	}
+	if hash("a" + digest + "b").Equal(hash("a" + zeroed + "b")) {
+		t.Error("digest and zero bytes hash the same")
+	}
+	if !hash("a" + digest + "b").Equal(hash("a" + digest + "b")) {
+		t.Error("hash is not deterministic")
+	}
+	if hash("a" + digest + "b").Equal(hash("ab" + digest)) {
+		t.Error("offset of digest does not affect hash")
+	}
+}
+
+func makeContentAddressed(tb testing.TB, narData []byte, tempPath nix.StorePath, refs []nix.StorePath) (*PathInfo, []byte) {
+	tb.Helper()
+	out := new(bytes.Buffer)
+	info, err := MakeContentAddressed(out, bytes.NewReader(narData), tempPath, "hello", refs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return info, out.Bytes()
+}
+
+func singleFileNAR(tb testing.TB, content string) []byte {
+	tb.Helper()
+	buf := new(bytes.Buffer)
+	w := nar.NewWriter(buf)
+	if err := w.WriteHeader(&nar.Header{Size: int64(len(content))}); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func nixSHA256(data []byte) nix.Hash {
+	h := sha256.Sum256(data)
+	return nix.NewHash(nix.SHA256, h[:])
+}
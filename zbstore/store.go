@@ -0,0 +1,662 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+// Package zbstore provides access to the store that zb builds into.
+// The store is currently managed by a local Nix installation:
+// operations are performed by running the nix-store command.
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/zb/internal/spans"
+)
+
+// Store is a handle to a local store.
+type Store struct {
+	// Dir is the store directory.
+	// If empty, [nix.DefaultStoreDirectory] is used.
+	Dir nix.StoreDirectory
+	// Root is a directory in the local file system
+	// that holds the store in place of the file system root,
+	// so that an unprivileged user can keep a store
+	// whose objects' paths are computed against Dir
+	// while the objects live at Root joined with their paths
+	// (see [Store.RealPath]).
+	// The backend's state directory is also under Root,
+	// and builds see the store mounted at Dir.
+	// If empty, the store is at its logical location.
+	Root string
+	// Lower is a read-only store whose objects are visible through this one,
+	// such as a store on a network mount that several machines share.
+	// Lookups that miss in this store fall through to Lower,
+	// and new objects are only written to this store,
+	// whose objects are kept in the UpperLayer directory.
+	// Lower must have the same Dir as this store.
+	//
+	// The backend expects the store directory (as given by [Store.RealPath])
+	// to be an overlay file system mount
+	// with Lower's store directory as the lower directory
+	// and UpperLayer as the upper directory.
+	// If nil, the store has no lower layer.
+	Lower *Store
+	// UpperLayer is the directory in the local file system
+	// that holds the objects that were added to the store
+	// on top of the objects in Lower.
+	// It is ignored if Lower is nil.
+	UpperLayer string
+	// Stderr is where the output of the backend's diagnostics are written.
+	// If nil, os.Stderr is used.
+	Stderr io.Writer
+	// ExtraPlatforms is a list of system types (e.g. "i686-linux")
+	// other than the host's that derivations may be built for locally.
+	// See [CompatibleSystems].
+	ExtraPlatforms []string
+	// SandboxPaths is a list of additional paths to make available
+	// inside the build sandbox, such as the interpreters of [Emulator]s.
+	SandboxPaths []string
+	// AutoOptimise is whether new store objects
+	// should have their files hard-linked to identical files already in the store.
+	// See [Store.Optimise].
+	AutoOptimise bool
+	// BuildUsersGroup is the name of a group whose members are unprivileged users
+	// that builders run as, one build per user at a time,
+	// so that builds cannot tamper with each other or with the invoking user's files.
+	// It only takes effect when the store is operated by root,
+	// such as in a daemon (see [Server]).
+	// If empty, the backend's configured group is used.
+	BuildUsersGroup string
+	// Substituters is a list of URLs of binary caches
+	// to download store objects from instead of building them.
+	// If empty, the backend's configured substituters are used.
+	Substituters []string
+	// TrustedPublicKeys is a list of public keys
+	// whose signatures are accepted on substituted store objects.
+	// If empty, the backend's configured keys are used.
+	TrustedPublicKeys []string
+	// ExtraSubstituters is a list of URLs of binary caches
+	// to use in addition to Substituters,
+	// such as peers found with [DiscoverPeers].
+	ExtraSubstituters []string
+	// NoRequireSigs disables the check that substituted store objects
+	// are signed by one of TrustedPublicKeys.
+	NoRequireSigs bool
+	// NoSubstitutes disables substitution,
+	// so that every missing store object is built locally.
+	NoSubstitutes bool
+	// Fallback is whether to build a derivation locally
+	// if downloading its outputs from a substituter fails,
+	// instead of failing the build.
+	Fallback bool
+	// NARInfoPositiveTTL and NARInfoNegativeTTL are how long the backend remembers
+	// that a substituter has or does not have a store object
+	// (see [NARInfoCache]).
+	// If zero, the backend's configured durations are used.
+	// If negative, the results are not remembered.
+	NARInfoPositiveTTL time.Duration
+	NARInfoNegativeTTL time.Duration
+	// NetrcFile is the path of a .netrc file
+	// with credentials for the substituters.
+	// If empty, the backend's configured file is used.
+	// (The backend does not support bearer tokens or client certificates:
+	// see [CacheAuth] for those.)
+	NetrcFile string
+	// MaxJobs is the maximum number of builds to run in parallel.
+	// If zero, the backend's configured limit is used.
+	MaxJobs int
+	// Sandbox is the backend's sandbox mode:
+	// "true", "false", or "relaxed".
+	// If empty, the backend's configured mode is used.
+	Sandbox string
+	// Progress is called with notifications of progress during [Store.Realise].
+	// If Progress is not nil, build logs are sent to Progress as [BuildLog] events
+	// instead of being written to Stderr.
+	// Progress is not called when builds are performed by a daemon (see Socket).
+	Progress func(*BuildEvent)
+	// BuildStats is called during [Store.Realise]
+	// with the time and resources used by each derivation
+	// that the backend built successfully.
+	// CPU time and peak memory are only known
+	// if the backend ran a single build itself
+	// rather than sending it to a Nix daemon.
+	// BuildStats is not called when builds are performed by a daemon (see Socket).
+	BuildStats func(*BuildStats)
+	// BuildFailed is called during [Store.Realise]
+	// for each derivation whose builder the backend ran and that failed.
+	// BuildFailed is not called when builds are performed by a daemon (see Socket).
+	BuildFailed func(*BuildFailure)
+	// Socket is the path to the Unix socket of a store daemon (see [Server]).
+	// If set, builds and root registrations are performed by the daemon
+	// instead of by running the backend directly.
+	// Queries, imports, and all other operations still run the backend locally,
+	// so the invoking user must still have access to the store.
+	Socket string
+}
+
+func (s *Store) dir() nix.StoreDirectory {
+	if s == nil || s.Dir == "" {
+		return nix.DefaultStoreDirectory
+	}
+	return s.Dir
+}
+
+// RealPath returns the location in the local file system
+// of the absolute path p, which is usually inside the store directory.
+// It is p unless the store has a [Store.Root].
+func (s *Store) RealPath(p string) string {
+	if s == nil || s.Root == "" {
+		return p
+	}
+	return filepath.Join(s.Root, p)
+}
+
+// stateDir returns the local path of the backend's state directory.
+func (s *Store) stateDir() string {
+	return s.RealPath(nixStateDir())
+}
+
+// hasCustomLayout reports whether the backend must be told
+// where to find the store
+// because it has a [Store.Root] or a [Store.Lower] layer.
+func (s *Store) hasCustomLayout() bool {
+	return s != nil && (s.Root != "" || s.Lower != nil)
+}
+
+// storeURL returns the backend's URL for the store.
+func (s *Store) storeURL() string {
+	params := s.localStoreParams()
+	if s.Lower == nil {
+		return "local?" + params.Encode()
+	}
+	lowerParams := s.Lower.localStoreParams()
+	lowerParams.Set("read-only", "true")
+	params.Set("lower-store", "local?"+lowerParams.Encode())
+	params.Set("upper-layer", s.UpperLayer)
+	return "local-overlay://?" + params.Encode()
+}
+
+// localStoreParams returns the backend's local store parameters
+// for the store's directory and root.
+func (s *Store) localStoreParams() url.Values {
+	params := make(url.Values)
+	if s.Root != "" {
+		params.Set("root", s.Root)
+	}
+	if s.Dir != "" {
+		params.Set("store", string(s.Dir))
+	}
+	return params
+}
+
+func (s *Store) socket() string {
+	if s == nil {
+		return ""
+	}
+	return s.Socket
+}
+
+func (s *Store) stderr() io.Writer {
+	if s == nil || s.Stderr == nil {
+		return os.Stderr
+	}
+	return s.Stderr
+}
+
+// command returns a nix-store command with the given arguments
+// that uses the store's configuration.
+// The command's stderr is not set.
+func (s *Store) command(ctx context.Context, args ...string) *exec.Cmd {
+	var argv []string
+	if s.hasCustomLayout() {
+		argv = append(argv, "--option", "store", s.storeURL())
+	}
+	if s != nil && s.Lower != nil {
+		argv = append(argv, "--option", "extra-experimental-features", "local-overlay-store")
+	}
+	if s != nil && len(s.ExtraPlatforms) > 0 {
+		argv = append(argv, "--option", "extra-platforms", strings.Join(s.ExtraPlatforms, " "))
+	}
+	if s != nil && len(s.SandboxPaths) > 0 {
+		argv = append(argv, "--option", "extra-sandbox-paths", strings.Join(s.SandboxPaths, " "))
+	}
+	if s != nil && s.AutoOptimise {
+		argv = append(argv, "--option", "auto-optimise-store", "true")
+	}
+	if s != nil && len(s.Substituters) > 0 {
+		argv = append(argv, "--option", "substituters", strings.Join(s.Substituters, " "))
+	}
+	if s != nil && len(s.ExtraSubstituters) > 0 {
+		argv = append(argv, "--option", "extra-substituters", strings.Join(s.ExtraSubstituters, " "))
+	}
+	if s != nil && s.NoSubstitutes {
+		argv = append(argv, "--option", "substitute", "false")
+	}
+	if s != nil && s.Fallback {
+		argv = append(argv, "--option", "fallback", "true")
+	}
+	if s != nil && len(s.TrustedPublicKeys) > 0 {
+		argv = append(argv, "--option", "trusted-public-keys", strings.Join(s.TrustedPublicKeys, " "))
+	}
+	if s != nil && s.NoRequireSigs {
+		argv = append(argv, "--option", "require-sigs", "false")
+	}
+	if s != nil && s.NARInfoPositiveTTL != 0 {
+		argv = append(argv, "--option", "narinfo-cache-positive-ttl", ttlSeconds(s.NARInfoPositiveTTL))
+	}
+	if s != nil && s.NARInfoNegativeTTL != 0 {
+		argv = append(argv, "--option", "narinfo-cache-negative-ttl", ttlSeconds(s.NARInfoNegativeTTL))
+	}
+	if s != nil && s.NetrcFile != "" {
+		argv = append(argv, "--option", "netrc-file", s.NetrcFile)
+	}
+	if s != nil && s.MaxJobs > 0 {
+		argv = append(argv, "--option", "max-jobs", strconv.Itoa(s.MaxJobs))
+	}
+	if s != nil && s.Sandbox != "" {
+		argv = append(argv, "--option", "sandbox", s.Sandbox)
+	}
+	if s != nil && s.BuildUsersGroup != "" {
+		argv = append(argv, "--option", "build-users-group", s.BuildUsersGroup)
+	}
+	argv = append(argv, args...)
+	return exec.CommandContext(ctx, "nix-store", argv...)
+}
+
+// ttlSeconds formats a duration as the whole number of seconds
+// that the backend's TTL settings take,
+// with a negative duration meaning zero (not remembered).
+func ttlSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(max(d, 0)/time.Second), 10)
+}
+
+// nixStore runs nix-store with the given arguments and returns its output.
+func (s *Store) nixStore(ctx context.Context, args ...string) ([]byte, error) {
+	c := s.command(ctx, args...)
+	c.Stderr = s.stderr()
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nix-store %s: %v", strings.Join(args[:min(len(args), 2)], " "), err)
+	}
+	return out, nil
+}
+
+// nixStorePaths runs nix-store with the given arguments
+// and parses its output as a list of store paths, one per line.
+func (s *Store) nixStorePaths(ctx context.Context, args ...string) ([]nix.StorePath, error) {
+	out, err := s.nixStore(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseStorePathLines(out)
+}
+
+func parseStorePathLines(out []byte) ([]nix.StorePath, error) {
+	var paths []nix.StorePath
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		p, err := nix.ParseStorePath(string(line))
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// Realise builds the given derivations if their outputs are not yet valid.
+// Realise returns the paths of all the derivations' outputs.
+func (s *Store) Realise(ctx context.Context, drvPaths ...nix.StorePath) ([]nix.StorePath, error) {
+	return s.RealisePaths(ctx, derivedPaths(drvPaths)...)
+}
+
+// RealisePaths builds the given derivation outputs if they are not yet valid
+// and ensures that the given store objects are valid,
+// substituting them if necessary.
+// A path that refers to a derivation without naming its outputs
+// realises all of the derivation's outputs.
+// RealisePaths returns the paths of the realised outputs and store objects.
+func (s *Store) RealisePaths(ctx context.Context, paths ...DerivedPath) (_ []nix.StorePath, err error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	ctx, span := tracer.Start(ctx, "zbstore.Realise", trace.WithAttributes(
+		attribute.Int("zb.derivation.count", len(paths)),
+	))
+	defer func() { spans.End(span, err) }()
+	if s.socket() != "" {
+		resp := new(RealiseResponse)
+		if err := s.call(ctx, "Realise", &RealiseRequest{Paths: paths}, resp); err != nil {
+			return nil, fmt.Errorf("realise: %w", err)
+		}
+		return resp.OutputPaths, nil
+	}
+	return s.realise(ctx, nil, paths)
+}
+
+func derivedPaths(paths []nix.StorePath) []DerivedPath {
+	dps := make([]DerivedPath, 0, len(paths))
+	for _, p := range paths {
+		dps = append(dps, DerivedPath{Path: p})
+	}
+	return dps
+}
+
+// Rebuild builds the given derivations
+// even if their outputs are already valid,
+// instead of substituting them or reusing the existing outputs.
+// The derivations' inputs are realised as usual by [Store.Realise].
+// Since the backend cannot replace valid store objects,
+// outputs that were already valid are built again
+// and compared against the existing outputs:
+// if the build is not reproducible, Rebuild returns an error
+// and the existing outputs are kept.
+// Rebuild returns the paths of all the derivations' outputs.
+func (s *Store) Rebuild(ctx context.Context, drvPaths ...nix.StorePath) (_ []nix.StorePath, err error) {
+	if len(drvPaths) == 0 {
+		return nil, nil
+	}
+	ctx, span := tracer.Start(ctx, "zbstore.Rebuild", trace.WithAttributes(
+		attribute.Int("zb.derivation.count", len(drvPaths)),
+	))
+	defer func() { spans.End(span, err) }()
+	if s.socket() != "" {
+		resp := new(RealiseResponse)
+		if err := s.call(ctx, "Realise", &RealiseRequest{Paths: derivedPaths(drvPaths), Rebuild: true}, resp); err != nil {
+			return nil, fmt.Errorf("rebuild: %w", err)
+		}
+		return resp.OutputPaths, nil
+	}
+
+	refs, err := s.QueryReferences(ctx, drvPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("rebuild: %v", err)
+	}
+	var inputs []nix.StorePath
+	for _, ref := range refs {
+		if ref.IsDerivation() && !slices.Contains(drvPaths, ref) {
+			inputs = append(inputs, ref)
+		}
+	}
+	if _, err := s.Realise(ctx, inputs...); err != nil {
+		return nil, fmt.Errorf("rebuild: %v", err)
+	}
+
+	var built, missing []nix.StorePath
+	for _, drvPath := range drvPaths {
+		if s.outputsValid(ctx, drvPath) {
+			built = append(built, drvPath)
+		} else {
+			missing = append(missing, drvPath)
+		}
+	}
+	var outPaths []nix.StorePath
+	if len(missing) > 0 {
+		paths, err := s.realise(ctx, []string{"--option", "substitute", "false"}, derivedPaths(missing))
+		if err != nil {
+			return nil, err
+		}
+		outPaths = append(outPaths, paths...)
+	}
+	if len(built) > 0 {
+		paths, err := s.realise(ctx, []string{"--check"}, derivedPaths(built))
+		if err != nil {
+			return nil, err
+		}
+		outPaths = append(outPaths, paths...)
+	}
+	return outPaths, nil
+}
+
+// outputsValid reports whether all the outputs of the derivation at drvPath
+// are present in the store.
+func (s *Store) outputsValid(ctx context.Context, drvPath nix.StorePath) bool {
+	outPaths, err := s.nixStorePaths(ctx, queryArgs("--outputs", []nix.StorePath{drvPath})...)
+	if err != nil || len(outPaths) == 0 {
+		return false
+	}
+	for _, p := range outPaths {
+		if _, err := os.Lstat(s.RealPath(string(p))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// realise runs nix-store --realise with the given extra flags.
+func (s *Store) realise(ctx context.Context, flags []string, paths []DerivedPath) ([]nix.StorePath, error) {
+	span := trace.SpanFromContext(ctx)
+	args := make([]string, 0, len(flags)+len(paths)+4)
+	// Builds and downloads are only visible in the backend's structured log.
+	structured := s.Progress != nil || s.BuildStats != nil || s.BuildFailed != nil || span.IsRecording()
+	if structured {
+		args = append(args, "--log-format", "internal-json")
+	}
+	args = append(args, "--realise")
+	args = append(args, flags...)
+	args = append(args, "--")
+	for _, p := range paths {
+		args = append(args, p.String())
+	}
+	if !structured {
+		return s.nixStorePaths(ctx, args...)
+	}
+
+	progress := s.Progress
+	if progress == nil {
+		progress = plainLog(s.stderr())
+	}
+	if span.IsRecording() {
+		spans := newActivitySpans(ctx, progress)
+		defer spans.close()
+		progress = spans.event
+	}
+	var timer *buildTimer
+	if s.BuildStats != nil || s.BuildFailed != nil {
+		timer = newBuildTimer(progress)
+		progress = timer.event
+	}
+	c := s.command(ctx, args...)
+	pw := newProgressWriter(progress, s.stderr())
+	c.Stderr = pw
+	out, err := c.Output()
+	pw.Flush()
+	if timer != nil && s.BuildStats != nil {
+		for _, stats := range timer.results(s.backendUsage(c.ProcessState)) {
+			s.BuildStats(stats)
+		}
+	}
+	if timer != nil && s.BuildFailed != nil {
+		for _, f := range timer.failures() {
+			s.BuildFailed(f)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --realise: %v", err)
+	}
+	return parseStorePathLines(out)
+}
+
+// RealiseOutputs builds the derivation at drvPath
+// if its outputs are not yet valid.
+// RealiseOutputs returns the derivation's output paths keyed by output name.
+func (s *Store) RealiseOutputs(ctx context.Context, drvPath nix.StorePath) (map[string]nix.StorePath, error) {
+	paths, err := s.Realise(ctx, drvPath)
+	if err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]nix.StorePath, len(paths))
+	for _, p := range paths {
+		name, ok := OutputName(drvPath, p)
+		if !ok {
+			return outputs, fmt.Errorf("realise %s: unexpected output %s", drvPath, p)
+		}
+		outputs[name] = p
+	}
+	return outputs, nil
+}
+
+// OutputName returns the name of the derivation output
+// that outputPath corresponds to, based on the store object names.
+// Derivation outputs are named "<drvName>" for the "out" output
+// and "<drvName>-<outputName>" for others.
+func OutputName(drvPath, outputPath nix.StorePath) (outputName string, ok bool) {
+	drvName, isDrv := strings.CutSuffix(drvPath.Name(), ".drv")
+	if !isDrv {
+		return "", false
+	}
+	name := outputPath.Name()
+	if name == drvName {
+		return "out", true
+	}
+	outputName, ok = strings.CutPrefix(name, drvName+"-")
+	if !ok || outputName == "" {
+		return "", false
+	}
+	return outputName, true
+}
+
+// QueryRequisites returns the closure of the given store paths:
+// the paths themselves and every path they transitively reference.
+func (s *Store) QueryRequisites(ctx context.Context, paths ...nix.StorePath) ([]nix.StorePath, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return s.nixStorePaths(ctx, queryArgs("--requisites", paths)...)
+}
+
+// QuerySizes returns the NAR size in bytes of each of the given store paths.
+func (s *Store) QuerySizes(ctx context.Context, paths ...nix.StorePath) ([]int64, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sizes := make([]int64, 0, len(paths))
+	for _, batch := range pathBatches(paths) {
+		out, err := s.nixStore(ctx, queryArgs("--size", batch)...)
+		if err != nil {
+			return sizes, err
+		}
+		for _, line := range strings.Fields(string(out)) {
+			n, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return sizes, fmt.Errorf("nix-store --query --size: %v", err)
+			}
+			sizes = append(sizes, n)
+		}
+	}
+	if len(sizes) != len(paths) {
+		return sizes, fmt.Errorf("nix-store --query --size: got %d sizes for %d paths", len(sizes), len(paths))
+	}
+	return sizes, nil
+}
+
+// ClosureSize returns the total NAR size in bytes
+// of the closure of the given store paths.
+func (s *Store) ClosureSize(ctx context.Context, paths ...nix.StorePath) (int64, error) {
+	closure, err := s.QueryRequisites(ctx, paths...)
+	if err != nil {
+		return 0, err
+	}
+	sizes, err := s.QuerySizes(ctx, closure...)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, n := range sizes {
+		total += n
+	}
+	return total, nil
+}
+
+// maxPathArgs is the largest number of store paths
+// passed to a single nix-store invocation,
+// which keeps the command line well under the operating system's limit.
+const maxPathArgs = 1000
+
+// pathBatches splits paths into consecutive batches
+// of at most maxPathArgs paths each.
+func pathBatches(paths []nix.StorePath) [][]nix.StorePath {
+	var batches [][]nix.StorePath
+	for len(paths) > maxPathArgs {
+		batches = append(batches, paths[:maxPathArgs:maxPathArgs])
+		paths = paths[maxPathArgs:]
+	}
+	if len(paths) > 0 {
+		batches = append(batches, paths)
+	}
+	return batches
+}
+
+func queryArgs(query string, paths []nix.StorePath) []string {
+	args := make([]string, 0, len(paths)+3)
+	args = append(args, "--query", query, "--")
+	for _, p := range paths {
+		args = append(args, string(p))
+	}
+	return args
+}
+
+// AddRoot registers the symlink at link as a garbage collector root
+// that keeps path alive, creating link in the process.
+// The root is indirect: removing link allows path to be collected.
+func (s *Store) AddRoot(ctx context.Context, link string, path nix.StorePath) error {
+	if s.socket() != "" {
+		// The daemon has a different working directory.
+		absLink, err := filepath.Abs(link)
+		if err != nil {
+			return fmt.Errorf("add root %s: %v", link, err)
+		}
+		// The daemon refuses to follow symlinks to the link's directory.
+		if dir, err := filepath.EvalSymlinks(filepath.Dir(absLink)); err == nil {
+			absLink = filepath.Join(dir, filepath.Base(absLink))
+		}
+		if err := s.call(ctx, "AddRoot", &AddRootRequest{Link: absLink, Path: path}, new(struct{})); err != nil {
+			return fmt.Errorf("add root %s: %w", link, err)
+		}
+		return nil
+	}
+	_, err := s.nixStore(ctx, "--add-root", link, "--realise", "--", string(path))
+	return err
+}
+
+// QueryReferences returns the store paths that the given paths directly reference.
+func (s *Store) QueryReferences(ctx context.Context, paths ...nix.StorePath) ([]nix.StorePath, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return s.nixStorePaths(ctx, queryArgs("--references", paths)...)
+}
+
+// QueryReferrers returns the valid store paths that directly reference
+// any of the given paths.
+func (s *Store) QueryReferrers(ctx context.Context, paths ...nix.StorePath) ([]nix.StorePath, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return s.nixStorePaths(ctx, queryArgs("--referrers", paths)...)
+}
+
+// QueryReferrersClosure returns the given paths
+// and every valid store path that transitively references them.
+func (s *Store) QueryReferrersClosure(ctx context.Context, paths ...nix.StorePath) ([]nix.StorePath, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return s.nixStorePaths(ctx, queryArgs("--referrers-closure", paths)...)
+}
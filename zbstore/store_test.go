@@ -0,0 +1,165 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestOutputName(t *testing.T) {
+	const drvPath nix.StorePath = "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv"
+	tests := []struct {
+		outputPath nix.StorePath
+		want       string
+		wantOK     bool
+	}{
+		{"/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello", "out", true},
+		{"/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-dev", "dev", true},
+		{"/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-goodbye", "", false},
+		{"/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello-", "", false},
+	}
+	for _, test := range tests {
+		got, ok := OutputName(drvPath, test.outputPath)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("OutputName(%q, %q) = %q, %t; want %q, %t",
+				drvPath, test.outputPath, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestCommandOptions(t *testing.T) {
+	s := &Store{
+		ExtraPlatforms:     []string{"i686-linux", "aarch64-linux"},
+		SandboxPaths:       []string{"/usr/bin/qemu-aarch64-static"},
+		BuildUsersGroup:    "zbbld",
+		Substituters:       []string{"https://cache.example.com", "https://cache2.example.com"},
+		ExtraSubstituters:  []string{"http://192.168.1.2:8080"},
+		NetrcFile:          "/etc/zb/netrc",
+		Fallback:           true,
+		NoRequireSigs:      true,
+		NARInfoNegativeTTL: 5 * time.Minute,
+		MaxJobs:            4,
+		Sandbox:            "relaxed",
+	}
+	c := s.command(context.Background(), "--realise", "--", "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv")
+	want := []string{
+		"nix-store",
+		"--option", "extra-platforms", "i686-linux aarch64-linux",
+		"--option", "extra-sandbox-paths", "/usr/bin/qemu-aarch64-static",
+		"--option", "substituters", "https://cache.example.com https://cache2.example.com",
+		"--option", "extra-substituters", "http://192.168.1.2:8080",
+		"--option", "fallback", "true",
+		"--option", "require-sigs", "false",
+		"--option", "narinfo-cache-negative-ttl", "300",
+		"--option", "netrc-file", "/etc/zb/netrc",
+		"--option", "max-jobs", "4",
+		"--option", "sandbox", "relaxed",
+		"--option", "build-users-group", "zbbld",
+		"--realise", "--", "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv",
+	}
+	if diff := cmp.Diff(want, c.Args); diff != "" {
+		t.Errorf("args (-want +got):\n%s", diff)
+	}
+}
+
+func TestCommandRoot(t *testing.T) {
+	s := &Store{
+		Dir:  "/zb/store",
+		Root: "/home/me/zbroot",
+	}
+	c := s.command(context.Background(), "--realise", "--", "/zb/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv")
+	want := []string{
+		"nix-store",
+		"--option", "store", "local?root=%2Fhome%2Fme%2Fzbroot&store=%2Fzb%2Fstore",
+		"--realise", "--", "/zb/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv",
+	}
+	if diff := cmp.Diff(want, c.Args); diff != "" {
+		t.Errorf("args (-want +got):\n%s", diff)
+	}
+	if got, want := s.RealPath("/zb/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"), filepath.Join("/home/me/zbroot", "/zb/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"); got != want {
+		t.Errorf("RealPath(...) = %q; want %q", got, want)
+	}
+}
+
+func TestCommandOverlay(t *testing.T) {
+	s := &Store{
+		Lower:      &Store{Root: "/mnt/warm"},
+		UpperLayer: "/var/zb/upper",
+	}
+	c := s.command(context.Background(), "--query", "--valid", "--", "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv")
+	want := []string{
+		"nix-store",
+		"--option", "store", "local-overlay://?lower-store=local%3Fread-only%3Dtrue%26root%3D%252Fmnt%252Fwarm&upper-layer=%2Fvar%2Fzb%2Fupper",
+		"--option", "extra-experimental-features", "local-overlay-store",
+		"--query", "--valid", "--", "/nix/store/cs4n5mbm46xwzb9yxm983gzqh0k5b2hp-hello.drv",
+	}
+	if diff := cmp.Diff(want, c.Args); diff != "" {
+		t.Errorf("args (-want +got):\n%s", diff)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake nix-store is a shell script")
+	}
+	const (
+		depDrv     nix.StorePath = "/nix/store/00000000000000000000000000000000-dep.drv"
+		builtDrv   nix.StorePath = "/nix/store/11111111111111111111111111111111-built.drv"
+		missingDrv nix.StorePath = "/nix/store/22222222222222222222222222222222-missing.drv"
+		missingOut nix.StorePath = "/nix/store/33333333333333333333333333333333-missing"
+	)
+	storeDir := t.TempDir()
+	builtOut := nix.StorePath(filepath.Join(storeDir, "44444444444444444444444444444444-built"))
+	if err := os.WriteFile(string(builtOut), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "nix-store.log")
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> '" + logPath + "'\n" +
+		"case \"$*\" in\n" +
+		"*'--query --references'*) echo " + string(depDrv) + " ;;\n" +
+		"*'--query --outputs -- " + string(builtDrv) + "') echo " + string(builtOut) + " ;;\n" +
+		"*'--query --outputs'*) echo " + string(missingOut) + " ;;\n" +
+		"*'--check'*) echo " + string(builtOut) + " ;;\n" +
+		"*'substitute false'*) echo " + string(missingOut) + " ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+
+	got, err := new(Store).Rebuild(context.Background(), builtDrv, missingDrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []nix.StorePath{missingOut, builtOut}; !cmp.Equal(want, got) {
+		t.Errorf("Rebuild(...) = %q; want %q", got, want)
+	}
+	logData, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLog := []string{
+		"--query --references -- " + string(builtDrv) + " " + string(missingDrv),
+		"--realise -- " + string(depDrv),
+		"--query --outputs -- " + string(builtDrv),
+		"--query --outputs -- " + string(missingDrv),
+		"--realise --option substitute false -- " + string(missingDrv),
+		"--realise --check -- " + string(builtDrv),
+	}
+	if diff := cmp.Diff(wantLog, strings.Split(strings.TrimSpace(string(logData)), "\n")); diff != "" {
+		t.Errorf("nix-store invocations (-want +got):\n%s", diff)
+	}
+}
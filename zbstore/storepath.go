@@ -0,0 +1,82 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nixbase32"
+)
+
+// StoreReferences is the set of store objects that a store object refers to.
+type StoreReferences struct {
+	// Self is true if the store object refers to itself.
+	Self bool
+	// Others is the sorted set of other store objects referenced.
+	Others []nix.StorePath
+}
+
+// IsEmpty reports whether refs does not contain any references.
+func (refs StoreReferences) IsEmpty() bool {
+	return !refs.Self && len(refs.Others) == 0
+}
+
+// FixedCAOutputPath computes the path of a content-addressed store object
+// according to https://nixos.org/manual/nix/stable/protocols/store-path.
+// Only text and SHA-256 recursive file content addresses may have references.
+func FixedCAOutputPath(dir nix.StoreDirectory, name string, ca nix.ContentAddress, refs StoreReferences) (nix.StorePath, error) {
+	h := ca.Hash()
+	htype := h.Type()
+	switch {
+	case ca.IsText():
+		if want := nix.SHA256; htype != want {
+			return "", fmt.Errorf("compute fixed output path for %s: text must be content-addressed by %v (got %v)",
+				name, want, htype)
+		}
+		if refs.Self {
+			return "", fmt.Errorf("compute fixed output path for %s: text cannot refer to itself", name)
+		}
+		return makeStorePath(dir, "text", h, name, refs)
+	case htype == nix.SHA256 && ca.IsRecursiveFile():
+		return makeStorePath(dir, "source", h, name, refs)
+	default:
+		if !refs.IsEmpty() {
+			return "", fmt.Errorf("compute fixed output path for %s: references not allowed", name)
+		}
+		h2 := nix.NewHasher(nix.SHA256)
+		h2.WriteString("fixed:out:")
+		if ca.IsRecursiveFile() {
+			h2.WriteString("r:")
+		}
+		h2.WriteString(h.Base16())
+		h2.WriteString(":")
+		return makeStorePath(dir, "output:out", h2.SumHash(), name, StoreReferences{})
+	}
+}
+
+// makeStorePath computes a store path
+// according to https://nixos.org/manual/nix/stable/protocols/store-path.
+func makeStorePath(dir nix.StoreDirectory, typ string, hash nix.Hash, name string, refs StoreReferences) (nix.StorePath, error) {
+	h := sha256.New()
+	io.WriteString(h, typ)
+	for _, ref := range refs.Others {
+		io.WriteString(h, ":")
+		io.WriteString(h, string(ref))
+	}
+	if refs.Self {
+		io.WriteString(h, ":self")
+	}
+	io.WriteString(h, ":")
+	io.WriteString(h, hash.Base16())
+	io.WriteString(h, ":")
+	io.WriteString(h, string(dir))
+	io.WriteString(h, ":")
+	io.WriteString(h, name)
+	compressed := make([]byte, 20)
+	nix.CompressHash(compressed, h.Sum(nil))
+	return dir.Object(nixbase32.EncodeToString(compressed) + "-" + name)
+}
@@ -0,0 +1,474 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/log"
+	"zombiezen.com/go/nix"
+)
+
+// A Substituter downloads store objects from a binary cache over HTTP,
+// such as one served by [BinaryCache].
+type Substituter struct {
+	// URL is the base URL of the binary cache.
+	// Besides http:// and https:// URLs,
+	// the cache can be stored in a Google Cloud Storage bucket
+	// (gs://bucket/prefix)
+	// or an Azure Storage container (azblob://account/container/prefix).
+	// (Experimental:) ipfs://cid and ipns://name URLs
+	// refer to caches published to IPFS,
+	// which are read through IPFSGateway.
+	// Object storage is accessed with the environment's ambient credentials:
+	// Application Default Credentials for Google Cloud
+	// and DefaultAzureCredential for Azure.
+	URL string
+	// Client is used to make requests.
+	// If nil, [http.DefaultClient] is used.
+	Client *http.Client
+	// TrustedPublicKeys is the list of keys
+	// whose signatures are accepted on the cache's .narinfo files.
+	// If empty, signatures are not checked.
+	TrustedPublicKeys []*nix.PublicKey
+	// Chunks is a local store of NAR chunks.
+	// If not nil and the cache provides a chunk index for a NAR
+	// (see [BinaryCache.Chunks]),
+	// the NAR is assembled from chunks
+	// and only the chunks that are not already in Chunks are downloaded.
+	Chunks *ChunkStore
+	// Parallelism is the maximum number of concurrent range requests
+	// used to download a single large NAR.
+	// If it is less than 2, NARs are downloaded in a single request.
+	// Either way, interrupted downloads are resumed
+	// from where they stopped.
+	Parallelism int
+	// Priority orders the substituter relative to others
+	// (see [SortSubstituters]):
+	// substituters with lower values are preferred.
+	// If zero, the priority is taken from the URL's priority query parameter
+	// (as in Nix, e.g. https://cache.example.com?priority=30)
+	// or else from the cache's nix-cache-info file.
+	Priority int
+	// IPFSGateway is the base URL of the IPFS HTTP gateway
+	// used for ipfs:// and ipns:// URLs.
+	// If empty, [DefaultIPFSGateway] is used.
+	IPFSGateway string
+	// NARInfoCache remembers the results of [Substituter.NARInfo]
+	// if not nil.
+	NARInfoCache *NARInfoCache
+
+	initOnce    sync.Once
+	initErr     error
+	baseURL     *url.URL
+	httpClient  *http.Client
+	urlPriority int
+}
+
+// defaultSubstituterPriority is the priority of a cache
+// that does not advertise one, as in Nix.
+const defaultSubstituterPriority = 50
+
+// init resolves sub.URL to an HTTP endpoint
+// and sets up the credentials for object storage URLs.
+func (sub *Substituter) init() error {
+	sub.initOnce.Do(func() {
+		u, err := url.Parse(sub.URL)
+		if err != nil {
+			sub.initErr = err
+			return
+		}
+		if q := u.Query(); q.Has("priority") {
+			sub.urlPriority, err = strconv.Atoi(q.Get("priority"))
+			if err != nil {
+				sub.initErr = fmt.Errorf("%v: invalid priority: %v", u.Redacted(), err)
+				return
+			}
+			q.Del("priority")
+			u.RawQuery = q.Encode()
+		}
+		sub.httpClient = sub.Client
+		if sub.httpClient == nil {
+			sub.httpClient = http.DefaultClient
+		}
+		if endpoint, isIPFS, err := ipfsEndpoint(sub.IPFSGateway, u); isIPFS {
+			sub.baseURL, sub.initErr = endpoint, err
+			return
+		}
+		endpoint, isObjectStore, err := objectStoreEndpoint(u)
+		if err != nil {
+			sub.initErr = err
+			return
+		}
+		if !isObjectStore {
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+			u.RawPath = ""
+			sub.baseURL = u
+			return
+		}
+		sub.baseURL = endpoint
+		sub.httpClient, sub.initErr = objectStoreClient(context.Background(), u.Scheme, sub.httpClient)
+	})
+	return sub.initErr
+}
+
+// maxNARInfoSize is the largest .narinfo file that a [Substituter] reads.
+const maxNARInfoSize = 1 << 20
+
+func (sub *Substituter) client() *http.Client {
+	if err := sub.init(); err != nil {
+		return http.DefaultClient
+	}
+	return sub.httpClient
+}
+
+// resolve returns the absolute URL of the cache file at the given relative path.
+func (sub *Substituter) resolve(path string) (string, error) {
+	if err := sub.init(); err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	return sub.baseURL.ResolveReference(ref).String(), nil
+}
+
+// get sends a GET request for the cache file at the given relative path.
+// If the cache does not have the file,
+// get returns an error that wraps [ErrNotFound].
+func (sub *Substituter) get(ctx context.Context, path string) (*http.Response, error) {
+	u, err := sub.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sub.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", u, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: http %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// CacheInfo returns the cache's nix-cache-info file.
+func (sub *Substituter) CacheInfo(ctx context.Context) (*nix.CacheInfo, error) {
+	resp, err := sub.get(ctx, "nix-cache-info")
+	if err != nil {
+		return nil, fmt.Errorf("query %s: %w", sub.URL, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxNARInfoSize))
+	if err != nil {
+		return nil, fmt.Errorf("query %s: %v", sub.URL, err)
+	}
+	info := new(nix.CacheInfo)
+	if err := info.UnmarshalText(data); err != nil {
+		return nil, fmt.Errorf("query %s: %v", sub.URL, err)
+	}
+	return info, nil
+}
+
+// SortSubstituters sorts subs in order of preference:
+// by increasing priority (see [Substituter.Priority]),
+// keeping the original order for substituters with the same priority.
+// Caches that need to be asked for their priority are queried concurrently,
+// and a cache that cannot be reached is given the default priority of 50.
+func SortSubstituters(ctx context.Context, subs []*Substituter) {
+	priorities := make([]int, len(subs))
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		switch {
+		case sub.Priority != 0:
+			priorities[i] = sub.Priority
+		case sub.init() == nil && sub.urlPriority != 0:
+			priorities[i] = sub.urlPriority
+		default:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				info, err := sub.CacheInfo(ctx)
+				if err != nil {
+					log.Debugf(ctx, "%v", err)
+					priorities[i] = defaultSubstituterPriority
+					return
+				}
+				priorities[i] = info.Priority
+				if priorities[i] == 0 {
+					priorities[i] = defaultSubstituterPriority
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	order := make(map[*Substituter]int, len(subs))
+	for i, sub := range subs {
+		order[sub] = priorities[i]
+	}
+	slices.SortStableFunc(subs, func(a, b *Substituter) int {
+		return cmp.Compare(order[a], order[b])
+	})
+}
+
+// NARInfo returns the cache's information about the given store object.
+// If the cache does not have the object,
+// NARInfo returns an error that wraps [ErrNotFound].
+func (sub *Substituter) NARInfo(ctx context.Context, path nix.StorePath) (*nix.NARInfo, error) {
+	now := time.Now()
+	data, cached, err := sub.narInfoData(ctx, path, now)
+	if err != nil {
+		return nil, fmt.Errorf("query %s from %s: %w", path, sub.URL, err)
+	}
+	info := new(nix.NARInfo)
+	if err := info.UnmarshalText(data); err != nil {
+		return nil, fmt.Errorf("query %s from %s: %v", path, sub.URL, err)
+	}
+	if info.StorePath != path {
+		return nil, fmt.Errorf("query %s from %s: cache returned information for %s", path, sub.URL, info.StorePath)
+	}
+	if sub.NARInfoCache != nil && !cached {
+		if err := sub.NARInfoCache.put(ctx, sub.URL, path.Digest(), data, now); err != nil {
+			log.Debugf(ctx, "%v", err)
+		}
+	}
+	if len(sub.TrustedPublicKeys) > 0 && !verifyNARInfo(sub.TrustedPublicKeys, info) {
+		return nil, fmt.Errorf("query %s from %s: no valid signature from a trusted key", path, sub.URL)
+	}
+	return info, nil
+}
+
+// narInfoData returns the contents of the cache's .narinfo file for path.
+// If sub.NARInfoCache has an unexpired result for path,
+// narInfoData uses it instead of contacting the cache
+// and cached is true.
+// Results for objects that the cache does not have
+// are saved to sub.NARInfoCache by narInfoData,
+// but it is up to the caller to save the file once it has been validated.
+func (sub *Substituter) narInfoData(ctx context.Context, path nix.StorePath, now time.Time) (data []byte, cached bool, err error) {
+	if sub.NARInfoCache != nil {
+		data, ok, err := sub.NARInfoCache.lookup(ctx, sub.URL, path.Digest(), now)
+		switch {
+		case err != nil:
+			log.Debugf(ctx, "%v", err)
+		case ok && data == nil:
+			return nil, true, fmt.Errorf("%s%s (cached): %w", path.Digest(), nix.NARInfoExtension, ErrNotFound)
+		case ok:
+			return data, true, nil
+		}
+	}
+	resp, err := sub.get(ctx, path.Digest()+nix.NARInfoExtension)
+	if errors.Is(err, ErrNotFound) && sub.NARInfoCache != nil {
+		if err := sub.NARInfoCache.put(ctx, sub.URL, path.Digest(), nil, now); err != nil {
+			log.Debugf(ctx, "%v", err)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxNARInfoSize))
+	if err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// Realization downloads the cache's realization for the given derivation output.
+// If TrustedPublicKeys is not empty,
+// the realization must carry a valid signature from one of them.
+// The returned realization's Source is the cache's URL.
+// If the cache does not have a realization for the output,
+// Realization returns an error that wraps [ErrNotFound].
+func (sub *Substituter) Realization(ctx context.Context, id DrvOutput) (*Realization, error) {
+	resp, err := sub.get(ctx, realizationCachePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("query realization %v from %s: %w", id, sub.URL, err)
+	}
+	defer resp.Body.Close()
+	r := new(Realization)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxNARInfoSize)).Decode(r); err != nil {
+		return nil, fmt.Errorf("query realization %v from %s: %v", id, sub.URL, err)
+	}
+	if !r.ID.DrvHash.Equal(id.DrvHash) || r.ID.OutputName != id.OutputName {
+		return nil, fmt.Errorf("query realization %v from %s: cache returned realization for %v", id, sub.URL, r.ID)
+	}
+	if len(sub.TrustedPublicKeys) > 0 {
+		if err := CheckRealizationTrust(sub.TrustedPublicKeys, r); err != nil {
+			return nil, fmt.Errorf("query realization %v from %s: %v", id, sub.URL, err)
+		}
+	}
+	r.Source = sub.URL
+	return r, nil
+}
+
+// verifyNARInfo reports whether info has a valid signature
+// from one of the trusted keys.
+func verifyNARInfo(trusted []*nix.PublicKey, info *nix.NARInfo) bool {
+	for _, sig := range info.Sig {
+		if nix.VerifyNARInfo(trusted, info, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadNAR returns the decompressed NAR of the store object described by info,
+// which should have been returned by [Substituter.NARInfo].
+// The NAR's size and hash are checked against info as it is read:
+// if they do not match, the final Read returns an error.
+// The caller is responsible for closing the returned reader.
+func (sub *Substituter) DownloadNAR(ctx context.Context, info *nix.NARInfo) (io.ReadCloser, error) {
+	if sub.Chunks != nil {
+		idx, err := sub.chunkIndex(ctx, info.StorePath)
+		switch {
+		case err == nil && idx.NARHash.Equal(info.NARHash) && idx.NARSize == info.NARSize:
+			return &verifyingReader{
+				r: &chunkedNARReader{
+					ctx:    ctx,
+					sub:    sub,
+					chunks: idx.Chunks,
+				},
+				path:   info.StorePath,
+				hasher: nix.NewHasher(info.NARHash.Type()),
+				want:   info.NARHash,
+				size:   info.NARSize,
+			}, nil
+		case err == nil:
+			log.Debugf(ctx, "Ignoring chunk index for %s from %s: does not match NAR", info.StorePath, sub.URL)
+		case !errors.Is(err, ErrNotFound):
+			log.Debugf(ctx, "%v", err)
+		}
+	}
+	body, err := sub.open(ctx, info.URL)
+	if err != nil {
+		return nil, fmt.Errorf("download %s from %s: %w", info.StorePath, sub.URL, err)
+	}
+	r, err := decompressNAR(body, info.Compression)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("download %s from %s: %v", info.StorePath, sub.URL, err)
+	}
+	return &verifyingReader{
+		r: r,
+		c: closerFunc(func() error {
+			r.Close()
+			return body.Close()
+		}),
+		path:   info.StorePath,
+		hasher: nix.NewHasher(info.NARHash.Type()),
+		want:   info.NARHash,
+		size:   info.NARSize,
+	}, nil
+}
+
+// DownloadNARDelta is like [Substituter.DownloadNAR],
+// but it downloads a delta from the NAR of the store object base
+// (see [WriteDelta])
+// and applies it to baseNAR, the local copy of base's NAR.
+// If the cache does not offer such a delta,
+// DownloadNARDelta returns an error that wraps [ErrNotFound]
+// and the caller should fall back to [Substituter.DownloadNAR].
+func (sub *Substituter) DownloadNARDelta(ctx context.Context, info *nix.NARInfo, base nix.StorePath, baseNAR io.ReaderAt) (io.ReadCloser, error) {
+	resp, err := sub.get(ctx, "delta/"+base.Digest()+"/"+info.StorePath.Digest())
+	if err != nil {
+		return nil, fmt.Errorf("download %s from %s as delta from %s: %w", info.StorePath, sub.URL, base, err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer resp.Body.Close()
+		pw.CloseWithError(ApplyDelta(pw, baseNAR, resp.Body))
+	}()
+	return &verifyingReader{
+		r:      pr,
+		c:      pr,
+		path:   info.StorePath,
+		hasher: nix.NewHasher(info.NARHash.Type()),
+		want:   info.NARHash,
+		size:   info.NARSize,
+	}, nil
+}
+
+// chunkIndex downloads the cache's chunk index for the given store object.
+// If the cache does not have an index for the object,
+// chunkIndex returns an error that wraps [ErrNotFound].
+func (sub *Substituter) chunkIndex(ctx context.Context, path nix.StorePath) (*ChunkIndex, error) {
+	resp, err := sub.get(ctx, path.Digest()+".chunks")
+	if err != nil {
+		return nil, fmt.Errorf("query chunks of %s from %s: %w", path, sub.URL, err)
+	}
+	defer resp.Body.Close()
+	idx := new(ChunkIndex)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxNARInfoSize<<4)).Decode(idx); err != nil {
+		return nil, fmt.Errorf("query chunks of %s from %s: %v", path, sub.URL, err)
+	}
+	return idx, nil
+}
+
+// verifyingReader checks that the data read from r
+// has the expected size and hash.
+type verifyingReader struct {
+	r io.Reader
+	// c is closed when the verifyingReader is closed if not nil.
+	c      io.Closer
+	path   nix.StorePath
+	hasher *nix.Hasher
+	want   nix.Hash
+	size   int64
+	n      int64
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.hasher.Write(p[:n])
+	vr.n += int64(n)
+	if vr.n > vr.size {
+		return n, fmt.Errorf("%s: NAR is larger than %d bytes", vr.path, vr.size)
+	}
+	if errors.Is(err, io.EOF) {
+		if vr.n != vr.size {
+			return n, fmt.Errorf("%s: NAR is %d bytes (expected %d)", vr.path, vr.n, vr.size)
+		}
+		if got := vr.hasher.SumHash(); !got.Equal(vr.want) {
+			return n, fmt.Errorf("%s: NAR hash %v does not match %v", vr.path, got, vr.want)
+		}
+	}
+	return n, err
+}
+
+func (vr *verifyingReader) Close() error {
+	if vr.c == nil {
+		return nil
+	}
+	return vr.c.Close()
+}
+
+// closerFunc is an [io.Closer] that calls itself.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
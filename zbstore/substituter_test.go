@@ -0,0 +1,180 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+const testSubstituterPath nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"
+
+// newTestSubstituter serves a binary cache containing testSubstituterPath,
+// a directory with an executable and a symlink.
+// The NAR is served uncompressed at nar/hello.nar
+// and compressed at nar/hello.nar.zst and nar/hello.nar.xz.
+// The cache's .narinfo file is signed with the returned key.
+// modify is called on the NAR information before it is served if not nil.
+func newTestSubstituter(tb testing.TB, modify func(*nix.NARInfo)) (*Substituter, *nix.PublicKey) {
+	tb.Helper()
+	src := filepath.Join(tb.TempDir(), "hello")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "hello"), []byte("#!/bin/sh\necho Hello\n"), 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Symlink("bin/hello", filepath.Join(src, "hello")); err != nil {
+		tb.Fatal(err)
+	}
+	narData := new(bytes.Buffer)
+	if err := nar.DumpPath(narData, src); err != nil {
+		tb.Fatal(err)
+	}
+	h := nix.NewHasher(nix.SHA256)
+	h.Write(narData.Bytes())
+	info := &nix.NARInfo{
+		StorePath:   testSubstituterPath,
+		URL:         "nar/hello.nar",
+		Compression: nix.NoCompression,
+		NARHash:     h.SumHash(),
+		NARSize:     int64(narData.Len()),
+	}
+	pub, pk, err := nix.GenerateKey("cache.example.com-1", rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sig, err := nix.SignNARInfo(pk, info)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	info.AddSignatures(sig)
+	if modify != nil {
+		modify(info)
+	}
+	infoData, err := info.MarshalText()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+testSubstituterPath.Digest()+".narinfo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", nix.NARInfoMIMEType)
+		w.Write(infoData)
+	})
+	for _, compression := range []nix.CompressionType{nix.NoCompression, nix.Zstandard, nix.XZ} {
+		ext, err := narFileExtension(compression)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		compressed := new(bytes.Buffer)
+		zw, err := compressNAR(compressed, compression)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		zw.Write(narData.Bytes())
+		if err := zw.Close(); err != nil {
+			tb.Fatal(err)
+		}
+		mux.HandleFunc("/nar/hello"+ext, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", nar.MIMEType)
+			w.Write(compressed.Bytes())
+		})
+	}
+	srv := httptest.NewServer(mux)
+	tb.Cleanup(srv.Close)
+	return &Substituter{URL: srv.URL, Client: srv.Client()}, pub
+}
+
+func TestSubstituter(t *testing.T) {
+	ctx := context.Background()
+	sub, pub := newTestSubstituter(t, nil)
+	sub.TrustedPublicKeys = []*nix.PublicKey{pub}
+
+	info, err := sub.NARInfo(ctx, testSubstituterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sub.DownloadNAR(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Error("Reading NAR:", err)
+	}
+
+	missing := nix.StorePath("/nix/store/22222222222222222222222222222222-missing")
+	if _, err := sub.NARInfo(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("NARInfo(ctx, %q) error = %v; want %v", missing, err, ErrNotFound)
+	}
+}
+
+func TestSubstituterCompression(t *testing.T) {
+	ctx := context.Background()
+	for _, compression := range []nix.CompressionType{nix.Zstandard, nix.XZ} {
+		t.Run(string(compression), func(t *testing.T) {
+			sub, pub := newTestSubstituter(t, nil)
+			sub.TrustedPublicKeys = []*nix.PublicKey{pub}
+			info, err := sub.NARInfo(ctx, testSubstituterPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := readAllNAR(t, sub, info)
+
+			ext, err := narFileExtension(compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info.URL = "nar/hello" + ext
+			info.Compression = compression
+			if got := readAllNAR(t, sub, info); !bytes.Equal(got, want) {
+				t.Error("decompressed NAR does not match uncompressed NAR")
+			}
+		})
+	}
+}
+
+func TestSubstituterUntrusted(t *testing.T) {
+	ctx := context.Background()
+	sub, _ := newTestSubstituter(t, nil)
+	otherPub, _, err := nix.GenerateKey("cache.example.com-1", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.TrustedPublicKeys = []*nix.PublicKey{otherPub}
+	if info, err := sub.NARInfo(ctx, testSubstituterPath); err == nil {
+		t.Errorf("NARInfo(ctx, %q) = %v, <nil>; want error", testSubstituterPath, info)
+	}
+}
+
+func TestSubstituterHashMismatch(t *testing.T) {
+	ctx := context.Background()
+	sub, _ := newTestSubstituter(t, func(info *nix.NARInfo) {
+		info.NARHash = nix.NewHash(nix.SHA256, make([]byte, nix.SHA256.Size()))
+	})
+	info, err := sub.NARInfo(ctx, testSubstituterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := sub.DownloadNAR(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(io.Discard, r); err == nil {
+		t.Error("Reading NAR with wrong hash did not return an error")
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans with the global OpenTelemetry tracer provider,
+// which discards them unless the program installs a provider.
+var tracer = otel.Tracer("zombiezen.com/go/zb/zbstore")
+
+// activitySpans records a span for each build and download
+// reported in [BuildEvent] values.
+type activitySpans struct {
+	ctx   context.Context
+	spans map[uint64]trace.Span
+	// next is called with each event after it is recorded.
+	next func(*BuildEvent)
+}
+
+func newActivitySpans(ctx context.Context, next func(*BuildEvent)) *activitySpans {
+	return &activitySpans{
+		ctx:   ctx,
+		spans: make(map[uint64]trace.Span),
+		next:  next,
+	}
+}
+
+func (as *activitySpans) event(ev *BuildEvent) {
+	switch ev.Kind {
+	case BuildStarted:
+		_, span := tracer.Start(as.ctx, "zbstore.build", trace.WithAttributes(
+			attribute.String("zb.derivation.path", string(ev.DrvPath)),
+		))
+		as.spans[ev.ID] = span
+	case DownloadStarted:
+		_, span := tracer.Start(as.ctx, "zbstore.substitute", trace.WithAttributes(
+			attribute.String("zb.store.path", string(ev.StorePath)),
+		))
+		as.spans[ev.ID] = span
+	case BuildFinished, DownloadFinished:
+		if span := as.spans[ev.ID]; span != nil {
+			span.End()
+			delete(as.spans, ev.ID)
+		}
+	case Message:
+		// Failures are reported after the build's activity stops,
+		// so they can only be attached to the enclosing span.
+		if ev.Error {
+			trace.SpanFromContext(as.ctx).AddEvent("error", trace.WithAttributes(
+				attribute.String("message", ev.Text),
+			))
+		}
+	}
+	as.next(ev)
+}
+
+// close ends the spans of any activities that did not finish.
+func (as *activitySpans) close() {
+	for id, span := range as.spans {
+		span.End()
+		delete(as.spans, id)
+	}
+}
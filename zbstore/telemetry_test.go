@@ -0,0 +1,61 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestActivitySpans(t *testing.T) {
+	const (
+		drvPath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello.drv"
+		openssl = "/nix/store/00000000000000000000000000000000-openssl"
+	)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	oldTracer := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = oldTracer })
+	ctx, root := provider.Tracer("test").Start(context.Background(), "test")
+	w := new(strings.Builder)
+	spans := newActivitySpans(ctx, plainLog(w))
+	events := []*BuildEvent{
+		{Kind: DownloadStarted, ID: 2, StorePath: openssl},
+		{Kind: DownloadFinished, ID: 2, StorePath: openssl},
+		{Kind: BuildStarted, ID: 4, DrvPath: drvPath},
+		{Kind: BuildLog, ID: 4, DrvPath: drvPath, Text: "make: Nothing to be done."},
+		{Kind: Message, Text: "error: build failed", Error: true},
+	}
+	for _, ev := range events {
+		spans.event(ev)
+	}
+	spans.close()
+	root.End()
+
+	got := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		got[span.Name()] = span
+	}
+	for _, name := range []string{"zbstore.substitute", "zbstore.build"} {
+		span := got[name]
+		if span == nil {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the context's span", name)
+		}
+	}
+	if rootSpan := got["test"]; rootSpan != nil && len(rootSpan.Events()) != 1 {
+		t.Errorf("context's span has %d events; want 1 for the error message", len(rootSpan.Events()))
+	}
+	if got, want := w.String(), "make: Nothing to be done.\nerror: build failed\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+}
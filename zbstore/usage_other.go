@@ -0,0 +1,14 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build !unix
+
+package zbstore
+
+import "os"
+
+// backendUsage returns the resources used by an exited nix-store process
+// and the builders it ran.
+func (s *Store) backendUsage(ps *os.ProcessState) *processUsage {
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+//go:build unix
+
+package zbstore
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// backendUsage returns the resources used by an exited nix-store process
+// and the builders it ran.
+// It returns nil if nix-store sends builds to a Nix daemon,
+// since the builders' usage is not included in the process's.
+func (s *Store) backendUsage(ps *os.ProcessState) *processUsage {
+	if ps == nil || s.buildsDelegated() {
+		return nil
+	}
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	peakMemory := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// Other systems report kibibytes.
+		peakMemory *= 1024
+	}
+	return &processUsage{
+		cpuTime:    ps.UserTime() + ps.SystemTime(),
+		peakMemory: peakMemory,
+	}
+}
+
+// buildsDelegated reports whether nix-store sends builds to a Nix daemon
+// instead of running them itself.
+// Like nix-store, it assumes a daemon is used
+// if the backend's database is not writable.
+func (s *Store) buildsDelegated() bool {
+	switch os.Getenv("NIX_REMOTE") {
+	case "", "local", "auto":
+	default:
+		return true
+	}
+	const writable = 0x2 // W_OK
+	return syscall.Access(filepath.Join(s.stateDir(), "db"), writable) != nil
+}
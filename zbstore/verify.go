@@ -0,0 +1,119 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/nix"
+	"zombiezen.com/go/nix/nar"
+)
+
+// ValidPaths returns every valid store object in the store directory.
+func (s *Store) ValidPaths(ctx context.Context) ([]nix.StorePath, error) {
+	entries, err := os.ReadDir(s.RealPath(string(s.dir())))
+	if err != nil {
+		return nil, err
+	}
+	var paths []nix.StorePath
+	for _, ent := range entries {
+		if strings.HasSuffix(ent.Name(), ".lock") {
+			continue
+		}
+		p, err := s.dir().Object(ent.Name())
+		if err != nil {
+			// Not a store object (e.g. the .links directory).
+			continue
+		}
+		paths = append(paths, p)
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	invalid := make(map[nix.StorePath]struct{})
+	for _, batch := range pathBatches(paths) {
+		args := make([]string, 0, len(batch)+3)
+		args = append(args, "--check-validity", "--print-invalid", "--")
+		for _, p := range batch {
+			args = append(args, string(p))
+		}
+		batchInvalid, err := s.nixStorePaths(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range batchInvalid {
+			invalid[p] = struct{}{}
+		}
+	}
+	paths = slices.DeleteFunc(paths, func(p nix.StorePath) bool {
+		_, isInvalid := invalid[p]
+		return isInvalid
+	})
+	return paths, nil
+}
+
+// QueryHash returns the NAR hash that the store has recorded for path.
+func (s *Store) QueryHash(ctx context.Context, path nix.StorePath) (nix.Hash, error) {
+	out, err := s.nixStore(ctx, queryArgs("--hash", []nix.StorePath{path})...)
+	if err != nil {
+		return nix.Hash{}, err
+	}
+	h, err := nix.ParseHash(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nix.Hash{}, fmt.Errorf("nix-store --query --hash: %v", err)
+	}
+	return h, nil
+}
+
+// NARHash computes the hash of the NAR serialization
+// of the file at path.
+func NARHash(typ nix.HashType, path string) (nix.Hash, error) {
+	h := nix.NewHasher(typ)
+	if err := nar.DumpPath(h, path); err != nil {
+		return nix.Hash{}, err
+	}
+	return h.SumHash(), nil
+}
+
+// A CorruptPathError is returned by [Store.Verify]
+// when a store object's contents do not match its recorded hash.
+type CorruptPathError struct {
+	Path nix.StorePath
+	Want nix.Hash
+	Got  nix.Hash
+}
+
+func (e *CorruptPathError) Error() string {
+	return fmt.Sprintf("%s was modified: expected hash %v, got %v", e.Path, e.Want, e.Got)
+}
+
+// Verify re-hashes the contents of the store object at path
+// and compares the result against the store's recorded NAR hash.
+// If they differ, Verify returns a [*CorruptPathError].
+func (s *Store) Verify(ctx context.Context, path nix.StorePath) error {
+	want, err := s.QueryHash(ctx, path)
+	if err != nil {
+		return err
+	}
+	got, err := NARHash(want.Type(), s.RealPath(string(path)))
+	if err != nil {
+		return fmt.Errorf("verify %s: %v", path, err)
+	}
+	if !got.Equal(want) {
+		return &CorruptPathError{Path: path, Want: want, Got: got}
+	}
+	return nil
+}
+
+// Repair replaces the contents of the store object at path
+// by substituting it again or rebuilding it from its deriver.
+func (s *Store) Repair(ctx context.Context, path nix.StorePath) error {
+	_, err := s.nixStore(ctx, "--repair-path", "--", string(path))
+	return err
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/nix"
+)
+
+func TestNARHash(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("Hello, World!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	before, err := NARHash(nix.SHA256, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Type() != nix.SHA256 {
+		t.Errorf("NARHash(nix.SHA256, ...).Type() = %v; want %v", before.Type(), nix.SHA256)
+	}
+	again, err := NARHash(nix.SHA256, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(before) {
+		t.Errorf("NARHash(...) changed from %v to %v without modification", before, again)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("Hello, Warld!\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	after, err := NARHash(nix.SHA256, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Equal(before) {
+		t.Errorf("NARHash(...) = %v after modifying file; want different hash", after)
+	}
+}
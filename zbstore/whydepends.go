@@ -0,0 +1,152 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"zombiezen.com/go/nix"
+)
+
+// ShortestReferencePaths returns every shortest chain of references
+// that leads from one store path to another.
+// Each chain starts with from and ends with to.
+// references is called to obtain the direct references of a store path.
+// ShortestReferencePaths returns an empty list if to is not in from's closure.
+func ShortestReferencePaths(from, to nix.StorePath, references func(nix.StorePath) ([]nix.StorePath, error)) ([][]nix.StorePath, error) {
+	if from == to {
+		return [][]nix.StorePath{{from}}, nil
+	}
+
+	// Breadth-first search, recording every parent at the shortest distance.
+	parents := map[nix.StorePath][]nix.StorePath{from: nil}
+	frontier := []nix.StorePath{from}
+	for len(frontier) > 0 {
+		if _, found := parents[to]; found {
+			break
+		}
+		var next []nix.StorePath
+		levelParents := make(map[nix.StorePath][]nix.StorePath)
+		for _, p := range frontier {
+			refs, err := references(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, ref := range refs {
+				if _, visited := parents[ref]; visited {
+					continue
+				}
+				if _, queued := levelParents[ref]; !queued {
+					next = append(next, ref)
+				}
+				levelParents[ref] = append(levelParents[ref], p)
+			}
+		}
+		for p, pp := range levelParents {
+			parents[p] = pp
+		}
+		slices.Sort(next)
+		frontier = next
+	}
+	if _, found := parents[to]; !found {
+		return nil, nil
+	}
+
+	var chains [][]nix.StorePath
+	var walk func(suffix []nix.StorePath)
+	walk = func(suffix []nix.StorePath) {
+		head := suffix[0]
+		if head == from {
+			chains = append(chains, slices.Clone(suffix))
+			return
+		}
+		for _, parent := range parents[head] {
+			walk(append([]nix.StorePath{parent}, suffix...))
+		}
+	}
+	walk([]nix.StorePath{to})
+	slices.SortFunc(chains, func(c1, c2 []nix.StorePath) int {
+		return slices.Compare(c1, c2)
+	})
+	return chains, nil
+}
+
+// A ReferenceSite is a location inside a store object
+// that contains a reference to another store object.
+type ReferenceSite struct {
+	// Path is the slash-separated path of the file relative to the store object.
+	// Path is "." if the store object itself is a file or symlink.
+	Path string
+	// IsSymlink is true if the reference is in a symlink's target.
+	IsSymlink bool
+	// Context is the text surrounding the reference,
+	// with unprintable bytes replaced by periods.
+	Context string
+}
+
+// referenceContextSize is the number of bytes of context
+// on either side of a reference that FindReferences reports.
+const referenceContextSize = 32
+
+// FindReferences returns the files inside the store object at root
+// that mention the store path ref.
+// Only the first mention in each file is reported.
+func FindReferences(root string, ref nix.StorePath) ([]ReferenceSite, error) {
+	digest := []byte(ref.Digest())
+	var sites []ReferenceSite
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var data []byte
+		switch entry.Type() {
+		case 0:
+			data, err = os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			data = []byte(target)
+		default:
+			return nil
+		}
+		i := bytes.Index(data, digest)
+		if i < 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		start := max(i-referenceContextSize, 0)
+		end := min(i+len(digest)+referenceContextSize, len(data))
+		sites = append(sites, ReferenceSite{
+			Path:      filepath.ToSlash(rel),
+			IsSymlink: entry.Type() == fs.ModeSymlink,
+			Context:   printableString(data[start:end]),
+		})
+		return nil
+	})
+	return sites, err
+}
+
+func printableString(b []byte) string {
+	s := make([]byte, len(b))
+	for i, c := range b {
+		if ' ' <= c && c <= '~' {
+			s[i] = c
+		} else {
+			s[i] = '.'
+		}
+	}
+	return string(s)
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Ross Light
+// SPDX-License-Identifier: MIT
+
+package zbstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"zombiezen.com/go/nix"
+)
+
+func TestShortestReferencePaths(t *testing.T) {
+	const (
+		a nix.StorePath = "/nix/store/00000000000000000000000000000000-a"
+		b nix.StorePath = "/nix/store/11111111111111111111111111111111-b"
+		c nix.StorePath = "/nix/store/22222222222222222222222222222222-c"
+		d nix.StorePath = "/nix/store/33333333333333333333333333333333-d"
+		e nix.StorePath = "/nix/store/44444444444444444444444444444444-e"
+	)
+	graph := map[nix.StorePath][]nix.StorePath{
+		a: {a, b, c},
+		b: {d},
+		c: {d, e},
+		d: {e},
+	}
+	references := func(p nix.StorePath) ([]nix.StorePath, error) {
+		return graph[p], nil
+	}
+
+	tests := []struct {
+		from, to nix.StorePath
+		want     [][]nix.StorePath
+	}{
+		{from: a, to: a, want: [][]nix.StorePath{{a}}},
+		{from: a, to: b, want: [][]nix.StorePath{{a, b}}},
+		{from: a, to: d, want: [][]nix.StorePath{{a, b, d}, {a, c, d}}},
+		{from: a, to: e, want: [][]nix.StorePath{{a, c, e}}},
+		{from: d, to: a, want: nil},
+	}
+	for _, test := range tests {
+		got, err := ShortestReferencePaths(test.from, test.to, references)
+		if err != nil {
+			t.Errorf("ShortestReferencePaths(%s, %s, ...): %v", test.from.Name(), test.to.Name(), err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("ShortestReferencePaths(%s, %s, ...) (-want +got):\n%s", test.from.Name(), test.to.Name(), diff)
+		}
+	}
+}
+
+func TestFindReferences(t *testing.T) {
+	const ref nix.StorePath = "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello"
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "bin"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bin", "greet"), []byte("#!/bin/sh\nexec "+string(ref)+"/bin/hello\n"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "README"), []byte("nothing to see here\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(string(ref)+"/share", filepath.Join(root, "share")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := FindReferences(root, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReferenceSite{
+		{
+			Path:    "bin/greet",
+			Context: "#!/bin/sh.exec /nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello/bin/hello.",
+		},
+		{
+			Path:      "share",
+			IsSymlink: true,
+			Context:   "/nix/store/1rz4g4znpzjwh1xymhjpm42vipw92pr7-hello/share",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FindReferences(...) (-want +got):\n%s", diff)
+	}
+}